@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var accountTypes = []string{"checking", "savings", "credit-card", "cash", "upi-wallet"}
+
+var errUnknownAccount = errors.New("accountId does not match an account")
+
+// Account is where money is held or spent from: a bank account, card, cash
+// or wallet. Expenses and income name the account they went through, and
+// the balance is worked out from them.
+type Account struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"` // checking, savings, credit-card, cash or upi-wallet
+	Institution string `json:"institution,omitempty"`
+	Currency    string `json:"currency"`
+	// OpeningBalance is the balance before the first linked transaction;
+	// negative for a card with an outstanding amount
+	OpeningBalance Money  `json:"openingBalance"`
+	Owner          string `json:"owner,omitempty"` // member, empty for joint accounts
+	Archived       bool   `json:"archived,omitempty"`
+	CreatedAt      string `json:"createdAt"`
+	UpdatedAt      string `json:"updatedAt"`
+
+	Balance *Money `json:"balance,omitempty"` // computed in listings
+}
+
+func (a *Account) validate(settings Settings) error {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := oneOf("type", a.Type, accountTypes); err != nil {
+		return err
+	}
+	var err error
+	if a.Currency, err = normalizeCurrency(a.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	a.OpeningBalance = roundForCurrency(a.OpeningBalance, a.Currency)
+	return nil
+}
+
+// checkAccount reports errUnknownAccount for an accountId naming no account
+func checkAccount(tx *bolt.Tx, id string) error {
+	if id == "" || tx.Bucket([]byte(accountsBucket)).Get([]byte(id)) != nil {
+		return nil
+	}
+	return errUnknownAccount
+}
+
+// AccountBalance is an account's balance worked out from its transactions,
+// in the account's currency
+type AccountBalance struct {
+	AccountID             string   `json:"accountId"`
+	Currency              string   `json:"currency"`
+	AsOf                  string   `json:"asOf"`
+	OpeningBalance        Money    `json:"openingBalance"`
+	Income                Money    `json:"income"`
+	Expenses              Money    `json:"expenses"`
+	Balance               Money    `json:"balance"`
+	Transactions          int      `json:"transactions"`
+	UnconvertedCurrencies []string `json:"unconvertedCurrencies"`
+}
+
+// accountBalances works out the balance of every account as of a date.
+// Transactions in other currencies are converted; ones without a rate are
+// left out and listed.
+func accountBalances(tx *bolt.Tx, settings Settings, asOf string) (map[string]*AccountBalance, error) {
+	balances := map[string]*AccountBalance{}
+	convs := map[string]*converter{}
+	err := tx.Bucket([]byte(accountsBucket)).ForEach(func(k, v []byte) error {
+		var a Account
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		balances[a.ID] = &AccountBalance{AccountID: a.ID, Currency: a.Currency, AsOf: asOf, OpeningBalance: a.OpeningBalance}
+		convs[a.ID] = newConverter(settings, a.Currency)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	count := func(accountID, date string, amount Money, currency string, total func(*AccountBalance) *Money) {
+		b, ok := balances[accountID]
+		if !ok || date > asOf {
+			return
+		}
+		if convs[accountID].add(total(b), amount, currency) {
+			b.Transactions++
+		}
+	}
+	err = tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+		var e Expense
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		count(e.AccountID, e.Date, e.Amount, e.Currency, func(b *AccountBalance) *Money { return &b.Expenses })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Bucket([]byte(incomeBucket)).ForEach(func(k, v []byte) error {
+		var i Income
+		if err := json.Unmarshal(v, &i); err != nil {
+			return err
+		}
+		count(i.AccountID, i.Date, i.Amount, i.Currency, func(b *AccountBalance) *Money { return &b.Income })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for id, b := range balances {
+		b.Balance = b.OpeningBalance + b.Income - b.Expenses
+		b.UnconvertedCurrencies = convs[id].unconverted()
+	}
+	return balances, nil
+}
+
+func (a Account) visibleTo(user string) bool { return ownedBy(a.Owner, user) }
+
+// ACCOUNTS
+
+// getAccounts lists accounts by name with their current balances. Archived
+// accounts are left out unless ?includeArchived=true.
+func getAccounts(w http.ResponseWriter, r *http.Request) {
+	archived := includeArchived(r)
+	user := authUser(r)
+	settings := currentSettings()
+	accounts := []Account{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		balances, err := accountBalances(tx, settings, today(settings.location(user)))
+		if err != nil {
+			return err
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(accountsBucket)), func(k, v []byte) error {
+			var a Account
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if (a.Archived && !archived) || !a.visibleTo(user) {
+				return nil
+			}
+			a.Balance = &balances[a.ID].Balance
+			accounts = append(accounts, a)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	respondJSON(w, http.StatusOK, accounts)
+}
+
+// saveAccount stores a created or edited account
+func saveAccount(w http.ResponseWriter, r *http.Request, a Account, status int) {
+	if err := a.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.Balance = nil
+	a.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(accountsBucket))
+		if v := b.Get([]byte(a.ID)); v != nil {
+			var old Account
+			json.Unmarshal(v, &old)
+			if !old.visibleTo(authUser(r)) {
+				return errNotFound
+			}
+			a.CreatedAt, a.Owner = old.CreatedAt, old.Owner
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(a.ID), data)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "account not found")
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, status, a)
+	}
+}
+
+func createAccount(w http.ResponseWriter, r *http.Request) {
+	var a Account
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if a.ID == "" {
+		a.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	if user := authUser(r); user != "" {
+		a.Owner = user
+	}
+	a.CreatedAt = now.Format(time.RFC3339)
+	saveAccount(w, r, a, http.StatusCreated)
+}
+
+func updateAccount(w http.ResponseWriter, r *http.Request) {
+	var a Account
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.ID = mux.Vars(r)["id"]
+	saveAccount(w, r, a, http.StatusOK)
+}
+
+// deleteAccount removes an account. Its transactions stay, unlinked.
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(accountsBucket))
+		if !reachable(b, id, authUser(r), Account.visibleTo) {
+			return errNotFound
+		}
+		j.track(accountsBucket, []byte(id))
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := unlinkAccount(tx, j, expensesBucket, id, func(e *Expense) *string { return &e.AccountID }); err != nil {
+			return err
+		}
+		return unlinkAccount(tx, j, incomeBucket, id, func(i *Income) *string { return &i.AccountID })
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Account deleted"})
+}
+
+// unlinkAccount clears the account of the records in bucket that name it
+func unlinkAccount[T any](tx *bolt.Tx, j *undoJournal, bucket, id string, field func(*T) *string) error {
+	b := tx.Bucket([]byte(bucket))
+	updates := map[string][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		var record T
+		if json.Unmarshal(v, &record) != nil || *field(&record) != id {
+			return nil
+		}
+		*field(&record) = ""
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		updates[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, data := range updates {
+		j.track(bucket, []byte(k))
+		if err := b.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAccountBalance returns an account's balance from its opening balance
+// and linked transactions, as of ?asOf= (default today)
+func getAccountBalance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	settings := currentSettings()
+	loc := settings.location(authUser(r))
+	asOf, err := normalizeDate(r.URL.Query().Get("asOf"), loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if asOf == "" {
+		asOf = today(loc)
+	}
+	var balance *AccountBalance
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(accountsBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var a Account
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		if !a.visibleTo(authUser(r)) {
+			return errNotFound
+		}
+		balances, err := accountBalances(tx, settings, asOf)
+		balance = balances[id]
+		return err
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, balance)
+}
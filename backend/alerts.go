@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// alertTask is the queue task type that delivers an alert
+const alertTask = "alert"
+
+// Alert is something the system wants the household to know about, such as
+// an overdue bill. Its ID identifies the occurrence, so the same bill being
+// overdue for the same due date is only ever alerted once.
+type Alert struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`    // e.g. "bill.overdue"
+	Subject string `json:"subject"` // ID of the record the alert is about
+	Message string `json:"message"`
+	// Key and Args render Message in other languages, see catalogs
+	Key  string   `json:"key,omitempty"`
+	Args []string `json:"args,omitempty"`
+	// Recipients limits external delivery to these members; empty means
+	// everyone with notification preferences
+	Recipients []string `json:"recipients,omitempty"`
+	// Link is the client path to what the alert is about, when it has one
+	Link      string `json:"link,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	ReadAt    string `json:"readAt,omitempty"` // set once read in the notifications center
+}
+
+// newAlert builds an alert whose message comes from the catalogs. Message
+// is stored in English.
+func newAlert(id, alertType, subject, key string, args ...string) Alert {
+	return Alert{
+		ID:      id,
+		Type:    alertType,
+		Subject: subject,
+		Message: translate(defaultLanguage, key, args...),
+		Key:     key,
+		Args:    args,
+	}
+}
+
+// localized returns the alert with its message in lang
+func (a Alert) localized(lang string) Alert {
+	if a.Key != "" {
+		a.Message = translate(lang, a.Key, a.Args...)
+	}
+	return a
+}
+
+// addressedTo reports whether a member should receive the alert
+func (a Alert) addressedTo(user string) bool {
+	if len(a.Recipients) == 0 {
+		return true
+	}
+	for _, r := range a.Recipients {
+		if r == user {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleTo reports whether the caller may see the alert: one addressed to
+// them, or any alert when nobody is signed in
+func (a Alert) visibleTo(user string) bool {
+	return user == "" || a.addressedTo(user)
+}
+
+// emitAlert records an alert and queues its delivery. It reports false when
+// an alert with the same ID was already emitted.
+func emitAlert(alert Alert) (bool, error) {
+	alert.CreatedAt = time.Now().Format(time.RFC3339)
+	created := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(alertsBucket))
+		if b.Get([]byte(alert.ID)) != nil {
+			return nil
+		}
+		data, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		created = true
+		return b.Put([]byte(alert.ID), data)
+	})
+	if err != nil || !created {
+		return false, err
+	}
+	publishWebhook(alert.Type, alert)
+	if _, err := enqueueTask(alertTask, alert); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// deliverAlert is the queue handler for alerts. Every alert is logged, then
+// routed to members by their notification preferences.
+func deliverAlert(payload json.RawMessage) error {
+	var alert Alert
+	if err := json.Unmarshal(payload, &alert); err != nil {
+		return err
+	}
+	logger("notifications").Warn(alert.Message, "type", alert.Type, "subject", alert.Subject, "alert", alert.ID)
+	return routeAlert(alert)
+}
+
+// ALERTS
+
+// getAlerts lists the caller's alerts newest first, muted ones included. ?type= narrows
+// them to one type, or to a family when it ends in "." as in "expense.";
+// ?subject= to the alerts about one record; ?limit caps the list (default
+// 100).
+func getAlerts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+	alertType, subject := q.Get("type"), q.Get("subject")
+	user := authUser(r)
+	alerts := []Alert{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(alertsBucket)), func(k, v []byte) error {
+			var a Alert
+			if json.Unmarshal(v, &a) != nil {
+				return nil
+			}
+			if alertType != "" && a.Type != alertType && !(strings.HasSuffix(alertType, ".") && strings.HasPrefix(a.Type, alertType)) {
+				return nil
+			}
+			if subject != "" && a.Subject != subject || !a.visibleTo(user) {
+				return nil
+			}
+			alerts = append(alerts, a)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].CreatedAt > alerts[j].CreatedAt })
+	if len(alerts) > limit {
+		alerts = alerts[:limit]
+	}
+	lang := requestLanguage(r)
+	for i := range alerts {
+		alerts[i] = alerts[i].localized(lang)
+	}
+	respondJSON(w, http.StatusOK, alerts)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var allowanceFrequencies = []string{"weekly", "biweekly", "monthly"}
+
+// AllowanceRule credits a child's allowance on a schedule
+type AllowanceRule struct {
+	ID        string `json:"id"`
+	Child     string `json:"child"`  // user name the child records expenses under
+	Parent    string `json:"parent"` // member told when the balance runs low
+	Amount    Money  `json:"amount"`
+	Currency  string `json:"currency"`
+	Frequency string `json:"frequency"` // weekly, biweekly or monthly
+	StartDate string `json:"startDate"`
+	// NextDate is the next credit; it moves on as credits are made
+	NextDate string `json:"nextDate"`
+	// LowBalance alerts the parent once the balance drops below it
+	LowBalance Money  `json:"lowBalance"`
+	Paused     bool   `json:"paused"` // stops credits until resumed
+	CreatedAt  string `json:"createdAt"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+// AllowanceCredit is one allowance payment. Credits are money moving
+// inside the household, so they are not income.
+type AllowanceCredit struct {
+	ID       string `json:"id"`
+	RuleID   string `json:"ruleId"`
+	Child    string `json:"child"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency"`
+	Date     string `json:"date"`
+}
+
+// AllowanceBalance is what a child has left of their allowance: credits
+// less the expenses they recorded since the first credit
+type AllowanceBalance struct {
+	RuleID   string            `json:"ruleId"`
+	Child    string            `json:"child"`
+	Currency string            `json:"currency"`
+	Credited Money             `json:"credited"`
+	Spent    Money             `json:"spent"`
+	Balance  Money             `json:"balance"`
+	Low      bool              `json:"low"`
+	Credits  []AllowanceCredit `json:"credits"`
+}
+
+func (a *AllowanceRule) validate(settings Settings) error {
+	a.Child = strings.TrimSpace(a.Child)
+	if a.Child == "" {
+		return fmt.Errorf("child is required")
+	}
+	if a.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if err := oneOf("frequency", a.Frequency, allowanceFrequencies); err != nil {
+		return err
+	}
+	var err error
+	if a.Currency, err = normalizeCurrency(a.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	a.Amount = roundForCurrency(a.Amount, a.Currency)
+	loc := settings.location(a.Child)
+	if a.StartDate, err = normalizeDate(a.StartDate, loc); err != nil {
+		return err
+	}
+	if a.StartDate == "" {
+		a.StartDate = today(loc)
+	}
+	return nil
+}
+
+// next returns the credit date after date
+func (a AllowanceRule) next(date string) string {
+	t, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return ""
+	}
+	switch a.Frequency {
+	case "weekly":
+		t = t.AddDate(0, 0, 7)
+	case "biweekly":
+		t = t.AddDate(0, 0, 14)
+	default:
+		// Keep the start date's day of month, clamped in short months
+		start, _ := time.Parse(dateLayout, a.StartDate)
+		months := (t.Year()-start.Year())*12 + int(t.Month()-start.Month()) + 1
+		t = addMonthsClamped(start, months)
+	}
+	return t.Format(dateLayout)
+}
+
+// allowanceBalance works out a rule's balance from its credits and the
+// child's expenses
+func allowanceBalance(tx *bolt.Tx, rule AllowanceRule) AllowanceBalance {
+	bal := AllowanceBalance{RuleID: rule.ID, Child: rule.Child, Currency: rule.Currency, Credits: []AllowanceCredit{}}
+	first := ""
+	tx.Bucket([]byte(allowanceCreditsBucket)).ForEach(func(k, v []byte) error {
+		var c AllowanceCredit
+		if json.Unmarshal(v, &c) == nil && c.RuleID == rule.ID {
+			bal.Credits = append(bal.Credits, c)
+			bal.Credited += c.Amount
+			if first == "" || c.Date < first {
+				first = c.Date
+			}
+		}
+		return nil
+	})
+	if first != "" {
+		conv := newConverter(loadSettings(tx), rule.Currency)
+		tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) == nil && e.User == rule.Child && e.Date >= first {
+				conv.add(&bal.Spent, e.Amount, e.Currency)
+			}
+			return nil
+		})
+	}
+	bal.Balance = bal.Credited - bal.Spent
+	bal.Low = rule.LowBalance > 0 && bal.Balance < rule.LowBalance
+	return bal
+}
+
+// creditAllowances makes every credit that has fallen due, then alerts
+// parents of children whose balance is low. A low balance is alerted once
+// per allowance period.
+func creditAllowances() error {
+	type low struct {
+		rule AllowanceRule
+		bal  AllowanceBalance
+	}
+	var lows []low
+	err := db.Update(func(tx *bolt.Tx) error {
+		rules := tx.Bucket([]byte(allowancesBucket))
+		credits := tx.Bucket([]byte(allowanceCreditsBucket))
+		settings := loadSettings(tx)
+		var updated []AllowanceRule
+		err := rules.ForEach(func(k, v []byte) error {
+			var rule AllowanceRule
+			if json.Unmarshal(v, &rule) != nil || rule.Paused {
+				return nil
+			}
+			now := today(settings.location(rule.Child))
+			credited := false
+			for rule.NextDate != "" && rule.NextDate <= now {
+				seq, _ := credits.NextSequence()
+				c := AllowanceCredit{
+					ID:       fmt.Sprintf("%s-%s-%d", rule.ID, rule.NextDate, seq),
+					RuleID:   rule.ID,
+					Child:    rule.Child,
+					Amount:   rule.Amount,
+					Currency: rule.Currency,
+					Date:     rule.NextDate,
+				}
+				data, err := json.Marshal(c)
+				if err != nil {
+					return err
+				}
+				if err := credits.Put([]byte(c.ID), data); err != nil {
+					return err
+				}
+				rule.NextDate = rule.next(rule.NextDate)
+				credited = true
+			}
+			if credited {
+				updated = append(updated, rule)
+			}
+			if bal := allowanceBalance(tx, rule); bal.Low {
+				lows = append(lows, low{rule, bal})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, rule := range updated {
+			data, err := json.Marshal(rule)
+			if err != nil {
+				return err
+			}
+			if err := rules.Put([]byte(rule.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, l := range lows {
+		alert := newAlert(fmt.Sprintf("allowance.low:%s:%s", l.rule.ID, l.rule.NextDate), "allowance.low", l.rule.ID,
+			"alert.allowance.low", l.rule.Child, formatMoney(l.bal.Balance, l.rule.Currency))
+		if l.rule.Parent != "" {
+			alert.Recipients = []string{l.rule.Parent}
+		}
+		if _, err := emitAlert(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ALLOWANCES
+
+func getAllowances(w http.ResponseWriter, r *http.Request) {
+	rules := []AllowanceRule{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(allowancesBucket)), func(k, v []byte) error {
+			var rule AllowanceRule
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, rules)
+}
+
+// saveAllowance stores a created or edited rule. Moving the start date
+// restarts the schedule from it.
+func saveAllowance(w http.ResponseWriter, r *http.Request, rule AllowanceRule, status int) {
+	if err := rule.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rule.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(allowancesBucket))
+		if v := b.Get([]byte(rule.ID)); v != nil {
+			var old AllowanceRule
+			json.Unmarshal(v, &old)
+			rule.CreatedAt = old.CreatedAt
+			rule.NextDate = old.NextDate
+			if old.StartDate != rule.StartDate || old.Frequency != rule.Frequency {
+				rule.NextDate = ""
+			}
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		if rule.NextDate == "" {
+			rule.NextDate = rule.StartDate
+		}
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(rule.ID), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "allowance not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, status, rule)
+}
+
+func createAllowance(w http.ResponseWriter, r *http.Request) {
+	var rule AllowanceRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	rule.CreatedAt = now.Format(time.RFC3339)
+	rule.NextDate = ""
+	saveAllowance(w, r, rule, http.StatusCreated)
+}
+
+func updateAllowance(w http.ResponseWriter, r *http.Request) {
+	var rule AllowanceRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rule.ID = mux.Vars(r)["id"]
+	saveAllowance(w, r, rule, http.StatusOK)
+}
+
+// deleteAllowance removes a rule; its past credits stay on record
+func deleteAllowance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(allowancesBucket, []byte(id))
+		return tx.Bucket([]byte(allowancesBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Allowance deleted"})
+}
+
+func getAllowanceBalance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var bal AllowanceBalance
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(allowancesBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var rule AllowanceRule
+		if err := json.Unmarshal(v, &rule); err != nil {
+			return err
+		}
+		bal = allowanceBalance(tx, rule)
+		return nil
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "allowance not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, bal)
+}
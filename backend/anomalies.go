@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// anomalyLookback is how recently an expense must have been recorded
+	// to be checked; older ones were checked by earlier runs
+	anomalyLookback = 24 * time.Hour
+	// anomalyHistoryDays is the span a category's average is taken over,
+	// and anomalyMinSamples how many expenses it needs to mean anything
+	anomalyHistoryDays = 90
+	anomalyMinSamples  = 3
+	// duplicateChargeDays is how far apart two identical charges may be
+	// dated and still look like one charged twice
+	duplicateChargeDays = 1
+)
+
+// chargeKey identifies who was paid for duplicate checks: the merchant, or
+// the description when there is none
+func chargeKey(e Expense) string {
+	if key := merchantKey(e.Merchant); key != "" {
+		return key
+	}
+	return strings.ToLower(strings.TrimSpace(e.Description))
+}
+
+// before orders expenses by when they were recorded
+func (e Expense) before(o Expense) bool {
+	if e.CreatedAt != o.CreatedAt {
+		return e.CreatedAt < o.CreatedAt
+	}
+	return e.ID < o.ID
+}
+
+// daysApart is how many days separate two dates
+func daysApart(a, b string) int {
+	ta, err1 := time.Parse(dateLayout, a)
+	tb, err2 := time.Parse(dateLayout, b)
+	if err1 != nil || err2 != nil {
+		return -1
+	}
+	days := int(ta.Sub(tb).Hours() / 24)
+	if days < 0 {
+		days = -days
+	}
+	return days
+}
+
+// expenseAnomalies lists the alerts an expense deserves against the rest:
+// costing AnomalyFactor times its category's recent average, a large first
+// payment to a merchant, or repeating a charge recorded just before it.
+// Only expenses its member can see are compared against.
+func expenseAnomalies(e Expense, all []Expense, conv *converter, c *Config) []Alert {
+	var amount Money
+	if !conv.add(&amount, e.Amount, e.Currency) {
+		return nil
+	}
+	currency := currentSettings().BaseCurrency
+	name := purchaseName(e)
+	var alerts []Alert
+
+	start := ""
+	if t, err := time.Parse(dateLayout, e.Date); err == nil {
+		start = t.AddDate(0, 0, -anomalyHistoryDays).Format(dateLayout)
+	}
+	var total Money
+	samples := 0
+	firstAtMerchant := merchantKey(e.Merchant) != ""
+	var repeats *Expense
+	for i, o := range all {
+		if o.ID == e.ID || !o.visibleTo(e.User) {
+			continue
+		}
+		if o.Category == e.Category && o.Date >= start && o.Date <= e.Date && conv.add(&total, o.Amount, o.Currency) {
+			samples++
+		}
+		if firstAtMerchant && merchantKey(o.Merchant) == merchantKey(e.Merchant) &&
+			(o.Date < e.Date || (o.Date == e.Date && o.before(e))) {
+			firstAtMerchant = false
+		}
+		if repeats == nil && o.User == e.User && o.Amount == e.Amount && o.Currency == e.Currency &&
+			chargeKey(o) == chargeKey(e) && o.before(e) {
+			if days := daysApart(o.Date, e.Date); days >= 0 && days <= duplicateChargeDays {
+				repeats = &all[i]
+			}
+		}
+	}
+
+	if samples >= anomalyMinSamples && total > 0 {
+		average := total / Money(samples)
+		if ratio := amount.Float64() / average.Float64(); ratio > c.AnomalyFactor {
+			alerts = append(alerts, newAlert("expense.unusual:"+e.ID, "expense.unusual", e.ID, "alert.expense.unusual",
+				name, formatMoney(e.Amount, e.Currency), fmt.Sprintf("%.1f", ratio), formatMoney(average, currency), e.Category))
+		}
+	}
+	if firstAtMerchant && c.AnomalyNewMerchantAmount > 0 && amount >= Money(c.AnomalyNewMerchantAmount)*majorUnit {
+		alerts = append(alerts, newAlert("expense.newMerchant:"+e.ID, "expense.newMerchant", e.ID, "alert.expense.newMerchant",
+			e.Merchant, formatMoney(e.Amount, e.Currency)))
+	}
+	if repeats != nil {
+		alerts = append(alerts, newAlert("expense.duplicate:"+e.ID, "expense.duplicate", e.ID, "alert.expense.duplicate",
+			name, formatMoney(e.Amount, e.Currency), repeats.Date))
+	}
+	for i := range alerts {
+		alerts[i].Link = expenseLink(e.ID)
+		if e.User != "" {
+			alerts[i].Recipients = []string{e.User}
+		}
+	}
+	return alerts
+}
+
+// detectAnomalies checks expenses recorded since the last runs for unusual
+// amounts, new merchants and duplicate charges. Each finding is alerted
+// once.
+func detectAnomalies() error {
+	since := time.Now().Add(-anomalyLookback).Format(time.RFC3339)
+	var all []Expense
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) == nil {
+				all = append(all, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	c := config()
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	for _, e := range all {
+		if e.CreatedAt < since {
+			continue
+		}
+		for _, alert := range expenseAnomalies(e, all, conv, c) {
+			if _, err := emitAlert(alert); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// uploadGrace is how long an uploaded file may sit unlinked, waiting for
+// the expense it was uploaded for to be saved, before it is collected
+const uploadGrace = time.Hour
+
+// Attachment is a file attached to an expense, such as a receipt. Files
+// are kept with the uploads and served under /uploads/.
+type Attachment struct {
+	ID          string `json:"id"`
+	ExpenseID   string `json:"expenseId"`
+	File        string `json:"file"`     // stored name
+	FileName    string `json:"fileName"` // name it was uploaded with
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	UploadedBy  string `json:"uploadedBy"`
+	CreatedAt   string `json:"createdAt"`
+
+	URL string `json:"url,omitempty"` // computed in responses
+}
+
+// expenseAttachments lists the attachments of an expense, oldest first
+func expenseAttachments(tx *bolt.Tx, expenseID string) []Attachment {
+	var attachments []Attachment
+	tx.Bucket([]byte(attachmentsBucket)).ForEach(func(k, v []byte) error {
+		var a Attachment
+		if json.Unmarshal(v, &a) == nil && a.ExpenseID == expenseID {
+			attachments = append(attachments, a)
+		}
+		return nil
+	})
+	sort.Slice(attachments, func(i, j int) bool {
+		if attachments[i].CreatedAt != attachments[j].CreatedAt {
+			return attachments[i].CreatedAt < attachments[j].CreatedAt
+		}
+		return attachments[i].ID < attachments[j].ID
+	})
+	return attachments
+}
+
+// setHasAttachments keeps an expense's attachment flag in step with its
+// attachments and the file URLs it lists itself
+func setHasAttachments(tx *bolt.Tx, expenseID string) error {
+	v := tx.Bucket([]byte(expensesBucket)).Get([]byte(expenseID))
+	if v == nil {
+		return nil
+	}
+	var e Expense
+	if err := json.Unmarshal(v, &e); err != nil {
+		return err
+	}
+	e.HasAttachments = len(e.Attachments) > 0 || len(expenseAttachments(tx, expenseID)) > 0
+	return putExpense(tx, e)
+}
+
+// deleteAttachments removes an expense's attachments along with it. Their
+// files stay until collectAttachmentFiles finds them unused, so the
+// deletion can be undone.
+func deleteAttachments(tx *bolt.Tx, j *undoJournal, expenseID string) error {
+	b := tx.Bucket([]byte(attachmentsBucket))
+	for _, a := range expenseAttachments(tx, expenseID) {
+		j.track(attachmentsBucket, []byte(a.ID))
+		if err := b.Delete([]byte(a.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usedUploads names the upload files something may still need: those of
+// attachments, those expenses link to themselves, member avatars and
+// merchant logos uploaded here, and those of records an undo could bring
+// back
+func usedUploads(tx *bolt.Tx, now time.Time) map[string]bool {
+	used := map[string]bool{}
+	link := func(url string) {
+		if i := strings.Index(url, "/uploads/"); i >= 0 {
+			used[path.Base(url[i:])] = true
+		}
+	}
+	record := func(bucket string, v []byte) {
+		switch bucket {
+		case attachmentsBucket:
+			var a Attachment
+			if json.Unmarshal(v, &a) == nil {
+				used[a.File] = true
+			}
+		case expensesBucket:
+			var e Expense
+			if json.Unmarshal(v, &e) == nil {
+				for _, url := range e.Attachments {
+					used[path.Base(url)] = true
+				}
+			}
+		case membersBucket:
+			var m Member
+			if json.Unmarshal(v, &m) == nil {
+				link(m.Avatar)
+			}
+		case merchantsBucket:
+			var m Merchant
+			if json.Unmarshal(v, &m) == nil {
+				link(m.LogoURL)
+			}
+		}
+	}
+	for _, bucket := range []string{attachmentsBucket, expensesBucket, membersBucket, merchantsBucket} {
+		tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			record(bucket, v)
+			return nil
+		})
+	}
+	tx.Bucket([]byte(undoBucket)).ForEach(func(k, v []byte) error {
+		var action UndoAction
+		if json.Unmarshal(v, &action) != nil || action.expired(now) {
+			return nil
+		}
+		for _, c := range action.Changes {
+			record(c.Bucket, c.Before)
+			record(c.Bucket, c.After)
+		}
+		return nil
+	})
+	return used
+}
+
+// collectAttachmentFiles deletes upload files nothing needs any more: those
+// of deleted expenses and attachments once they can no longer be undone,
+// and uploads never linked to an expense
+func collectAttachmentFiles(dir string, now time.Time) (int, error) {
+	var used map[string]bool
+	err := db.View(func(tx *bolt.Tx) error {
+		used = usedUploads(tx, now)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || used[name] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < uploadGrace {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// collectUploads is the scheduled sweep of the uploads directory
+func collectUploads() error {
+	removed, err := collectAttachmentFiles(uploadsDir, time.Now())
+	if removed > 0 {
+		logger("store").Info("unused uploads removed", "files", removed)
+	}
+	return err
+}
+
+// ATTACHMENTS
+
+// getExpenseAttachments lists an expense's attachments oldest first
+func getExpenseAttachments(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var attachments []Attachment
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(expensesBucket))
+		if b.Get([]byte(id)) == nil || !reachable(b, id, authUser(r), Expense.visibleTo) {
+			return errNotFound
+		}
+		attachments = expenseAttachments(tx, id)
+		return nil
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if attachments == nil {
+		attachments = []Attachment{}
+	}
+	for i := range attachments {
+		attachments[i].URL = publicURL(r, "/uploads/"+attachments[i].File)
+	}
+	respondJSON(w, http.StatusOK, attachments)
+}
+
+// createExpenseAttachment stores the multipart "file" as an attachment of
+// the expense
+func createExpenseAttachment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	file, header, err := saveUpload(r, uploadsDir)
+	if err == errNoUpload {
+		respondError(w, http.StatusBadRequest, "Error retrieving file")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Error saving file")
+		return
+	}
+	now := time.Now()
+	a := Attachment{
+		ID:          fmt.Sprintf("%d", now.UnixNano()),
+		ExpenseID:   id,
+		File:        file,
+		FileName:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		UploadedBy:  requestActor(r),
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(expensesBucket))
+		if b.Get([]byte(id)) == nil || !reachable(b, id, authUser(r), Expense.visibleTo) {
+			return errNotFound
+		}
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(attachmentsBucket)).Put([]byte(a.ID), data); err != nil {
+			return err
+		}
+		return setHasAttachments(tx, id)
+	})
+	if err != nil {
+		os.Remove(filepath.Join(uploadsDir, file))
+	}
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.URL = publicURL(r, "/uploads/"+a.File)
+	respondJSON(w, http.StatusCreated, a)
+}
+
+// deleteAttachment detaches a file from its expense. The file is removed
+// by the next sweep once the deletion can no longer be undone.
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(attachmentsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var a Attachment
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		if !reachable(tx.Bucket([]byte(expensesBucket)), a.ExpenseID, authUser(r), Expense.visibleTo) {
+			return errNotFound
+		}
+		j.track(attachmentsBucket, []byte(id))
+		j.track(expensesBucket, []byte(a.ExpenseID))
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return setHasAttachments(tx, a.ExpenseID)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Attachment deleted"})
+}
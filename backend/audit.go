@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time          string `json:"time"`
+	Actor         string `json:"actor"`
+	IP            string `json:"ip"`
+	ForwardedFor  string `json:"forwardedFor,omitempty"`
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Status        int    `json:"status"`
+	PayloadSHA256 string `json:"payloadSha256"`
+	PayloadBytes  int    `json:"payloadBytes"`
+	DurationMs    int64  `json:"durationMs"`
+}
+
+// auditLog is an append-only JSON-lines file that rotates when it grows past
+// the size limit or the day changes.
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened string // date the current file was started, "2006-01-02"
+}
+
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	a.opened = info.ModTime().Format("2006-01-02")
+	if a.size == 0 {
+		a.opened = time.Now().Format("2006-01-02")
+	}
+	return nil
+}
+
+func (a *auditLog) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	today := time.Now().Format("2006-01-02")
+	maxSize := int64(config().AuditMaxSizeMB) << 20
+	if a.size > 0 && (a.opened != today || (maxSize > 0 && a.size+int64(len(line)) > maxSize)) {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate renames the current file with a timestamp suffix, starts a new one
+// and prunes rotated files past the configured age.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", a.path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(a.path, rotated); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	if config().AuditMaxAgeDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -config().AuditMaxAgeDays)
+		matches, _ := filepath.Glob(a.path + ".*")
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.ModTime().Before(cutoff) {
+				os.Remove(m)
+			}
+		}
+	}
+	return nil
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Hijack hands the connection over for WebSockets
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// requestActor identifies who made a request: the member signed in with a
+// token, or "anonymous". Headers naming a user are not trusted; anyone can
+// send them.
+func requestActor(r *http.Request) string {
+	if user := authUser(r); user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+// clientIP returns the host part of the connection's remote address
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditMiddleware records every mutating request in the audit log
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil || !isWriteMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "error reading request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry := AuditEntry{
+			Time:          started.Format(time.RFC3339Nano),
+			Actor:         requestActor(r),
+			IP:            clientIP(r),
+			ForwardedFor:  strings.TrimSpace(r.Header.Get("X-Forwarded-For")),
+			Method:        r.Method,
+			Path:          r.URL.RequestURI(),
+			Status:        rec.status,
+			PayloadSHA256: hex.EncodeToString(sum[:]),
+			PayloadBytes:  len(body),
+			DurationMs:    time.Since(started).Milliseconds(),
+		}
+		if err := audit.write(entry); err != nil {
+			logger("http").Error("audit log write failed", "err", err)
+		}
+	})
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// authSecretKey is where earlier releases kept the generated token signing
+// key, in the settings bucket
+const authSecretKey = "auth-secret"
+
+// passwordIterations is the PBKDF2-HMAC-SHA256 work factor for new
+// password hashes
+const passwordIterations = 600000
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{1,31}$`)
+
+	errBadToken    = errors.New("invalid or expired token")
+	errUserExists  = errors.New("username is taken")
+	errBadPassword = errors.New("invalid username or password")
+)
+
+// User is a household member's account. Username is the name recorded on
+// the member's expenses and income.
+type User struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Name         string `json:"name,omitempty"`
+	Role         string `json:"role"` // adult or child
+	PasswordHash string `json:"passwordHash,omitempty"`
+	CreatedAt    string `json:"createdAt"`
+}
+
+// userKey is a user's key in the users bucket; usernames are unique
+// regardless of case
+func userKey(username string) []byte {
+	return []byte(strings.ToLower(username))
+}
+
+// pbkdf2SHA256 derives a key from a password as in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	size := prf.Size()
+	var key []byte
+	u := make([]byte, size)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		key = prf.Sum(key)
+		t := key[len(key)-size:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:keyLen]
+}
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<key>", salt and
+// key hex-encoded
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%x$%x", passwordIterations, salt, key), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err1 := hex.DecodeString(parts[2])
+	want, err2 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// authSecretPath is where the generated signing key is kept: a file beside
+// the database rather than in it, so snapshots, exports and backups never
+// carry it
+func authSecretPath() string {
+	return config().DBPath + ".jwt-secret"
+}
+
+// authSecretCache holds the generated key once read, keyed by its path
+var authSecretCache struct {
+	sync.Mutex
+	path   string
+	secret []byte
+}
+
+// authSecret is the key tokens are signed with: JWT_SECRET, or else one
+// generated for the database on first use
+func authSecret() ([]byte, error) {
+	if secret := config().JWTSecret; secret != "" {
+		return []byte(secret), nil
+	}
+	path := authSecretPath()
+	authSecretCache.Lock()
+	defer authSecretCache.Unlock()
+	if authSecretCache.path == path {
+		return authSecretCache.secret, nil
+	}
+	secret, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		err = writeAuthSecret(path, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	authSecretCache.path, authSecretCache.secret = path, secret
+	return secret, nil
+}
+
+// writeAuthSecret creates the key file readable only by the server
+func writeAuthSecret(path string, secret []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(secret); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// moveAuthSecret takes a signing key generated by earlier releases out of
+// the settings bucket and into its file, so tokens already issued stay valid
+func moveAuthSecret(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(settingsBucket))
+	v := b.Get([]byte(authSecretKey))
+	if v == nil {
+		return 0, nil
+	}
+	if err := writeAuthSecret(authSecretPath(), v); err != nil && !errors.Is(err, fs.ErrExist) {
+		return 0, err
+	}
+	return 1, b.Delete([]byte(authSecretKey))
+}
+
+// tokenClaims are the JWT claims the API issues and accepts
+type tokenClaims struct {
+	Subject   string `json:"sub"` // username
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signToken issues an HS256 JWT for the user
+func signToken(u User, now time.Time) (string, time.Time, error) {
+	secret, err := authSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := now.Add(time.Duration(config().TokenTTLHours) * time.Hour)
+	claims, err := json.Marshal(tokenClaims{Subject: u.Username, Role: u.Role, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), expires, nil
+}
+
+// parseToken verifies a JWT's signature and expiry and returns its claims
+func parseToken(token string, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errBadToken
+	}
+	secret, err := authSecret()
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errBadToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errBadToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil || claims.Subject == "" {
+		return claims, errBadToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, errBadToken
+	}
+	return claims, nil
+}
+
+type authUserKey struct{}
+
+// authUser is the member a request's token was issued to, or "" for an
+// unauthenticated request
+func authUser(r *http.Request) string {
+	user, _ := r.Context().Value(authUserKey{}).(string)
+	return user
+}
+
+// ownedBy reports whether user may reach a record belonging to owner.
+// Unauthenticated requests and records from before accounts existed are not
+// restricted.
+func ownedBy(owner, user string) bool {
+	return user == "" || owner == "" || owner == user
+}
+
+// visibleTo reports whether user may see the expense: their own, and every
+// shared one
+func (e Expense) visibleTo(user string) bool {
+	return e.IsShared || ownedBy(e.User, user)
+}
+
+func (i Income) visibleTo(user string) bool { return ownedBy(i.User, user) }
+func (b Budget) visibleTo(user string) bool { return ownedBy(b.Owner, user) }
+func (g Goal) visibleTo(user string) bool   { return ownedBy(g.Owner, user) }
+
+// reachable reports whether user may change the record stored under id.
+// A missing record is reachable, leaving the handler to treat it as usual.
+func reachable[T any](b *bolt.Bucket, id, user string, visible func(T, string) bool) bool {
+	v := b.Get([]byte(id))
+	if v == nil || user == "" {
+		return true
+	}
+	var record T
+	return json.Unmarshal(v, &record) != nil || visible(record, user)
+}
+
+// ownTokenPaths are API paths whose bearer tokens are not ours: the admin
+// and replication APIs check their own
+var ownTokenPaths = []string{"/api/admin/", "/api/replication/"}
+
+// publicPaths are API paths open without a token even with AUTH_REQUIRED
+var publicPaths = []string{"/api/auth/", "/api/openapi.json", "/api/docs"}
+
+// authMiddleware reads the bearer token of API requests into the request
+// context. With AUTH_REQUIRED set, API requests other than sign-in and the
+// API docs need a token; otherwise tokens are optional, but a bad one still
+// fails.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, prefix := range ownTokenPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok && r.URL.Path == "/api/ws" {
+			// Browsers cannot set headers on a WebSocket
+			token = r.URL.Query().Get("token")
+			ok = token != ""
+		}
+		if !ok {
+			if config().AuthRequired && !slices.ContainsFunc(publicPaths, func(p string) bool { return strings.HasPrefix(r.URL.Path, p) }) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				respondError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := parseToken(token, time.Now())
+		if err == nil && !accountExists(claims.Subject) {
+			// The account was removed after the token was issued
+			err = errBadToken
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			respondError(w, http.StatusUnauthorized, errBadToken.Error())
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && currentSettings().MemberRoles[claims.Subject] == roleViewer {
+			respondError(w, http.StatusForbidden, "viewers cannot make changes")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, claims.Subject)))
+	})
+}
+
+// accountExists reports whether username still has an account
+func accountExists(username string) bool {
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(usersBucket)).Get(userKey(username)) != nil
+		return nil
+	})
+	return found
+}
+
+// authResponse is what login and registration return
+type authResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt"`
+	User      User   `json:"user"`
+}
+
+func respondToken(w http.ResponseWriter, status int, u User) {
+	token, expires, err := signToken(u, time.Now())
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	u.PasswordHash = ""
+	respondJSON(w, status, authResponse{Token: token, ExpiresAt: expires.Format(time.RFC3339), User: u})
+}
+
+// AUTH
+
+// registerRequest is the body of a registration
+type registerRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+}
+
+// register creates an account. The first account can be created by anyone
+// and is an adult's; after that only signed-in adults can add members.
+func register(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !usernamePattern.MatchString(req.Username) {
+		respondError(w, http.StatusBadRequest, "username must be 2-32 letters, digits, '.', '_' or '-', starting with a letter")
+		return
+	}
+	if len(req.Password) < 8 {
+		respondError(w, http.StatusBadRequest, "password must be at least 8 characters")
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleAdult
+	}
+	if err := oneOf("role", req.Role, memberRoles); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now()
+	u := User{
+		ID:           fmt.Sprintf("%d", now.UnixNano()),
+		Username:     req.Username,
+		Name:         strings.TrimSpace(req.Name),
+		Role:         req.Role,
+		PasswordHash: hash,
+		CreatedAt:    now.Format(time.RFC3339),
+	}
+	caller := authUser(r)
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(usersBucket))
+		settings := loadSettings(tx)
+		if k, _ := b.Cursor().First(); k != nil && (caller == "" || !settings.isAdult(caller)) {
+			return errForbidden
+		}
+		if b.Get(userKey(u.Username)) != nil {
+			return errUserExists
+		}
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(userKey(u.Username), data); err != nil {
+			return err
+		}
+		// The account's role is the member's household role
+		settings.MemberRoles[u.Username] = u.Role
+		data, err = json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(settingsBucket)).Put([]byte(householdSettingsKey), data); err != nil {
+			return err
+		}
+		_, err = ensureMember(tx, u.Username, u.Name, u.Role, now, 0)
+		return err
+	})
+	switch {
+	case err == errForbidden:
+		respondError(w, http.StatusForbidden, "only signed-in adults can add members")
+	case err == errUserExists:
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondToken(w, http.StatusCreated, u)
+	}
+}
+
+// loginRequest is the body of a sign-in
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var u User
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(usersBucket)).Get(userKey(req.Username))
+		if v == nil {
+			return errBadPassword
+		}
+		return json.Unmarshal(v, &u)
+	})
+	if err != nil && err != errBadPassword {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err == errBadPassword || !checkPassword(u.PasswordHash, req.Password) {
+		respondError(w, http.StatusUnauthorized, errBadPassword.Error())
+		return
+	}
+	respondToken(w, http.StatusOK, u)
+}
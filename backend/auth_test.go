@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Errorf("pbkdf2 = %s, want %s", got, want)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "correct horse") {
+		t.Error("right password rejected")
+	}
+	for _, bad := range []string{"correct horsf", ""} {
+		if checkPassword(hash, bad) {
+			t.Errorf("wrong password %q accepted", bad)
+		}
+	}
+	if checkPassword("plain", "plain") {
+		t.Error("malformed hash accepted")
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	old := config()
+	t.Cleanup(func() { setConfig(old) })
+	setConfig(&Config{JWTSecret: "test-secret", TokenTTLHours: 1})
+	now := time.Unix(1700000000, 0)
+	token, expires, err := signToken(User{Username: "asha", Role: roleAdult}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("expires %v, want an hour on", expires)
+	}
+	claims, err := parseToken(token, now.Add(time.Minute))
+	if err != nil || claims.Subject != "asha" || claims.Role != roleAdult {
+		t.Fatalf("parse = %+v, %v", claims, err)
+	}
+	if _, err := parseToken(token, now.Add(2*time.Hour)); err != errBadToken {
+		t.Errorf("expired token: err %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + strings.TrimRight(parts[1], "=") + "x." + parts[2]
+	if _, err := parseToken(forged, now); err != errBadToken {
+		t.Errorf("tampered token: err %v", err)
+	}
+	setConfig(&Config{JWTSecret: "other-secret", TokenTTLHours: 1})
+	if _, err := parseToken(token, now); err != errBadToken {
+		t.Errorf("token under another key: err %v", err)
+	}
+}
+
+func TestIsAdultNeedsTheRole(t *testing.T) {
+	s := Settings{MemberRoles: map[string]string{"asha": roleAdult, "ravi": roleChild, "planner": roleViewer, "guest": ""}}
+	for user, want := range map[string]bool{"asha": true, "ravi": false, "planner": false, "guest": false, "stranger": false,
+		"": false, "anonymous": false} {
+		if got := s.isAdult(user); got != want {
+			t.Errorf("isAdult(%q) = %v, want %v", user, got, want)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BackupInfo describes a stored database snapshot
+type BackupInfo struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"createdAt"`
+	Store     string `json:"store"` // dir or s3
+}
+
+// backupStore keeps database snapshots somewhere off the live file
+type backupStore interface {
+	name() string
+	put(ctx context.Context, name string, f *os.File, size int64, sum string) error
+	list(ctx context.Context) ([]BackupInfo, error)
+	open(ctx context.Context, name string) (io.ReadCloser, error)
+	remove(ctx context.Context, name string) error
+}
+
+var (
+	errBackupNotFound = errors.New("backup not found")
+	// backupPrefix starts every backup's name; the timestamp after it
+	// sorts them
+	backupPrefix = "family-finance-"
+)
+
+// configuredBackups is the store backups go to: the S3 bucket when one is
+// configured, else the backup directory
+func configuredBackups() backupStore {
+	c := config()
+	if c.BackupS3Bucket != "" {
+		return s3Backups{endpoint: strings.TrimRight(c.BackupS3Endpoint, "/"), region: c.BackupS3Region,
+			bucket: c.BackupS3Bucket, prefix: c.BackupS3Prefix, accessKey: c.BackupS3AccessKey, secretKey: c.BackupS3SecretKey}
+	}
+	return dirBackups{dir: c.BackupDir}
+}
+
+// validBackupName keeps names to ones this server could have made, so they
+// cannot reach outside the store
+func validBackupName(name string) bool {
+	return strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, ".db") &&
+		!strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
+}
+
+// dirBackups keeps backups as files in a directory
+type dirBackups struct {
+	dir string
+}
+
+func (dirBackups) name() string { return "dir" }
+
+func (d dirBackups) put(ctx context.Context, name string, f *os.File, size int64, sum string) error {
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.dir, name))
+}
+
+func (d dirBackups) list(ctx context.Context) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupInfo
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !validBackupName(e.Name()) {
+			continue
+		}
+		backups = append(backups, BackupInfo{Name: e.Name(), Size: info.Size(),
+			CreatedAt: info.ModTime().Format(time.RFC3339), Store: d.name()})
+	}
+	return backups, nil
+}
+
+func (d dirBackups) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return nil, errBackupNotFound
+	}
+	return f, err
+}
+
+func (d dirBackups) remove(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(d.dir, name))
+}
+
+// s3Backups keeps backups in an S3-compatible bucket (AWS, MinIO,
+// Backblaze B2, ...), addressed path-style and signed with Signature V4
+type s3Backups struct {
+	endpoint, region, bucket, prefix string
+	accessKey, secretKey             string
+}
+
+// emptySHA256 is the hash of an empty request body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s3Backups) name() string { return "s3" }
+
+// request sends a signed request for key (the bucket itself when empty)
+func (s s3Backups) request(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, sum string) (*http.Response, error) {
+	path := "/" + s.bucket
+	if key != "" {
+		path += "/" + s.prefix + key
+	}
+	u, err := url.Parse(s.endpoint + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if sum == "" {
+		sum = emptySHA256
+	}
+	s.sign(req, sum, time.Now().UTC())
+	return http.DefaultClient.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (s s3Backups) sign(req *http.Request, sum string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", sum)
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + sum + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		sum,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac(mac(mac(mac([]byte("AWS4"+s.secretKey), day), s.region), "s3"), "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		s.accessKey, scope, hex.EncodeToString(mac(key, toSign))))
+}
+
+// s3Error reads an unexpected response as an error
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s s3Backups) put(ctx context.Context, name string, f *os.File, size int64, sum string) error {
+	resp, err := s.request(ctx, http.MethodPut, name, nil, f, size, sum)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s s3Backups) list(ctx context.Context) ([]BackupInfo, error) {
+	var backups []BackupInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + backupPrefix}}
+	for {
+		resp, err := s.request(ctx, http.MethodGet, "", query, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string `xml:"Key"`
+				Size         int64  `xml:"Size"`
+				LastModified string `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading bucket listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, s.prefix)
+			if !validBackupName(name) {
+				continue
+			}
+			created := c.LastModified
+			if t, err := time.Parse(time.RFC3339, c.LastModified); err == nil {
+				created = t.Format(time.RFC3339)
+			}
+			backups = append(backups, BackupInfo{Name: name, Size: c.Size, CreatedAt: created, Store: s.name()})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return backups, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s s3Backups) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.request(ctx, http.MethodGet, name, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errBackupNotFound
+	}
+	defer resp.Body.Close()
+	return nil, s3Error(resp)
+}
+
+func (s s3Backups) remove(ctx context.Context, name string) error {
+	resp, err := s.request(ctx, http.MethodDelete, name, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// listBackups lists the store's backups, newest first
+func listBackups(ctx context.Context, store backupStore) ([]BackupInfo, error) {
+	backups, err := store.list(ctx)
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, err
+}
+
+// createBackup snapshots the database with a read transaction, so writers
+// carry on meanwhile, and stores it. A label, such as "pre-restore", is
+// added to the name. Unlabelled backups then delete the oldest beyond
+// BackupKeep; labelled ones leave the backup being restored alone.
+func createBackup(ctx context.Context, label string) (BackupInfo, error) {
+	store := configuredBackups()
+	tmp, err := os.CreateTemp("", "backup-*.db")
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	var size int64
+	err = db.View(func(tx *bolt.Tx) error {
+		size, err = tx.WriteTo(io.MultiWriter(tmp, h))
+		return err
+	})
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("writing snapshot: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return BackupInfo{}, err
+	}
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format("20060102T150405.000000Z")
+	if label != "" {
+		name += "-" + label
+	}
+	name += ".db"
+	if err := store.put(ctx, name, tmp, size, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return BackupInfo{}, fmt.Errorf("storing backup: %w", err)
+	}
+	info := BackupInfo{Name: name, Size: size, CreatedAt: now.Format(time.RFC3339), Store: store.name()}
+	logger("store").Info("database backed up", "backup", name, "store", store.name(), "bytes", size)
+	if label != "" {
+		return info, nil
+	}
+
+	backups, err := listBackups(ctx, store)
+	if err != nil {
+		return info, fmt.Errorf("listing backups to prune: %w", err)
+	}
+	for i := config().BackupKeep; i < len(backups); i++ {
+		if err := store.remove(ctx, backups[i].Name); err != nil {
+			return info, fmt.Errorf("pruning %s: %w", backups[i].Name, err)
+		}
+	}
+	return info, nil
+}
+
+// runBackup is the scheduled backup job
+func runBackup() error {
+	_, err := createBackup(context.Background(), "")
+	return err
+}
+
+// checkBackup opens a downloaded snapshot and makes sure it is a sound
+// database of this app: bolt's consistency check passes and the core
+// buckets are there
+func checkBackup(path string) error {
+	snap, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("not a database file: %w", err)
+	}
+	defer snap.Close()
+	return snap.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("backup is corrupt: %w", err)
+		}
+		for _, name := range []string{expensesBucket, incomeBucket, settingsBucket} {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("backup has no %s bucket; it is not a Family Finance database", name)
+			}
+		}
+		return checkSchemaVersion(storedSchemaVersion(tx))
+	})
+}
+
+// ADMIN: BACKUPS
+
+func getBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := listBackups(r.Context(), configuredBackups())
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if backups == nil {
+		backups = []BackupInfo{}
+	}
+	respondJSON(w, http.StatusOK, backups)
+}
+
+// backupNow takes a backup on demand
+func backupNow(w http.ResponseWriter, r *http.Request) {
+	info, err := createBackup(r.Context(), "")
+	if err != nil && info.Name == "" {
+		logger("store").Error("backup failed", "err", err)
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err != nil {
+		logger("store").Warn("backup taken but not pruned", "err", err)
+	}
+	respondJSON(w, http.StatusCreated, info)
+}
+
+// restoreRequest names the backup to restore. Confirm must repeat the name.
+type restoreRequest struct {
+	Name    string `json:"name"`
+	Confirm string `json:"confirm"`
+}
+
+// restoreBackup replaces every bucket with a backup's, in one transaction.
+// It refuses a backup that fails the consistency check, and first backs up
+// the current data so the restore itself can be undone by restoring that.
+func restoreBackup(w http.ResponseWriter, r *http.Request) {
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validBackupName(req.Name) {
+		respondError(w, http.StatusBadRequest, "name must be a backup from GET /api/admin/backups")
+		return
+	}
+	if req.Confirm != req.Name {
+		respondError(w, http.StatusBadRequest, "confirm must repeat the backup name; restoring replaces all current data")
+		return
+	}
+	// A full download can take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	src, err := configuredBackups().open(r.Context(), req.Name)
+	if err == errBackupNotFound {
+		respondError(w, http.StatusNotFound, "backup not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	tmp, err := os.CreateTemp("", "restore-*.db")
+	if err != nil {
+		src.Close()
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	src.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, "downloading backup: "+err.Error())
+		return
+	}
+	if err := checkBackup(tmp.Name()); err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	safety, err := createBackup(r.Context(), "pre-restore")
+	if safety.Name == "" {
+		respondError(w, http.StatusInternalServerError, "backing up current data before restoring: "+err.Error())
+		return
+	}
+	snap, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer snap.Close()
+	err = snap.View(func(src *bolt.Tx) error {
+		return db.Update(func(dst *bolt.Tx) error {
+			if err := copyBuckets(src, dst); err != nil {
+				return err
+			}
+			// A backup from an older release may lack newer buckets
+			return createBuckets(dst)
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Bring records from an older release into the current shape
+	if err := runStartupMigrations(); err != nil {
+		logger("store").Error("migrating restored data", "err", err)
+	}
+	logger("store").Warn("database restored from backup", "backup", req.Name, "safetyBackup", safety.Name, "by", requestActor(r))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"restored": req.Name, "safetyBackup": safety})
+}
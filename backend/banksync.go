@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bankSyncMaxPages caps the pages of transactions read per sync; the rest
+// wait for the next one
+const bankSyncMaxPages = 20
+
+var (
+	errBankSyncOff        = errors.New("bank sync is not configured")
+	errUnknownBankAccount = errors.New("accounts names an account the bank did not link")
+)
+
+// bankProvider connects to banks through an aggregator
+type bankProvider interface {
+	name() string
+	// linkToken starts the provider's account linking flow in the browser
+	linkToken(ctx context.Context, user string) (string, error)
+	// exchange trades the public token the flow ends with for an access
+	// token to the linked accounts
+	exchange(ctx context.Context, publicToken string) (token, itemID string, err error)
+	accounts(ctx context.Context, token string) ([]BankAccount, error)
+	// sync reads the transactions changed since the cursor, one page at a
+	// time
+	sync(ctx context.Context, token, cursor string) (bankSyncPage, error)
+	// remove revokes the access token
+	remove(ctx context.Context, token string) error
+}
+
+// bankProviders build the provider named by the bankSyncProvider setting
+var bankProviders = map[string]func(c *Config) bankProvider{
+	"plaid": func(c *Config) bankProvider {
+		return plaidProvider{url: plaidHosts[c.PlaidEnv], clientID: c.PlaidClientID, secret: c.PlaidSecret, countries: c.PlaidCountryCodes}
+	},
+}
+
+// configuredBankProvider is the provider banks are linked through, or nil
+// when bank sync is not set up
+func configuredBankProvider() bankProvider {
+	c := config()
+	if build, ok := bankProviders[c.BankSyncProvider]; ok {
+		return build(c)
+	}
+	return nil
+}
+
+// bankTransaction is a transaction read from a bank. Amount is money out;
+// refunds and deposits are negative.
+type bankTransaction struct {
+	ID        string
+	AccountID string
+	Amount    Money
+	Currency  string
+	Date      string
+	Name      string
+	Merchant  string
+	Pending   bool
+}
+
+// bankSyncPage is one page of changed transactions
+type bankSyncPage struct {
+	Added   []bankTransaction
+	Removed []string // IDs
+	Cursor  string
+	More    bool
+}
+
+// BankAccount is an account at a linked bank
+type BankAccount struct {
+	ID       string `json:"id"` // the provider's
+	Name     string `json:"name"`
+	Mask     string `json:"mask,omitempty"` // last digits of the number
+	Type     string `json:"type,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	// AccountID is the household account its transactions are paid from
+	AccountID string `json:"accountId,omitempty"`
+}
+
+// BankConnection is a bank linked through the provider. Its transactions
+// are queued for review.
+type BankConnection struct {
+	ID          string        `json:"id"`
+	Provider    string        `json:"provider"`
+	ItemID      string        `json:"itemId"`
+	Institution string        `json:"institution"`
+	User        string        `json:"user,omitempty"` // member the transactions are for
+	Accounts    []BankAccount `json:"accounts"`
+	// Token is the access token sealed with BankTokenKey; it never leaves
+	// the server
+	Token      string `json:"token,omitempty"`
+	Cursor     string `json:"cursor,omitempty"`
+	Status     string `json:"status"` // active or error
+	LastError  string `json:"lastError,omitempty"`
+	LastSyncAt string `json:"lastSyncAt,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+// account finds a linked account by the provider's ID
+func (bc BankConnection) account(id string) (BankAccount, bool) {
+	for _, a := range bc.Accounts {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return BankAccount{}, false
+}
+
+// bankTokenCipher is the AES-256-GCM cipher access tokens are sealed with,
+// keyed by the hash of BankTokenKey
+func bankTokenCipher(c *Config) (cipher.AEAD, error) {
+	if c.BankTokenKey == "" {
+		return nil, errBankSyncOff
+	}
+	key := sha256.Sum256([]byte(c.BankTokenKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealBankToken(c *Config, token string) (string, error) {
+	aead, err := bankTokenCipher(c)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(token), nil)), nil
+}
+
+func openBankToken(c *Config, sealed string) (string, error) {
+	aead, err := bankTokenCipher(c)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("sealed access token is corrupt")
+	}
+	token, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("access token does not open with the bank token key")
+	}
+	return string(token), nil
+}
+
+// plaidHosts are Plaid's API hosts by environment
+var plaidHosts = map[string]string{
+	"sandbox":     "https://sandbox.plaid.com",
+	"development": "https://development.plaid.com",
+	"production":  "https://production.plaid.com",
+}
+
+var plaidClient = &http.Client{Timeout: 30 * time.Second}
+
+// plaidProvider links banks through Plaid
+type plaidProvider struct {
+	url       string
+	clientID  string
+	secret    string
+	countries []string
+}
+
+func (plaidProvider) name() string { return "plaid" }
+
+// call posts a request to a Plaid endpoint and decodes the reply into out
+func (p plaidProvider) call(ctx context.Context, path string, body map[string]interface{}, out interface{}) error {
+	body["client_id"], body["secret"] = p.clientID, p.secret
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := plaidClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `json:"error_code"`
+			Message string `json:"error_message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		return fmt.Errorf("plaid %s: %s %s: %s", path, resp.Status, e.Code, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p plaidProvider) linkToken(ctx context.Context, user string) (string, error) {
+	if user == "" {
+		user = "household"
+	}
+	var out struct {
+		LinkToken string `json:"link_token"`
+	}
+	err := p.call(ctx, "/link/token/create", map[string]interface{}{
+		"client_name":   "Family Finance",
+		"user":          map[string]string{"client_user_id": user},
+		"products":      []string{"transactions"},
+		"country_codes": p.countries,
+		"language":      "en",
+	}, &out)
+	return out.LinkToken, err
+}
+
+func (p plaidProvider) exchange(ctx context.Context, publicToken string) (string, string, error) {
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ItemID      string `json:"item_id"`
+	}
+	err := p.call(ctx, "/item/public_token/exchange", map[string]interface{}{"public_token": publicToken}, &out)
+	return out.AccessToken, out.ItemID, err
+}
+
+func (p plaidProvider) accounts(ctx context.Context, token string) ([]BankAccount, error) {
+	var out struct {
+		Accounts []struct {
+			AccountID string `json:"account_id"`
+			Name      string `json:"name"`
+			Mask      string `json:"mask"`
+			Type      string `json:"type"`
+			Balances  struct {
+				Currency string `json:"iso_currency_code"`
+			} `json:"balances"`
+		} `json:"accounts"`
+	}
+	if err := p.call(ctx, "/accounts/get", map[string]interface{}{"access_token": token}, &out); err != nil {
+		return nil, err
+	}
+	accounts := []BankAccount{}
+	for _, a := range out.Accounts {
+		accounts = append(accounts, BankAccount{ID: a.AccountID, Name: a.Name, Mask: a.Mask, Type: a.Type, Currency: a.Balances.Currency})
+	}
+	return accounts, nil
+}
+
+func (p plaidProvider) sync(ctx context.Context, token, cursor string) (bankSyncPage, error) {
+	var out struct {
+		Added []struct {
+			TransactionID string  `json:"transaction_id"`
+			AccountID     string  `json:"account_id"`
+			Amount        float64 `json:"amount"`
+			Currency      string  `json:"iso_currency_code"`
+			Date          string  `json:"date"`
+			Name          string  `json:"name"`
+			MerchantName  string  `json:"merchant_name"`
+			Pending       bool    `json:"pending"`
+		} `json:"added"`
+		Removed []struct {
+			TransactionID string `json:"transaction_id"`
+		} `json:"removed"`
+		NextCursor string `json:"next_cursor"`
+		HasMore    bool   `json:"has_more"`
+	}
+	body := map[string]interface{}{"access_token": token, "count": 500}
+	if cursor != "" {
+		body["cursor"] = cursor
+	}
+	if err := p.call(ctx, "/transactions/sync", body, &out); err != nil {
+		return bankSyncPage{}, err
+	}
+	page := bankSyncPage{Cursor: out.NextCursor, More: out.HasMore}
+	for _, t := range out.Added {
+		page.Added = append(page.Added, bankTransaction{
+			ID:        t.TransactionID,
+			AccountID: t.AccountID,
+			Amount:    moneyFromFloat(t.Amount), // Plaid's are positive out
+			Currency:  t.Currency,
+			Date:      t.Date,
+			Name:      t.Name,
+			Merchant:  t.MerchantName,
+			Pending:   t.Pending,
+		})
+	}
+	for _, t := range out.Removed {
+		page.Removed = append(page.Removed, t.TransactionID)
+	}
+	return page, nil
+}
+
+func (p plaidProvider) remove(ctx context.Context, token string) error {
+	var out struct{}
+	return p.call(ctx, "/item/remove", map[string]interface{}{"access_token": token}, &out)
+}
+
+func putBankConnection(tx *bolt.Tx, bc BankConnection) error {
+	data, err := json.Marshal(bc)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(bankConnectionsBucket)).Put([]byte(bc.ID), data)
+}
+
+// syncBankConnection queues the new posted spending of one linked bank for
+// review, and rejects queued transactions the bank withdrew. Transactions
+// the bank holds as pending wait until they post. It returns how many it
+// queued.
+func syncBankConnection(ctx context.Context, p bankProvider, id string) (int, error) {
+	c := config()
+	var bc BankConnection
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bankConnectionsBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(v, &bc)
+	})
+	if err != nil {
+		return 0, err
+	}
+	token, syncErr := openBankToken(c, bc.Token)
+	var added []bankTransaction
+	removed := map[string]bool{}
+	cursor := bc.Cursor
+	for pages := 0; syncErr == nil && pages < bankSyncMaxPages; pages++ {
+		var page bankSyncPage
+		page, syncErr = p.sync(ctx, token, cursor)
+		if syncErr != nil {
+			break
+		}
+		added = append(added, page.Added...)
+		for _, id := range page.Removed {
+			removed["bank:"+id] = true
+		}
+		cursor = page.Cursor
+		if !page.More {
+			break
+		}
+	}
+
+	settings := currentSettings()
+	now := time.Now()
+	queued := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bankConnectionsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound // unlinked meanwhile
+		}
+		if err := json.Unmarshal(v, &bc); err != nil {
+			return err
+		}
+		bc.UpdatedAt = now.Format(time.RFC3339)
+		if syncErr != nil {
+			bc.Status, bc.LastError = "error", syncErr.Error()
+			return putBankConnection(tx, bc)
+		}
+
+		seen := map[string]bool{}
+		err := tx.Bucket([]byte(pendingBucket)).ForEach(func(k, v []byte) error {
+			var d PendingTransaction
+			if json.Unmarshal(v, &d) != nil || d.Source != "bank" {
+				return nil
+			}
+			seen[d.MessageID] = true
+			if removed[d.MessageID] && d.Status == pendingReview {
+				d.Status = pendingRejected
+				d.UpdatedAt = bc.UpdatedAt
+				return putPendingTransaction(tx, d)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range added {
+			if t.Pending || t.Amount <= 0 || removed["bank:"+t.ID] || seen["bank:"+t.ID] {
+				continue
+			}
+			seen["bank:"+t.ID] = true
+			account, _ := bc.account(t.AccountID)
+			currency, err := normalizeCurrency(t.Currency, settings.BaseCurrency)
+			if err != nil {
+				currency = settings.BaseCurrency
+			}
+			d := PendingTransaction{
+				ID:        fmt.Sprintf("%d", now.UnixNano()+int64(queued)),
+				Source:    "bank",
+				MessageID: "bank:" + t.ID,
+				From:      bc.Institution,
+				Subject:   t.Name,
+				User:      bc.User,
+				Bank:      bc.Institution,
+				Account:   account.Mask,
+				AccountID: account.AccountID,
+				Amount:    roundForCurrency(t.Amount, currency),
+				Currency:  currency,
+				Merchant:  t.Merchant,
+				Date:      t.Date,
+				Status:    pendingReview,
+				CreatedAt: bc.UpdatedAt,
+				UpdatedAt: bc.UpdatedAt,
+			}
+			if d.Merchant == "" {
+				d.Merchant = t.Name
+			}
+			if m, ok := knownMerchant(tx, d.Merchant); ok {
+				if m.Name != "" {
+					d.Merchant = m.Name
+				}
+				d.Category = m.DefaultCategory
+			}
+			if err := putPendingTransaction(tx, d); err != nil {
+				return err
+			}
+			queued++
+		}
+		bc.Cursor = cursor
+		bc.Status, bc.LastError = "active", ""
+		bc.LastSyncAt = bc.UpdatedAt
+		return putBankConnection(tx, bc)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return queued, syncErr
+}
+
+// syncBanks syncs every linked bank while the bankSync feature is on. A
+// bank that fails is marked and the rest still sync.
+func syncBanks() error {
+	p := configuredBankProvider()
+	if !featureEnabled("bankSync") || p == nil {
+		return nil
+	}
+	var ids []string
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bankConnectionsBucket)).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, id := range ids {
+		n, err := syncBankConnection(context.Background(), p, id)
+		if err != nil {
+			logger("banksync").Warn("syncing bank", "connection", id, "err", err)
+			failed = append(failed, id)
+			continue
+		}
+		if n > 0 {
+			logger("banksync").Info("queued bank transactions", "connection", id, "queued", n)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d banks failed to sync: %s", len(failed), len(ids), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// BANK SYNC
+
+// bankProviderFor is the provider for a bank sync request, answering 503
+// when none is configured
+func bankProviderFor(w http.ResponseWriter) bankProvider {
+	p := configuredBankProvider()
+	if p == nil || config().BankTokenKey == "" {
+		respondError(w, http.StatusServiceUnavailable, errBankSyncOff.Error())
+		return nil
+	}
+	return p
+}
+
+// createBankLinkToken starts linking a bank in the provider's widget
+func createBankLinkToken(w http.ResponseWriter, r *http.Request) {
+	p := bankProviderFor(w)
+	if p == nil {
+		return
+	}
+	token, err := p.linkToken(r.Context(), authUser(r))
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"linkToken": token})
+}
+
+func getBankConnections(w http.ResponseWriter, r *http.Request) {
+	connections := []BankConnection{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(bankConnectionsBucket)), func(k, v []byte) error {
+			var bc BankConnection
+			if err := json.Unmarshal(v, &bc); err != nil {
+				return err
+			}
+			bc.Token, bc.Cursor = "", ""
+			connections = append(connections, bc)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].CreatedAt < connections[j].CreatedAt })
+	respondJSON(w, http.StatusOK, connections)
+}
+
+// createBankConnection finishes linking a bank with the public token the
+// provider's widget returned
+func createBankConnection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PublicToken string `json:"publicToken"`
+		Institution string `json:"institution"`
+		User        string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.PublicToken == "" {
+		respondError(w, http.StatusBadRequest, "publicToken is required")
+		return
+	}
+	p := bankProviderFor(w)
+	if p == nil {
+		return
+	}
+	if user := authUser(r); user != "" {
+		req.User = user
+	}
+	token, itemID, err := p.exchange(r.Context(), req.PublicToken)
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	accounts, err := p.accounts(r.Context(), token)
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	now := time.Now()
+	bc := BankConnection{
+		ID:          fmt.Sprintf("%d", now.UnixNano()),
+		Provider:    p.name(),
+		ItemID:      itemID,
+		Institution: strings.TrimSpace(req.Institution),
+		User:        req.User,
+		Accounts:    accounts,
+		Status:      "active",
+		CreatedAt:   now.Format(time.RFC3339),
+		UpdatedAt:   now.Format(time.RFC3339),
+	}
+	if bc.Institution == "" {
+		bc.Institution = "Bank"
+	}
+	if bc.Token, err = sealBankToken(config(), token); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error { return putBankConnection(tx, bc) })
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	bc.Token = ""
+	respondJSON(w, http.StatusCreated, bc)
+}
+
+// updateBankConnection changes the member a bank's transactions are for
+// and the household accounts its accounts are paid from
+func updateBankConnection(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		User     *string           `json:"user"`
+		Accounts map[string]string `json:"accounts"` // bank account ID to household account ID
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var bc BankConnection
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bankConnectionsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &bc); err != nil {
+			return err
+		}
+		if req.User != nil {
+			bc.User = *req.User
+		}
+		for bankID, accountID := range req.Accounts {
+			if _, ok := bc.account(bankID); !ok {
+				return errUnknownBankAccount
+			}
+			if err := checkAccount(tx, accountID); err != nil {
+				return err
+			}
+			for i := range bc.Accounts {
+				if bc.Accounts[i].ID == bankID {
+					bc.Accounts[i].AccountID = accountID
+				}
+			}
+		}
+		bc.UpdatedAt = time.Now().Format(time.RFC3339)
+		return putBankConnection(tx, bc)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "bank connection not found")
+		return
+	}
+	if err == errUnknownAccount || err == errUnknownBankAccount {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	bc.Token, bc.Cursor = "", ""
+	respondJSON(w, http.StatusOK, bc)
+}
+
+// deleteBankConnection unlinks a bank, revoking its access token.
+// Transactions already queued stay for review.
+func deleteBankConnection(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var bc BankConnection
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bankConnectionsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &bc); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "bank connection not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if p := configuredBankProvider(); p != nil {
+		token, err := openBankToken(config(), bc.Token)
+		if err == nil {
+			err = p.remove(r.Context(), token)
+		}
+		if err != nil {
+			logger("banksync").Warn("revoking access token", "connection", id, "err", err)
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Bank unlinked"})
+}
+
+// syncBankNow syncs one linked bank without waiting for the schedule
+func syncBankNow(w http.ResponseWriter, r *http.Request) {
+	p := bankProviderFor(w)
+	if p == nil {
+		return
+	}
+	queued, err := syncBankConnection(r.Context(), p, mux.Vars(r)["id"])
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "bank connection not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]int{"queued": queued})
+}
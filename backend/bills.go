@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bill statuses, computed from the due date and paid state
+const (
+	billUpcoming = "upcoming"
+	billDue      = "due" // due within billDueSoonDays
+	billOverdue  = "overdue"
+	billPaid     = "paid"
+)
+
+// billDueSoonDays is how close the due date must be for a bill to be "due"
+const billDueSoonDays = 3
+
+func validBillStatus(status string) bool {
+	switch status {
+	case billUpcoming, billDue, billOverdue, billPaid:
+		return true
+	}
+	return false
+}
+
+// billStatus works out a bill's status on the given day (YYYY-MM-DD)
+func billStatus(bill BillReminder, today string) string {
+	if bill.IsPaid {
+		return billPaid
+	}
+	if bill.DueDate == "" {
+		return billUpcoming
+	}
+	if bill.DueDate < today {
+		return billOverdue
+	}
+	t, err := time.Parse(dateLayout, today)
+	if err == nil && bill.DueDate <= t.AddDate(0, 0, billDueSoonDays).Format(dateLayout) {
+		return billDue
+	}
+	return billUpcoming
+}
+
+// billToday is the household's current day, against which statuses are set
+func billToday() string {
+	return today(householdLocation())
+}
+
+// checkOverdueBills raises an alert for every unpaid bill past its due
+// date. Alerts are keyed by bill and due date, so each is sent once.
+func checkOverdueBills() error {
+	now := billToday()
+	var overdue []BillReminder
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(billsBucket)).ForEach(func(k, v []byte) error {
+			var bill BillReminder
+			if err := json.Unmarshal(v, &bill); err != nil {
+				return nil // left for the integrity check
+			}
+			bill.refresh(now)
+			if bill.Status == billOverdue {
+				overdue = append(overdue, bill)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, bill := range overdue {
+		_, err := emitAlert(newAlert(fmt.Sprintf("bill.overdue:%s:%s", bill.ID, bill.DueDate), "bill.overdue", bill.ID,
+			"alert.bill.overdue", bill.Name, bill.Amount.String(), bill.Currency, bill.DueDate))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// billRecurrences are how often a bill comes round; custom ones repeat
+// every IntervalDays
+var billRecurrences = []string{"monthly", "quarterly", "yearly", "custom"}
+
+// billRecurrenceMonths is the length of each calendar recurrence
+var billRecurrenceMonths = map[string]int{"monthly": 1, "quarterly": 3, "yearly": 12}
+
+// validateRecurrence checks a recurring bill has a due date to repeat from
+// and, for custom recurrence, a positive interval
+func (b *BillReminder) validateRecurrence() error {
+	if b.Recurrence == "" {
+		b.IntervalDays = 0
+		return nil
+	}
+	if err := oneOf("recurrence", b.Recurrence, billRecurrences); err != nil {
+		return err
+	}
+	if b.DueDate == "" {
+		return fmt.Errorf("a recurring bill needs a dueDate")
+	}
+	if b.Recurrence != "custom" {
+		b.IntervalDays = 0
+	} else if b.IntervalDays <= 0 {
+		return fmt.Errorf("intervalDays must be positive for custom recurrence")
+	}
+	return nil
+}
+
+// followingDue is when the occurrence after one due on due falls due
+func (b BillReminder) followingDue(due time.Time) time.Time {
+	if months := billRecurrenceMonths[b.Recurrence]; months > 0 {
+		return addMonthsClamped(due, months)
+	}
+	return due.AddDate(0, 0, b.IntervalDays)
+}
+
+// raiseNextBill adds the next occurrence of a paid recurring bill, once.
+// Premium bills are left to their insurance policy.
+func raiseNextBill(tx *bolt.Tx, bill *BillReminder) error {
+	if !bill.IsPaid || bill.Recurrence == "" || bill.NextBillID != "" || bill.PolicyID != "" {
+		return nil
+	}
+	due, err := time.Parse(dateLayout, bill.DueDate)
+	if err != nil {
+		return nil
+	}
+	next := BillReminder{
+		ID:           fmt.Sprintf("%d", time.Now().UnixNano()),
+		Name:         bill.Name,
+		Amount:       bill.Amount,
+		Currency:     bill.Currency,
+		DueDate:      bill.followingDue(due).Format(dateLayout),
+		Category:     bill.Category,
+		Tags:         bill.Tags,
+		Recurrence:   bill.Recurrence,
+		IntervalDays: bill.IntervalDays,
+	}
+	next.refresh(billToday())
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	bill.NextBillID = next.ID
+	return tx.Bucket([]byte(billsBucket)).Put([]byte(next.ID), data)
+}
+
+// checkDueBills reminds the household of unpaid bills falling due within
+// the configured number of days, once per bill and due date
+func checkDueBills() error {
+	now := billToday()
+	t, err := time.Parse(dateLayout, now)
+	if err != nil {
+		return err
+	}
+	until := t.AddDate(0, 0, config().BillReminderDays).Format(dateLayout)
+	var due []BillReminder
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(billsBucket)).ForEach(func(k, v []byte) error {
+			var bill BillReminder
+			if err := json.Unmarshal(v, &bill); err != nil {
+				return nil // left for the integrity check
+			}
+			bill.refresh(now)
+			if !bill.IsPaid && bill.DueDate >= now && bill.DueDate <= until {
+				due = append(due, bill)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, bill := range due {
+		_, err := emitAlert(newAlert(fmt.Sprintf("bill.due:%s:%s", bill.ID, bill.DueDate), "bill.due", bill.ID,
+			"alert.bill.due", bill.Name, bill.Remaining.String(), bill.Currency, bill.DueDate))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BillPayment is one payment made against a bill, possibly one of several
+type BillPayment struct {
+	ID        string `json:"id"`
+	Amount    Money  `json:"amount"`
+	Date      string `json:"date"`
+	Note      string `json:"note,omitempty"`
+	ExpenseID string `json:"expenseId,omitempty"` // expense recorded for it, if any
+	CreatedAt string `json:"createdAt"`
+}
+
+var (
+	errOverpayment = errors.New("payment exceeds the remaining balance")
+	errBillPaid    = errors.New("bill is already paid")
+)
+
+// applyPayments derives the paid and remaining amounts from the payment
+// history. A bill whose payments cover its amount becomes paid.
+func (b *BillReminder) applyPayments() {
+	b.AmountPaid = 0
+	for _, p := range b.Payments {
+		b.AmountPaid += p.Amount
+	}
+	b.Remaining = b.Amount - b.AmountPaid
+	if b.Remaining < 0 {
+		b.Remaining = 0
+	}
+	if len(b.Payments) > 0 && b.Remaining == 0 {
+		b.IsPaid = true
+	}
+}
+
+// refresh recomputes everything derived: payment totals and status
+func (b *BillReminder) refresh(today string) {
+	b.applyPayments()
+	b.Status = billStatus(*b, today)
+}
+
+// BILL PAYMENTS
+
+func getBill(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var bill BillReminder
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(billsBucket)).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("bill not found")
+		}
+		return json.Unmarshal(v, &bill)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusNotFound, err)
+		return
+	}
+	bill.refresh(billToday())
+	respondJSON(w, http.StatusOK, bill)
+}
+
+// paymentRequest is the body of POST /api/bills/{id}/payments. With
+// createExpense set, the payment is also recorded as an expense in the
+// bill's category.
+type paymentRequest struct {
+	Amount        Money  `json:"amount"`
+	Date          string `json:"date"`
+	Note          string `json:"note"`
+	CreateExpense bool   `json:"createExpense"`
+	User          string `json:"user"`
+}
+
+// paymentDate is the day a payment was made, today unless given
+func (req paymentRequest) paymentDate() (string, error) {
+	loc := currentSettings().location(req.User)
+	date, err := normalizeDate(req.Date, loc)
+	if date == "" && err == nil {
+		date = today(loc)
+	}
+	return date, err
+}
+
+// addBillPayment records a payment against the bill stored under id, with
+// an expense for it when asked. A zero amount pays off whatever is left. A
+// paid bill raises what follows it: its policy's next premium or its next
+// occurrence.
+func addBillPayment(tx *bolt.Tx, id string, req paymentRequest, date string, bill *BillReminder) error {
+	b := tx.Bucket([]byte(billsBucket))
+	v := b.Get([]byte(id))
+	if v == nil {
+		return errNotFound
+	}
+	if err := json.Unmarshal(v, bill); err != nil {
+		return err
+	}
+	bill.applyPayments()
+	if req.Amount == 0 {
+		if bill.IsPaid {
+			return errBillPaid
+		}
+		req.Amount = bill.Remaining
+	}
+	if bill.Amount > 0 && req.Amount > bill.Remaining {
+		return errOverpayment
+	}
+
+	now := time.Now()
+	payment := BillPayment{
+		ID:        fmt.Sprintf("%d", now.UnixNano()),
+		Amount:    req.Amount,
+		Date:      date,
+		Note:      req.Note,
+		CreatedAt: now.Format(time.RFC3339),
+	}
+	if req.CreateExpense && payment.Amount > 0 {
+		expense := Expense{
+			ID:          fmt.Sprintf("%d", now.UnixNano()+1),
+			Amount:      roundForCurrency(payment.Amount, bill.Currency),
+			Currency:    bill.Currency,
+			Description: bill.Name + " payment",
+			Category:    bill.Category,
+			Merchant:    bill.Name,
+			Date:        payment.Date,
+			User:        req.User,
+			Notes:       payment.Note,
+			CreatedAt:   payment.CreatedAt,
+			UpdatedAt:   payment.CreatedAt,
+		}
+		data, err := json.Marshal(expense)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(expensesBucket)).Put([]byte(expense.ID), data); err != nil {
+			return err
+		}
+		expenseWritten(tx)
+		payment.ExpenseID = expense.ID
+	}
+
+	if payment.Amount > 0 {
+		bill.Payments = append(bill.Payments, payment)
+	} else {
+		// Nothing to pay on a bill without an amount but to tick it off
+		bill.IsPaid = true
+	}
+	bill.refresh(billToday())
+	if err := raiseNextBill(tx, bill); err != nil {
+		return err
+	}
+	data, err := json.Marshal(bill)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(id), data); err != nil {
+		return err
+	}
+	// A paid premium raises the bill for the next one
+	if bill.PolicyID != "" && bill.IsPaid {
+		return advancePolicy(tx, bill.PolicyID)
+	}
+	return nil
+}
+
+func createBillPayment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req paymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Amount <= 0 {
+		respondError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	date, err := req.paymentDate()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var bill BillReminder
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		return addBillPayment(tx, id, req, date, &bill)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "bill not found")
+	case err == errOverpayment:
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("%s (%s left to pay)", err, bill.Remaining))
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusCreated, bill)
+	}
+}
+
+// markBillPaid pays off what is left of a bill in one payment. The body is
+// optional and takes the date, note, user and createExpense of a payment.
+func markBillPaid(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req paymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Amount = 0
+	date, err := req.paymentDate()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var bill BillReminder
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		return addBillPayment(tx, id, req, date, &bill)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "bill not found")
+	case err == errBillPaid:
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusOK, bill)
+	}
+}
+
+// deleteBillPayment removes a payment along with the expense recorded for
+// it. A bill that was only paid through its payments becomes unpaid again.
+func deleteBillPayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, paymentID := vars["id"], vars["paymentId"]
+	var bill BillReminder
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(billsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &bill); err != nil {
+			return err
+		}
+		bill.applyPayments()
+		wasCovered := len(bill.Payments) > 0 && bill.Remaining == 0
+		var kept []BillPayment
+		var removed *BillPayment
+		for _, p := range bill.Payments {
+			if p.ID == paymentID {
+				removed = &p
+				continue
+			}
+			kept = append(kept, p)
+		}
+		if removed == nil {
+			return errNotFound
+		}
+		j.track(billsBucket, []byte(id))
+		if removed.ExpenseID != "" {
+			j.track(expensesBucket, []byte(removed.ExpenseID))
+			if err := tx.Bucket([]byte(expensesBucket)).Delete([]byte(removed.ExpenseID)); err != nil {
+				return err
+			}
+		}
+		bill.Payments = kept
+		if wasCovered {
+			bill.IsPaid = false
+		}
+		bill.refresh(billToday())
+		data, err := json.Marshal(bill)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "payment not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, bill)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// budgetPeriods are how often a budget's limit starts afresh
+var budgetPeriods = []string{"monthly", "weekly", "yearly"}
+
+var errNotMonthly = errors.New("history is kept for monthly budgets only")
+
+// defaultBudgetThresholds alert as a budget nears its limit and again once
+// it is spent
+var defaultBudgetThresholds = []int{80, 100}
+
+// validate canonicalizes the currency and period, which default to the
+// base currency and monthly
+func (b *Budget) validate(settings Settings) error {
+	var err error
+	if b.Currency, err = normalizeCurrency(b.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	if b.Period == "" {
+		b.Period = "monthly"
+	}
+	if err := oneOf("period", b.Period, budgetPeriods); err != nil {
+		return err
+	}
+	b.CarriedOver = 0
+	if b.Rollover && b.Period != "monthly" {
+		return fmt.Errorf("rollover is only supported for monthly budgets")
+	}
+	if b.AlertThresholds == nil {
+		b.AlertThresholds = slices.Clone(defaultBudgetThresholds)
+	}
+	for _, t := range b.AlertThresholds {
+		if t < 1 || t > 1000 {
+			return fmt.Errorf("alertThresholds must be percentages between 1 and 1000")
+		}
+	}
+	slices.Sort(b.AlertThresholds)
+	b.AlertThresholds = slices.Compact(b.AlertThresholds)
+	return nil
+}
+
+// window is the period a budget's spending is counted over as of now.
+// Monthly budgets cover their month's cycle, or the running cycle when they
+// name no month. Yearly budgets likewise cover the financial year of their
+// month or the running one; weekly budgets the running week.
+func (b Budget) window(s Settings, now time.Time) Period {
+	now = now.In(s.location(""))
+	month := b.Month
+	if _, err := time.Parse("2006-01", month); err != nil {
+		month = currentBudgetMonth(now, s.BudgetStartDay)
+	}
+	cycle, _ := budgetPeriod(month, s.BudgetStartDay)
+	switch b.Period {
+	case "weekly":
+		return weekPeriod(now)
+	case "yearly":
+		start, _ := time.Parse(dateLayout, cycle.Start)
+		return fiscalYear(start, s.FiscalYearStartMonth)
+	}
+	return cycle
+}
+
+// share is the part of an expense counted against a budget: all of it when
+// linked to the budget, else its parts in the budget's category. Expenses
+// the budget's owner cannot see never count.
+func (b Budget) share(e Expense) (Money, bool) {
+	if !e.visibleTo(b.Owner) {
+		return 0, false
+	}
+	if slices.Contains(e.BudgetIds, b.ID) {
+		return e.Amount, true
+	}
+	var amount Money
+	found := false
+	if b.Category != "" {
+		for _, part := range e.categoryParts() {
+			if strings.EqualFold(part.Category, b.Category) {
+				amount += part.Amount
+				found = true
+			}
+		}
+	}
+	return amount, found
+}
+
+// budgetSpending works out what each budget has spent in its current
+// period: expenses linked to it, and the parts of other expenses in its
+// category. Amounts are converted to the budget's currency. Budgets saved
+// before periods or alert thresholds existed get the defaults.
+func budgetSpending(ctx context.Context, tx *bolt.Tx, s Settings, budgets []Budget, now time.Time) error {
+	windows := make([]Period, len(budgets))
+	convs := make([]*converter, len(budgets))
+	for i := range budgets {
+		budgets[i].Spent = 0
+		if budgets[i].Period == "" {
+			budgets[i].Period = "monthly"
+		}
+		if budgets[i].AlertThresholds == nil {
+			budgets[i].AlertThresholds = slices.Clone(defaultBudgetThresholds)
+		}
+		windows[i] = budgets[i].window(s, now)
+		convs[i] = newConverter(s, budgets[i].Currency)
+	}
+	err := forEach(ctx, tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) != nil || !e.personal() {
+			return nil // Skip malformed expenses
+		}
+		for i, b := range budgets {
+			if !windows[i].contains(e.Date) {
+				continue
+			}
+			if amount, ok := b.share(e); ok {
+				convs[i].add(&budgets[i].Spent, amount, e.Currency)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Rollover budgets also have what was left of earlier months
+	for i := range budgets {
+		if !budgets[i].Rollover {
+			continue
+		}
+		history, err := budgetHistory(ctx, tx, s, budgets[i], now)
+		if err != nil {
+			return err
+		}
+		for _, m := range history {
+			if m.Period.Start == windows[i].Start {
+				budgets[i].CarriedOver = m.CarriedOver
+			}
+		}
+	}
+	return nil
+}
+
+// BudgetMonth is how a monthly budget stood in one budget cycle
+type BudgetMonth struct {
+	Month       string `json:"month"`
+	Period      Period `json:"period"`
+	Limit       Money  `json:"limit"`
+	CarriedOver Money  `json:"carriedOver"` // unspent in the month before, for rollover budgets
+	Spent       Money  `json:"spent"`
+	Remaining   Money  `json:"remaining"` // limit and carry-over less spending; negative when overspent
+}
+
+// budgetHistory goes through a monthly budget's cycles, from its month (or
+// its first spending, when it names none) to its last: its own month, or
+// the running cycle for recurring budgets. With rollover, what is left of
+// each month carries into the next; overspending does not.
+func budgetHistory(ctx context.Context, tx *bolt.Tx, s Settings, b Budget, now time.Time) ([]BudgetMonth, error) {
+	now = now.In(s.location(""))
+	current := currentBudgetMonth(now, s.BudgetStartDay)
+	conv := newConverter(s, b.Currency)
+	spent := map[string]*Money{}
+	first := ""
+	err := forEach(ctx, tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) != nil || !e.personal() {
+			return nil
+		}
+		amount, ok := b.share(e)
+		date, err := time.Parse(dateLayout, e.Date)
+		if !ok || err != nil {
+			return nil
+		}
+		month := currentBudgetMonth(date, s.BudgetStartDay)
+		if spent[month] == nil {
+			spent[month] = new(Money)
+		}
+		conv.add(spent[month], amount, e.Currency)
+		if first == "" || month < first {
+			first = month
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := b.Month, b.Month
+	if _, err := time.Parse("2006-01", b.Month); err != nil {
+		start, end = first, current
+		if start == "" || start > current {
+			start = current
+		}
+	} else if b.IsRecurring && current > end {
+		end = current
+	}
+	var history []BudgetMonth
+	var carry Money
+	for month := start; month <= end; {
+		period, _ := budgetPeriod(month, s.BudgetStartDay)
+		m := BudgetMonth{Month: month, Period: period, Limit: b.Limit}
+		if b.Rollover {
+			m.CarriedOver = carry
+		}
+		if spent[month] != nil {
+			m.Spent = *spent[month]
+		}
+		m.Remaining = m.Limit + m.CarriedOver - m.Spent
+		carry = max(m.Remaining, 0)
+		history = append(history, m)
+		t, _ := time.Parse("2006-01", month)
+		month = t.AddDate(0, 1, 0).Format("2006-01")
+	}
+	return history, nil
+}
+
+// getBudgetHistory lists a monthly budget's limit, spending and carry-over
+// month by month
+func getBudgetHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var history []BudgetMonth
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(budgetsBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var b Budget
+		if err := json.Unmarshal(v, &b); err != nil {
+			return err
+		}
+		if !b.visibleTo(authUser(r)) {
+			return errNotFound
+		}
+		if b.Period != "" && b.Period != "monthly" {
+			return errNotMonthly
+		}
+		var err error
+		history, err = budgetHistory(r.Context(), tx, loadSettings(tx), b, time.Now())
+		return err
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "budget not found")
+	case err == errNotMonthly:
+		respondError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusOK, history)
+	}
+}
+
+// budgetChecks remembers the write transactions that will check budget
+// thresholds once they commit, so one saving many expenses checks once
+var budgetChecks = struct {
+	sync.Mutex
+	txs map[int]*bolt.Tx
+}{txs: map[int]*bolt.Tx{}}
+
+// expenseWritten checks budget thresholds after tx commits. Every write to
+// an expense calls it. A rolled back transaction leaves its entry behind,
+// to be replaced by the next one reusing its ID.
+func expenseWritten(tx *bolt.Tx) {
+	budgetChecks.Lock()
+	defer budgetChecks.Unlock()
+	if budgetChecks.txs[tx.ID()] == tx {
+		return
+	}
+	budgetChecks.txs[tx.ID()] = tx
+	tx.OnCommit(func() {
+		budgetChecks.Lock()
+		delete(budgetChecks.txs, tx.ID())
+		budgetChecks.Unlock()
+		if err := checkBudgetThresholds(); err != nil {
+			logger("notifications").Error("checking budget thresholds", "err", err)
+		}
+	})
+}
+
+// checkBudgetThresholds alerts on budgets whose spending in the running
+// period has reached one of their thresholds. Only the highest threshold
+// reached is alerted, once per period.
+func checkBudgetThresholds() error {
+	settings := currentSettings()
+	now := time.Now()
+	var budgets []Budget
+	err := db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(budgetsBucket)).ForEach(func(k, v []byte) error {
+			var b Budget
+			if json.Unmarshal(v, &b) == nil && b.Limit > 0 {
+				budgets = append(budgets, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return budgetSpending(context.Background(), tx, settings, budgets, now)
+	})
+	if err != nil {
+		return err
+	}
+	today := today(settings.location(""))
+	for _, b := range budgets {
+		window := b.window(settings, now)
+		thresholds := b.AlertThresholds
+		limit := b.Limit + b.CarriedOver
+		if !window.contains(today) || limit <= 0 {
+			continue
+		}
+		for i := len(thresholds) - 1; i >= 0; i-- {
+			t := thresholds[i]
+			if b.Spent*100 < limit*Money(t) {
+				continue
+			}
+			key, args := "alert.budget.threshold", []string{b.Name, strconv.Itoa(t), formatMoney(limit, b.Currency), formatMoney(b.Spent, b.Currency)}
+			if t >= 100 {
+				key, args = "alert.budget.over", []string{b.Name, formatMoney(limit, b.Currency), formatMoney(b.Spent, b.Currency)}
+			}
+			alert := newAlert(fmt.Sprintf("budget.threshold:%s:%s:%d", b.ID, window.Start, t), "budget.threshold", b.ID, key, args...)
+			alert.Link = "/budgets"
+			if b.Owner != "" {
+				alert.Recipients = []string{b.Owner}
+			}
+			created, err := emitAlert(alert)
+			if err != nil {
+				return err
+			}
+			if created && t >= 100 {
+				publishWebhook("budget.exceeded", b)
+			}
+			break
+		}
+	}
+	return nil
+}
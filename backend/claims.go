@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Claim groups reimbursable expenses sent to an employer. It moves from
+// draft through submitted and approved to paid; once paid, the
+// reimbursement income is linked and the expenses drop out of personal
+// spending.
+type Claim struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Employer    string   `json:"employer"`
+	User        string   `json:"user"`
+	ExpenseIDs  []string `json:"expenseIds"`
+	Total       Money    `json:"total"`
+	Currency    string   `json:"currency"`
+	Status      string   `json:"status"`             // draft, submitted, approved or paid
+	IncomeID    string   `json:"incomeId,omitempty"` // the reimbursement, once paid
+	SubmittedAt string   `json:"submittedAt,omitempty"`
+	ApprovedAt  string   `json:"approvedAt,omitempty"`
+	PaidAt      string   `json:"paidAt,omitempty"`
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
+}
+
+// claimSteps maps each claim status to the one it must follow
+var claimSteps = map[string]string{
+	"submitted": "draft",
+	"approved":  "submitted",
+	"paid":      "approved",
+}
+
+var (
+	errClaimNotDraft  = errors.New("claim is no longer a draft")
+	errClaimStep      = errors.New("claim cannot move to that status")
+	errExpenseClaimed = errors.New("expense is on another claim")
+	errIncomeClaimed  = errors.New("income is linked to another claim")
+)
+
+// claimProblem is a mistake in the request found while changing a claim
+type claimProblem string
+
+func (p claimProblem) Error() string { return string(p) }
+
+func (c Claim) visibleTo(user string) bool { return ownedBy(c.User, user) }
+
+// personal reports whether an expense counts towards the household's own
+// spending. Expenses an employer has paid back do not.
+func (e Expense) personal() bool {
+	return !e.Reimbursed
+}
+
+// personal reports whether income is the household's own. Reimbursements of
+// claims only pay back expenses and are left out too.
+func (i Income) personal() bool {
+	return i.ClaimID == ""
+}
+
+// claimExpenses attaches a draft claim's expenses to it, detaching ones it
+// no longer lists, and works out its total. Every expense must be marked
+// reimbursable, be in the claim's currency and be visible to user.
+func claimExpenses(tx *bolt.Tx, claim *Claim, previous []string, user string) error {
+	b := tx.Bucket([]byte(expensesBucket))
+	listed := map[string]bool{}
+	var ids []string
+	claim.Total, claim.Currency = 0, ""
+	var expenses []Expense
+	for _, id := range claim.ExpenseIDs {
+		if listed[id] {
+			continue
+		}
+		listed[id] = true
+		ids = append(ids, id)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return claimProblem(fmt.Sprintf("expense %s not found", id))
+		}
+		var e Expense
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		if !e.visibleTo(user) {
+			return claimProblem(fmt.Sprintf("expense %s not found", id))
+		}
+		if !e.Reimbursable {
+			return claimProblem(fmt.Sprintf("expense %s is not marked reimbursable", id))
+		}
+		if e.ClaimID != "" && e.ClaimID != claim.ID {
+			return errExpenseClaimed
+		}
+		if claim.Currency == "" {
+			claim.Currency = e.Currency
+		} else if e.Currency != claim.Currency {
+			return claimProblem("expenses on a claim must share one currency")
+		}
+		claim.Total += e.Amount
+		e.ClaimID = claim.ID
+		expenses = append(expenses, e)
+	}
+	for _, id := range previous {
+		if listed[id] {
+			continue
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			continue
+		}
+		var e Expense
+		if json.Unmarshal(v, &e) == nil && e.ClaimID == claim.ID {
+			e.ClaimID, e.Reimbursed = "", false
+			expenses = append(expenses, e)
+		}
+	}
+	claim.ExpenseIDs = ids
+	for _, e := range expenses {
+		if err := putExpense(tx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putExpense(tx *bolt.Tx, e Expense) error {
+	e.Version = ""
+	e.MemberID = memberIDFor(tx, e.User)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	expenseWritten(tx)
+	return tx.Bucket([]byte(expensesBucket)).Put([]byte(e.ID), data)
+}
+
+func putClaim(tx *bolt.Tx, claim Claim) error {
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(claimsBucket)).Put([]byte(claim.ID), data)
+}
+
+// CLAIMS
+
+func getClaims(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	user := authUser(r)
+	claims := []Claim{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(claimsBucket)), func(k, v []byte) error {
+			var claim Claim
+			if err := json.Unmarshal(v, &claim); err != nil {
+				return err
+			}
+			if (status == "" || claim.Status == status) && claim.visibleTo(user) {
+				claims = append(claims, claim)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, claims)
+}
+
+// respondClaimError writes the response for errors of claim changes
+func respondClaimError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		respondError(w, http.StatusNotFound, "claim not found")
+	case errClaimNotDraft, errClaimStep, errExpenseClaimed, errIncomeClaimed:
+		respondError(w, http.StatusConflict, err.Error())
+	default:
+		if p, ok := err.(claimProblem); ok {
+			respondError(w, http.StatusBadRequest, string(p))
+			return
+		}
+		respondStoreError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// saveClaim stores a created or edited draft claim
+func saveClaim(w http.ResponseWriter, r *http.Request, claim Claim, status int) {
+	claim.Name = strings.TrimSpace(claim.Name)
+	if claim.Name == "" {
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if len(claim.ExpenseIDs) == 0 {
+		respondError(w, http.StatusBadRequest, "a claim needs at least one expense")
+		return
+	}
+	claim.Employer = strings.TrimSpace(claim.Employer)
+	claim.UpdatedAt = time.Now().Format(time.RFC3339)
+	user := authUser(r)
+	if user != "" {
+		claim.User = user
+	}
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		var previous []string
+		if v := tx.Bucket([]byte(claimsBucket)).Get([]byte(claim.ID)); v != nil {
+			var old Claim
+			json.Unmarshal(v, &old)
+			if !old.visibleTo(user) {
+				return errNotFound
+			}
+			if old.Status != "draft" {
+				return errClaimNotDraft
+			}
+			claim.CreatedAt = old.CreatedAt
+			previous = old.ExpenseIDs
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		claim.Status = "draft"
+		if err := claimExpenses(tx, &claim, previous, user); err != nil {
+			return err
+		}
+		return putClaim(tx, claim)
+	})
+	if err != nil {
+		respondClaimError(w, err)
+		return
+	}
+	respondJSON(w, status, claim)
+}
+
+func createClaim(w http.ResponseWriter, r *http.Request) {
+	var claim Claim
+	if err := json.NewDecoder(r.Body).Decode(&claim); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	claim.ID = fmt.Sprintf("%d", now.UnixNano())
+	claim.CreatedAt = now.Format(time.RFC3339)
+	claim.IncomeID, claim.SubmittedAt, claim.ApprovedAt, claim.PaidAt = "", "", "", ""
+	saveClaim(w, r, claim, http.StatusCreated)
+}
+
+// updateClaim edits a claim's name, employer or expenses while it is a draft
+func updateClaim(w http.ResponseWriter, r *http.Request) {
+	var claim Claim
+	if err := json.NewDecoder(r.Body).Decode(&claim); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	claim.ID = mux.Vars(r)["id"]
+	claim.IncomeID, claim.SubmittedAt, claim.ApprovedAt, claim.PaidAt = "", "", "", ""
+	saveClaim(w, r, claim, http.StatusOK)
+}
+
+// setClaimStatus moves a claim one step along. Marking it paid takes the
+// incomeId of the reimbursement, which is linked to the claim, and nets its
+// expenses out of personal spending.
+func setClaimStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		Status   string `json:"status"`
+		IncomeID string `json:"incomeId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := claimSteps[req.Status]; !ok {
+		respondError(w, http.StatusBadRequest, "status must be submitted, approved or paid")
+		return
+	}
+	if req.Status == "paid" && req.IncomeID == "" {
+		respondError(w, http.StatusBadRequest, "incomeId of the reimbursement is required")
+		return
+	}
+	var claim Claim
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(claimsBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &claim); err != nil {
+			return err
+		}
+		if !claim.visibleTo(authUser(r)) {
+			return errNotFound
+		}
+		if claim.Status != claimSteps[req.Status] {
+			return errClaimStep
+		}
+		now := time.Now().Format(time.RFC3339)
+		claim.Status, claim.UpdatedAt = req.Status, now
+		switch req.Status {
+		case "submitted":
+			claim.SubmittedAt = now
+		case "approved":
+			claim.ApprovedAt = now
+		case "paid":
+			claim.PaidAt = now
+			if err := payClaim(tx, &claim, req.IncomeID, authUser(r)); err != nil {
+				return err
+			}
+		}
+		return putClaim(tx, claim)
+	})
+	if err != nil {
+		respondClaimError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, claim)
+}
+
+// payClaim links the reimbursement income, which must be visible to user,
+// and marks the claim's expenses reimbursed
+func payClaim(tx *bolt.Tx, claim *Claim, incomeID, user string) error {
+	ib := tx.Bucket([]byte(incomeBucket))
+	v := ib.Get([]byte(incomeID))
+	if v == nil {
+		return claimProblem(fmt.Sprintf("income %s not found", incomeID))
+	}
+	var income Income
+	if err := json.Unmarshal(v, &income); err != nil {
+		return err
+	}
+	if !income.visibleTo(user) {
+		return claimProblem(fmt.Sprintf("income %s not found", incomeID))
+	}
+	if income.ClaimID != "" && income.ClaimID != claim.ID {
+		return errIncomeClaimed
+	}
+	income.ClaimID = claim.ID
+	data, err := json.Marshal(income)
+	if err != nil {
+		return err
+	}
+	if err := ib.Put([]byte(income.ID), data); err != nil {
+		return err
+	}
+	claim.IncomeID = income.ID
+
+	eb := tx.Bucket([]byte(expensesBucket))
+	for _, expenseID := range claim.ExpenseIDs {
+		var e Expense
+		if v := eb.Get([]byte(expenseID)); v == nil || json.Unmarshal(v, &e) != nil {
+			continue
+		}
+		e.Reimbursed = true
+		if err := putExpense(tx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteClaim removes a claim, returning its expenses to personal spending
+// and unlinking the reimbursement
+func deleteClaim(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		cb := tx.Bucket([]byte(claimsBucket))
+		v := cb.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var claim Claim
+		if err := json.Unmarshal(v, &claim); err != nil {
+			return err
+		}
+		if !claim.visibleTo(authUser(r)) {
+			return errNotFound
+		}
+		for _, expenseID := range claim.ExpenseIDs {
+			j.track(expensesBucket, []byte(expenseID))
+		}
+		previous := claim.ExpenseIDs
+		claim.ExpenseIDs = nil
+		if err := claimExpenses(tx, &claim, previous, ""); err != nil {
+			return err
+		}
+		if claim.IncomeID != "" {
+			ib := tx.Bucket([]byte(incomeBucket))
+			var income Income
+			if v := ib.Get([]byte(claim.IncomeID)); v != nil && json.Unmarshal(v, &income) == nil && income.ClaimID == id {
+				j.track(incomeBucket, []byte(income.ID))
+				income.ClaimID = ""
+				data, err := json.Marshal(income)
+				if err != nil {
+					return err
+				}
+				if err := ib.Put([]byte(income.ID), data); err != nil {
+					return err
+				}
+			}
+		}
+		j.track(claimsBucket, []byte(id))
+		return cb.Delete([]byte(id))
+	})
+	if err != nil {
+		respondClaimError(w, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Claim deleted"})
+}
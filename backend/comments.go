@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExpenseComment is a note a member leaves on an expense. Members named as
+// @name in it are notified.
+type ExpenseComment struct {
+	ID        string   `json:"id"`
+	ExpenseID string   `json:"expenseId"`
+	Author    string   `json:"author"`
+	Content   string   `json:"content"`
+	Mentions  []string `json:"mentions"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_.-]+)`)
+
+// parseMentions finds the members @mentioned in text, matching names
+// case-insensitively against members. The author is never mentioned.
+func parseMentions(text, author string, members []string) []string {
+	known := map[string]string{}
+	for _, m := range members {
+		known[strings.ToLower(m)] = m
+	}
+	seen := map[string]bool{}
+	mentions := []string{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name, ok := known[strings.ToLower(strings.TrimRight(match[1], ".-"))]
+		if !ok || name == author || seen[name] {
+			continue
+		}
+		seen[name] = true
+		mentions = append(mentions, name)
+	}
+	return mentions
+}
+
+// householdMembers gathers every member name the store knows of: those with
+// settings or preferences, and those who recorded expenses
+func householdMembers(tx *bolt.Tx) []string {
+	names := map[string]bool{}
+	settings := loadSettings(tx)
+	for user := range settings.MemberRoles {
+		names[user] = true
+	}
+	for user := range settings.UserTimezones {
+		names[user] = true
+	}
+	tx.Bucket([]byte(userPrefsBucket)).ForEach(func(k, v []byte) error {
+		names[string(k)] = true
+		return nil
+	})
+	tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) == nil && e.User != "" {
+			names[e.User] = true
+		}
+		return nil
+	})
+	members := make([]string, 0, len(names))
+	for name := range names {
+		members = append(members, name)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// mentionAlertID identifies the alert telling member of a comment
+func mentionAlertID(commentID, member string) string {
+	return fmt.Sprintf("comment.mention:%s:%s", commentID, member)
+}
+
+// commentSnippet shortens a comment for alert messages
+func commentSnippet(content string) string {
+	const max = 80
+	if r := []rune(content); len(r) > max {
+		return string(r[:max]) + "…"
+	}
+	return content
+}
+
+// expenseLink is where clients show an expense
+func expenseLink(id string) string {
+	return "/transactions?expense=" + id
+}
+
+// countComments counts the comments on an expense
+func countComments(tx *bolt.Tx, expenseID string) int {
+	n := 0
+	tx.Bucket([]byte(commentsBucket)).ForEach(func(k, v []byte) error {
+		var c ExpenseComment
+		if json.Unmarshal(v, &c) == nil && c.ExpenseID == expenseID {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// backfillCommentCounts stores the count of comments on every expense. Counts
+// used to be set by clients, so older records may carry any number.
+func backfillCommentCounts(tx *bolt.Tx) (int, error) {
+	counts := map[string]int{}
+	err := tx.Bucket([]byte(commentsBucket)).ForEach(func(k, v []byte) error {
+		var c ExpenseComment
+		if json.Unmarshal(v, &c) == nil {
+			counts[c.ExpenseID]++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rewriteRecords(tx, expensesBucket, func(e *Expense) { e.CommentCount = counts[e.ID] })
+}
+
+// setCommentCount keeps an expense's comment count in step with its
+// comments, counting them afresh so a count that drifted is put right
+func setCommentCount(tx *bolt.Tx, expenseID string) error {
+	b := tx.Bucket([]byte(expensesBucket))
+	v := b.Get([]byte(expenseID))
+	if v == nil {
+		return nil
+	}
+	var e Expense
+	if err := json.Unmarshal(v, &e); err != nil {
+		return err
+	}
+	e.CommentCount = countComments(tx, expenseID)
+	return putExpense(tx, e)
+}
+
+// deleteComments removes an expense's comments along with it
+func deleteComments(tx *bolt.Tx, j *undoJournal, expenseID string) error {
+	b := tx.Bucket([]byte(commentsBucket))
+	var ids []string
+	b.ForEach(func(k, v []byte) error {
+		var c ExpenseComment
+		if json.Unmarshal(v, &c) == nil && c.ExpenseID == expenseID {
+			ids = append(ids, c.ID)
+		}
+		return nil
+	})
+	for _, id := range ids {
+		j.track(commentsBucket, []byte(id))
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// COMMENTS
+
+// getExpenseComments lists the comments on an expense the caller can see,
+// oldest first
+func getExpenseComments(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	comments := []ExpenseComment{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(expensesBucket))
+		if b.Get([]byte(id)) == nil || !reachable(b, id, authUser(r), Expense.visibleTo) {
+			return errNotFound
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(commentsBucket)), func(k, v []byte) error {
+			var c ExpenseComment
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.ExpenseID == id {
+				comments = append(comments, c)
+			}
+			return nil
+		})
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].CreatedAt < comments[j].CreatedAt })
+	respondJSON(w, http.StatusOK, comments)
+}
+
+// createExpenseComment adds a comment by the requesting member and alerts
+// everyone it mentions. Without an auth proxy the body's author is used.
+func createExpenseComment(w http.ResponseWriter, r *http.Request) {
+	var c ExpenseComment
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Content = strings.TrimSpace(c.Content)
+	if c.Content == "" {
+		respondError(w, http.StatusBadRequest, "content is required")
+		return
+	}
+	if actor := requestActor(r); actor != "anonymous" || c.Author == "" {
+		c.Author = actor
+	}
+	now := time.Now()
+	c.ID = fmt.Sprintf("%d", now.UnixNano())
+	c.ExpenseID = mux.Vars(r)["id"]
+	c.CreatedAt = now.Format(time.RFC3339)
+	var expense Expense
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(expensesBucket)).Get([]byte(c.ExpenseID))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &expense); err != nil {
+			return err
+		}
+		if !expense.visibleTo(authUser(r)) {
+			return errNotFound
+		}
+		// Members who cannot see the expense are not told of it
+		c.Mentions = slices.DeleteFunc(parseMentions(c.Content, c.Author, householdMembers(tx)),
+			func(member string) bool { return !expense.visibleTo(member) })
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(commentsBucket)).Put([]byte(c.ID), data); err != nil {
+			return err
+		}
+		return setCommentCount(tx, c.ExpenseID)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, member := range c.Mentions {
+		alert := newAlert(mentionAlertID(c.ID, member), "comment.mention", c.ExpenseID,
+			"alert.comment.mention", c.Author, purchaseName(expense), commentSnippet(c.Content))
+		alert.Recipients = []string{member}
+		alert.Link = expenseLink(c.ExpenseID)
+		if _, err := emitAlert(alert); err != nil {
+			logger("notifications").Error("alerting mention", "comment", c.ID, "user", member, "err", err)
+		}
+	}
+	respondJSON(w, http.StatusCreated, c)
+}
+
+func deleteExpenseComment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, commentID := vars["id"], vars["commentId"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		if !reachable(tx.Bucket([]byte(expensesBucket)), id, authUser(r), Expense.visibleTo) {
+			return errNotFound
+		}
+		b := tx.Bucket([]byte(commentsBucket))
+		v := b.Get([]byte(commentID))
+		if v == nil {
+			return errNotFound
+		}
+		var c ExpenseComment
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		if c.ExpenseID != id {
+			return errNotFound
+		}
+		j.track(commentsBucket, []byte(commentID))
+		j.track(expensesBucket, []byte(id))
+		if err := b.Delete([]byte(commentID)); err != nil {
+			return err
+		}
+		return setCommentCount(tx, id)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "comment not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Comment deleted"})
+}
+
+// Mention is a comment that mentions the caller, with the expense it is on
+type Mention struct {
+	Comment ExpenseComment `json:"comment"`
+	Expense Expense        `json:"expense"`
+	AlertID string         `json:"alertId"` // mark it read to clear the mention
+	Read    bool           `json:"read"`
+	Link    string         `json:"link"`
+}
+
+// getMyMentions lists comments mentioning the caller whose alert they have
+// not read yet, newest first. ?all=true includes read ones.
+func getMyMentions(w http.ResponseWriter, r *http.Request) {
+	user := requestActor(r)
+	all := r.URL.Query().Get("all") == "true"
+	mentions := []Mention{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		expenses := tx.Bucket([]byte(expensesBucket))
+		alerts := tx.Bucket([]byte(alertsBucket))
+		return forEach(r.Context(), tx.Bucket([]byte(commentsBucket)), func(k, v []byte) error {
+			var c ExpenseComment
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if !slices.Contains(c.Mentions, user) || !reachable(expenses, c.ExpenseID, authUser(r), Expense.visibleTo) {
+				return nil
+			}
+			m := Mention{Comment: c, AlertID: mentionAlertID(c.ID, user), Link: expenseLink(c.ExpenseID)}
+			if v := alerts.Get([]byte(m.AlertID)); v != nil {
+				var a Alert
+				json.Unmarshal(v, &a)
+				m.Read = a.ReadAt != ""
+			}
+			if m.Read && !all {
+				return nil
+			}
+			if v := expenses.Get([]byte(c.ExpenseID)); v != nil {
+				json.Unmarshal(v, &m.Expense)
+			}
+			mentions = append(mentions, m)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(mentions, func(i, j int) bool { return mentions[i].Comment.CreatedAt > mentions[j].Comment.CreatedAt })
+	respondJSON(w, http.StatusOK, mentions)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// errVersionConflict reports an edit made to a copy that has since changed
+var errVersionConflict = errors.New("changed by someone else since you loaded it; review the current copy and try again")
+
+// recordVersion identifies the stored bytes of a record. Any write that
+// changes the record changes its version, whichever code path made it.
+func recordVersion(v []byte) string {
+	sum := sha256.Sum256(v)
+	return hex.EncodeToString(sum[:8])
+}
+
+// expectedVersions are the versions an edit may be based on: those of
+// If-Match, otherwise the version sent in the body. None means the client
+// does not check.
+func expectedVersions(r *http.Request, body string) []string {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if body == "" {
+			return nil
+		}
+		return []string{body}
+	}
+	var versions []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		versions = append(versions, strings.Trim(tag, `"`))
+	}
+	return versions
+}
+
+// checkVersion fails with errVersionConflict unless current, the stored
+// record, is at one of the expected versions. "*" matches any record.
+func checkVersion(expected []string, current []byte) error {
+	if expected == nil {
+		return nil
+	}
+	version := recordVersion(current)
+	for _, e := range expected {
+		if e == "*" || e == version {
+			return nil
+		}
+	}
+	return errVersionConflict
+}
+
+// setETag sends a record's version as its entity tag
+func setETag(w http.ResponseWriter, version string) {
+	w.Header().Set("ETag", `"`+version+`"`)
+}
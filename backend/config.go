@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Config holds runtime settings. Values come from an optional JSON file
+// (CONFIG_FILE, default ./config.json) and are overridden by environment
+// variables so existing deployments keep working unchanged.
+type Config struct {
+	Port     string          `json:"port"`
+	DBPath   string          `json:"dbPath"`
+	Features map[string]bool `json:"features"`
+
+	// ListenAddr overrides Port: "127.0.0.1:8080" binds one interface,
+	// "unix:/run/finance/api.sock" a Unix domain socket
+	ListenAddr string `json:"listenAddr"`
+
+	// TLSCertFile and TLSKeyFile serve HTTPS from a PEM certificate chain
+	// and key. The files are re-read when they change, so certbot or another
+	// ACME client can renew a Let's Encrypt certificate without a restart.
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+	// TLSRedirectAddr, such as ":80", listens for plain HTTP and redirects
+	// it to HTTPS
+	TLSRedirectAddr string `json:"tlsRedirectAddr"`
+
+	// HTTP server timeouts in seconds; 0 disables the limit
+	ReadTimeoutSeconds  int `json:"readTimeoutSeconds"`
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds"`
+	IdleTimeoutSeconds  int `json:"idleTimeoutSeconds"`
+	// RequestTimeoutSeconds bounds time spent in a handler; slow storage
+	// scans are abandoned with 503 once it passes
+	RequestTimeoutSeconds int `json:"requestTimeoutSeconds"`
+	// ShutdownTimeoutSeconds is how long SIGINT or SIGTERM waits for
+	// requests in flight before closing their connections
+	ShutdownTimeoutSeconds int `json:"shutdownTimeoutSeconds"`
+
+	// DemoMode serves seeded sample data read-only to the public
+	DemoMode bool `json:"demoMode"`
+	// RateLimitPerMinute caps requests per client; 0 disables the limit.
+	// Demo mode defaults it to 60.
+	RateLimitPerMinute int `json:"rateLimitPerMinute"`
+
+	// AdminToken protects /api/admin; when empty only local clients
+	// may use it
+	AdminToken string `json:"adminToken"`
+
+	// Accounts: API requests carry a bearer token from /api/auth/login.
+	// AuthRequired is on by default; turned off, tokens are optional and
+	// unauthenticated requests see and change every member's records.
+	AuthRequired bool `json:"authRequired"`
+	// JWTSecret signs tokens; when empty a key is generated and kept in a
+	// file beside the database. Replicas need the primary's JWTSecret to
+	// accept its tokens.
+	JWTSecret     string `json:"jwtSecret"`
+	TokenTTLHours int    `json:"tokenTtlHours"`
+
+	// Replication: a replica pulls bolt snapshots from the primary and
+	// serves them read-only. The primary only serves snapshots once a
+	// replication token is set.
+	Role               string `json:"role"` // "primary" or "replica"
+	PrimaryURL         string `json:"primaryUrl"`
+	ReplicationToken   string `json:"replicationToken"`
+	ReplicaSyncSeconds int    `json:"replicaSyncSeconds"`
+
+	// Jobs overrides schedules of registered jobs, keyed by job name
+	Jobs map[string]JobConfig `json:"jobs"`
+
+	// Background task queue
+	QueueWorkers     int `json:"queueWorkers"`
+	QueueMaxAttempts int `json:"queueMaxAttempts"`
+
+	// Audit log of mutating requests; disabled when the path is empty
+	AuditLogPath    string `json:"auditLogPath"`
+	AuditMaxSizeMB  int    `json:"auditMaxSizeMb"`
+	AuditMaxAgeDays int    `json:"auditMaxAgeDays"`
+
+	// Logging
+	LogLevel  string `json:"logLevel"`  // debug, info, warn, error
+	LogFormat string `json:"logFormat"` // text or json
+
+	// Tracing exports OpenTelemetry spans over OTLP/HTTP; disabled when
+	// the endpoint is empty
+	TracingEndpoint    string  `json:"tracingEndpoint"`
+	TracingServiceName string  `json:"tracingServiceName"`
+	TracingSampleRatio float64 `json:"tracingSampleRatio"`
+
+	// Error reporting for panics and 5xx responses; either or both may be set
+	SentryDSN       string `json:"sentryDsn"`
+	ErrorWebhookURL string `json:"errorWebhookUrl"`
+
+	// IntegrityRepairOnBoot fixes problems found by the startup scan
+	// instead of only reporting them
+	IntegrityRepairOnBoot bool `json:"integrityRepairOnBoot"`
+
+	// SMTP server email notifications go out through; email is only
+	// logged while SMTPHost is empty
+	SMTPHost     string `json:"smtpHost"`
+	SMTPPort     int    `json:"smtpPort"`
+	SMTPUsername string `json:"smtpUsername"`
+	SMTPPassword string `json:"smtpPassword"`
+	SMTPFrom     string `json:"smtpFrom"` // sender address, e.g. "Family Finance <finance@example.com>"
+	// TelegramBotToken is the bot telegram notifications are sent as;
+	// they are only logged while it is empty
+	TelegramBotToken string `json:"telegramBotToken"`
+	// IMAP mailbox polled for bank and card transaction alerts while the
+	// emailIngest feature is on; each is queued for review as an expense.
+	// MailTemplates read banks besides the built-in ones.
+	IMAPHost      string         `json:"imapHost"`
+	IMAPPort      int            `json:"imapPort"` // TLS, usually 993
+	IMAPUsername  string         `json:"imapUsername"`
+	IMAPPassword  string         `json:"imapPassword"`
+	IMAPMailbox   string         `json:"imapMailbox"`
+	MailTemplates []MailTemplate `json:"mailTemplates"`
+	// SMSTemplates read bank texts sent to POST /api/ingest/sms besides the
+	// built-in ones, From matching the sender ID
+	SMSTemplates []MailTemplate `json:"smsTemplates"`
+	// Bank sync queues transactions of banks linked through
+	// BankSyncProvider ("plaid") for review while the bankSync feature is
+	// on. PlaidEnv is sandbox, development or production. BankTokenKey,
+	// any passphrase, encrypts the banks' access tokens in the database;
+	// changing it means linking the banks again.
+	BankSyncProvider  string   `json:"bankSyncProvider"`
+	PlaidClientID     string   `json:"plaidClientId"`
+	PlaidSecret       string   `json:"plaidSecret"`
+	PlaidEnv          string   `json:"plaidEnv"`
+	PlaidCountryCodes []string `json:"plaidCountryCodes"`
+	BankTokenKey      string   `json:"bankTokenKey"`
+	// BillReminderDays is how far ahead of its due date a bill is reminded of
+	BillReminderDays int `json:"billReminderDays"`
+	// AnomalyFactor flags an expense costing this many times its category's
+	// recent average; AnomalyNewMerchantAmount flags a first expense at a
+	// merchant from this much, in whole units of the base currency (0 turns
+	// it off)
+	AnomalyFactor            float64 `json:"anomalyFactor"`
+	AnomalyNewMerchantAmount int     `json:"anomalyNewMerchantAmount"`
+
+	// ExchangeRatesProvider fetches exchange rates on a schedule: "http"
+	// reads ExchangeRatesURL, with {base} standing for the base currency.
+	// When empty, only rates set in the household settings are used.
+	ExchangeRatesProvider string `json:"exchangeRatesProvider"`
+	ExchangeRatesURL      string `json:"exchangeRatesUrl"`
+
+	// PriceProvider prices investments that do not name their own
+	// provider: yahoo, alphavantage or amfi. AlphaVantageAPIKey is needed
+	// for alphavantage.
+	PriceProvider      string `json:"priceProvider"`
+	AlphaVantageAPIKey string `json:"alphaVantageApiKey"`
+
+	// OCRProvider reads scanned receipts: "tesseract" runs the binary at
+	// TesseractPath, "vision" calls Google Cloud Vision with VisionAPIKey.
+	// Empty turns scanning off.
+	OCRProvider   string `json:"ocrProvider"`
+	TesseractPath string `json:"tesseractPath"`
+	VisionAPIKey  string `json:"visionApiKey"`
+
+	// Backups snapshot the database on the "backup" job's schedule into
+	// BackupDir, or into an S3-compatible bucket when BackupS3Bucket is
+	// set. Only the newest BackupKeep are kept.
+	BackupDir         string `json:"backupDir"`
+	BackupKeep        int    `json:"backupKeep"`
+	BackupS3Endpoint  string `json:"backupS3Endpoint"` // e.g. https://s3.ap-south-1.amazonaws.com
+	BackupS3Region    string `json:"backupS3Region"`
+	BackupS3Bucket    string `json:"backupS3Bucket"`
+	BackupS3Prefix    string `json:"backupS3Prefix"` // key prefix, e.g. "finance/"
+	BackupS3AccessKey string `json:"backupS3AccessKey"`
+	BackupS3SecretKey string `json:"backupS3SecretKey"`
+
+	// BaseURL is the public origin used in generated links, e.g.
+	// "https://finance.example.com". When empty it is derived per request.
+	BaseURL           string `json:"baseUrl"`
+	TrustProxyHeaders bool   `json:"trustProxyHeaders"`
+
+	// CORS policy for browsers calling the API from another origin, such as
+	// the frontend's dev server. "*" allows any origin, but not together
+	// with credentials.
+	CORSAllowedOrigins   []string `json:"corsAllowedOrigins"`
+	CORSAllowedMethods   []string `json:"corsAllowedMethods"`
+	CORSAllowedHeaders   []string `json:"corsAllowedHeaders"`
+	CORSAllowCredentials bool     `json:"corsAllowCredentials"`
+}
+
+// current holds the active configuration. It is replaced wholesale on
+// reload, so readers always see a consistent snapshot.
+var current atomic.Pointer[Config]
+
+// allowsOrigin reports whether the CORS policy lets a page on origin call
+// the API
+func (c *Config) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.CORSAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// config returns the active configuration. Callers must not modify it.
+func config() *Config {
+	return current.Load()
+}
+
+func setConfig(c *Config) {
+	current.Store(c)
+}
+
+// defaultFeatures lists every known feature flag and its default state.
+// Experimental subsystems ship disabled.
+var defaultFeatures = map[string]bool{
+	"bankSync":    false,
+	"ocr":         false,
+	"emailIngest": false,
+	"smsIngest":   false,
+	"webhooks":    false,
+}
+
+func loadConfig() (*Config, error) {
+	c := &Config{
+		Port:         "8080",
+		DBPath:       "./family_finance.db",
+		Features:     map[string]bool{},
+		AuthRequired: true,
+
+		CORSAllowedOrigins: []string{"http://localhost:4321", "http://127.0.0.1:4321"},
+		CORSAllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		CORSAllowedHeaders: []string{"Content-Type", "Authorization", "If-Match"},
+
+		ReadTimeoutSeconds:     60,
+		WriteTimeoutSeconds:    60,
+		IdleTimeoutSeconds:     120,
+		RequestTimeoutSeconds:  30,
+		ShutdownTimeoutSeconds: 30,
+
+		TokenTTLHours: 7 * 24,
+
+		Role:               rolePrimary,
+		ReplicaSyncSeconds: 30,
+
+		QueueWorkers:     2,
+		QueueMaxAttempts: 5,
+
+		AuditMaxSizeMB:  10,
+		AuditMaxAgeDays: 365,
+
+		SMTPPort:          587,
+		IMAPPort:          993,
+		IMAPMailbox:       "INBOX",
+		PlaidEnv:          "sandbox",
+		PlaidCountryCodes: []string{"US"},
+		BillReminderDays:  3,
+
+		AnomalyFactor:            3,
+		AnomalyNewMerchantAmount: 5000,
+
+		PriceProvider: "yahoo",
+
+		OCRProvider:   "tesseract",
+		TesseractPath: "tesseract",
+
+		BackupDir:      "./backups",
+		BackupKeep:     7,
+		BackupS3Region: "us-east-1",
+
+		LogLevel:  "info",
+		LogFormat: "text",
+
+		TracingServiceName: "family-finance-api",
+		TracingSampleRatio: 1,
+	}
+	for name, enabled := range defaultFeatures {
+		c.Features[name] = enabled
+	}
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		path = "./config.json"
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		// Fields absent from the file keep their defaults; maps are merged
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) || os.Getenv("CONFIG_FILE") != "" {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	envString(&c.Port, "PORT")
+	envString(&c.ListenAddr, "LISTEN_ADDR")
+	envString(&c.TLSCertFile, "TLS_CERT_FILE")
+	envString(&c.TLSKeyFile, "TLS_KEY_FILE")
+	envString(&c.TLSRedirectAddr, "TLS_REDIRECT_ADDR")
+	envString(&c.DBPath, "DB_PATH")
+	if err := envInt(&c.ReadTimeoutSeconds, "HTTP_READ_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.WriteTimeoutSeconds, "HTTP_WRITE_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.IdleTimeoutSeconds, "HTTP_IDLE_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.RequestTimeoutSeconds, "REQUEST_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.ShutdownTimeoutSeconds, "SHUTDOWN_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	envString(&c.Role, "ROLE")
+	envString(&c.PrimaryURL, "PRIMARY_URL")
+	envString(&c.ReplicationToken, "REPLICATION_TOKEN")
+	envString(&c.AdminToken, "ADMIN_TOKEN")
+	if err := envBool(&c.AuthRequired, "AUTH_REQUIRED"); err != nil {
+		return nil, err
+	}
+	envString(&c.JWTSecret, "JWT_SECRET")
+	if err := envInt(&c.TokenTTLHours, "TOKEN_TTL_HOURS"); err != nil {
+		return nil, err
+	}
+	if err := envBool(&c.DemoMode, "DEMO_MODE"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.RateLimitPerMinute, "RATE_LIMIT_PER_MINUTE"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.ReplicaSyncSeconds, "REPLICA_SYNC_INTERVAL"); err != nil {
+		return nil, err
+	}
+	if err := envInt(&c.QueueWorkers, "QUEUE_WORKERS"); err != nil {
+		return nil, err
+	}
+	envString(&c.AuditLogPath, "AUDIT_LOG_PATH")
+	envString(&c.LogLevel, "LOG_LEVEL")
+	envString(&c.LogFormat, "LOG_FORMAT")
+	envString(&c.TracingEndpoint, "OTEL_EXPORTER_OTLP_ENDPOINT")
+	envString(&c.TracingServiceName, "OTEL_SERVICE_NAME")
+	envString(&c.SentryDSN, "SENTRY_DSN")
+	envString(&c.ErrorWebhookURL, "ERROR_WEBHOOK_URL")
+	if err := envBool(&c.IntegrityRepairOnBoot, "INTEGRITY_REPAIR_ON_BOOT"); err != nil {
+		return nil, err
+	}
+	envString(&c.SMTPHost, "SMTP_HOST")
+	if err := envInt(&c.SMTPPort, "SMTP_PORT"); err != nil {
+		return nil, err
+	}
+	envString(&c.SMTPUsername, "SMTP_USERNAME")
+	envString(&c.SMTPPassword, "SMTP_PASSWORD")
+	envString(&c.SMTPFrom, "SMTP_FROM")
+	envString(&c.TelegramBotToken, "TELEGRAM_BOT_TOKEN")
+	envString(&c.IMAPHost, "IMAP_HOST")
+	if err := envInt(&c.IMAPPort, "IMAP_PORT"); err != nil {
+		return nil, err
+	}
+	envString(&c.IMAPUsername, "IMAP_USERNAME")
+	envString(&c.IMAPPassword, "IMAP_PASSWORD")
+	envString(&c.IMAPMailbox, "IMAP_MAILBOX")
+	envString(&c.BankSyncProvider, "BANK_SYNC_PROVIDER")
+	envString(&c.PlaidClientID, "PLAID_CLIENT_ID")
+	envString(&c.PlaidSecret, "PLAID_SECRET")
+	envString(&c.PlaidEnv, "PLAID_ENV")
+	envList(&c.PlaidCountryCodes, "PLAID_COUNTRY_CODES")
+	envString(&c.BankTokenKey, "BANK_TOKEN_KEY")
+	if err := envInt(&c.BillReminderDays, "BILL_REMINDER_DAYS"); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("ANOMALY_FACTOR"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ANOMALY_FACTOR: %w", err)
+		}
+		c.AnomalyFactor = f
+	}
+	if err := envInt(&c.AnomalyNewMerchantAmount, "ANOMALY_NEW_MERCHANT_AMOUNT"); err != nil {
+		return nil, err
+	}
+	envString(&c.ExchangeRatesProvider, "EXCHANGE_RATES_PROVIDER")
+	envString(&c.ExchangeRatesURL, "EXCHANGE_RATES_URL")
+	envString(&c.PriceProvider, "PRICE_PROVIDER")
+	envString(&c.AlphaVantageAPIKey, "ALPHAVANTAGE_API_KEY")
+	envString(&c.OCRProvider, "OCR_PROVIDER")
+	envString(&c.TesseractPath, "TESSERACT_PATH")
+	envString(&c.VisionAPIKey, "VISION_API_KEY")
+	envString(&c.BackupDir, "BACKUP_DIR")
+	if err := envInt(&c.BackupKeep, "BACKUP_KEEP"); err != nil {
+		return nil, err
+	}
+	envString(&c.BackupS3Endpoint, "BACKUP_S3_ENDPOINT")
+	envString(&c.BackupS3Region, "BACKUP_S3_REGION")
+	envString(&c.BackupS3Bucket, "BACKUP_S3_BUCKET")
+	envString(&c.BackupS3Prefix, "BACKUP_S3_PREFIX")
+	envString(&c.BackupS3AccessKey, "BACKUP_S3_ACCESS_KEY")
+	envString(&c.BackupS3SecretKey, "BACKUP_S3_SECRET_KEY")
+	envString(&c.BaseURL, "BASE_URL")
+	envList(&c.CORSAllowedOrigins, "CORS_ALLOWED_ORIGINS")
+	envList(&c.CORSAllowedMethods, "CORS_ALLOWED_METHODS")
+	envList(&c.CORSAllowedHeaders, "CORS_ALLOWED_HEADERS")
+	if err := envBool(&c.CORSAllowCredentials, "CORS_ALLOW_CREDENTIALS"); err != nil {
+		return nil, err
+	}
+	if err := envBool(&c.TrustProxyHeaders, "TRUST_PROXY_HEADERS"); err != nil {
+		return nil, err
+	}
+	// FEATURES=ocr,-bankSync enables ocr and disables bankSync
+	for _, name := range strings.Split(os.Getenv("FEATURES"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, "-") {
+			c.Features[name[1:]] = false
+		} else {
+			c.Features[name] = true
+		}
+	}
+
+	for i, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			if c.CORSAllowCredentials {
+				return nil, fmt.Errorf("corsAllowedOrigins cannot be \"*\" with corsAllowCredentials")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("corsAllowedOrigins: %q is not an origin such as https://finance.example.com", origin)
+		}
+		c.CORSAllowedOrigins[i] = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return nil, fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	if c.TLSRedirectAddr != "" && c.TLSCertFile == "" {
+		return nil, fmt.Errorf("tlsRedirectAddr needs tlsCertFile and tlsKeyFile")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", c.LogLevel)
+	}
+	if f := strings.ToLower(c.LogFormat); f != "" && f != "text" && f != "json" {
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", c.LogFormat)
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio %v must be between 0 and 1", c.TracingSampleRatio)
+	}
+	if c.SentryDSN != "" {
+		u, err := url.Parse(c.SentryDSN)
+		if err != nil || u.User == nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return nil, fmt.Errorf("invalid Sentry DSN (want https://<key>@<host>/<project>)")
+		}
+	}
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid base URL %q (want e.g. https://finance.example.com)", c.BaseURL)
+		}
+	}
+	if c.SMTPHost != "" {
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			return nil, fmt.Errorf("invalid SMTP from address %q", c.SMTPFrom)
+		}
+		if c.SMTPPort <= 0 || c.SMTPPort > 65535 {
+			return nil, fmt.Errorf("invalid SMTP port %d", c.SMTPPort)
+		}
+	}
+	if c.IMAPHost != "" && (c.IMAPPort <= 0 || c.IMAPPort > 65535) {
+		return nil, fmt.Errorf("invalid IMAP port %d", c.IMAPPort)
+	}
+	for i, t := range c.MailTemplates {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("mailTemplates[%d]: %v", i, err)
+		}
+	}
+	for i, t := range c.SMSTemplates {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("smsTemplates[%d]: %v", i, err)
+		}
+	}
+	if c.BankSyncProvider != "" {
+		if _, ok := bankProviders[c.BankSyncProvider]; !ok {
+			return nil, fmt.Errorf("unknown bank sync provider %q (want plaid)", c.BankSyncProvider)
+		}
+		if c.BankTokenKey == "" {
+			return nil, fmt.Errorf("bank sync requires BANK_TOKEN_KEY to encrypt access tokens")
+		}
+	}
+	if c.BankSyncProvider == "plaid" {
+		if c.PlaidClientID == "" || c.PlaidSecret == "" {
+			return nil, fmt.Errorf("the plaid bank sync provider requires PLAID_CLIENT_ID and PLAID_SECRET")
+		}
+		if _, ok := plaidHosts[c.PlaidEnv]; !ok {
+			return nil, fmt.Errorf("invalid Plaid environment %q (want sandbox, development or production)", c.PlaidEnv)
+		}
+	}
+	if c.BillReminderDays < 0 {
+		return nil, fmt.Errorf("bill reminder days %d cannot be negative", c.BillReminderDays)
+	}
+	if c.AnomalyFactor <= 1 {
+		return nil, fmt.Errorf("anomaly factor %v must be above 1", c.AnomalyFactor)
+	}
+	if c.AnomalyNewMerchantAmount < 0 {
+		return nil, fmt.Errorf("anomaly new merchant amount %d cannot be negative", c.AnomalyNewMerchantAmount)
+	}
+	if c.ExchangeRatesProvider != "" {
+		if _, ok := rateProviders[c.ExchangeRatesProvider]; !ok {
+			return nil, fmt.Errorf("unknown exchange rate provider %q", c.ExchangeRatesProvider)
+		}
+		if c.ExchangeRatesProvider == "http" && c.ExchangeRatesURL == "" {
+			return nil, fmt.Errorf("the http exchange rate provider requires EXCHANGE_RATES_URL")
+		}
+	}
+	if c.PriceProvider != "" {
+		if _, ok := priceProviders[c.PriceProvider]; !ok {
+			return nil, fmt.Errorf("unknown price provider %q (want yahoo, alphavantage or amfi)", c.PriceProvider)
+		}
+	}
+	if c.PriceProvider == "alphavantage" && c.AlphaVantageAPIKey == "" {
+		return nil, fmt.Errorf("the alphavantage price provider requires ALPHAVANTAGE_API_KEY")
+	}
+	if c.OCRProvider != "" {
+		if _, ok := ocrEngines[c.OCRProvider]; !ok {
+			return nil, fmt.Errorf("unknown OCR provider %q (want tesseract or vision)", c.OCRProvider)
+		}
+	}
+	if c.OCRProvider == "vision" && c.VisionAPIKey == "" {
+		return nil, fmt.Errorf("the vision OCR provider requires VISION_API_KEY")
+	}
+	if c.BackupKeep < 1 {
+		return nil, fmt.Errorf("backup keep %d must be at least 1", c.BackupKeep)
+	}
+	if c.BackupS3Bucket != "" {
+		u, err := url.Parse(c.BackupS3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid backup S3 endpoint %q (want e.g. https://s3.ap-south-1.amazonaws.com)", c.BackupS3Endpoint)
+		}
+		if c.BackupS3AccessKey == "" || c.BackupS3SecretKey == "" {
+			return nil, fmt.Errorf("S3 backups require BACKUP_S3_ACCESS_KEY and BACKUP_S3_SECRET_KEY")
+		}
+	} else if c.BackupDir == "" {
+		return nil, fmt.Errorf("backups need BACKUP_DIR or BACKUP_S3_BUCKET")
+	}
+	if c.TokenTTLHours <= 0 {
+		return nil, fmt.Errorf("token TTL %d must be positive", c.TokenTTLHours)
+	}
+	if c.Role != rolePrimary && c.Role != roleReplica {
+		return nil, fmt.Errorf("invalid role %q (want %q or %q)", c.Role, rolePrimary, roleReplica)
+	}
+	if c.Role == roleReplica && c.PrimaryURL == "" {
+		return nil, fmt.Errorf("replica role requires PRIMARY_URL")
+	}
+	if c.DemoMode {
+		if c.Role == roleReplica {
+			return nil, fmt.Errorf("demo mode cannot run on a replica")
+		}
+		if c.RateLimitPerMinute == 0 {
+			c.RateLimitPerMinute = 60
+		}
+	}
+
+	return c, nil
+}
+
+func envString(dst *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*dst = v
+	}
+}
+
+// envList reads a comma-separated list, replacing the configured one
+func envList(dst *[]string, key string) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	*dst = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+func envBool(dst *bool, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func envInt(dst *int, key string) error {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = n
+	return nil
+}
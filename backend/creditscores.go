@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var creditBureaus = []string{"CIBIL", "Experian", "Equifax", "CRIF High Mark"}
+
+const (
+	// creditScoreRecheckDays is how old a member's latest score gets before
+	// they are reminded to check again: about a quarter
+	creditScoreRecheckDays = 90
+	// creditScoreSparkline is how many recent scores the dashboard plots
+	creditScoreSparkline = 8
+)
+
+// CreditScore is one check of a member's credit score
+type CreditScore struct {
+	ID        string `json:"id"`
+	Member    string `json:"member"`
+	Bureau    string `json:"bureau"`
+	Score     int    `json:"score"` // 300-900
+	Date      string `json:"date"`
+	Notes     string `json:"notes,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (c *CreditScore) validate(settings Settings) error {
+	c.Member = strings.TrimSpace(c.Member)
+	if c.Member == "" {
+		return fmt.Errorf("member is required")
+	}
+	if err := oneOf("bureau", c.Bureau, creditBureaus); err != nil {
+		return err
+	}
+	if c.Score < 300 || c.Score > 900 {
+		return fmt.Errorf("score must be between 300 and 900")
+	}
+	loc := settings.location(c.Member)
+	var err error
+	if c.Date, err = normalizeDate(c.Date, loc); err != nil {
+		return err
+	}
+	if c.Date == "" {
+		c.Date = today(loc)
+	}
+	return nil
+}
+
+// CreditHistory is a member's scores oldest first, with the latest and its
+// change from the one before
+type CreditHistory struct {
+	Member string        `json:"member"`
+	Latest *CreditScore  `json:"latest"`
+	Change int           `json:"change"`
+	Scores []CreditScore `json:"scores"`
+	// Due is set once the latest check is old enough to repeat
+	Due bool `json:"due"`
+}
+
+// creditHistories groups scores by member, members in name order
+func creditHistories(scores []CreditScore, now string) []CreditHistory {
+	byMember := map[string]*CreditHistory{}
+	for _, c := range scores {
+		h, ok := byMember[c.Member]
+		if !ok {
+			h = &CreditHistory{Member: c.Member}
+			byMember[c.Member] = h
+		}
+		h.Scores = append(h.Scores, c)
+	}
+	t, _ := time.Parse(dateLayout, now)
+	recheck := t.AddDate(0, 0, -creditScoreRecheckDays).Format(dateLayout)
+	histories := []CreditHistory{}
+	for _, h := range byMember {
+		sort.Slice(h.Scores, func(i, j int) bool {
+			if h.Scores[i].Date != h.Scores[j].Date {
+				return h.Scores[i].Date < h.Scores[j].Date
+			}
+			return h.Scores[i].CreatedAt < h.Scores[j].CreatedAt
+		})
+		n := len(h.Scores)
+		h.Latest = &h.Scores[n-1]
+		if n > 1 {
+			h.Change = h.Scores[n-1].Score - h.Scores[n-2].Score
+		}
+		h.Due = h.Latest.Date <= recheck
+		histories = append(histories, *h)
+	}
+	sort.Slice(histories, func(i, j int) bool { return histories[i].Member < histories[j].Member })
+	return histories
+}
+
+func loadCreditScores(tx *bolt.Tx) []CreditScore {
+	var scores []CreditScore
+	tx.Bucket([]byte(creditScoresBucket)).ForEach(func(k, v []byte) error {
+		var c CreditScore
+		if json.Unmarshal(v, &c) == nil {
+			scores = append(scores, c)
+		}
+		return nil
+	})
+	return scores
+}
+
+// creditSparklines gives the dashboard each member's latest scores
+func creditSparklines(tx *bolt.Tx, now string) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, h := range creditHistories(loadCreditScores(tx), now) {
+		points := h.Scores
+		if len(points) > creditScoreSparkline {
+			points = points[len(points)-creditScoreSparkline:]
+		}
+		values := make([]int, len(points))
+		for i, p := range points {
+			values[i] = p.Score
+		}
+		lines = append(lines, map[string]interface{}{
+			"member": h.Member,
+			"latest": h.Latest.Score,
+			"change": h.Change,
+			"scores": values,
+		})
+	}
+	return lines
+}
+
+// checkCreditScores reminds members whose latest credit score is a quarter
+// old to check it again, once for each check
+func checkCreditScores() error {
+	var histories []CreditHistory
+	err := db.View(func(tx *bolt.Tx) error {
+		histories = creditHistories(loadCreditScores(tx), billToday())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, h := range histories {
+		if !h.Due {
+			continue
+		}
+		alert := newAlert(fmt.Sprintf("creditScore.recheck:%s:%s", h.Member, h.Latest.Date), "creditScore.recheck", h.Member,
+			"alert.creditScore.recheck", h.Member, h.Latest.Date)
+		alert.Recipients = []string{h.Member}
+		if _, err := emitAlert(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CREDIT SCORES
+
+// getCreditScores lists recorded scores newest first, optionally for one
+// ?member=
+func getCreditScores(w http.ResponseWriter, r *http.Request) {
+	member := r.URL.Query().Get("member")
+	scores := []CreditScore{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(creditScoresBucket)), func(k, v []byte) error {
+			var c CreditScore
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if member == "" || c.Member == member {
+				scores = append(scores, c)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Date > scores[j].Date })
+	respondJSON(w, http.StatusOK, scores)
+}
+
+func createCreditScore(w http.ResponseWriter, r *http.Request) {
+	var c CreditScore
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	c.ID = fmt.Sprintf("%d", now.UnixNano())
+	c.CreatedAt = now.Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(creditScoresBucket)).Put([]byte(c.ID), data)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, c)
+}
+
+func deleteCreditScore(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(creditScoresBucket, []byte(id))
+		return tx.Bucket([]byte(creditScoresBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Credit score deleted"})
+}
+
+// getCreditHistory returns every member's score history, or one ?member='s
+func getCreditHistory(w http.ResponseWriter, r *http.Request) {
+	member := r.URL.Query().Get("member")
+	var histories []CreditHistory
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		histories = creditHistories(loadCreditScores(tx), billToday())
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := []CreditHistory{}
+	for _, h := range histories {
+		if member == "" || h.Member == member {
+			list = append(list, h)
+		}
+	}
+	respondJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, tc := range []struct {
+		expr             string
+		ok               bool
+		domStar, dowStar bool
+	}{
+		{"*/15 * * * *", true, true, true},
+		{"0 6 * * 1-5", true, true, false},
+		{"@daily", true, true, true},
+		{"@monthly", true, false, true},
+		{"0 0 */1 * 0-6", true, true, true},
+		{"0 0 1-31 * 0-7", true, true, true},
+		{"0 0 */2 * *", true, false, true},
+		{"0 0 1,15 * 1", true, false, false},
+		{"* * * *", false, false, false},
+		{"60 * * * *", false, false, false},
+		{"0 24 * * *", false, false, false},
+		{"0 0 0 * *", false, false, false},
+		{"0 0 * 13 *", false, false, false},
+		{"0 0 * * 8", false, false, false},
+		{"*/0 * * * *", false, false, false},
+		{"5-1 * * * *", false, false, false},
+		{"a * * * *", false, false, false},
+	} {
+		s, err := parseCron(tc.expr)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseCron(%q) err = %v, want ok %v", tc.expr, err, tc.ok)
+			continue
+		}
+		if err == nil && (s.domStar != tc.domStar || s.dowStar != tc.dowStar) {
+			t.Errorf("parseCron(%q) unrestricted days = %v, %v, want %v, %v", tc.expr, s.domStar, s.dowStar, tc.domStar, tc.dowStar)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Thursday 15 January 2026, 10:20
+	from := time.Date(2026, 1, 15, 10, 20, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{"*/15 * * * *", "2026-01-15 10:30"},
+		{"20 10 * * *", "2026-01-16 10:20"},
+		{"0 6 * * 1-5", "2026-01-16 06:00"},
+		{"0 9 * * 7", "2026-01-18 09:00"},
+		{"@monthly", "2026-02-01 00:00"},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+		// With both days restricted either one matches: the 20th, or the
+		// Monday before it
+		{"0 0 20 * 1", "2026-01-19 00:00"},
+		{"0 0 16 * 1", "2026-01-16 00:00"},
+		// A day field allowing every day leaves the other to decide
+		{"0 0 */1 * 1", "2026-01-19 00:00"},
+		{"0 0 20 * 0-6", "2026-01-20 00:00"},
+		{"0 0 1-31 * 0-7", "2026-01-16 00:00"},
+	} {
+		s, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.expr, err)
+			continue
+		}
+		if got := s.next(from).Format("2006-01-02 15:04"); got != tc.want {
+			t.Errorf("next(%q) = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+	s, _ := parseCron("0 0 31 2 *")
+	if next := s.next(from); !next.IsZero() {
+		t.Errorf("31 February came round at %v", next)
+	}
+}
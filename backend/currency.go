@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultCurrency is the household currency until settings say otherwise
+const defaultCurrency = "INR"
+
+// iso4217 holds the active ISO 4217 currency codes
+var iso4217 = map[string]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD
+		BND BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE
+		CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF
+		GTQ GYD HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS
+		KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD
+		MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR
+		PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK
+		SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD
+		TWD TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XCG XOF XPF YER
+		ZAR ZMW ZWG`) {
+		iso4217[code] = true
+	}
+}
+
+// normalizeCurrency upper-cases a currency code and checks it against ISO
+// 4217. Empty means the household's base currency.
+func normalizeCurrency(code, base string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return base, nil
+	}
+	if !iso4217[code] {
+		return "", fmt.Errorf("unknown currency %q (want an ISO 4217 code such as INR)", code)
+	}
+	return code, nil
+}
+
+// rate is the value of one unit of currency in the base currency. Rates set
+// by hand win over fetched ones.
+func (s Settings) rate(currency string) (float64, bool) {
+	if currency == "" || currency == s.BaseCurrency {
+		return 1, true
+	}
+	if r, ok := s.ExchangeRates[currency]; ok {
+		return r, true
+	}
+	r, ok := s.fetchedRates[currency]
+	return r, ok
+}
+
+// convert changes an amount from one currency into another through the
+// base currency. It reports false when either rate is unknown.
+func (s Settings) convert(m Money, from, to string) (Money, bool) {
+	if from == to {
+		return m, true
+	}
+	fromRate, ok1 := s.rate(from)
+	toRate, ok2 := s.rate(to)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return roundForCurrency(moneyFromFloat(m.Float64()*fromRate/toRate), to), true
+}
+
+// converter totals amounts in a single currency. Amounts it has no rate for
+// are left out and listed by unconverted, rather than mixed in as if they
+// were already in the target currency.
+type converter struct {
+	settings Settings
+	to       string
+	missing  map[string]bool
+}
+
+func newConverter(s Settings, to string) *converter {
+	if to == "" {
+		to = s.BaseCurrency
+	}
+	return &converter{settings: s, to: to, missing: map[string]bool{}}
+}
+
+// add converts m and adds it to total
+func (c *converter) add(total *Money, m Money, from string) bool {
+	if from == "" {
+		from = c.settings.BaseCurrency
+	}
+	converted, ok := c.settings.convert(m, from, c.to)
+	if !ok {
+		c.missing[from] = true
+		return false
+	}
+	*total += converted
+	return true
+}
+
+// unconverted lists the currencies skipped for lack of an exchange rate
+func (c *converter) unconverted() []string {
+	codes := []string{}
+	for code := range c.missing {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// CurrencyTotal is what was spent and earned in one currency, and what that
+// comes to in the base currency when there is a rate
+type CurrencyTotal struct {
+	Currency     string `json:"currency"`
+	Spent        Money  `json:"spent"`
+	Income       Money  `json:"income,omitempty"`
+	SpentInBase  *Money `json:"spentInBase,omitempty"`
+	IncomeInBase *Money `json:"incomeInBase,omitempty"`
+}
+
+// currencyTotals add up amounts in the currency they were recorded in
+type currencyTotals struct {
+	settings Settings
+	totals   map[string]*CurrencyTotal
+}
+
+func newCurrencyTotals(s Settings) *currencyTotals {
+	return &currencyTotals{settings: s, totals: map[string]*CurrencyTotal{}}
+}
+
+func (t *currencyTotals) get(currency string) *CurrencyTotal {
+	if currency == "" {
+		currency = t.settings.BaseCurrency
+	}
+	if t.totals[currency] == nil {
+		t.totals[currency] = &CurrencyTotal{Currency: currency}
+	}
+	return t.totals[currency]
+}
+
+func (t *currencyTotals) spend(m Money, currency string) { t.get(currency).Spent += m }
+func (t *currencyTotals) earn(m Money, currency string)  { t.get(currency).Income += m }
+
+// list returns the totals by currency code, converted where possible
+func (t *currencyTotals) list() []CurrencyTotal {
+	list := []CurrencyTotal{}
+	for _, total := range t.totals {
+		c := *total
+		if m, ok := t.settings.convert(c.Spent, c.Currency, t.settings.BaseCurrency); ok {
+			c.SpentInBase = &m
+		}
+		if m, ok := t.settings.convert(c.Income, c.Currency, t.settings.BaseCurrency); ok && c.Income != 0 {
+			c.IncomeInBase = &m
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+	return list
+}
+
+// currencySymbols are used when amounts are written into messages
+var currencySymbols = map[string]string{"INR": "₹", "USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥"}
+
+// formatMoney writes an amount for people to read, e.g. ₹1,23,450 or
+// $3,450.50. Rupees use Indian digit grouping; paise are shown only when
+// there are any, to the currency's own decimal places.
+func formatMoney(m Money, currency string) string {
+	m = roundForCurrency(m, currency)
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	digits := fmt.Sprint(int64(m / majorUnit))
+	var groups []string
+	for size := 3; len(digits) > size; size = 2 {
+		if currency != "INR" {
+			size = 3
+		}
+		groups = append([]string{digits[len(digits)-size:]}, groups...)
+		digits = digits[:len(digits)-size]
+	}
+	text := strings.Join(append([]string{digits}, groups...), ",")
+	if minor := m % majorUnit; minor != 0 {
+		text += "." + minorDigits(minor)
+	}
+	if symbol, ok := currencySymbols[currency]; ok {
+		return sign + symbol + text
+	}
+	return sign + text + " " + currency
+}
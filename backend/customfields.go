@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CustomField is an extra field the household records on expenses, such as
+// "Project code". Values are stored on each expense under the field's key.
+type CustomField struct {
+	Key       string   `json:"key"` // e.g. "projectCode"; fixed once created
+	Label     string   `json:"label"`
+	Type      string   `json:"type"`              // text, number, bool or select
+	Options   []string `json:"options,omitempty"` // allowed values of select fields
+	Required  bool     `json:"required"`
+	CreatedAt string   `json:"createdAt"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+var (
+	customFieldTypes = []string{"text", "number", "bool", "select"}
+	customFieldKey   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,39}$`)
+
+	errDuplicateCustomField = errors.New("duplicate custom field")
+	errCustomFieldInUse     = errors.New("custom field in use")
+)
+
+func (f *CustomField) validate() error {
+	if !customFieldKey.MatchString(f.Key) {
+		return fmt.Errorf("key must start with a letter and contain only letters, digits and underscores")
+	}
+	f.Label = strings.TrimSpace(f.Label)
+	if f.Label == "" {
+		f.Label = f.Key
+	}
+	if err := oneOf("type", f.Type, customFieldTypes); err != nil {
+		return err
+	}
+	if f.Type != "select" {
+		f.Options = nil
+		return nil
+	}
+	if len(f.Options) == 0 {
+		return fmt.Errorf("select fields need options")
+	}
+	return nil
+}
+
+// coerce checks a value against the field's type, converting numbers and
+// booleans sent as strings
+func (f CustomField) coerce(v interface{}) (interface{}, error) {
+	switch f.Type {
+	case "number":
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case string:
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(n), 64); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, fmt.Errorf("customFields.%s must be a number", f.Key)
+	case "bool":
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if parsed, err := strconv.ParseBool(b); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, fmt.Errorf("customFields.%s must be true or false", f.Key)
+	case "select":
+		s, _ := v.(string)
+		for _, o := range f.Options {
+			if s == o {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("customFields.%s must be one of %s", f.Key, strings.Join(f.Options, ", "))
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("customFields.%s must be text", f.Key)
+		}
+		return s, nil
+	}
+}
+
+// fieldString is a custom field value as it appears in query strings and
+// report groups
+func fieldString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case string:
+		return x
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func loadCustomFields(tx *bolt.Tx) (map[string]CustomField, error) {
+	fields := map[string]CustomField{}
+	err := tx.Bucket([]byte(customFieldsBucket)).ForEach(func(k, v []byte) error {
+		var f CustomField
+		if json.Unmarshal(v, &f) == nil {
+			fields[f.Key] = f
+		}
+		return nil
+	})
+	return fields, err
+}
+
+// validateCustomFields checks an expense's custom values against the
+// household's definitions, returning them with their types settled. Empty
+// values are dropped.
+func validateCustomFields(ctx context.Context, values map[string]interface{}) (map[string]interface{}, error) {
+	var defs map[string]CustomField
+	err := viewContext(ctx, func(tx *bolt.Tx) error {
+		var err error
+		defs, err = loadCustomFields(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	clean := map[string]interface{}{}
+	for key, v := range values {
+		def, ok := defs[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown custom field %q", key)
+		}
+		if v == nil || v == "" {
+			continue
+		}
+		if clean[key], err = def.coerce(v); err != nil {
+			return nil, err
+		}
+	}
+	for key, def := range defs {
+		if _, ok := clean[key]; def.Required && !ok {
+			return nil, fmt.Errorf("customFields.%s is required", key)
+		}
+	}
+	if len(clean) == 0 {
+		return nil, nil
+	}
+	return clean, nil
+}
+
+// CUSTOM FIELDS
+
+func getCustomFields(w http.ResponseWriter, r *http.Request) {
+	fields := []CustomField{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(customFieldsBucket)), func(k, v []byte) error {
+			var f CustomField
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			fields = append(fields, f)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, fields)
+}
+
+func putCustomField(tx *bolt.Tx, f CustomField) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(customFieldsBucket)).Put([]byte(f.Key), data)
+}
+
+func createCustomField(w http.ResponseWriter, r *http.Request) {
+	var f CustomField
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := f.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.CreatedAt = time.Now().Format(time.RFC3339)
+	f.UpdatedAt = f.CreatedAt
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(customFieldsBucket)).Get([]byte(f.Key)) != nil {
+			return errDuplicateCustomField
+		}
+		return putCustomField(tx, f)
+	})
+	if err == errDuplicateCustomField {
+		respondError(w, http.StatusConflict, fmt.Sprintf("custom field %q already exists", f.Key))
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, f)
+}
+
+// updateCustomField changes a field's label, options or required flag.
+// Stored values are not rewritten; ones that no longer fit are reported
+// when their expense is next saved.
+func updateCustomField(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	var f CustomField
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.Key = key
+	if err := f.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(customFieldsBucket)).Get([]byte(key))
+		if v == nil {
+			return errNotFound
+		}
+		var old CustomField
+		json.Unmarshal(v, &old)
+		f.CreatedAt = old.CreatedAt
+		return putCustomField(tx, f)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "custom field not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, f)
+}
+
+// deleteCustomField refuses to remove a field expenses still have values for
+func deleteCustomField(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	used := 0
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		err := forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) == nil && e.CustomFields[key] != nil {
+				used++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if used > 0 {
+			return errCustomFieldInUse
+		}
+		j.track(customFieldsBucket, []byte(key))
+		return tx.Bucket([]byte(customFieldsBucket)).Delete([]byte(key))
+	})
+	if err == errCustomFieldInUse {
+		respondError(w, http.StatusConflict, fmt.Sprintf("custom field is set on %d expenses", used))
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Custom field deleted"})
+}
+
+// BREAKDOWN
+
+// BreakdownGroup summarizes the expenses sharing one value of a dimension
+type BreakdownGroup struct {
+	Value string `json:"value"`
+	Summary
+}
+
+// getExpenseBreakdown groups filtered expenses by ?by=category, user or
+// field.<key>, largest total first
+func getExpenseBreakdown(w http.ResponseWriter, r *http.Request) {
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	by := r.URL.Query().Get("by")
+	var dimension func(e entry) string
+	switch key, isField := strings.CutPrefix(by, "field."); {
+	case by == "category":
+		dimension = func(e entry) string { return e.Category }
+	case by == "user":
+		dimension = func(e entry) string { return e.User }
+	case isField && key != "":
+		dimension = func(e entry) string { return fieldString(e.Fields[key]) }
+	default:
+		respondError(w, http.StatusBadRequest, "by must be category, user or field.<key>")
+		return
+	}
+
+	groups := map[string]*BreakdownGroup{}
+	convs := map[string]*converter{}
+	settings := currentSettings()
+	user := authUser(r)
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var expense Expense
+			if err := json.Unmarshal(v, &expense); err != nil {
+				return err
+			}
+			e := expenseFields(expense)
+			if !f.matches(e) || !expense.personal() || !expense.visibleTo(user) {
+				return nil
+			}
+			// Itemized expenses count towards each of their categories
+			parts := []categoryPart{{dimension(e), e.Amount}}
+			if by == "category" {
+				parts = expense.categoryParts()
+			}
+			for _, part := range parts {
+				g, ok := groups[part.Category]
+				if !ok {
+					g = &BreakdownGroup{Value: part.Category, Summary: Summary{Currency: settings.BaseCurrency}}
+					groups[part.Category] = g
+					convs[part.Category] = newConverter(settings, settings.BaseCurrency)
+				}
+				g.add(convs[part.Category], part.Amount, e.Currency, e.Date)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := []BreakdownGroup{}
+	for value, g := range groups {
+		g.UnconvertedCurrencies = convs[value].unconverted()
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Total != list[j].Total {
+			return list[i].Total > list[j].Total
+		}
+		return list[i].Value < list[j].Value
+	})
+	respondJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dateLayout is the canonical stored form of calendar dates. It sorts
+// lexically, so range queries can compare strings.
+const dateLayout = "2006-01-02"
+
+// dateInputLayouts are the formats accepted from clients and old records.
+// Slashed dates are read day first, as written in India.
+var dateInputLayouts = []string{
+	dateLayout,
+	"2006/01/02",
+	"02/01/2006",
+	"02-01-2006",
+	"2 Jan 2006",
+	"2 January 2006",
+	"Jan 2, 2006",
+	"January 2, 2006",
+}
+
+// normalizeDate parses a client-supplied date and returns it as YYYY-MM-DD.
+// Timestamps are placed on the calendar of loc, so an expense logged at
+// 23:30 IST and sent as UTC still lands on the right day. Empty stays empty.
+func normalizeDate(s string, loc *time.Location) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.In(loc).Format(dateLayout), nil
+		}
+	}
+	for _, layout := range dateInputLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(dateLayout), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q (use YYYY-MM-DD)", s)
+}
+
+// today is the default date for new transactions
+func today(loc *time.Location) string {
+	return time.Now().In(loc).Format(dateLayout)
+}
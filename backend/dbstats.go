@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DBStats summarizes the bolt file and its buckets
+type DBStats struct {
+	Path           string        `json:"path"`
+	SchemaVersion  int           `json:"schemaVersion"`
+	FileSize       int64         `json:"fileSize"`
+	DataSize       int64         `json:"dataSize"`
+	PageSize       int           `json:"pageSize"`
+	FreePages      int           `json:"freePages"`
+	PendingPages   int           `json:"pendingPages"`
+	FreeBytes      int           `json:"freeBytes"`
+	FreelistBytes  int           `json:"freelistBytes"`
+	Buckets        []BucketStats `json:"buckets"`
+	LargestRecords []RecordSize  `json:"largestRecords"`
+}
+
+// BucketStats describes one top-level bucket
+type BucketStats struct {
+	Name      string `json:"name"`
+	Records   int    `json:"records"`
+	Bytes     int    `json:"bytes"` // keys plus values
+	InUse     int    `json:"inUse"` // bytes used by its pages, including overhead
+	Allocated int    `json:"allocated"`
+}
+
+// RecordSize identifies a single stored value by size
+type RecordSize struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Bytes  int    `json:"bytes"`
+}
+
+// collectDBStats walks every bucket once, keeping the top largest records
+func collectDBStats(ctx context.Context, top int) (*DBStats, error) {
+	s := db.Stats()
+	stats := &DBStats{
+		Path:           db.Path(),
+		PageSize:       db.Info().PageSize,
+		FreePages:      s.FreePageN,
+		PendingPages:   s.PendingPageN,
+		FreeBytes:      s.FreeAlloc,
+		FreelistBytes:  s.FreelistInuse,
+		Buckets:        []BucketStats{},
+		LargestRecords: []RecordSize{},
+	}
+	if fi, err := os.Stat(db.Path()); err == nil {
+		stats.FileSize = fi.Size()
+	}
+
+	err := viewContext(ctx, func(tx *bolt.Tx) error {
+		stats.DataSize = tx.Size()
+		stats.SchemaVersion = storedSchemaVersion(tx)
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bs := b.Stats()
+			entry := BucketStats{
+				Name:      string(name),
+				Records:   bs.KeyN,
+				InUse:     bs.BranchInuse + bs.LeafInuse + bs.InlineBucketInuse,
+				Allocated: bs.BranchAlloc + bs.LeafAlloc,
+			}
+			err := forEach(ctx, b, func(k, v []byte) error {
+				entry.Bytes += len(k) + len(v)
+				stats.LargestRecords = keepLargest(stats.LargestRecords, RecordSize{
+					Bucket: string(name), Key: string(k), Bytes: len(v),
+				}, top)
+				return nil
+			})
+			stats.Buckets = append(stats.Buckets, entry)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// keepLargest inserts rec into list, sorted by size descending, and trims
+// it to at most n entries.
+func keepLargest(list []RecordSize, rec RecordSize, n int) []RecordSize {
+	if n <= 0 || (len(list) == n && rec.Bytes <= list[n-1].Bytes) {
+		return list
+	}
+	i := sort.Search(len(list), func(i int) bool { return list[i].Bytes < rec.Bytes })
+	list = append(list, RecordSize{})
+	copy(list[i+1:], list[i:])
+	list[i] = rec
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// ADMIN: DATABASE
+
+func getDBStats(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 1000 {
+			respondError(w, http.StatusBadRequest, "top must be between 0 and 1000")
+			return
+		}
+		top = n
+	}
+
+	stats, err := collectDBStats(r.Context(), top)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, stats)
+}
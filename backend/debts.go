@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Debt directions
+const (
+	debtLent     = "lent"     // someone outside the household owes us
+	debtBorrowed = "borrowed" // we owe someone outside the household
+)
+
+// Debt statuses, computed from the due date and repayments
+const (
+	debtOpen    = "open"
+	debtDue     = "due" // due within billDueSoonDays
+	debtOverdue = "overdue"
+	debtSettled = "settled"
+)
+
+// debtRepaymentSource is the income source repayments of money we lent are
+// recorded under
+const debtRepaymentSource = "Loan repayments"
+
+// Debt is money lent to or borrowed from a friend or relative
+type Debt struct {
+	ID           string `json:"id"`
+	Direction    string `json:"direction"` // lent or borrowed
+	Counterparty string `json:"counterparty"`
+	Amount       Money  `json:"amount"`
+	Currency     string `json:"currency"`
+	Date         string `json:"date"`
+	DueDate      string `json:"dueDate,omitempty"`
+	Note         string `json:"note,omitempty"`
+	User         string `json:"user"` // household member who lent or borrowed
+	CreatedAt    string `json:"createdAt"`
+	UpdatedAt    string `json:"updatedAt"`
+
+	// Repayments so far; Repaid, Outstanding and Status are derived
+	Repayments  []DebtRepayment `json:"repayments,omitempty"`
+	Repaid      Money           `json:"repaid"`
+	Outstanding Money           `json:"outstanding"`
+	Status      string          `json:"status"`
+}
+
+// DebtRepayment is a partial or full repayment. It is also recorded as an
+// income entry (money lent coming back) or an expense (paying back what we
+// borrowed).
+type DebtRepayment struct {
+	ID        string `json:"id"`
+	Amount    Money  `json:"amount"`
+	Date      string `json:"date"`
+	Note      string `json:"note,omitempty"`
+	IncomeID  string `json:"incomeId,omitempty"`
+	ExpenseID string `json:"expenseId,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// refresh derives the repaid and outstanding amounts and the status
+func (d *Debt) refresh(today string) {
+	d.Repaid = 0
+	for _, p := range d.Repayments {
+		d.Repaid += p.Amount
+	}
+	d.Outstanding = d.Amount - d.Repaid
+	if d.Outstanding < 0 {
+		d.Outstanding = 0
+	}
+	switch {
+	case d.Outstanding == 0:
+		d.Status = debtSettled
+	case d.DueDate == "":
+		d.Status = debtOpen
+	default:
+		bill := BillReminder{DueDate: d.DueDate}
+		switch billStatus(bill, today) {
+		case billOverdue:
+			d.Status = debtOverdue
+		case billDue:
+			d.Status = debtDue
+		default:
+			d.Status = debtOpen
+		}
+	}
+}
+
+func (d *Debt) validate(settings Settings) error {
+	if d.Direction != debtLent && d.Direction != debtBorrowed {
+		return fmt.Errorf("direction must be lent or borrowed")
+	}
+	d.Counterparty = strings.TrimSpace(d.Counterparty)
+	if d.Counterparty == "" {
+		return fmt.Errorf("counterparty is required")
+	}
+	if d.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	var err error
+	if d.Currency, err = normalizeCurrency(d.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	d.Amount = roundForCurrency(d.Amount, d.Currency)
+	loc := settings.location(d.User)
+	if d.Date, err = normalizeDate(d.Date, loc); err != nil {
+		return err
+	}
+	if d.Date == "" {
+		d.Date = today(loc)
+	}
+	d.DueDate, err = normalizeDate(d.DueDate, loc)
+	return err
+}
+
+// debtPosition totals what outsiders owe the household and what it owes
+// them, in the converter's currency
+func debtPosition(tx *bolt.Tx, conv *converter) (lent, borrowed Money) {
+	now := billToday()
+	tx.Bucket([]byte(debtsBucket)).ForEach(func(k, v []byte) error {
+		var d Debt
+		if json.Unmarshal(v, &d) != nil {
+			return nil
+		}
+		d.refresh(now)
+		if d.Direction == debtLent {
+			conv.add(&lent, d.Outstanding, d.Currency)
+		} else {
+			conv.add(&borrowed, d.Outstanding, d.Currency)
+		}
+		return nil
+	})
+	return lent, borrowed
+}
+
+// checkDebts reminds the household of debts coming due and overdue. Alerts
+// are keyed by debt, status and due date, so each is sent once.
+func checkDebts() error {
+	now := billToday()
+	var debts []Debt
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(debtsBucket)).ForEach(func(k, v []byte) error {
+			var d Debt
+			if json.Unmarshal(v, &d) != nil {
+				return nil
+			}
+			d.refresh(now)
+			if d.Status == debtDue || d.Status == debtOverdue {
+				debts = append(debts, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range debts {
+		alertType := "debt." + d.Status
+		key := fmt.Sprintf("alert.debt.%s.%s", d.Direction, d.Status)
+		_, err := emitAlert(newAlert(fmt.Sprintf("%s:%s:%s", alertType, d.ID, d.DueDate), alertType, d.ID,
+			key, d.Counterparty, formatMoney(d.Outstanding, d.Currency), d.DueDate))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DEBTS
+
+// getDebts lists debts, optionally only those of one ?status= or
+// ?direction=
+func getDebts(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	direction := r.URL.Query().Get("direction")
+	now := billToday()
+	debts := []Debt{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(debtsBucket)), func(k, v []byte) error {
+			var d Debt
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			d.refresh(now)
+			if (status == "" || d.Status == status) && (direction == "" || d.Direction == direction) {
+				debts = append(debts, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, debts)
+}
+
+func createDebt(w http.ResponseWriter, r *http.Request) {
+	var d Debt
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := d.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if d.ID == "" {
+		d.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	d.Repayments = nil
+	d.CreatedAt = now.Format(time.RFC3339)
+	d.UpdatedAt = d.CreatedAt
+	d.refresh(billToday())
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(debtsBucket)).Put([]byte(d.ID), data)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, d)
+}
+
+// updateDebt edits a debt, keeping its repayment history
+func updateDebt(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var d Debt
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := d.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d.ID = id
+	d.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(debtsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var old Debt
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		d.CreatedAt = old.CreatedAt
+		d.Repayments = old.Repayments
+		d.refresh(billToday())
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "debt not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, d)
+}
+
+// deleteDebt removes a debt. Income and expense entries recorded for its
+// repayments stay, as the money did move.
+func deleteDebt(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(debtsBucket, []byte(id))
+		return tx.Bucket([]byte(debtsBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Debt deleted"})
+}
+
+// createDebtRepayment records a repayment together with the income or
+// expense entry for the money that changed hands
+func createDebtRepayment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req paymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Amount <= 0 {
+		respondError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	loc := currentSettings().location(req.User)
+	date, err := normalizeDate(req.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+
+	now := time.Now()
+	repayment := DebtRepayment{
+		ID:        fmt.Sprintf("%d", now.UnixNano()),
+		Amount:    req.Amount,
+		Date:      date,
+		Note:      req.Note,
+		CreatedAt: now.Format(time.RFC3339),
+	}
+	var d Debt
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(debtsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		d.refresh(billToday())
+		if repayment.Amount > d.Outstanding {
+			return errOverpayment
+		}
+		user := req.User
+		if user == "" {
+			user = d.User
+		}
+		amount := roundForCurrency(repayment.Amount, d.Currency)
+		entryID := fmt.Sprintf("%d", now.UnixNano()+1)
+
+		var bucket string
+		var entry interface{}
+		if d.Direction == debtLent {
+			income := Income{
+				ID:          entryID,
+				Amount:      amount,
+				Currency:    d.Currency,
+				Source:      debtRepaymentSource,
+				Description: "Repayment from " + d.Counterparty,
+				Date:        repayment.Date,
+				User:        user,
+				CreatedAt:   repayment.CreatedAt,
+				UpdatedAt:   repayment.CreatedAt,
+			}
+			if err := linkIncomeSource(tx, &income); err != nil {
+				return err
+			}
+			bucket, entry, repayment.IncomeID = incomeBucket, income, entryID
+		} else {
+			expense := Expense{
+				ID:          entryID,
+				Amount:      amount,
+				Currency:    d.Currency,
+				Description: "Repayment to " + d.Counterparty,
+				Category:    "Debt repayment",
+				Merchant:    d.Counterparty,
+				Date:        repayment.Date,
+				User:        user,
+				Notes:       repayment.Note,
+				CreatedAt:   repayment.CreatedAt,
+				UpdatedAt:   repayment.CreatedAt,
+			}
+			bucket, entry, repayment.ExpenseID = expensesBucket, expense, entryID
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucket)).Put([]byte(entryID), data); err != nil {
+			return err
+		}
+
+		d.Repayments = append(d.Repayments, repayment)
+		d.UpdatedAt = repayment.CreatedAt
+		d.refresh(billToday())
+		data, err = json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "debt not found")
+	case err == errOverpayment:
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("%s (%s outstanding)", err, d.Outstanding))
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusCreated, d)
+	}
+}
+
+// deleteDebtRepayment removes a repayment along with its income or expense
+// entry
+func deleteDebtRepayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, repaymentID := vars["id"], vars["repaymentId"]
+	var d Debt
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(debtsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		var kept []DebtRepayment
+		var removed *DebtRepayment
+		for i, p := range d.Repayments {
+			if p.ID == repaymentID {
+				removed = &d.Repayments[i]
+				continue
+			}
+			kept = append(kept, p)
+		}
+		if removed == nil {
+			return errNotFound
+		}
+		j.track(debtsBucket, []byte(id))
+		for bucket, entryID := range map[string]string{incomeBucket: removed.IncomeID, expensesBucket: removed.ExpenseID} {
+			if entryID == "" {
+				continue
+			}
+			j.track(bucket, []byte(entryID))
+			if err := tx.Bucket([]byte(bucket)).Delete([]byte(entryID)); err != nil {
+				return err
+			}
+		}
+		d.Repayments = kept
+		d.refresh(billToday())
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "repayment not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, d)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// notificationChannels are the external channels alerts can go out on
+var notificationChannels = []string{"email", "push", "telegram", "webhook"}
+
+// criticalAlerts go out even during quiet hours
+var criticalAlerts = map[string]bool{
+	"bill.overdue": true,
+}
+
+// channelSenders deliver a batch of alerts to a user on one channel. A
+// channel without a sender has its messages written to the notifications
+// log instead.
+var channelSenders = map[string]func(user string, alerts []Alert) error{}
+
+// NotificationPrefs decide how one household member hears about alerts.
+// Members without saved preferences only see alerts in the notifications
+// center.
+type NotificationPrefs struct {
+	User string `json:"user"`
+	// Email is where the email channel delivers to
+	Email string `json:"email,omitempty"`
+	// Webhook is the URL the webhook channel posts alerts to as JSON
+	Webhook string `json:"webhook,omitempty"`
+	// TelegramChatID is the chat the telegram channel messages, as given
+	// by the bot's getUpdates
+	TelegramChatID string `json:"telegramChatId,omitempty"`
+	// Channels maps an alert type to the channels it goes out on; "*"
+	// covers types not listed. An empty list keeps the type in-app only.
+	Channels map[string][]string `json:"channels"`
+	// Digest lists alert types collected into one daily message instead of
+	// being sent as they happen; "*" digests everything
+	Digest []string `json:"digest"`
+	// DigestHour is the local hour, 0-23, the digest goes out
+	DigestHour int `json:"digestHour"`
+	// QuietHours hold non-critical alerts until they end
+	QuietHours *QuietHours `json:"quietHours,omitempty"`
+	UpdatedAt  string      `json:"updatedAt"`
+}
+
+// QuietHours is a daily local time window such as 22:00-07:00
+type QuietHours struct {
+	Start string `json:"start"` // HH:MM
+	End   string `json:"end"`   // HH:MM
+}
+
+// HeldNotification is an alert waiting in the outbox for a digest or for
+// quiet hours to end
+type HeldNotification struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Channel string `json:"channel"`
+	Alert   Alert  `json:"alert"`
+	Digest  bool   `json:"digest"`
+	HeldAt  string `json:"heldAt"`
+}
+
+func defaultNotificationPrefs(user string) NotificationPrefs {
+	return NotificationPrefs{
+		User:       user,
+		Channels:   map[string][]string{"*": {"push"}},
+		Digest:     []string{},
+		DigestHour: 8,
+	}
+}
+
+func (p *NotificationPrefs) validate() error {
+	if p.Channels == nil {
+		p.Channels = map[string][]string{}
+	}
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil {
+			return fmt.Errorf("email must be an email address")
+		}
+		p.Email = addr.Address
+	}
+	if p.Webhook != "" {
+		u, err := url.Parse(p.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook must be an http or https URL")
+		}
+	}
+	for alertType, channels := range p.Channels {
+		for _, c := range channels {
+			if !validChannel(c) {
+				return fmt.Errorf("channels[%s]: unknown channel %q, must be one of %s", alertType, c, strings.Join(notificationChannels, ", "))
+			}
+			if c == "email" && p.Email == "" {
+				return fmt.Errorf("channels[%s]: the email channel needs an email address", alertType)
+			}
+			if c == "webhook" && p.Webhook == "" {
+				return fmt.Errorf("channels[%s]: the webhook channel needs a webhook URL", alertType)
+			}
+			if c == "telegram" && p.TelegramChatID == "" {
+				return fmt.Errorf("channels[%s]: the telegram channel needs a telegramChatId", alertType)
+			}
+		}
+	}
+	if p.Digest == nil {
+		p.Digest = []string{}
+	}
+	if p.DigestHour < 0 || p.DigestHour > 23 {
+		return fmt.Errorf("digestHour must be 0-23")
+	}
+	if q := p.QuietHours; q != nil {
+		if _, err := time.Parse("15:04", q.Start); err != nil {
+			return fmt.Errorf("quietHours.start must be HH:MM")
+		}
+		if _, err := time.Parse("15:04", q.End); err != nil {
+			return fmt.Errorf("quietHours.end must be HH:MM")
+		}
+	}
+	return nil
+}
+
+func validChannel(c string) bool {
+	for _, known := range notificationChannels {
+		if c == known {
+			return true
+		}
+	}
+	return false
+}
+
+// channelsFor returns the channels an alert type goes out on
+func (p NotificationPrefs) channelsFor(alertType string) []string {
+	if channels, ok := p.Channels[alertType]; ok {
+		return channels
+	}
+	return p.Channels["*"]
+}
+
+func (p NotificationPrefs) digests(alertType string) bool {
+	for _, t := range p.Digest {
+		if t == alertType || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// quiet reports whether t falls in the quiet hours. Windows past midnight
+// wrap around; a window starting and ending at the same time is empty.
+func (p NotificationPrefs) quiet(t time.Time) bool {
+	if p.QuietHours == nil {
+		return false
+	}
+	start, _ := time.Parse("15:04", p.QuietHours.Start)
+	end, _ := time.Parse("15:04", p.QuietHours.End)
+	m := t.Hour()*60 + t.Minute()
+	s := start.Hour()*60 + start.Minute()
+	e := end.Hour()*60 + end.Minute()
+	if s <= e {
+		return m >= s && m < e
+	}
+	return m >= s || m < e
+}
+
+// localizedAlerts renders alerts in a member's language
+func localizedAlerts(user string, alerts []Alert) []Alert {
+	lang := defaultLanguage
+	db.View(func(tx *bolt.Tx) error {
+		if l := userLanguage(tx, user); l != "" {
+			lang = l
+		}
+		return nil
+	})
+	out := make([]Alert, len(alerts))
+	for i, a := range alerts {
+		out[i] = a.localized(lang)
+	}
+	return out
+}
+
+func loadNotificationPrefs(tx *bolt.Tx) ([]NotificationPrefs, error) {
+	prefs := []NotificationPrefs{}
+	err := tx.Bucket([]byte(notificationPrefsBucket)).ForEach(func(k, v []byte) error {
+		var p NotificationPrefs
+		if json.Unmarshal(v, &p) == nil {
+			prefs = append(prefs, p)
+		}
+		return nil
+	})
+	return prefs, err
+}
+
+// sendNotifications hands alerts to a channel's sender in the member's
+// language
+func sendNotifications(user, channel string, alerts []Alert) error {
+	alerts = localizedAlerts(user, alerts)
+	if send, ok := channelSenders[channel]; ok {
+		return send(user, alerts)
+	}
+	logNotifications(user, channel, alerts)
+	return nil
+}
+
+// logNotifications writes alerts to the notifications log in place of
+// sending them
+func logNotifications(user, channel string, alerts []Alert) {
+	for _, a := range alerts {
+		logger("notifications").Info(a.Message, "user", user, "channel", channel, "alert", a.ID)
+	}
+}
+
+// routeAlert sends an alert to every member on the channels they chose,
+// holding it in the outbox when it belongs in a digest or arrives during
+// quiet hours
+func routeAlert(alert Alert) error {
+	var prefs []NotificationPrefs
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		prefs, err = loadNotificationPrefs(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	settings := currentSettings()
+	now := time.Now()
+	var held []HeldNotification
+	var failed error
+	for _, p := range prefs {
+		if !alert.addressedTo(p.User) {
+			continue
+		}
+		digest := p.digests(alert.Type)
+		hold := digest || (!criticalAlerts[alert.Type] && p.quiet(now.In(settings.location(p.User))))
+		for _, channel := range p.channelsFor(alert.Type) {
+			if hold {
+				held = append(held, HeldNotification{User: p.User, Channel: channel, Alert: alert, Digest: digest})
+				continue
+			}
+			if err := sendNotifications(p.User, channel, []Alert{alert}); err != nil {
+				logger("notifications").Error("sending notification", "user", p.User, "channel", channel, "alert", alert.ID, "err", err)
+				failed = err
+			}
+		}
+	}
+	if len(held) > 0 {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(notificationOutboxBucket))
+			for _, h := range held {
+				seq, _ := b.NextSequence()
+				h.ID = fmt.Sprintf("%d-%d", now.UnixNano(), seq)
+				h.HeldAt = now.Format(time.RFC3339)
+				data, err := json.Marshal(h)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(h.ID), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return failed
+}
+
+// flushNotifications releases held alerts: digests at each member's digest
+// hour and everything else once their quiet hours are over. Alerts for one
+// member and channel go out together.
+func flushNotifications() error {
+	var prefs []NotificationPrefs
+	var held []HeldNotification
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		if prefs, err = loadNotificationPrefs(tx); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(notificationOutboxBucket)).ForEach(func(k, v []byte) error {
+			var h HeldNotification
+			if json.Unmarshal(v, &h) == nil {
+				held = append(held, h)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(held) == 0 {
+		return err
+	}
+
+	byUser := map[string]NotificationPrefs{}
+	for _, p := range prefs {
+		byUser[p.User] = p
+	}
+	settings := currentSettings()
+	now := time.Now()
+	type batch struct{ user, channel string }
+	batches := map[batch][]HeldNotification{}
+	for _, h := range held {
+		// Members who removed their preferences get what was held for them
+		if p, ok := byUser[h.User]; ok {
+			local := now.In(settings.location(h.User))
+			if p.quiet(local) || (h.Digest && local.Hour() != p.DigestHour) {
+				continue
+			}
+		}
+		key := batch{h.User, h.Channel}
+		batches[key] = append(batches[key], h)
+	}
+
+	var sent []string
+	var failed error
+	for key, items := range batches {
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+		alerts := make([]Alert, len(items))
+		for i, h := range items {
+			alerts[i] = h.Alert
+		}
+		if err := sendNotifications(key.user, key.channel, alerts); err != nil {
+			logger("notifications").Error("sending held notifications", "user", key.user, "channel", key.channel, "err", err)
+			failed = err
+			continue
+		}
+		for _, h := range items {
+			sent = append(sent, h.ID)
+		}
+	}
+	if len(sent) > 0 {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(notificationOutboxBucket))
+			for _, id := range sent {
+				if err := b.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		logger("scheduler").Info("released held notifications", "notifications", len(sent))
+	}
+	return failed
+}
+
+// NOTIFICATION PREFERENCES
+
+// mayManagePrefs reports whether the caller may see and change a member's
+// preferences: their own, or anyone's for an adult. They say where the
+// member's alerts go, so nobody else may point them elsewhere.
+func mayManagePrefs(r *http.Request, user string) bool {
+	caller := authUser(r)
+	return caller == "" || caller == user || currentSettings().isAdult(caller)
+}
+
+// getAllNotificationPrefs lists every member's preferences to adults, and
+// only their own to anyone else
+func getAllNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	var prefs []NotificationPrefs
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		prefs, err = loadNotificationPrefs(tx)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	visible := prefs[:0]
+	for _, p := range prefs {
+		if mayManagePrefs(r, p.User) {
+			visible = append(visible, p)
+		}
+	}
+	respondJSON(w, http.StatusOK, visible)
+}
+
+// getNotificationPrefs returns a member's preferences, or the defaults
+// they would start from
+func getNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	if !mayManagePrefs(r, user) {
+		respondError(w, http.StatusForbidden, "you can only manage your own notification preferences")
+		return
+	}
+	prefs := defaultNotificationPrefs(user)
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(notificationPrefsBucket)).Get([]byte(user)); v != nil {
+			return json.Unmarshal(v, &prefs)
+		}
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, prefs)
+}
+
+func updateNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	if !mayManagePrefs(r, user) {
+		respondError(w, http.StatusForbidden, "you can only manage your own notification preferences")
+		return
+	}
+	prefs := defaultNotificationPrefs(user)
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := prefs.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefs.User = user
+	prefs.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		data, err := json.Marshal(prefs)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(notificationPrefsBucket)).Put([]byte(user), data)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, prefs)
+}
+
+func deleteNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	if !mayManagePrefs(r, user) {
+		respondError(w, http.StatusForbidden, "you can only manage your own notification preferences")
+		return
+	}
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(notificationPrefsBucket)).Delete([]byte(user))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Notification preferences deleted"})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// demoReadOnlyMiddleware turns away writes from public visitors when the
+// instance runs as a public demo. The admin API keeps working for whoever
+// holds the admin token.
+func demoReadOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config().DemoMode {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-Demo-Mode", "true")
+		if isWriteMethod(r.Method) && !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			respondError(w, http.StatusForbidden, "this is a read-only demo; changes are disabled")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// prepareDemo makes sure a demo instance only ever serves sample data: it
+// refuses to start on a database holding real records, then seeds it.
+func prepareDemo() error {
+	var found string
+	err := db.View(func(tx *bolt.Tx) error {
+		for _, name := range demoBuckets {
+			c := tx.Bucket([]byte(name)).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if !strings.HasPrefix(string(k), demoIDPrefix) {
+					found = name + "/" + string(k)
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if found != "" {
+		return fmt.Errorf("database holds non-demo record %s; point DB_PATH at a separate file for the public demo", found)
+	}
+
+	counts, err := seedDemoData()
+	if err != nil {
+		return err
+	}
+	logger("store").Info("demo mode: seeded sample data", "created", counts)
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// defaultDocumentFolder holds documents filed without a folder
+	defaultDocumentFolder = "Unfiled"
+	// defaultDocumentRemindDays is how long before a document lapses it is
+	// reminded of, unless the document sets its own
+	defaultDocumentRemindDays = 30
+)
+
+// Document is a file kept in the vault that belongs to no transaction:
+// policies, property papers, identity scans. Files are stored beside the
+// database rather than with the public uploads, and only adults can reach
+// them.
+type Document struct {
+	ID     string   `json:"id"`
+	Title  string   `json:"title"`
+	Folder string   `json:"folder"`
+	Labels []string `json:"labels"`
+	Owner  string   `json:"owner,omitempty"` // member the document belongs to
+	// ExpiresOn is when the document lapses, e.g. a passport; reminders go
+	// out RemindDays before
+	ExpiresOn   string `json:"expiresOn,omitempty"`
+	RemindDays  int    `json:"remindDays"`
+	Notes       string `json:"notes,omitempty"`
+	File        string `json:"file"`     // stored name
+	FileName    string `json:"fileName"` // name it was uploaded with
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	UploadedBy  string `json:"uploadedBy"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+}
+
+func (d *Document) validate(settings Settings) error {
+	d.Title = strings.TrimSpace(d.Title)
+	if d.Title == "" {
+		d.Title = d.FileName
+	}
+	if d.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	d.Folder = strings.TrimSpace(d.Folder)
+	if d.Folder == "" {
+		d.Folder = defaultDocumentFolder
+	}
+	seen := map[string]bool{}
+	labels := []string{}
+	for _, label := range d.Labels {
+		if label = strings.TrimSpace(label); label != "" && !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	d.Labels = labels
+	d.Owner = strings.TrimSpace(d.Owner)
+	if d.RemindDays < 0 {
+		return fmt.Errorf("remindDays cannot be negative")
+	}
+	if d.RemindDays == 0 {
+		d.RemindDays = defaultDocumentRemindDays
+	}
+	var err error
+	d.ExpiresOn, err = normalizeDate(d.ExpiresOn, settings.location(d.Owner))
+	return err
+}
+
+// expiring reports whether the document lapses within its reminder window
+// of today, or already has
+func (d Document) expiring(today string) bool {
+	if d.ExpiresOn == "" {
+		return false
+	}
+	t, err := time.Parse(dateLayout, today)
+	return err == nil && d.ExpiresOn <= t.AddDate(0, 0, d.RemindDays).Format(dateLayout)
+}
+
+// documentsDir is where vault files are kept: next to the database, so
+// backups of one carry the other
+func documentsDir() string {
+	return filepath.Join(filepath.Dir(config().DBPath), "documents")
+}
+
+// checkDocumentExpiry reminds the household of documents about to lapse,
+// once per expiry date. Reminders go to the document's owner, or else to
+// the adults, never to children.
+func checkDocumentExpiry() error {
+	now := billToday()
+	var settings Settings
+	var expiring []Document
+	err := db.View(func(tx *bolt.Tx) error {
+		settings = loadSettings(tx)
+		return tx.Bucket([]byte(documentsBucket)).ForEach(func(k, v []byte) error {
+			var d Document
+			if json.Unmarshal(v, &d) == nil && d.expiring(now) {
+				expiring = append(expiring, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range expiring {
+		key := "alert.document.expiring"
+		if d.ExpiresOn < now {
+			key = "alert.document.expired"
+		}
+		alert := newAlert(fmt.Sprintf("document.expiry:%s:%s", d.ID, d.ExpiresOn), "document.expiry", d.ID, key, d.Title, d.ExpiresOn)
+		if d.Owner != "" && settings.isAdult(d.Owner) {
+			alert.Recipients = []string{d.Owner}
+		} else {
+			alert.Recipients = settings.adults()
+		}
+		if _, err := emitAlert(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putDocument(tx *bolt.Tx, d Document) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(documentsBucket)).Put([]byte(d.ID), data)
+}
+
+func loadDocument(tx *bolt.Tx, id string) (Document, error) {
+	var d Document
+	v := tx.Bucket([]byte(documentsBucket)).Get([]byte(id))
+	if v == nil {
+		return d, errNotFound
+	}
+	return d, json.Unmarshal(v, &d)
+}
+
+// splitLabels reads a comma-separated form value
+func splitLabels(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// DOCUMENTS
+
+// getDocuments lists documents by title, optionally only those in one
+// ?folder=, with a ?label=, or ?expiring=true
+func getDocuments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	folder, label, expiring := q.Get("folder"), q.Get("label"), q.Get("expiring") == "true"
+	now := billToday()
+	docs := []Document{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(documentsBucket)), func(k, v []byte) error {
+			var d Document
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if folder != "" && d.Folder != folder {
+				return nil
+			}
+			if label != "" && !slices.Contains(d.Labels, label) {
+				return nil
+			}
+			if expiring && !d.expiring(now) {
+				return nil
+			}
+			docs = append(docs, d)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(docs, func(i, j int) bool { return strings.ToLower(docs[i].Title) < strings.ToLower(docs[j].Title) })
+	respondJSON(w, http.StatusOK, docs)
+}
+
+// getDocumentFolders counts documents by folder and by label, for browsing
+// the vault
+func getDocumentFolders(w http.ResponseWriter, r *http.Request) {
+	folders, labels := map[string]int{}, map[string]int{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(documentsBucket)), func(k, v []byte) error {
+			var d Document
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			folders[d.Folder]++
+			for _, l := range d.Labels {
+				labels[l]++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	type count struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	sorted := func(m map[string]int) []count {
+		list := []count{}
+		for name, n := range m {
+			list = append(list, count{name, n})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		return list
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"folders": sorted(folders),
+		"labels":  sorted(labels),
+	})
+}
+
+// createDocument stores an uploaded file in the vault. The multipart form
+// carries the file and the document's title, folder, comma-separated
+// labels, owner, expiresOn, remindDays and notes.
+func createDocument(w http.ResponseWriter, r *http.Request) {
+	dir := documentsDir()
+	file, header, err := saveUpload(r, dir)
+	if err == errNoUpload {
+		respondError(w, http.StatusBadRequest, "Error retrieving file")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Error saving file")
+		return
+	}
+	now := time.Now()
+	d := Document{
+		ID:          fmt.Sprintf("%d", now.UnixNano()),
+		Title:       r.FormValue("title"),
+		Folder:      r.FormValue("folder"),
+		Labels:      splitLabels(r.FormValue("labels")),
+		Owner:       r.FormValue("owner"),
+		ExpiresOn:   r.FormValue("expiresOn"),
+		Notes:       r.FormValue("notes"),
+		File:        file,
+		FileName:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		UploadedBy:  requestActor(r),
+		CreatedAt:   now.Format(time.RFC3339),
+		UpdatedAt:   now.Format(time.RFC3339),
+	}
+	if days := r.FormValue("remindDays"); days != "" {
+		if d.RemindDays, err = strconv.Atoi(days); err != nil {
+			os.Remove(filepath.Join(dir, file))
+			respondError(w, http.StatusBadRequest, "remindDays must be a number")
+			return
+		}
+	}
+	if err := d.validate(currentSettings()); err != nil {
+		os.Remove(filepath.Join(dir, file))
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		return putDocument(tx, d)
+	})
+	if err != nil {
+		os.Remove(filepath.Join(dir, file))
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, d)
+}
+
+// updateDocument edits a document's details; the file itself is kept
+func updateDocument(w http.ResponseWriter, r *http.Request) {
+	var d Document
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := d.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id := mux.Vars(r)["id"]
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		old, err := loadDocument(tx, id)
+		if err != nil {
+			return err
+		}
+		d.ID = id
+		d.File, d.FileName, d.ContentType, d.Size = old.File, old.FileName, old.ContentType, old.Size
+		d.UploadedBy, d.CreatedAt = old.UploadedBy, old.CreatedAt
+		d.UpdatedAt = time.Now().Format(time.RFC3339)
+		return putDocument(tx, d)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, d)
+}
+
+// deleteDocument removes a document from the vault. Its file stays on disk
+// so the deletion can be undone.
+func deleteDocument(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(documentsBucket, []byte(id))
+		return tx.Bucket([]byte(documentsBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Document deleted"})
+}
+
+// getDocumentFile downloads a document's file under its original name
+func getDocumentFile(w http.ResponseWriter, r *http.Request) {
+	var d Document
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		d, err = loadDocument(tx, mux.Vars(r)["id"])
+		return err
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	f, err := os.Open(filepath.Join(documentsDir(), filepath.Base(d.File)))
+	if err != nil {
+		respondError(w, http.StatusNotFound, "document file not found")
+		return
+	}
+	defer f.Close()
+	if d.ContentType != "" {
+		w.Header().Set("Content-Type", d.ContentType)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.FileName}))
+	modified, _ := time.Parse(time.RFC3339, d.CreatedAt)
+	http.ServeContent(w, r, d.FileName, modified, f)
+}
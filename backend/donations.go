@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	donationModes = []string{"online", "cheque", "cash"}
+	panPattern    = regexp.MustCompile(`^[A-Z]{5}[0-9]{4}[A-Z]$`)
+)
+
+// cashDonationLimit is the largest cash donation 80G allows a deduction
+// for, in rupees
+const cashDonationLimit = 2000 * majorUnit
+
+// Donation marks an expense as a gift to a charity, with the donee details
+// an 80G claim needs
+type Donation struct {
+	Organization string `json:"organization"`
+	PAN          string `json:"pan,omitempty"`          // the donee's
+	Registration string `json:"registration,omitempty"` // 80G registration number
+	// DeductionPercent is how much of the gift 80G allows: 50 or 100
+	DeductionPercent int    `json:"deductionPercent"`
+	Mode             string `json:"mode"` // online, cheque or cash
+	ReceiptNumber    string `json:"receiptNumber,omitempty"`
+}
+
+// validateDonation checks an expense's donee details
+func validateDonation(e *Expense) error {
+	d := e.Donation
+	if d == nil {
+		return nil
+	}
+	d.Organization = strings.TrimSpace(d.Organization)
+	if d.Organization == "" {
+		return fmt.Errorf("donation.organization is required")
+	}
+	d.PAN = strings.ToUpper(strings.TrimSpace(d.PAN))
+	if d.PAN != "" && !panPattern.MatchString(d.PAN) {
+		return fmt.Errorf("donation.pan must be a PAN such as AAATC1234F")
+	}
+	if d.DeductionPercent == 0 {
+		d.DeductionPercent = 50
+	}
+	if d.DeductionPercent != 50 && d.DeductionPercent != 100 {
+		return fmt.Errorf("donation.deductionPercent must be 50 or 100")
+	}
+	if d.Mode == "" {
+		d.Mode = "online"
+	}
+	if err := oneOf("donation.mode", d.Mode, donationModes); err != nil {
+		return err
+	}
+	d.Registration = strings.TrimSpace(d.Registration)
+	d.ReceiptNumber = strings.TrimSpace(d.ReceiptNumber)
+	return nil
+}
+
+// DonationEntry is one donation in the report, in the base currency
+type DonationEntry struct {
+	ExpenseID     string   `json:"expenseId"`
+	Date          string   `json:"date"`
+	Amount        Money    `json:"amount"`
+	Mode          string   `json:"mode"`
+	ReceiptNumber string   `json:"receiptNumber,omitempty"`
+	Percent       int      `json:"deductionPercent"`
+	Deductible    Money    `json:"deductible"` // 0 for cash over the limit
+	Attachments   []string `json:"attachments"`
+}
+
+// DonationGroup totals the donations to one organization
+type DonationGroup struct {
+	Organization string          `json:"organization"`
+	PAN          string          `json:"pan,omitempty"`
+	Registration string          `json:"registration,omitempty"`
+	Total        Money           `json:"total"`
+	Deductible   Money           `json:"deductible"`
+	Donations    []DonationEntry `json:"donations"`
+}
+
+// DonationReport is a financial year's donations by organization
+type DonationReport struct {
+	FiscalYear            string          `json:"fiscalYear"`
+	Start                 string          `json:"start"`
+	End                   string          `json:"end"`
+	Currency              string          `json:"currency"`
+	UnconvertedCurrencies []string        `json:"unconvertedCurrencies"`
+	Total                 Money           `json:"total"`
+	Deductible            Money           `json:"deductible"`
+	Organizations         []DonationGroup `json:"organizations"`
+}
+
+// donationReport gathers the donations the caller can see made in a
+// financial year, with the receipts they list and those attached to them.
+// Donations to the same PAN, or failing that the same name, are grouped
+// together.
+func donationReport(r *http.Request, settings Settings, label string, period Period) (DonationReport, error) {
+	conv := newConverter(settings, settings.BaseCurrency)
+	var cashLimit Money
+	conv.add(&cashLimit, cashDonationLimit, "INR")
+	report := DonationReport{FiscalYear: label, Start: period.Start, End: period.End, Currency: settings.BaseCurrency}
+	groups := map[string]*DonationGroup{}
+	user := authUser(r)
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			d := e.Donation
+			if d == nil || !period.contains(e.Date) || !e.visibleTo(user) {
+				return nil
+			}
+			entry := DonationEntry{ExpenseID: e.ID, Date: e.Date, Mode: d.Mode, ReceiptNumber: d.ReceiptNumber,
+				Percent: d.DeductionPercent, Attachments: append([]string{}, e.Attachments...)}
+			for _, a := range expenseAttachments(tx, e.ID) {
+				entry.Attachments = append(entry.Attachments, publicURL(r, "/uploads/"+a.File))
+			}
+			if !conv.add(&entry.Amount, e.Amount, e.Currency) {
+				return nil
+			}
+			if d.Mode != "cash" || entry.Amount <= cashLimit {
+				entry.Deductible = entry.Amount * Money(d.DeductionPercent) / 100
+			}
+			key := d.PAN
+			if key == "" {
+				key = strings.ToLower(d.Organization)
+			}
+			g, ok := groups[key]
+			if !ok {
+				g = &DonationGroup{Organization: d.Organization, PAN: d.PAN}
+				groups[key] = g
+			}
+			if d.Registration != "" {
+				g.Registration = d.Registration
+			}
+			g.Total += entry.Amount
+			g.Deductible += entry.Deductible
+			g.Donations = append(g.Donations, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Organizations = []DonationGroup{}
+	for _, g := range groups {
+		sort.Slice(g.Donations, func(i, j int) bool { return g.Donations[i].Date < g.Donations[j].Date })
+		report.Total += g.Total
+		report.Deductible += g.Deductible
+		report.Organizations = append(report.Organizations, *g)
+	}
+	sort.Slice(report.Organizations, func(i, j int) bool {
+		return report.Organizations[i].Organization < report.Organizations[j].Organization
+	})
+	report.UnconvertedCurrencies = conv.unconverted()
+	return report, nil
+}
+
+// receiptFile is the path of an uploaded attachment, by its URL, or "" when
+// it isn't one of ours
+func receiptFile(url string) string {
+	i := strings.Index(url, "/uploads/")
+	if i < 0 {
+		return ""
+	}
+	return filepath.Join(uploadsDir, path.Base(url[i:]))
+}
+
+// writeDonationExport writes the report as CSV with each donation's
+// receipts, as a zip
+func writeDonationExport(w io.Writer, report DonationReport) error {
+	z := zip.NewWriter(w)
+	var receipts [][2]string // archive name, file
+	rows := [][]string{{"Organization", "PAN", "Registration", "Date", "Amount", "Currency", "Mode",
+		"Receipt number", "Deduction %", "Deductible", "Receipts"}}
+	for _, g := range report.Organizations {
+		for _, d := range g.Donations {
+			var names []string
+			for i, url := range d.Attachments {
+				file := receiptFile(url)
+				if file == "" {
+					continue
+				}
+				name := fmt.Sprintf("receipts/%s-%s-%d%s", d.Date, d.ExpenseID, i+1, filepath.Ext(file))
+				receipts = append(receipts, [2]string{name, file})
+				names = append(names, name)
+			}
+			rows = append(rows, []string{g.Organization, g.PAN, g.Registration, d.Date, d.Amount.String(),
+				report.Currency, d.Mode, d.ReceiptNumber, strconv.Itoa(d.Percent), d.Deductible.String(),
+				strings.Join(names, " ")})
+		}
+	}
+	rows = append(rows, []string{"Total", "", "", "", report.Total.String(), report.Currency, "", "", "",
+		report.Deductible.String(), ""})
+
+	f, err := z.Create("donations.csv")
+	if err != nil {
+		return err
+	}
+	if err := csv.NewWriter(f).WriteAll(rows); err != nil {
+		return err
+	}
+	for _, receipt := range receipts {
+		if err := addZipFile(z, receipt[0], receipt[1]); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// addZipFile copies a file into the archive. A receipt that has gone
+// missing from disk is skipped rather than failing the export.
+func addZipFile(z *zip.Writer, name, file string) error {
+	src, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// DONATIONS
+
+// getDonationReport returns ?year='s donations by organization for an 80G
+// claim. ?year= is the year the financial year starts in, default the
+// running one.
+func getDonationReport(w http.ResponseWriter, r *http.Request) {
+	settings := currentSettings()
+	label, period, err := fiscalYearParam(r.URL.Query().Get("year"), settings, time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := donationReport(r, settings, label, period)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
+
+// exportDonations downloads the donation report as a zip of a CSV and the
+// receipts attached to the donations
+func exportDonations(w http.ResponseWriter, r *http.Request) {
+	settings := currentSettings()
+	label, period, err := fiscalYearParam(r.URL.Query().Get("year"), settings, time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := donationReport(r, settings, label, period)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": "donations-" + report.FiscalYear + ".zip"}))
+	if err := writeDonationExport(w, report); err != nil {
+		logger("http").Error("donation export failed", "err", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxDuplicateDays bounds the ?days= window of the duplicate scan
+const maxDuplicateDays = 30
+
+// DuplicateGroup is a set of expenses that look like one charge recorded
+// more than once: the same amount paid to the same merchant on dates close
+// together. Expenses are oldest first.
+type DuplicateGroup struct {
+	Amount   Money     `json:"amount"`
+	Currency string    `json:"currency"`
+	Merchant string    `json:"merchant"`
+	Expenses []Expense `json:"expenses"`
+}
+
+// ExpenseMerge names the expenses to fold into another
+type ExpenseMerge struct {
+	IDs []string `json:"ids"`
+}
+
+// mergeProblem is a merge the request asks for wrongly
+type mergeProblem string
+
+func (p mergeProblem) Error() string { return string(p) }
+
+// duplicateGroups groups expenses with the same amount, currency and payee
+// whose dates are at most days apart, each from the one before it
+func duplicateGroups(expenses []Expense, days int) []DuplicateGroup {
+	byCharge := map[string][]Expense{}
+	for _, e := range expenses {
+		key := chargeKey(e)
+		if key == "" || e.Amount <= 0 {
+			continue
+		}
+		key = e.Currency + "\x00" + e.Amount.String() + "\x00" + key
+		byCharge[key] = append(byCharge[key], e)
+	}
+	var groups []DuplicateGroup
+	for _, list := range byCharge {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Date != list[j].Date {
+				return list[i].Date < list[j].Date
+			}
+			return list[i].before(list[j])
+		})
+		start := 0
+		for i := 1; i <= len(list); i++ {
+			if i < len(list) {
+				if d := daysApart(list[i-1].Date, list[i].Date); d >= 0 && d <= days {
+					continue
+				}
+			}
+			if i-start > 1 {
+				run := list[start:i]
+				merchant := run[0].Merchant
+				if merchant == "" {
+					merchant = run[0].Description
+				}
+				groups = append(groups, DuplicateGroup{Amount: run[0].Amount, Currency: run[0].Currency,
+					Merchant: merchant, Expenses: run})
+			}
+			start = i
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i].Expenses, groups[j].Expenses
+		if a[len(a)-1].Date != b[len(b)-1].Date {
+			return a[len(a)-1].Date > b[len(b)-1].Date
+		}
+		return a[0].ID > b[0].ID
+	})
+	return groups
+}
+
+// mergeExpenses folds the expenses ids into keep and deletes them. Their
+// comments and attachments move to keep, as do their tags, attached files
+// and any details keep lacks; pending transactions approved as them point
+// at keep instead.
+func mergeExpenses(tx *bolt.Tx, j *undoJournal, keepID string, ids []string, user string) (Expense, error) {
+	b := tx.Bucket([]byte(expensesBucket))
+	read := func(id string) (Expense, error) {
+		var e Expense
+		v := b.Get([]byte(id))
+		if v == nil {
+			return e, errNotFound
+		}
+		if err := json.Unmarshal(v, &e); err != nil {
+			return e, err
+		}
+		if user != "" && !e.visibleTo(user) {
+			return e, errNotFound
+		}
+		return e, nil
+	}
+	keep, err := read(keepID)
+	if err != nil {
+		return keep, err
+	}
+	merged := map[string]bool{}
+	for _, id := range ids {
+		if id == keepID || merged[id] {
+			return keep, mergeProblem("ids must name other expenses, each once")
+		}
+		merged[id] = true
+		e, err := read(id)
+		if err != nil {
+			return keep, err
+		}
+		if e.ClaimID != "" && e.ClaimID != keep.ClaimID {
+			return keep, errExpenseClaimed
+		}
+		j.track(expensesBucket, []byte(id))
+		if err := b.Delete([]byte(id)); err != nil {
+			return keep, err
+		}
+		for _, fill := range []struct{ to, from *string }{
+			{&keep.Description, &e.Description}, {&keep.Category, &e.Category}, {&keep.Merchant, &e.Merchant},
+			{&keep.AccountID, &e.AccountID}, {&keep.Notes, &e.Notes},
+		} {
+			if *fill.to == "" {
+				*fill.to = *fill.from
+			}
+		}
+		keep.Tags = normalizeTags(append(keep.Tags, e.Tags...))
+		for _, url := range e.Attachments {
+			if !slices.Contains(keep.Attachments, url) {
+				keep.Attachments = append(keep.Attachments, url)
+			}
+		}
+	}
+
+	if err := repointRecords(tx, j, commentsBucket, merged, keepID, func(c *ExpenseComment) *string { return &c.ExpenseID }); err != nil {
+		return keep, err
+	}
+	if err := repointRecords(tx, j, attachmentsBucket, merged, keepID, func(a *Attachment) *string { return &a.ExpenseID }); err != nil {
+		return keep, err
+	}
+	if err := repointRecords(tx, j, pendingBucket, merged, keepID, func(p *PendingTransaction) *string { return &p.ExpenseID }); err != nil {
+		return keep, err
+	}
+
+	j.track(expensesBucket, []byte(keepID))
+	keep.CommentCount = countComments(tx, keepID)
+	keep.HasAttachments = len(keep.Attachments) > 0 || len(expenseAttachments(tx, keepID)) > 0
+	keep.UpdatedAt = time.Now().Format(time.RFC3339)
+	return keep, putExpense(tx, keep)
+}
+
+// repointRecords moves the records of a bucket whose expense, the field
+// ref points to, was merged onto keepID
+func repointRecords[T any](tx *bolt.Tx, j *undoJournal, bucket string, merged map[string]bool, keepID string, ref func(*T) *string) error {
+	b := tx.Bucket([]byte(bucket))
+	type update struct{ key, value []byte }
+	var updates []update
+	err := b.ForEach(func(k, v []byte) error {
+		var record T
+		if json.Unmarshal(v, &record) != nil || !merged[*ref(&record)] {
+			return nil
+		}
+		*ref(&record) = keepID
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, update{append([]byte(nil), k...), data})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		j.track(bucket, u.key)
+		if err := b.Put(u.key, u.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DUPLICATES
+
+// getDuplicateExpenses lists groups of expenses that look like one charge
+// recorded twice, newest first. ?days= widens how far apart their dates
+// may be, from one day.
+func getDuplicateExpenses(w http.ResponseWriter, r *http.Request) {
+	days := duplicateChargeDays
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxDuplicateDays {
+			respondError(w, http.StatusBadRequest, "days must be a number from 0 to "+strconv.Itoa(maxDuplicateDays))
+			return
+		}
+		days = n
+	}
+	user := authUser(r)
+	var expenses []Expense
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.visibleTo(user) {
+				expenses = append(expenses, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	groups := duplicateGroups(expenses, days)
+	if groups == nil {
+		groups = []DuplicateGroup{}
+	}
+	respondJSON(w, http.StatusOK, groups)
+}
+
+// mergeExpense folds the duplicates named in the body into the expense and
+// answers with it; the action header undoes the merge
+func mergeExpense(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req ExpenseMerge
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.IDs) == 0 {
+		respondError(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	var expense Expense
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		var err error
+		expense, err = mergeExpenses(tx, j, id, req.IDs, authUser(r))
+		return err
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	case err == errExpenseClaimed:
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		if p, ok := err.(mergeProblem); ok {
+			respondError(w, http.StatusBadRequest, string(p))
+			return
+		}
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, merged := range req.IDs {
+		publishWebhook("expense.deleted", map[string]string{"id": merged})
+	}
+	publishWebhook("expense.updated", expense)
+	respondUndoable(w, http.StatusOK, actionID, expense)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sendMail hands a message to the SMTP server; tests replace it
+var sendMail = smtp.SendMail
+
+func init() {
+	channelSenders["email"] = emailAlerts
+}
+
+// emailAlerts sends a member their alerts in one email, to the address in
+// their notification preferences. Without an SMTP server the alerts are
+// only logged.
+func emailAlerts(user string, alerts []Alert) error {
+	c := config()
+	if c.SMTPHost == "" {
+		logNotifications(user, "email", alerts)
+		return nil
+	}
+	var prefs NotificationPrefs
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(notificationPrefsBucket)).Get([]byte(user)); v != nil {
+			return json.Unmarshal(v, &prefs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if prefs.Email == "" {
+		return fmt.Errorf("no email address for %s", user)
+	}
+	from, err := mail.ParseAddress(c.SMTPFrom)
+	if err != nil {
+		return err
+	}
+
+	subject := alerts[0].Message
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("%d notifications from Family Finance", len(alerts))
+	}
+	var body strings.Builder
+	for _, a := range alerts {
+		body.WriteString(a.Message + "\r\n")
+		// Links need a known origin; there is no request to take it from
+		if a.Link != "" && c.BaseURL != "" {
+			body.WriteString(strings.TrimRight(c.BaseURL, "/") + "/" + strings.TrimLeft(a.Link, "/") + "\r\n")
+		}
+	}
+	msg := "From: " + from.String() + "\r\n" +
+		"To: " + prefs.Email + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body.String()
+
+	var auth smtp.Auth
+	if c.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, c.SMTPHost)
+	}
+	addr := net.JoinHostPort(c.SMTPHost, strconv.Itoa(c.SMTPPort))
+	return sendMail(addr, auth, from.Address, []string{prefs.Email}, []byte(msg))
+}
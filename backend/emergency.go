@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const emergencyFundKey = "emergency-fund"
+
+// EmergencyFundConfig is how the household sizes its emergency fund and
+// where the money for it is kept. It lives in the settings bucket.
+type EmergencyFundConfig struct {
+	TargetMonths float64 `json:"targetMonths"` // months of essential spend to hold
+	// AlertBelowMonths raises an alert when coverage falls under it
+	AlertBelowMonths float64 `json:"alertBelowMonths"`
+	// TrailingMonths is how many full months the essential spend is
+	// averaged over
+	TrailingMonths      int      `json:"trailingMonths"`
+	EssentialCategories []string `json:"essentialCategories"`
+	// The fund is the sum of a goal's savings, investments and a balance
+	// kept elsewhere, all optional
+	GoalID        string   `json:"goalId,omitempty"`
+	InvestmentIDs []string `json:"investmentIds,omitempty"`
+	Balance       Money    `json:"balance"`
+	Currency      string   `json:"currency"` // of Balance
+	UpdatedAt     string   `json:"updatedAt,omitempty"`
+}
+
+func defaultEmergencyFundConfig() EmergencyFundConfig {
+	return EmergencyFundConfig{
+		TargetMonths:        6,
+		AlertBelowMonths:    3,
+		TrailingMonths:      6,
+		EssentialCategories: []string{"Groceries", "Utilities", "Health", "Transport"},
+	}
+}
+
+func (c *EmergencyFundConfig) validate(settings Settings) error {
+	if c.TargetMonths <= 0 || c.TargetMonths > 36 {
+		return fmt.Errorf("targetMonths must be between 0 and 36")
+	}
+	if c.AlertBelowMonths < 0 || c.AlertBelowMonths > c.TargetMonths {
+		return fmt.Errorf("alertBelowMonths must be between 0 and targetMonths")
+	}
+	if c.TrailingMonths < 1 || c.TrailingMonths > 24 {
+		return fmt.Errorf("trailingMonths must be between 1 and 24")
+	}
+	categories := []string{}
+	for _, category := range c.EssentialCategories {
+		if category = strings.TrimSpace(category); category != "" {
+			categories = append(categories, category)
+		}
+	}
+	if len(categories) == 0 {
+		return fmt.Errorf("essentialCategories cannot be empty")
+	}
+	c.EssentialCategories = categories
+	if c.Balance < 0 {
+		return fmt.Errorf("balance cannot be negative")
+	}
+	var err error
+	c.Currency, err = normalizeCurrency(c.Currency, settings.BaseCurrency)
+	return err
+}
+
+func loadEmergencyFundConfig(tx *bolt.Tx) EmergencyFundConfig {
+	c := defaultEmergencyFundConfig()
+	if v := tx.Bucket([]byte(settingsBucket)).Get([]byte(emergencyFundKey)); v != nil {
+		json.Unmarshal(v, &c)
+	}
+	return c
+}
+
+// EmergencyFund is the computed state of the fund, in the base currency
+type EmergencyFund struct {
+	Config EmergencyFundConfig `json:"config"`
+	// MonthlyEssential is the average essential spend of the trailing
+	// months
+	MonthlyEssential Money  `json:"monthlyEssential"`
+	Since            string `json:"since"` // first day averaged
+	Target           Money  `json:"target"`
+	Current          Money  `json:"current"`
+	Shortfall        Money  `json:"shortfall"`
+	// CoverageMonths is how many months of essential spend the fund
+	// covers; 0 while there is no essential spend to measure against
+	CoverageMonths        float64  `json:"coverageMonths"`
+	Low                   bool     `json:"low"`
+	Currency              string   `json:"currency"`
+	UnconvertedCurrencies []string `json:"unconvertedCurrencies"`
+}
+
+// emergencyFund works the fund out as of now from what user can see, the
+// whole household's when user is empty. Essential spend is averaged over
+// the trailing full months, leaving out the running one.
+func emergencyFund(tx *bolt.Tx, now time.Time, user string) EmergencyFund {
+	settings := loadSettings(tx)
+	conv := newConverter(settings, settings.BaseCurrency)
+	c := loadEmergencyFundConfig(tx)
+	now = now.In(settings.location(""))
+	end := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	window := Period{Start: end.AddDate(0, -c.TrailingMonths, 0).Format(dateLayout), End: end.Format(dateLayout)}
+
+	essential := map[string]bool{}
+	for _, category := range c.EssentialCategories {
+		essential[category] = true
+	}
+	var spent Money
+	tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) != nil || !e.personal() || !e.visibleTo(user) || !window.contains(e.Date) {
+			return nil
+		}
+		for _, part := range e.categoryParts() {
+			if essential[part.Category] {
+				conv.add(&spent, part.Amount, e.Currency)
+			}
+		}
+		return nil
+	})
+
+	f := EmergencyFund{Config: c, Since: window.Start, Currency: settings.BaseCurrency}
+	f.MonthlyEssential = spent / Money(c.TrailingMonths)
+	f.Target = Money(math.Round(float64(f.MonthlyEssential) * c.TargetMonths))
+
+	conv.add(&f.Current, c.Balance, c.Currency)
+	if c.GoalID != "" {
+		var g Goal
+		if v := tx.Bucket([]byte(goalsBucket)).Get([]byte(c.GoalID)); v != nil && json.Unmarshal(v, &g) == nil && g.visibleTo(user) {
+			conv.add(&f.Current, g.Current, g.Currency)
+		}
+	}
+	for _, id := range c.InvestmentIDs {
+		var inv Investment
+		if v := tx.Bucket([]byte(investmentsBucket)).Get([]byte(id)); v != nil && json.Unmarshal(v, &inv) == nil {
+			conv.add(&f.Current, inv.Value, inv.Currency)
+		}
+	}
+	if f.Current < f.Target {
+		f.Shortfall = f.Target - f.Current
+	}
+	if f.MonthlyEssential > 0 {
+		f.CoverageMonths = math.Round(float64(f.Current)/float64(f.MonthlyEssential)*10) / 10
+		f.Low = f.CoverageMonths < c.AlertBelowMonths
+	}
+	f.UnconvertedCurrencies = conv.unconverted()
+	return f
+}
+
+// checkEmergencyFund alerts when the fund covers fewer months than the
+// configured threshold, at most once a month
+func checkEmergencyFund() error {
+	var f EmergencyFund
+	now := time.Now()
+	err := db.View(func(tx *bolt.Tx) error {
+		f = emergencyFund(tx, now, "")
+		return nil
+	})
+	if err != nil || !f.Low {
+		return err
+	}
+	month := billToday()[:7]
+	_, err = emitAlert(newAlert("emergencyFund.low:"+month, "emergencyFund.low", emergencyFundKey,
+		"alert.emergencyFund.low", fmt.Sprintf("%.1f", f.CoverageMonths), fmt.Sprintf("%g", f.Config.TargetMonths),
+		formatMoney(f.Shortfall, f.Currency)))
+	return err
+}
+
+// EMERGENCY FUND
+
+func getEmergencyFund(w http.ResponseWriter, r *http.Request) {
+	var f EmergencyFund
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		f = emergencyFund(tx, time.Now(), authUser(r))
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, f)
+}
+
+// updateEmergencyFund replaces the fund's configuration; fields left out
+// take their defaults
+func updateEmergencyFund(w http.ResponseWriter, r *http.Request) {
+	c := defaultEmergencyFundConfig()
+	c.EssentialCategories = nil
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if c.EssentialCategories == nil {
+		c.EssentialCategories = defaultEmergencyFundConfig().EssentialCategories
+	}
+	if err := c.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.UpdatedAt = time.Now().Format(time.RFC3339)
+	var f EmergencyFund
+	var missing string
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		if c.GoalID != "" && tx.Bucket([]byte(goalsBucket)).Get([]byte(c.GoalID)) == nil {
+			missing = "goal " + c.GoalID
+			return errNotFound
+		}
+		for _, id := range c.InvestmentIDs {
+			if tx.Bucket([]byte(investmentsBucket)).Get([]byte(id)) == nil {
+				missing = "investment " + id
+				return errNotFound
+			}
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(settingsBucket)).Put([]byte(emergencyFundKey), data); err != nil {
+			return err
+		}
+		f = emergencyFund(tx, time.Now(), authUser(r))
+		return nil
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusBadRequest, missing+" not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, f)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrorReport is what gets sent for a panic or 5xx response. It carries no
+// request bodies, header values or query values, which may hold financial data.
+type ErrorReport struct {
+	Time      string   `json:"time"`
+	RequestID string   `json:"requestId"`
+	Method    string   `json:"method"`
+	Route     string   `json:"route"`
+	Path      string   `json:"path"`
+	QueryKeys []string `json:"queryKeys,omitempty"`
+	Status    int      `json:"status"`
+	Message   string   `json:"message"`
+	Panic     bool     `json:"panic"`
+	Stack     string   `json:"stack,omitempty"`
+	Role      string   `json:"role"`
+}
+
+// errorReports buffers reports for the sender goroutine. When it is full,
+// new reports are dropped rather than slowing requests down.
+var errorReports = make(chan ErrorReport, 64)
+
+var errorReportClient = &http.Client{Timeout: 10 * time.Second}
+
+// startErrorReporter sends buffered reports to the configured Sentry DSN
+// and/or webhook. Nothing is sent while neither is set.
+func startErrorReporter() {
+	go func() {
+		log := logger("errors")
+		for report := range errorReports {
+			c := config()
+			if c.SentryDSN != "" {
+				if err := sendToSentry(c.SentryDSN, report); err != nil {
+					log.Warn("sending error report to sentry failed", "err", err)
+				}
+			}
+			if c.ErrorWebhookURL != "" {
+				if err := postJSON(c.ErrorWebhookURL, nil, report); err != nil {
+					log.Warn("sending error report to webhook failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+func reportError(report ErrorReport) {
+	c := config()
+	if c.SentryDSN == "" && c.ErrorWebhookURL == "" {
+		return
+	}
+	report.Time = time.Now().Format(time.RFC3339)
+	report.Role = c.Role
+	select {
+	case errorReports <- report:
+	default:
+		logger("errors").Warn("error report dropped, queue full", "requestId", report.RequestID)
+	}
+}
+
+// errorReportMiddleware recovers panics into a 500 and reports them along
+// with any other 5xx response.
+func errorReportMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &errorRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		report := ErrorReport{
+			RequestID: requestID(r),
+			Method:    r.Method,
+			Route:     routeTemplate(r),
+			Path:      r.URL.Path,
+		}
+		for key := range r.URL.Query() {
+			report.QueryKeys = append(report.QueryKeys, key)
+		}
+		sort.Strings(report.QueryKeys)
+
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				logger("http").Error("handler panicked", "requestId", report.RequestID, "panic", p)
+				report.Status = http.StatusInternalServerError
+				report.Message = fmt.Sprint(p)
+				report.Panic = true
+				report.Stack = string(debug.Stack())
+				reportError(report)
+				if !rec.wroteHeader {
+					respondError(rec, http.StatusInternalServerError, "internal server error")
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= 500 {
+			report.Status = rec.status
+			var body struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(rec.body.Bytes(), &body)
+			report.Message = body.Error
+			reportError(report)
+		}
+	})
+}
+
+// errorRecorder keeps the start of 5xx response bodies so the error
+// message can go into the report.
+type errorRecorder struct {
+	statusRecorder
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (e *errorRecorder) WriteHeader(code int) {
+	e.wroteHeader = true
+	e.statusRecorder.WriteHeader(code)
+}
+
+func (e *errorRecorder) Write(p []byte) (int, error) {
+	e.wroteHeader = true
+	if e.status >= 500 && e.body.Len() < 1024 {
+		e.body.Write(p[:min(len(p), 1024-e.body.Len())])
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+// routeTemplate returns the matched mux route, e.g. /api/expenses/{id}
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
+
+// sendToSentry posts the report to Sentry's store endpoint. The DSN has the
+// form https://<key>@<host>/<project>.
+func sendToSentry(dsn string, report ErrorReport) error {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		return fmt.Errorf("invalid sentry DSN")
+	}
+	key := u.User.Username()
+	project := strings.TrimPrefix(u.Path, "/")
+	endpoint := fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	level := "error"
+	if report.Panic {
+		level = "fatal"
+	}
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   report.Time,
+		"level":       level,
+		"platform":    "go",
+		"logger":      "family-finance-api",
+		"message":     fmt.Sprintf("%s %s: %s", report.Method, report.Route, report.Message),
+		"transaction": report.Method + " " + report.Route,
+		"tags": map[string]string{
+			"request_id": report.RequestID,
+			"route":      report.Route,
+			"status":     fmt.Sprint(report.Status),
+			"role":       report.Role,
+		},
+		"extra": report,
+	}
+	header := http.Header{}
+	header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=family-finance-api/1.0, sentry_key=%s", key))
+	return postJSON(endpoint, header, event)
+}
+
+func postJSON(endpoint string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// exportTable is a list of records laid out for a spreadsheet. Cells are
+// strings, or Money for amounts so spreadsheets can sum them.
+type exportTable struct {
+	Name    string
+	Headers []string
+	Rows    [][]interface{}
+}
+
+// exportTypes are the record types GET /export serves, with the bucket
+// each is read from
+var exportTypes = map[string]string{
+	"expenses":    expensesBucket,
+	"income":      incomeBucket,
+	"budgets":     budgetsBucket,
+	"goals":       goalsBucket,
+	"bills":       billsBucket,
+	"investments": investmentsBucket,
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// exportRow lays out one stored record of the given type, reporting false
+// for records the filter leaves out
+func exportRow(kind string, v []byte, f listFilter) ([]interface{}, bool, error) {
+	switch kind {
+	case "expenses":
+		var e Expense
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, false, err
+		}
+		return []interface{}{e.Date, e.Description, e.Category, e.Merchant, e.Amount, e.Currency, e.User,
+			yesNo(e.IsShared), e.Notes, e.ID}, f.matches(expenseFields(e)), nil
+	case "income":
+		var i Income
+		if err := json.Unmarshal(v, &i); err != nil {
+			return nil, false, err
+		}
+		return []interface{}{i.Date, i.Source, i.Description, i.Amount, i.Currency, i.User,
+			yesNo(i.IsRecurring), i.ID}, f.matches(incomeFields(i)), nil
+	case "budgets":
+		var b Budget
+		if err := json.Unmarshal(v, &b); err != nil {
+			return nil, false, err
+		}
+		return []interface{}{b.Month, b.Name, b.Category, b.Limit, b.Currency, yesNo(b.IsRecurring), b.ID},
+			b.visibleTo(f.Viewer), nil
+	case "goals":
+		var g Goal
+		if err := json.Unmarshal(v, &g); err != nil {
+			return nil, false, err
+		}
+		return []interface{}{g.Name, g.Target, g.Current, g.Currency, g.Deadline, g.Status, g.ID},
+			g.visibleTo(f.Viewer), nil
+	case "bills":
+		var b BillReminder
+		if err := json.Unmarshal(v, &b); err != nil {
+			return nil, false, err
+		}
+		b.applyPayments()
+		return []interface{}{b.DueDate, b.Name, b.Category, b.Amount, b.AmountPaid, b.Currency, yesNo(b.IsPaid), b.ID},
+			f.matches(billFields(b)), nil
+	case "investments":
+		var i Investment
+		if err := json.Unmarshal(v, &i); err != nil {
+			return nil, false, err
+		}
+		return []interface{}{i.Name, i.Type, i.InvestedValue, i.Value, i.Returns, i.Currency, i.ID}, true, nil
+	}
+	return nil, false, fmt.Errorf("unknown export type %q", kind)
+}
+
+var exportHeaders = map[string][]string{
+	"expenses":    {"Date", "Description", "Category", "Merchant", "Amount", "Currency", "Member", "Shared", "Notes", "ID"},
+	"income":      {"Date", "Source", "Description", "Amount", "Currency", "Member", "Recurring", "ID"},
+	"budgets":     {"Month", "Name", "Category", "Limit", "Currency", "Recurring", "ID"},
+	"goals":       {"Name", "Target", "Saved", "Currency", "Deadline", "Status", "ID"},
+	"bills":       {"Due date", "Name", "Category", "Amount", "Paid so far", "Currency", "Paid", "ID"},
+	"investments": {"Name", "Type", "Invested", "Value", "Returns", "Currency", "ID"},
+}
+
+// loadExportTable reads the records of one type, dated ones in date order
+func loadExportTable(r *http.Request, kind string, f listFilter) (exportTable, error) {
+	t := exportTable{Name: kind, Headers: exportHeaders[kind]}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(exportTypes[kind])), func(k, v []byte) error {
+			row, ok, err := exportRow(kind, v, f)
+			if ok {
+				t.Rows = append(t.Rows, row)
+			}
+			return err
+		})
+	})
+	sort.SliceStable(t.Rows, func(i, j int) bool {
+		a, _ := t.Rows[i][0].(string)
+		b, _ := t.Rows[j][0].(string)
+		return a < b
+	})
+	return t, err
+}
+
+// spreadsheetText defuses text a spreadsheet would run as a formula
+func spreadsheetText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func writeExportCSV(w io.Writer, t exportTable) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(t.Headers); err != nil {
+		return err
+	}
+	record := make([]string, len(t.Headers))
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			switch c := cell.(type) {
+			case Money:
+				record[i] = c.String()
+			case string:
+				record[i] = spreadsheetText(c)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// columnName is a spreadsheet column's letters: A, B, ... Z, AA, ...
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxParts are the fixed parts of a one-sheet workbook
+var xlsxParts = [][2]string{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// writeExportXLSX writes the table as a one-sheet Excel workbook, amounts as
+// numbers and everything else as text
+func writeExportXLSX(w io.Writer, t exportTable) error {
+	z := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := z.Create(part[0])
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part[1]); err != nil {
+			return err
+		}
+	}
+	f, err := z.Create("xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" `+
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`+
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`, t.Name)
+
+	f, err = z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	io.WriteString(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]interface{}, len(t.Headers))
+	for i, h := range t.Headers {
+		header[i] = h
+	}
+	for n, row := range append([][]interface{}{header}, t.Rows...) {
+		fmt.Fprintf(f, `<row r="%d">`, n+1)
+		for i, cell := range row {
+			ref := fmt.Sprintf("%s%d", columnName(i), n+1)
+			switch c := cell.(type) {
+			case Money:
+				fmt.Fprintf(f, `<c r="%s"><v>%s</v></c>`, ref, c.String())
+			case string:
+				fmt.Fprintf(f, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+				xml.EscapeText(f, []byte(c))
+				io.WriteString(f, `</t></is></c>`)
+			}
+		}
+		io.WriteString(f, `</row>`)
+	}
+	if _, err := io.WriteString(f, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// EXPORT
+
+// exportRecords downloads one ?type= of record as ?format=csv (default) or
+// xlsx. Expenses, income and bills take the list filters ?from=&to=,
+// ?category= and ?user=.
+func exportRecords(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("type")
+	if _, ok := exportTypes[kind]; !ok {
+		respondError(w, http.StatusBadRequest, "type must be one of budgets, bills, expenses, goals, income, investments")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		respondError(w, http.StatusBadRequest, "format must be csv or xlsx")
+		return
+	}
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := loadExportTable(r, kind, f)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", kind, time.Now().In(householdLocation()).Format(dateLayout), format)
+	contentType := "text/csv; charset=utf-8"
+	write := writeExportCSV
+	if format == "xlsx" {
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		write = writeExportXLSX
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if err := write(w, t); err != nil {
+		logger("http").Error("export failed", "type", kind, "err", err)
+	}
+}
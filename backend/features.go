@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+)
+
+// featureEnabled reports whether the named feature flag is switched on
+func featureEnabled(name string) bool {
+	return config().Features[name]
+}
+
+// requireFeature hides a handler behind a feature flag, answering 404 while
+// the flag is off so disabled subsystems look absent to clients.
+func requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(name) {
+			respondError(w, http.StatusNotFound, "feature "+name+" is disabled")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// FEATURES
+
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, config().Features)
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func fixtureBudgets() []Budget {
+	return []Budget{
+		{ID: "b-groceries", Name: "Groceries", Category: "Groceries", Month: "2026-01", Limit: 12000 * majorUnit, Color: "#22c55e", IsRecurring: true},
+		{ID: "b-fun", Name: "Fun", Month: "2026-01", Limit: 5000 * majorUnit, Color: "#f59e0b"},
+	}
+}
+
+func fixtureExpenses() []Expense {
+	return []Expense{
+		{ID: "e-001", Amount: 2450*majorUnit + 500, Currency: "INR", Description: "Weekly groceries", Category: "Groceries", CategoryColor: "#22c55e", Merchant: "BigBasket", Date: "2026-01-04", User: "alice", BudgetIds: []string{"b-groceries"}},
+		{ID: "e-002", Amount: 780 * majorUnit, Description: "Movie night", Category: "Entertainment", Merchant: "PVR", Date: "2026-01-10", User: "bob", IsShared: true, BudgetIds: []string{"b-fun"}},
+		{ID: "e-003", Amount: 1320*majorUnit + 250, Currency: "INR", Description: "Vegetables and fruit", Category: "Groceries", Merchant: "Reliance Fresh", Date: "2026-01-18", User: "alice", BudgetIds: []string{"b-groceries", "b-fun"}},
+		{ID: "e-004", Amount: 45 * majorUnit, Currency: "USD", Description: "App subscription", Category: "Software", Merchant: "Apple", Date: "2026-02-01", User: "bob"},
+	}
+}
+
+func fixtureGoals() []Goal {
+	return []Goal{
+		{ID: "g-emergency", Name: "Emergency Fund", Target: 300000 * majorUnit, Current: 120000 * majorUnit, Deadline: "2027-03-31", Color: "#22c55e"},
+	}
+}
+
+func fixtureInvestments() []Investment {
+	return []Investment{
+		{ID: "i-index", Name: "Nifty 50 Index Fund", Type: "Mutual Fund", Value: 115000 * majorUnit, InvestedValue: 100000 * majorUnit, Returns: 15000 * majorUnit, ReturnsPercent: 15},
+	}
+}
+
+func fixtureBills() []BillReminder {
+	return []BillReminder{
+		{ID: "bill-power", Name: "Electricity", Amount: 1800 * majorUnit, DueDate: "2026-01-20", Status: "upcoming", Category: "Utilities"},
+	}
+}
+
+func fixtureIncomeSources() []IncomeSource {
+	return []IncomeSource{
+		{ID: "src-salary", Name: "Salary", Type: "salary", DefaultRecurring: true},
+	}
+}
+
+func fixtureIncomes() []Income {
+	return []Income{
+		{ID: "inc-salary", Amount: 85000 * majorUnit, Currency: "INR", SourceID: "src-salary", Description: "January salary", Date: "2026-01-01", IsRecurring: true, User: "alice"},
+	}
+}
+
+// loadFixtures creates every fixture entity through the public API
+func loadFixtures(t *testing.T, s *testServer) {
+	t.Helper()
+	for _, b := range fixtureBudgets() {
+		s.mustDo("POST", "/api/budgets", b, 201)
+	}
+	for _, e := range fixtureExpenses() {
+		s.mustDo("POST", "/api/expenses", e, 201)
+	}
+	for _, g := range fixtureGoals() {
+		s.mustDo("POST", "/api/goals", g, 201)
+	}
+	for _, i := range fixtureInvestments() {
+		s.mustDo("POST", "/api/investments", i, 201)
+	}
+	for _, b := range fixtureBills() {
+		s.mustDo("POST", "/api/bills", b, 201)
+	}
+	for _, src := range fixtureIncomeSources() {
+		s.mustDo("POST", "/api/income-sources", src, 201)
+	}
+	for _, i := range fixtureIncomes() {
+		s.mustDo("POST", "/api/income", i, 201)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// forecastHistoryMonths is how many whole months of spending the
+// discretionary average is taken over
+const forecastHistoryMonths = 3
+
+// ForecastMonth is one month of a balance forecast, in the base currency
+type ForecastMonth struct {
+	Month         string `json:"month"` // YYYY-MM
+	Inflow        Money  `json:"inflow"`
+	Bills         Money  `json:"bills"`         // unpaid and recurring bills due
+	Subscriptions Money  `json:"subscriptions"` // renewals
+	Discretionary Money  `json:"discretionary"` // everyday spending at the recent average
+	Outflow       Money  `json:"outflow"`
+	Net           Money  `json:"net"`
+	Balance       Money  `json:"balance"` // projected across all accounts at month end
+}
+
+// Forecast projects account balances over the coming months
+type Forecast struct {
+	Currency       string `json:"currency"`
+	OpeningBalance Money  `json:"openingBalance"` // across the accounts the caller can see, today
+	// DiscretionaryAverage is the monthly spending outside bills and
+	// subscriptions over the last whole months
+	DiscretionaryAverage  Money           `json:"discretionaryAverage"`
+	Months                []ForecastMonth `json:"months"`
+	UnconvertedCurrencies []string        `json:"unconvertedCurrencies"`
+}
+
+// getForecast projects balances over the coming ?months= (default 3, the
+// current one included), starting from today's account balances. Inflow is
+// recurring income; outflow is unpaid bills and the recurrences still to be
+// raised, subscription renewals and the average of recent spending not
+// paying either. The current month counts only what is left of it; overdue
+// bills count in it too.
+func getForecast(w http.ResponseWriter, r *http.Request) {
+	count := 3
+	if v := r.URL.Query().Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 24 {
+			respondError(w, http.StatusBadRequest, "months must be between 1 and 24")
+			return
+		}
+		count = n
+	}
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	now := time.Now().In(settings.location(""))
+	from := now.Format(dateLayout)
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	until := first.AddDate(0, count, -1).Format(dateLayout)
+	historyFrom := first.AddDate(0, -forecastHistoryMonths, 0).Format(dateLayout)
+	historyTo := first.Format(dateLayout)
+
+	forecast := Forecast{Currency: settings.BaseCurrency, Months: make([]ForecastMonth, count)}
+	index := map[string]int{}
+	for i := range forecast.Months {
+		forecast.Months[i].Month = first.AddDate(0, i, 0).Format("2006-01")
+		index[forecast.Months[i].Month] = i
+	}
+	// month finds the forecast a date falls in; earlier ones count now
+	month := func(date string) *ForecastMonth {
+		if len(date) < 7 || date[:7] < forecast.Months[0].Month {
+			return &forecast.Months[0]
+		}
+		if i, ok := index[date[:7]]; ok {
+			return &forecast.Months[i]
+		}
+		return nil
+	}
+
+	var incomes []Income
+	var spent Money
+	// Expenses paying a bill or subscription are forecast as such
+	linked := map[string]bool{}
+	user := authUser(r)
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		balances, err := accountBalances(tx, settings, from)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(accountsBucket)).ForEach(func(k, v []byte) error {
+			var a Account
+			if json.Unmarshal(v, &a) == nil && a.visibleTo(user) {
+				conv.add(&forecast.OpeningBalance, balances[a.ID].Balance, balances[a.ID].Currency)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEach(r.Context(), tx.Bucket([]byte(billsBucket)), func(k, v []byte) error {
+			var bill BillReminder
+			if json.Unmarshal(v, &bill) != nil {
+				return nil
+			}
+			for _, p := range bill.Payments {
+				if p.ExpenseID != "" {
+					linked[p.ExpenseID] = true
+				}
+			}
+			bill.refresh(from)
+			if m := month(bill.DueDate); m != nil && !bill.IsPaid {
+				conv.add(&m.Bills, bill.Remaining, bill.Currency)
+			}
+			// Occurrences not raised yet
+			due, err := time.Parse(dateLayout, bill.DueDate)
+			if err != nil || bill.Recurrence == "" || bill.NextBillID != "" || bill.PolicyID != "" {
+				return nil
+			}
+			for next := bill.followingDue(due); next.After(due); due, next = next, bill.followingDue(next) {
+				date := next.Format(dateLayout)
+				if date > until {
+					break
+				}
+				if m := month(date); m != nil && date >= from {
+					conv.add(&m.Bills, bill.Amount, bill.Currency)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEach(r.Context(), tx.Bucket([]byte(subscriptionsBucket)), func(k, v []byte) error {
+			var s Subscription
+			if json.Unmarshal(v, &s) != nil || s.Status == "cancelled" || !ownedBy(s.User, user) {
+				return nil
+			}
+			if s.ExpenseID != "" {
+				linked[s.ExpenseID] = true
+			}
+			s.renew(from)
+			renewal, err := time.Parse(dateLayout, s.RenewalDate)
+			if err != nil {
+				return nil
+			}
+			for n := 0; ; n++ {
+				date := addMonthsClamped(renewal, n*subscriptionCycleMonths[s.Cycle]).Format(dateLayout)
+				if date > until {
+					break
+				}
+				if m := month(date); m != nil {
+					conv.add(&m.Subscriptions, s.Amount, s.Currency)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) != nil {
+				return nil
+			}
+			if e.personal() && e.visibleTo(user) && !linked[e.ID] && e.Date >= historyFrom && e.Date < historyTo {
+				conv.add(&spent, e.Amount, e.Currency)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var income Income
+			if json.Unmarshal(v, &income) == nil && income.visibleTo(user) {
+				incomes = append(incomes, income)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, projected := range projectIncome(incomes, from, until) {
+		if m := month(projected.Date); m != nil {
+			conv.add(&m.Inflow, projected.Amount, projected.Currency)
+		}
+	}
+
+	forecast.DiscretionaryAverage = spent / forecastHistoryMonths
+	balance := forecast.OpeningBalance
+	for i := range forecast.Months {
+		m := &forecast.Months[i]
+		m.Discretionary = forecast.DiscretionaryAverage
+		if i == 0 {
+			// Only the rest of this month is still to spend
+			days := first.AddDate(0, 1, -1).Day()
+			m.Discretionary = m.Discretionary * Money(days-now.Day()+1) / Money(days)
+		}
+		m.Outflow = m.Bills + m.Subscriptions + m.Discretionary
+		m.Net = m.Inflow - m.Outflow
+		balance += m.Net
+		m.Balance = balance
+	}
+	forecast.UnconvertedCurrencies = conv.unconverted()
+	respondJSON(w, http.StatusOK, forecast)
+}
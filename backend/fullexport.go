@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	fullExportFormat = "family-finance-export"
+	// fullExportVersion changes when the document's layout does; records
+	// themselves are brought up to date by the startup migrations
+	fullExportVersion = 1
+)
+
+// FullExport is every bucket of the store as one JSON document. Records
+// that are JSON are kept as they are; anything else, such as the token
+// signing key, is carried as base64.
+type FullExport struct {
+	Format     string                       `json:"format"`
+	Version    int                          `json:"version"`
+	ExportedAt string                       `json:"exportedAt"`
+	Buckets    map[string][]FullExportEntry `json:"buckets"`
+}
+
+// FullExportEntry is one stored record
+type FullExportEntry struct {
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Base64 []byte          `json:"base64,omitempty"`
+}
+
+// writeFullExport streams the document for tx, a record at a time
+func writeFullExport(w io.Writer, tx *bolt.Tx, now time.Time) error {
+	var names []string
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		names = append(names, string(name))
+		return nil
+	})
+	sort.Strings(names)
+	header, _ := json.Marshal(map[string]interface{}{"format": fullExportFormat, "version": fullExportVersion,
+		"exportedAt": now.Format(time.RFC3339)})
+	// Reopen the header object to append the buckets
+	if _, err := w.Write(append(header[:len(header)-1], `,"buckets":{`...)); err != nil {
+		return err
+	}
+	for i, name := range names {
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		key, _ := json.Marshal(name)
+		if _, err := fmt.Fprintf(w, "%s\n%s:[", sep, key); err != nil {
+			return err
+		}
+		first := true
+		err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+			if v == nil {
+				return fmt.Errorf("bucket %s holds a nested bucket, which exports do not support", name)
+			}
+			entry := FullExportEntry{Key: string(k)}
+			if json.Valid(v) {
+				entry.Value = v
+			} else {
+				entry.Base64 = v
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if !first {
+				data = append([]byte(","), data...)
+			}
+			first = false
+			_, err = w.Write(append([]byte("\n"), data...))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "]"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n}}\n")
+	return err
+}
+
+// validate checks a document can be imported into this release
+func (doc FullExport) validate() error {
+	if doc.Format != fullExportFormat {
+		return fmt.Errorf("not a Family Finance export (format %q)", doc.Format)
+	}
+	if doc.Version < 1 || doc.Version > fullExportVersion {
+		return fmt.Errorf("export version %d is not supported; this server reads up to version %d", doc.Version, fullExportVersion)
+	}
+	for name, entries := range doc.Buckets {
+		if !slices.Contains(storeBuckets, name) {
+			return fmt.Errorf("unknown bucket %q", name)
+		}
+		for i, e := range entries {
+			if e.Key == "" {
+				return fmt.Errorf("%s[%d]: key is required", name, i)
+			}
+			if len(e.Value) == 0 && e.Base64 == nil {
+				return fmt.Errorf("%s[%d]: value or base64 is required", name, i)
+			}
+		}
+	}
+	if _, ok := doc.Buckets[expensesBucket]; !ok {
+		return fmt.Errorf("export has no %s bucket", expensesBucket)
+	}
+	for _, e := range doc.Buckets[metaBucket] {
+		if e.Key == schemaVersionKey {
+			version, _ := strconv.Atoi(string(e.Value))
+			return checkSchemaVersion(version)
+		}
+	}
+	return nil
+}
+
+// replaceStore swaps every bucket's contents for the document's
+func (doc FullExport) replaceStore(tx *bolt.Tx) error {
+	var names [][]byte
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	})
+	for _, name := range names {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	if err := createBuckets(tx); err != nil {
+		return err
+	}
+	for name, entries := range doc.Buckets {
+		b := tx.Bucket([]byte(name))
+		for _, e := range entries {
+			v := e.Base64
+			if len(e.Value) > 0 {
+				var buf bytes.Buffer
+				if err := json.Compact(&buf, e.Value); err != nil {
+					return fmt.Errorf("%s/%s: %w", name, e.Key, err)
+				}
+				v = buf.Bytes()
+			}
+			if err := b.Put([]byte(e.Key), v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EXPORT & IMPORT: FULL
+
+// exportFull downloads the whole store as one versioned JSON document, for
+// moving to another machine or storage backend
+func exportFull(w http.ResponseWriter, r *http.Request) {
+	// A large store can take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	now := time.Now()
+	name := fmt.Sprintf("family-finance-%s.json", now.In(householdLocation()).Format(dateLayout))
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		return writeFullExport(w, tx, now)
+	})
+	if err != nil {
+		logger("http").Error("full export failed", "err", err)
+	}
+}
+
+// importFull replaces all data with an uploaded full export. It needs
+// ?confirm=replace, and backs up the current data first.
+func importFull(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("confirm") != "replace" {
+		respondError(w, http.StatusBadRequest, "importing replaces all current data; repeat with ?confirm=replace")
+		return
+	}
+	var doc FullExport
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := doc.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	safety, err := createBackup(r.Context(), "pre-import")
+	if safety.Name == "" {
+		respondError(w, http.StatusInternalServerError, "backing up current data before importing: "+err.Error())
+		return
+	}
+	if err := updateContext(r.Context(), doc.replaceStore); err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Bring records from an older release into the current shape
+	if err := runStartupMigrations(); err != nil {
+		logger("store").Error("migrating imported data", "err", err)
+	}
+	records := map[string]int{}
+	for name, entries := range doc.Buckets {
+		records[name] = len(entries)
+	}
+	logger("store").Warn("store replaced by full import", "exportedAt", doc.ExportedAt, "safetyBackup", safety.Name, "by", requestActor(r))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"records": records, "safetyBackup": safety})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Goal states
+const (
+	goalActive    = "active"
+	goalPaused    = "paused"
+	goalCompleted = "completed"
+	goalArchived  = "archived"
+)
+
+// goalArchiveAfter is how long completed goals stay on the dashboard
+const goalArchiveAfter = 30 * 24 * time.Hour
+
+func validGoalStatus(status string) bool {
+	switch status {
+	case goalActive, goalPaused, goalCompleted, goalArchived:
+		return true
+	}
+	return false
+}
+
+// applyLifecycle settles a goal's state after an edit. Goals that reach
+// their target complete on their own; it reports whether that just
+// happened. prev is the stored goal, nil for new ones.
+func (g *Goal) applyLifecycle(prev *Goal, now time.Time) bool {
+	if g.Status == "" {
+		g.Status = goalActive
+		if prev != nil {
+			g.Status = prev.Status
+		}
+	}
+	if (g.Status == goalActive || g.Status == goalPaused) && g.Target > 0 && g.Current >= g.Target {
+		g.Status = goalCompleted
+	}
+	if g.Status != goalCompleted && g.Status != goalArchived {
+		g.CompletedAt = ""
+		return false
+	}
+	if prev != nil && prev.CompletedAt != "" {
+		g.CompletedAt = prev.CompletedAt
+	}
+	if g.CompletedAt == "" {
+		g.CompletedAt = now.Format(time.RFC3339)
+	}
+	return g.Status == goalCompleted && (prev == nil || prev.Status != goalCompleted)
+}
+
+// includeArchived reads the ?includeArchived flag of goal listings
+func includeArchived(r *http.Request) bool {
+	return r.URL.Query().Get("includeArchived") == "true"
+}
+
+// goalCompletedAlert tells the household a goal was reached
+func goalCompletedAlert(g Goal) {
+	_, err := emitAlert(newAlert(fmt.Sprintf("goal.completed:%s:%s", g.ID, g.CompletedAt), "goal.completed", g.ID,
+		"alert.goal.completed", g.Name, g.Target.String(), g.Currency))
+	if err != nil {
+		logger("notifications").Error("emitting goal alert", "goal", g.ID, "err", err)
+	}
+}
+
+// archiveCompletedGoals archives goals completed more than goalArchiveAfter
+// ago, taking them off the dashboard
+func archiveCompletedGoals() error {
+	cutoff := time.Now().Add(-goalArchiveAfter)
+	return db.Update(func(tx *bolt.Tx) error {
+		n, err := rewriteRecords(tx, goalsBucket, func(g *Goal) {
+			if g.Status != goalCompleted {
+				return
+			}
+			if completed, err := time.Parse(time.RFC3339, g.CompletedAt); err == nil && completed.Before(cutoff) {
+				g.Status = goalArchived
+			}
+		})
+		if n > 0 {
+			logger("scheduler").Info("archived completed goals", "goals", n)
+		}
+		return err
+	})
+}
+
+// migrateGoalStatus gives goals saved before states existed one
+func migrateGoalStatus(tx *bolt.Tx) (int, error) {
+	now := time.Now()
+	return rewriteRecords(tx, goalsBucket, func(g *Goal) {
+		if g.Status == "" {
+			g.applyLifecycle(nil, now)
+		}
+	})
+}
+
+// saveGoal validates the state of a created or edited goal, stores it and
+// alerts when it has just been completed
+func saveGoal(w http.ResponseWriter, r *http.Request, goal Goal, status int) {
+	if goal.Status != "" && !validGoalStatus(goal.Status) {
+		respondError(w, http.StatusBadRequest, "status must be active, paused, completed or archived")
+		return
+	}
+	completed := false
+	goal.Owner = authUser(r)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(goalsBucket))
+		var prev *Goal
+		if v := b.Get([]byte(goal.ID)); v != nil {
+			prev = &Goal{}
+			json.Unmarshal(v, prev)
+			if !prev.visibleTo(goal.Owner) {
+				return errNotFound
+			}
+			goal.Owner = prev.Owner
+		}
+		completed = goal.applyLifecycle(prev, time.Now())
+		data, err := json.Marshal(goal)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(goal.ID), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "goal not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if completed {
+		goalCompletedAlert(goal)
+	}
+	respondJSON(w, status, goal)
+}
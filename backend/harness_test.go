@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata/golden")
+
+// testServer runs the full router against a throwaway bolt file
+type testServer struct {
+	*httptest.Server
+	t     *testing.T
+	token string // sent as a bearer token when set
+	admin string // sent as the bearer token on /api/admin routes when set
+}
+
+// newTestServer points the package globals at a fresh database and config
+// and serves the router. Tests using it must not run in parallel.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configPath)
+	t.Setenv("DB_PATH", filepath.Join(dir, "test.db"))
+	for _, key := range []string{
+		"PORT", "LISTEN_ADDR", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_REDIRECT_ADDR", "ROLE", "PRIMARY_URL", "FEATURES", "AUDIT_LOG_PATH",
+		"ADMIN_TOKEN", "BASE_URL", "SENTRY_DSN", "ERROR_WEBHOOK_URL", "OTEL_EXPORTER_OTLP_ENDPOINT",
+		"JWT_SECRET", "TOKEN_TTL_HOURS",
+		"SMTP_HOST", "SMTP_PORT", "SMTP_FROM", "TELEGRAM_BOT_TOKEN", "IMAP_HOST", "IMAP_PORT", "IMAP_USERNAME", "IMAP_PASSWORD", "IMAP_MAILBOX",
+		"BANK_SYNC_PROVIDER", "PLAID_CLIENT_ID", "PLAID_SECRET", "PLAID_ENV", "PLAID_COUNTRY_CODES", "BANK_TOKEN_KEY",
+		"BILL_REMINDER_DAYS",
+		"ANOMALY_FACTOR", "ANOMALY_NEW_MERCHANT_AMOUNT",
+		"EXCHANGE_RATES_PROVIDER", "EXCHANGE_RATES_URL", "PRICE_PROVIDER", "ALPHAVANTAGE_API_KEY",
+		"OCR_PROVIDER", "TESSERACT_PATH", "VISION_API_KEY",
+		"BACKUP_DIR", "BACKUP_KEEP", "BACKUP_S3_ENDPOINT", "BACKUP_S3_REGION", "BACKUP_S3_BUCKET", "BACKUP_S3_PREFIX",
+		"BACKUP_S3_ACCESS_KEY", "BACKUP_S3_SECRET_KEY",
+		"CORS_ALLOWED_ORIGINS", "CORS_ALLOWED_METHODS", "CORS_ALLOWED_HEADERS", "CORS_ALLOW_CREDENTIALS",
+	} {
+		t.Setenv(key, "")
+	}
+	// Tests act as unauthenticated callers unless they sign in
+	t.Setenv("AUTH_REQUIRED", "false")
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(c)
+	if err := openDB(config().DBPath); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		srv.Close()
+		db.Close()
+	})
+	return &testServer{Server: srv, t: t}
+}
+
+// enableAdmin sets an ADMIN_TOKEN and sends it on admin requests
+func (s *testServer) enableAdmin() {
+	config().AdminToken = "admin-s3cret"
+	s.admin = config().AdminToken
+}
+
+// register creates an account with the current token, which must be an
+// adult's unless it is the first, and returns the new account's token
+func (s *testServer) register(username, role string) string {
+	s.t.Helper()
+	var session struct {
+		Token string `json:"token"`
+	}
+	decode(s.t, s.mustDo("POST", "/api/auth/register", map[string]string{
+		"username": username, "password": username + "-password", "role": role}, http.StatusCreated), &session)
+	return session.Token
+}
+
+// do sends a request with an optional JSON body and returns the response
+// status and body.
+func (s *testServer) do(method, path string, body interface{}) (int, []byte) {
+	s.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if s.admin != "" && strings.HasPrefix(path, "/api/admin/") {
+		req.Header.Set("Authorization", "Bearer "+s.admin)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// mustDo is do that fails the test on an unexpected status
+func (s *testServer) mustDo(method, path string, body interface{}, wantStatus int) []byte {
+	s.t.Helper()
+	status, data := s.do(method, path, body)
+	if status != wantStatus {
+		s.t.Fatalf("%s %s: status %d, want %d: %s", method, path, status, wantStatus, data)
+	}
+	return data
+}
+
+// decode unmarshals a response body into v
+func decode(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+}
+
+// volatileKeys hold server-generated timestamps that differ on every run,
+// and record versions, which cover them, with what to put in their place
+var volatileKeys = map[string]string{"createdAt": "<timestamp>", "updatedAt": "<timestamp>", "version": "<version>"}
+
+func normalizeJSON(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if placeholder, ok := volatileKeys[k]; ok {
+				val[k] = placeholder
+				continue
+			}
+			val[k] = normalizeJSON(child)
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = normalizeJSON(child)
+		}
+	}
+	return v
+}
+
+// assertGolden compares a JSON response with testdata/golden/<name>.json.
+// Run `go test -update` to accept new output.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	var v interface{}
+	decode(t, got, &v)
+	normalized, err := json.MarshalIndent(normalizeJSON(v), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized = append(normalized, '\n')
+
+	path := filepath.Join("testdata", "golden", name+".json")
+	if *update {
+		if err := os.WriteFile(path, normalized, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file (run go test -update to create it): %v", err)
+	}
+	if !bytes.Equal(normalized, want) {
+		t.Errorf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", path, normalized, want)
+	}
+}
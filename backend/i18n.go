@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultLanguage is used when neither the member's preferences nor the
+// request name a language we have a catalog for
+const defaultLanguage = "en"
+
+// catalogs hold server-generated text by language and message key. Keys
+// missing from a catalog fall back to English.
+var catalogs = map[string]map[string]string{
+	"en": {
+		"alert.bill.overdue":   "%s (%s %s) was due on %s",
+		"alert.bill.due":       "%s (%s %s) is due on %s",
+		"alert.goal.completed": "Goal %q reached its target of %s %s",
+		"balance.owes":         "%s owes %s %s",
+
+		"alert.debt.lent.due":         "%s owes you %s, due on %s",
+		"alert.debt.lent.overdue":     "%s still owes you %s, which was due on %s",
+		"alert.debt.borrowed.due":     "You owe %s %s, due on %s",
+		"alert.debt.borrowed.overdue": "You still owe %s %s, which was due on %s",
+		"alert.allowance.low":         "%s has only %s of their allowance left",
+		"alert.purchase.return":       "The return window for %s closes on %s",
+		"alert.subscription.active":   "%s renews for %s on %s",
+		"alert.subscription.flagged":  "%s is flagged for cancellation but renews for %s on %s",
+		"alert.creditScore.recheck":   "%s's credit score was last checked on %s; time to check it again",
+		"alert.emergencyFund.low":     "The emergency fund covers only %s months of essential spending (target %s); %s short",
+		"alert.document.expiring":     "%s expires on %s",
+		"alert.comment.mention":       "%s mentioned you on %s: %s",
+		"alert.document.expired":      "%s expired on %s",
+		"alert.expense.unusual":       "%s cost %s, %s times the usual %s for %s",
+		"alert.expense.newMerchant":   "First payment to %s: %s",
+		"alert.expense.duplicate":     "%s for %s looks like a repeat of the charge on %s",
+		"alert.budget.threshold":      "Budget %s has reached %s%% of its %s limit, with %s spent",
+		"alert.budget.over":           "Budget %s is over its %s limit, with %s spent",
+
+		"category.uncategorized": "Uncategorized",
+		"category.Groceries":     "Groceries",
+		"category.Dining":        "Dining",
+		"category.Transport":     "Transport",
+		"category.Utilities":     "Utilities",
+		"category.Shopping":      "Shopping",
+		"category.Entertainment": "Entertainment",
+		"category.Health":        "Health",
+	},
+	"hi": {
+		"alert.bill.overdue":   "%s (%s %s) का भुगतान %s तक करना था",
+		"alert.bill.due":       "%s (%s %s) का भुगतान %s तक करना है",
+		"alert.goal.completed": "लक्ष्य %q ने %s %s का लक्ष्य पूरा कर लिया",
+		"balance.owes":         "%s को %s को %s देने हैं",
+
+		"alert.debt.lent.due":         "%s को आपको %s लौटाने हैं, देय तिथि %s",
+		"alert.debt.lent.overdue":     "%s ने अब तक आपके %s नहीं लौटाए, देय तिथि %s थी",
+		"alert.debt.borrowed.due":     "आपको %s को %s लौटाने हैं, देय तिथि %s",
+		"alert.debt.borrowed.overdue": "आपने अब तक %s को %s नहीं लौटाए, देय तिथि %s थी",
+		"alert.allowance.low":         "%s के जेब खर्च में केवल %s बचे हैं",
+		"alert.purchase.return":       "%s लौटाने की अंतिम तिथि %s है",
+		"alert.subscription.active":   "%s का %s का नवीनीकरण %s को होगा",
+		"alert.subscription.flagged":  "%s रद्द करने के लिए चिह्नित है, पर इसका %s का नवीनीकरण %s को होगा",
+		"alert.creditScore.recheck":   "%s का क्रेडिट स्कोर पिछली बार %s को देखा गया था; इसे फिर से देखने का समय है",
+		"alert.emergencyFund.low":     "आपातकालीन कोष केवल %s महीनों के ज़रूरी खर्च के लिए पर्याप्त है (लक्ष्य %s); %s कम",
+		"alert.comment.mention":       "%s ने %s पर आपका ज़िक्र किया: %s",
+		"alert.document.expiring":     "%s की वैधता %s को समाप्त होगी",
+		"alert.document.expired":      "%s की वैधता %s को समाप्त हो गई",
+		"alert.expense.unusual":       "%[1]s पर %[2]s खर्च हुए, जो %[5]s के सामान्य खर्च %[4]s का %[3]s गुना है",
+		"alert.expense.newMerchant":   "%s को पहला भुगतान: %s",
+		"alert.expense.duplicate":     "%s का %s का भुगतान %s के भुगतान का दोहराव लगता है",
+		"alert.budget.threshold":      "बजट %s अपनी %[3]s की सीमा के %[2]s%% तक पहुँच गया है, %[4]s खर्च हुए",
+		"alert.budget.over":           "बजट %s अपनी %s की सीमा से आगे निकल गया है, %s खर्च हुए",
+
+		"category.uncategorized": "अवर्गीकृत",
+		"category.Groceries":     "किराना",
+		"category.Dining":        "खान-पान",
+		"category.Transport":     "यातायात",
+		"category.Utilities":     "बिजली-पानी",
+		"category.Shopping":      "खरीदारी",
+		"category.Entertainment": "मनोरंजन",
+		"category.Health":        "स्वास्थ्य",
+	},
+}
+
+// language maps a locale such as "hi-IN" to the catalog that serves it
+func language(locale string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(locale)), "-")
+	if _, ok := catalogs[lang]; ok {
+		return lang
+	}
+	return ""
+}
+
+// translate renders a message in a language, falling back to English and
+// then to the key itself
+func translate(lang, key string, args ...string) string {
+	format, ok := catalogs[lang][key]
+	if !ok {
+		if format, ok = catalogs[defaultLanguage][key]; !ok {
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = a
+	}
+	return fmt.Sprintf(format, values...)
+}
+
+// categoryLabel translates the names of the default categories and the
+// empty category. Categories the household made up are shown as entered.
+func categoryLabel(lang, category string) string {
+	if category == "" {
+		return translate(lang, "category.uncategorized")
+	}
+	if _, ok := catalogs[defaultLanguage]["category."+category]; ok {
+		return translate(lang, "category."+category)
+	}
+	return category
+}
+
+// acceptedLanguage picks the preferred language of an Accept-Language
+// header that we have a catalog for
+func acceptedLanguage(header string) string {
+	type option struct {
+		lang string
+		q    float64
+	}
+	var options []option
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if lang := language(tag); lang != "" && q > 0 {
+			options = append(options, option{lang, q})
+		}
+	}
+	sort.SliceStable(options, func(i, j int) bool { return options[i].q > options[j].q })
+	if len(options) == 0 {
+		return ""
+	}
+	return options[0].lang
+}
+
+// userLanguage is the language of a member's saved locale, if any
+func userLanguage(tx *bolt.Tx, user string) string {
+	if tx.Bucket([]byte(userPrefsBucket)).Get([]byte(user)) == nil {
+		return ""
+	}
+	return language(loadUserPreferences(tx, user).Locale)
+}
+
+// requestLanguage chooses the language of a response: the caller's locale
+// preference, then Accept-Language, then English
+func requestLanguage(r *http.Request) string {
+	var lang string
+	db.View(func(tx *bolt.Tx) error {
+		lang = userLanguage(tx, requestActor(r))
+		return nil
+	})
+	if lang == "" {
+		lang = acceptedLanguage(r.Header.Get("Accept-Language"))
+	}
+	if lang == "" {
+		lang = defaultLanguage
+	}
+	return lang
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestAcceptedLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          "",
+		"hi-IN,hi;q=0.9,en;q=0.8":   "hi",
+		"fr-FR, en;q=0.5, hi;q=0.7": "hi",
+		"en-GB":                     "en",
+		"de, fr;q=0.9":              "",
+		"hi;q=0, en;q=0.1":          "en",
+	} {
+		if got := acceptedLanguage(header); got != want {
+			t.Errorf("acceptedLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestTranslateFallsBack(t *testing.T) {
+	catalogs["en"]["test.only"] = "only in %s"
+	defer delete(catalogs["en"], "test.only")
+
+	if got := translate("hi", "test.only", "English"); got != "only in English" {
+		t.Errorf("missing Hindi message = %q", got)
+	}
+	if got := translate("hi", "no.such.key"); got != "no.such.key" {
+		t.Errorf("unknown key = %q", got)
+	}
+	if got := categoryLabel("hi", "Groceries"); got != "किराना" {
+		t.Errorf("default category label = %q", got)
+	}
+	if got := categoryLabel("hi", "Pets"); got != "Pets" {
+		t.Errorf("custom category label = %q", got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// imapTimeout bounds each command's round trip
+	imapTimeout = time.Minute
+	// imapMaxMessage is the largest message read; alerts are far smaller
+	imapMaxMessage = 10 << 20
+	// mailFirstPollDays is how far back the first poll of a mailbox looks
+	mailFirstPollDays = 7
+	// mailPollBatch caps the messages read per poll; the rest wait for the
+	// next one
+	mailPollBatch = 100
+)
+
+// imapDial connects to the IMAP server over TLS; tests replace it
+var imapDial = func(addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+}
+
+var (
+	imapUIDValidity = regexp.MustCompile(`(?i)\[UIDVALIDITY (\d+)\]`)
+	imapLiteral     = regexp.MustCompile(`\{(\d+)\}$`)
+)
+
+// mailCursor is how far a mailbox has been read: messages up to LastUID,
+// valid while the mailbox keeps its UIDValidity
+type mailCursor struct {
+	UIDValidity uint32 `json:"uidValidity"`
+	LastUID     uint32 `json:"lastUid"`
+}
+
+// mailMessage is one message read from the mailbox
+type mailMessage struct {
+	UID uint32
+	Raw []byte
+}
+
+// imapResponse is one response line, with the literals sent inside it
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// imapConn speaks just enough IMAP4rev1 to read new messages
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+func (c *imapConn) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+		// A line ending in {n} goes on after n bytes of literal
+		m := imapLiteral.FindStringSubmatch(line)
+		if m == nil {
+			return resp, nil
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n > imapMaxMessage {
+			return resp, fmt.Errorf("imap: literal of %s bytes is too large", m[1])
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// command sends a command and collects the untagged responses up to its
+// tagged reply, failing unless that is OK
+func (c *imapConn) command(format string, args ...interface{}) ([]imapResponse, error) {
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...); err != nil {
+		return nil, err
+	}
+	var untagged []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if status, ok := strings.CutPrefix(resp.line, tag+" "); ok {
+			if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return nil, fmt.Errorf("imap: %s", status)
+			}
+			return untagged, nil
+		}
+		untagged = append(untagged, resp)
+	}
+}
+
+// imapQuote writes s as an IMAP quoted string
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// fetchIMAP reads the messages that arrived in the configured mailbox since
+// the cursor, oldest first, and returns the cursor past them. Messages are
+// left unread. A new mailbox, or one whose UIDs were reset, is read from
+// mailFirstPollDays back.
+func fetchIMAP(c *Config, cursor mailCursor) ([]mailMessage, mailCursor, error) {
+	conn, err := imapDial(fmt.Sprintf("%s:%d", c.IMAPHost, c.IMAPPort))
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer conn.Close()
+	ic := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := ic.readResponse()
+	if err != nil {
+		return nil, cursor, err
+	}
+	if !strings.HasPrefix(strings.ToUpper(greeting.line), "* OK") {
+		return nil, cursor, fmt.Errorf("imap: %s", greeting.line)
+	}
+	if _, err := ic.command("LOGIN %s %s", imapQuote(c.IMAPUsername), imapQuote(c.IMAPPassword)); err != nil {
+		return nil, cursor, err
+	}
+	defer ic.command("LOGOUT")
+
+	selected, err := ic.command("EXAMINE %s", imapQuote(c.IMAPMailbox))
+	if err != nil {
+		return nil, cursor, err
+	}
+	var validity uint32
+	for _, resp := range selected {
+		if m := imapUIDValidity.FindStringSubmatch(resp.line); m != nil {
+			n, _ := strconv.ParseUint(m[1], 10, 32)
+			validity = uint32(n)
+		}
+	}
+	if validity != cursor.UIDValidity {
+		cursor = mailCursor{UIDValidity: validity}
+	}
+
+	var found []imapResponse
+	if cursor.LastUID == 0 {
+		since := time.Now().AddDate(0, 0, -mailFirstPollDays).Format("2-Jan-2006")
+		found, err = ic.command("UID SEARCH SINCE %s", since)
+	} else {
+		found, err = ic.command("UID SEARCH UID %d:*", cursor.LastUID+1)
+	}
+	if err != nil {
+		return nil, cursor, err
+	}
+	var uids []uint32
+	for _, resp := range found {
+		fields := strings.Fields(resp.line)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		for _, f := range fields[2:] {
+			// n:* always matches the newest message, even one already read
+			if n, err := strconv.ParseUint(f, 10, 32); err == nil && uint32(n) > cursor.LastUID {
+				uids = append(uids, uint32(n))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if len(uids) > mailPollBatch {
+		uids = uids[:mailPollBatch]
+	}
+
+	var messages []mailMessage
+	for _, uid := range uids {
+		fetched, err := ic.command("UID FETCH %d BODY.PEEK[]", uid)
+		if err != nil {
+			return messages, cursor, err
+		}
+		for _, resp := range fetched {
+			if len(resp.literals) > 0 {
+				messages = append(messages, mailMessage{UID: uid, Raw: resp.literals[0]})
+				break
+			}
+		}
+		cursor.LastUID = uid
+	}
+	return messages, cursor, nil
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// importPreviewTTL is how long an uncommitted import preview is kept
+const importPreviewTTL = 24 * time.Hour
+
+// Import row states
+const (
+	importNew       = "new"
+	importDuplicate = "duplicate"
+	importInvalid   = "invalid"
+	importImported  = "imported"
+	importSkipped   = "skipped"
+	importQueued    = "queued"
+)
+
+var errAlreadyCommitted = errors.New("import already committed")
+
+// CSVMapping names the statement columns, by header, that fill each field.
+// Amounts come either from one signed Amount column, where money out is
+// negative, or from separate Debit and Credit columns.
+type CSVMapping struct {
+	Date string `json:"date"`
+	// DateFormat is a Go layout such as "01/02/2006"; by default the usual
+	// input formats are tried, slashed dates day first
+	DateFormat  string `json:"dateFormat,omitempty"`
+	Amount      string `json:"amount,omitempty"`
+	Debit       string `json:"debit,omitempty"`
+	Credit      string `json:"credit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Merchant    string `json:"merchant,omitempty"`
+	Category    string `json:"category,omitempty"`
+	// SpendingPositive reads a positive Amount as money out, as card
+	// statements list it
+	SpendingPositive bool   `json:"spendingPositive,omitempty"`
+	Currency         string `json:"currency,omitempty"`
+	User             string `json:"user,omitempty"`      // member the records are for
+	AccountID        string `json:"accountId,omitempty"` // account the statement is of
+}
+
+// ImportRow is one statement line, read as an expense or an income
+type ImportRow struct {
+	Line        int    `json:"line"`
+	Kind        string `json:"kind,omitempty"` // expense or income
+	Date        string `json:"date,omitempty"`
+	Amount      Money  `json:"amount"`
+	Description string `json:"description,omitempty"`
+	Merchant    string `json:"merchant,omitempty"`
+	Category    string `json:"category,omitempty"`
+	// Status is new, duplicate or invalid in a preview, and imported,
+	// queued for review or skipped once committed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// DuplicateOf is the ID of the matching record, or "line N" for an
+	// earlier line of the same file
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	RecordID    string `json:"recordId,omitempty"`
+}
+
+// CSVImport is an uploaded statement. It is previewed first and written as
+// income and queued expenses only when committed.
+type CSVImport struct {
+	ID          string      `json:"id"`
+	FileName    string      `json:"fileName"`
+	Mapping     CSVMapping  `json:"mapping"`
+	Currency    string      `json:"currency"`
+	User        string      `json:"user,omitempty"`
+	Status      string      `json:"status"` // preview or committed
+	Rows        []ImportRow `json:"rows"`
+	New         int         `json:"new"`
+	Duplicates  int         `json:"duplicates"`
+	Invalid     int         `json:"invalid"`
+	Imported    int         `json:"imported"`
+	Queued      int         `json:"queued,omitempty"` // expenses sent to the pending queue
+	CreatedAt   string      `json:"createdAt"`
+	CommittedAt string      `json:"committedAt,omitempty"`
+}
+
+func (m *CSVMapping) validate() error {
+	if m.Date == "" {
+		return fmt.Errorf("mapping.date is required")
+	}
+	if m.Amount == "" && m.Debit == "" && m.Credit == "" {
+		return fmt.Errorf("mapping needs an amount column, or debit and credit columns")
+	}
+	if m.Amount != "" && (m.Debit != "" || m.Credit != "") {
+		return fmt.Errorf("map either amount or debit and credit, not both")
+	}
+	return nil
+}
+
+// columns maps each mapped field to its index in header
+func (m CSVMapping) columns(header []string) (map[string]int, error) {
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	cols := map[string]int{}
+	for field, name := range map[string]string{"date": m.Date, "amount": m.Amount, "debit": m.Debit,
+		"credit": m.Credit, "description": m.Description, "merchant": m.Merchant, "category": m.Category} {
+		if name == "" {
+			continue
+		}
+		i, ok := index[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("column %q is not in the file", name)
+		}
+		cols[field] = i
+	}
+	return cols, nil
+}
+
+// parseStatementAmount reads amounts as banks write them: with thousands
+// separators and currency symbols, negatives in parentheses or with a
+// trailing "Dr". Empty is zero.
+func parseStatementAmount(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	neg := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		neg, s = true, s[1:len(s)-1]
+	}
+	upper := strings.ToUpper(s)
+	switch {
+	case strings.HasSuffix(upper, "DR"):
+		neg, s = !neg, s[:len(s)-2]
+	case strings.HasSuffix(upper, "CR"):
+		s = s[:len(s)-2]
+	}
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || r == '+' || r == '.' || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, s)
+	var m Money
+	if s == "" {
+		return 0, nil
+	}
+	if err := m.UnmarshalJSON([]byte(s)); err != nil {
+		return 0, err
+	}
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
+
+// readRow turns one CSV record into an import row
+func (m CSVMapping) readRow(record []string, cols map[string]int, loc *time.Location) ImportRow {
+	get := func(field string) string {
+		if i, ok := cols[field]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	row := ImportRow{Description: get("description"), Merchant: get("merchant"), Category: get("category")}
+	var err error
+	if m.DateFormat != "" {
+		var t time.Time
+		if t, err = time.Parse(m.DateFormat, get("date")); err == nil {
+			row.Date = t.Format(dateLayout)
+		}
+	} else {
+		row.Date, err = normalizeDate(get("date"), loc)
+	}
+	if err == nil && row.Date == "" {
+		err = fmt.Errorf("date is empty")
+	}
+	if err != nil {
+		row.Status, row.Error = importInvalid, err.Error()
+		return row
+	}
+
+	var amount Money // positive is money in
+	if m.Amount != "" {
+		if amount, err = parseStatementAmount(get("amount")); err == nil && m.SpendingPositive {
+			amount = -amount
+		}
+	} else {
+		var debit, credit Money
+		if debit, err = parseStatementAmount(get("debit")); err == nil {
+			credit, err = parseStatementAmount(get("credit"))
+		}
+		if debit < 0 {
+			debit = -debit
+		}
+		amount = credit - debit
+	}
+	if err == nil && amount == 0 {
+		err = fmt.Errorf("amount is empty")
+	}
+	if err != nil {
+		row.Status, row.Error = importInvalid, err.Error()
+		return row
+	}
+	row.Kind, row.Amount = "income", amount
+	if amount < 0 {
+		row.Kind, row.Amount = "expense", -amount
+	}
+	if row.Description == "" {
+		row.Description = row.Merchant
+	}
+	row.Status = importNew
+	return row
+}
+
+// importKey identifies a transaction for duplicate detection: its kind,
+// date, amount and merchant
+func importKey(kind, date string, amount Money, merchant string) string {
+	return fmt.Sprintf("%s|%s|%d|%s", kind, date, amount, merchantKey(merchant))
+}
+
+func (row ImportRow) key() string {
+	merchant := row.Merchant
+	if merchant == "" {
+		merchant = row.Description
+	}
+	return importKey(row.Kind, row.Date, row.Amount, merchant)
+}
+
+// existingKeys indexes stored expenses and income by importKey. Amounts
+// are compared in the statement's currency only.
+func existingKeys(tx *bolt.Tx, currency string) map[string]string {
+	keys := map[string]string{}
+	tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) == nil && e.Currency == currency {
+			merchant := e.Merchant
+			if merchant == "" {
+				merchant = e.Description
+			}
+			keys[importKey("expense", e.Date, e.Amount, merchant)] = e.ID
+		}
+		return nil
+	})
+	tx.Bucket([]byte(incomeBucket)).ForEach(func(k, v []byte) error {
+		var i Income
+		if json.Unmarshal(v, &i) == nil && i.Currency == currency {
+			merchant := i.Source
+			if merchant == "" {
+				merchant = i.Description
+			}
+			keys[importKey("income", i.Date, i.Amount, merchant)] = i.ID
+		}
+		return nil
+	})
+	return keys
+}
+
+// markDuplicates flags rows matching a stored record or an earlier row
+func (imp *CSVImport) markDuplicates(tx *bolt.Tx) {
+	existing := existingKeys(tx, imp.Currency)
+	seen := map[string]int{}
+	imp.New, imp.Duplicates, imp.Invalid = 0, 0, 0
+	for i := range imp.Rows {
+		row := &imp.Rows[i]
+		if row.Status == importInvalid {
+			imp.Invalid++
+			continue
+		}
+		key := row.key()
+		row.Status, row.DuplicateOf = importNew, ""
+		if id, ok := existing[key]; ok {
+			row.Status, row.DuplicateOf = importDuplicate, id
+		} else if line, ok := seen[key]; ok {
+			row.Status, row.DuplicateOf = importDuplicate, fmt.Sprintf("line %d", line)
+		} else {
+			seen[key] = row.Line
+		}
+		if row.Status == importNew {
+			imp.New++
+		} else {
+			imp.Duplicates++
+		}
+	}
+}
+
+// readStatement parses an uploaded CSV statement with its header row
+func readStatement(src io.Reader, m CSVMapping, loc *time.Location) ([]ImportRow, error) {
+	reader := csv.NewReader(src)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	cols, err := m.columns(header)
+	if err != nil {
+		return nil, err
+	}
+	rows := []ImportRow{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		row := m.readRow(record, cols, loc)
+		row.Line = line
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func putImport(tx *bolt.Tx, imp CSVImport) error {
+	data, err := json.Marshal(imp)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(importsBucket)).Put([]byte(imp.ID), data)
+}
+
+// purgeImportPreviews drops previews nobody committed
+func purgeImportPreviews(tx *bolt.Tx, now time.Time) error {
+	b := tx.Bucket([]byte(importsBucket))
+	var stale []string
+	b.ForEach(func(k, v []byte) error {
+		var imp CSVImport
+		if json.Unmarshal(v, &imp) != nil || imp.Status != "preview" {
+			return nil
+		}
+		if created, err := time.Parse(time.RFC3339, imp.CreatedAt); err == nil && now.Sub(created) > importPreviewTTL {
+			stale = append(stale, string(k))
+		}
+		return nil
+	})
+	for _, id := range stale {
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IMPORT
+
+// importCSV reads a bank statement uploaded as "file" with its column
+// mapping as JSON in "mapping", and stores a preview of the expenses and
+// income it holds, duplicates marked. Nothing is recorded until the
+// preview is committed.
+func importCSV(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		respondError(w, http.StatusBadRequest, "expected a multipart upload")
+		return
+	}
+	var m CSVMapping
+	if err := json.Unmarshal([]byte(r.FormValue("mapping")), &m); err != nil {
+		respondError(w, http.StatusBadRequest, "mapping must be JSON: "+err.Error())
+		return
+	}
+	if err := m.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errNoUpload.Error())
+		return
+	}
+	defer file.Close()
+
+	settings := currentSettings()
+	now := time.Now()
+	imp := CSVImport{
+		ID:        fmt.Sprintf("%d", now.UnixNano()),
+		FileName:  header.Filename,
+		Mapping:   m,
+		User:      m.User,
+		Status:    "preview",
+		CreatedAt: now.Format(time.RFC3339),
+	}
+	if user := authUser(r); user != "" {
+		imp.User = user
+	}
+	if imp.Currency, err = normalizeCurrency(m.Currency, settings.BaseCurrency); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if imp.Rows, err = readStatement(file, m, settings.location(imp.User)); err != nil {
+		respondError(w, http.StatusBadRequest, "reading CSV: "+err.Error())
+		return
+	}
+	for i := range imp.Rows {
+		imp.Rows[i].Amount = roundForCurrency(imp.Rows[i].Amount, imp.Currency)
+	}
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		if err := checkAccount(tx, m.AccountID); err != nil {
+			return err
+		}
+		if err := purgeImportPreviews(tx, now); err != nil {
+			return err
+		}
+		// Statement spellings become the directory's, so "AMZN Mktp" rows
+		// meet the Amazon expenses they may repeat
+		for i := range imp.Rows {
+			row := &imp.Rows[i]
+			if m, ok := knownMerchant(tx, row.Merchant); ok && row.Kind == "expense" {
+				row.Merchant = m.Name
+			}
+		}
+		imp.markDuplicates(tx)
+		return putImport(tx, imp)
+	})
+	if err == errUnknownAccount {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, imp)
+}
+
+func getImport(w http.ResponseWriter, r *http.Request) {
+	var imp CSVImport
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(importsBucket)).Get([]byte(mux.Vars(r)["id"]))
+		if v == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(v, &imp)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "import not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, imp)
+}
+
+// commitImport takes a preview's new rows: income is recorded and expenses
+// wait in the pending queue for review. A body of {"lines": [...]} picks the
+// rows instead, which may include duplicates the member wants anyway, and
+// {"review": false} records the expenses straight away.
+func commitImport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Lines []int `json:"lines"`
+		// Review, on unless turned off, queues the expense rows as pending
+		// transactions instead of recording them
+		Review *bool `json:"review"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	review := req.Review == nil || *req.Review
+	picked := map[int]bool{}
+	for _, line := range req.Lines {
+		picked[line] = true
+	}
+	var imp CSVImport
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(importsBucket)).Get([]byte(mux.Vars(r)["id"]))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &imp); err != nil {
+			return err
+		}
+		if imp.Status != "preview" {
+			return errAlreadyCommitted
+		}
+		// Records may have been added, and the account deleted, since the
+		// preview
+		imp.markDuplicates(tx)
+		if checkAccount(tx, imp.Mapping.AccountID) != nil {
+			imp.Mapping.AccountID = ""
+		}
+		now := time.Now()
+		id := now.UnixNano()
+		for i := range imp.Rows {
+			row := &imp.Rows[i]
+			take := row.Status == importNew
+			if len(picked) > 0 {
+				take = picked[row.Line] && row.Status != importInvalid
+			}
+			if !take {
+				if row.Status != importInvalid {
+					row.Status = importSkipped
+				}
+				continue
+			}
+			row.RecordID = fmt.Sprintf("%d", id)
+			id++
+			if review && row.Kind != "income" {
+				if err := queueImportRow(tx, imp, *row, now); err != nil {
+					return fmt.Errorf("line %d: %w", row.Line, err)
+				}
+				row.Status = importQueued
+				imp.Queued++
+				continue
+			}
+			if err := importRecord(tx, imp, *row, now); err != nil {
+				return fmt.Errorf("line %d: %w", row.Line, err)
+			}
+			row.Status = importImported
+			imp.Imported++
+		}
+		imp.Status = "committed"
+		imp.CommittedAt = now.Format(time.RFC3339)
+		return putImport(tx, imp)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "import not found")
+	case err == errAlreadyCommitted:
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusOK, imp)
+	}
+}
+
+// queueImportRow sends one statement expense to the pending queue, under
+// the row's record ID
+func queueImportRow(tx *bolt.Tx, imp CSVImport, row ImportRow, now time.Time) error {
+	stamp := now.Format(time.RFC3339)
+	return putPendingTransaction(tx, PendingTransaction{
+		ID:          row.RecordID,
+		Source:      "import",
+		MessageID:   fmt.Sprintf("import:%s:%d", imp.ID, row.Line),
+		ImportID:    imp.ID,
+		From:        imp.FileName,
+		User:        imp.User,
+		AccountID:   imp.Mapping.AccountID,
+		Amount:      row.Amount,
+		Currency:    imp.Currency,
+		Merchant:    row.Merchant,
+		Description: row.Description,
+		Category:    row.Category,
+		Date:        row.Date,
+		Status:      pendingReview,
+		CreatedAt:   stamp,
+		UpdatedAt:   stamp,
+	})
+}
+
+// importRecord writes one statement row as an expense or an income
+func importRecord(tx *bolt.Tx, imp CSVImport, row ImportRow, now time.Time) error {
+	stamp := now.Format(time.RFC3339)
+	if row.Kind == "income" {
+		source := row.Merchant
+		if source == "" {
+			source = row.Description
+		}
+		income := Income{ID: row.RecordID, Amount: row.Amount, Currency: imp.Currency, Source: source,
+			Description: row.Description, Date: row.Date, User: imp.User, AccountID: imp.Mapping.AccountID,
+			CreatedAt: stamp, UpdatedAt: stamp}
+		if err := linkIncomeSource(tx, &income); err != nil {
+			return err
+		}
+		income.MemberID = memberIDFor(tx, income.User)
+		data, err := json.Marshal(income)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(incomeBucket)).Put([]byte(income.ID), data)
+	}
+	expense := Expense{ID: row.RecordID, Amount: row.Amount, Currency: imp.Currency, Description: row.Description,
+		Category: row.Category, Merchant: row.Merchant, Date: row.Date, User: imp.User, AccountID: imp.Mapping.AccountID,
+		CreatedAt: stamp, UpdatedAt: stamp}
+	if err := applyRules(tx, &expense); err != nil {
+		return err
+	}
+	if err := applyMerchant(tx, &expense); err != nil {
+		return err
+	}
+	return putExpense(tx, expense)
+}
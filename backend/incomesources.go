@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// IncomeSource is a named origin of income that entries refer to
+type IncomeSource struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"` // salary, freelance, rental, interest or other
+	// DefaultRecurring pre-fills IsRecurring on new entries from this source
+	DefaultRecurring bool   `json:"defaultRecurring"`
+	CreatedAt        string `json:"createdAt"`
+	UpdatedAt        string `json:"updatedAt"`
+
+	// Received totals the source's entries in the base currency
+	Entries  int   `json:"entries"`
+	Received Money `json:"received"`
+}
+
+var incomeSourceTypes = []string{"salary", "freelance", "rental", "interest", "other"}
+
+var (
+	errUnknownIncomeSource   = errors.New("unknown income source")
+	errDuplicateIncomeSource = errors.New("duplicate income source")
+	errIncomeSourceInUse     = errors.New("income source in use")
+)
+
+func (s *IncomeSource) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Type == "" {
+		s.Type = guessIncomeSourceType(s.Name)
+	}
+	for _, t := range incomeSourceTypes {
+		if s.Type == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("type must be one of %s", strings.Join(incomeSourceTypes, ", "))
+}
+
+// guessIncomeSourceType picks a type from a free-text source name
+func guessIncomeSourceType(name string) string {
+	name = strings.ToLower(name)
+	for _, guess := range []struct{ word, kind string }{
+		{"salary", "salary"}, {"payroll", "salary"}, {"wage", "salary"},
+		{"freelanc", "freelance"}, {"consult", "freelance"},
+		{"rent", "rental"},
+		{"interest", "interest"}, {"deposit", "interest"},
+	} {
+		if strings.Contains(name, guess.word) {
+			return guess.kind
+		}
+	}
+	return "other"
+}
+
+// findIncomeSource looks a source up by name, ignoring case
+func findIncomeSource(tx *bolt.Tx, name string) (*IncomeSource, error) {
+	var found *IncomeSource
+	err := tx.Bucket([]byte(incomeSourcesBucket)).ForEach(func(k, v []byte) error {
+		var s IncomeSource
+		if json.Unmarshal(v, &s) == nil && found == nil && strings.EqualFold(s.Name, name) {
+			found = &s
+		}
+		return nil
+	})
+	return found, err
+}
+
+// linkIncomeSource ties an income entry to its source. Entries naming a
+// source by ID get its current name; entries with only a free-text name are
+// linked to the source of that name, which is created if needed.
+func linkIncomeSource(tx *bolt.Tx, income *Income) error {
+	if income.SourceID != "" {
+		v := tx.Bucket([]byte(incomeSourcesBucket)).Get([]byte(income.SourceID))
+		if v == nil {
+			return errUnknownIncomeSource
+		}
+		var s IncomeSource
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		income.Source = s.Name
+		return nil
+	}
+	name := strings.TrimSpace(income.Source)
+	if name == "" {
+		return nil
+	}
+	s, err := findIncomeSource(tx, name)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		now := time.Now()
+		id := now.UnixNano()
+		for tx.Bucket([]byte(incomeSourcesBucket)).Get([]byte(fmt.Sprint(id))) != nil {
+			id++
+		}
+		s = &IncomeSource{
+			ID:               fmt.Sprint(id),
+			Name:             name,
+			Type:             guessIncomeSourceType(name),
+			DefaultRecurring: income.IsRecurring,
+			CreatedAt:        now.Format(time.RFC3339),
+			UpdatedAt:        now.Format(time.RFC3339),
+		}
+		if err := putIncomeSource(tx, *s); err != nil {
+			return err
+		}
+	}
+	income.SourceID = s.ID
+	income.Source = s.Name
+	return nil
+}
+
+// putIncomeSource stores a source without its computed totals
+func putIncomeSource(tx *bolt.Tx, s IncomeSource) error {
+	s.Entries, s.Received = 0, 0
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(incomeSourcesBucket)).Put([]byte(s.ID), data)
+}
+
+// migrateIncomeSources links entries saved with a free-text Source to a
+// managed source of that name
+func migrateIncomeSources(tx *bolt.Tx) (int, error) {
+	var failed error
+	n, err := rewriteRecords(tx, incomeBucket, func(income *Income) {
+		if err := linkIncomeSource(tx, income); err != nil && err != errUnknownIncomeSource {
+			failed = err
+		}
+	})
+	if failed != nil {
+		return n, failed
+	}
+	return n, err
+}
+
+// INCOME SOURCES
+
+func getIncomeSources(w http.ResponseWriter, r *http.Request) {
+	sources := []IncomeSource{}
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		index := map[string]int{}
+		err := forEach(r.Context(), tx.Bucket([]byte(incomeSourcesBucket)), func(k, v []byte) error {
+			var s IncomeSource
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			index[s.ID] = len(sources)
+			sources = append(sources, s)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var income Income
+			if json.Unmarshal(v, &income) != nil {
+				return nil
+			}
+			if i, ok := index[income.SourceID]; ok {
+				sources[i].Entries++
+				conv.add(&sources[i].Received, income.Amount, income.Currency)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, sources)
+}
+
+func createIncomeSource(w http.ResponseWriter, r *http.Request) {
+	var s IncomeSource
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if s.ID == "" {
+		s.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	s.CreatedAt = now.Format(time.RFC3339)
+	s.UpdatedAt = s.CreatedAt
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		existing, err := findIncomeSource(tx, s.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errDuplicateIncomeSource
+		}
+		return putIncomeSource(tx, s)
+	})
+	if err == errDuplicateIncomeSource {
+		respondError(w, http.StatusConflict, fmt.Sprintf("income source %q already exists", s.Name))
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, s)
+}
+
+// updateIncomeSource also renames the source on its income entries
+func updateIncomeSource(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var s IncomeSource
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.ID = id
+	s.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(incomeSourcesBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var old IncomeSource
+		json.Unmarshal(v, &old)
+		s.CreatedAt = old.CreatedAt
+		if other, err := findIncomeSource(tx, s.Name); err != nil {
+			return err
+		} else if other != nil && other.ID != id {
+			return errDuplicateIncomeSource
+		}
+		if err := putIncomeSource(tx, s); err != nil {
+			return err
+		}
+		_, err := rewriteRecords(tx, incomeBucket, func(income *Income) {
+			if income.SourceID == id {
+				income.Source = s.Name
+			}
+		})
+		return err
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "income source not found")
+	case err == errDuplicateIncomeSource:
+		respondError(w, http.StatusConflict, fmt.Sprintf("income source %q already exists", s.Name))
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusOK, s)
+	}
+}
+
+// deleteIncomeSource refuses to remove a source income entries still use;
+// they have to be moved to another source first
+func deleteIncomeSource(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	used := 0
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		err := forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var income Income
+			if json.Unmarshal(v, &income) == nil && income.SourceID == id {
+				used++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if used > 0 {
+			return errIncomeSourceInUse
+		}
+		j.track(incomeSourcesBucket, []byte(id))
+		return tx.Bucket([]byte(incomeSourcesBucket)).Delete([]byte(id))
+	})
+	if err == errIncomeSourceInUse {
+		respondError(w, http.StatusConflict, fmt.Sprintf("income source is used by %d income entries", used))
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Income source deleted"})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	insuranceTypes         = []string{"life", "term", "health", "vehicle", "home", "travel", "other"}
+	premiumFrequencies     = []string{"monthly", "quarterly", "half-yearly", "yearly", "single"}
+	premiumFrequencyMonths = map[string]int{"monthly": 1, "quarterly": 3, "half-yearly": 6, "yearly": 12}
+)
+
+// premiumCategory is the bill category premium reminders are raised in
+const premiumCategory = "Insurance"
+
+// InsurancePolicy is an insurance policy the household holds. The next
+// premium is always tracked as a bill reminder; paying it moves the renewal
+// date on and raises the bill for the premium after.
+type InsurancePolicy struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"` // life, term, health, vehicle, home, travel or other
+	Insurer      string `json:"insurer"`
+	PolicyNumber string `json:"policyNumber,omitempty"`
+	SumAssured   Money  `json:"sumAssured"`
+	Premium      Money  `json:"premium"`
+	Currency     string `json:"currency"`
+	Frequency    string `json:"frequency"`   // monthly, quarterly, half-yearly, yearly or single
+	RenewalDate  string `json:"renewalDate"` // next premium due
+	Nominee      string `json:"nominee,omitempty"`
+	User         string `json:"user,omitempty"` // policy holder
+	// Health cover for parents, and cover of senior citizens, have their own
+	// 80D limits
+	Parents   bool   `json:"parents,omitempty"`
+	Senior    bool   `json:"senior,omitempty"`
+	BillID    string `json:"billId,omitempty"` // reminder for the next premium
+	Notes     string `json:"notes,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+
+	TaxSection string `json:"taxSection,omitempty"` // computed: 80C, 80D or 80D-parents
+}
+
+func (p *InsurancePolicy) validate(settings Settings) error {
+	if err := oneOf("type", p.Type, insuranceTypes); err != nil {
+		return err
+	}
+	p.Insurer = strings.TrimSpace(p.Insurer)
+	if p.Insurer == "" {
+		return fmt.Errorf("insurer is required")
+	}
+	if p.SumAssured < 0 {
+		return fmt.Errorf("sumAssured cannot be negative")
+	}
+	if p.Premium <= 0 {
+		return fmt.Errorf("premium must be positive")
+	}
+	if p.Frequency == "" {
+		p.Frequency = "yearly"
+	}
+	if err := oneOf("frequency", p.Frequency, premiumFrequencies); err != nil {
+		return err
+	}
+	p.Nominee = strings.TrimSpace(p.Nominee)
+	var err error
+	if p.Currency, err = normalizeCurrency(p.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	p.Premium = roundForCurrency(p.Premium, p.Currency)
+	p.SumAssured = roundForCurrency(p.SumAssured, p.Currency)
+	if p.RenewalDate, err = normalizeDate(p.RenewalDate, settings.location(p.User)); err != nil {
+		return err
+	}
+	if p.RenewalDate == "" {
+		return fmt.Errorf("renewalDate is required")
+	}
+	return nil
+}
+
+// taxSection is the income tax deduction the policy's premiums count
+// towards, if any: life cover under 80C, health cover under 80D
+func (p InsurancePolicy) taxSection() string {
+	switch p.Type {
+	case "life", "term":
+		return "80C"
+	case "health":
+		if p.Parents {
+			return "80D-parents"
+		}
+		return "80D"
+	}
+	return ""
+}
+
+// premiumName is the name of the policy's premium bills
+func (p InsurancePolicy) premiumName() string {
+	name := p.Insurer + " " + p.Type + " premium"
+	if p.PolicyNumber != "" {
+		name += " (" + p.PolicyNumber + ")"
+	}
+	return name
+}
+
+// syncPremiumBill keeps the bill reminder for the policy's next premium in
+// step with the policy. Once that bill is paid the renewal date moves on a
+// cycle and the next bill is raised; single premium policies stop there. A
+// part-paid bill is left alone.
+func syncPremiumBill(tx *bolt.Tx, p *InsurancePolicy) error {
+	bills := tx.Bucket([]byte(billsBucket))
+	var bill BillReminder
+	if p.BillID != "" {
+		if v := bills.Get([]byte(p.BillID)); v != nil && json.Unmarshal(v, &bill) == nil {
+			bill.applyPayments()
+			switch {
+			case bill.IsPaid:
+				months := premiumFrequencyMonths[p.Frequency]
+				if months == 0 {
+					return nil
+				}
+				due, err := time.Parse(dateLayout, bill.DueDate)
+				if err != nil {
+					return err
+				}
+				if next := addMonthsClamped(due, months).Format(dateLayout); next > p.RenewalDate {
+					p.RenewalDate = next
+				}
+				bill = BillReminder{}
+			case len(bill.Payments) > 0:
+				return nil
+			case bill.Name == p.premiumName() && bill.Amount == p.Premium && bill.Currency == p.Currency &&
+				bill.DueDate == p.RenewalDate:
+				return nil
+			}
+		} else {
+			bill = BillReminder{}
+		}
+	}
+	if bill.ID == "" {
+		bill.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	bill.Name = p.premiumName()
+	bill.Amount = p.Premium
+	bill.Currency = p.Currency
+	bill.DueDate = p.RenewalDate
+	bill.Category = premiumCategory
+	bill.PolicyID = p.ID
+	bill.refresh(billToday())
+	data, err := json.Marshal(bill)
+	if err != nil {
+		return err
+	}
+	p.BillID = bill.ID
+	return bills.Put([]byte(bill.ID), data)
+}
+
+func putPolicy(tx *bolt.Tx, p InsurancePolicy) error {
+	p.TaxSection = ""
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(insurancePoliciesBucket)).Put([]byte(p.ID), data)
+}
+
+// advancePolicy syncs a policy with its premium bill, after the bill has
+// been paid
+func advancePolicy(tx *bolt.Tx, id string) error {
+	v := tx.Bucket([]byte(insurancePoliciesBucket)).Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	var p InsurancePolicy
+	if err := json.Unmarshal(v, &p); err != nil {
+		return err
+	}
+	billID, renewal := p.BillID, p.RenewalDate
+	if err := syncPremiumBill(tx, &p); err != nil {
+		return err
+	}
+	if p.BillID == billID && p.RenewalDate == renewal {
+		return nil
+	}
+	return putPolicy(tx, p)
+}
+
+// syncPremiumBills raises premium bills that have gone missing or been paid
+// outside the payments endpoint
+func syncPremiumBills() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		var ids []string
+		tx.Bucket([]byte(insurancePoliciesBucket)).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+		for _, id := range ids {
+			if err := advancePolicy(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func loadPolicies(tx *bolt.Tx) map[string]InsurancePolicy {
+	policies := map[string]InsurancePolicy{}
+	tx.Bucket([]byte(insurancePoliciesBucket)).ForEach(func(k, v []byte) error {
+		var p InsurancePolicy
+		if json.Unmarshal(v, &p) == nil {
+			policies[p.ID] = p
+		}
+		return nil
+	})
+	return policies
+}
+
+// INSURANCE
+
+// getPolicies lists policies by renewal date, optionally only those of one
+// ?type=
+func getPolicies(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("type")
+	policies := []InsurancePolicy{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(insurancePoliciesBucket)), func(k, v []byte) error {
+			var p InsurancePolicy
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if kind == "" || p.Type == kind {
+				p.TaxSection = p.taxSection()
+				policies = append(policies, p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].RenewalDate < policies[j].RenewalDate })
+	respondJSON(w, http.StatusOK, policies)
+}
+
+// savePolicy stores a created or edited policy along with the bill for its
+// next premium
+func savePolicy(w http.ResponseWriter, r *http.Request, p InsurancePolicy, status int) {
+	if err := p.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		p.BillID = ""
+		if v := tx.Bucket([]byte(insurancePoliciesBucket)).Get([]byte(p.ID)); v != nil {
+			var old InsurancePolicy
+			json.Unmarshal(v, &old)
+			p.CreatedAt, p.BillID = old.CreatedAt, old.BillID
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		if err := syncPremiumBill(tx, &p); err != nil {
+			return err
+		}
+		return putPolicy(tx, p)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "policy not found")
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		p.TaxSection = p.taxSection()
+		respondJSON(w, status, p)
+	}
+}
+
+func createPolicy(w http.ResponseWriter, r *http.Request) {
+	var p InsurancePolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if p.ID == "" {
+		p.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	p.CreatedAt = now.Format(time.RFC3339)
+	savePolicy(w, r, p, http.StatusCreated)
+}
+
+func updatePolicy(w http.ResponseWriter, r *http.Request) {
+	var p InsurancePolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.ID = mux.Vars(r)["id"]
+	savePolicy(w, r, p, http.StatusOK)
+}
+
+// deletePolicy removes a policy and its outstanding premium bill. Bills with
+// payments stay as history, unlinked.
+func deletePolicy(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		bills := tx.Bucket([]byte(billsBucket))
+		var linked []BillReminder
+		bills.ForEach(func(k, v []byte) error {
+			var bill BillReminder
+			if json.Unmarshal(v, &bill) == nil && bill.PolicyID == id {
+				linked = append(linked, bill)
+			}
+			return nil
+		})
+		for _, bill := range linked {
+			j.track(billsBucket, []byte(bill.ID))
+			if len(bill.Payments) == 0 && !bill.IsPaid {
+				if err := bills.Delete([]byte(bill.ID)); err != nil {
+					return err
+				}
+				continue
+			}
+			bill.PolicyID = ""
+			data, err := json.Marshal(bill)
+			if err != nil {
+				return err
+			}
+			if err := bills.Put([]byte(bill.ID), data); err != nil {
+				return err
+			}
+		}
+		j.track(insurancePoliciesBucket, []byte(id))
+		return tx.Bucket([]byte(insurancePoliciesBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Policy deleted"})
+}
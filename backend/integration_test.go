@@ -0,0 +1,4840 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/websocket"
+)
+
+func TestListEndpointsGolden(t *testing.T) {
+	s := newTestServer(t)
+	loadFixtures(t, s)
+
+	tests := []struct {
+		golden string
+		path   string
+	}{
+		{"expenses", "/api/expenses"},
+		{"budgets", "/api/budgets"},
+		{"goals", "/api/goals"},
+		{"investments", "/api/investments"},
+		{"bills", "/api/bills"},
+		{"income", "/api/income"},
+		{"income-sources", "/api/income-sources"},
+		{"stats", "/api/stats"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			assertGolden(t, tt.golden, s.mustDo("GET", tt.path, nil, http.StatusOK))
+		})
+	}
+}
+
+func TestEmptyListsAreArrays(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/api/expenses", "/api/budgets", "/api/goals", "/api/investments", "/api/bills", "/api/income"} {
+		if got := string(s.mustDo("GET", path, nil, http.StatusOK)); got != "[]\n" {
+			t.Errorf("GET %s = %q, want []", path, got)
+		}
+	}
+}
+
+func TestExpenseLifecycle(t *testing.T) {
+	s := newTestServer(t)
+
+	var created Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 99*majorUnit + 500, Description: "Tea", Category: "Dining", Date: "2026-01-05"}, http.StatusCreated), &created)
+	if created.ID == "" || created.CreatedAt == "" {
+		t.Fatalf("created expense missing server fields: %+v", created)
+	}
+	if created.Currency != "INR" {
+		t.Errorf("currency = %q, want INR default", created.Currency)
+	}
+
+	update := created
+	update.Amount = 120 * majorUnit
+	update.CreatedAt = ""
+	var updated Expense
+	decode(t, s.mustDo("PUT", "/api/expenses/"+created.ID, update, http.StatusOK), &updated)
+	if updated.Amount != 120*majorUnit || updated.CreatedAt != created.CreatedAt {
+		t.Errorf("update = %+v, want amount 120 and original createdAt %s", updated, created.CreatedAt)
+	}
+
+	s.mustDo("DELETE", "/api/expenses/"+created.ID, nil, http.StatusOK)
+	s.mustDo("GET", "/api/expenses/"+created.ID, nil, http.StatusNotFound)
+}
+
+func TestDeleteBudgetUnlinksExpenses(t *testing.T) {
+	s := newTestServer(t)
+	loadFixtures(t, s)
+
+	s.mustDo("DELETE", "/api/budgets/b-fun", nil, http.StatusOK)
+
+	var e Expense
+	decode(t, s.mustDo("GET", "/api/expenses/e-003", nil, http.StatusOK), &e)
+	if len(e.BudgetIds) != 1 || e.BudgetIds[0] != "b-groceries" {
+		t.Errorf("budgetIds = %v, want [b-groceries]", e.BudgetIds)
+	}
+}
+
+func TestReplicaRejectsWrites(t *testing.T) {
+	s := newTestServer(t)
+	config().Role = roleReplica
+	config().PrimaryURL = "http://primary.invalid"
+
+	s.mustDo("GET", "/api/expenses", nil, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit}, http.StatusServiceUnavailable)
+}
+
+func TestReplicationSnapshotNeedsToken(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("GET", "/api/replication/snapshot", nil, http.StatusNotFound)
+
+	config().ReplicationToken = "replica-secret"
+	s.mustDo("GET", "/api/replication/snapshot", nil, http.StatusUnauthorized)
+	s.token = "wrong"
+	s.mustDo("GET", "/api/replication/snapshot", nil, http.StatusUnauthorized)
+	s.token = "replica-secret"
+	if data := s.mustDo("GET", "/api/replication/snapshot", nil, http.StatusOK); len(data) == 0 {
+		t.Error("empty snapshot")
+	}
+}
+
+func TestIntegrityCheckAndRepair(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	loadFixtures(t, s)
+	db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(budgetsBucket)).Delete([]byte("b-fun"))
+		tx.Bucket([]byte(goalsBucket)).Put([]byte("g-broken"), []byte("{not json"))
+		return tx.Bucket([]byte(billsBucket)).Put([]byte("bill-moved"), []byte(`{"id":"bill-old","name":"Water"}`))
+	})
+
+	var report IntegrityReport
+	decode(t, s.mustDo("GET", "/api/admin/integrity", nil, http.StatusOK), &report)
+	kinds := map[string]int{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	want := map[string]int{"invalid_json": 1, "id_mismatch": 1, "dangling_reference": 2}
+	for kind, n := range want {
+		if kinds[kind] != n {
+			t.Errorf("%s issues = %d, want %d (%+v)", kind, kinds[kind], n, report.Issues)
+		}
+	}
+
+	decode(t, s.mustDo("POST", "/api/admin/integrity/repair", nil, http.StatusOK), &report)
+	if report.Repaired != 4 {
+		t.Errorf("repaired = %d, want 4", report.Repaired)
+	}
+	decode(t, s.mustDo("GET", "/api/admin/integrity", nil, http.StatusOK), &report)
+	if len(report.Issues) != 0 {
+		t.Errorf("issues after repair: %+v", report.Issues)
+	}
+	var e Expense
+	decode(t, s.mustDo("GET", "/api/expenses/e-003", nil, http.StatusOK), &e)
+	if len(e.BudgetIds) != 1 || e.BudgetIds[0] != "b-groceries" {
+		t.Errorf("budgetIds after repair = %v, want [b-groceries]", e.BudgetIds)
+	}
+}
+
+func TestCancelledRequestReturns503(t *testing.T) {
+	s := newTestServer(t)
+	loadFixtures(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/api/budgets", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503 (%s)", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestMaintenanceModeBlocksWrites(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	s.mustDo("PUT", "/api/admin/maintenance", MaintenanceState{Enabled: true, Reason: "compacting"}, http.StatusOK)
+	t.Cleanup(func() { maintenance.state = MaintenanceState{RetryAfterSeconds: 60} })
+
+	s.mustDo("GET", "/api/expenses", nil, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit}, http.StatusServiceUnavailable)
+
+	s.mustDo("PUT", "/api/admin/maintenance", MaintenanceState{Enabled: false}, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit}, http.StatusCreated)
+}
+
+func TestPanicIsRecoveredAndReported(t *testing.T) {
+	newTestServer(t)
+	config().ErrorWebhookURL = "http://errors.invalid"
+
+	router := newRouter()
+	router.HandleFunc("/api/boom", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/boom?month=2024-01", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	select {
+	case report := <-errorReports:
+		if !report.Panic || report.Message != "boom" || report.RequestID == "" {
+			t.Errorf("unexpected report %+v", report)
+		}
+		if report.RequestID != rec.Header().Get("X-Request-ID") {
+			t.Errorf("report request ID %q, response header %q", report.RequestID, rec.Header().Get("X-Request-ID"))
+		}
+		if len(report.QueryKeys) != 1 || report.QueryKeys[0] != "month" {
+			t.Errorf("query keys = %v, want [month]", report.QueryKeys)
+		}
+	default:
+		t.Fatal("no error report queued")
+	}
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	s := newTestServer(t)
+	router := newRouter()
+	serve := func(remote, auth string) int {
+		req := httptest.NewRequest("GET", "/api/admin/jobs", nil)
+		req.RemoteAddr = remote
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a token the admin API is off, even for local clients
+	s.mustDo("GET", "/api/admin/jobs", nil, http.StatusForbidden)
+	if got := serve("127.0.0.1:5000", ""); got != http.StatusForbidden {
+		t.Errorf("local without token: status %d, want 403", got)
+	}
+	if got := serve("@", ""); got != http.StatusForbidden {
+		t.Errorf("unix socket without token: status %d, want 403", got)
+	}
+
+	config().AdminToken = "s3cret"
+	if got := serve("127.0.0.1:5000", ""); got != http.StatusUnauthorized {
+		t.Errorf("missing token: status %d, want 401", got)
+	}
+	if got := serve("192.0.2.10:5000", "Bearer wrong"); got != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want 401", got)
+	}
+	if got := serve("192.0.2.10:5000", "Bearer s3cret"); got != http.StatusOK {
+		t.Errorf("valid token: status %d, want 200", got)
+	}
+	s.mustDo("GET", "/api/expenses", nil, http.StatusOK)
+}
+
+func TestDemoMode(t *testing.T) {
+	s := newTestServer(t)
+	loadFixtures(t, s)
+	if err := prepareDemo(); err == nil {
+		t.Fatal("prepareDemo accepted a database with real records")
+	}
+
+	config().DemoMode = true
+	config().RateLimitPerMinute = 3
+	t.Cleanup(func() { limiter.visitors = map[string]*visitor{} })
+
+	s.mustDo("GET", "/api/expenses", nil, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit}, http.StatusForbidden)
+	s.mustDo("GET", "/api/budgets", nil, http.StatusOK)
+	s.mustDo("GET", "/api/budgets", nil, http.StatusTooManyRequests)
+}
+
+func TestMoneyMigration(t *testing.T) {
+	s := newTestServer(t)
+	db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(expensesBucket)).Put([]byte("e-old"), []byte(`{"id":"e-old","amount":0.30000000000000004,"currency":"INR"}`))
+		return tx.Bucket([]byte(incomeBucket)).Put([]byte("i-yen"), []byte(`{"id":"i-yen","amount":1234.56,"currency":"JPY"}`))
+	})
+	if err := runStartupMigrations(); err != nil {
+		t.Fatal(err)
+	}
+
+	var e Expense
+	decode(t, s.mustDo("GET", "/api/expenses/e-old", nil, http.StatusOK), &e)
+	if e.Amount != 3*majorUnit/10 {
+		t.Errorf("expense amount = %s, want 0.30", e.Amount)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if v := string(tx.Bucket([]byte(incomeBucket)).Get([]byte("i-yen"))); !strings.Contains(v, `"amount":1235,`) {
+			t.Errorf("yen income stored as %s", v)
+		}
+		return nil
+	})
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	if err := runStartupMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if v := storedSchemaVersion(tx); v != currentSchemaVersion() {
+			t.Errorf("fresh store at schema version %d, want %d", v, currentSchemaVersion())
+		}
+		return nil
+	})
+
+	// A store from before versioning, with a count a client once set
+	setVersion := func(v string) {
+		db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(metaBucket)).Put([]byte(schemaVersionKey), []byte(v))
+		})
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(metaBucket)).Delete([]byte(schemaVersionKey))
+		return tx.Bucket([]byte(expensesBucket)).Put([]byte("e-old"), []byte(`{"id":"e-old","amount":1,"currency":"INR","commentCount":7}`))
+	})
+	if err := runStartupMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	var e Expense
+	decode(t, s.mustDo("GET", "/api/expenses/e-old", nil, http.StatusOK), &e)
+	if e.CommentCount != 0 {
+		t.Errorf("comment count = %d after backfill, want 0", e.CommentCount)
+	}
+	var stats DBStats
+	decode(t, s.mustDo("GET", "/api/admin/dbstats", nil, http.StatusOK), &stats)
+	if stats.SchemaVersion != currentSchemaVersion() {
+		t.Errorf("dbstats schema version = %d, want %d", stats.SchemaVersion, currentSchemaVersion())
+	}
+
+	// Applied migrations do not run again
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(expensesBucket)).Put([]byte("e-old"), []byte(`{"id":"e-old","amount":1,"currency":"INR","commentCount":3}`))
+	})
+	if err := runStartupMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, s.mustDo("GET", "/api/expenses/e-old", nil, http.StatusOK), &e)
+	if e.CommentCount != 3 {
+		t.Errorf("comment count = %d, want the migration not to rerun", e.CommentCount)
+	}
+
+	// Data from a newer release is refused
+	setVersion("99")
+	if err := runStartupMigrations(); err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Errorf("migrating a newer store: err = %v", err)
+	}
+	doc := FullExport{Format: fullExportFormat, Version: fullExportVersion, Buckets: map[string][]FullExportEntry{
+		expensesBucket: {},
+		metaBucket:     {{Key: schemaVersionKey, Value: json.RawMessage("99")}},
+	}}
+	if err := doc.validate(); err == nil {
+		t.Error("import of a newer export was accepted")
+	}
+}
+
+func TestDatesAreNormalized(t *testing.T) {
+	s := newTestServer(t)
+
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit, Date: "05/01/2026"}, http.StatusCreated), &e)
+	if e.Date != "2026-01-05" {
+		t.Errorf("date = %q, want 2026-01-05", e.Date)
+	}
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit, Date: "2026-01-05T23:30:00+05:30"}, http.StatusCreated), &e)
+	if e.Date != "2026-01-05" {
+		t.Errorf("timestamp date = %q, want 2026-01-05", e.Date)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit, Date: "next tuesday"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Rent", DueDate: "2026-02-30"}, http.StatusBadRequest)
+
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(goalsBucket)).Put([]byte("g-old"), []byte(`{"id":"g-old","deadline":"31 March 2027"}`))
+	})
+	if err := runStartupMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	var goals []Goal
+	decode(t, s.mustDo("GET", "/api/goals", nil, http.StatusOK), &goals)
+	if len(goals) != 1 || goals[0].Deadline != "2027-03-31" {
+		t.Errorf("migrated goals = %+v", goals)
+	}
+}
+
+func TestHouseholdTimezone(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("PUT", "/api/settings", Settings{Timezone: "Nowhere/Special"}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/settings", Settings{
+		Timezone:      "Asia/Kolkata",
+		UserTimezones: map[string]string{"bob": "America/New_York"},
+	}, http.StatusOK)
+
+	// 19:00 UTC is already the next day in India but not in New York
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit, Date: "2026-01-05T19:00:00Z", User: "alice"}, http.StatusCreated), &e)
+	if e.Date != "2026-01-06" {
+		t.Errorf("alice's date = %q, want 2026-01-06", e.Date)
+	}
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit, Date: "2026-01-05T19:00:00Z", User: "bob"}, http.StatusCreated), &e)
+	if e.Date != "2026-01-05" {
+		t.Errorf("bob's date = %q, want 2026-01-05", e.Date)
+	}
+}
+
+func TestDashboardRecentTransactions(t *testing.T) {
+	s := newTestServer(t)
+	for _, date := range []string{"2026-01-03", "2026-01-10", "2026-01-01", "2026-01-10"} {
+		s.mustDo("POST", "/api/expenses", Expense{Amount: majorUnit, Description: date, Date: date}, http.StatusCreated)
+	}
+
+	var dashboard struct {
+		RecentTransactions []Expense `json:"recentTransactions"`
+	}
+	decode(t, s.mustDo("GET", "/api/dashboard?recent=3", nil, http.StatusOK), &dashboard)
+	var got []string
+	for _, e := range dashboard.RecentTransactions {
+		got = append(got, e.Date)
+	}
+	if want := []string{"2026-01-10", "2026-01-10", "2026-01-03"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("recent dates = %v, want %v", got, want)
+	}
+	s.mustDo("GET", "/api/dashboard?recent=-1", nil, http.StatusBadRequest)
+}
+
+func TestExpenseCountAndSummary(t *testing.T) {
+	s := newTestServer(t)
+	for _, e := range []Expense{
+		{Amount: 100 * majorUnit, Category: "Groceries", User: "alice", Date: "2026-01-03"},
+		{Amount: 250*majorUnit + 500, Category: "Groceries", User: "bob", Date: "2026-01-20"},
+		{Amount: 40 * majorUnit, Category: "Transport", User: "alice", Date: "2026-02-01"},
+	} {
+		s.mustDo("POST", "/api/expenses", e, http.StatusCreated)
+	}
+
+	var count struct{ Count int }
+	decode(t, s.mustDo("GET", "/api/expenses/count?user=alice", nil, http.StatusOK), &count)
+	if count.Count != 2 {
+		t.Errorf("count for alice = %d, want 2", count.Count)
+	}
+
+	var summary Summary
+	decode(t, s.mustDo("GET", "/api/expenses/summary?category=Groceries&from=2026-01-01&to=2026-01-31", nil, http.StatusOK), &summary)
+	want := Summary{Count: 2, Total: 350*majorUnit + 500, Currency: "INR", UnconvertedCurrencies: []string{},
+		FirstDate: "2026-01-03", LastDate: "2026-01-20"}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+	s.mustDo("GET", "/api/expenses/summary?from=someday", nil, http.StatusBadRequest)
+
+	// Other currencies count at their rate, or not at all without one
+	s.mustDo("PUT", "/api/settings", Settings{ExchangeRates: map[string]float64{"USD": 80}}, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 10 * majorUnit, Currency: "USD", Category: "Groceries", Date: "2026-01-25"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 5 * majorUnit, Currency: "GBP", Category: "Groceries", Date: "2026-01-26"}, http.StatusCreated)
+	decode(t, s.mustDo("GET", "/api/expenses/summary?category=Groceries", nil, http.StatusOK), &summary)
+	if summary.Count != 4 || summary.Total != 1150*majorUnit+500 || fmt.Sprint(summary.UnconvertedCurrencies) != "[GBP]" {
+		t.Errorf("mixed currency summary = %+v", summary)
+	}
+}
+
+func TestCurrencies(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/investments", Investment{Name: "S&P 500", Currency: "XYZ"}, http.StatusBadRequest)
+
+	var budget Budget
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Travel", Month: "2026-01", Limit: 1000 * majorUnit, Currency: "usd"}, http.StatusCreated), &budget)
+	if budget.Currency != "USD" {
+		t.Errorf("budget currency = %q, want USD", budget.Currency)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 8320 * majorUnit, Date: "2026-01-05", BudgetIds: []string{budget.ID}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 50 * majorUnit, Currency: "EUR", Date: "2026-01-06", BudgetIds: []string{budget.ID}}, http.StatusCreated)
+
+	// Without rates, only the INR expense counts towards INR totals
+	var stats map[string]interface{}
+	decode(t, s.mustDo("GET", "/api/stats", nil, http.StatusOK), &stats)
+	if stats["totalSpent"] != 8320.0 || fmt.Sprint(stats["unconvertedCurrencies"]) != "[EUR USD]" {
+		t.Errorf("stats without rates = %v", stats)
+	}
+
+	s.mustDo("PUT", "/api/settings", Settings{ExchangeRates: map[string]float64{"usd": 83.2, "EUR": 91}}, http.StatusOK)
+	var budgets []Budget
+	decode(t, s.mustDo("GET", "/api/budgets", nil, http.StatusOK), &budgets)
+	// 8320 INR is 100 USD, 50 EUR is 4550 INR or 54.69 USD
+	if len(budgets) != 1 || budgets[0].Spent != 154*majorUnit+690 {
+		t.Errorf("budgets = %+v, want 154.69 USD spent", budgets)
+	}
+	decode(t, s.mustDo("GET", "/api/stats", nil, http.StatusOK), &stats)
+	if stats["totalSpent"] != 12870.0 || stats["monthlyBudget"] != 83200.0 {
+		t.Errorf("stats with rates = %v", stats)
+	}
+
+	// Fils survive in dinars; rupees round to paise; fractions are not amounts
+	var kwd, inr Expense
+	decode(t, s.mustDo("POST", "/api/expenses", map[string]interface{}{"amount": 1.234, "currency": "KWD", "date": "2026-02-01"}, http.StatusCreated), &kwd)
+	decode(t, s.mustDo("POST", "/api/expenses", map[string]interface{}{"amount": 1.234, "currency": "INR", "date": "2026-02-01"}, http.StatusCreated), &inr)
+	if kwd.Amount != majorUnit+234 || inr.Amount != majorUnit+230 {
+		t.Errorf("amounts = %s KWD, %s INR, want 1.234 KWD, 1.23 INR", kwd.Amount, inr.Amount)
+	}
+	s.mustDo("POST", "/api/expenses", map[string]interface{}{"amount": "1/3", "date": "2026-02-01"}, http.StatusBadRequest)
+}
+
+func TestBillStatusAndOverdueAlerts(t *testing.T) {
+	s := newTestServer(t)
+	day := func(offset int) string { return time.Now().AddDate(0, 0, offset).Format(dateLayout) }
+	for _, b := range []BillReminder{
+		{ID: "late", Name: "Water", Amount: 300 * majorUnit, DueDate: day(-2), Status: "upcoming"},
+		{ID: "soon", Name: "Phone", DueDate: day(1)},
+		{ID: "later", Name: "Insurance", DueDate: day(30), Status: "overdue"},
+		{ID: "done", Name: "Rent", DueDate: day(-5), Status: "paid"},
+	} {
+		s.mustDo("POST", "/api/bills", b, http.StatusCreated)
+	}
+
+	var bills []BillReminder
+	decode(t, s.mustDo("GET", "/api/bills", nil, http.StatusOK), &bills)
+	want := map[string]string{"late": billOverdue, "soon": billDue, "later": billUpcoming, "done": billPaid}
+	for _, b := range bills {
+		if b.Status != want[b.ID] {
+			t.Errorf("bill %s status = %q, want %q", b.ID, b.Status, want[b.ID])
+		}
+	}
+	decode(t, s.mustDo("GET", "/api/bills?status=overdue", nil, http.StatusOK), &bills)
+	if len(bills) != 1 || bills[0].ID != "late" {
+		t.Errorf("overdue bills = %+v", bills)
+	}
+	s.mustDo("GET", "/api/bills?status=stale", nil, http.StatusBadRequest)
+
+	// Each overdue bill is alerted once per due date
+	for i := 0; i < 2; i++ {
+		if err := checkOverdueBills(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var alerts []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(alertsBucket)).ForEach(func(k, v []byte) error {
+			alerts = append(alerts, string(k))
+			return nil
+		})
+	})
+	if want := []string{"bill.overdue:late:" + day(-2)}; fmt.Sprint(alerts) != fmt.Sprint(want) {
+		t.Errorf("alerts = %v, want %v", alerts, want)
+	}
+}
+
+func TestBillPartialPayments(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/bills", BillReminder{ID: "card", Name: "Credit Card", Amount: 10000 * majorUnit, Category: "Shopping", DueDate: "2026-01-20"}, http.StatusCreated)
+
+	var bill BillReminder
+	decode(t, s.mustDo("POST", "/api/bills/card/payments", map[string]interface{}{"amount": 4000, "date": "2026-01-10", "createExpense": true}, http.StatusCreated), &bill)
+	if bill.AmountPaid != 4000*majorUnit || bill.Remaining != 6000*majorUnit || bill.IsPaid {
+		t.Errorf("after first payment: %+v", bill)
+	}
+	s.mustDo("POST", "/api/bills/card/payments", map[string]interface{}{"amount": 7000}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/bills/missing/payments", map[string]interface{}{"amount": 1}, http.StatusNotFound)
+
+	var expense Expense
+	decode(t, s.mustDo("GET", "/api/expenses/"+bill.Payments[0].ExpenseID, nil, http.StatusOK), &expense)
+	if expense.Amount != 4000*majorUnit || expense.Category != "Shopping" || expense.Date != "2026-01-10" {
+		t.Errorf("linked expense = %+v", expense)
+	}
+
+	// Editing the bill keeps its payment history
+	s.mustDo("PUT", "/api/bills/card", BillReminder{Name: "Credit Card", Amount: 10000 * majorUnit, DueDate: "2026-01-20"}, http.StatusOK)
+	decode(t, s.mustDo("POST", "/api/bills/card/payments", map[string]interface{}{"amount": 6000}, http.StatusCreated), &bill)
+	if len(bill.Payments) != 2 || bill.Remaining != 0 || !bill.IsPaid || bill.Status != billPaid {
+		t.Errorf("after paying in full: %+v", bill)
+	}
+
+	decode(t, s.mustDo("DELETE", "/api/bills/card/payments/"+bill.Payments[0].ID, nil, http.StatusOK), &bill)
+	if bill.Remaining != 4000*majorUnit || bill.IsPaid {
+		t.Errorf("after removing a payment: %+v", bill)
+	}
+	s.mustDo("GET", "/api/expenses/"+expense.ID, nil, http.StatusNotFound)
+	decode(t, s.mustDo("GET", "/api/bills/card", nil, http.StatusOK), &bill)
+	if len(bill.Payments) != 1 || bill.Payments[0].Amount != 6000*majorUnit {
+		t.Errorf("payment history = %+v", bill.Payments)
+	}
+}
+
+func TestIncomeSources(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/income-sources", IncomeSource{Name: "Flat rent", Type: "lottery"}, http.StatusBadRequest)
+	var flat IncomeSource
+	decode(t, s.mustDo("POST", "/api/income-sources", IncomeSource{Name: "Flat rent"}, http.StatusCreated), &flat)
+	if flat.Type != "rental" {
+		t.Errorf("guessed type = %q, want rental", flat.Type)
+	}
+	s.mustDo("POST", "/api/income-sources", IncomeSource{Name: "flat RENT"}, http.StatusConflict)
+
+	// Free-text sources link to the matching source or create one
+	var income Income
+	decode(t, s.mustDo("POST", "/api/income", Income{Amount: 20000 * majorUnit, Source: "flat rent"}, http.StatusCreated), &income)
+	if income.SourceID != flat.ID || income.Source != "Flat rent" {
+		t.Errorf("linked income = %+v", income)
+	}
+	decode(t, s.mustDo("POST", "/api/income", Income{Amount: 500 * majorUnit, Source: "Savings interest"}, http.StatusCreated), &income)
+	s.mustDo("POST", "/api/income", Income{Amount: majorUnit, SourceID: "nope"}, http.StatusBadRequest)
+
+	s.mustDo("PUT", "/api/income-sources/"+flat.ID, IncomeSource{Name: "Koramangala flat", Type: "rental"}, http.StatusOK)
+	var sources []IncomeSource
+	decode(t, s.mustDo("GET", "/api/income-sources", nil, http.StatusOK), &sources)
+	if len(sources) != 2 {
+		t.Fatalf("sources = %+v", sources)
+	}
+	for _, src := range sources {
+		if src.ID == flat.ID && (src.Entries != 1 || src.Received != 20000*majorUnit) {
+			t.Errorf("flat totals = %+v", src)
+		}
+		if src.ID == income.SourceID && src.Type != "interest" {
+			t.Errorf("created source = %+v", src)
+		}
+	}
+	var incomes []Income
+	decode(t, s.mustDo("GET", "/api/income", nil, http.StatusOK), &incomes)
+	for _, i := range incomes {
+		if i.SourceID == flat.ID && i.Source != "Koramangala flat" {
+			t.Errorf("renamed source not applied: %+v", i)
+		}
+	}
+	s.mustDo("DELETE", "/api/income-sources/"+flat.ID, nil, http.StatusConflict)
+}
+
+func TestGoalLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/goals", Goal{Name: "Bike", Status: "dreaming"}, http.StatusBadRequest)
+
+	var goal Goal
+	decode(t, s.mustDo("POST", "/api/goals", Goal{ID: "bike", Name: "Bike", Target: 90000 * majorUnit, Current: 60000 * majorUnit}, http.StatusCreated), &goal)
+	if goal.Status != goalActive {
+		t.Errorf("new goal status = %q, want active", goal.Status)
+	}
+	decode(t, s.mustDo("PUT", "/api/goals/bike", Goal{Name: "Bike", Target: 90000 * majorUnit, Current: 90000 * majorUnit}, http.StatusOK), &goal)
+	if goal.Status != goalCompleted || goal.CompletedAt == "" {
+		t.Errorf("funded goal = %+v, want completed", goal)
+	}
+	var alert Alert
+	db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket([]byte(alertsBucket)).Get([]byte("goal.completed:bike:"+goal.CompletedAt)), &alert)
+	})
+	if alert.Subject != "bike" {
+		t.Errorf("completion alert = %+v", alert)
+	}
+
+	// Completed a while ago: the nightly job archives it
+	db.Update(func(tx *bolt.Tx) error {
+		goal.CompletedAt = time.Now().Add(-40 * 24 * time.Hour).Format(time.RFC3339)
+		data, _ := json.Marshal(goal)
+		return tx.Bucket([]byte(goalsBucket)).Put([]byte("bike"), data)
+	})
+	if err := archiveCompletedGoals(); err != nil {
+		t.Fatal(err)
+	}
+	var goals []Goal
+	decode(t, s.mustDo("GET", "/api/goals", nil, http.StatusOK), &goals)
+	if len(goals) != 0 {
+		t.Errorf("archived goal listed by default: %+v", goals)
+	}
+	decode(t, s.mustDo("GET", "/api/goals?includeArchived=true", nil, http.StatusOK), &goals)
+	if len(goals) != 1 || goals[0].Status != goalArchived {
+		t.Errorf("goals including archived = %+v", goals)
+	}
+}
+
+func TestUndoDelete(t *testing.T) {
+	s := newTestServer(t)
+	loadFixtures(t, s)
+
+	var deleted map[string]string
+	decode(t, s.mustDo("DELETE", "/api/budgets/b-fun", nil, http.StatusOK), &deleted)
+	if deleted["actionId"] == "" {
+		t.Fatalf("delete response has no action ID: %v", deleted)
+	}
+	s.mustDo("POST", "/api/undo/"+deleted["actionId"], nil, http.StatusOK)
+
+	var budgets []Budget
+	decode(t, s.mustDo("GET", "/api/budgets", nil, http.StatusOK), &budgets)
+	if len(budgets) != 2 {
+		t.Errorf("budgets after undo = %+v", budgets)
+	}
+	var e Expense
+	decode(t, s.mustDo("GET", "/api/expenses/e-003", nil, http.StatusOK), &e)
+	if fmt.Sprint(e.BudgetIds) != "[b-groceries b-fun]" {
+		t.Errorf("budget links after undo = %v", e.BudgetIds)
+	}
+	s.mustDo("POST", "/api/undo/"+deleted["actionId"], nil, http.StatusNotFound)
+
+	// A record recreated since the delete is not overwritten
+	decode(t, s.mustDo("DELETE", "/api/expenses/e-001", nil, http.StatusOK), &deleted)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e-001", Amount: majorUnit}, http.StatusCreated)
+	s.mustDo("POST", "/api/undo/"+deleted["actionId"], nil, http.StatusConflict)
+}
+
+func TestNotifications(t *testing.T) {
+	s := newTestServer(t)
+	for _, a := range []Alert{
+		{ID: "bill.overdue:1", Type: "bill.overdue", Subject: "1", Message: "Rent is overdue"},
+		{ID: "bill.overdue:2", Type: "bill.overdue", Subject: "2", Message: "Power is overdue"},
+		{ID: "goal.completed:3", Type: "goal.completed", Subject: "3", Message: "Goal reached"},
+	} {
+		if _, err := emitAlert(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var unread struct {
+		Unread int            `json:"unread"`
+		ByType map[string]int `json:"byType"`
+	}
+	decode(t, s.mustDo("GET", "/api/notifications/unread", nil, http.StatusOK), &unread)
+	if unread.Unread != 3 || unread.ByType["bill.overdue"] != 2 {
+		t.Errorf("unread = %+v", unread)
+	}
+
+	var read Alert
+	decode(t, s.mustDo("POST", "/api/notifications/bill.overdue:1/read", nil, http.StatusOK), &read)
+	if read.ReadAt == "" {
+		t.Errorf("marked notification has no readAt: %+v", read)
+	}
+	s.mustDo("POST", "/api/notifications/nope/read", nil, http.StatusNotFound)
+
+	var list []Alert
+	decode(t, s.mustDo("GET", "/api/notifications?unread=true", nil, http.StatusOK), &list)
+	if len(list) != 2 {
+		t.Errorf("unread notifications = %+v", list)
+	}
+
+	// Muted types are kept out of the list and the counts
+	s.mustDo("PUT", "/api/notifications/mutes/bill.overdue", nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &list)
+	if len(list) != 1 || list[0].Type != "goal.completed" {
+		t.Errorf("notifications with bills muted = %+v", list)
+	}
+	decode(t, s.mustDo("GET", "/api/notifications/unread", nil, http.StatusOK), &unread)
+	if unread.Unread != 1 {
+		t.Errorf("unread with bills muted = %+v", unread)
+	}
+	var mutes []string
+	decode(t, s.mustDo("DELETE", "/api/notifications/mutes/bill.overdue", nil, http.StatusOK), &mutes)
+	if len(mutes) != 0 {
+		t.Errorf("mutes after unmuting = %v", mutes)
+	}
+
+	s.mustDo("POST", "/api/notifications/read", nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/notifications/unread", nil, http.StatusOK), &unread)
+	if unread.Unread != 0 {
+		t.Errorf("unread after marking all read = %+v", unread)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	s := newTestServer(t)
+	var sent []string
+	channelSenders["push"] = func(user string, alerts []Alert) error {
+		for _, a := range alerts {
+			sent = append(sent, user+":"+a.ID)
+		}
+		return nil
+	}
+	defer delete(channelSenders, "push")
+
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", map[string]interface{}{"channels": map[string][]string{"*": {"fax"}}}, http.StatusBadRequest)
+
+	now := time.Now().In(currentSettings().location("Sid"))
+	quiet := &QuietHours{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}
+	prefs := NotificationPrefs{
+		Channels:   map[string][]string{"*": {"push"}},
+		Digest:     []string{"goal.completed"},
+		DigestHour: (now.Hour() + 12) % 24,
+		QuietHours: quiet,
+	}
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", prefs, http.StatusOK)
+
+	for _, a := range []Alert{
+		{ID: "bill.overdue:1", Type: "bill.overdue"},
+		{ID: "budget.threshold:2", Type: "budget.threshold"},
+		{ID: "goal.completed:3", Type: "goal.completed"},
+	} {
+		if err := routeAlert(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Critical alerts ignore quiet hours; the rest are held
+	if fmt.Sprint(sent) != "[Sid:bill.overdue:1]" {
+		t.Fatalf("sent during quiet hours = %v", sent)
+	}
+	if err := flushNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("held alerts released during quiet hours: %v", sent)
+	}
+
+	// Once quiet hours are over the held alert goes out; the digest waits
+	// for its hour
+	prefs.QuietHours = nil
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", prefs, http.StatusOK)
+	if err := flushNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[Sid:bill.overdue:1 Sid:budget.threshold:2]" {
+		t.Fatalf("sent after quiet hours = %v", sent)
+	}
+	prefs.DigestHour = now.Hour()
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", prefs, http.StatusOK)
+	if err := flushNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 || sent[2] != "Sid:goal.completed:3" {
+		t.Fatalf("sent at digest hour = %v", sent)
+	}
+
+	held := 0
+	db.View(func(tx *bolt.Tx) error {
+		held = tx.Bucket([]byte(notificationOutboxBucket)).Stats().KeyN
+		return nil
+	})
+	if held != 0 {
+		t.Errorf("%d notifications still held", held)
+	}
+}
+
+func TestMyPreferences(t *testing.T) {
+	s := newTestServer(t)
+	s.token = s.register("Sid", roleAdult)
+	s.mustDo("PUT", "/api/me/preferences", map[string]string{"theme": "neon"}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/me/preferences", map[string]string{"theme": "dark", "baseCurrency": "usd"}, http.StatusOK)
+
+	var me struct {
+		User        string          `json:"user"`
+		Preferences UserPreferences `json:"preferences"`
+	}
+	decode(t, s.mustDo("GET", "/api/me", nil, http.StatusOK), &me)
+	p := me.Preferences
+	if me.User != "Sid" || p.Theme != "dark" || p.BaseCurrency != "USD" || p.DateFormat != "DD/MM/YYYY" {
+		t.Errorf("me = %+v", me)
+	}
+
+	// Other members keep the defaults, and a user header names nobody
+	s.token = ""
+	req, _ := http.NewRequest("GET", s.URL+"/api/me/preferences", nil)
+	req.Header.Set("Remote-User", "Sid")
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var other UserPreferences
+	json.NewDecoder(resp.Body).Decode(&other)
+	if other.User != "anonymous" || other.Theme != "system" {
+		t.Errorf("anonymous preferences = %+v", other)
+	}
+}
+
+func TestLocalizedNotifications(t *testing.T) {
+	s := newTestServer(t)
+	s.token = s.register("Sid", roleAdult)
+	s.mustDo("PUT", "/api/me/preferences", map[string]string{"locale": "hi-IN"}, http.StatusOK)
+	if _, err := emitAlert(newAlert("goal.completed:g1", "goal.completed", "g1", "alert.goal.completed", "Car", "5000.00", "INR")); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &list)
+	if len(list) != 1 || list[0].Message != `लक्ष्य "Car" ने 5000.00 INR का लक्ष्य पूरा कर लिया` {
+		t.Errorf("Hindi notifications = %+v", list)
+	}
+	s.token = ""
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &list)
+	if len(list) != 1 || list[0].Message != `Goal "Car" reached its target of 5000.00 INR` {
+		t.Errorf("English notifications = %+v", list)
+	}
+}
+
+func TestCustomFields(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/custom-fields", CustomField{Key: "km", Label: "Km driven", Type: "number"}, http.StatusCreated)
+	s.mustDo("POST", "/api/custom-fields", CustomField{Key: "project", Type: "select", Options: []string{"home", "work"}}, http.StatusCreated)
+	s.mustDo("POST", "/api/custom-fields", CustomField{Key: "project", Type: "text"}, http.StatusConflict)
+	s.mustDo("POST", "/api/custom-fields", CustomField{Key: "bad key", Type: "text"}, http.StatusBadRequest)
+
+	s.mustDo("POST", "/api/expenses", Expense{ID: "x1", Amount: 10 * majorUnit, CustomFields: map[string]interface{}{"project": "play"}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "x1", Amount: 10 * majorUnit, CustomFields: map[string]interface{}{"colour": "red"}}, http.StatusBadRequest)
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{ID: "x1", Amount: 10 * majorUnit, CustomFields: map[string]interface{}{"project": "work", "km": "42.5"}}, http.StatusCreated), &e)
+	if e.CustomFields["km"] != 42.5 {
+		t.Errorf("km not stored as a number: %#v", e.CustomFields)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{ID: "x2", Amount: 5 * majorUnit, CustomFields: map[string]interface{}{"project": "work"}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "x3", Amount: 7 * majorUnit, CustomFields: map[string]interface{}{"project": "home"}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "x4", Amount: 1 * majorUnit}, http.StatusCreated)
+
+	var list []Expense
+	decode(t, s.mustDo("GET", "/api/expenses?field.project=work", nil, http.StatusOK), &list)
+	if len(list) != 2 {
+		t.Errorf("expenses for project work = %+v", list)
+	}
+	var summary Summary
+	decode(t, s.mustDo("GET", "/api/expenses/summary?field.km=42.5", nil, http.StatusOK), &summary)
+	if summary.Count != 1 || summary.Total != 10*majorUnit {
+		t.Errorf("summary for km=42.5 = %+v", summary)
+	}
+
+	var groups []BreakdownGroup
+	decode(t, s.mustDo("GET", "/api/expenses/breakdown?by=field.project", nil, http.StatusOK), &groups)
+	if len(groups) != 3 || groups[0].Value != "work" || groups[0].Total != 15*majorUnit || groups[2].Value != "" {
+		t.Errorf("breakdown by project = %+v", groups)
+	}
+	s.mustDo("GET", "/api/expenses/breakdown?by=merchant", nil, http.StatusBadRequest)
+
+	s.mustDo("DELETE", "/api/custom-fields/project", nil, http.StatusConflict)
+}
+
+func TestMerchantDirectory(t *testing.T) {
+	s := newTestServer(t)
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{ID: "m1", Amount: 300 * majorUnit, Merchant: "D-Mart", Date: "2026-01-02"}, http.StatusCreated), &e)
+	if e.Category != "Groceries" {
+		t.Errorf("category from merchant = %q", e.Category)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{ID: "m2", Amount: 200 * majorUnit, Merchant: "dmart", Category: "Household", Date: "2026-01-05"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "m3", Amount: 50 * majorUnit, Merchant: "Corner Store", Date: "2026-01-03"}, http.StatusCreated)
+
+	var merchants []Merchant
+	decode(t, s.mustDo("GET", "/api/merchants", nil, http.StatusOK), &merchants)
+	if len(merchants) != 2 {
+		t.Fatalf("merchants = %+v", merchants)
+	}
+	dmart := merchants[0]
+	if dmart.Key != "dmart" || dmart.Name != "DMart" || dmart.Source != "bundled" || dmart.LogoURL == "" ||
+		dmart.Transactions != 2 || dmart.Total != 500*majorUnit || dmart.LastSeen != "2026-01-05" {
+		t.Errorf("enriched merchant = %+v", dmart)
+	}
+	if corner := merchants[1]; corner.Name != "Corner Store" || corner.Source != "" {
+		t.Errorf("unknown merchant = %+v", corner)
+	}
+
+	// Manual edits win over enrichment
+	s.mustDo("PUT", "/api/merchants/cornerstore", Merchant{Name: "Corner Store", DefaultCategory: "Groceries"}, http.StatusOK)
+	if err := enrichMerchants(); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{ID: "m4", Amount: 20 * majorUnit, Merchant: "Corner store"}, http.StatusCreated), &e)
+	if e.Category != "Groceries" {
+		t.Errorf("category from edited merchant = %q", e.Category)
+	}
+	s.mustDo("PUT", "/api/merchants/nowhere", Merchant{Name: "Nowhere"}, http.StatusNotFound)
+}
+
+func TestMerchantAliases(t *testing.T) {
+	s := newTestServer(t)
+	var e Expense
+	for i, name := range []string{"AMZN Mktp IN*1A2B3C", "Amazon.in", "AMAZON PAY INDIA"} {
+		decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: Money(i+1) * 100 * majorUnit, Merchant: name,
+			Date: fmt.Sprintf("2026-0%d-10", i+1), User: "mom"}, http.StatusCreated), &e)
+		if e.Merchant != "Amazon" || e.Category != "Shopping" {
+			t.Fatalf("%s recorded as %q in %q", name, e.Merchant, e.Category)
+		}
+	}
+
+	// Household aliases roll local names up too
+	s.mustDo("POST", "/api/merchants", Merchant{Name: ""}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/merchants", Merchant{Name: "Amazon"}, http.StatusConflict)
+	s.mustDo("POST", "/api/merchants", Merchant{Name: "Sharma Kirana", Aliases: []string{"AMZN"}}, http.StatusConflict)
+	var kirana Merchant
+	decode(t, s.mustDo("POST", "/api/merchants", Merchant{Name: "Sharma Kirana", Aliases: []string{"SHARMA GEN STORE", " "},
+		DefaultCategory: "Groceries"}, http.StatusCreated), &kirana)
+	if kirana.Key != "sharmakirana" || len(kirana.Aliases) != 1 || kirana.Source != "manual" {
+		t.Fatalf("created merchant = %+v", kirana)
+	}
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 80 * majorUnit, Merchant: "SHARMA GEN STORE BLR", Date: "2026-03-12", User: "dad"},
+		http.StatusCreated), &e)
+	if e.Merchant != "Sharma Kirana" || e.Category != "Groceries" {
+		t.Fatalf("aliased expense = %+v", e)
+	}
+
+	var spending MerchantSpending
+	decode(t, s.mustDo("GET", "/api/merchants/amazon/spending", nil, http.StatusOK), &spending)
+	if spending.Transactions != 3 || spending.Total != 600*majorUnit || spending.Average != 200*majorUnit ||
+		len(spending.Months) != 3 || spending.Months[0].Month != "2026-01" || spending.ByUser["mom"] != 600*majorUnit ||
+		len(spending.Merchant.Aliases) == 0 {
+		t.Fatalf("amazon spending = %+v", spending)
+	}
+	decode(t, s.mustDo("GET", "/api/merchants/amazon/spending?from=2026-02-01", nil, http.StatusOK), &spending)
+	if spending.Transactions != 2 || spending.FirstDate != "2026-02-10" {
+		t.Fatalf("amazon spending since February = %+v", spending)
+	}
+	s.mustDo("GET", "/api/merchants/nowhere/spending", nil, http.StatusNotFound)
+
+	s.mustDo("GET", "/api/merchants/sharmakirana", nil, http.StatusOK)
+	s.mustDo("DELETE", "/api/merchants/sharmakirana", nil, http.StatusOK)
+	s.mustDo("GET", "/api/merchants/sharmakirana", nil, http.StatusNotFound)
+	s.mustDo("DELETE", "/api/merchants/sharmakirana", nil, http.StatusNotFound)
+}
+
+func TestSettleUp(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "s1", Amount: 900 * majorUnit, User: "Mom",
+		Splits: []ExpenseSplit{{User: "Mom", Amount: 300 * majorUnit}, {User: "Dad", Amount: 500 * majorUnit}}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "s1", Amount: 9000 * majorUnit, User: "Mom",
+		Splits: []ExpenseSplit{{User: "Mom", Amount: 4500 * majorUnit}, {User: "Dad", Amount: 4500 * majorUnit}}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "s2", Amount: 2100 * majorUnit, User: "Dad",
+		Splits: []ExpenseSplit{{User: "Mom", Amount: 1050 * majorUnit}, {User: "Dad", Amount: 1050 * majorUnit}}}, http.StatusCreated)
+
+	var balances []Balance
+	decode(t, s.mustDo("GET", "/api/balances", nil, http.StatusOK), &balances)
+	if len(balances) != 1 || balances[0].Message != "Dad owes Mom ₹3,450" {
+		t.Fatalf("balances = %+v", balances)
+	}
+
+	s.mustDo("POST", "/api/balances/settle", Transfer{From: "Mom", To: "Dad"}, http.StatusConflict)
+	s.mustDo("POST", "/api/balances/settle", Transfer{From: "Dad", To: "Mom", Amount: 4000 * majorUnit}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/balances/settle", Transfer{From: "Dad", To: "Mom", Amount: 450 * majorUnit}, http.StatusCreated)
+	var settled struct {
+		Transfer Transfer  `json:"transfer"`
+		Balances []Balance `json:"balances"`
+	}
+	decode(t, s.mustDo("POST", "/api/balances/settle", Transfer{From: "Dad", To: "Mom"}, http.StatusCreated), &settled)
+	if settled.Transfer.Amount != 3000*majorUnit || settled.Transfer.Kind != "settlement" || len(settled.Balances) != 0 {
+		t.Errorf("settle = %+v", settled)
+	}
+
+	// Transfers are not spending
+	var stats map[string]interface{}
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &stats)
+	if spent := stats["stats"].(map[string]interface{})["totalSpent"]; spent != 11100.0 {
+		t.Errorf("totalSpent = %v", spent)
+	}
+}
+
+func TestDebts(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/debts", Debt{Direction: "gifted", Counterparty: "Ravi", Amount: majorUnit}, http.StatusBadRequest)
+	yesterday := time.Now().In(householdLocation()).AddDate(0, 0, -1).Format(dateLayout)
+	var lent, borrowed Debt
+	decode(t, s.mustDo("POST", "/api/debts", Debt{ID: "d1", Direction: "lent", Counterparty: "Ravi", Amount: 5000 * majorUnit, DueDate: yesterday, User: "Dad"}, http.StatusCreated), &lent)
+	if lent.Status != debtOverdue || lent.Outstanding != 5000*majorUnit {
+		t.Errorf("new debt = %+v", lent)
+	}
+	s.mustDo("POST", "/api/debts", Debt{ID: "d2", Direction: "borrowed", Counterparty: "Aunt Meera", Amount: 2000 * majorUnit, User: "Mom"}, http.StatusCreated)
+
+	// Repayments become income or expenses
+	decode(t, s.mustDo("POST", "/api/debts/d1/repayments", paymentRequest{Amount: 1500 * majorUnit}, http.StatusCreated), &lent)
+	if lent.Outstanding != 3500*majorUnit || len(lent.Repayments) != 1 || lent.Repayments[0].IncomeID == "" {
+		t.Errorf("after repayment = %+v", lent)
+	}
+	s.mustDo("POST", "/api/debts/d1/repayments", paymentRequest{Amount: 4000 * majorUnit}, http.StatusBadRequest)
+	var incomes []Income
+	decode(t, s.mustDo("GET", "/api/income", nil, http.StatusOK), &incomes)
+	if len(incomes) != 1 || incomes[0].ID != lent.Repayments[0].IncomeID || incomes[0].Source != debtRepaymentSource ||
+		incomes[0].User != "Dad" || incomes[0].Amount != 1500*majorUnit {
+		t.Errorf("repayment income = %+v", incomes)
+	}
+	decode(t, s.mustDo("POST", "/api/debts/d2/repayments", paymentRequest{Amount: 2000 * majorUnit}, http.StatusCreated), &borrowed)
+	if borrowed.Status != debtSettled || borrowed.Repayments[0].ExpenseID == "" {
+		t.Errorf("repaid loan = %+v", borrowed)
+	}
+
+	var dashboard struct {
+		Stats map[string]interface{} `json:"stats"`
+	}
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &dashboard)
+	if stats := dashboard.Stats; stats["debtsLent"] != 3500.0 || stats["debtsBorrowed"] != 0.0 || stats["netWorth"] != 3500.0 {
+		t.Errorf("dashboard debt stats = %v", stats)
+	}
+
+	if err := checkDebts(); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Message != "Ravi still owes you ₹3,500, which was due on "+yesterday {
+		t.Errorf("debt alerts = %+v", alerts)
+	}
+
+	// Removing a repayment removes its income entry too
+	s.mustDo("DELETE", "/api/debts/d1/repayments/"+lent.Repayments[0].ID, nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/income", nil, http.StatusOK), &incomes)
+	if len(incomes) != 0 {
+		t.Errorf("income after removing the repayment = %+v", incomes)
+	}
+}
+
+func TestAllowances(t *testing.T) {
+	s := newTestServer(t)
+	loc := householdLocation()
+	start := time.Now().In(loc).AddDate(0, 0, -14).Format(dateLayout)
+	s.mustDo("POST", "/api/allowances", AllowanceRule{Child: "Riya", Amount: 100 * majorUnit, Frequency: "daily"}, http.StatusBadRequest)
+	var rule AllowanceRule
+	decode(t, s.mustDo("POST", "/api/allowances", AllowanceRule{ID: "a1", Child: "Riya", Parent: "Mom", Amount: 200 * majorUnit,
+		Frequency: "weekly", StartDate: start, LowBalance: 100 * majorUnit}, http.StatusCreated), &rule)
+	if rule.NextDate != start {
+		t.Errorf("first credit on %s, want %s", rule.NextDate, start)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 350 * majorUnit, User: "Riya", Date: today(loc)}, http.StatusCreated)
+
+	// Three weekly credits have fallen due: 14 and 7 days ago, and today
+	if err := creditAllowances(); err != nil {
+		t.Fatal(err)
+	}
+	if err := creditAllowances(); err != nil {
+		t.Fatal(err)
+	}
+	var bal AllowanceBalance
+	decode(t, s.mustDo("GET", "/api/allowances/a1/balance", nil, http.StatusOK), &bal)
+	if len(bal.Credits) != 3 || bal.Credited != 600*majorUnit || bal.Spent != 350*majorUnit || bal.Balance != 250*majorUnit || bal.Low {
+		t.Errorf("balance = %+v", bal)
+	}
+
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 200 * majorUnit, User: "Riya", Date: today(loc)}, http.StatusCreated)
+	if err := creditAllowances(); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Message != "Riya has only ₹50 of their allowance left" || fmt.Sprint(alerts[0].Recipients) != "[Mom]" {
+		t.Errorf("low balance alerts = %+v", alerts)
+	}
+}
+
+func TestReimbursementClaims(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e1", Amount: 1200 * majorUnit, Category: "Travel", Reimbursable: true}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e2", Amount: 800 * majorUnit, Category: "Travel", Reimbursable: true}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e3", Amount: 500 * majorUnit, Category: "Groceries"}, http.StatusCreated)
+
+	s.mustDo("POST", "/api/claims", Claim{Name: "Pune trip", ExpenseIDs: []string{"e1", "e3"}}, http.StatusBadRequest)
+	var claim Claim
+	decode(t, s.mustDo("POST", "/api/claims", Claim{Name: "Pune trip", Employer: "Acme", ExpenseIDs: []string{"e1", "e2"}}, http.StatusCreated), &claim)
+	if claim.Status != "draft" || claim.Total != 2000*majorUnit {
+		t.Errorf("new claim = %+v", claim)
+	}
+	s.mustDo("POST", "/api/claims", Claim{Name: "Again", ExpenseIDs: []string{"e2"}}, http.StatusConflict)
+
+	// States move one step at a time
+	s.mustDo("POST", "/api/claims/"+claim.ID+"/status", map[string]string{"status": "approved"}, http.StatusConflict)
+	s.mustDo("POST", "/api/claims/"+claim.ID+"/status", map[string]string{"status": "submitted"}, http.StatusOK)
+	s.mustDo("PUT", "/api/claims/"+claim.ID, Claim{Name: "Pune trip", ExpenseIDs: []string{"e1"}}, http.StatusConflict)
+	s.mustDo("POST", "/api/claims/"+claim.ID+"/status", map[string]string{"status": "approved"}, http.StatusOK)
+	s.mustDo("POST", "/api/claims/"+claim.ID+"/status", map[string]string{"status": "paid"}, http.StatusBadRequest)
+
+	s.mustDo("POST", "/api/income", Income{ID: "i1", Amount: 2000 * majorUnit, Source: "Acme"}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{ID: "i2", Amount: 50000 * majorUnit, Source: "Salary"}, http.StatusCreated)
+	decode(t, s.mustDo("POST", "/api/claims/"+claim.ID+"/status", map[string]string{"status": "paid", "incomeId": "i1"}, http.StatusOK), &claim)
+	if claim.Status != "paid" || claim.IncomeID != "i1" || claim.PaidAt == "" {
+		t.Errorf("paid claim = %+v", claim)
+	}
+
+	// Reimbursed expenses and the reimbursement leave personal analytics
+	var stats map[string]interface{}
+	decode(t, s.mustDo("GET", "/api/stats", nil, http.StatusOK), &stats)
+	if stats["totalSpent"] != 500.0 {
+		t.Errorf("totalSpent = %v", stats["totalSpent"])
+	}
+	var dashboard struct {
+		Stats map[string]interface{} `json:"stats"`
+	}
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &dashboard)
+	if dashboard.Stats["totalIncome"] != 50000.0 {
+		t.Errorf("dashboard totalIncome = %v", dashboard.Stats["totalIncome"])
+	}
+	var expense Expense
+	decode(t, s.mustDo("GET", "/api/expenses/e1", nil, http.StatusOK), &expense)
+	if !expense.Reimbursed || expense.ClaimID != claim.ID {
+		t.Errorf("claimed expense = %+v", expense)
+	}
+
+	// Deleting the claim puts everything back
+	s.mustDo("DELETE", "/api/claims/"+claim.ID, nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/stats", nil, http.StatusOK), &stats)
+	if stats["totalSpent"] != 2500.0 {
+		t.Errorf("totalSpent after delete = %v", stats["totalSpent"])
+	}
+}
+
+func TestTaxSummary(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Tax: &ExpenseTax{GSTRate: 101}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Tax: &ExpenseTax{Amount: 200 * majorUnit}}, http.StatusBadRequest)
+
+	// The tax is worked out from the rate when left out
+	var laptop Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 1180 * majorUnit, Date: "2026-01-10", User: "Asha",
+		Tax: &ExpenseTax{GSTRate: 18, Business: true, InvoiceNumber: " INV-42 "}}, http.StatusCreated), &laptop)
+	if laptop.Tax.Amount != 180*majorUnit || laptop.Tax.InvoiceNumber != "INV-42" {
+		t.Errorf("laptop tax = %+v", laptop.Tax)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 525 * majorUnit, Date: "2026-02-03", User: "Asha",
+		Tax: &ExpenseTax{GSTRate: 5, Amount: 25 * majorUnit, Business: true}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 112 * majorUnit, Date: "2026-04-02", User: "Asha",
+		Tax: &ExpenseTax{GSTRate: 12}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 300 * majorUnit, Date: "2026-01-11"}, http.StatusCreated)
+
+	var summary struct {
+		Periods []TaxPeriod `json:"periods"`
+		Total   TaxPeriod   `json:"total"`
+	}
+	decode(t, s.mustDo("GET", "/api/expenses/tax-summary?by=quarter&business=true", nil, http.StatusOK), &summary)
+	if len(summary.Periods) != 1 || summary.Periods[0].Label != "FY2025-26 Q4" || summary.Periods[0].Count != 2 {
+		t.Fatalf("quarters = %+v", summary.Periods)
+	}
+	if q := summary.Periods[0]; q.Tax != 205*majorUnit || q.Taxable != 1500*majorUnit || len(q.ByRate) != 2 || q.ByRate[0].GSTRate != 5 {
+		t.Errorf("quarter = %+v", q)
+	}
+
+	decode(t, s.mustDo("GET", "/api/expenses/tax-summary", nil, http.StatusOK), &summary)
+	if len(summary.Periods) != 3 || summary.Periods[2].Label != "2026-04" || summary.Total.Tax != 217*majorUnit {
+		t.Errorf("monthly summary = %+v", summary)
+	}
+	s.mustDo("GET", "/api/expenses/tax-summary?by=week", nil, http.StatusBadRequest)
+}
+
+func TestItemizedExpenses(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 500 * majorUnit, Items: []LineItem{{Name: "Rice", Price: 400 * majorUnit}}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses", Expense{Items: []LineItem{{Name: "", Price: 40 * majorUnit}}}, http.StatusBadRequest)
+
+	// Without an amount the expense takes the items' total
+	var bill Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Category: "Groceries", Merchant: "Corner Store", Items: []LineItem{
+		{Name: "Rice", Quantity: 2, Price: 120 * majorUnit},
+		{Name: "Detergent", Price: 250 * majorUnit, Category: "Household"},
+		{Name: "Shampoo", Price: 180 * majorUnit, Category: "Personal Care"},
+		{Name: "Milk", Quantity: 1.5, Price: 60 * majorUnit},
+	}}, http.StatusCreated), &bill)
+	if bill.Amount != 760*majorUnit || bill.Items[0].Amount != 240*majorUnit || bill.Items[1].Quantity != 1 {
+		t.Errorf("itemized expense = %+v", bill)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Category: "Household"}, http.StatusCreated)
+
+	var groups []BreakdownGroup
+	decode(t, s.mustDo("GET", "/api/expenses/breakdown?by=category", nil, http.StatusOK), &groups)
+	want := map[string]Money{"Groceries": 330 * majorUnit, "Household": 350 * majorUnit, "Personal Care": 180 * majorUnit}
+	if len(groups) != len(want) {
+		t.Fatalf("groups = %+v", groups)
+	}
+	for _, g := range groups {
+		if want[g.Value] != g.Total {
+			t.Errorf("%s total = %s, want %s", g.Value, g.Total, want[g.Value])
+		}
+	}
+
+	var dashboard struct {
+		Categories []struct {
+			Name  string  `json:"name"`
+			Value float64 `json:"value"`
+		} `json:"categoryData"`
+	}
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &dashboard)
+	for _, c := range dashboard.Categories {
+		if c.Name == "Household" && c.Value != 350 {
+			t.Errorf("dashboard Household = %v", c.Value)
+		}
+	}
+	if len(dashboard.Categories) != 3 {
+		t.Errorf("dashboard categories = %+v", dashboard.Categories)
+	}
+}
+
+func TestWarrantiesAndReturnWindows(t *testing.T) {
+	s := newTestServer(t)
+	loc := householdLocation()
+	now := time.Now().In(loc)
+	bought := now.AddDate(0, 0, -28).Format(dateLayout)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Date: bought, Purchase: &Purchase{ReturnBy: "2020-01-01"}}, http.StatusBadRequest)
+
+	var phone Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{ID: "phone", Amount: 30000 * majorUnit, Description: "Phone", User: "Dad", Date: bought,
+		Purchase: &Purchase{WarrantyMonths: 12, ReturnDays: 30}}, http.StatusCreated), &phone)
+	if want := addMonthsClamped(now.AddDate(0, 0, -28), 12).Format(dateLayout); phone.Purchase.WarrantyExpires != want {
+		t.Errorf("warranty expires %s, want %s", phone.Purchase.WarrantyExpires, want)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{ID: "kettle", Amount: 1500 * majorUnit, Description: "Kettle", Date: "2023-01-10",
+		Purchase: &Purchase{WarrantyMonths: 12}}, http.StatusCreated)
+
+	var warranties []Expense
+	decode(t, s.mustDo("GET", "/api/warranties", nil, http.StatusOK), &warranties)
+	if len(warranties) != 1 || warranties[0].ID != "phone" {
+		t.Errorf("under warranty = %+v", warranties)
+	}
+	decode(t, s.mustDo("GET", "/api/warranties?all=true", nil, http.StatusOK), &warranties)
+	if len(warranties) != 2 || warranties[0].ID != "kettle" {
+		t.Errorf("all warranties = %+v", warranties)
+	}
+
+	// The phone's return window closes in two days
+	if err := checkReturnWindows(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReturnWindows(); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Message != "The return window for Phone closes on "+phone.Purchase.ReturnBy ||
+		len(alerts[0].Recipients) != 1 || alerts[0].Recipients[0] != "Dad" {
+		t.Errorf("return alerts = %+v", alerts)
+	}
+
+	// Suggestions from receipt text need the ocr feature
+	req := map[string]string{"text": "2 year warranty. Return within 15 days.", "date": "2026-03-01"}
+	s.mustDo("POST", "/api/purchases/suggest", req, http.StatusNotFound)
+	c := *config()
+	c.Features = map[string]bool{"ocr": true}
+	setConfig(&c)
+	var suggested Purchase
+	decode(t, s.mustDo("POST", "/api/purchases/suggest", req, http.StatusOK), &suggested)
+	if suggested.WarrantyExpires != "2028-03-01" || suggested.ReturnBy != "2026-03-16" {
+		t.Errorf("suggested = %+v", suggested)
+	}
+}
+
+func TestPlannedPurchases(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now().In(householdLocation())
+	thisMonth := now.Format("2006-01")
+	nextMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0).Format("2006-01")
+	s.mustDo("POST", "/api/planned-purchases", PlannedPurchase{Item: "Sofa", EstimatedCost: 100 * majorUnit, TargetMonth: "next year"}, http.StatusBadRequest)
+
+	var tv PlannedPurchase
+	decode(t, s.mustDo("POST", "/api/planned-purchases", PlannedPurchase{Item: "TV", EstimatedCost: 40000 * majorUnit, Saved: 15000 * majorUnit,
+		TargetMonth: nextMonth, Priority: "high"}, http.StatusCreated), &tv)
+	if tv.Status != "planned" {
+		t.Errorf("new planned purchase = %+v", tv)
+	}
+	s.mustDo("POST", "/api/planned-purchases", PlannedPurchase{Item: "Old wish", EstimatedCost: 2000 * majorUnit, TargetMonth: "2020-01"}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Amount: 60000 * majorUnit, Source: "Salary", IsRecurring: true, Date: now.AddDate(0, 0, -20).Format(dateLayout)}, http.StatusCreated)
+
+	var flow struct {
+		Months []CashFlowMonth `json:"months"`
+	}
+	decode(t, s.mustDo("GET", "/api/cashflow?months=3", nil, http.StatusOK), &flow)
+	if len(flow.Months) != 3 || flow.Months[0].Month != thisMonth {
+		t.Fatalf("cash flow = %+v", flow.Months)
+	}
+	if m := flow.Months[1]; m.Planned != 25000*majorUnit {
+		t.Errorf("next month = %+v", m)
+	}
+	if m := flow.Months[0]; m.Planned != 2000*majorUnit {
+		t.Errorf("this month = %+v", m)
+	}
+	var income Money
+	for _, m := range flow.Months {
+		income += m.Income
+	}
+	if income < 60000*majorUnit {
+		t.Errorf("projected income = %s", income)
+	}
+
+	// Buying makes the expense and the goal in one go
+	var bought struct {
+		PlannedPurchase PlannedPurchase `json:"plannedPurchase"`
+		Expense         Expense         `json:"expense"`
+		Goal            Goal            `json:"goal"`
+	}
+	decode(t, s.mustDo("POST", "/api/planned-purchases/"+tv.ID+"/buy", buyRequest{Amount: 38000 * majorUnit, Category: "Shopping"}, http.StatusCreated), &bought)
+	if bought.Expense.Amount != 38000*majorUnit || bought.Expense.Description != "TV" || bought.Goal.Current != 15000*majorUnit ||
+		bought.Goal.Status != goalActive || bought.PlannedPurchase.ExpenseID != bought.Expense.ID || bought.PlannedPurchase.GoalID != bought.Goal.ID {
+		t.Errorf("bought = %+v", bought)
+	}
+	s.mustDo("GET", "/api/expenses/"+bought.Expense.ID, nil, http.StatusOK)
+	s.mustDo("POST", "/api/planned-purchases/"+tv.ID+"/buy", buyRequest{}, http.StatusConflict)
+	s.mustDo("PUT", "/api/planned-purchases/"+tv.ID, tv, http.StatusConflict)
+
+	decode(t, s.mustDo("GET", "/api/cashflow?months=3", nil, http.StatusOK), &flow)
+	if flow.Months[1].Planned != 0 {
+		t.Errorf("bought item still planned: %+v", flow.Months[1])
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := newTestServer(t)
+	loc := householdLocation()
+	now := time.Now().In(loc)
+	s.mustDo("POST", "/api/subscriptions", Subscription{Service: "Netflix", Amount: 649 * majorUnit, Cycle: "weekly", RenewalDate: today(loc)}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/subscriptions", Subscription{Service: "Netflix", Amount: 649 * majorUnit, RenewalDate: today(loc), ExpenseID: "missing"}, http.StatusBadRequest)
+
+	s.mustDo("POST", "/api/expenses", Expense{ID: "nf", Amount: 649 * majorUnit, Merchant: "Netflix"}, http.StatusCreated)
+	var netflix Subscription
+	decode(t, s.mustDo("POST", "/api/subscriptions", Subscription{Service: "Netflix", Plan: "Standard", Amount: 649 * majorUnit, ExpenseID: "nf",
+		RenewalDate: "2025-01-05", User: "Mom"}, http.StatusCreated), &netflix)
+	if netflix.Annualized != 12*649*majorUnit || netflix.Status != "active" || netflix.RemindDays != defaultRemindDays {
+		t.Errorf("new subscription = %+v", netflix)
+	}
+	var prime Subscription
+	decode(t, s.mustDo("POST", "/api/subscriptions", Subscription{Service: "Prime", Amount: 1499 * majorUnit, Cycle: "yearly",
+		RenewalDate: now.AddDate(0, 0, 1).Format(dateLayout)}, http.StatusCreated), &prime)
+	s.mustDo("POST", "/api/subscriptions", Subscription{Service: "Gym", Amount: 2000 * majorUnit, Cycle: "quarterly",
+		RenewalDate: now.AddDate(0, 0, 40).Format(dateLayout), Status: "cancelled"}, http.StatusCreated)
+
+	// Flag Prime for cancellation
+	prime.Status = "flagged"
+	decode(t, s.mustDo("PUT", "/api/subscriptions/"+prime.ID, prime, http.StatusOK), &prime)
+	if prime.FlaggedAt == "" {
+		t.Errorf("flagged subscription = %+v", prime)
+	}
+
+	var report struct {
+		Count          int   `json:"count"`
+		Annual         Money `json:"annual"`
+		FlaggedSavings Money `json:"flaggedSavings"`
+	}
+	decode(t, s.mustDo("GET", "/api/subscriptions/report", nil, http.StatusOK), &report)
+	if report.Count != 2 || report.Annual != (12*649+1499)*majorUnit || report.FlaggedSavings != 1499*majorUnit {
+		t.Errorf("report = %+v", report)
+	}
+
+	// Netflix's passed renewals roll on to the next 5th; Prime renews tomorrow
+	if err := checkSubscriptionRenewals(); err != nil {
+		t.Fatal(err)
+	}
+	var subs []Subscription
+	decode(t, s.mustDo("GET", "/api/subscriptions?status=active", nil, http.StatusOK), &subs)
+	if len(subs) != 1 || subs[0].RenewalDate < today(loc) || subs[0].RenewalDate[8:] != "05" ||
+		subs[0].RenewalDate > now.AddDate(0, 1, 0).Format(dateLayout) {
+		t.Errorf("renewed = %+v", subs)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	messages := map[string]bool{}
+	for _, a := range alerts {
+		messages[a.Message] = true
+	}
+	if !messages["Prime is flagged for cancellation but renews for ₹1,499 on "+prime.RenewalDate] {
+		t.Errorf("renewal alerts = %v", messages)
+	}
+}
+
+func TestEmergencyFund(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now().In(householdLocation())
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	lastMonth := first.AddDate(0, -1, 3).Format(dateLayout)
+	twoMonthsAgo := first.AddDate(0, -2, 10).Format(dateLayout)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 20000 * majorUnit, Category: "Groceries", Date: lastMonth}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 10000 * majorUnit, Category: "Utilities", Date: twoMonthsAgo}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 5000 * majorUnit, Category: "Dining", Date: lastMonth}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 99999 * majorUnit, Category: "Groceries", Date: first.Format(dateLayout)}, http.StatusCreated)
+
+	s.mustDo("PUT", "/api/emergency-fund", EmergencyFundConfig{TargetMonths: 6, TrailingMonths: 2, GoalID: "missing"}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/emergency-fund", EmergencyFundConfig{TargetMonths: 6, AlertBelowMonths: 8, TrailingMonths: 2}, http.StatusBadRequest)
+	var fund EmergencyFund
+	decode(t, s.mustDo("PUT", "/api/emergency-fund", EmergencyFundConfig{TargetMonths: 6, AlertBelowMonths: 3, TrailingMonths: 2,
+		Balance: 30000 * majorUnit}, http.StatusOK), &fund)
+	if fund.MonthlyEssential != 15000*majorUnit || fund.Target != 90000*majorUnit || fund.CoverageMonths != 2 || !fund.Low ||
+		fund.Shortfall != 60000*majorUnit || len(fund.Config.EssentialCategories) != 4 {
+		t.Errorf("fund = %+v", fund)
+	}
+
+	if err := checkEmergencyFund(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEmergencyFund(); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Message != "The emergency fund covers only 2.0 months of essential spending (target 6); ₹60,000 short" {
+		t.Errorf("fund alerts = %+v", alerts)
+	}
+
+	// A goal's savings count towards the fund
+	s.mustDo("POST", "/api/goals", Goal{ID: "ef", Name: "Rainy day", Target: 100000 * majorUnit, Current: 45000 * majorUnit}, http.StatusCreated)
+	decode(t, s.mustDo("PUT", "/api/emergency-fund", EmergencyFundConfig{TargetMonths: 6, AlertBelowMonths: 3, TrailingMonths: 2,
+		Balance: 30000 * majorUnit, GoalID: "ef"}, http.StatusOK), &fund)
+	if fund.Current != 75000*majorUnit || fund.CoverageMonths != 5 || fund.Low {
+		t.Errorf("fund with goal = %+v", fund)
+	}
+	decode(t, s.mustDo("GET", "/api/emergency-fund", nil, http.StatusOK), &fund)
+	if fund.Config.GoalID != "ef" {
+		t.Errorf("stored config = %+v", fund.Config)
+	}
+}
+
+func TestCreditScores(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now().In(householdLocation())
+	s.mustDo("POST", "/api/credit-scores", CreditScore{Member: "Dad", Bureau: "CIBIL", Score: 950}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/credit-scores", CreditScore{Member: "Dad", Bureau: "Acme", Score: 750}, http.StatusBadRequest)
+
+	for i, score := range []int{712, 735, 748} {
+		date := now.AddDate(0, 0, 91*(i-3)).Format(dateLayout)
+		s.mustDo("POST", "/api/credit-scores", CreditScore{Member: "Dad", Bureau: "CIBIL", Score: score, Date: date}, http.StatusCreated)
+	}
+	s.mustDo("POST", "/api/credit-scores", CreditScore{Member: "Mom", Bureau: "Experian", Score: 801, Notes: "after card closure"}, http.StatusCreated)
+
+	var history []CreditHistory
+	decode(t, s.mustDo("GET", "/api/credit-scores/history", nil, http.StatusOK), &history)
+	if len(history) != 2 || history[0].Member != "Dad" || len(history[0].Scores) != 3 || history[0].Latest.Score != 748 ||
+		history[0].Change != 13 || !history[0].Due || history[1].Due {
+		t.Fatalf("history = %+v", history)
+	}
+
+	var dashboard struct {
+		CreditScores []struct {
+			Member string `json:"member"`
+			Scores []int  `json:"scores"`
+		} `json:"creditScores"`
+	}
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &dashboard)
+	if len(dashboard.CreditScores) != 2 || len(dashboard.CreditScores[0].Scores) != 3 || dashboard.CreditScores[0].Scores[2] != 748 {
+		t.Errorf("dashboard sparklines = %+v", dashboard.CreditScores)
+	}
+
+	// Dad's latest check is a quarter old
+	if err := checkCreditScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCreditScores(); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Subject != "Dad" || alerts[0].Recipients[0] != "Dad" {
+		t.Errorf("recheck alerts = %+v", alerts)
+	}
+}
+
+func TestInsurancePremiumsAndDeductions(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now().In(householdLocation())
+	due := now.AddDate(0, 0, 10).Format(dateLayout)
+	s.mustDo("POST", "/api/insurance", InsurancePolicy{Type: "pet", Insurer: "Acme", Premium: majorUnit, RenewalDate: due}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/insurance", InsurancePolicy{Type: "health", Insurer: "Acme", RenewalDate: due}, http.StatusBadRequest)
+
+	var health InsurancePolicy
+	decode(t, s.mustDo("POST", "/api/insurance", InsurancePolicy{Type: "health", Insurer: "Star", SumAssured: 500000 * majorUnit,
+		Premium: 20000 * majorUnit, RenewalDate: due, Nominee: "Mom"}, http.StatusCreated), &health)
+	if health.BillID == "" || health.Frequency != "yearly" || health.TaxSection != "80D" {
+		t.Fatalf("health policy = %+v", health)
+	}
+	var bill BillReminder
+	decode(t, s.mustDo("GET", "/api/bills/"+health.BillID, nil, http.StatusOK), &bill)
+	if bill.Amount != 20000*majorUnit || bill.DueDate != due || bill.Category != premiumCategory || bill.PolicyID != health.ID {
+		t.Fatalf("premium bill = %+v", bill)
+	}
+
+	// Paying the premium raises the next year's bill
+	s.mustDo("POST", "/api/bills/"+bill.ID+"/payments", paymentRequest{Amount: 20000 * majorUnit}, http.StatusCreated)
+	var policies []InsurancePolicy
+	decode(t, s.mustDo("GET", "/api/insurance", nil, http.StatusOK), &policies)
+	next := addMonthsClamped(now.AddDate(0, 0, 10), 12).Format(dateLayout)
+	if len(policies) != 1 || policies[0].RenewalDate != next || policies[0].BillID == bill.ID {
+		t.Fatalf("policies after payment = %+v, want renewal %s", policies, next)
+	}
+	var nextBill BillReminder
+	decode(t, s.mustDo("GET", "/api/bills/"+policies[0].BillID, nil, http.StatusOK), &nextBill)
+	if nextBill.DueDate != next || nextBill.IsPaid {
+		t.Errorf("next premium bill = %+v", nextBill)
+	}
+
+	var life InsurancePolicy
+	decode(t, s.mustDo("POST", "/api/insurance", InsurancePolicy{Type: "life", Insurer: "LIC", Premium: 200000 * majorUnit,
+		Frequency: "single", RenewalDate: due}, http.StatusCreated), &life)
+	s.mustDo("POST", "/api/bills/"+life.BillID+"/payments", paymentRequest{Amount: 200000 * majorUnit}, http.StatusCreated)
+
+	var report struct {
+		Sections []TaxDeduction `json:"sections"`
+		Total    float64        `json:"total"`
+	}
+	decode(t, s.mustDo("GET", "/api/tax/deductions", nil, http.StatusOK), &report)
+	if len(report.Sections) != 3 || report.Sections[0].Paid != 200000*majorUnit || report.Sections[0].Deductible != 150000*majorUnit ||
+		report.Sections[1].Deductible != 20000*majorUnit || len(report.Sections[1].Sources) != 1 || report.Total != 170000 {
+		t.Errorf("deductions = %+v", report)
+	}
+	s.mustDo("GET", "/api/tax/deductions?year=soon", nil, http.StatusBadRequest)
+
+	// Deleting a policy drops its unpaid bill but keeps paid ones
+	s.mustDo("DELETE", "/api/insurance/"+health.ID, nil, http.StatusOK)
+	s.mustDo("GET", "/api/bills/"+nextBill.ID, nil, http.StatusNotFound)
+	var paid BillReminder
+	decode(t, s.mustDo("GET", "/api/bills/"+bill.ID, nil, http.StatusOK), &paid)
+	if paid.PolicyID != "" {
+		t.Errorf("paid premium bill still linked: %+v", paid)
+	}
+}
+
+func TestDocumentsVault(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("PUT", "/api/settings", Settings{MemberRoles: map[string]string{"Dad": "adult", "Mom": "adult", "Riya": "teen"}}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/settings", Settings{MemberRoles: map[string]string{"Dad": "adult", "Mom": "adult", "Riya": "child"}}, http.StatusOK)
+	dad := s.register("Dad", roleAdult)
+	s.token = dad
+	mom, riya := s.register("Mom", roleAdult), s.register("Riya", roleChild)
+	s.token = ""
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "passport.pdf")
+	part.Write([]byte("%PDF scan"))
+	form.WriteField("folder", "Identity")
+	form.WriteField("labels", "passport, travel,passport")
+	form.WriteField("owner", "Dad")
+	form.WriteField("expiresOn", time.Now().In(householdLocation()).AddDate(0, 0, 20).Format(dateLayout))
+	form.Close()
+	upload := func(token, user string) (*http.Response, Document) {
+		req, _ := http.NewRequest("POST", s.URL+"/api/documents", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Remote-User", user)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var d Document
+		json.NewDecoder(resp.Body).Decode(&d)
+		return resp, d
+	}
+	// A Remote-User header does not make anyone an adult
+	if resp, _ := upload("", "Dad"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("anonymous upload: status %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := upload(riya, "Dad"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("child upload: status %d, want 403", resp.StatusCode)
+	}
+	resp, doc := upload(dad, "")
+	if resp.StatusCode != http.StatusCreated || doc.Title != "passport.pdf" || len(doc.Labels) != 2 || doc.UploadedBy != "Dad" ||
+		doc.RemindDays != defaultDocumentRemindDays {
+		t.Fatalf("upload: status %d, document %+v", resp.StatusCode, doc)
+	}
+
+	s.token = riya
+	s.mustDo("GET", "/api/documents", nil, http.StatusForbidden)
+	s.mustDo("GET", "/api/documents/"+doc.ID+"/file", nil, http.StatusForbidden)
+	// Nor can a child promote themselves
+	s.mustDo("PUT", "/api/settings", Settings{MemberRoles: map[string]string{"Dad": "adult", "Mom": "adult", "Riya": "adult"}}, http.StatusForbidden)
+	s.token = mom
+	if got := string(s.mustDo("GET", "/api/documents/"+doc.ID+"/file", nil, http.StatusOK)); got != "%PDF scan" {
+		t.Errorf("file = %q", got)
+	}
+	var docs []Document
+	decode(t, s.mustDo("GET", "/api/documents?label=travel&expiring=true", nil, http.StatusOK), &docs)
+	if len(docs) != 1 {
+		t.Errorf("expiring travel documents = %+v", docs)
+	}
+	doc.Title, doc.Folder = "Dad's passport", ""
+	decode(t, s.mustDo("PUT", "/api/documents/"+doc.ID, doc, http.StatusOK), &doc)
+	if doc.Folder != defaultDocumentFolder || doc.FileName != "passport.pdf" {
+		t.Errorf("updated document = %+v", doc)
+	}
+
+	if err := checkDocumentExpiry(); err != nil {
+		t.Fatal(err)
+	}
+	s.token = dad
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Key != "alert.document.expiring" || alerts[0].Recipients[0] != "Dad" {
+		t.Fatalf("expiry alerts = %+v", alerts)
+	}
+	// Nor does a child hear of the vault through alerts
+	s.token = riya
+	var hidden []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &hidden)
+	var unread struct {
+		Unread int `json:"unread"`
+	}
+	decode(t, s.mustDo("GET", "/api/notifications/unread", nil, http.StatusOK), &unread)
+	if len(hidden) != 0 || unread.Unread != 0 {
+		t.Errorf("child's notifications = %+v, unread %d", hidden, unread.Unread)
+	}
+	decode(t, s.mustDo("GET", "/api/alerts", nil, http.StatusOK), &hidden)
+	if len(hidden) != 0 {
+		t.Errorf("child's alerts = %+v", hidden)
+	}
+	s.mustDo("POST", "/api/notifications/"+alerts[0].ID+"/read", nil, http.StatusNotFound)
+	s.mustDo("POST", "/api/notifications/read", nil, http.StatusOK)
+	s.token = dad
+	decode(t, s.mustDo("GET", "/api/notifications?unread=true", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 {
+		t.Errorf("child marked the adult's alert read: %+v", alerts)
+	}
+
+	s.mustDo("DELETE", "/api/documents/"+doc.ID, nil, http.StatusOK)
+	s.mustDo("GET", "/api/documents/"+doc.ID+"/file", nil, http.StatusNotFound)
+}
+
+func TestCommentMentions(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("PUT", "/api/settings", Settings{MemberRoles: map[string]string{"Dad": "adult", "Mom": "adult"}}, http.StatusOK)
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 1200 * majorUnit, Description: "Plumber", Category: "Utilities", User: "Dad", IsShared: true}, http.StatusCreated), &e)
+
+	dad := s.register("Dad", roleAdult)
+	s.token = dad
+	mom := s.register("Mom", roleAdult)
+	s.mustDo("POST", "/api/expenses/"+e.ID+"/comments", ExpenseComment{Content: " "}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses/missing/comments", ExpenseComment{Content: "hi"}, http.StatusNotFound)
+	var c ExpenseComment
+	decode(t, s.mustDo("POST", "/api/expenses/"+e.ID+"/comments", ExpenseComment{Content: "@mom can you check this? cc @Dad @nobody"}, http.StatusCreated), &c)
+	if c.Author != "Dad" || len(c.Mentions) != 1 || c.Mentions[0] != "Mom" {
+		t.Fatalf("comment = %+v, want Dad mentioning Mom", c)
+	}
+	decode(t, s.mustDo("GET", "/api/expenses/"+e.ID, nil, http.StatusOK), &e)
+	if e.CommentCount != 1 {
+		t.Errorf("commentCount = %d, want 1", e.CommentCount)
+	}
+	// Clients cannot set the count
+	e.CommentCount = 7
+	decode(t, s.mustDo("PUT", "/api/expenses/"+e.ID, e, http.StatusOK), &e)
+	if e.CommentCount != 1 {
+		t.Errorf("commentCount after edit = %d, want 1", e.CommentCount)
+	}
+
+	s.token = mom
+	var mentions []Mention
+	decode(t, s.mustDo("GET", "/api/me/mentions", nil, http.StatusOK), &mentions)
+	if len(mentions) != 1 || mentions[0].Comment.ID != c.ID || mentions[0].Expense.Description != "Plumber" || mentions[0].Read {
+		t.Fatalf("mentions = %+v", mentions)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/notifications", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Link != "/transactions?expense="+e.ID || alerts[0].Recipients[0] != "Mom" {
+		t.Fatalf("mention alerts = %+v", alerts)
+	}
+
+	// Reading the alert clears the mention
+	s.mustDo("POST", "/api/notifications/"+mentions[0].AlertID+"/read", nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/me/mentions", nil, http.StatusOK), &mentions)
+	if len(mentions) != 0 {
+		t.Errorf("mentions after reading = %+v", mentions)
+	}
+	decode(t, s.mustDo("GET", "/api/me/mentions?all=true", nil, http.StatusOK), &mentions)
+	if len(mentions) != 1 || !mentions[0].Read {
+		t.Errorf("all mentions = %+v", mentions)
+	}
+
+	s.mustDo("DELETE", "/api/expenses/"+e.ID+"/comments/"+c.ID, nil, http.StatusOK)
+	var comments []ExpenseComment
+	decode(t, s.mustDo("GET", "/api/expenses/"+e.ID+"/comments", nil, http.StatusOK), &comments)
+	decode(t, s.mustDo("GET", "/api/expenses/"+e.ID, nil, http.StatusOK), &e)
+	if len(comments) != 0 || e.CommentCount != 0 {
+		t.Errorf("after delete: comments %+v, commentCount %d", comments, e.CommentCount)
+	}
+}
+
+func TestDonationReportAndExport(t *testing.T) {
+	s := newTestServer(t)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "receipt.pdf")
+	part.Write([]byte("80G receipt"))
+	form.Close()
+	resp, err := s.Client().Post(s.URL+"/api/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploaded map[string]string
+	json.NewDecoder(resp.Body).Decode(&uploaded)
+	resp.Body.Close()
+	t.Cleanup(func() { os.Remove(filepath.Join(uploadsDir, uploaded["filename"])) })
+
+	today := time.Now().In(householdLocation()).Format(dateLayout)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Date: today, Donation: &Donation{Organization: " "}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Date: today, Donation: &Donation{Organization: "CRY", PAN: "bad"}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 5000 * majorUnit, Date: today, Category: "Charity", Attachments: []string{uploaded["url"]},
+		Donation: &Donation{Organization: "CRY", PAN: "aaatc1234f", Registration: "80G/123", ReceiptNumber: "R-1"}}, http.StatusCreated)
+	var attached Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 1000 * majorUnit, Date: today, Category: "Charity",
+		Donation: &Donation{Organization: "CRY India", PAN: "AAATC1234F", DeductionPercent: 100}}, http.StatusCreated), &attached)
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	part, _ = form.CreateFormFile("file", "receipt-2.pdf")
+	part.Write([]byte("80G receipt"))
+	form.Close()
+	resp, err = s.Client().Post(s.URL+"/api/expenses/"+attached.ID+"/attachments", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attachment Attachment
+	json.NewDecoder(resp.Body).Decode(&attachment)
+	resp.Body.Close()
+	t.Cleanup(func() { os.Remove(filepath.Join(uploadsDir, attachment.File)) })
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 3000 * majorUnit, Date: today, Category: "Charity",
+		Donation: &Donation{Organization: "Temple trust", Mode: "cash"}}, http.StatusCreated)
+
+	var report DonationReport
+	decode(t, s.mustDo("GET", "/api/donations/report", nil, http.StatusOK), &report)
+	// CRY: half of 5000 plus all of 1000; cash over 2000 isn't deductible
+	if len(report.Organizations) != 2 || report.Organizations[0].Organization != "CRY" || len(report.Organizations[0].Donations) != 2 ||
+		report.Organizations[0].Deductible != 3500*majorUnit || report.Organizations[1].Deductible != 0 ||
+		report.Total != 9000*majorUnit || report.Deductible != 3500*majorUnit {
+		t.Fatalf("report = %+v", report)
+	}
+	for _, d := range report.Organizations[0].Donations {
+		if len(d.Attachments) != 1 {
+			t.Errorf("donation %s receipts = %v", d.ExpenseID, d.Attachments)
+		}
+	}
+	s.mustDo("GET", "/api/donations/report?year=last", nil, http.StatusBadRequest)
+
+	data := s.mustDo("GET", "/api/donations/export", nil, http.StatusOK)
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		rc, _ := f.Open()
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	if len(files) != 3 || !strings.Contains(files["donations.csv"], "CRY,AAATC1234F,80G/123") {
+		t.Errorf("export files = %v", files)
+	}
+	for name, content := range files {
+		if strings.HasPrefix(name, "receipts/") && content != "80G receipt" {
+			t.Errorf("receipt %s = %q", name, content)
+		}
+	}
+}
+
+func TestMembers(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 40 * majorUnit, Description: "Bus pass", User: "dad"}, http.StatusCreated)
+
+	// Profiles are an adult's to manage
+	s.mustDo("POST", "/api/members", Member{Name: "riya"}, http.StatusUnauthorized)
+	mom := s.register("mom", roleAdult)
+	s.token = mom
+	s.mustDo("POST", "/api/members", Member{DisplayName: "Riya"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/members", Member{Name: "riya", Color: "red"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/members", Member{Name: "riya", Role: "teen"}, http.StatusBadRequest)
+	var riya, dad Member
+	decode(t, s.mustDo("POST", "/api/members", Member{Name: "riya", DisplayName: "Riya", Avatar: "🦊", Color: "#ff7043", Role: "child",
+		DefaultCurrency: "usd"}, http.StatusCreated), &riya)
+	if riya.ID == "" || riya.DefaultCurrency != "USD" || riya.Role != roleChild {
+		t.Fatalf("created member = %+v", riya)
+	}
+	s.mustDo("POST", "/api/members", Member{Name: "riya"}, http.StatusConflict)
+	if currentSettings().MemberRoles["riya"] != roleChild {
+		t.Errorf("member roles = %v", currentSettings().MemberRoles)
+	}
+
+	// Existing records under the name link to the new profile
+	decode(t, s.mustDo("POST", "/api/members", Member{Name: "dad"}, http.StatusCreated), &dad)
+	if dad.DisplayName != "dad" || dad.Role != roleAdult {
+		t.Fatalf("defaults = %+v", dad)
+	}
+	s.token = ""
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 1 || expenses[0].MemberID != dad.ID {
+		t.Fatalf("expenses = %+v", expenses)
+	}
+
+	// Records name members by ID, taking their name and currency
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 12 * majorUnit, Description: "Comics", MemberID: riya.ID}, http.StatusCreated), &e)
+	if e.User != "riya" || e.MemberID != riya.ID || e.Currency != "USD" {
+		t.Fatalf("expense by member ID = %+v", e)
+	}
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 5 * majorUnit, Description: "Snacks", User: "riya", Currency: "INR"}, http.StatusCreated), &e)
+	if e.MemberID != riya.ID || e.Currency != "INR" {
+		t.Fatalf("expense by name = %+v", e)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 5 * majorUnit, MemberID: "nope"}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/expenses/"+e.ID, Expense{Amount: 5 * majorUnit, Description: "Snacks", MemberID: "nope"}, http.StatusBadRequest)
+	var income Income
+	decode(t, s.mustDo("POST", "/api/income", Income{Amount: 20 * majorUnit, Source: "Pocket money", MemberID: riya.ID}, http.StatusCreated), &income)
+	if income.User != "riya" || income.Currency != "USD" {
+		t.Fatalf("income by member ID = %+v", income)
+	}
+
+	// Profiles change without the name records use
+	s.token = mom
+	s.mustDo("PUT", "/api/members/"+riya.ID, Member{Name: "riyaa"}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/members/nope", Member{DisplayName: "Nobody"}, http.StatusNotFound)
+	var updated Member
+	decode(t, s.mustDo("PUT", "/api/members/"+riya.ID, Member{DisplayName: "Riya S", Color: "#42a5f5", Role: "adult"}, http.StatusOK), &updated)
+	if updated.Name != "riya" || updated.DisplayName != "Riya S" || updated.DefaultCurrency != "" || currentSettings().MemberRoles["riya"] != roleAdult {
+		t.Fatalf("updated member = %+v", updated)
+	}
+	var members []Member
+	decode(t, s.mustDo("GET", "/api/members", nil, http.StatusOK), &members)
+	if len(members) != 3 || members[0].ID != dad.ID || members[2].DisplayName != "Riya S" {
+		t.Fatalf("members = %+v", members)
+	}
+
+	s.mustDo("DELETE", "/api/members/"+riya.ID, nil, http.StatusConflict)
+	var guest Member
+	decode(t, s.mustDo("POST", "/api/members", Member{Name: "guest"}, http.StatusCreated), &guest)
+	s.mustDo("DELETE", "/api/members/"+guest.ID, nil, http.StatusOK)
+	s.mustDo("GET", "/api/members/"+guest.ID, nil, http.StatusNotFound)
+}
+
+func TestMemberProfilesMigration(t *testing.T) {
+	newTestServer(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(expensesBucket)).Put([]byte("1"), []byte(`{"id":"1","amount":100,"user":"Mom"}`))
+		tx.Bucket([]byte(incomeBucket)).Put([]byte("2"), []byte(`{"id":"2","amount":100,"user":"Riya"}`))
+		settings := loadSettings(tx)
+		settings.MemberRoles["Riya"] = roleChild
+		data, _ := json.Marshal(settings)
+		tx.Bucket([]byte(settingsBucket)).Put([]byte(householdSettingsKey), data)
+		if _, err := createMemberProfiles(tx); err != nil {
+			return err
+		}
+		members := loadMembers(tx)
+		if len(members) != 2 || members[0].Name != "Mom" || members[1].Role != roleChild {
+			t.Fatalf("members = %+v", members)
+		}
+		var e Expense
+		json.Unmarshal(tx.Bucket([]byte(expensesBucket)).Get([]byte("1")), &e)
+		var i Income
+		json.Unmarshal(tx.Bucket([]byte(incomeBucket)).Get([]byte("2")), &i)
+		if e.MemberID != members[0].ID || i.MemberID != members[1].ID {
+			t.Errorf("linked expense %+v, income %+v", e, i)
+		}
+		// Running again creates nothing
+		if _, err := createMemberProfiles(tx); err != nil {
+			return err
+		}
+		if n := len(loadMembers(tx)); n != 2 {
+			t.Errorf("%d members after a second run", n)
+		}
+
+		// Links to profiles since removed, or to someone else's, are redone
+		tx.Bucket([]byte(expensesBucket)).Put([]byte("3"), []byte(`{"id":"3","amount":100,"user":"Mom","memberId":"gone"}`))
+		tx.Bucket([]byte(incomeBucket)).Put([]byte("4"), []byte(`{"id":"4","amount":100,"user":"Mom","memberId":"`+members[1].ID+`"}`))
+		if n, err := relinkMembers(tx); err != nil || n != 2 {
+			t.Errorf("relinked %d records, err %v", n, err)
+		}
+		json.Unmarshal(tx.Bucket([]byte(expensesBucket)).Get([]byte("3")), &e)
+		json.Unmarshal(tx.Bucket([]byte(incomeBucket)).Get([]byte("4")), &i)
+		if e.MemberID != members[0].ID || i.MemberID != members[0].ID {
+			t.Errorf("relinked expense %+v, income %+v", e, i)
+		}
+		if _, err := linkMember(tx, members[1].ID, "Mom"); err != errUnknownMember {
+			t.Errorf("linking Mom's record to Riya: err = %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthAccountsAndScoping(t *testing.T) {
+	s := newTestServer(t)
+	type session struct {
+		Token string `json:"token"`
+		User  User   `json:"user"`
+	}
+
+	// An expense recorded without a member stays visible to everyone
+	s.mustDo("POST", "/api/expenses", map[string]interface{}{"description": "Legacy", "amount": 10}, http.StatusCreated)
+
+	var asha session
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusCreated), &asha)
+	if asha.Token == "" || asha.User.Role != roleAdult || asha.User.PasswordHash != "" {
+		t.Fatalf("register = %+v", asha)
+	}
+	// Further accounts need a signed-in adult
+	s.mustDo("POST", "/api/auth/register", map[string]string{"username": "ravi", "password": "another-pass"}, http.StatusForbidden)
+	s.token = asha.Token
+	s.mustDo("POST", "/api/auth/register", map[string]string{"username": "ravi", "password": "another-pass", "role": "child"}, http.StatusCreated)
+	s.mustDo("POST", "/api/auth/register", map[string]string{"username": "Ravi", "password": "another-pass"}, http.StatusConflict)
+	s.mustDo("POST", "/api/auth/register", map[string]string{"username": "neha", "password": "short"}, http.StatusBadRequest)
+	var planner session
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "planner", "password": "viewer-pass", "role": "viewer"},
+		http.StatusCreated), &planner)
+	// Viewers look but cannot change anything
+	s.token = planner.Token
+	s.mustDo("GET", "/api/expenses", nil, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", map[string]interface{}{"description": "Fee", "amount": 10}, http.StatusForbidden)
+	s.token = ""
+
+	s.mustDo("POST", "/api/auth/login", map[string]string{"username": "ravi", "password": "wrong-pass"}, http.StatusUnauthorized)
+	var ravi session
+	decode(t, s.mustDo("POST", "/api/auth/login", map[string]string{"username": "ravi", "password": "another-pass"}, http.StatusOK), &ravi)
+
+	// Records are stamped with the token's member, whatever the body says
+	s.token = asha.Token
+	var mine Expense
+	decode(t, s.mustDo("POST", "/api/expenses", map[string]interface{}{"description": "Groceries", "amount": 50, "user": "ravi"}, http.StatusCreated), &mine)
+	if mine.User != "asha" {
+		t.Fatalf("expense user = %q, want asha", mine.User)
+	}
+	s.mustDo("POST", "/api/expenses", map[string]interface{}{"description": "Rent", "amount": 900, "isShared": true}, http.StatusCreated)
+	var budget Budget
+	decode(t, s.mustDo("POST", "/api/budgets", map[string]interface{}{"name": "Food", "limit": 100, "month": "2026-01"}, http.StatusCreated), &budget)
+	s.mustDo("POST", "/api/goals", map[string]interface{}{"name": "Car", "target": 1000}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", map[string]interface{}{"source": "Salary", "amount": 500}, http.StatusCreated)
+
+	s.token = ravi.Token
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 2 {
+		t.Fatalf("ravi sees %d expenses, want the legacy and shared ones: %+v", len(expenses), expenses)
+	}
+	var count map[string]int
+	decode(t, s.mustDo("GET", "/api/expenses/count", nil, http.StatusOK), &count)
+	if count["count"] != 2 {
+		t.Errorf("ravi's expense count = %d, want 2", count["count"])
+	}
+	s.mustDo("GET", "/api/expenses/"+mine.ID, nil, http.StatusNotFound)
+	s.mustDo("PUT", "/api/expenses/"+mine.ID, map[string]interface{}{"description": "Mine now", "amount": 1}, http.StatusNotFound)
+	s.mustDo("DELETE", "/api/expenses/"+mine.ID, nil, http.StatusNotFound)
+	s.mustDo("DELETE", "/api/budgets/"+budget.ID, nil, http.StatusNotFound)
+	for path, want := range map[string]int{"/api/budgets": 0, "/api/goals": 0, "/api/income": 0} {
+		var list []map[string]interface{}
+		decode(t, s.mustDo("GET", path, nil, http.StatusOK), &list)
+		if len(list) != want {
+			t.Errorf("ravi sees %d records at %s, want %d", len(list), path, want)
+		}
+	}
+
+	s.token = asha.Token
+	decode(t, s.mustDo("PUT", "/api/budgets/"+budget.ID, map[string]interface{}{"name": "Food", "limit": 200, "month": "2026-01"}, http.StatusOK), &budget)
+	if budget.Owner != "asha" {
+		t.Errorf("budget owner after edit = %q", budget.Owner)
+	}
+	var goals []Goal
+	decode(t, s.mustDo("GET", "/api/goals", nil, http.StatusOK), &goals)
+	if len(goals) != 1 || goals[0].Owner != "asha" {
+		t.Errorf("asha's goals = %+v", goals)
+	}
+
+	s.token = "not-a-token"
+	s.mustDo("GET", "/api/expenses", nil, http.StatusUnauthorized)
+
+	// With AUTH_REQUIRED only login and registration are open
+	s.token = ""
+	c := *config()
+	c.AuthRequired = true
+	setConfig(&c)
+	s.mustDo("GET", "/api/expenses", nil, http.StatusUnauthorized)
+	s.mustDo("POST", "/api/auth/login", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusOK)
+	s.token = asha.Token
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 3 {
+		t.Errorf("asha sees %d expenses, want 3", len(expenses))
+	}
+}
+
+func TestReportsScopedToCaller(t *testing.T) {
+	s := newTestServer(t)
+	type session struct {
+		Token string `json:"token"`
+	}
+	var asha, ravi session
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusCreated), &asha)
+	s.token = asha.Token
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "ravi", "password": "another-pass"}, http.StatusCreated), &ravi)
+
+	today := time.Now().In(householdLocation()).Format(dateLayout)
+	var private Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 500 * majorUnit, Date: today, Category: "Charity", Reimbursable: true,
+		Donation: &Donation{Organization: "CRY", DeductionPercent: 50}}, http.StatusCreated), &private)
+	s.mustDo("POST", "/api/expenses/"+private.ID+"/comments", ExpenseComment{Content: "Receipt came by mail"}, http.StatusCreated)
+	var claim Claim
+	decode(t, s.mustDo("POST", "/api/claims", Claim{Name: "Trip", ExpenseIDs: []string{private.ID}}, http.StatusCreated), &claim)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 90 * majorUnit, Date: today, PaidBy: "asha",
+		Splits: []ExpenseSplit{{User: "asha", Amount: 45 * majorUnit}, {User: "neha", Amount: 45 * majorUnit}}}, http.StatusCreated)
+	var settled struct {
+		Transfer Transfer `json:"transfer"`
+	}
+	decode(t, s.mustDo("POST", "/api/balances/settle", Transfer{From: "neha", To: "asha", Amount: 10 * majorUnit}, http.StatusCreated), &settled)
+
+	s.token = ravi.Token
+	var stats map[string]interface{}
+	decode(t, s.mustDo("GET", "/api/stats", nil, http.StatusOK), &stats)
+	if stats["transactionCount"] != 1.0 {
+		t.Errorf("ravi's stats count %v expenses, want the shared one", stats["transactionCount"])
+	}
+	var donations DonationReport
+	decode(t, s.mustDo("GET", "/api/donations/report", nil, http.StatusOK), &donations)
+	if len(donations.Organizations) != 0 {
+		t.Errorf("ravi sees donations %+v", donations.Organizations)
+	}
+	s.mustDo("GET", "/api/expenses/"+private.ID+"/comments", nil, http.StatusNotFound)
+	s.mustDo("POST", "/api/expenses/"+private.ID+"/comments", ExpenseComment{Content: "@asha what is this?"}, http.StatusNotFound)
+	var claims []Claim
+	decode(t, s.mustDo("GET", "/api/claims", nil, http.StatusOK), &claims)
+	if len(claims) != 0 {
+		t.Errorf("ravi sees claims %+v", claims)
+	}
+	s.mustDo("POST", "/api/claims/"+claim.ID+"/status", map[string]string{"status": "submitted"}, http.StatusNotFound)
+	s.mustDo("DELETE", "/api/claims/"+claim.ID, nil, http.StatusNotFound)
+	s.mustDo("POST", "/api/claims", Claim{Name: "Mine", ExpenseIDs: []string{private.ID}}, http.StatusBadRequest)
+	for _, path := range []string{"/api/balances", "/api/transfers"} {
+		var list []map[string]interface{}
+		decode(t, s.mustDo("GET", path, nil, http.StatusOK), &list)
+		if len(list) != 0 {
+			t.Errorf("ravi sees %s %+v", path, list)
+		}
+	}
+	s.mustDo("POST", "/api/balances/settle", Transfer{From: "neha", To: "asha"}, http.StatusForbidden)
+	s.mustDo("DELETE", "/api/transfers/"+settled.Transfer.ID, nil, http.StatusNotFound)
+	var forecast Forecast
+	decode(t, s.mustDo("GET", "/api/forecast", nil, http.StatusOK), &forecast)
+	var fund EmergencyFund
+	decode(t, s.mustDo("GET", "/api/emergency-fund", nil, http.StatusOK), &fund)
+	if fund.MonthlyEssential != 0 {
+		t.Errorf("ravi's essential spending = %v", fund.MonthlyEssential)
+	}
+
+	// The owner still sees all of it
+	s.token = asha.Token
+	decode(t, s.mustDo("GET", "/api/donations/report", nil, http.StatusOK), &donations)
+	if len(donations.Organizations) != 1 {
+		t.Errorf("asha's donations = %+v", donations.Organizations)
+	}
+	var comments []ExpenseComment
+	decode(t, s.mustDo("GET", "/api/expenses/"+private.ID+"/comments", nil, http.StatusOK), &comments)
+	if len(comments) != 1 {
+		t.Errorf("asha's comments = %+v", comments)
+	}
+	decode(t, s.mustDo("GET", "/api/claims", nil, http.StatusOK), &claims)
+	if len(claims) != 1 || claims[0].User != "asha" {
+		t.Errorf("asha's claims = %+v", claims)
+	}
+}
+
+func TestTokenOfRemovedAccount(t *testing.T) {
+	s := newTestServer(t)
+	var session struct {
+		Token string `json:"token"`
+	}
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusCreated), &session)
+	s.token = session.Token
+	s.mustDo("GET", "/api/expenses", nil, http.StatusOK)
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(usersBucket)).Delete(userKey("asha"))
+	})
+	s.mustDo("GET", "/api/expenses", nil, http.StatusUnauthorized)
+}
+
+func TestAuthSecretKeptOutOfDatabase(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/auth/register", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusCreated)
+	secret, err := os.ReadFile(authSecretPath())
+	if err != nil || len(secret) != 32 {
+		t.Fatalf("secret file: %d bytes, %v", len(secret), err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(settingsBucket)).ForEach(func(k, v []byte) error {
+			if bytes.Contains(v, secret) {
+				t.Errorf("settings key %s holds the signing key", k)
+			}
+			return nil
+		})
+	})
+
+	// A key generated by an earlier release moves to the file
+	legacy := []byte("legacy-signing-key-from-settings")
+	os.Remove(authSecretPath())
+	authSecretCache.path = ""
+	err = db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(settingsBucket)).Put([]byte(authSecretKey), legacy)
+		_, err := moveAuthSecret(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := authSecret(); !bytes.Equal(got, legacy) {
+		t.Errorf("secret after the move = %q", got)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(settingsBucket)).Get([]byte(authSecretKey)) != nil {
+			t.Error("legacy key left in the settings bucket")
+		}
+		return nil
+	})
+}
+
+func TestExpensePagingAndSorting(t *testing.T) {
+	s := newTestServer(t)
+	for i, e := range []struct {
+		date   string
+		amount float64
+	}{{"2026-01-03", 30}, {"2026-01-01", 50}, {"2026-01-02", 10}, {"2026-01-04", 40}, {"2026-01-05", 20}} {
+		s.mustDo("POST", "/api/expenses", map[string]interface{}{
+			"description": fmt.Sprintf("e%d", i), "amount": e.amount, "date": e.date}, http.StatusCreated)
+	}
+	amounts := func(path string) []float64 {
+		var list []map[string]interface{}
+		decode(t, s.mustDo("GET", path, nil, http.StatusOK), &list)
+		got := []float64{}
+		for _, e := range list {
+			got = append(got, e["amount"].(float64))
+		}
+		return got
+	}
+	for path, want := range map[string][]float64{
+		"/api/expenses":                                       {30, 50, 10, 40, 20},
+		"/api/expenses?sortBy=date":                           {50, 10, 30, 40, 20},
+		"/api/expenses?sortBy=amount&order=desc":              {50, 40, 30, 20, 10},
+		"/api/expenses?order=desc":                            {20, 40, 30, 10, 50},
+		"/api/expenses?sortBy=date&order=desc&limit=2":        {20, 40},
+		"/api/expenses?sortBy=date&order=desc&page=2&limit=2": {30, 10},
+		"/api/expenses?sortBy=date&page=3&limit=2":            {20},
+		"/api/expenses?page=4&limit=2":                        {},
+	} {
+		if got := amounts(path); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s = %v, want %v", path, got, want)
+		}
+	}
+
+	resp, err := http.Get(s.URL + "/api/expenses?page=1&limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Total-Count"); got != "5" {
+		t.Errorf("X-Total-Count = %q, want 5", got)
+	}
+	for _, query := range []string{"page=0", "limit=501", "sortBy=category", "order=up"} {
+		s.mustDo("GET", "/api/expenses?"+query, nil, http.StatusBadRequest)
+	}
+}
+
+func TestExpenseListFilters(t *testing.T) {
+	s := newTestServer(t)
+	for _, e := range []map[string]interface{}{
+		{"description": "Veg", "amount": 10, "date": "2024-01-05", "category": "Groceries", "user": "alice"},
+		{"description": "Milk", "amount": 20, "date": "2024-01-31", "category": "Groceries", "user": "bob"},
+		{"description": "Fuel", "amount": 30, "date": "2024-01-15", "category": "Transport", "user": "alice"},
+		{"description": "Rice", "amount": 40, "date": "2024-02-01", "category": "Groceries", "user": "alice"},
+	} {
+		s.mustDo("POST", "/api/expenses", e, http.StatusCreated)
+	}
+	for query, want := range map[string]string{
+		"from=2024-01-01&to=2024-01-31":                               "Veg Milk Fuel",
+		"category=Groceries":                                          "Veg Milk Rice",
+		"user=alice&category=Groceries":                               "Veg Rice",
+		"from=2024-01-01&to=2024-01-31&category=Groceries&user=alice": "Veg",
+		"from=2024-01-31&sortBy=date":                                 "Milk Rice",
+		"to=2024-01-10":                                               "Veg",
+	} {
+		var list []Expense
+		decode(t, s.mustDo("GET", "/api/expenses?"+query, nil, http.StatusOK), &list)
+		var got []string
+		for _, e := range list {
+			got = append(got, e.Description)
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("?%s = %v, want %s", query, got, want)
+		}
+	}
+	s.mustDo("GET", "/api/expenses?from=yesterday-ish", nil, http.StatusBadRequest)
+}
+
+func TestCSVImportPreviewAndCommit(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 450 * majorUnit, Date: "2026-03-02", Merchant: "Swiggy", Description: "Dinner"}, http.StatusCreated)
+
+	statement := "\ufeffTxn Date,Narration,Withdrawal,Deposit\n" +
+		"02/03/2026,SWIGGY,450.00,\n" +
+		"03/03/2026,Salary ACME,,\"1,20,000.00\"\n" +
+		"04/03/2026,DMart,\"1,234.50\",\n" +
+		"04/03/2026,DMart,\"1,234.50\",\n" +
+		"not a date,Refund,,10\n" +
+		"\n"
+	upload := func(mapping string) (int, CSVImport) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "march.csv")
+		part.Write([]byte(statement))
+		form.WriteField("mapping", mapping)
+		form.Close()
+		resp, err := s.Client().Post(s.URL+"/api/import/csv", form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var imp CSVImport
+		json.NewDecoder(resp.Body).Decode(&imp)
+		return resp.StatusCode, imp
+	}
+	if status, _ := upload(`{"date": "Txn Date", "amount": "Amount"}`); status != http.StatusBadRequest {
+		t.Errorf("missing column: status %d", status)
+	}
+	if status, _ := upload(`{"date": "Txn Date"}`); status != http.StatusBadRequest {
+		t.Errorf("no amount column: status %d", status)
+	}
+	status, imp := upload(`{"date": "txn date", "merchant": "Narration", "debit": "Withdrawal", "credit": "Deposit"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("preview: status %d", status)
+	}
+	if imp.New != 2 || imp.Duplicates != 2 || imp.Invalid != 1 || len(imp.Rows) != 5 {
+		t.Fatalf("preview counts new %d dup %d invalid %d: %+v", imp.New, imp.Duplicates, imp.Invalid, imp.Rows)
+	}
+	if r := imp.Rows[1]; r.Kind != "income" || r.Amount != 120000*majorUnit || r.Date != "2026-03-03" || r.Line != 3 {
+		t.Errorf("salary row = %+v", r)
+	}
+	if r := imp.Rows[3]; r.Status != importDuplicate || r.DuplicateOf != "line 4" {
+		t.Errorf("repeated row = %+v", r)
+	}
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 1 {
+		t.Fatalf("preview recorded expenses: %d", len(expenses))
+	}
+
+	var done CSVImport
+	direct := map[string]bool{"review": false}
+	decode(t, s.mustDo("POST", "/api/import/csv/"+imp.ID+"/commit", direct, http.StatusOK), &done)
+	if done.Status != "committed" || done.Imported != 2 || done.Rows[0].Status != importSkipped || done.Rows[2].RecordID == "" {
+		t.Errorf("commit = %+v", done)
+	}
+	s.mustDo("POST", "/api/import/csv/"+imp.ID+"/commit", direct, http.StatusConflict)
+	decode(t, s.mustDo("GET", "/api/expenses?sortBy=date", nil, http.StatusOK), &expenses)
+	if len(expenses) != 2 || expenses[1].Amount != 1234*majorUnit+500 || expenses[1].Category != "Groceries" {
+		t.Errorf("expenses after import = %+v", expenses)
+	}
+	var incomes []Income
+	decode(t, s.mustDo("GET", "/api/income", nil, http.StatusOK), &incomes)
+	if len(incomes) != 1 || incomes[0].Source != "Salary ACME" {
+		t.Errorf("income after import = %+v", incomes)
+	}
+
+	// Importing the statement again finds everything already there; a
+	// duplicate can still be picked by line
+	_, again := upload(`{"date": "Txn Date", "description": "Narration", "debit": "Withdrawal", "credit": "Deposit"}`)
+	if again.New != 0 || again.Duplicates != 4 {
+		t.Errorf("second preview new %d dup %d", again.New, again.Duplicates)
+	}
+	decode(t, s.mustDo("POST", "/api/import/csv/"+again.ID+"/commit", map[string]interface{}{"lines": []int{5}, "review": false}, http.StatusOK), &done)
+	if done.Imported != 1 || done.Rows[3].Status != importImported {
+		t.Errorf("picked commit = %+v", done.Rows)
+	}
+	s.mustDo("GET", "/api/import/csv/nope", nil, http.StatusNotFound)
+}
+
+func TestExportCSVAndXLSX(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 1250 * majorUnit / 10, Date: "2026-01-10", Description: `Dinner, "Taj"`, Category: "Dining"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 80 * majorUnit, Date: "2026-01-02", Description: "=HYPERLINK(\"x\")", Category: "Misc"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 5 * majorUnit, Date: "2026-02-01", Description: "Tea"}, http.StatusCreated)
+
+	get := func(query string) (*http.Response, []byte) {
+		resp, err := http.Get(s.URL + "/api/export?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	}
+	resp, data := get("type=expenses&from=2026-01-01&to=2026-01-31")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") ||
+		!strings.Contains(resp.Header.Get("Content-Disposition"), `filename=expenses-`) {
+		t.Fatalf("csv export: %d %v", resp.StatusCode, resp.Header)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], `2026-01-02,"'=HYPERLINK(""x"")",Misc,,80.00,INR`) ||
+		!strings.HasPrefix(lines[2], `2026-01-10,"Dinner, ""Taj""",Dining,,125.00,INR`) {
+		t.Errorf("csv export:\n%s", data)
+	}
+
+	resp, data = get("type=expenses&format=xlsx")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("xlsx export: %d %s", resp.StatusCode, data)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sheet []byte
+	for _, f := range zr.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, _ := f.Open()
+			sheet, _ = io.ReadAll(rc)
+			rc.Close()
+		}
+	}
+	for _, want := range []string{`<c r="E2"><v>80.00</v></c>`, `Dinner, &#34;Taj&#34;`, `<row r="4">`} {
+		if !bytes.Contains(sheet, []byte(want)) {
+			t.Errorf("sheet lacks %s:\n%s", want, sheet)
+		}
+	}
+
+	for _, query := range []string{"type=widgets", "type=goals&format=pdf", "type=income&from=soon"} {
+		if resp, _ := get(query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 250 * majorUnit, Date: "2026-02-01", Description: "Uber to airport", Category: "Transport"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 90 * majorUnit, Date: "2026-02-03", Description: "Late dinner", Merchant: "Uber Eats", Notes: "ordered via app"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 40 * majorUnit, Date: "2026-02-04", Description: "Tea", Notes: "uber driver asked"}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Amount: 500 * majorUnit, Date: "2026-02-05", Source: "Uber refund"}, http.StatusCreated)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Electricity", Amount: 1200 * majorUnit, DueDate: "2026-02-10", Category: "Utilities"}, http.StatusCreated)
+
+	find := func(query string) []SearchResult {
+		var results []SearchResult
+		decode(t, s.mustDo("GET", "/api/search?"+query, nil, http.StatusOK), &results)
+		return results
+	}
+	results := find("q=uber")
+	if len(results) != 4 {
+		t.Fatalf("q=uber: %+v", results)
+	}
+	if results[0].Type != "income" || results[len(results)-1].Title != "Tea" || results[len(results)-1].Matched[0] != "notes" {
+		t.Errorf("q=uber ranking: %+v", results)
+	}
+	if got := find("q=uber+air"); len(got) != 1 || got[0].Title != "Uber to airport" {
+		t.Errorf("q=uber air: %+v", got)
+	}
+	if got := find("q=UTIL"); len(got) != 1 || got[0].Type != "bill" {
+		t.Errorf("q=UTIL: %+v", got)
+	}
+	if got := find("q=uber&type=expense&limit=1"); len(got) != 1 || got[0].Type != "expense" {
+		t.Errorf("typed search: %+v", got)
+	}
+
+	// Writes show up in the next search
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 10 * majorUnit, Description: "Samosa"}, http.StatusCreated)
+	if got := find("q=samosa"); len(got) != 1 {
+		t.Errorf("new expense not found: %+v", got)
+	}
+	s.mustDo("GET", "/api/search?q=+!", nil, http.StatusBadRequest)
+	s.mustDo("GET", "/api/search?q=uber&type=goal", nil, http.StatusBadRequest)
+}
+
+func TestAccountsAndBalances(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/accounts", Account{Name: "HDFC", Type: "current"}, http.StatusBadRequest)
+	var bank, card Account
+	decode(t, s.mustDo("POST", "/api/accounts", Account{Name: "HDFC Savings", Type: "savings", OpeningBalance: 10000 * majorUnit}, http.StatusCreated), &bank)
+	decode(t, s.mustDo("POST", "/api/accounts", Account{Name: "Amex", Type: "credit-card"}, http.StatusCreated), &card)
+
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Date: "2026-01-05", AccountID: "missing"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/income", Income{Amount: 100 * majorUnit, Date: "2026-01-05", AccountID: "missing"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/income", Income{Amount: 50000 * majorUnit, Date: "2026-01-01", Source: "Salary", AccountID: bank.ID}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 15000 * majorUnit, Date: "2026-01-03", Description: "Rent", AccountID: bank.ID}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 2000 * majorUnit, Date: "2026-01-20", Description: "Fuel", AccountID: bank.ID}, http.StatusCreated)
+	var dinner Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 1500 * majorUnit, Date: "2026-01-04", Description: "Dinner", AccountID: card.ID}, http.StatusCreated), &dinner)
+
+	var balance AccountBalance
+	decode(t, s.mustDo("GET", "/api/accounts/"+bank.ID+"/balance", nil, http.StatusOK), &balance)
+	if balance.Balance != 43000*majorUnit || balance.Income != 50000*majorUnit || balance.Expenses != 17000*majorUnit || balance.Transactions != 3 {
+		t.Errorf("bank balance = %+v", balance)
+	}
+	decode(t, s.mustDo("GET", "/api/accounts/"+bank.ID+"/balance?asOf=2026-01-10", nil, http.StatusOK), &balance)
+	if balance.Balance != 45000*majorUnit || balance.AsOf != "2026-01-10" {
+		t.Errorf("bank balance on the 10th = %+v", balance)
+	}
+	var accounts []Account
+	decode(t, s.mustDo("GET", "/api/accounts", nil, http.StatusOK), &accounts)
+	if len(accounts) != 2 || accounts[0].Name != "Amex" || accounts[0].Balance == nil || *accounts[0].Balance != -1500*majorUnit {
+		t.Errorf("accounts = %+v", accounts)
+	}
+
+	s.mustDo("PUT", "/api/accounts/"+card.ID, Account{Name: "Amex", Type: "credit-card", Archived: true}, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/accounts", nil, http.StatusOK), &accounts)
+	if len(accounts) != 1 {
+		t.Errorf("archived account listed: %+v", accounts)
+	}
+	s.mustDo("DELETE", "/api/accounts/"+card.ID, nil, http.StatusOK)
+	var unlinked Expense
+	decode(t, s.mustDo("GET", "/api/expenses/"+dinner.ID, nil, http.StatusOK), &unlinked)
+	if unlinked.AccountID != "" {
+		t.Errorf("expense still linked to deleted account: %q", unlinked.AccountID)
+	}
+	s.mustDo("GET", "/api/accounts/"+card.ID+"/balance", nil, http.StatusNotFound)
+	s.mustDo("PUT", "/api/accounts/"+card.ID, Account{Name: "Amex", Type: "credit-card"}, http.StatusNotFound)
+}
+
+func TestBudgetSpentByPeriod(t *testing.T) {
+	s := newTestServer(t)
+	day := func(offset int) string { return time.Now().AddDate(0, 0, offset).Format(dateLayout) }
+	s.mustDo("POST", "/api/budgets", Budget{Name: "Food", Limit: 100 * majorUnit, Period: "daily"}, http.StatusBadRequest)
+	var food, fuel, books Budget
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Food", Category: "Groceries", Limit: 8000 * majorUnit}, http.StatusCreated), &food)
+	if food.Period != "monthly" {
+		t.Errorf("default period = %q, want monthly", food.Period)
+	}
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Fuel", Category: "Transport", Limit: 1000 * majorUnit, Period: "weekly"}, http.StatusCreated), &fuel)
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Books", Limit: 5000 * majorUnit, Period: "yearly"}, http.StatusCreated), &books)
+
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 900 * majorUnit, Category: "groceries", Date: day(0)}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 700 * majorUnit, Category: "Groceries", Date: day(-40)}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 400 * majorUnit, Category: "Transport", Date: day(0), BudgetIds: []string{books.ID}}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 300 * majorUnit, Category: "Transport", Date: day(-8)}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 250 * majorUnit, Category: "Books", Date: day(-400), BudgetIds: []string{books.ID}}, http.StatusCreated)
+
+	want := map[string]Money{food.ID: 900 * majorUnit, fuel.ID: 400 * majorUnit, books.ID: 400 * majorUnit}
+	var budgets []Budget
+	decode(t, s.mustDo("GET", "/api/budgets", nil, http.StatusOK), &budgets)
+	for _, b := range budgets {
+		if b.Spent != want[b.ID] {
+			t.Errorf("%s spent = %v, want %v", b.Name, b.Spent, want[b.ID])
+		}
+	}
+	var dashboard struct{ Budgets []Budget }
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &dashboard)
+	for _, b := range dashboard.Budgets {
+		if b.Spent != want[b.ID] {
+			t.Errorf("dashboard %s spent = %v, want %v", b.Name, b.Spent, want[b.ID])
+		}
+	}
+	if len(budgets) != 3 || len(dashboard.Budgets) != 3 {
+		t.Errorf("budgets = %d, dashboard budgets = %d, want 3", len(budgets), len(dashboard.Budgets))
+	}
+}
+
+func TestBudgetRolloverHistory(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/budgets", Budget{Name: "Fuel", Limit: 100 * majorUnit, Period: "weekly", Rollover: true}, http.StatusBadRequest)
+	var food Budget
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Food", Category: "Groceries", Month: "2026-01", Limit: 1000 * majorUnit, IsRecurring: true, Rollover: true}, http.StatusCreated), &food)
+	for date, amount := range map[string]Money{"2026-01-10": 600, "2026-02-03": 1000, "2026-02-20": 500, "2026-03-15": 200} {
+		s.mustDo("POST", "/api/expenses", Expense{Amount: amount * majorUnit, Category: "Groceries", Date: date}, http.StatusCreated)
+	}
+
+	var history []BudgetMonth
+	decode(t, s.mustDo("GET", "/api/budgets/"+food.ID+"/history", nil, http.StatusOK), &history)
+	want := []BudgetMonth{
+		{Month: "2026-01", Period: Period{"2026-01-01", "2026-02-01"}, Limit: 1000 * majorUnit, Spent: 600 * majorUnit, Remaining: 400 * majorUnit},
+		{Month: "2026-02", Period: Period{"2026-02-01", "2026-03-01"}, Limit: 1000 * majorUnit, CarriedOver: 400 * majorUnit, Spent: 1500 * majorUnit, Remaining: -100 * majorUnit},
+		{Month: "2026-03", Period: Period{"2026-03-01", "2026-04-01"}, Limit: 1000 * majorUnit, Spent: 200 * majorUnit, Remaining: 800 * majorUnit},
+	}
+	if len(history) < len(want) {
+		t.Fatalf("history = %+v", history)
+	}
+	for i, m := range want {
+		if history[i] != m {
+			t.Errorf("history[%d] = %+v, want %+v", i, history[i], m)
+		}
+	}
+	if len(history) > 3 && history[3].CarriedOver != 800*majorUnit {
+		t.Errorf("carried into April = %v, want 800", history[3].CarriedOver)
+	}
+
+	// A budget for the running cycle shows what it brought forward
+	var books Budget
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Books", Category: "Books", Limit: 500 * majorUnit, Rollover: true}, http.StatusCreated), &books)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, Category: "Books", Date: time.Now().AddDate(0, 0, -40).Format(dateLayout)}, http.StatusCreated)
+	decode(t, s.mustDo("GET", "/api/budgets/"+books.ID+"/history", nil, http.StatusOK), &history)
+	var budgets []Budget
+	decode(t, s.mustDo("GET", "/api/budgets", nil, http.StatusOK), &budgets)
+	for _, b := range budgets {
+		if b.ID == books.ID && (b.CarriedOver < 400*majorUnit || b.CarriedOver != history[len(history)-1].CarriedOver) {
+			t.Errorf("books carried over %v, history %+v", b.CarriedOver, history)
+		}
+	}
+
+	var fuel Budget
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Fuel", Limit: 100 * majorUnit, Period: "weekly"}, http.StatusCreated), &fuel)
+	s.mustDo("GET", "/api/budgets/"+fuel.ID+"/history", nil, http.StatusBadRequest)
+	s.mustDo("GET", "/api/budgets/missing/history", nil, http.StatusNotFound)
+}
+
+func TestRecurringBills(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Gas", Amount: 900 * majorUnit, Recurrence: "monthly"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Gas", Amount: 900 * majorUnit, DueDate: "2026-01-10", Recurrence: "custom"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Gas", Amount: 900 * majorUnit, DueDate: "2026-01-10", Recurrence: "weekly"}, http.StatusBadRequest)
+
+	var rent BillReminder
+	decode(t, s.mustDo("POST", "/api/bills", BillReminder{Name: "Rent", Amount: 25000 * majorUnit, DueDate: "2026-01-31", Category: "Housing", Recurrence: "monthly"}, http.StatusCreated), &rent)
+	var paid BillReminder
+	decode(t, s.mustDo("POST", "/api/bills/"+rent.ID+"/pay", map[string]interface{}{"date": "2026-01-30", "createExpense": true, "user": "alice"}, http.StatusOK), &paid)
+	if !paid.IsPaid || paid.NextBillID == "" || len(paid.Payments) != 1 || paid.Payments[0].Amount != 25000*majorUnit || paid.Payments[0].ExpenseID == "" {
+		t.Fatalf("paid bill = %+v", paid)
+	}
+	var expense Expense
+	decode(t, s.mustDo("GET", "/api/expenses/"+paid.Payments[0].ExpenseID, nil, http.StatusOK), &expense)
+	if expense.Amount != 25000*majorUnit || expense.Category != "Housing" || expense.Date != "2026-01-30" {
+		t.Errorf("expense for payment = %+v", expense)
+	}
+	var next BillReminder
+	decode(t, s.mustDo("GET", "/api/bills/"+paid.NextBillID, nil, http.StatusOK), &next)
+	if next.DueDate != "2026-02-28" || next.IsPaid || next.Recurrence != "monthly" || next.Amount != 25000*majorUnit {
+		t.Errorf("next bill = %+v", next)
+	}
+	s.mustDo("POST", "/api/bills/"+rent.ID+"/pay", nil, http.StatusConflict)
+	s.mustDo("POST", "/api/bills/missing/pay", nil, http.StatusNotFound)
+
+	// Paying a custom bill off in parts raises the next one when it is covered
+	var water BillReminder
+	decode(t, s.mustDo("POST", "/api/bills", BillReminder{Name: "Water", Amount: 600 * majorUnit, DueDate: "2026-01-10", Recurrence: "custom", IntervalDays: 45}, http.StatusCreated), &water)
+	var part BillReminder
+	decode(t, s.mustDo("POST", "/api/bills/"+water.ID+"/payments", paymentRequest{Amount: 200 * majorUnit, Date: "2026-01-05"}, http.StatusCreated), &part)
+	if part.NextBillID != "" {
+		t.Errorf("part-paid bill raised its next occurrence")
+	}
+	decode(t, s.mustDo("POST", "/api/bills/"+water.ID+"/payments", paymentRequest{Amount: 400 * majorUnit, Date: "2026-01-08"}, http.StatusCreated), &part)
+	decode(t, s.mustDo("GET", "/api/bills/"+part.NextBillID, nil, http.StatusOK), &next)
+	if next.DueDate != "2026-02-24" || next.IntervalDays != 45 {
+		t.Errorf("next water bill = %+v", next)
+	}
+}
+
+func TestNotificationPrefsAreMembersOwn(t *testing.T) {
+	s := newTestServer(t)
+	mom := s.register("mom", roleAdult)
+	s.token = mom
+	riya := s.register("riya", roleChild)
+	s.mustDo("PUT", "/api/notifications/preferences/mom", NotificationPrefs{Email: "mom@example.com"}, http.StatusOK)
+
+	// A child can't read, redirect or drop another member's alerts
+	s.token = riya
+	s.mustDo("GET", "/api/notifications/preferences/mom", nil, http.StatusForbidden)
+	s.mustDo("PUT", "/api/notifications/preferences/mom", NotificationPrefs{Email: "riya@example.com"}, http.StatusForbidden)
+	s.mustDo("DELETE", "/api/notifications/preferences/mom", nil, http.StatusForbidden)
+	s.mustDo("PUT", "/api/notifications/preferences/riya", NotificationPrefs{Email: "riya@example.com"}, http.StatusOK)
+	var prefs []NotificationPrefs
+	decode(t, s.mustDo("GET", "/api/notifications/preferences", nil, http.StatusOK), &prefs)
+	if len(prefs) != 1 || prefs[0].User != "riya" {
+		t.Errorf("child sees preferences %+v", prefs)
+	}
+
+	// Adults manage everyone's
+	s.token = mom
+	decode(t, s.mustDo("GET", "/api/notifications/preferences", nil, http.StatusOK), &prefs)
+	if len(prefs) != 2 {
+		t.Errorf("adult sees preferences %+v", prefs)
+	}
+	var mine NotificationPrefs
+	decode(t, s.mustDo("GET", "/api/notifications/preferences/mom", nil, http.StatusOK), &mine)
+	if mine.Email != "mom@example.com" {
+		t.Errorf("prefs after the child's attempt = %+v", mine)
+	}
+	s.mustDo("DELETE", "/api/notifications/preferences/riya", nil, http.StatusOK)
+}
+
+func TestBillEmailReminders(t *testing.T) {
+	s := newTestServer(t)
+	c := *config()
+	c.SMTPHost, c.SMTPFrom = "smtp.example.com", "Family Finance <finance@example.com>"
+	setConfig(&c)
+	type email struct {
+		addr string
+		to   []string
+		msg  string
+	}
+	var sent []email
+	old := sendMail
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, email{addr, to, string(msg)})
+		return nil
+	}
+	defer func() { sendMail = old }()
+
+	s.mustDo("PUT", "/api/notifications/preferences/alice", map[string]interface{}{"channels": map[string][]string{"*": {"email"}}}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/notifications/preferences/alice", map[string]interface{}{"email": "not an address"}, http.StatusBadRequest)
+	prefs := map[string]interface{}{"email": "Alice <alice@example.com>", "channels": map[string][]string{"*": {"email"}}}
+	s.mustDo("PUT", "/api/notifications/preferences/alice", prefs, http.StatusOK)
+
+	day := func(offset int) string {
+		return time.Now().In(householdLocation()).AddDate(0, 0, offset).Format(dateLayout)
+	}
+	for _, b := range []BillReminder{
+		{ID: "soon", Name: "Phone", Amount: 499 * majorUnit, DueDate: day(2)},
+		{ID: "later", Name: "Insurance", Amount: 9000 * majorUnit, DueDate: day(10)},
+		{ID: "late", Name: "Water", Amount: 300 * majorUnit, DueDate: day(-1)},
+		{ID: "done", Name: "Rent", Amount: 25000 * majorUnit, DueDate: day(1), IsPaid: true},
+	} {
+		s.mustDo("POST", "/api/bills", b, http.StatusCreated)
+	}
+	for i := 0; i < 2; i++ {
+		if err := checkDueBills(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var alerts []Alert
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(alertsBucket)).ForEach(func(k, v []byte) error {
+			var a Alert
+			json.Unmarshal(v, &a)
+			alerts = append(alerts, a)
+			return nil
+		})
+	})
+	if len(alerts) != 1 || alerts[0].ID != "bill.due:soon:"+day(2) {
+		t.Fatalf("alerts = %+v", alerts)
+	}
+	if err := routeAlert(alerts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent = %+v", sent)
+	}
+	want := "Phone (499.00 INR) is due on " + day(2)
+	if e := sent[0]; e.addr != "smtp.example.com:587" || fmt.Sprint(e.to) != "[alice@example.com]" ||
+		!strings.Contains(e.msg, "To: alice@example.com\r\n") || !strings.Contains(e.msg, want) {
+		t.Errorf("email = %+v", e)
+	}
+}
+
+func TestExchangeRateProvider(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/exchange-rates/refresh", nil, http.StatusBadRequest)
+
+	var asked []string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.Path)
+		fmt.Fprint(w, `{"result": "success", "rates": {"INR": 1, "USD": 0.0125, "EUR": 0.01, "XYZ": 3}}`)
+	}))
+	defer provider.Close()
+	c := *config()
+	c.ExchangeRatesProvider, c.ExchangeRatesURL = "http", provider.URL+"/latest/{base}"
+	setConfig(&c)
+
+	s.mustDo("PUT", "/api/settings", Settings{ExchangeRates: map[string]float64{"EUR": 90}}, http.StatusOK)
+	var rates struct {
+		Base     string
+		Provider string
+		Rates    []ExchangeRate
+	}
+	decode(t, s.mustDo("POST", "/api/exchange-rates/refresh", nil, http.StatusOK), &rates)
+	if fmt.Sprint(asked) != "[/latest/INR]" {
+		t.Errorf("provider asked for %v", asked)
+	}
+	if rates.Base != "INR" || rates.Provider != "http" || len(rates.Rates) != 2 {
+		t.Fatalf("rates = %+v", rates)
+	}
+	if r := rates.Rates[0]; r.Currency != "EUR" || r.Rate != 90 || r.Source != "manual" {
+		t.Errorf("EUR rate = %+v, want the manual 90", r)
+	}
+	if r := rates.Rates[1]; r.Currency != "USD" || r.Rate != 80 || r.Source != "http" || r.FetchedAt == "" {
+		t.Errorf("USD rate = %+v, want 80 from the provider", r)
+	}
+
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 1000 * majorUnit, Date: "2026-01-05"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 10 * majorUnit, Currency: "USD", Date: "2026-01-06"}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 5 * majorUnit, Currency: "GBP", Date: "2026-01-07"}, http.StatusCreated)
+	var stats struct {
+		TotalSpent            Money
+		UnconvertedCurrencies []string
+		ByCurrency            []CurrencyTotal
+	}
+	decode(t, s.mustDo("GET", "/api/stats", nil, http.StatusOK), &stats)
+	if stats.TotalSpent != 1800*majorUnit || fmt.Sprint(stats.UnconvertedCurrencies) != "[GBP]" || len(stats.ByCurrency) != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if usd := stats.ByCurrency[2]; usd.Currency != "USD" || usd.Spent != 10*majorUnit || usd.SpentInBase == nil || *usd.SpentInBase != 800*majorUnit {
+		t.Errorf("USD breakdown = %+v", usd)
+	}
+	if gbp := stats.ByCurrency[0]; gbp.Currency != "GBP" || gbp.SpentInBase != nil {
+		t.Errorf("GBP breakdown = %+v", gbp)
+	}
+
+	var dashboard struct {
+		Stats struct{ ByCurrency []CurrencyTotal }
+	}
+	decode(t, s.mustDo("GET", "/api/dashboard", nil, http.StatusOK), &dashboard)
+	if len(dashboard.Stats.ByCurrency) != 3 {
+		t.Errorf("dashboard breakdown = %+v", dashboard.Stats.ByCurrency)
+	}
+}
+
+func TestInvestmentPriceRefresh(t *testing.T) {
+	s := newTestServer(t)
+	market := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v8/finance/chart/INFY.NS":
+			fmt.Fprint(w, `{"chart": {"result": [{"meta": {"currency": "INR", "regularMarketPrice": 1650.5}}]}}`)
+		case "/v8/finance/chart/VOO":
+			fmt.Fprint(w, `{"chart": {"result": [{"meta": {"currency": "USD", "regularMarketPrice": 500}}]}}`)
+		case "/mf/120503/latest":
+			fmt.Fprint(w, `{"data": [{"date": "14-10-2026", "nav": "85.1234"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer market.Close()
+	oldYahoo, oldAMFI := yahooURL, amfiURL
+	yahooURL, amfiURL = market.URL, market.URL
+	defer func() { yahooURL, amfiURL = oldYahoo, oldAMFI }()
+
+	s.mustDo("POST", "/api/investments", Investment{Name: "Bad", Symbol: "X", PriceProvider: "bloomberg"}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/settings", Settings{ExchangeRates: map[string]float64{"USD": 80}}, http.StatusOK)
+	for _, inv := range []Investment{
+		{ID: "infy", Name: "Infosys", Type: "stock", Symbol: "INFY.NS", Units: 10, InvestedValue: 15000 * majorUnit},
+		{ID: "voo", Name: "Vanguard S&P 500", Type: "etf", Symbol: "VOO", Units: 2, InvestedValue: 70000 * majorUnit},
+		{ID: "fund", Name: "Index fund", Type: "mutual-fund", Symbol: "120503", Units: 100, PriceProvider: "amfi", InvestedValue: 9000 * majorUnit},
+		{ID: "gone", Name: "Delisted", Type: "stock", Symbol: "GONE", Units: 5},
+		{ID: "fd", Name: "Fixed deposit", Type: "fd", Value: 50000 * majorUnit, InvestedValue: 50000 * majorUnit},
+	} {
+		s.mustDo("POST", "/api/investments", inv, http.StatusCreated)
+	}
+
+	var report PriceRefresh
+	decode(t, s.mustDo("POST", "/api/investments/refresh", nil, http.StatusOK), &report)
+	if len(report.Updated) != 3 || len(report.Failed) != 1 || report.Failed["gone"] == "" {
+		t.Fatalf("report = %+v", report)
+	}
+	want := map[string][2]Money{
+		"fund": {8512*majorUnit + 340, -487*majorUnit - 660},
+		"infy": {16505 * majorUnit, 1505 * majorUnit},
+		"voo":  {80000 * majorUnit, 10000 * majorUnit},
+	}
+	var investments []Investment
+	decode(t, s.mustDo("GET", "/api/investments", nil, http.StatusOK), &investments)
+	for _, inv := range investments {
+		if w, ok := want[inv.ID]; ok && (inv.Value != w[0] || inv.Returns != w[1] || inv.PricedAt == "") {
+			t.Errorf("%s = %+v, want value %v returns %v", inv.ID, inv, w[0], w[1])
+		}
+		if inv.ID == "voo" && inv.ReturnsPercent != 14.29 {
+			t.Errorf("voo returns = %v%%, want 14.29%%", inv.ReturnsPercent)
+		}
+		if inv.ID == "fd" && inv.Value != 50000*majorUnit {
+			t.Errorf("unpriced investment changed: %+v", inv)
+		}
+	}
+}
+
+func TestInvestmentTransactions(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/investments", Investment{ID: "mf", Name: "Index fund", Type: "mutual-fund", Price: 60}, http.StatusCreated)
+	s.mustDo("POST", "/api/investments/none/transactions", InvestmentTransaction{Type: "buy", Amount: majorUnit}, http.StatusNotFound)
+	s.mustDo("POST", "/api/investments/mf/transactions", InvestmentTransaction{Type: "swap", Amount: majorUnit}, http.StatusBadRequest)
+
+	var inv Investment
+	for _, tx := range []InvestmentTransaction{
+		{Type: "buy", Date: "2025-01-10", Units: 100, Amount: 5000 * majorUnit},
+		{Type: "sip", Date: "2025-02-10", Units: 100, Amount: 6000 * majorUnit},
+		{Type: "dividend", Date: "2025-07-01", Amount: 300 * majorUnit},
+		{Type: "sell", Date: "2025-06-10", Units: 50, Amount: 4000 * majorUnit},
+	} {
+		decode(t, s.mustDo("POST", "/api/investments/mf/transactions", tx, http.StatusCreated), &inv)
+	}
+	// The sale takes a quarter of the 11000 cost: 1250 realized
+	if inv.Units != 150 || inv.InvestedValue != 8250*majorUnit || inv.Realized != 1250*majorUnit ||
+		inv.Dividends != 300*majorUnit || inv.Value != 9000*majorUnit {
+		t.Fatalf("position = %+v", inv)
+	}
+	if inv.Returns != 2300*majorUnit || inv.ReturnsPercent != 20.91 || inv.XIRR == nil || *inv.XIRR <= 0 {
+		t.Errorf("returns = %v (%v%%), xirr %v", inv.Returns, inv.ReturnsPercent, inv.XIRR)
+	}
+	s.mustDo("POST", "/api/investments/mf/transactions", InvestmentTransaction{Type: "sell", Units: 500, Amount: majorUnit}, http.StatusBadRequest)
+
+	// Editing the investment keeps its transactions and derived position
+	inv.Name, inv.Units, inv.InvestedValue = "Nifty index fund", 1, 1
+	var edited Investment
+	decode(t, s.mustDo("PUT", "/api/investments/mf", inv, http.StatusOK), &edited)
+	if edited.Name != "Nifty index fund" || len(edited.Transactions) != 4 || edited.Units != 150 || edited.InvestedValue != 8250*majorUnit {
+		t.Errorf("edited = %+v", edited)
+	}
+
+	var sell string
+	for _, tx := range edited.Transactions {
+		if tx.Type == "sell" {
+			sell = tx.ID
+		}
+	}
+	var after Investment
+	decode(t, s.mustDo("DELETE", "/api/investments/mf/transactions/"+sell, nil, http.StatusOK), &after)
+	if after.Units != 200 || after.InvestedValue != 11000*majorUnit || after.Realized != 0 || after.Value != 12000*majorUnit {
+		t.Errorf("after deleting the sale = %+v", after)
+	}
+	s.mustDo("DELETE", "/api/investments/mf/transactions/"+sell, nil, http.StatusNotFound)
+}
+
+func TestNetWorth(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("PUT", "/api/settings", Settings{ExchangeRates: map[string]float64{"USD": 80}}, http.StatusOK)
+	s.mustDo("POST", "/api/accounts", Account{ID: "sb", Name: "Savings", Type: "savings", OpeningBalance: 10000 * majorUnit}, http.StatusCreated)
+	s.mustDo("POST", "/api/accounts", Account{ID: "cc", Name: "Card", Type: "credit-card", OpeningBalance: -2000 * majorUnit}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Description: "Rent", Category: "Housing", Amount: 4000 * majorUnit, AccountID: "sb"}, http.StatusCreated)
+	s.mustDo("POST", "/api/investments", Investment{Name: "VOO", Value: 100 * majorUnit, Currency: "USD"}, http.StatusCreated)
+	s.mustDo("POST", "/api/goals", Goal{Name: "Holiday", Target: 5000 * majorUnit, Current: 3000 * majorUnit}, http.StatusCreated)
+	s.mustDo("POST", "/api/debts", Debt{Direction: "lent", Counterparty: "Ravi", Amount: 1000 * majorUnit, User: "Dad"}, http.StatusCreated)
+	s.mustDo("POST", "/api/debts", Debt{Direction: "borrowed", Counterparty: "Meera", Amount: 500 * majorUnit, User: "Mom"}, http.StatusCreated)
+
+	var n NetWorth
+	decode(t, s.mustDo("GET", "/api/networth", nil, http.StatusOK), &n)
+	want := NetWorth{Date: n.Date, Currency: "INR", Accounts: 6000 * majorUnit, Investments: 8000 * majorUnit,
+		Goals: 3000 * majorUnit, Lent: 1000 * majorUnit, AccountsOwed: 2000 * majorUnit, Borrowed: 500 * majorUnit,
+		Assets: 18000 * majorUnit, Liabilities: 2500 * majorUnit, NetWorth: 15500 * majorUnit, UnconvertedCurrencies: []string{}}
+	if fmt.Sprintf("%+v", n) != fmt.Sprintf("%+v", want) {
+		t.Fatalf("net worth = %+v\nwant %+v", n, want)
+	}
+
+	if err := snapshotNetWorth(); err != nil {
+		t.Fatal(err)
+	}
+	var history []NetWorth
+	decode(t, s.mustDo("GET", "/api/networth/history", nil, http.StatusOK), &history)
+	if len(history) != 1 || history[0].NetWorth != 15500*majorUnit || history[0].Date != billToday() {
+		t.Errorf("history = %+v", history)
+	}
+	decode(t, s.mustDo("GET", "/api/networth/history?to=2000-01-01", nil, http.StatusOK), &history)
+	if len(history) != 0 {
+		t.Errorf("history before 2000 = %+v", history)
+	}
+	s.mustDo("GET", "/api/networth/history?from=someday", nil, http.StatusBadRequest)
+}
+
+func TestMonthlyReport(t *testing.T) {
+	s := newTestServer(t)
+	for _, e := range []Expense{
+		{Description: "Groceries", Category: "Food", Merchant: "BigBasket", Amount: 3000 * majorUnit, Date: "2024-06-03"},
+		{Description: "More groceries", Category: "Food", Merchant: "Big Basket", Amount: 1000 * majorUnit, Date: "2024-06-20"},
+		{Description: "Fuel", Category: "Transport", Merchant: "HP", Amount: 2000 * majorUnit, Date: "2024-06-10"},
+		{Description: "Groceries", Category: "Food", Merchant: "BigBasket", Amount: 2000 * majorUnit, Date: "2024-05-12"},
+		{Description: "Movie", Category: "Fun", Amount: 1000 * majorUnit, Date: "2024-05-18"},
+	} {
+		s.mustDo("POST", "/api/expenses", e, http.StatusCreated)
+	}
+	s.mustDo("POST", "/api/income", Income{Source: "Salary", Amount: 50000 * majorUnit, Date: "2024-06-01"}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Source: "Salary", Amount: 40000 * majorUnit, Date: "2024-05-01"}, http.StatusCreated)
+	s.mustDo("POST", "/api/budgets", Budget{ID: "food", Name: "Food", Category: "Food", Limit: 3500 * majorUnit, Month: "2024-06"}, http.StatusCreated)
+	s.mustDo("POST", "/api/budgets", Budget{ID: "fuel", Name: "Fuel", Category: "Transport", Limit: 2500 * majorUnit, Month: "2024-04", IsRecurring: true}, http.StatusCreated)
+	s.mustDo("POST", "/api/budgets", Budget{ID: "old", Name: "Old", Category: "Food", Limit: majorUnit, Month: "2024-05"}, http.StatusCreated)
+
+	s.mustDo("GET", "/api/reports/monthly?month=June", nil, http.StatusBadRequest)
+	var report MonthlyReport
+	decode(t, s.mustDo("GET", "/api/reports/monthly?month=2024-06", nil, http.StatusOK), &report)
+	if report.Month != "2024-06" || report.Income != 50000*majorUnit || report.Expenses != 6000*majorUnit ||
+		report.Net != 44000*majorUnit || report.SavingsRate != 88 {
+		t.Errorf("totals = %+v", report.ReportTotals)
+	}
+	if report.Previous.Expenses != 3000*majorUnit || report.Change.Expenses != 3000*majorUnit ||
+		report.Change.ExpensesPercent == nil || *report.Change.ExpensesPercent != 100 || *report.Change.IncomePercent != 25 {
+		t.Errorf("previous = %+v, change = %+v", report.Previous, report.Change)
+	}
+	got := fmt.Sprintf("%+v", report.Categories)
+	want := fmt.Sprintf("%+v", []ReportCategory{
+		{Category: "Food", Amount: 4000 * majorUnit, Share: 66.67, Previous: 2000 * majorUnit, Change: 2000 * majorUnit},
+		{Category: "Transport", Amount: 2000 * majorUnit, Share: 33.33, Change: 2000 * majorUnit},
+		{Category: "Fun", Previous: 1000 * majorUnit, Change: -1000 * majorUnit},
+	})
+	if got != want {
+		t.Errorf("categories = %s\nwant %s", got, want)
+	}
+	if len(report.TopMerchants) != 2 || report.TopMerchants[0].Amount != 4000*majorUnit || report.TopMerchants[0].Transactions != 2 {
+		t.Errorf("top merchants = %+v", report.TopMerchants)
+	}
+	if len(report.Budgets) != 2 {
+		t.Fatalf("budgets = %+v", report.Budgets)
+	}
+	food, fuel := report.Budgets[0], report.Budgets[1]
+	if food.ID != "food" || food.Spent != 4000*majorUnit || !food.Over || food.Used != 114.29 {
+		t.Errorf("food budget = %+v", food)
+	}
+	if fuel.ID != "fuel" || fuel.Spent != 2000*majorUnit || fuel.Over || fuel.Remaining != 500*majorUnit {
+		t.Errorf("fuel budget = %+v", fuel)
+	}
+}
+
+func TestMonthlyReportPDF(t *testing.T) {
+	s := newTestServer(t)
+	// Enough categories to run over several pages
+	for i := 0; i < 40; i++ {
+		s.mustDo("POST", "/api/expenses", Expense{Description: "Item", Category: fmt.Sprintf("Things (%d)", i),
+			Merchant: "Corner shop", Amount: Money(i+1) * majorUnit, Date: "2024-06-05"}, http.StatusCreated)
+	}
+	s.mustDo("POST", "/api/income", Income{Source: "Salary", Amount: 50000 * majorUnit, Date: "2024-06-01"}, http.StatusCreated)
+
+	resp, err := http.Get(s.URL + "/api/reports/monthly.pdf?month=2024-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/pdf" ||
+		!strings.Contains(resp.Header.Get("Content-Disposition"), "statement-2024-06.pdf") {
+		t.Fatalf("pdf: %d %v", resp.StatusCode, resp.Header)
+	}
+	pdf := string(data)
+	if !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatalf("not a PDF:\n%.200s", pdf)
+	}
+	for _, want := range []string{"(Monthly statement: June 2024)", "(Things \\(39\\))", "(50,000)", "/Count 3"} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("PDF lacks %s", want)
+		}
+	}
+	// Every object sits where the cross-reference table says
+	var xref int
+	fmt.Sscanf(pdf[strings.LastIndex(pdf, "startxref\n")+len("startxref\n"):], "%d", &xref)
+	if !strings.HasPrefix(pdf[xref:], "xref\n") {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	entries := strings.Split(pdf[xref:strings.Index(pdf, "trailer")], "\n")[3:]
+	for i, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		var offset int
+		fmt.Sscanf(entry, "%d", &offset)
+		if !strings.HasPrefix(pdf[offset:], fmt.Sprintf("%d 0 obj", i+1)) {
+			t.Errorf("object %d is not at offset %d", i+1, offset)
+		}
+	}
+	s.mustDo("GET", "/api/reports/monthly.pdf?month=2024-13", nil, http.StatusBadRequest)
+}
+
+func TestChangeEventsSocket(t *testing.T) {
+	s := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/api/ws"
+	ws, err := websocket.Dial(wsURL, "", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	next := func() ChangeEvent {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var e ChangeEvent
+		if err := websocket.JSON.Receive(ws, &e); err != nil {
+			t.Fatalf("receiving event: %v", err)
+		}
+		return e
+	}
+	// The hub learns of the client once the handshake is through
+	for deadline := time.Now().Add(5 * time.Second); !events.listening() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Tea", Amount: 5 * majorUnit}, http.StatusCreated), &expense)
+	if e := next(); e.Entity != "expenses" || e.Action != "created" || e.ID != expense.ID || e.Path != "/api/expenses" {
+		t.Errorf("create event = %+v", e)
+	}
+	s.mustDo("POST", "/api/expenses/nope/comments", map[string]string{"content": "hot"}, http.StatusNotFound)
+	s.mustDo("PUT", "/api/expenses/"+expense.ID, Expense{Description: "Coffee", Amount: 6 * majorUnit}, http.StatusOK)
+	if e := next(); e.Action != "updated" || e.ID != expense.ID {
+		t.Errorf("update event = %+v", e)
+	}
+	s.mustDo("POST", "/api/expenses/"+expense.ID+"/comments", map[string]string{"content": "hot"}, http.StatusCreated)
+	if e := next(); e.Entity != "expenses" || e.Action != "updated" || e.ID != expense.ID {
+		t.Errorf("comment event = %+v", e)
+	}
+	s.mustDo("DELETE", "/api/expenses/"+expense.ID, nil, http.StatusOK)
+	if e := next(); e.Action != "deleted" || e.ID != expense.ID {
+		t.Errorf("delete event = %+v", e)
+	}
+
+	// With AUTH_REQUIRED the token comes in the query string
+	c := *config()
+	c.AuthRequired = true
+	setConfig(&c)
+	if _, err := websocket.Dial(wsURL, "", s.URL); err == nil {
+		t.Error("socket opened without a token")
+	}
+	c.AuthRequired = false
+	setConfig(&c)
+	var session struct {
+		Token string `json:"token"`
+	}
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusCreated), &session)
+	c.AuthRequired = true
+	setConfig(&c)
+	signedIn, err := websocket.Dial(wsURL+"?token="+session.Token, "", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedIn.Close()
+}
+
+func TestExpenseAttachments(t *testing.T) {
+	s := newTestServer(t)
+	attach := func(expenseID, name string, wantStatus int) Attachment {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", name)
+		part.Write([]byte("receipt for " + expenseID))
+		form.Close()
+		resp, err := s.Client().Post(s.URL+"/api/expenses/"+expenseID+"/attachments", form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var a Attachment
+		json.NewDecoder(resp.Body).Decode(&a)
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("attaching to %s: status %d, want %d", expenseID, resp.StatusCode, wantStatus)
+		}
+		if a.File != "" {
+			t.Cleanup(func() { os.Remove(filepath.Join(uploadsDir, a.File)) })
+		}
+		return a
+	}
+	age := func(file string) {
+		old := time.Now().Add(-2 * uploadGrace)
+		os.Chtimes(filepath.Join(uploadsDir, file), old, old)
+	}
+	exists := func(file string) bool {
+		_, err := os.Stat(filepath.Join(uploadsDir, file))
+		return err == nil
+	}
+
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Laptop", Amount: 900 * majorUnit}, http.StatusCreated), &e)
+	attach("nope", "bill.pdf", http.StatusNotFound)
+	receipt := attach(e.ID, "receipt.pdf", http.StatusCreated)
+	warranty := attach(e.ID, "warranty.pdf", http.StatusCreated)
+	if receipt.ExpenseID != e.ID || receipt.FileName != "receipt.pdf" || receipt.Size == 0 ||
+		!strings.HasSuffix(receipt.URL, "/uploads/"+receipt.File) {
+		t.Errorf("attachment = %+v", receipt)
+	}
+	var attachments []Attachment
+	decode(t, s.mustDo("GET", "/api/expenses/"+e.ID+"/attachments", nil, http.StatusOK), &attachments)
+	decode(t, s.mustDo("GET", "/api/expenses/"+e.ID, nil, http.StatusOK), &e)
+	if len(attachments) != 2 || attachments[0].ID != receipt.ID || !e.HasAttachments {
+		t.Fatalf("attachments = %+v, hasAttachments %v", attachments, e.HasAttachments)
+	}
+
+	// A member's avatar, uploaded on its own, is in use too
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "avatar.png")
+	part.Write([]byte("png"))
+	form.Close()
+	resp, err := s.Client().Post(s.URL+"/api/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var avatar map[string]string
+	json.NewDecoder(resp.Body).Decode(&avatar)
+	resp.Body.Close()
+	t.Cleanup(func() { os.Remove(filepath.Join(uploadsDir, avatar["filename"])) })
+	s.token = s.register("mom", roleAdult)
+	s.mustDo("POST", "/api/members", Member{Name: "riya", Avatar: avatar["url"]}, http.StatusCreated)
+	s.token = ""
+
+	// Files nothing links to are swept once past the grace period
+	orphan := "orphan-upload.txt"
+	os.WriteFile(filepath.Join(uploadsDir, orphan), []byte("stray"), 0644)
+	t.Cleanup(func() { os.Remove(filepath.Join(uploadsDir, orphan)) })
+	age(orphan)
+	age(warranty.File)
+	age(avatar["filename"])
+	if n, err := collectAttachmentFiles(uploadsDir, time.Now()); err != nil || n != 1 || exists(orphan) || !exists(warranty.File) {
+		t.Fatalf("sweep removed %d (%v); orphan left %v, attachment kept %v", n, err, exists(orphan), exists(warranty.File))
+	}
+	if !exists(avatar["filename"]) {
+		t.Error("member avatar swept")
+	}
+
+	s.mustDo("DELETE", "/api/attachments/"+warranty.ID, nil, http.StatusOK)
+	s.mustDo("DELETE", "/api/attachments/"+warranty.ID, nil, http.StatusNotFound)
+	decode(t, s.mustDo("GET", "/api/expenses/"+e.ID+"/attachments", nil, http.StatusOK), &attachments)
+	if len(attachments) != 1 {
+		t.Errorf("after delete: %+v", attachments)
+	}
+
+	// Deleting the expense takes its attachments; their files go once the
+	// deletion can no longer be undone
+	s.mustDo("DELETE", "/api/expenses/"+e.ID, nil, http.StatusOK)
+	s.mustDo("GET", "/api/expenses/"+e.ID+"/attachments", nil, http.StatusNotFound)
+	age(receipt.File)
+	collectAttachmentFiles(uploadsDir, time.Now())
+	if !exists(receipt.File) || !exists(warranty.File) {
+		t.Fatal("files removed while the deletions could still be undone")
+	}
+	collectAttachmentFiles(uploadsDir, time.Now().Add(undoWindow+time.Minute))
+	if exists(receipt.File) || exists(warranty.File) {
+		t.Error("files of deleted attachments kept")
+	}
+
+	var other Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Phone", Amount: 500 * majorUnit}, http.StatusCreated), &other)
+	a := attach(other.ID, "phone.pdf", http.StatusCreated)
+	s.mustDo("DELETE", "/api/attachments/"+a.ID, nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/expenses/"+other.ID, nil, http.StatusOK), &other)
+	if other.HasAttachments {
+		t.Error("hasAttachments still set with no attachments")
+	}
+}
+
+func TestScanReceipt(t *testing.T) {
+	s := newTestServer(t)
+	receipt := "TAX INVOICE\nStarbucks\nMG Road, Bengaluru\nDate: 14/03/2026 18:42\n" +
+		"Caffe Latte 2 x 250.00 500.00\nBlueberry Muffin 180.00\nSub Total 680.00\nCGST 2.5% 17.00\nSGST 2.5% 17.00\n" +
+		"Grand Total 714.00\nCard 714.00\n"
+	vision := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "vision-key" {
+			http.Error(w, "bad key", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"responses":[{"fullTextAnnotation":{"text":%q}}]}`, receipt)
+	}))
+	defer vision.Close()
+	defer func(url string) { visionURL = url }(visionURL)
+	visionURL = vision.URL
+
+	scan := func(wantStatus int) ReceiptScan {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "receipt.jpg")
+		part.Write([]byte("jpeg bytes"))
+		form.Close()
+		resp, err := s.Client().Post(s.URL+"/api/receipts/scan", form.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("scan status %d, want %d", resp.StatusCode, wantStatus)
+		}
+		var got ReceiptScan
+		json.NewDecoder(resp.Body).Decode(&got)
+		return got
+	}
+
+	// Scanning needs the ocr feature
+	scan(http.StatusNotFound)
+	c := *config()
+	c.Features = map[string]bool{"ocr": true}
+	c.OCRProvider, c.VisionAPIKey = "vision", "vision-key"
+	setConfig(&c)
+
+	got := scan(http.StatusOK)
+	if got.Merchant != "Starbucks" || got.Category != "Dining" || got.Date != "2026-03-14" ||
+		got.Total != 714*majorUnit || got.Engine != "vision" || got.Text != receipt {
+		t.Errorf("scan = %+v", got)
+	}
+	items := fmt.Sprintf("%+v", got.Items)
+	if want := fmt.Sprintf("%+v", []LineItem{
+		{Name: "Caffe Latte", Quantity: 2, Price: 250 * majorUnit, Amount: 500 * majorUnit},
+		{Name: "Blueberry Muffin", Quantity: 1, Price: 180 * majorUnit, Amount: 180 * majorUnit},
+	}); items != want {
+		t.Errorf("items = %s, want %s", items, want)
+	}
+
+	// A failing engine is reported as a bad gateway
+	c.VisionAPIKey = "revoked"
+	setConfig(&c)
+	scan(http.StatusBadGateway)
+}
+
+func TestSettlements(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 100 * majorUnit, User: "Mom",
+		Splits: []ExpenseSplit{{User: "Mom", Percent: 50}, {User: "Dad", Percent: 60}}}, http.StatusBadRequest)
+
+	// Dad records dinner Mom paid for, split by percentage; rounding goes to
+	// the last share
+	var dinner Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 100*majorUnit + 10, User: "Dad", PaidBy: "Mom",
+		Splits: []ExpenseSplit{{User: "Mom", Percent: 33.33}, {User: "Dad", Percent: 33.33}, {User: "Kid", Percent: 33.34}}}, http.StatusCreated), &dinner)
+	if got := fmt.Sprintf("%v", dinner.Splits); got != "[{Mom 33.33 33.33} {Dad 33.33 33.33} {Kid 33.35 33.34}]" || !dinner.IsShared {
+		t.Errorf("percentage splits = %s", got)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 60 * majorUnit, User: "Kid",
+		Splits: []ExpenseSplit{{User: "Dad", Amount: 60 * majorUnit}}}, http.StatusCreated)
+
+	// Pair by pair it takes three payments; simplified, two
+	var balances []Balance
+	decode(t, s.mustDo("GET", "/api/balances", nil, http.StatusOK), &balances)
+	if len(balances) != 3 {
+		t.Errorf("balances = %+v", balances)
+	}
+	var settlements Settlements
+	decode(t, s.mustDo("GET", "/api/settlements", nil, http.StatusOK), &settlements)
+	if got := fmt.Sprintf("%v", settlements.Members); got != "[{Mom INR 66.68} {Kid INR 26.65} {Dad INR -93.33}]" {
+		t.Errorf("members = %s", got)
+	}
+	if p := settlements.Payments; len(p) != 2 || p[0].Message != "Dad owes Mom ₹66.68" || p[1].Message != "Dad owes Kid ₹26.65" {
+		t.Fatalf("payments = %+v", p)
+	}
+
+	s.mustDo("POST", "/api/settlements/settle", Transfer{From: "Kid", To: "Mom"}, http.StatusConflict)
+	var settled struct {
+		Transfer    Transfer    `json:"transfer"`
+		Settlements Settlements `json:"settlements"`
+	}
+	decode(t, s.mustDo("POST", "/api/settlements/settle", Transfer{From: "Dad", To: "Mom"}, http.StatusCreated), &settled)
+	if p := settled.Settlements.Payments; settled.Transfer.Amount != 66*majorUnit+680 || len(p) != 1 || p[0].From != "Dad" || p[0].To != "Kid" {
+		t.Errorf("settle = %+v", settled)
+	}
+	decode(t, s.mustDo("POST", "/api/settlements/settle", Transfer{From: "Dad", To: "Kid"}, http.StatusCreated), &settled)
+	if len(settled.Settlements.Payments) != 0 || len(settled.Settlements.Members) != 0 {
+		t.Errorf("after settling up = %+v", settled.Settlements)
+	}
+}
+
+func TestTags(t *testing.T) {
+	s := newTestServer(t)
+	var e Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 4000 * majorUnit, Description: "Hotel", Category: "Travel",
+		Tags: []string{" Vacation2024 ", "goa", "vacation2024", ""}}, http.StatusCreated), &e)
+	if fmt.Sprint(e.Tags) != "[vacation2024 goa]" {
+		t.Errorf("tags = %q", e.Tags)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 300 * majorUnit, Description: "Groceries", Category: "Groceries"}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Amount: 1500 * majorUnit, Source: "Refund", Tags: []string{"VACATION2024"}}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Amount: 90000 * majorUnit, Source: "Salary"}, http.StatusCreated)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Flight EMI", Amount: 2500 * majorUnit, Tags: []string{"vacation2024"}}, http.StatusCreated)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Rent", Amount: 25000 * majorUnit}, http.StatusCreated)
+
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses?tag=Vacation2024", nil, http.StatusOK), &expenses)
+	if len(expenses) != 1 || expenses[0].ID != e.ID {
+		t.Errorf("tagged expenses = %+v", expenses)
+	}
+	var incomes []Income
+	decode(t, s.mustDo("GET", "/api/income?tag=vacation2024", nil, http.StatusOK), &incomes)
+	if len(incomes) != 1 || incomes[0].Source != "Refund" {
+		t.Errorf("tagged income = %+v", incomes)
+	}
+	var bills []BillReminder
+	decode(t, s.mustDo("GET", "/api/bills?tag=vacation2024", nil, http.StatusOK), &bills)
+	if len(bills) != 1 || bills[0].Name != "Flight EMI" {
+		t.Errorf("tagged bills = %+v", bills)
+	}
+
+	var tags []TagUsage
+	decode(t, s.mustDo("GET", "/api/tags", nil, http.StatusOK), &tags)
+	if got := fmt.Sprintf("%+v", tags); got != "[{Tag:vacation2024 Count:3 Expenses:1 Income:1 Bills:1} {Tag:goa Count:1 Expenses:1 Income:0 Bills:0}]" {
+		t.Errorf("tags = %s", got)
+	}
+}
+
+func TestCategoryRules(t *testing.T) {
+	s := newTestServer(t)
+	var chai Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 40 * majorUnit, Merchant: "Raju Tea Stall", Description: "Morning chai"}, http.StatusCreated), &chai)
+	s.mustDo("POST", "/api/expenses", Expense{Amount: 90 * majorUnit, Merchant: "Raju Tea Stall", Description: "Chai and samosa", Category: "Dining"}, http.StatusCreated)
+
+	s.mustDo("POST", "/api/rules", CategoryRule{Field: "amount", Pattern: "x", Category: "Food"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/rules", CategoryRule{Pattern: "swiggy"}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/rules", CategoryRule{Operator: "regex", Pattern: "(", Category: "Food"}, http.StatusBadRequest)
+	var swiggy, tea CategoryRule
+	decode(t, s.mustDo("POST", "/api/rules", CategoryRule{Pattern: "Swiggy", Category: "Food", Tags: []string{"Takeout"}}, http.StatusCreated), &swiggy)
+	decode(t, s.mustDo("POST", "/api/rules", CategoryRule{Field: "description", Operator: "regex", Pattern: `\bchai\b`, Category: "Snacks", Priority: 1}, http.StatusCreated), &tea)
+	if swiggy.Field != "merchant" || swiggy.Operator != "contains" || fmt.Sprint(swiggy.Tags) != "[takeout]" {
+		t.Errorf("rule defaults = %+v", swiggy)
+	}
+
+	// Rules beat the merchant's default category
+	var order Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Amount: 350 * majorUnit, Merchant: "Swiggy", Description: "Dinner"}, http.StatusCreated), &order)
+	if order.Category != "Food" || fmt.Sprint(order.Tags) != "[takeout]" {
+		t.Errorf("categorized expense = %+v", order)
+	}
+
+	// Only uncategorized expenses are changed retroactively
+	var applied struct {
+		Updated    int      `json:"updated"`
+		ExpenseIDs []string `json:"expenseIds"`
+		ActionID   string   `json:"actionId"`
+	}
+	decode(t, s.mustDo("POST", "/api/rules/apply", nil, http.StatusOK), &applied)
+	if applied.Updated != 1 || applied.ExpenseIDs[0] != chai.ID || applied.ActionID == "" {
+		t.Fatalf("apply = %+v", applied)
+	}
+	decode(t, s.mustDo("GET", "/api/expenses/"+chai.ID, nil, http.StatusOK), &chai)
+	if chai.Category != "Snacks" {
+		t.Errorf("chai category = %q", chai.Category)
+	}
+	var rules []CategoryRule
+	decode(t, s.mustDo("GET", "/api/rules", nil, http.StatusOK), &rules)
+	if len(rules) != 2 || rules[0].ID != swiggy.ID || rules[0].Matched != 1 || rules[1].Matched != 1 {
+		t.Errorf("rules = %+v", rules)
+	}
+	s.mustDo("POST", "/api/undo/"+applied.ActionID, nil, http.StatusOK)
+	decode(t, s.mustDo("GET", "/api/expenses/"+chai.ID, nil, http.StatusOK), &chai)
+	if chai.Category != "" {
+		t.Errorf("chai category after undo = %q", chai.Category)
+	}
+
+	// Imported statements are categorized too
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "april.csv")
+	part.Write([]byte("Date,Narration,Amount\n02/04/2026,SWIGGY BANGALORE,-220.00\n"))
+	form.WriteField("mapping", `{"date": "Date", "merchant": "Narration", "amount": "Amount"}`)
+	form.Close()
+	resp, err := s.Client().Post(s.URL+"/api/import/csv", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imp CSVImport
+	json.NewDecoder(resp.Body).Decode(&imp)
+	resp.Body.Close()
+	var done CSVImport
+	decode(t, s.mustDo("POST", "/api/import/csv/"+imp.ID+"/commit", map[string]bool{"review": false}, http.StatusOK), &done)
+	var imported Expense
+	decode(t, s.mustDo("GET", "/api/expenses/"+done.Rows[0].RecordID, nil, http.StatusOK), &imported)
+	if imported.Category != "Food" || fmt.Sprint(imported.Tags) != "[takeout]" {
+		t.Errorf("imported expense = %+v", imported)
+	}
+}
+
+func TestTaskQueue(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	c := *config()
+	c.QueueMaxAttempts = 2
+	setConfig(&c)
+	calls := 0
+	registerTaskHandler("test.flaky", func(payload json.RawMessage) error {
+		calls++
+		if string(payload) != `{"n":1}` {
+			t.Errorf("payload = %s", payload)
+		}
+		return errors.New("not yet")
+	})
+	registerTaskHandler("test.panics", func(json.RawMessage) error { panic("boom") })
+
+	task, err := enqueueTask("test.flaky", map[string]int{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A claimed task is not handed out again while it runs
+	due := dueTasks()
+	if len(due) != 1 || due[0].ID != task.ID {
+		t.Fatalf("due tasks = %+v", due)
+	}
+	if again := dueTasks(); len(again) != 0 {
+		t.Errorf("claimed task handed out again: %+v", again)
+	}
+	processTask(due[0])
+
+	// A failure is retried after a backoff
+	var queued []Task
+	decode(t, s.mustDo("GET", "/api/admin/queue", nil, http.StatusOK), &queued)
+	if len(queued) != 1 || queued[0].Attempts != 1 || queued[0].LastError != "not yet" {
+		t.Fatalf("queue after a failure = %+v", queued)
+	}
+	if runAt, _ := time.Parse(time.RFC3339Nano, queued[0].RunAt); !runAt.After(time.Now()) {
+		t.Errorf("retry runs at %s, want a backoff", queued[0].RunAt)
+	}
+	if due := dueTasks(); len(due) != 0 {
+		t.Errorf("retry due before its backoff: %+v", due)
+	}
+
+	// The last attempt sends it to the dead letters, from where it can be
+	// retried afresh
+	processTask(queued[0])
+	decode(t, s.mustDo("GET", "/api/admin/queue", nil, http.StatusOK), &queued)
+	var dead []Task
+	decode(t, s.mustDo("GET", "/api/admin/queue/dead", nil, http.StatusOK), &dead)
+	if len(queued) != 0 || len(dead) != 1 || dead[0].Attempts != 2 || calls != 2 {
+		t.Fatalf("after the last attempt: queue %+v, dead letters %+v, %d calls", queued, dead, calls)
+	}
+	var retried Task
+	decode(t, s.mustDo("POST", "/api/admin/queue/dead/"+task.ID+"/retry", nil, http.StatusOK), &retried)
+	if retried.Attempts != 0 {
+		t.Errorf("retried task = %+v", retried)
+	}
+	s.mustDo("POST", "/api/admin/queue/dead/"+task.ID+"/retry", nil, http.StatusNotFound)
+
+	// Panics and tasks nobody handles fail like errors
+	panicking, _ := enqueueTask("test.panics", nil)
+	orphan, _ := enqueueTask("test.unhandled", nil)
+	for _, task := range dueTasks() {
+		processTask(task)
+	}
+	decode(t, s.mustDo("GET", "/api/admin/queue", nil, http.StatusOK), &queued)
+	errs := map[string]string{}
+	for _, task := range queued {
+		errs[task.ID] = task.LastError
+	}
+	if len(queued) != 3 || calls != 3 || errs[task.ID] != "not yet" || errs[panicking.ID] != "panic: boom" ||
+		!strings.Contains(errs[orphan.ID], "no handler registered") {
+		t.Errorf("queue = %+v after %d calls", queued, calls)
+	}
+	s.mustDo("DELETE", "/api/admin/queue/dead/"+task.ID, nil, http.StatusOK)
+}
+
+func TestRetention(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	for _, rule := range []RetentionRule{
+		{Target: "budgets", Action: "delete", MaxAgeDays: 30},
+		{Target: "expenses", Action: "shred", MaxAgeDays: 30},
+		{Target: "expenses", Action: "delete"},
+	} {
+		s.mustDo("POST", "/api/admin/retention/rules", rule, http.StatusBadRequest)
+	}
+	var archive RetentionRule
+	decode(t, s.mustDo("POST", "/api/admin/retention/rules", RetentionRule{Target: "expenses", Action: "archive", MaxAgeDays: 365, Enabled: true},
+		http.StatusCreated), &archive)
+	s.mustDo("POST", "/api/admin/retention/rules", RetentionRule{Target: "deadLetters", Action: "delete", MaxAgeDays: 30, Enabled: true},
+		http.StatusCreated)
+	// Disabled rules are kept but not applied
+	s.mustDo("POST", "/api/admin/retention/rules", RetentionRule{Target: "income", Action: "delete", MaxAgeDays: 1}, http.StatusCreated)
+
+	old := time.Now().AddDate(-2, 0, 0)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "old", Amount: majorUnit, Date: old.Format(dateLayout)}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "recent", Amount: majorUnit}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Amount: majorUnit, Source: "Salary", Date: old.Format(dateLayout)}, http.StatusCreated)
+	db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket([]byte(deadLettersBucket))
+		dead.Put([]byte("d-old"), []byte(`{"id":"d-old","updatedAt":"`+old.Format(time.RFC3339)+`"}`))
+		return dead.Put([]byte("d-new"), []byte(`{"id":"d-new","updatedAt":"`+time.Now().Format(time.RFC3339)+`"}`))
+	})
+	if err := runRetention(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mustDo("GET", "/api/expenses/old", nil, http.StatusNotFound)
+	s.mustDo("GET", "/api/expenses/recent", nil, http.StatusOK)
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(archiveBucket)).Get([]byte("expenses/old")) == nil {
+			t.Error("expired expense was not archived")
+		}
+		return nil
+	})
+	var incomes []Income
+	decode(t, s.mustDo("GET", "/api/income", nil, http.StatusOK), &incomes)
+	var dead []Task
+	decode(t, s.mustDo("GET", "/api/admin/queue/dead", nil, http.StatusOK), &dead)
+	if len(incomes) != 1 || len(dead) != 1 || dead[0].ID != "d-new" {
+		t.Errorf("after retention: income %+v, dead letters %+v", incomes, dead)
+	}
+	var runs []RetentionRun
+	decode(t, s.mustDo("GET", "/api/admin/retention/runs", nil, http.StatusOK), &runs)
+	if len(runs) != 1 || len(runs[0].Results) != 2 {
+		t.Fatalf("runs = %+v", runs)
+	}
+	for _, result := range runs[0].Results {
+		if result.RuleID == archive.ID && (result.Count != 1 || fmt.Sprint(result.IDs) != "[old]") {
+			t.Errorf("archive result = %+v", result)
+		}
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	c := *config()
+	c.BackupDir, c.BackupKeep = t.TempDir(), 2
+	setConfig(&c)
+
+	s.mustDo("POST", "/api/expenses", Expense{ID: "kept", Amount: 500 * majorUnit, Description: "Before backup"}, http.StatusCreated)
+	var backup BackupInfo
+	decode(t, s.mustDo("POST", "/api/admin/backup", nil, http.StatusCreated), &backup)
+	if backup.Store != "dir" || backup.Size == 0 || !strings.HasPrefix(backup.Name, "family-finance-") {
+		t.Fatalf("backup = %+v", backup)
+	}
+	s.mustDo("DELETE", "/api/expenses/kept", nil, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "later", Amount: 90 * majorUnit, Description: "After backup"}, http.StatusCreated)
+
+	// Safety checks
+	s.mustDo("POST", "/api/admin/restore", restoreRequest{Name: backup.Name}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/admin/restore", restoreRequest{Name: "../family_finance.db", Confirm: "../family_finance.db"}, http.StatusBadRequest)
+	missing := "family-finance-20200101T000000.000000Z.db"
+	s.mustDo("POST", "/api/admin/restore", restoreRequest{Name: missing, Confirm: missing}, http.StatusNotFound)
+	junk := "family-finance-20200102T000000.000000Z.db"
+	os.WriteFile(filepath.Join(c.BackupDir, junk), []byte("not a database"), 0600)
+	s.mustDo("POST", "/api/admin/restore", restoreRequest{Name: junk, Confirm: junk}, http.StatusUnprocessableEntity)
+	os.Remove(filepath.Join(c.BackupDir, junk))
+
+	var restored struct {
+		Restored     string     `json:"restored"`
+		SafetyBackup BackupInfo `json:"safetyBackup"`
+	}
+	decode(t, s.mustDo("POST", "/api/admin/restore", restoreRequest{Name: backup.Name, Confirm: backup.Name}, http.StatusOK), &restored)
+	if restored.Restored != backup.Name || !strings.HasSuffix(restored.SafetyBackup.Name, "-pre-restore.db") {
+		t.Errorf("restore = %+v", restored)
+	}
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 1 || expenses[0].ID != "kept" {
+		t.Errorf("expenses after restore = %+v", expenses)
+	}
+
+	// Only the newest backups are kept
+	s.mustDo("POST", "/api/admin/backup", nil, http.StatusCreated)
+	var backups []BackupInfo
+	decode(t, s.mustDo("GET", "/api/admin/backups", nil, http.StatusOK), &backups)
+	if len(backups) != 2 || backups[1].Name != restored.SafetyBackup.Name {
+		t.Errorf("backups = %+v", backups)
+	}
+}
+
+func TestS3Backups(t *testing.T) {
+	s := newTestServer(t)
+	s.enableAdmin()
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/ap-south-1/s3/aws4_request") {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/finance/")
+		switch {
+		case r.Method == "PUT":
+			body, _ := io.ReadAll(r.Body)
+			if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+				http.Error(w, "bad hash", http.StatusBadRequest)
+				return
+			}
+			objects[key] = body
+		case r.Method == "GET" && r.URL.Path == "/finance":
+			fmt.Fprint(w, `<ListBucketResult>`)
+			for k, v := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>2026-10-15T04:00:00.000Z</LastModified></Contents>`, k, len(v))
+				}
+			}
+			fmt.Fprint(w, `<IsTruncated>false</IsTruncated></ListBucketResult>`)
+		case r.Method == "GET":
+			body, ok := objects[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(body)
+		case r.Method == "DELETE":
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer bucket.Close()
+	c := *config()
+	c.BackupS3Endpoint, c.BackupS3Region, c.BackupS3Bucket, c.BackupS3Prefix = bucket.URL, "ap-south-1", "finance", "nightly/"
+	c.BackupS3AccessKey, c.BackupS3SecretKey, c.BackupKeep = "AKID", "secret", 1
+	setConfig(&c)
+
+	var first, second BackupInfo
+	decode(t, s.mustDo("POST", "/api/admin/backup", nil, http.StatusCreated), &first)
+	decode(t, s.mustDo("POST", "/api/admin/backup", nil, http.StatusCreated), &second)
+	var backups []BackupInfo
+	decode(t, s.mustDo("GET", "/api/admin/backups", nil, http.StatusOK), &backups)
+	if len(backups) != 1 || backups[0].Name != second.Name || backups[0].Store != "s3" || len(objects) != 1 {
+		t.Fatalf("backups = %+v, objects %d", backups, len(objects))
+	}
+	if _, ok := objects["nightly/"+second.Name]; !ok {
+		t.Errorf("object keys = %v", objects)
+	}
+	s.mustDo("POST", "/api/admin/restore", restoreRequest{Name: second.Name, Confirm: second.Name}, http.StatusOK)
+}
+
+func TestFullExportImport(t *testing.T) {
+	s := newTestServer(t)
+	c := *config()
+	c.BackupDir = t.TempDir()
+	setConfig(&c)
+	// As on startup, so the store carries its schema version
+	if err := runStartupMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e1", Amount: 1234 * majorUnit, Description: "Laptop", Category: "Shopping"}, http.StatusCreated)
+	s.mustDo("POST", "/api/goals", Goal{ID: "g1", Name: "Car", Target: 500000 * majorUnit}, http.StatusCreated)
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(settingsBucket)).Put([]byte("binary"), []byte{0xff, 0x00, 0x01})
+	})
+
+	// The admin token goes to the admin API, not through sign-in
+	var session struct {
+		Token string `json:"token"`
+	}
+	decode(t, s.mustDo("POST", "/api/auth/register", map[string]string{"username": "asha", "password": "s3cret-pass"}, http.StatusCreated), &session)
+	s.enableAdmin()
+	s.admin = session.Token
+	s.mustDo("GET", "/api/admin/export/full", nil, http.StatusUnauthorized)
+	s.admin = config().AdminToken
+
+	dump := s.mustDo("GET", "/api/admin/export/full", nil, http.StatusOK)
+	var doc FullExport
+	decode(t, dump, &doc)
+	if doc.Format != "family-finance-export" || doc.Version != 1 || len(doc.Buckets[expensesBucket]) != 1 || len(doc.Buckets) != len(storeBuckets) {
+		t.Fatalf("export = %s", dump)
+	}
+
+	// The import replaces everything, so it must be confirmed
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e2", Amount: 50 * majorUnit, Description: "After export"}, http.StatusCreated)
+	s.mustDo("POST", "/api/admin/import/full", doc, http.StatusBadRequest)
+	s.mustDo("POST", "/api/admin/import/full?confirm=replace", FullExport{Format: "family-finance-export", Version: 2}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/admin/import/full?confirm=replace", FullExport{Format: "family-finance-export", Version: 1,
+		Buckets: map[string][]FullExportEntry{expensesBucket: {}, "mystery": {}}}, http.StatusBadRequest)
+
+	var result struct {
+		Records      map[string]int `json:"records"`
+		SafetyBackup BackupInfo     `json:"safetyBackup"`
+	}
+	decode(t, s.mustDo("POST", "/api/admin/import/full?confirm=replace", doc, http.StatusOK), &result)
+	if result.Records[expensesBucket] != 1 || !strings.HasSuffix(result.SafetyBackup.Name, "-pre-import.db") {
+		t.Errorf("import = %+v", result)
+	}
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 1 || expenses[0].ID != "e1" || expenses[0].Amount != 1234*majorUnit {
+		t.Errorf("expenses after import = %+v", expenses)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(settingsBucket)).Get([]byte("binary")); !bytes.Equal(v, []byte{0xff, 0x00, 0x01}) {
+			t.Errorf("binary record after import = %v", v)
+		}
+		return nil
+	})
+	if again := s.mustDo("GET", "/api/admin/export/full", nil, http.StatusOK); !bytes.Equal(again[bytes.Index(again, []byte(`"buckets"`)):], dump[bytes.Index(dump, []byte(`"buckets"`)):]) {
+		t.Errorf("export after a round trip differs")
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := newTestServer(t)
+	c := *config()
+	c.AuthRequired = true
+	setConfig(&c)
+
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	decode(t, s.mustDo("GET", "/api/openapi.json", nil, http.StatusOK), &spec)
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("openapi = %q", spec.OpenAPI)
+	}
+	for key := range apiOperations {
+		method, path, _ := strings.Cut(key, " ")
+		if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("documented operation %s is not a route", key)
+		}
+	}
+	if _, ok := spec.Paths["/settlements/settle"]["post"]; !ok {
+		t.Error("undocumented route left out of the spec")
+	}
+	create := spec.Paths["/expenses"]["post"]
+	if _, ok := create["requestBody"]; !ok {
+		t.Errorf("POST /expenses = %v", create)
+	}
+	if _, ok := create["responses"].(map[string]interface{})["201"]; !ok {
+		t.Errorf("POST /expenses responses = %v", create["responses"])
+	}
+	params, _ := spec.Paths["/expenses/{id}/comments/{commentId}"]["delete"]["parameters"].([]interface{})
+	if len(params) != 2 {
+		t.Errorf("path parameters = %v", params)
+	}
+	expense := spec.Components.Schemas["Expense"].Properties
+	if expense["amount"]["type"] != "number" || expense["tags"]["type"] != "array" {
+		t.Errorf("Expense schema = %v", expense)
+	}
+
+	status, body := s.do("GET", "/api/docs", nil)
+	if status != http.StatusOK || !strings.Contains(string(body), "openapi.json") {
+		t.Errorf("docs = %d %s", status, body)
+	}
+	s.mustDo("GET", "/api/expenses", nil, http.StatusUnauthorized)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	newTestServer(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := newServer(config(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		respondJSON(w, http.StatusOK, map[string]string{"status": "done"})
+	}))
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- serve(srv, ln, 5*time.Second) }()
+
+	responded := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			responded <- 0
+			return
+		}
+		resp.Body.Close()
+		responded <- resp.StatusCode
+	}()
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-stopped:
+		t.Fatalf("server stopped with a request in flight: %v", err)
+	default:
+	}
+	close(release)
+	if status := <-responded; status != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want 200", status)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("serve = %v", err)
+	}
+
+	// A request outlasting the grace period is cut off, and serve still
+	// returns for the cleanup to run
+	started, release = make(chan struct{}), make(chan struct{})
+	defer close(release)
+	srv = newServer(config(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	if ln, err = listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go func() { stopped <- serve(srv, ln, 50*time.Millisecond) }()
+	go http.Get("http://" + ln.Addr().String() + "/")
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-stopped:
+		if err != errDrainTimeout {
+			t.Errorf("serve after the grace period = %v, want errDrainTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return when the grace period ran out")
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	s := newTestServer(t)
+	preflight := func(origin string) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest("OPTIONS", s.URL+"/api/expenses", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	h := preflight("http://localhost:4321")
+	if h.Get("Access-Control-Allow-Origin") != "http://localhost:4321" || h.Get("Access-Control-Allow-Credentials") != "" ||
+		!strings.Contains(h.Get("Access-Control-Allow-Methods"), "PUT") || h.Get("Vary") != "Origin" {
+		t.Errorf("dev origin preflight headers = %v", h)
+	}
+	if h := preflight("https://evil.example"); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("unknown origin allowed: %v", h)
+	}
+
+	c := *config()
+	c.CORSAllowedOrigins = []string{"https://finance.example.com"}
+	c.CORSAllowedHeaders = []string{"Content-Type", "Authorization", "X-Household"}
+	c.CORSAllowCredentials = true
+	setConfig(&c)
+	h = preflight("https://Finance.example.com")
+	if h.Get("Access-Control-Allow-Origin") != "https://Finance.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" ||
+		!strings.Contains(h.Get("Access-Control-Allow-Headers"), "X-Household") {
+		t.Errorf("configured origin preflight headers = %v", h)
+	}
+	if h := preflight("http://localhost:4321"); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("dev origin still allowed: %v", h)
+	}
+
+	// Sockets from other sites are refused; the API's own origin is fine
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/api/ws"
+	if _, err := websocket.Dial(wsURL, "", "https://evil.example"); err == nil {
+		t.Error("socket from a disallowed origin connected")
+	}
+	ws, err := websocket.Dial(wsURL, "", "https://finance.example.com")
+	if err != nil {
+		t.Fatalf("socket from an allowed origin: %v", err)
+	}
+	ws.Close()
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	if _, err := loadConfig(); err == nil {
+		t.Error("wildcard origin with credentials accepted")
+	}
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://finance.example.com/app")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "")
+	if _, err := loadConfig(); err == nil {
+		t.Error("origin with a path accepted")
+	}
+}
+
+func TestExpenseEditConflicts(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/expenses", Expense{ID: "e1", Amount: 500 * majorUnit, Description: "Groceries", Date: "2026-03-01"}, http.StatusCreated)
+
+	get := func() (Expense, string) {
+		t.Helper()
+		resp, err := http.Get(s.URL + "/api/expenses/e1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var e Expense
+		json.NewDecoder(resp.Body).Decode(&e)
+		return e, resp.Header.Get("ETag")
+	}
+	put := func(e Expense, ifMatch string) (int, []byte) {
+		t.Helper()
+		data, _ := json.Marshal(e)
+		req, _ := http.NewRequest("PUT", s.URL+"/api/expenses/e1", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	alice, etag := get()
+	if alice.Version == "" || etag != `"`+alice.Version+`"` {
+		t.Fatalf("version = %q, ETag = %q", alice.Version, etag)
+	}
+	bob := alice
+
+	// Alice saves first; Bob's edit of the same copy is refused
+	alice.Description = "Groceries and milk"
+	if status, body := put(alice, ""); status != http.StatusOK {
+		t.Fatalf("first edit = %d %s", status, body)
+	}
+	bob.Amount = 550 * majorUnit
+	status, body := put(bob, "")
+	var conflict struct {
+		Error   string  `json:"error"`
+		Current Expense `json:"current"`
+	}
+	decode(t, body, &conflict)
+	if status != http.StatusConflict || conflict.Current.Description != "Groceries and milk" || conflict.Current.Amount != 500*majorUnit {
+		t.Fatalf("stale edit = %d %s", status, body)
+	}
+
+	// Retrying on the current copy goes through, here with If-Match
+	latest, etag := get()
+	if latest.Version != conflict.Current.Version {
+		t.Errorf("conflict copy version %q, stored %q", conflict.Current.Version, latest.Version)
+	}
+	latest.Amount = 550 * majorUnit
+	latest.Version = ""
+	if status, body := put(latest, etag); status != http.StatusOK {
+		t.Fatalf("edit with If-Match = %d %s", status, body)
+	}
+	if status, _ := put(latest, etag); status != http.StatusConflict {
+		t.Errorf("stale If-Match = %d, want 409", status)
+	}
+	if status, _ := put(latest, "*"); status != http.StatusOK {
+		t.Errorf("If-Match * = %d, want 200", status)
+	}
+
+	// Writes elsewhere change the version too
+	before, _ := get()
+	s.mustDo("POST", "/api/expenses/e1/comments", ExpenseComment{Content: "receipt is in the drawer"}, http.StatusCreated)
+	after, _ := get()
+	if before.Version == after.Version {
+		t.Error("version unchanged by a new comment")
+	}
+
+	// Clients that send no version keep last-write-wins
+	before.Version = ""
+	if status, _ := put(before, ""); status != http.StatusOK {
+		t.Errorf("unversioned edit = %d, want 200", status)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(expensesBucket)).Get([]byte("e1")); strings.Contains(string(v), `"version"`) {
+			t.Errorf("version stored: %s", v)
+		}
+		return nil
+	})
+}
+
+func TestTrends(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Now().In(householdLocation())
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	lastMonth := thisMonth.AddDate(0, -1, 0)
+	for _, e := range []Expense{
+		{Description: "Groceries", Category: "Food", Amount: 3000 * majorUnit, Date: thisMonth.Format(dateLayout)},
+		{Description: "Fuel", Category: "Transport", Amount: 2000 * majorUnit, Date: lastMonth.Format(dateLayout)},
+		{Description: "Supermarket", Category: "Food", Amount: 1500 * majorUnit, Date: lastMonth.AddDate(0, 0, 9).Format(dateLayout), Items: []LineItem{
+			{Name: "Vegetables", Price: 1000 * majorUnit},
+			{Name: "Soap", Category: "Household", Price: 500 * majorUnit},
+		}},
+		// Before the window
+		{Description: "Old", Category: "Food", Amount: 9000 * majorUnit, Date: thisMonth.AddDate(0, -2, 0).Format(dateLayout)},
+	} {
+		s.mustDo("POST", "/api/expenses", e, http.StatusCreated)
+	}
+	s.mustDo("POST", "/api/income", Income{Source: "Salary", Amount: 50000 * majorUnit, Date: lastMonth.Format(dateLayout)}, http.StatusCreated)
+
+	s.mustDo("GET", "/api/analytics/trends?granularity=year", nil, http.StatusBadRequest)
+	s.mustDo("GET", "/api/analytics/trends?months=0", nil, http.StatusBadRequest)
+
+	var trends Trends
+	decode(t, s.mustDo("GET", "/api/analytics/trends?months=2", nil, http.StatusOK), &trends)
+	if trends.Granularity != "month" || len(trends.Periods) != 2 || trends.Periods[0] != lastMonth.Format(dateLayout) {
+		t.Fatalf("periods = %s %v", trends.Granularity, trends.Periods)
+	}
+	if trends.Spending[0] != 3500*majorUnit || trends.Spending[1] != 3000*majorUnit ||
+		trends.Income[0] != 50000*majorUnit || trends.Income[1] != 0 {
+		t.Errorf("spending = %v, income = %v", trends.Spending, trends.Income)
+	}
+	got := fmt.Sprintf("%v", trends.SpendingByCategory)
+	want := fmt.Sprintf("%v", []TrendSeries{
+		{Category: "Food", Total: 4000 * majorUnit, Values: []Money{1000 * majorUnit, 3000 * majorUnit}},
+		{Category: "Transport", Total: 2000 * majorUnit, Values: []Money{2000 * majorUnit, 0}},
+		{Category: "Household", Total: 500 * majorUnit, Values: []Money{500 * majorUnit, 0}},
+	})
+	if got != want {
+		t.Errorf("by category = %s\nwant %s", got, want)
+	}
+	if len(trends.IncomeBySource) != 1 || trends.IncomeBySource[0].Category != "Salary" {
+		t.Errorf("by source = %+v", trends.IncomeBySource)
+	}
+
+	decode(t, s.mustDo("GET", "/api/analytics/trends?granularity=week&months=2&category=Transport", nil, http.StatusOK), &trends)
+	var total Money
+	for i, p := range trends.Periods {
+		start, _ := time.Parse(dateLayout, p)
+		if start.Weekday() != time.Monday || (i > 0 && trends.Periods[i-1] != start.AddDate(0, 0, -7).Format(dateLayout)) {
+			t.Errorf("week %d starts %s", i, p)
+		}
+		total += trends.Spending[i]
+	}
+	if total != 2000*majorUnit || len(trends.SpendingByCategory) != 1 {
+		t.Errorf("weekly transport = %v %+v", trends.Spending, trends.SpendingByCategory)
+	}
+
+	decode(t, s.mustDo("GET", "/api/analytics/trends?granularity=day&months=1", nil, http.StatusOK), &trends)
+	if len(trends.Periods) != now.Day() || trends.Spending[0] != 3000*majorUnit {
+		t.Errorf("daily = %v %v", trends.Periods, trends.Spending)
+	}
+}
+
+func TestForecast(t *testing.T) {
+	s := newTestServer(t)
+	loc := householdLocation()
+	now := time.Now().In(loc)
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	s.mustDo("POST", "/api/accounts", Account{Name: "Savings", Type: "savings", OpeningBalance: 100000 * majorUnit}, http.StatusCreated)
+	s.mustDo("POST", "/api/income", Income{Source: "Salary", Amount: 50000 * majorUnit, IsRecurring: true,
+		Date: first.AddDate(0, -1, 14).Format(dateLayout)}, http.StatusCreated)
+	s.mustDo("POST", "/api/bills", BillReminder{Name: "Rent", Amount: 20000 * majorUnit, Recurrence: "monthly",
+		DueDate: first.AddDate(0, 1, 4).Format(dateLayout)}, http.StatusCreated)
+	for i := 1; i <= forecastHistoryMonths; i++ {
+		s.mustDo("POST", "/api/expenses", Expense{Description: "Groceries", Category: "Food", Amount: 3000 * majorUnit,
+			Date: first.AddDate(0, -i, 2).Format(dateLayout)}, http.StatusCreated)
+	}
+	// Paying a subscription is not everyday spending, nor is older spending
+	s.mustDo("POST", "/api/expenses", Expense{ID: "nf", Description: "Netflix", Amount: 500 * majorUnit,
+		Date: first.AddDate(0, -1, 0).Format(dateLayout)}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Description: "Old", Amount: 9000 * majorUnit,
+		Date: first.AddDate(0, -forecastHistoryMonths-1, 0).Format(dateLayout)}, http.StatusCreated)
+	s.mustDo("POST", "/api/subscriptions", Subscription{Service: "Netflix", Amount: 500 * majorUnit, ExpenseID: "nf",
+		RenewalDate: today(loc)}, http.StatusCreated)
+
+	s.mustDo("GET", "/api/forecast?months=0", nil, http.StatusBadRequest)
+	var forecast Forecast
+	decode(t, s.mustDo("GET", "/api/forecast", nil, http.StatusOK), &forecast)
+	if forecast.OpeningBalance != 100000*majorUnit || forecast.DiscretionaryAverage != 3000*majorUnit || len(forecast.Months) != 3 {
+		t.Fatalf("forecast = %+v", forecast)
+	}
+	for i, m := range forecast.Months[1:] {
+		if m.Inflow != 50000*majorUnit || m.Bills != 20000*majorUnit || m.Subscriptions != 500*majorUnit ||
+			m.Discretionary != 3000*majorUnit || m.Outflow != 23500*majorUnit || m.Net != 26500*majorUnit {
+			t.Errorf("month %d = %+v", i+1, m)
+		}
+	}
+	current := forecast.Months[0]
+	if current.Month != now.Format("2006-01") || current.Subscriptions != 500*majorUnit || current.Discretionary > 3000*majorUnit {
+		t.Errorf("current month = %+v", current)
+	}
+	balance := forecast.OpeningBalance
+	for _, m := range forecast.Months {
+		balance += m.Net
+		if m.Balance != balance {
+			t.Errorf("%s balance = %s, want %s", m.Month, m.Balance, balance)
+		}
+	}
+}
+
+func TestAnomalyAlerts(t *testing.T) {
+	s := newTestServer(t)
+	day := func(offset int) string {
+		return time.Now().In(householdLocation()).AddDate(0, 0, offset).Format(dateLayout)
+	}
+	for _, offset := range []int{-20, -10, -5} {
+		s.mustDo("POST", "/api/expenses", Expense{Description: "Groceries", Category: "Food", Merchant: "BigBasket",
+			Amount: 1000 * majorUnit, Date: day(offset), User: "Sid"}, http.StatusCreated)
+	}
+	var unusual, laptop, repeat Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Party groceries", Category: "Food", Merchant: "BigBasket",
+		Amount: 5000 * majorUnit, Date: day(0), User: "Sid"}, http.StatusCreated), &unusual)
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Laptop", Category: "Electronics", Merchant: "Croma",
+		Amount: 60000 * majorUnit, Date: day(0), User: "Sid"}, http.StatusCreated), &laptop)
+	s.mustDo("POST", "/api/expenses", Expense{Description: "Ride", Category: "Transport", Merchant: "Uber",
+		Amount: 250 * majorUnit, Date: day(-1), User: "Sid"}, http.StatusCreated)
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Ride", Category: "Transport", Merchant: "Uber",
+		Amount: 250 * majorUnit, Date: day(0), User: "Sid"}, http.StatusCreated), &repeat)
+
+	if err := detectAnomalies(); err != nil {
+		t.Fatal(err)
+	}
+	// Each finding is alerted once
+	if err := detectAnomalies(); err != nil {
+		t.Fatal(err)
+	}
+	var alerts []Alert
+	decode(t, s.mustDo("GET", "/api/alerts?type=expense.", nil, http.StatusOK), &alerts)
+	found := map[string]string{}
+	for _, a := range alerts {
+		found[a.Type] = a.Subject
+	}
+	want := map[string]string{"expense.unusual": unusual.ID, "expense.newMerchant": laptop.ID, "expense.duplicate": repeat.ID}
+	if len(alerts) != 3 || fmt.Sprint(found) != fmt.Sprint(want) {
+		t.Fatalf("alerts = %+v", alerts)
+	}
+	decode(t, s.mustDo("GET", "/api/alerts?type=expense.unusual", nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Message != "Party groceries cost ₹5,000, 5.0 times the usual ₹1,000 for Food" ||
+		alerts[0].Recipients[0] != "Sid" {
+		t.Errorf("unusual = %+v", alerts)
+	}
+	decode(t, s.mustDo("GET", "/api/alerts?subject="+repeat.ID, nil, http.StatusOK), &alerts)
+	if len(alerts) != 1 || alerts[0].Type != "expense.duplicate" {
+		t.Errorf("alerts about the repeat = %+v", alerts)
+	}
+	s.mustDo("GET", "/api/alerts?limit=0", nil, http.StatusBadRequest)
+
+	// Alerts can go out to a webhook once the feature is on
+	var posted []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			User   string  `json:"user"`
+			Alerts []Alert `json:"alerts"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, a := range body.Alerts {
+			posted = append(posted, body.User+":"+a.Type)
+		}
+	}))
+	defer hook.Close()
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", NotificationPrefs{Channels: map[string][]string{"*": {"webhook"}}}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", NotificationPrefs{Webhook: hook.URL,
+		Channels: map[string][]string{"expense.duplicate": {"webhook"}}}, http.StatusOK)
+	if err := routeAlert(alerts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 0 {
+		t.Fatalf("posted with webhooks off: %v", posted)
+	}
+	c := *config()
+	c.Features = map[string]bool{"webhooks": true}
+	setConfig(&c)
+	if err := routeAlert(alerts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(posted) != "[Sid:expense.duplicate]" {
+		t.Errorf("posted = %v", posted)
+	}
+}
+
+func TestBudgetThresholdAlerts(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("POST", "/api/budgets", Budget{Name: "Food", Category: "Food", Limit: 1000 * majorUnit, AlertThresholds: []int{0}}, http.StatusBadRequest)
+	var food Budget
+	decode(t, s.mustDo("POST", "/api/budgets", Budget{Name: "Food", Category: "Food", Limit: 1000 * majorUnit}, http.StatusCreated), &food)
+	if fmt.Sprint(food.AlertThresholds) != "[80 100]" {
+		t.Errorf("default thresholds = %v", food.AlertThresholds)
+	}
+	s.mustDo("POST", "/api/budgets", Budget{Name: "Fun", Category: "Fun", Limit: 100 * majorUnit, AlertThresholds: []int{}}, http.StatusCreated)
+
+	alerts := func() []Alert {
+		t.Helper()
+		var alerts []Alert
+		decode(t, s.mustDo("GET", "/api/alerts?type=budget.threshold", nil, http.StatusOK), &alerts)
+		return alerts
+	}
+	date := today(householdLocation())
+	s.mustDo("POST", "/api/expenses", Expense{Description: "Groceries", Category: "Food", Amount: 500 * majorUnit, Date: date}, http.StatusCreated)
+	s.mustDo("POST", "/api/expenses", Expense{Description: "Movie", Category: "Fun", Amount: 500 * majorUnit, Date: date}, http.StatusCreated)
+	if got := alerts(); len(got) != 0 {
+		t.Fatalf("alerts at half the limit = %+v", got)
+	}
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Vegetables", Category: "Food", Amount: 350 * majorUnit, Date: date}, http.StatusCreated), &expense)
+	got := alerts()
+	if len(got) != 1 || got[0].Subject != food.ID || got[0].Message != "Budget Food has reached 80% of its ₹1,000 limit, with ₹850 spent" {
+		t.Fatalf("alerts at 85%% = %+v", got)
+	}
+	// Editing an expense counts too; jumping past both thresholds alerts
+	// only the higher
+	expense.Amount = 700 * majorUnit
+	s.mustDo("PUT", "/api/expenses/"+expense.ID, expense, http.StatusOK)
+	s.mustDo("POST", "/api/expenses", Expense{Description: "Snacks", Category: "Food", Amount: 10 * majorUnit, Date: date}, http.StatusCreated)
+	got = alerts()
+	if len(got) != 2 {
+		t.Fatalf("alerts over the limit = %+v", got)
+	}
+	over := got[0]
+	if over.Key != "alert.budget.over" {
+		over = got[1]
+	}
+	if over.Message != "Budget Food is over its ₹1,000 limit, with ₹1,200 spent" {
+		t.Errorf("over the limit = %+v", over)
+	}
+
+	// Alerts can go out on telegram
+	var sent []map[string]string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		body["path"] = r.URL.Path
+		sent = append(sent, body)
+	}))
+	defer api.Close()
+	defer func(old string) { telegramAPI = old }(telegramAPI)
+	telegramAPI = api.URL
+	c := *config()
+	c.TelegramBotToken = "123:abc"
+	setConfig(&c)
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", NotificationPrefs{Channels: map[string][]string{"*": {"telegram"}}}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/notifications/preferences/Sid", NotificationPrefs{TelegramChatID: "42",
+		Channels: map[string][]string{"budget.threshold": {"telegram"}}}, http.StatusOK)
+	if err := routeAlert(over); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0]["path"] != "/bot123:abc/sendMessage" || sent[0]["chat_id"] != "42" ||
+		!strings.HasPrefix(sent[0]["text"], over.Message) {
+		t.Errorf("sent to telegram = %v", sent)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	s := newTestServer(t)
+	hook := Webhook{URL: "https://hooks.example.com/finance", Events: []string{"expense.created"}}
+	s.mustDo("POST", "/api/webhooks", hook, http.StatusNotFound)
+	c := *config()
+	c.Features = map[string]bool{"webhooks": true}
+	setConfig(&c)
+
+	var received []*http.Request
+	var bodies [][]byte
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received, bodies = append(received, r), append(bodies, body)
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer receiver.Close()
+
+	s.mustDo("POST", "/api/webhooks", Webhook{URL: receiver.URL, Events: []string{"expense.shredded"}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/webhooks", Webhook{URL: "ftp://example.com", Events: []string{"*"}}, http.StatusBadRequest)
+	var created Webhook
+	decode(t, s.mustDo("POST", "/api/webhooks", Webhook{URL: receiver.URL, Events: []string{"expense.created", "budget.exceeded"}},
+		http.StatusCreated), &created)
+	if created.Secret == "" {
+		t.Fatal("no secret generated")
+	}
+	var hooks []Webhook
+	decode(t, s.mustDo("GET", "/api/webhooks", nil, http.StatusOK), &hooks)
+	if len(hooks) != 1 || hooks[0].Secret != "" {
+		t.Fatalf("webhooks = %+v", hooks)
+	}
+
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/expenses", Expense{Description: "Tea", Category: "Food", Amount: 40 * majorUnit}, http.StatusCreated), &expense)
+	// Not subscribed to updates
+	s.mustDo("PUT", "/api/expenses/"+expense.ID, expense, http.StatusOK)
+
+	tasks, err := listTasks(context.Background(), queueBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []Task
+	for _, task := range tasks {
+		if task.Type == webhookTask {
+			deliveries = append(deliveries, task)
+		}
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("queued deliveries = %+v", deliveries)
+	}
+	// The first attempt fails and is retried
+	if err := deliverWebhook(deliveries[0].Payload); err == nil {
+		t.Fatal("failed delivery not retried")
+	}
+	var log []WebhookDelivery
+	decode(t, s.mustDo("GET", "/api/webhooks/"+created.ID+"/deliveries", nil, http.StatusOK), &log)
+	if len(log) != 1 || log[0].Status != "retrying" || log[0].ResponseStatus != http.StatusBadGateway || log[0].Attempts != 1 {
+		t.Fatalf("log after a failure = %+v", log)
+	}
+	fail = false
+	if err := deliverWebhook(deliveries[0].Payload); err != nil {
+		t.Fatal(err)
+	}
+	log = nil
+	decode(t, s.mustDo("GET", "/api/webhooks/"+created.ID+"/deliveries?status=delivered", nil, http.StatusOK), &log)
+	if len(log) != 1 || log[0].Attempts != 2 || log[0].Error != "" {
+		t.Fatalf("log after delivery = %+v", log)
+	}
+
+	if len(received) != 2 || !bytes.Equal(bodies[0], bodies[1]) {
+		t.Fatalf("received %d deliveries", len(received))
+	}
+	r := received[1]
+	if r.Header.Get("X-Webhook-Event") != "expense.created" || r.Header.Get("X-Webhook-Delivery") != log[0].ID ||
+		r.Header.Get("X-Webhook-Signature") != signWebhook(created.Secret, bodies[1]) {
+		t.Errorf("headers = %v", r.Header)
+	}
+	var event struct {
+		Event string  `json:"event"`
+		Data  Expense `json:"data"`
+	}
+	json.Unmarshal(bodies[1], &event)
+	if event.Event != "expense.created" || event.Data.ID != expense.ID {
+		t.Errorf("event = %+v", event)
+	}
+
+	// A deleted webhook has no log to show
+	s.mustDo("DELETE", "/api/webhooks/"+created.ID, nil, http.StatusOK)
+	s.mustDo("GET", "/api/webhooks/"+created.ID+"/deliveries", nil, http.StatusNotFound)
+}
+
+// fakeIMAP serves messages, keyed by UID, to each connection dialled
+func fakeIMAP(validity int, messages map[int]string) func(string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			r := bufio.NewReader(server)
+			fmt.Fprint(server, "* OK IMAP ready\r\n")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				fields := strings.Fields(line)
+				tag, cmd := fields[0], strings.Join(fields[1:], " ")
+				var uids []int
+				for uid := range messages {
+					uids = append(uids, uid)
+				}
+				sort.Ints(uids)
+				switch {
+				case strings.HasPrefix(cmd, "EXAMINE"):
+					fmt.Fprintf(server, "* OK [UIDVALIDITY %d] UIDs valid\r\n", validity)
+				case strings.HasPrefix(cmd, "UID SEARCH UID"):
+					var from int
+					fmt.Sscanf(fields[4], "%d:*", &from)
+					found := []string{}
+					for _, uid := range uids {
+						if uid >= from || uid == uids[len(uids)-1] {
+							found = append(found, fmt.Sprint(uid))
+						}
+					}
+					fmt.Fprintf(server, "* SEARCH %s\r\n", strings.Join(found, " "))
+				case strings.HasPrefix(cmd, "UID SEARCH"):
+					found := []string{}
+					for _, uid := range uids {
+						found = append(found, fmt.Sprint(uid))
+					}
+					fmt.Fprintf(server, "* SEARCH %s\r\n", strings.Join(found, " "))
+				case strings.HasPrefix(cmd, "UID FETCH"):
+					var uid int
+					fmt.Sscanf(fields[3], "%d", &uid)
+					fmt.Fprintf(server, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid, uid, len(messages[uid]), messages[uid])
+				case strings.HasPrefix(cmd, "LOGOUT"):
+					fmt.Fprintf(server, "* BYE\r\n%s OK\r\n", tag)
+					return
+				}
+				fmt.Fprintf(server, "%s OK done\r\n", tag)
+			}
+		}()
+		return client, nil
+	}
+}
+
+func TestMailInbox(t *testing.T) {
+	s := newTestServer(t)
+	c := *config()
+	c.Features = map[string]bool{"emailIngest": true}
+	c.IMAPHost, c.IMAPUsername, c.IMAPPassword = "imap.example.com", "family", "secret"
+	setConfig(&c)
+
+	iciciHTML := base64.StdEncoding.EncodeToString([]byte(
+		"<html><style>p{color:red}</style><body><p>Dear Customer,</p><p>INR 1,250.50 spent using ICICI Bank Card XX9876 on 13-Oct-26 on SWIGGY. Avl Limit: INR 50,000.00</p></body></html>"))
+	messages := map[int]string{
+		3: "From: HDFC Bank InstaAlerts <alerts@hdfcbank.net>\r\nSubject: Alert : Update on your HDFC Bank Credit Card\r\n" +
+			"Message-Id: <hdfc-1@hdfcbank.net>\r\nDate: Mon, 12 Oct 2026 14:21:00 +0530\r\n\r\n" +
+			"Dear Card Member,\r\nRs.2,499.00 has been spent on your HDFC Bank Credit Card ending 4321\r\nat AMAZON on 12-10-2026 14:20:11.\r\n",
+		4: "From: credit_cards@icicibank.com\r\nSubject: Transaction alert for your ICICI Bank Credit Card\r\n" +
+			"Message-Id: <icici-1@icicibank.com>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+			"--b1\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" + iciciHTML + "\r\n--b1--\r\n",
+		5: "From: alerts@hdfcbank.net\r\nSubject: Your statement is ready\r\nMessage-Id: <hdfc-2@hdfcbank.net>\r\n\r\nYour statement is ready.\r\n",
+		6: "From: friend@example.com\r\nSubject: Lunch?\r\nMessage-Id: <x@example.com>\r\n\r\nRs.500.00 has been spent on lunch.\r\n",
+	}
+	old := imapDial
+	defer func() { imapDial = old }()
+	imapDial = fakeIMAP(7, messages)
+
+	if err := pollMail(); err != nil {
+		t.Fatal(err)
+	}
+	var drafts []PendingTransaction
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &drafts)
+	if len(drafts) != 2 {
+		t.Fatalf("drafts = %+v", drafts)
+	}
+	icici, hdfc := drafts[0], drafts[1]
+	if hdfc.Bank != "HDFC Bank" || hdfc.Amount != 2499*majorUnit || hdfc.Merchant != "Amazon" || hdfc.Date != "2026-10-12" ||
+		hdfc.Account != "4321" || hdfc.Status != "pending" {
+		t.Fatalf("hdfc draft = %+v", hdfc)
+	}
+	if icici.Bank != "ICICI Bank" || icici.Amount != 125050*majorUnit/100 || !strings.EqualFold(icici.Merchant, "SWIGGY") || icici.Date != "2026-10-13" {
+		t.Fatalf("icici draft = %+v", icici)
+	}
+
+	// Only new messages are read on the next poll
+	messages[8] = strings.Replace(messages[3], "hdfc-1", "hdfc-3", 1)
+	messages[8] = strings.Replace(messages[8], "AMAZON", "FLIPKART", 1)
+	if err := pollMail(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollMail(); err != nil {
+		t.Fatal(err)
+	}
+	drafts = nil
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &drafts)
+	if len(drafts) != 3 {
+		t.Fatalf("drafts after second poll = %+v", drafts)
+	}
+
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/pending/"+hdfc.ID+"/approve", map[string]string{"category": "Shopping", "user": "dad"},
+		http.StatusCreated), &expense)
+	if expense.Amount != 2499*majorUnit || expense.Merchant != "Amazon" || expense.Category != "Shopping" ||
+		expense.User != "dad" || expense.Date != "2026-10-12" || !strings.Contains(expense.Notes, "4321") {
+		t.Fatalf("accepted expense = %+v", expense)
+	}
+	s.mustDo("GET", "/api/expenses/"+expense.ID, nil, http.StatusOK)
+	s.mustDo("POST", "/api/pending/"+hdfc.ID+"/approve", nil, http.StatusConflict)
+	s.mustDo("POST", "/api/pending/"+icici.ID+"/reject", nil, http.StatusOK)
+	s.mustDo("POST", "/api/pending/"+icici.ID+"/reject", nil, http.StatusConflict)
+	s.mustDo("POST", "/api/pending/nope/approve", nil, http.StatusNotFound)
+
+	drafts = nil
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &drafts)
+	if len(drafts) != 1 || !strings.EqualFold(drafts[0].Merchant, "FLIPKART") {
+		t.Fatalf("pending drafts = %+v", drafts)
+	}
+	flipkart := drafts[0]
+	drafts = nil
+	decode(t, s.mustDo("GET", "/api/pending?status=all", nil, http.StatusOK), &drafts)
+	if len(drafts) != 3 {
+		t.Fatalf("all drafts = %+v", drafts)
+	}
+
+	// The inbox routes of earlier releases work on the queue
+	drafts = nil
+	decode(t, s.mustDo("GET", "/api/inbox?status=dismissed", nil, http.StatusOK), &drafts)
+	if len(drafts) != 1 || drafts[0].ID != icici.ID {
+		t.Fatalf("dismissed inbox drafts = %+v", drafts)
+	}
+	s.mustDo("DELETE", "/api/inbox/"+flipkart.ID, nil, http.StatusOK)
+	s.mustDo("POST", "/api/inbox/"+flipkart.ID+"/accept", nil, http.StatusConflict)
+	drafts = nil
+	decode(t, s.mustDo("GET", "/api/inbox", nil, http.StatusOK), &drafts)
+	if len(drafts) != 0 {
+		t.Errorf("inbox after dismissing = %+v", drafts)
+	}
+}
+
+func TestSMSIngest(t *testing.T) {
+	s := newTestServer(t)
+	hdfc := SMSMessage{Sender: "VM-HDFCBK", Text: "Sent Rs.250.00\nFrom HDFC Bank A/C *1234\nTo SWIGGY\nOn 14/10/26\nRef 628712345678\nNot You? Call 18002586161",
+		ReceivedAt: "2026-10-14T13:05:00+05:30", User: "mom"}
+	s.mustDo("POST", "/api/ingest/sms", hdfc, http.StatusNotFound)
+	c := *config()
+	c.Features = map[string]bool{"smsIngest": true}
+	setConfig(&c)
+
+	var draft PendingTransaction
+	decode(t, s.mustDo("POST", "/api/ingest/sms", hdfc, http.StatusCreated), &draft)
+	if draft.Source != "sms" || draft.Bank != "HDFC Bank" || draft.Amount != 250*majorUnit || !strings.EqualFold(draft.Merchant, "SWIGGY") ||
+		draft.Account != "1234" || draft.Date != "2026-10-14" || draft.User != "mom" || draft.Status != "pending" {
+		t.Fatalf("hdfc draft = %+v", draft)
+	}
+	// Forwarded twice
+	var again PendingTransaction
+	decode(t, s.mustDo("POST", "/api/ingest/sms", hdfc, http.StatusOK), &again)
+	if again.ID != draft.ID {
+		t.Fatalf("resent text drafted again: %+v", again)
+	}
+
+	cases := []struct {
+		msg                 SMSMessage
+		bank, merchant, day string
+		amount              Money
+	}{
+		{SMSMessage{Sender: "AD-ICICIB", Text: "ICICI Bank Acct XX123 debited for Rs 1,200.00 on 13-Oct-26; Zomato Ltd credited. UPI:628700001111. Call 18002662 for dispute."},
+			"ICICI Bank", "Zomato Ltd", "2026-10-13", 1200 * majorUnit},
+		{SMSMessage{Sender: "JD-SBIUPI", Text: "Dear UPI user A/C X5678 debited by 99.0 on date 12Oct26 trf to BIGBASKET Refno 628755554444. If not u? call 1800111109. -SBI"},
+			"SBI", "BIGBASKET", "2026-10-12", 99 * majorUnit},
+		{SMSMessage{Sender: "BP-PAYTMB", Text: "Rs.45.00 paid to chaiwala@ybl from your Paytm Payments Bank a/c", ReceivedAt: "2026-10-11T08:00:00+05:30"},
+			"UPI", "chaiwala@ybl", "2026-10-11", 45 * majorUnit},
+	}
+	for _, tc := range cases {
+		var d PendingTransaction
+		decode(t, s.mustDo("POST", "/api/ingest/sms", tc.msg, http.StatusCreated), &d)
+		if d.Bank != tc.bank || !strings.EqualFold(d.Merchant, tc.merchant) || d.Date != tc.day || d.Amount != tc.amount {
+			t.Errorf("%s draft = %+v", tc.msg.Sender, d)
+		}
+	}
+
+	// Not debits
+	s.mustDo("POST", "/api/ingest/sms", SMSMessage{Sender: "VM-HDFCBK", Text: "Your OTP for login is 123456. Do not share it."}, http.StatusUnprocessableEntity)
+	s.mustDo("POST", "/api/ingest/sms", SMSMessage{Sender: "VM-HDFCBK", Text: "Rs.5000.00 credited to HDFC Bank A/c XX1234 from VPA boss@okaxis"}, http.StatusUnprocessableEntity)
+	s.mustDo("POST", "/api/ingest/sms", SMSMessage{Sender: "VM-HDFCBK"}, http.StatusBadRequest)
+
+	var drafts []PendingTransaction
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &drafts)
+	if len(drafts) != 4 {
+		t.Fatalf("pending = %+v", drafts)
+	}
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/pending/"+draft.ID+"/approve", nil, http.StatusCreated), &expense)
+	if expense.User != "mom" || expense.Amount != 250*majorUnit || expense.Date != "2026-10-14" {
+		t.Fatalf("accepted expense = %+v", expense)
+	}
+}
+
+func TestDuplicateExpenses(t *testing.T) {
+	s := newTestServer(t)
+	create := func(e Expense) Expense {
+		decode(t, s.mustDo("POST", "/api/expenses", e, http.StatusCreated), &e)
+		return e
+	}
+	first := create(Expense{Amount: 899 * majorUnit, Date: "2026-10-01", Merchant: "Netflix", Tags: []string{"tv"}})
+	second := create(Expense{Amount: 899 * majorUnit, Date: "2026-10-02", Merchant: "NETFLIX", Notes: "charged twice?", Tags: []string{"dispute"}})
+	create(Expense{Amount: 899 * majorUnit, Date: "2026-11-01", Merchant: "Netflix"})
+	create(Expense{Amount: 450 * majorUnit, Date: "2026-10-01", Merchant: "Netflix"})
+	create(Expense{Amount: 120 * majorUnit, Date: "2026-10-05", Description: "Chai"})
+	create(Expense{Amount: 120 * majorUnit, Date: "2026-10-08", Description: "chai"})
+
+	var groups []DuplicateGroup
+	decode(t, s.mustDo("GET", "/api/expenses/duplicates", nil, http.StatusOK), &groups)
+	if len(groups) != 1 || len(groups[0].Expenses) != 2 || groups[0].Expenses[0].ID != first.ID || groups[0].Expenses[1].ID != second.ID {
+		t.Fatalf("duplicates = %+v", groups)
+	}
+	groups = nil
+	decode(t, s.mustDo("GET", "/api/expenses/duplicates?days=3", nil, http.StatusOK), &groups)
+	if len(groups) != 2 || groups[0].Merchant != "Chai" {
+		t.Fatalf("duplicates within 3 days = %+v", groups)
+	}
+	s.mustDo("GET", "/api/expenses/duplicates?days=-1", nil, http.StatusBadRequest)
+
+	s.mustDo("POST", "/api/expenses/"+second.ID+"/comments", ExpenseComment{Content: "bank says it was one charge"}, http.StatusCreated)
+	db.Update(func(tx *bolt.Tx) error {
+		data, _ := json.Marshal(Attachment{ID: "a1", ExpenseID: second.ID, File: "statement.pdf", FileName: "statement.pdf"})
+		return tx.Bucket([]byte(attachmentsBucket)).Put([]byte("a1"), data)
+	})
+
+	s.mustDo("POST", "/api/expenses/"+first.ID+"/merge", ExpenseMerge{}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses/"+first.ID+"/merge", ExpenseMerge{IDs: []string{first.ID}}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/expenses/"+first.ID+"/merge", ExpenseMerge{IDs: []string{"nope"}}, http.StatusNotFound)
+	var merged Expense
+	decode(t, s.mustDo("POST", "/api/expenses/"+first.ID+"/merge", ExpenseMerge{IDs: []string{second.ID}}, http.StatusOK), &merged)
+	if merged.Notes != "charged twice?" || len(merged.Tags) != 2 || merged.CommentCount != 1 || !merged.HasAttachments {
+		t.Fatalf("merged expense = %+v", merged)
+	}
+	s.mustDo("GET", "/api/expenses/"+second.ID, nil, http.StatusNotFound)
+	var comments []ExpenseComment
+	decode(t, s.mustDo("GET", "/api/expenses/"+first.ID+"/comments", nil, http.StatusOK), &comments)
+	var attachments []Attachment
+	decode(t, s.mustDo("GET", "/api/expenses/"+first.ID+"/attachments", nil, http.StatusOK), &attachments)
+	if len(comments) != 1 || len(attachments) != 1 {
+		t.Fatalf("merged comments %+v, attachments %+v", comments, attachments)
+	}
+	groups = nil
+	decode(t, s.mustDo("GET", "/api/expenses/duplicates", nil, http.StatusOK), &groups)
+	if len(groups) != 0 {
+		t.Fatalf("duplicates after merge = %+v", groups)
+	}
+}
+
+func TestPendingTransactions(t *testing.T) {
+	s := newTestServer(t)
+	statement := "Date,Narration,Amount\n" +
+		"02/03/2026,SWIGGY,-450.00\n" +
+		"03/03/2026,DMART,-1234.50\n" +
+		"04/03/2026,Uber,-310.00\n"
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "march.csv")
+	part.Write([]byte(statement))
+	form.WriteField("mapping", `{"date": "Date", "merchant": "Narration", "amount": "Amount"}`)
+	form.Close()
+	resp, err := s.Client().Post(s.URL+"/api/import/csv", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imp CSVImport
+	json.NewDecoder(resp.Body).Decode(&imp)
+	resp.Body.Close()
+
+	// Imports queue their expenses for review instead of recording them
+	decode(t, s.mustDo("POST", "/api/import/csv/"+imp.ID+"/commit", nil, http.StatusOK), &imp)
+	if imp.Queued != 3 || imp.Imported != 0 || imp.Rows[0].Status != "queued" {
+		t.Fatalf("committed import = %+v", imp)
+	}
+	var expenses []Expense
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 0 {
+		t.Fatalf("queued rows recorded as expenses: %+v", expenses)
+	}
+	var pending []PendingTransaction
+	decode(t, s.mustDo("GET", "/api/pending?source=import", nil, http.StatusOK), &pending)
+	if len(pending) != 3 || pending[0].Date != "2026-03-04" || pending[0].ImportID != imp.ID || pending[0].From != "march.csv" {
+		t.Fatalf("pending = %+v", pending)
+	}
+	uber, dmart, swiggy := pending[0], pending[1], pending[2]
+
+	// Approval may correct the expense first
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/pending/"+uber.ID+"/approve", map[string]string{"category": "Transport", "description": "Airport cab"},
+		http.StatusCreated), &expense)
+	if expense.Category != "Transport" || expense.Description != "Airport cab" || expense.Amount != 310*majorUnit {
+		t.Fatalf("approved expense = %+v", expense)
+	}
+	s.mustDo("POST", "/api/pending/"+uber.ID+"/approve", nil, http.StatusConflict)
+	s.mustDo("POST", "/api/pending/"+dmart.ID+"/approve", map[string]string{"date": "someday"}, http.StatusBadRequest)
+
+	// Bulk approval is all or none
+	s.mustDo("POST", "/api/pending/approve", PendingApproval{}, http.StatusBadRequest)
+	s.mustDo("POST", "/api/pending/approve", PendingApproval{IDs: []string{dmart.ID, uber.ID}}, http.StatusConflict)
+	s.mustDo("POST", "/api/pending/approve", PendingApproval{IDs: []string{dmart.ID, "nope"}}, http.StatusNotFound)
+	expenses = nil
+	decode(t, s.mustDo("GET", "/api/expenses", nil, http.StatusOK), &expenses)
+	if len(expenses) != 1 {
+		t.Fatalf("failed bulk approval left expenses: %+v", expenses)
+	}
+
+	// Rejection can be undone
+	var rejected map[string]string
+	decode(t, s.mustDo("POST", "/api/pending/"+swiggy.ID+"/reject", nil, http.StatusOK), &rejected)
+	s.mustDo("POST", "/api/pending/"+swiggy.ID+"/reject", nil, http.StatusConflict)
+	s.mustDo("POST", "/api/undo/"+rejected["actionId"], nil, http.StatusOK)
+
+	var approved struct {
+		Approved int       `json:"approved"`
+		Expenses []Expense `json:"expenses"`
+	}
+	decode(t, s.mustDo("POST", "/api/pending/approve", PendingApproval{IDs: []string{dmart.ID, swiggy.ID}}, http.StatusOK), &approved)
+	if approved.Approved != 2 || approved.Expenses[0].ID == approved.Expenses[1].ID {
+		t.Fatalf("bulk approval = %+v", approved)
+	}
+	pending = nil
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &pending)
+	if len(pending) != 0 {
+		t.Fatalf("still pending = %+v", pending)
+	}
+	pending = nil
+	decode(t, s.mustDo("GET", "/api/pending?status=approved", nil, http.StatusOK), &pending)
+	if len(pending) != 3 || pending[0].ExpenseID != expense.ID {
+		t.Fatalf("approved = %+v", pending)
+	}
+}
+
+func TestMoveInboxDrafts(t *testing.T) {
+	newTestServer(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		inbox, err := tx.CreateBucket([]byte("inbox"))
+		if err != nil {
+			return err
+		}
+		inbox.Put([]byte("1"), []byte(`{"id":"1","source":"email","amount":100,"status":"accepted"}`))
+		inbox.Put([]byte("2"), []byte(`{"id":"2","source":"sms","amount":100,"status":"dismissed"}`))
+		inbox.Put([]byte("3"), []byte(`{"id":"3","source":"sms","amount":100,"status":"pending"}`))
+		n, err := moveInboxDrafts(tx)
+		if err != nil || n != 3 {
+			t.Fatalf("moved %d drafts: %v", n, err)
+		}
+		if tx.Bucket([]byte("inbox")) != nil {
+			t.Error("inbox bucket kept")
+		}
+		want := map[string]string{"1": pendingApproved, "2": pendingRejected, "3": pendingReview}
+		for id, status := range want {
+			var p PendingTransaction
+			json.Unmarshal(tx.Bucket([]byte(pendingBucket)).Get([]byte(id)), &p)
+			if p.Status != status {
+				t.Errorf("draft %s moved as %q, want %q", id, p.Status, status)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBankSync(t *testing.T) {
+	s := newTestServer(t)
+	s.mustDo("GET", "/api/bank/connections", nil, http.StatusNotFound)
+	c := *config()
+	c.Features = map[string]bool{"bankSync": true}
+	setConfig(&c)
+	s.mustDo("POST", "/api/bank/link-token", nil, http.StatusServiceUnavailable)
+
+	var syncs int
+	removed := []map[string]string{}
+	plaid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["client_id"] != "client" || body["secret"] != "shh" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error_code":"INVALID_API_KEYS","error_message":"bad keys"}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/link/token/create":
+			fmt.Fprint(w, `{"link_token":"link-sandbox-1"}`)
+		case "/item/public_token/exchange":
+			fmt.Fprint(w, `{"access_token":"access-sandbox-secret","item_id":"item-1"}`)
+		case "/accounts/get":
+			fmt.Fprint(w, `{"accounts":[{"account_id":"acc-card","name":"Platinum Card","mask":"4321","type":"credit","balances":{"iso_currency_code":"INR"}}]}`)
+		case "/transactions/sync":
+			if body["access_token"] != "access-sandbox-secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			syncs++
+			switch body["cursor"] {
+			case nil:
+				fmt.Fprint(w, `{"added":[
+					{"transaction_id":"t1","account_id":"acc-card","amount":1499.5,"iso_currency_code":"INR","date":"2026-10-10","name":"AMAZON PAY","merchant_name":"Amazon"},
+					{"transaction_id":"t2","account_id":"acc-card","amount":-200,"iso_currency_code":"INR","date":"2026-10-11","name":"REFUND"}],
+					"removed":[],"next_cursor":"c1","has_more":true}`)
+			case "c1":
+				fmt.Fprint(w, `{"added":[
+					{"transaction_id":"t3","account_id":"acc-card","amount":300,"iso_currency_code":"INR","date":"2026-10-12","name":"CAFE COFFEE DAY","pending":true},
+					{"transaction_id":"t4","account_id":"acc-card","amount":80,"iso_currency_code":"INR","date":"2026-10-12","name":"METRO CARD"}],
+					"removed":[],"next_cursor":"c2","has_more":false}`)
+			default:
+				fmt.Fprint(w, `{"added":[],"removed":[{"transaction_id":"t4"}],"next_cursor":"c3","has_more":false}`)
+			}
+		case "/item/remove":
+			removed = append(removed, map[string]string{"token": fmt.Sprint(body["access_token"])})
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer plaid.Close()
+	defer func(url string) { plaidHosts["sandbox"] = url }(plaidHosts["sandbox"])
+	plaidHosts["sandbox"] = plaid.URL
+	c.BankSyncProvider, c.PlaidClientID, c.PlaidSecret, c.PlaidEnv = "plaid", "client", "shh", "sandbox"
+	c.PlaidCountryCodes, c.BankTokenKey = []string{"US"}, "correct horse battery staple"
+	setConfig(&c)
+
+	var link map[string]string
+	decode(t, s.mustDo("POST", "/api/bank/link-token", nil, http.StatusOK), &link)
+	if link["linkToken"] != "link-sandbox-1" {
+		t.Fatalf("link token = %v", link)
+	}
+	s.mustDo("POST", "/api/bank/connections", map[string]string{}, http.StatusBadRequest)
+	var bc BankConnection
+	decode(t, s.mustDo("POST", "/api/bank/connections", map[string]string{"publicToken": "public-1", "institution": "HDFC Bank", "user": "dad"},
+		http.StatusCreated), &bc)
+	if bc.Token != "" || len(bc.Accounts) != 1 || bc.Accounts[0].Mask != "4321" || bc.User != "dad" {
+		t.Fatalf("connection = %+v", bc)
+	}
+	// The access token is stored sealed
+	db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bankConnectionsBucket)).Get([]byte(bc.ID))
+		if bytes.Contains(v, []byte("access-sandbox-secret")) {
+			t.Error("access token stored in the clear")
+		}
+		return nil
+	})
+
+	var account Account
+	decode(t, s.mustDo("POST", "/api/accounts", Account{Name: "HDFC card", Type: "credit-card"}, http.StatusCreated), &account)
+	s.mustDo("PUT", "/api/bank/connections/"+bc.ID, map[string]interface{}{"accounts": map[string]string{"nope": account.ID}}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/bank/connections/"+bc.ID, map[string]interface{}{"accounts": map[string]string{"acc-card": "nope"}}, http.StatusBadRequest)
+	s.mustDo("PUT", "/api/bank/connections/"+bc.ID, map[string]interface{}{"accounts": map[string]string{"acc-card": account.ID}}, http.StatusOK)
+
+	// Posted spending is queued; refunds and pending charges are not
+	if err := syncBanks(); err != nil {
+		t.Fatal(err)
+	}
+	var drafts []PendingTransaction
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &drafts)
+	if len(drafts) != 2 || syncs != 2 {
+		t.Fatalf("drafts = %+v after %d syncs", drafts, syncs)
+	}
+	metro, amazon := drafts[0], drafts[1]
+	if amazon.Source != "bank" || amazon.Amount != 14995*majorUnit/10 || amazon.Merchant != "Amazon" || amazon.Date != "2026-10-10" ||
+		amazon.AccountID != account.ID || amazon.Account != "4321" || amazon.User != "dad" {
+		t.Fatalf("amazon draft = %+v", amazon)
+	}
+
+	// A transaction the bank withdraws takes its draft with it
+	var synced map[string]int
+	decode(t, s.mustDo("POST", "/api/bank/connections/"+bc.ID+"/sync", nil, http.StatusOK), &synced)
+	if synced["queued"] != 0 {
+		t.Fatalf("sync = %v", synced)
+	}
+	drafts = nil
+	decode(t, s.mustDo("GET", "/api/pending", nil, http.StatusOK), &drafts)
+	if len(drafts) != 1 || drafts[0].ID != amazon.ID {
+		t.Fatalf("drafts after removal = %+v (metro %s)", drafts, metro.ID)
+	}
+	var expense Expense
+	decode(t, s.mustDo("POST", "/api/pending/"+amazon.ID+"/approve", nil, http.StatusCreated), &expense)
+	if expense.AccountID != account.ID || expense.User != "dad" {
+		t.Fatalf("accepted expense = %+v", expense)
+	}
+
+	// Failures are recorded on the connection
+	c.PlaidSecret = "wrong"
+	setConfig(&c)
+	s.mustDo("POST", "/api/bank/connections/"+bc.ID+"/sync", nil, http.StatusBadGateway)
+	var connections []BankConnection
+	decode(t, s.mustDo("GET", "/api/bank/connections", nil, http.StatusOK), &connections)
+	if len(connections) != 1 || connections[0].Status != "error" || !strings.Contains(connections[0].LastError, "INVALID_API_KEYS") ||
+		connections[0].Token != "" {
+		t.Fatalf("connections = %+v", connections)
+	}
+	c.PlaidSecret = "shh"
+	setConfig(&c)
+
+	s.mustDo("DELETE", "/api/bank/connections/"+bc.ID, nil, http.StatusOK)
+	if len(removed) != 1 || removed[0]["token"] != "access-sandbox-secret" {
+		t.Fatalf("item removals = %v", removed)
+	}
+	s.mustDo("DELETE", "/api/bank/connections/"+bc.ID, nil, http.StatusNotFound)
+}
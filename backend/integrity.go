@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// IntegrityIssue describes one problem found in stored data
+type IntegrityIssue struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	Kind     string `json:"kind"` // invalid_json, id_mismatch or dangling_reference
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+// IntegrityReport is the result of a full scan
+type IntegrityReport struct {
+	CheckedAt string           `json:"checkedAt"`
+	Records   map[string]int   `json:"records"`
+	Issues    []IntegrityIssue `json:"issues"`
+	Repaired  int              `json:"repaired"`
+}
+
+// integrityRecordBuckets maps buckets holding JSON records to the field
+// that must equal the record's key.
+var integrityRecordBuckets = map[string]string{
+	expensesBucket:       "id",
+	budgetsBucket:        "id",
+	goalsBucket:          "id",
+	investmentsBucket:    "id",
+	billsBucket:          "id",
+	incomeBucket:         "id",
+	jobsBucket:           "name",
+	queueBucket:          "id",
+	deadLettersBucket:    "id",
+	retentionRulesBucket: "id",
+	retentionRunsBucket:  "id",
+	alertsBucket:         "id",
+	incomeSourcesBucket:  "id",
+	undoBucket:           "id",
+
+	notificationPrefsBucket:  "user",
+	notificationOutboxBucket: "id",
+	userPrefsBucket:          "user",
+	customFieldsBucket:       "key",
+	merchantsBucket:          "key",
+	transfersBucket:          "id",
+	debtsBucket:              "id",
+	allowancesBucket:         "id",
+	allowanceCreditsBucket:   "id",
+	claimsBucket:             "id",
+	plannedPurchasesBucket:   "id",
+	subscriptionsBucket:      "id",
+	creditScoresBucket:       "id",
+	insurancePoliciesBucket:  "id",
+	documentsBucket:          "id",
+	commentsBucket:           "id",
+	importsBucket:            "id",
+	accountsBucket:           "id",
+	exchangeRatesBucket:      "currency",
+	netWorthHistoryBucket:    "date",
+	attachmentsBucket:        "id",
+	rulesBucket:              "id",
+	webhooksBucket:           "id",
+	webhookDeliveriesBucket:  "id",
+	pendingBucket:            "id",
+	bankConnectionsBucket:    "id",
+	membersBucket:            "id",
+}
+
+// integrityRef is a field in one bucket that holds keys of another
+type integrityRef struct {
+	bucket string
+	field  string
+	target string
+	many   bool // field is a list of keys rather than a single key
+}
+
+var integrityRefs = []integrityRef{
+	{bucket: expensesBucket, field: "budgetIds", target: budgetsBucket, many: true},
+	{bucket: incomeBucket, field: "sourceId", target: incomeSourcesBucket},
+	{bucket: claimsBucket, field: "expenseIds", target: expensesBucket, many: true},
+	{bucket: expensesBucket, field: "claimId", target: claimsBucket},
+	{bucket: incomeBucket, field: "claimId", target: claimsBucket},
+	{bucket: subscriptionsBucket, field: "expenseId", target: expensesBucket},
+	{bucket: insurancePoliciesBucket, field: "billId", target: billsBucket},
+	{bucket: billsBucket, field: "policyId", target: insurancePoliciesBucket},
+	{bucket: commentsBucket, field: "expenseId", target: expensesBucket},
+	{bucket: attachmentsBucket, field: "expenseId", target: expensesBucket},
+	{bucket: expensesBucket, field: "accountId", target: accountsBucket},
+	{bucket: incomeBucket, field: "accountId", target: accountsBucket},
+}
+
+// checkIntegrity scans every record bucket. With repair set it quarantines
+// unparseable records, rewrites mismatched IDs and strips dangling
+// references, all in one transaction.
+func checkIntegrity(ctx context.Context, repair bool) (*IntegrityReport, error) {
+	report := &IntegrityReport{
+		CheckedAt: time.Now().Format(time.RFC3339),
+		Records:   map[string]int{},
+		Issues:    []IntegrityIssue{},
+	}
+
+	check := func(tx *bolt.Tx) error {
+		for name, idField := range integrityRecordBuckets {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+			type fix struct {
+				key   []byte
+				value []byte // nil quarantines the record
+			}
+			var fixes []fix
+			err := forEach(ctx, b, func(k, v []byte) error {
+				report.Records[name]++
+				var fields map[string]json.RawMessage
+				if err := json.Unmarshal(v, &fields); err != nil {
+					report.Issues = append(report.Issues, IntegrityIssue{
+						Bucket: name, Key: string(k), Kind: "invalid_json", Detail: err.Error(), Repaired: repair,
+					})
+					fixes = append(fixes, fix{key: append([]byte(nil), k...)})
+					return nil
+				}
+				var id string
+				json.Unmarshal(fields[idField], &id)
+				if id != string(k) {
+					report.Issues = append(report.Issues, IntegrityIssue{
+						Bucket: name, Key: string(k), Kind: "id_mismatch",
+						Detail: fmt.Sprintf("%s is %q", idField, id), Repaired: repair,
+					})
+					fields[idField], _ = json.Marshal(string(k))
+					data, err := json.Marshal(fields)
+					if err != nil {
+						return err
+					}
+					fixes = append(fixes, fix{key: append([]byte(nil), k...), value: data})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !repair {
+				continue
+			}
+			for _, f := range fixes {
+				if f.value == nil {
+					bad := b.Get(f.key)
+					quarantineKey := []byte(name + "/" + string(f.key))
+					if err := tx.Bucket([]byte(quarantineBucket)).Put(quarantineKey, bad); err != nil {
+						return err
+					}
+					if err := b.Delete(f.key); err != nil {
+						return err
+					}
+				} else if err := b.Put(f.key, f.value); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, ref := range integrityRefs {
+			if err := checkReferences(ctx, tx, ref, repair, report); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if repair {
+		err = updateContext(ctx, check)
+	} else {
+		err = viewContext(ctx, check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if repair {
+		report.Repaired = len(report.Issues)
+	}
+	return report, nil
+}
+
+func checkReferences(ctx context.Context, tx *bolt.Tx, ref integrityRef, repair bool, report *IntegrityReport) error {
+	b := tx.Bucket([]byte(ref.bucket))
+	target := tx.Bucket([]byte(ref.target))
+	type fix struct{ key, value []byte }
+	var fixes []fix
+
+	err := forEach(ctx, b, func(k, v []byte) error {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(v, &fields) != nil || fields[ref.field] == nil {
+			return nil
+		}
+		var ids []string
+		if ref.many {
+			json.Unmarshal(fields[ref.field], &ids)
+		} else {
+			var id string
+			json.Unmarshal(fields[ref.field], &id)
+			if id != "" {
+				ids = []string{id}
+			}
+		}
+		kept := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if target.Get([]byte(id)) != nil {
+				kept = append(kept, id)
+				continue
+			}
+			report.Issues = append(report.Issues, IntegrityIssue{
+				Bucket: ref.bucket, Key: string(k), Kind: "dangling_reference",
+				Detail: fmt.Sprintf("%s references missing %s %q", ref.field, ref.target, id), Repaired: repair,
+			})
+		}
+		if len(kept) == len(ids) {
+			return nil
+		}
+		if ref.many {
+			fields[ref.field], _ = json.Marshal(kept)
+		} else {
+			fields[ref.field], _ = json.Marshal("")
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		fixes = append(fixes, fix{append([]byte(nil), k...), data})
+		return nil
+	})
+	if err != nil || !repair {
+		return err
+	}
+	for _, f := range fixes {
+		if err := b.Put(f.key, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStartupIntegrityCheck logs problems found on boot and repairs them
+// when configured to.
+func runStartupIntegrityCheck() {
+	log := logger("store")
+	report, err := checkIntegrity(context.Background(), config().IntegrityRepairOnBoot && config().Role != roleReplica)
+	if err != nil {
+		log.Error("integrity check failed", "err", err)
+		return
+	}
+	if len(report.Issues) == 0 {
+		log.Info("integrity check passed", "records", report.Records)
+		return
+	}
+	for _, issue := range report.Issues {
+		log.Warn("integrity issue", "bucket", issue.Bucket, "key", issue.Key, "kind", issue.Kind, "detail", issue.Detail, "repaired", issue.Repaired)
+	}
+}
+
+// ADMIN: INTEGRITY
+
+func getIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	report, err := checkIntegrity(r.Context(), false)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
+
+func repairIntegrity(w http.ResponseWriter, r *http.Request) {
+	report, err := checkIntegrity(r.Context(), true)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// investmentTransactionTypes are what can happen to a position. Buys and
+// SIP installments put money in; sells and dividends take it out.
+var investmentTransactionTypes = []string{"buy", "sip", "sell", "dividend"}
+
+var errOversold = errors.New("cannot sell more units than are held")
+
+// InvestmentTransaction is money put into or taken out of an investment
+type InvestmentTransaction struct {
+	ID        string  `json:"id"`
+	Type      string  `json:"type"` // buy, sip, sell or dividend
+	Date      string  `json:"date"`
+	Units     float64 `json:"units,omitempty"` // bought or sold; none for dividends
+	Amount    Money   `json:"amount"`          // paid, or received for sells and dividends
+	Note      string  `json:"note,omitempty"`
+	CreatedAt string  `json:"createdAt"`
+}
+
+func (t *InvestmentTransaction) validate(loc *time.Location) error {
+	if err := oneOf("type", t.Type, investmentTransactionTypes); err != nil {
+		return err
+	}
+	if t.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if t.Units < 0 {
+		return fmt.Errorf("units cannot be negative")
+	}
+	if t.Type == "dividend" {
+		t.Units = 0
+	}
+	date, err := normalizeDate(t.Date, loc)
+	if err != nil {
+		return err
+	}
+	if date == "" {
+		date = today(loc)
+	}
+	t.Date = date
+	return nil
+}
+
+// applyTransactions derives the position from its transactions, in date
+// order: units held, what they cost (average cost, so a sale takes its
+// share of the cost with it), gains realized on sales and dividends
+// received. Investments without transactions keep the values entered by
+// hand.
+func (inv *Investment) applyTransactions() error {
+	if len(inv.Transactions) == 0 {
+		return nil
+	}
+	sort.SliceStable(inv.Transactions, func(i, j int) bool { return inv.Transactions[i].Date < inv.Transactions[j].Date })
+	var units float64
+	var cost, realized, dividends Money
+	for _, t := range inv.Transactions {
+		switch t.Type {
+		case "buy", "sip":
+			units += t.Units
+			cost += t.Amount
+		case "sell":
+			// Without units the sale comes off the cost as it is
+			sold := t.Amount
+			if units > 0 || t.Units > 0 {
+				if t.Units > units+1e-9 {
+					return errOversold
+				}
+				sold = moneyFromFloat(cost.Float64() * t.Units / units)
+				units -= t.Units
+			}
+			if sold > cost {
+				sold = cost
+			}
+			realized += t.Amount - sold
+			cost -= sold
+		case "dividend":
+			dividends += t.Amount
+		}
+	}
+	if units > 0 || inv.Units > 0 {
+		inv.Units = math.Round(units*1e6) / 1e6
+	}
+	inv.InvestedValue = cost
+	inv.Realized = realized
+	inv.Dividends = dividends
+	if inv.Price > 0 {
+		inv.Value = roundForCurrency(moneyFromFloat(inv.Units*inv.Price), inv.Currency)
+	}
+	inv.computeReturns()
+	return nil
+}
+
+// computeReturns works out returns on what is held, plus what sales and
+// dividends brought in, as an amount and as a share of the money put in
+func (inv *Investment) computeReturns() {
+	inv.Returns = inv.Value - inv.InvestedValue + inv.Realized + inv.Dividends
+	paid := inv.InvestedValue
+	if len(inv.Transactions) > 0 {
+		paid = 0
+		for _, t := range inv.Transactions {
+			if t.Type == "buy" || t.Type == "sip" {
+				paid += t.Amount
+			}
+		}
+	}
+	inv.ReturnsPercent = 0
+	if paid != 0 {
+		inv.ReturnsPercent = math.Round(float64(inv.Returns)/float64(paid)*10000) / 100
+	}
+}
+
+// cashFlow is money in (negative) or out (positive) of an investment
+type cashFlow struct {
+	date   time.Time
+	amount float64
+}
+
+// xirr is the annual rate, as a fraction, at which the cash flows are worth
+// nothing today: the investment's annualized return. It reports false when
+// there is no rate, such as when money only went one way.
+func xirr(flows []cashFlow) (float64, bool) {
+	if len(flows) < 2 {
+		return 0, false
+	}
+	hasIn, hasOut := false, false
+	first := flows[0].date
+	for _, f := range flows {
+		hasIn = hasIn || f.amount < 0
+		hasOut = hasOut || f.amount > 0
+		if f.date.Before(first) {
+			first = f.date
+		}
+	}
+	if !hasIn || !hasOut {
+		return 0, false
+	}
+	npv := func(rate float64) (value, derivative float64) {
+		for _, f := range flows {
+			years := f.date.Sub(first).Hours() / 24 / 365
+			d := math.Pow(1+rate, years)
+			value += f.amount / d
+			derivative -= years * f.amount / (d * (1 + rate))
+		}
+		return value, derivative
+	}
+	// Newton's method from 10%, falling back to bisection when it strays
+	rate := 0.1
+	for i := 0; i < 50; i++ {
+		value, derivative := npv(rate)
+		if math.Abs(value) < 1e-7 {
+			return rate, true
+		}
+		if derivative == 0 {
+			break
+		}
+		next := rate - value/derivative
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < 1e-10 {
+			return next, true
+		}
+		rate = next
+	}
+	low, high := -0.9999, 10.0
+	vLow, _ := npv(low)
+	vHigh, _ := npv(high)
+	if vLow*vHigh > 0 {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (low + high) / 2
+		v, _ := npv(mid)
+		if math.Abs(v) < 1e-7 {
+			return mid, true
+		}
+		if (v > 0) == (vLow > 0) {
+			low, vLow = mid, v
+		} else {
+			high = mid
+		}
+	}
+	return (low + high) / 2, true
+}
+
+// computeXIRR sets the annualized return of an investment with
+// transactions, counting what is held as sold on the given day
+func (inv *Investment) computeXIRR(today string) {
+	inv.XIRR = nil
+	var flows []cashFlow
+	for _, t := range inv.Transactions {
+		date, err := time.Parse(dateLayout, t.Date)
+		if err != nil {
+			continue
+		}
+		amount := t.Amount.Float64()
+		if t.Type == "buy" || t.Type == "sip" {
+			amount = -amount
+		}
+		flows = append(flows, cashFlow{date, amount})
+	}
+	if now, err := time.Parse(dateLayout, today); err == nil && inv.Value > 0 {
+		flows = append(flows, cashFlow{now, inv.Value.Float64()})
+	}
+	if rate, ok := xirr(flows); ok {
+		percent := math.Round(rate*10000) / 100
+		inv.XIRR = &percent
+	}
+}
+
+// INVESTMENT TRANSACTIONS
+
+// createInvestmentTransaction records a buy, sell, SIP installment or
+// dividend and returns the investment with its position worked out again
+func createInvestmentTransaction(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var t InvestmentTransaction
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	loc := householdLocation()
+	if err := t.validate(loc); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	t.ID = fmt.Sprintf("%d", now.UnixNano())
+	t.CreatedAt = now.Format(time.RFC3339)
+	var inv Investment
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(investmentsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return err
+		}
+		if len(inv.Transactions) == 0 {
+			// The position is built from transactions from now on
+			inv.Units = 0
+		}
+		inv.Transactions = append(inv.Transactions, t)
+		if err := inv.applyTransactions(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "investment not found")
+	case err == errOversold:
+		respondError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		inv.computeXIRR(today(loc))
+		respondJSON(w, http.StatusCreated, inv)
+	}
+}
+
+// deleteInvestmentTransaction removes a transaction recorded by mistake
+func deleteInvestmentTransaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, txID := vars["id"], vars["txId"]
+	var inv Investment
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(investmentsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return err
+		}
+		kept := inv.Transactions[:0:0]
+		for _, t := range inv.Transactions {
+			if t.ID != txID {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == len(inv.Transactions) {
+			return errNotFound
+		}
+		inv.Transactions = kept
+		if err := inv.applyTransactions(); err != nil {
+			return err
+		}
+		j.track(investmentsBucket, []byte(id))
+		data, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "transaction not found")
+	case err == errOversold:
+		respondError(w, http.StatusBadRequest, "removing it would leave more units sold than bought")
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		inv.computeXIRR(today(householdLocation()))
+		respondUndoable(w, http.StatusOK, actionID, inv)
+	}
+}
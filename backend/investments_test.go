@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestXIRR(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse(dateLayout, s)
+		return d
+	}
+	cases := []struct {
+		name  string
+		flows []cashFlow
+		want  float64
+		ok    bool
+	}{
+		{"one year", []cashFlow{{day("2025-01-01"), -1000}, {day("2026-01-01"), 1100}}, 0.10, true},
+		{"loss", []cashFlow{{day("2025-01-01"), -1000}, {day("2026-01-01"), 800}}, -0.20, true},
+		{"instalments", []cashFlow{
+			{day("2025-01-01"), -1000}, {day("2025-07-02"), -1000}, {day("2026-01-01"), 2150},
+		}, 0.1007, true},
+		{"money only in", []cashFlow{{day("2025-01-01"), -1000}, {day("2025-06-01"), -500}}, 0, false},
+		{"single flow", []cashFlow{{day("2025-01-01"), -1000}}, 0, false},
+	}
+	for _, c := range cases {
+		got, ok := xirr(c.flows)
+		if ok != c.ok || math.Abs(got-c.want) > 0.0005 {
+			t.Errorf("%s: xirr = %.4f, %v; want %.4f, %v", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
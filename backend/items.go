@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// LineItem is one line of an itemized expense, such as a supermarket bill
+// spanning several categories
+type LineItem struct {
+	Name     string  `json:"name"`
+	Quantity float64 `json:"quantity"` // defaults to 1
+	Price    Money   `json:"price"`    // per unit
+	// Category defaults to the expense's own
+	Category string `json:"category,omitempty"`
+	Amount   Money  `json:"amount"` // quantity times price, worked out on save
+}
+
+// validateItems works out line amounts and checks they add up to the
+// expense amount. An expense sent without an amount takes the items' total.
+func validateItems(e *Expense) error {
+	if len(e.Items) == 0 {
+		e.Items = nil
+		return nil
+	}
+	var total Money
+	for i := range e.Items {
+		item := &e.Items[i]
+		item.Name = strings.TrimSpace(item.Name)
+		if item.Name == "" {
+			return fmt.Errorf("items[%d]: name is required", i)
+		}
+		if item.Quantity == 0 {
+			item.Quantity = 1
+		}
+		if item.Quantity < 0 {
+			return fmt.Errorf("items[%d]: quantity must be positive", i)
+		}
+		if item.Price < 0 {
+			return fmt.Errorf("items[%d]: price cannot be negative", i)
+		}
+		item.Category = strings.TrimSpace(item.Category)
+		item.Amount = roundForCurrency(Money(math.Round(float64(item.Price)*item.Quantity)), e.Currency)
+		total += item.Amount
+	}
+	if e.Amount == 0 {
+		e.Amount = total
+	}
+	if total != e.Amount {
+		return fmt.Errorf("items add up to %s, expense amount is %s", total, e.Amount)
+	}
+	return nil
+}
+
+// categoryPart is the share of an expense spent in one category
+type categoryPart struct {
+	Category string
+	Amount   Money
+}
+
+// categoryParts splits an expense by category. Itemized expenses count each
+// line in its own category; others count whole in the expense's.
+func (e Expense) categoryParts() []categoryPart {
+	if len(e.Items) == 0 {
+		return []categoryPart{{e.Category, e.Amount}}
+	}
+	var parts []categoryPart
+	index := map[string]int{}
+	for _, item := range e.Items {
+		category := item.Category
+		if category == "" {
+			category = e.Category
+		}
+		if i, ok := index[category]; ok {
+			parts[i].Amount += item.Amount
+			continue
+		}
+		index[category] = len(parts)
+		parts = append(parts, categoryPart{category, item.Amount})
+	}
+	return parts
+}
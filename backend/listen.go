@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// unixPrefix marks a listen address as a Unix domain socket path
+const unixPrefix = "unix:"
+
+// listenAddr returns the configured listen address, falling back to all
+// interfaces on the configured port.
+func listenAddr(c *Config) string {
+	if c.ListenAddr != "" {
+		return c.ListenAddr
+	}
+	return ":" + c.Port
+}
+
+// newServer builds the HTTP server with the configured timeouts so slow
+// clients can't hold connections, goroutines and transactions indefinitely.
+func newServer(c *Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Duration(c.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(c.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(c.IdleTimeoutSeconds) * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger("http").Handler(), slog.LevelWarn),
+	}
+}
+
+// errDrainTimeout is returned by serve when requests were still running
+// as the grace period ran out and had to be cut off
+var errDrainTimeout = errors.New("requests still in flight when the grace period ran out")
+
+// serve runs the server until SIGINT or SIGTERM, then stops accepting
+// connections and gives requests in flight up to grace to finish, so none
+// is cut off in the middle of a write. Live update sockets are closed.
+func serve(srv *http.Server, ln net.Listener, grace time.Duration) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	srv.RegisterOnShutdown(events.closeAll)
+
+	served := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			served <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		served <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		logger("http").Info("shutting down", "signal", sig.String(), "grace", grace.String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger("http").Error("cutting off requests still in flight", "grace", grace.String(), "err", err)
+		srv.Close()
+		return errDrainTimeout
+	}
+	return nil
+}
+
+// listen opens the server socket. "unix:/run/finance/api.sock" binds a Unix
+// domain socket, anything else is a TCP host:port.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("listen address %q has no socket path", addr)
+	}
+
+	// A socket left behind by an unclean exit would make the bind fail.
+	// Only remove it if it really is a socket.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Let a reverse proxy in the same group connect
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// certReloader serves a certificate from files, loading them again when
+// the certificate file changes
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fi, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil // mid-renewal; keep serving the old one
+		}
+		return nil, err
+	}
+	if c.cert != nil && !fi.ModTime().After(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			logger("http").Error("reloading TLS certificate", "err", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTime = &cert, fi.ModTime()
+	return c.cert, nil
+}
+
+// newTLSConfig loads the configured certificate, failing if it cannot be
+// read so a bad path is caught on startup rather than on the first client
+func newTLSConfig(c *Config) (*tls.Config, error) {
+	certs := &certReloader{certFile: c.TLSCertFile, keyFile: c.TLSKeyFile}
+	if _, err := certs.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}, nil
+}
+
+// httpsRedirect sends plain HTTP requests to the same URL over HTTPS on the
+// port the server listens on
+func httpsRedirect(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveRedirect listens on addr and redirects everything to HTTPS
+func serveRedirect(c *Config) (*http.Server, error) {
+	ln, err := net.Listen("tcp", c.TLSRedirectAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           httpsRedirect(listenAddr(c)),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Duration(c.IdleTimeoutSeconds) * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger("http").Handler(), slog.LevelWarn),
+	}
+	go srv.Serve(ln)
+	return srv, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+func writeTestCert(t *testing.T, certFile, keyFile, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestTLSServesAndReloadsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{TLSCertFile: filepath.Join(dir, "cert.pem"), TLSKeyFile: filepath.Join(dir, "key.pem")}
+	if _, err := newTLSConfig(c); err == nil {
+		t.Fatal("missing certificate accepted")
+	}
+	writeTestCert(t, c.TLSCertFile, c.TLSKeyFile, "first")
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{TLSConfig: tlsConfig, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(srv, ln, time.Second)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	served := func() string {
+		t.Helper()
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("status = %d", resp.StatusCode)
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if name := served(); name != "first" {
+		t.Errorf("certificate = %q, want first", name)
+	}
+
+	// A renewal replaces the files
+	writeTestCert(t, c.TLSCertFile, c.TLSKeyFile, "renewed")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(c.TLSCertFile, later, later)
+	if name := served(); name != "renewed" {
+		t.Errorf("certificate after renewal = %q, want renewed", name)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, tc := range []struct{ listen, host, want string }{
+		{":443", "finance.example.com", "https://finance.example.com/api/expenses?from=2026-01-01"},
+		{":443", "finance.example.com:80", "https://finance.example.com/api/expenses?from=2026-01-01"},
+		{":8443", "finance.example.com", "https://finance.example.com:8443/api/expenses?from=2026-01-01"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tc.host+"/api/expenses?from=2026-01-01", nil)
+		rec := httptest.NewRecorder()
+		httpsRedirect(tc.listen).ServeHTTP(rec, req)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s via %s: %d %s, want %s", tc.host, tc.listen, rec.Code, rec.Header().Get("Location"), tc.want)
+		}
+	}
+}
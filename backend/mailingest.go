@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// mailCursorKey holds the mailbox's mailCursor in the settings bucket
+const mailCursorKey = "mail-cursor"
+
+// fetchMail reads new messages from the mailbox; tests replace it
+var fetchMail = fetchIMAP
+
+// MailTemplate reads one bank's transaction alert emails
+type MailTemplate struct {
+	Bank string `json:"bank"`
+	// From must appear in the sender's address, e.g. "hdfcbank"; empty
+	// tries the template on every message
+	From string `json:"from"`
+	// Pattern is a regular expression matched, case-insensitively, against
+	// the message text with its whitespace collapsed. Its named groups fill
+	// the pending transaction: amount is required; merchant, date, account (the last
+	// digits of the card or account) and currency are optional.
+	Pattern string `json:"pattern"`
+	// DateFormat is a Go layout for the date group; by default the usual
+	// formats are tried, day first
+	DateFormat string `json:"dateFormat,omitempty"`
+}
+
+// defaultMailTemplates read the alerts of common Indian banks. Templates in
+// the config are tried first.
+var defaultMailTemplates = []MailTemplate{
+	{Bank: "HDFC Bank", From: "hdfcbank", Pattern: `Rs\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) (?:has been )?(?:spent|debited) on (?:your )?HDFC Bank (?:Credit |Debit )?Card (?:ending )?[x*]*(?P<account>\d{4}) at (?P<merchant>.+?) on (?P<date>\d{2}-\d{2}-\d{2,4})`},
+	{Bank: "HDFC Bank", From: "hdfcbank", Pattern: `Rs\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) has been debited from (?:your )?account (?:ending )?[x*]*(?P<account>\d{4}) to VPA (?P<merchant>\S+).*? on (?P<date>\d{2}-\d{2}-\d{2,4})`},
+	{Bank: "ICICI Bank", From: "icicibank", Pattern: `INR (?P<amount>[\d,]+(?:\.\d{1,2})?) spent (?:using|on) (?:your )?ICICI Bank (?:Credit )?Card XX(?P<account>\d{4}) on (?P<date>\d{2}-\w{3}-\d{2,4}) (?:at|on) (?P<merchant>.+?)\.`},
+	{Bank: "SBI Card", From: "sbicard", Pattern: `Rs\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) spent on your SBI Credit Card ending (?:with )?(?P<account>\d{4}) at (?P<merchant>.+?) on (?P<date>\d{2}/\d{2}/\d{2,4})`},
+	{Bank: "Axis Bank", From: "axisbank", Pattern: `(?:INR|Rs\.?)\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) (?:was )?spent on (?:your )?(?:Axis Bank )?Credit Card no\. XX(?P<account>\d{4}) at (?P<merchant>.+?) on (?P<date>\d{2}-\d{2}-\d{2,4})`},
+}
+
+// mailDateLayouts are the dates banks write in alerts, besides the usual
+// input formats
+var mailDateLayouts = []string{"02-01-06", "02/01/06", "02-Jan-06", "02-Jan-2006", "02Jan06"}
+
+func (t MailTemplate) compile() (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?i)" + t.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("amount") < 0 {
+		return nil, fmt.Errorf("pattern has no (?P<amount>...) group")
+	}
+	return re, nil
+}
+
+func (t MailTemplate) validate() error {
+	if strings.TrimSpace(t.Bank) == "" {
+		return fmt.Errorf("bank is required")
+	}
+	_, err := t.compile()
+	return err
+}
+
+var (
+	mailHTMLHidden = regexp.MustCompile(`(?is)<(style|script)[^>]*>.*?</(style|script)>`)
+	mailHTMLTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// mailText is the readable text of a message part: its plain text, or its
+// HTML with the markup removed. Multipart messages give their first plain
+// text part, or else their first HTML one.
+func mailText(contentType, encoding string, body io.Reader) (string, error) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var htmlText string
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return htmlText, nil
+			}
+			if err != nil {
+				return "", err
+			}
+			// NextPart undoes quoted-printable itself
+			text, err := mailText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if text != "" && partType != "text/html" {
+				return text, nil
+			}
+			if htmlText == "" {
+				htmlText = text
+			}
+		}
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "", nil
+	}
+	data, err := io.ReadAll(io.LimitReader(body, imapMaxMessage))
+	if err != nil {
+		return "", err
+	}
+	text := string(data)
+	if mediaType == "text/html" {
+		text = mailHTMLHidden.ReplaceAllString(text, " ")
+		text = html.UnescapeString(mailHTMLTag.ReplaceAllString(text, " "))
+	}
+	return strings.Join(strings.Fields(text), " "), nil
+}
+
+// parseTransactionMail reads a raw message with the first template it
+// matches. ok is false for messages that are not transaction alerts.
+func parseTransactionMail(raw []byte, templates []MailTemplate, settings Settings) (PendingTransaction, bool, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		return PendingTransaction{}, false, err
+	}
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	from := msg.Header.Get("From")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	var text string
+	draft := PendingTransaction{
+		Source:    "email",
+		MessageID: strings.Trim(msg.Header.Get("Message-Id"), "<> "),
+		From:      from,
+		Subject:   subject,
+	}
+	received, err := msg.Header.Date()
+	if err == nil {
+		draft.ReceivedAt = received.Format(time.RFC3339)
+	}
+
+	for _, t := range templates {
+		if !strings.Contains(strings.ToLower(from), strings.ToLower(t.From)) {
+			continue
+		}
+		re, err := t.compile()
+		if err != nil {
+			return PendingTransaction{}, false, err
+		}
+		if text == "" {
+			text, err = mailText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+			if err != nil {
+				return PendingTransaction{}, false, err
+			}
+		}
+		if t.read(re, text, &draft, received, settings) {
+			return draft, true, nil
+		}
+	}
+	return PendingTransaction{}, false, nil
+}
+
+// read fills a pending transaction from the text if the template's pattern,
+// compiled as re, matches it. Undated alerts take the date they were
+// received.
+func (t MailTemplate) read(re *regexp.Regexp, text string, draft *PendingTransaction, received time.Time, settings Settings) bool {
+	m := re.FindStringSubmatch(text)
+	if m == nil {
+		return false
+	}
+	group := func(name string) string {
+		if i := re.SubexpIndex(name); i >= 0 {
+			return strings.TrimSpace(m[i])
+		}
+		return ""
+	}
+	amount, err := parseStatementAmount(group("amount"))
+	if err != nil || amount <= 0 {
+		return false
+	}
+	draft.Bank = t.Bank
+	draft.Account = group("account")
+	draft.Merchant = group("merchant")
+	draft.Currency = settings.BaseCurrency
+	if c := group("currency"); c != "" {
+		if code, err := normalizeCurrency(strings.ToUpper(strings.Trim(c, ".")), settings.BaseCurrency); err == nil {
+			draft.Currency = code
+		}
+	}
+	draft.Amount = roundForCurrency(amount, draft.Currency)
+	loc := settings.location(draft.User)
+	draft.Date = mailDate(group("date"), t.DateFormat)
+	if draft.Date == "" && !received.IsZero() {
+		draft.Date = received.In(loc).Format(dateLayout)
+	}
+	if draft.Date == "" {
+		draft.Date = today(loc)
+	}
+	return true
+}
+
+// mailDate reads an alert's date, empty when it cannot
+func mailDate(s, layout string) string {
+	if s == "" {
+		return ""
+	}
+	layouts := append(append([]string{}, mailDateLayouts...), dateInputLayouts...)
+	if layout != "" {
+		layouts = []string{layout}
+	}
+	for _, l := range layouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.Format(dateLayout)
+		}
+	}
+	return ""
+}
+
+// pollMail reads new mail while the emailIngest feature is on and an IMAP
+// server is configured, and queues each transaction alert for review.
+// Messages the templates do not match are passed over.
+func pollMail() error {
+	c := config()
+	if !featureEnabled("emailIngest") || c.IMAPHost == "" {
+		return nil
+	}
+	var cursor mailCursor
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(settingsBucket)).Get([]byte(mailCursorKey)); v != nil {
+			return json.Unmarshal(v, &cursor)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	messages, cursor, fetchErr := fetchMail(c, cursor)
+
+	settings := currentSettings()
+	templates := append(append([]MailTemplate{}, c.MailTemplates...), defaultMailTemplates...)
+	var drafts []PendingTransaction
+	for _, m := range messages {
+		draft, ok, err := parseTransactionMail(m.Raw, templates, settings)
+		if err != nil {
+			logger("mail").Warn("reading message", "uid", m.UID, "err", err)
+			continue
+		}
+		if ok {
+			drafts = append(drafts, draft)
+		}
+	}
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pendingBucket))
+		seen := map[string]bool{}
+		err := b.ForEach(func(k, v []byte) error {
+			var d PendingTransaction
+			if json.Unmarshal(v, &d) == nil && d.MessageID != "" {
+				seen[d.MessageID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, d := range drafts {
+			if d.MessageID != "" && seen[d.MessageID] {
+				continue
+			}
+			seen[d.MessageID] = true
+			d.ID = fmt.Sprintf("%d", now.UnixNano()+int64(i))
+			d.Status = pendingReview
+			d.CreatedAt = now.Format(time.RFC3339)
+			d.UpdatedAt = d.CreatedAt
+			if m, ok := knownMerchant(tx, d.Merchant); ok {
+				if m.Name != "" {
+					d.Merchant = m.Name
+				}
+				d.Category = m.DefaultCategory
+			}
+			if err := putPendingTransaction(tx, d); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(cursor)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(settingsBucket)).Put([]byte(mailCursorKey), data)
+	})
+	if err != nil {
+		return err
+	}
+	if len(drafts) > 0 {
+		logger("mail").Info("queued transactions from mail", "messages", len(messages), "queued", len(drafts))
+	}
+	return fetchErr
+}
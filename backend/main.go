@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -14,45 +22,84 @@ import (
 
 // Expense represents a financial expense
 type Expense struct {
-	ID             string   `json:"id"`
-	Amount         float64  `json:"amount"`
-	Currency       string   `json:"currency"`
-	Description    string   `json:"description"`
-	Category       string   `json:"category"`
-	CategoryColor  string   `json:"categoryColor,omitempty"`
-	Merchant       string   `json:"merchant"`
-	Date           string   `json:"date"`
-	User           string   `json:"user"`
-	IsShared       bool     `json:"isShared"`
+	ID            string `json:"id"`
+	Amount        Money  `json:"amount"`
+	Currency      string `json:"currency"`
+	Description   string `json:"description"`
+	Category      string `json:"category"`
+	CategoryColor string `json:"categoryColor,omitempty"`
+	Merchant      string `json:"merchant"`
+	AccountID     string `json:"accountId,omitempty"` // account it was paid from
+	Date          string `json:"date"`
+	User          string `json:"user"`
+	MemberID      string `json:"memberId,omitempty"` // profile of User; see Member
+	IsShared      bool   `json:"isShared"`
+	// PaidBy is the member who paid for a split expense, when not User
+	PaidBy         string   `json:"paidBy,omitempty"`
 	HasAttachments bool     `json:"hasAttachments"`
 	CommentCount   int      `json:"commentCount"`
 	Notes          string   `json:"notes,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
 	Attachments    []string `json:"attachments,omitempty"`
 	BudgetIds      []string `json:"budgetIds,omitempty"`
-	CreatedAt      string   `json:"createdAt"`
-	UpdatedAt      string   `json:"updatedAt"`
+	// Splits share the expense between members; see ExpenseSplit
+	Splits []ExpenseSplit `json:"splits,omitempty"`
+	// CustomFields holds values of the household's custom fields by key
+	CustomFields map[string]interface{} `json:"customFields,omitempty"`
+	// Items itemize the expense; see LineItem
+	Items []LineItem `json:"items,omitempty"`
+	// Tax holds GST details for members claiming input tax
+	Tax *ExpenseTax `json:"tax,omitempty"`
+	// Purchase flags goods with a warranty or return window
+	Purchase *Purchase `json:"purchase,omitempty"`
+	// Donation flags a gift to a charity, for 80G claims
+	Donation *Donation `json:"donation,omitempty"`
+	// Reimbursable expenses are paid back by an employer through a claim;
+	// ClaimID and Reimbursed are kept by the claim
+	Reimbursable bool   `json:"reimbursable"`
+	ClaimID      string `json:"claimId,omitempty"`
+	Reimbursed   bool   `json:"reimbursed,omitempty"`
+	CreatedAt    string `json:"createdAt"`
+	UpdatedAt    string `json:"updatedAt"`
+	// Version identifies the stored copy, for detecting conflicting edits.
+	// It is worked out on reading and never stored.
+	Version string `json:"version,omitempty"`
 }
 
 // Budget represents a budget category
 type Budget struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Category    string  `json:"category,omitempty"` // Optional - budget can span multiple categories
-	Month       string  `json:"month"`              // Format: "2026-01"
-	Limit       float64 `json:"limit"`
-	Spent       float64 `json:"spent"`
-	Color       string  `json:"color"`
-	IsRecurring bool    `json:"isRecurring"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Category    string `json:"category,omitempty"` // Optional - budget can span multiple categories
+	Month       string `json:"month"`              // Format: "2026-01"
+	Limit       Money  `json:"limit"`
+	Currency    string `json:"currency"`
+	Spent       Money  `json:"spent"`
+	Color       string `json:"color"`
+	IsRecurring bool   `json:"isRecurring"`
+	Period      string `json:"period"`             // monthly, weekly or yearly
+	Rollover    bool   `json:"rollover,omitempty"` // carry what is left of a month into the next
+	// AlertThresholds are the percentages of the limit that raise an alert
+	// as spending reaches them; 80 and 100 unless set, none when empty
+	AlertThresholds []int  `json:"alertThresholds"`
+	CarriedOver     Money  `json:"carriedOver,omitempty"` // computed in listings
+	Owner           string `json:"owner,omitempty"`       // member who created it, when signed in
 }
 
 // Goal represents a financial goal
 type Goal struct {
-	ID       string  `json:"id"`
-	Name     string  `json:"name"`
-	Target   float64 `json:"target"`
-	Current  float64 `json:"current"`
-	Deadline string  `json:"deadline"`
-	Color    string  `json:"color"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Target   Money  `json:"target"`
+	Current  Money  `json:"current"`
+	Currency string `json:"currency"`
+	Deadline string `json:"deadline"`
+	Color    string `json:"color"`
+	// Status is active, paused, completed or archived. Goals complete when
+	// Current reaches Target and are archived a while later.
+	Status      string `json:"status"`
+	CompletedAt string `json:"completedAt,omitempty"`
+	Owner       string `json:"owner,omitempty"` // member who created it, when signed in
 }
 
 // Investment represents an investment
@@ -60,34 +107,71 @@ type Investment struct {
 	ID             string  `json:"id"`
 	Name           string  `json:"name"`
 	Type           string  `json:"type"`
-	Value          float64 `json:"value"`
-	InvestedValue  float64 `json:"investedValue"`
-	Returns        float64 `json:"returns"`
+	Value          Money   `json:"value"`
+	InvestedValue  Money   `json:"investedValue"`
+	Currency       string  `json:"currency"`
+	Returns        Money   `json:"returns"`
 	ReturnsPercent float64 `json:"returnsPercent"`
+
+	// Market pricing: with a symbol and units, Value and returns follow the
+	// latest price from PriceProvider, or the configured default
+	Symbol        string  `json:"symbol,omitempty"` // ticker, or AMFI scheme code for mutual funds
+	Units         float64 `json:"units,omitempty"`
+	PriceProvider string  `json:"priceProvider,omitempty"` // yahoo, alphavantage or amfi
+	Price         float64 `json:"price,omitempty"`         // latest unit price, in Currency
+	PricedAt      string  `json:"pricedAt,omitempty"`
+
+	// Transactions, when there are any, decide Units and InvestedValue (the
+	// cost of the units still held); Returns then include Realized gains on
+	// sales and Dividends
+	Transactions []InvestmentTransaction `json:"transactions,omitempty"`
+	Realized     Money                   `json:"realized,omitempty"`
+	Dividends    Money                   `json:"dividends,omitempty"`
+	XIRR         *float64                `json:"xirr,omitempty"` // annualized return in percent, computed in listings
 }
 
 // BillReminder represents a bill reminder
 type BillReminder struct {
-	ID       string  `json:"id"`
-	Name     string  `json:"name"`
-	Amount   float64 `json:"amount"`
-	DueDate  string  `json:"dueDate"`
-	Status   string  `json:"status"`
-	Category string  `json:"category"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency"`
+	DueDate  string `json:"dueDate"`
+	IsPaid   bool   `json:"isPaid"`
+	Status   string `json:"status"` // computed: upcoming, due, overdue or paid
+
+	// Payments made so far; AmountPaid and Remaining are derived from them
+	Payments   []BillPayment `json:"payments,omitempty"`
+	AmountPaid Money         `json:"amountPaid"`
+	Remaining  Money         `json:"remaining"`
+	Category   string        `json:"category"`
+	Tags       []string      `json:"tags,omitempty"`
+	PolicyID   string        `json:"policyId,omitempty"` // insurance premium it reminds of
+
+	// Recurrence raises the next bill once this one is paid: monthly,
+	// quarterly, yearly, or custom every IntervalDays days
+	Recurrence   string `json:"recurrence,omitempty"`
+	IntervalDays int    `json:"intervalDays,omitempty"`
+	NextBillID   string `json:"nextBillId,omitempty"` // bill raised when this one was paid
 }
 
 // Income represents an income entry
 type Income struct {
-	ID          string  `json:"id"`
-	Amount      float64 `json:"amount"`
-	Currency    string  `json:"currency"`
-	Source      string  `json:"source"`
-	Description string  `json:"description"`
-	Date        string  `json:"date"`
-	IsRecurring bool    `json:"isRecurring"`
-	User        string  `json:"user"`
-	CreatedAt   string  `json:"createdAt"`
-	UpdatedAt   string  `json:"updatedAt"`
+	ID          string   `json:"id"`
+	Amount      Money    `json:"amount"`
+	Currency    string   `json:"currency"`
+	Source      string   `json:"source"`
+	SourceID    string   `json:"sourceId,omitempty"`  // managed source; Source mirrors its name
+	AccountID   string   `json:"accountId,omitempty"` // account it was paid into
+	Description string   `json:"description"`
+	Date        string   `json:"date"`
+	IsRecurring bool     `json:"isRecurring"`
+	User        string   `json:"user"`
+	MemberID    string   `json:"memberId,omitempty"` // profile of User; see Member
+	Tags        []string `json:"tags,omitempty"`
+	ClaimID     string   `json:"claimId,omitempty"` // set when the income reimburses a claim
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
 }
 
 var db *bolt.DB
@@ -99,52 +183,389 @@ const (
 	investmentsBucket = "investments"
 	billsBucket       = "bills"
 	incomeBucket      = "income"
+	jobsBucket        = "jobs"
+	queueBucket       = "queue"
+	deadLettersBucket = "dead_letters"
+
+	retentionRulesBucket = "retention_rules"
+	retentionRunsBucket  = "retention_runs"
+	archiveBucket        = "archive"
+	quarantineBucket     = "quarantine"
+	settingsBucket       = "settings"
+	alertsBucket         = "alerts"
+	incomeSourcesBucket  = "income_sources"
+	undoBucket           = "undo"
+
+	notificationPrefsBucket  = "notification_prefs"
+	notificationOutboxBucket = "notification_outbox"
+	userPrefsBucket          = "user_prefs"
+	customFieldsBucket       = "custom_fields"
+	merchantsBucket          = "merchants"
+	transfersBucket          = "transfers"
+	debtsBucket              = "debts"
+	allowancesBucket         = "allowances"
+	allowanceCreditsBucket   = "allowance_credits"
+	claimsBucket             = "claims"
+	plannedPurchasesBucket   = "planned_purchases"
+	subscriptionsBucket      = "subscriptions"
+	creditScoresBucket       = "credit_scores"
+	insurancePoliciesBucket  = "insurance_policies"
+	documentsBucket          = "documents"
+	commentsBucket           = "comments"
+	usersBucket              = "users"
+	importsBucket            = "imports"
+	accountsBucket           = "accounts"
+	exchangeRatesBucket      = "exchange_rates"
+	netWorthHistoryBucket    = "networth_history"
+	attachmentsBucket        = "attachments"
+	rulesBucket              = "rules"
+	metaBucket               = "meta"
+	webhooksBucket           = "webhooks"
+	webhookDeliveriesBucket  = "webhook_deliveries"
+	pendingBucket            = "pending_transactions"
+	bankConnectionsBucket    = "bank_connections"
+	membersBucket            = "members"
+)
+
+var (
+	errNotFound  = errors.New("not found")
+	errForbidden = errors.New("forbidden")
 )
 
 func main() {
-	var err error
-	dbPath := os.Getenv("DB_PATH")
-	if dbPath == "" {
-		dbPath = "./family_finance.db"
-	}
+	// A shutdown that cut requests off still closes the database and
+	// flushes traces on the way out, then exits with a failure
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	demo := flag.Bool("demo", false, "populate the database with sample data on startup")
+	flag.Parse()
 
-	db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	c, err := loadConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal("loading config", err)
+	}
+	setConfig(c)
+	if err := setupLogging(c); err != nil {
+		fatal("configuring logging", err)
+	}
+	shutdownTracing, err := setupTracing(c)
+	if err != nil {
+		fatal("configuring tracing", err)
+	}
+	if !c.AuthRequired {
+		logger("config").Warn("AUTH_REQUIRED is off: requests without a token see and change every member's records")
+	}
+	defer shutdownTracing(context.Background())
+
+	if err := openDB(config().DBPath); err != nil {
+		fatal("opening database", err)
 	}
 	defer db.Close()
+	logger("store").Info("database opened", "path", config().DBPath)
+	runStartupIntegrityCheck()
+	if config().Role != roleReplica {
+		if err := runStartupMigrations(); err != nil {
+			fatal("migrating data", err)
+		}
+	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		buckets := []string{expensesBucket, budgetsBucket, goalsBucket, investmentsBucket, billsBucket, incomeBucket}
-		for _, bucket := range buckets {
-			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
-			if err != nil {
-				return err
-			}
+	if config().DemoMode {
+		if err := prepareDemo(); err != nil {
+			fatal("preparing demo", err)
 		}
-		return nil
-	})
+	} else if *demo {
+		counts, err := seedDemoData()
+		if err != nil {
+			fatal("seeding demo data", err)
+		}
+		logger("store").Info("seeded demo data", "created", counts)
+	}
+
+	if err := buildSearchIndex(); err != nil {
+		fatal("building search index", err)
+	}
+
+	if config().AuditLogPath != "" {
+		audit, err = openAuditLog(config().AuditLogPath)
+		if err != nil {
+			fatal("opening audit log", err)
+		}
+	}
+
+	r := newRouter()
+
+	if config().Role == roleReplica {
+		go runReplica()
+		logger("replication").Info("running as read-only replica", "primary", config().PrimaryURL)
+	} else {
+		// Scheduled jobs
+		registerJob("retention", "0 3 * * *", runRetention)
+		registerJob("overdue-bills", "0 * * * *", checkOverdueBills)
+		registerJob("due-bills", "0 8 * * *", checkDueBills)
+		registerJob("archive-goals", "30 3 * * *", archiveCompletedGoals)
+		registerJob("notification-digest", "5 * * * *", flushNotifications)
+		registerJob("enrich-merchants", "0 4 * * *", enrichMerchants)
+		registerJob("debt-reminders", "15 9 * * *", checkDebts)
+		registerJob("allowances", "0 6 * * *", creditAllowances)
+		registerJob("return-reminders", "0 9 * * *", checkReturnWindows)
+		registerJob("subscription-renewals", "30 9 * * *", checkSubscriptionRenewals)
+		registerJob("anomalies", "20 * * * *", detectAnomalies)
+		registerJob("mail-ingest", "*/15 * * * *", pollMail)
+		registerJob("bank-sync", "0 */4 * * *", syncBanks)
+		registerJob("emergency-fund", "45 9 * * *", checkEmergencyFund)
+		registerJob("credit-score-reminders", "0 10 * * *", checkCreditScores)
+		registerJob("insurance-premiums", "15 6 * * *", syncPremiumBills)
+		registerJob("document-expiry", "15 10 * * *", checkDocumentExpiry)
+		registerJob("exchange-rates", "0 */6 * * *", refreshExchangeRates)
+		registerJob("investment-prices", "30 18 * * 1-5", refreshInvestmentPrices)
+		registerJob("networth-snapshot", "55 23 * * *", snapshotNetWorth)
+		registerJob("backup", "30 2 * * *", runBackup)
+		registerJob("collect-uploads", "45 4 * * *", collectUploads)
+		registerTaskHandler(alertTask, deliverAlert)
+		registerTaskHandler(webhookTask, deliverWebhook)
+
+		if err := startScheduler(); err != nil {
+			fatal("starting scheduler", err)
+		}
+		startQueue()
+	}
+	if config().AdminToken == "" {
+		logger("http").Warn("ADMIN_TOKEN is not set; the admin API is disabled")
+	}
+	startErrorReporter()
+	go watchReloadSignal()
+
+	addr := listenAddr(config())
+	ln, err := listen(addr)
+	if err != nil {
+		fatal("listening on "+addr, err)
+	}
+	srv := newServer(config(), r)
+	if config().TLSCertFile != "" {
+		if srv.TLSConfig, err = newTLSConfig(config()); err != nil {
+			fatal("loading TLS certificate", err)
+		}
+	}
+	if config().TLSRedirectAddr != "" {
+		redirect, err := serveRedirect(config())
+		if err != nil {
+			fatal("listening on "+config().TLSRedirectAddr, err)
+		}
+		defer redirect.Close()
+		logger("http").Info("redirecting plain HTTP to HTTPS", "addr", config().TLSRedirectAddr)
+	}
+	logger("http").Info("🚀 Family Finance API running", "addr", addr, "tls", srv.TLSConfig != nil)
+	grace := time.Duration(config().ShutdownTimeoutSeconds) * time.Second
+	switch err := serve(srv, ln, grace); {
+	case err == errDrainTimeout:
+		exitCode = 1
+	case err != nil:
+		fatal("server stopped", err)
+	}
+	// Returning runs the deferred db.Close, which waits for jobs' open
+	// transactions to commit
+	logger("http").Info("server stopped")
+}
+
+// storeBuckets are the top-level buckets every database has
+var storeBuckets = []string{
+	expensesBucket, budgetsBucket, goalsBucket, investmentsBucket, billsBucket, incomeBucket,
+	jobsBucket, queueBucket, deadLettersBucket,
+	retentionRulesBucket, retentionRunsBucket, archiveBucket, quarantineBucket,
+	settingsBucket, alertsBucket, incomeSourcesBucket, undoBucket,
+	notificationPrefsBucket, notificationOutboxBucket, userPrefsBucket, customFieldsBucket,
+	merchantsBucket, transfersBucket, debtsBucket, allowancesBucket, allowanceCreditsBucket,
+	claimsBucket, plannedPurchasesBucket, subscriptionsBucket, creditScoresBucket,
+	insurancePoliciesBucket, documentsBucket, commentsBucket, usersBucket,
+	importsBucket, accountsBucket, exchangeRatesBucket, netWorthHistoryBucket, attachmentsBucket,
+	rulesBucket, metaBucket, webhooksBucket, webhookDeliveriesBucket, pendingBucket,
+	bankConnectionsBucket, membersBucket,
+}
+
+// createBuckets creates any missing buckets
+func createBuckets(tx *bolt.Tx) error {
+	for _, bucket := range storeBuckets {
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openDB opens the bolt file and creates any missing buckets
+func openDB(path string) error {
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return db.Update(createBuckets)
+}
 
+// newRouter wires every API route and middleware
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(tracingMiddleware)
+	r.Use(requestIDMiddleware)
+	r.Use(requestLogMiddleware)
+	r.Use(errorReportMiddleware)
+	r.Use(rateLimitMiddleware)
 	r.Use(corsMiddleware)
+	r.Use(authMiddleware)
+	r.Use(replicaReadOnlyMiddleware)
+	r.Use(demoReadOnlyMiddleware)
+	r.Use(maintenanceMiddleware)
+	r.Use(auditMiddleware)
+	r.Use(eventsMiddleware)
+	r.Use(requestDeadlineMiddleware)
 
 	api := r.PathPrefix("/api").Subrouter()
 
+	// Change events for live updates
+	api.Handle("/ws", eventsSocket).Methods("GET")
+
+	// Sign-in
+	api.HandleFunc("/auth/register", register).Methods("POST", "OPTIONS")
+	api.HandleFunc("/auth/login", login).Methods("POST", "OPTIONS")
+
 	// Expenses
 	api.HandleFunc("/expenses", getExpenses).Methods("GET", "OPTIONS")
 	api.HandleFunc("/expenses", createExpense).Methods("POST", "OPTIONS")
+	api.HandleFunc("/expenses/count", getExpenseCount).Methods("GET", "OPTIONS")
+	api.HandleFunc("/expenses/summary", getExpenseSummary).Methods("GET", "OPTIONS")
+	api.HandleFunc("/expenses/breakdown", getExpenseBreakdown).Methods("GET", "OPTIONS")
+	api.HandleFunc("/expenses/tax-summary", getTaxSummary).Methods("GET", "OPTIONS")
+	api.HandleFunc("/expenses/duplicates", getDuplicateExpenses).Methods("GET", "OPTIONS")
 	api.HandleFunc("/expenses/{id}", getExpense).Methods("GET", "OPTIONS")
 	api.HandleFunc("/expenses/{id}", updateExpense).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/expenses/{id}", deleteExpense).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/expenses/{id}/merge", mergeExpense).Methods("POST", "OPTIONS")
+	api.HandleFunc("/expenses/{id}/comments", getExpenseComments).Methods("GET", "OPTIONS")
+	api.HandleFunc("/expenses/{id}/comments", createExpenseComment).Methods("POST", "OPTIONS")
+	api.HandleFunc("/expenses/{id}/comments/{commentId}", deleteExpenseComment).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/expenses/{id}/attachments", getExpenseAttachments).Methods("GET", "OPTIONS")
+	api.HandleFunc("/expenses/{id}/attachments", createExpenseAttachment).Methods("POST", "OPTIONS")
+	api.HandleFunc("/attachments/{id}", deleteAttachment).Methods("DELETE", "OPTIONS")
+
+	// Shared expense balances and settlements
+	api.HandleFunc("/balances", getBalances).Methods("GET", "OPTIONS")
+	api.HandleFunc("/balances/settle", settleUp).Methods("POST", "OPTIONS")
+	api.HandleFunc("/settlements", getSettlements).Methods("GET", "OPTIONS")
+	api.HandleFunc("/settlements/settle", settleSettlement).Methods("POST", "OPTIONS")
+	api.HandleFunc("/transfers", getTransfers).Methods("GET", "OPTIONS")
+	api.HandleFunc("/transfers/{id}", deleteTransfer).Methods("DELETE", "OPTIONS")
+
+	// Debts with people outside the household
+	api.HandleFunc("/debts", getDebts).Methods("GET", "OPTIONS")
+	api.HandleFunc("/debts", createDebt).Methods("POST", "OPTIONS")
+	api.HandleFunc("/debts/{id}", updateDebt).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/debts/{id}", deleteDebt).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/debts/{id}/repayments", createDebtRepayment).Methods("POST", "OPTIONS")
+	api.HandleFunc("/debts/{id}/repayments/{repaymentId}", deleteDebtRepayment).Methods("DELETE", "OPTIONS")
+
+	// Kids' allowances
+	api.HandleFunc("/allowances", getAllowances).Methods("GET", "OPTIONS")
+	api.HandleFunc("/allowances", createAllowance).Methods("POST", "OPTIONS")
+	api.HandleFunc("/allowances/{id}", updateAllowance).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/allowances/{id}", deleteAllowance).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/allowances/{id}/balance", getAllowanceBalance).Methods("GET", "OPTIONS")
+
+	// Wishlist and cash-flow projection
+	api.HandleFunc("/planned-purchases", getPlannedPurchases).Methods("GET", "OPTIONS")
+	api.HandleFunc("/planned-purchases", createPlannedPurchase).Methods("POST", "OPTIONS")
+	api.HandleFunc("/planned-purchases/{id}", updatePlannedPurchase).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/planned-purchases/{id}", deletePlannedPurchase).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/planned-purchases/{id}/buy", buyPlannedPurchase).Methods("POST", "OPTIONS")
+	api.HandleFunc("/cashflow", getCashFlow).Methods("GET", "OPTIONS")
+	api.HandleFunc("/forecast", getForecast).Methods("GET", "OPTIONS")
+
+	// Reports
+	api.HandleFunc("/reports/monthly", getMonthlyReport).Methods("GET", "OPTIONS")
+	api.HandleFunc("/reports/monthly.pdf", getMonthlyReportPDF).Methods("GET", "OPTIONS")
+	api.HandleFunc("/analytics/trends", getTrends).Methods("GET", "OPTIONS")
+
+	// Net worth
+	api.HandleFunc("/networth", getNetWorth).Methods("GET", "OPTIONS")
+	api.HandleFunc("/networth/history", getNetWorthHistory).Methods("GET", "OPTIONS")
+
+	// Emergency fund
+	api.HandleFunc("/emergency-fund", getEmergencyFund).Methods("GET", "OPTIONS")
+	api.HandleFunc("/emergency-fund", updateEmergencyFund).Methods("PUT", "OPTIONS")
+
+	// Credit scores
+	api.HandleFunc("/credit-scores", getCreditScores).Methods("GET", "OPTIONS")
+	api.HandleFunc("/credit-scores", createCreditScore).Methods("POST", "OPTIONS")
+	api.HandleFunc("/credit-scores/history", getCreditHistory).Methods("GET", "OPTIONS")
+	api.HandleFunc("/credit-scores/{id}", deleteCreditScore).Methods("DELETE", "OPTIONS")
+
+	// Insurance
+	api.HandleFunc("/insurance", getPolicies).Methods("GET", "OPTIONS")
+	api.HandleFunc("/insurance", createPolicy).Methods("POST", "OPTIONS")
+	api.HandleFunc("/insurance/{id}", updatePolicy).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/insurance/{id}", deletePolicy).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/tax/deductions", getTaxDeductions).Methods("GET", "OPTIONS")
+	api.HandleFunc("/donations/report", getDonationReport).Methods("GET", "OPTIONS")
+	api.HandleFunc("/donations/export", exportDonations).Methods("GET", "OPTIONS")
+
+	// Documents vault, for adults only
+	api.HandleFunc("/documents", requireAdult(getDocuments)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/documents", requireAdult(createDocument)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/documents/folders", requireAdult(getDocumentFolders)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/documents/{id}", requireAdult(updateDocument)).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/documents/{id}", requireAdult(deleteDocument)).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/documents/{id}/file", requireAdult(getDocumentFile)).Methods("GET", "OPTIONS")
+
+	// Subscriptions
+	api.HandleFunc("/subscriptions", getSubscriptions).Methods("GET", "OPTIONS")
+	api.HandleFunc("/subscriptions", createSubscription).Methods("POST", "OPTIONS")
+	api.HandleFunc("/subscriptions/report", getSubscriptionReport).Methods("GET", "OPTIONS")
+	api.HandleFunc("/subscriptions/{id}", updateSubscription).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/subscriptions/{id}", deleteSubscription).Methods("DELETE", "OPTIONS")
+
+	// Warranties and return windows of purchases
+	api.HandleFunc("/warranties", getWarranties).Methods("GET", "OPTIONS")
+	api.HandleFunc("/purchases/suggest", requireFeature("ocr", suggestPurchaseTerms)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/receipts/scan", requireFeature("ocr", scanReceipt)).Methods("POST", "OPTIONS")
+
+	// Employer reimbursement claims
+	api.HandleFunc("/claims", getClaims).Methods("GET", "OPTIONS")
+	api.HandleFunc("/claims", createClaim).Methods("POST", "OPTIONS")
+	api.HandleFunc("/claims/{id}", updateClaim).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/claims/{id}", deleteClaim).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/claims/{id}/status", setClaimStatus).Methods("POST", "OPTIONS")
+
+	// Household members
+	api.HandleFunc("/members", getMembers).Methods("GET", "OPTIONS")
+	api.HandleFunc("/members", requireAdult(createMember)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/members/{id}", getMember).Methods("GET", "OPTIONS")
+	api.HandleFunc("/members/{id}", requireAdult(updateMember)).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/members/{id}", requireAdult(deleteMember)).Methods("DELETE", "OPTIONS")
+
+	// Merchant directory
+	api.HandleFunc("/merchants", getMerchants).Methods("GET", "OPTIONS")
+	api.HandleFunc("/merchants", createMerchant).Methods("POST", "OPTIONS")
+	api.HandleFunc("/merchants/{key}", getMerchant).Methods("GET", "OPTIONS")
+	api.HandleFunc("/merchants/{key}", updateMerchant).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/merchants/{key}", deleteMerchant).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/merchants/{key}/spending", getMerchantSpending).Methods("GET", "OPTIONS")
+
+	// Custom expense fields
+	api.HandleFunc("/custom-fields", getCustomFields).Methods("GET", "OPTIONS")
+	api.HandleFunc("/custom-fields", createCustomField).Methods("POST", "OPTIONS")
+	api.HandleFunc("/custom-fields/{key}", updateCustomField).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/custom-fields/{key}", deleteCustomField).Methods("DELETE", "OPTIONS")
 
 	// Budgets
 	api.HandleFunc("/budgets", getBudgets).Methods("GET", "OPTIONS")
 	api.HandleFunc("/budgets", createBudget).Methods("POST", "OPTIONS")
 	api.HandleFunc("/budgets/{id}", updateBudget).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/budgets/{id}", deleteBudget).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/budgets/{id}/history", getBudgetHistory).Methods("GET", "OPTIONS")
 
 	// Goals
 	api.HandleFunc("/goals", getGoals).Methods("GET", "OPTIONS")
@@ -155,45 +576,185 @@ func main() {
 	// Investments
 	api.HandleFunc("/investments", getInvestments).Methods("GET", "OPTIONS")
 	api.HandleFunc("/investments", createInvestment).Methods("POST", "OPTIONS")
+	api.HandleFunc("/investments/refresh", refreshInvestmentsHandler).Methods("POST", "OPTIONS")
 	api.HandleFunc("/investments/{id}", updateInvestment).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/investments/{id}", deleteInvestment).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/investments/{id}/transactions", createInvestmentTransaction).Methods("POST", "OPTIONS")
+	api.HandleFunc("/investments/{id}/transactions/{txId}", deleteInvestmentTransaction).Methods("DELETE", "OPTIONS")
 
 	// Bills
 	api.HandleFunc("/bills", getBills).Methods("GET", "OPTIONS")
 	api.HandleFunc("/bills", createBill).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bills/{id}", getBill).Methods("GET", "OPTIONS")
 	api.HandleFunc("/bills/{id}", updateBill).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/bills/{id}", deleteBill).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/bills/{id}/payments", createBillPayment).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bills/{id}/pay", markBillPaid).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bills/{id}/payments/{paymentId}", deleteBillPayment).Methods("DELETE", "OPTIONS")
 
 	// Income
 	api.HandleFunc("/income", getIncomes).Methods("GET", "OPTIONS")
 	api.HandleFunc("/income", createIncome).Methods("POST", "OPTIONS")
+	api.HandleFunc("/income/count", getIncomeCount).Methods("GET", "OPTIONS")
+	api.HandleFunc("/income/summary", getIncomeSummary).Methods("GET", "OPTIONS")
+	api.HandleFunc("/income/upcoming", getUpcomingIncome).Methods("GET", "OPTIONS")
 	api.HandleFunc("/income/{id}", updateIncome).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/income/{id}", deleteIncome).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/income-sources", getIncomeSources).Methods("GET", "OPTIONS")
+	api.HandleFunc("/income-sources", createIncomeSource).Methods("POST", "OPTIONS")
+	api.HandleFunc("/income-sources/{id}", updateIncomeSource).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/income-sources/{id}", deleteIncomeSource).Methods("DELETE", "OPTIONS")
+
+	// Accounts
+	api.HandleFunc("/accounts", getAccounts).Methods("GET", "OPTIONS")
+	api.HandleFunc("/accounts", createAccount).Methods("POST", "OPTIONS")
+	api.HandleFunc("/accounts/{id}", updateAccount).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/accounts/{id}", deleteAccount).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/accounts/{id}/balance", getAccountBalance).Methods("GET", "OPTIONS")
 
 	// File Upload
 	api.HandleFunc("/upload", uploadFile).Methods("POST", "OPTIONS")
 
+	// Statement import
+	api.HandleFunc("/import/csv", importCSV).Methods("POST", "OPTIONS")
+	api.HandleFunc("/import/csv/{id}", getImport).Methods("GET", "OPTIONS")
+	api.HandleFunc("/import/csv/{id}/commit", commitImport).Methods("POST", "OPTIONS")
+
+	// Spreadsheet export
+	api.HandleFunc("/export", exportRecords).Methods("GET", "OPTIONS")
+
+	// Search
+	api.HandleFunc("/search", searchRecords).Methods("GET", "OPTIONS")
+	api.HandleFunc("/tags", getTags).Methods("GET", "OPTIONS")
+
+	// Categorization rules
+	api.HandleFunc("/rules", getRules).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rules", createRule).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rules/apply", applyRulesToExpenses).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rules/{id}", updateRule).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/rules/{id}", deleteRule).Methods("DELETE", "OPTIONS")
+
+	// API contract
+	api.HandleFunc("/openapi.json", openAPIHandler(r)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/docs", getAPIDocs).Methods("GET", "OPTIONS")
+
 	// Serve uploaded files
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads"))))
+	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadsDir))))
 
 	// Stats & Dashboard
 	api.HandleFunc("/stats", getStats).Methods("GET", "OPTIONS")
 	api.HandleFunc("/dashboard", getDashboardData).Methods("GET", "OPTIONS")
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	fmt.Printf("🚀 Family Finance API running on http://localhost:%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	// Undo a recent delete
+	api.HandleFunc("/undo/{actionId}", undoAction).Methods("POST", "OPTIONS")
+
+	// Notifications center
+	api.HandleFunc("/alerts", getAlerts).Methods("GET", "OPTIONS")
+
+	// Webhooks
+	api.HandleFunc("/webhooks", requireFeature("webhooks", getWebhooks)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/webhooks", requireFeature("webhooks", createWebhook)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/webhooks/{id}", requireFeature("webhooks", updateWebhook)).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/webhooks/{id}", requireFeature("webhooks", deleteWebhook)).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/webhooks/{id}/deliveries", requireFeature("webhooks", getWebhookDeliveries)).Methods("GET", "OPTIONS")
+	// Transactions waiting for review before they become expenses
+	api.HandleFunc("/pending", getPendingTransactions).Methods("GET", "OPTIONS")
+	api.HandleFunc("/pending/approve", approvePendingTransactions).Methods("POST", "OPTIONS")
+	api.HandleFunc("/pending/{id}/approve", approvePendingTransaction).Methods("POST", "OPTIONS")
+	api.HandleFunc("/pending/{id}/reject", rejectPendingTransaction).Methods("POST", "OPTIONS")
+	// The mail inbox these replaced
+	api.HandleFunc("/inbox", requireFeature("emailIngest", getInbox)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/inbox/{id}/accept", requireFeature("emailIngest", approvePendingTransaction)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/inbox/{id}", requireFeature("emailIngest", rejectPendingTransaction)).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/ingest/sms", requireFeature("smsIngest", ingestSMS)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bank/link-token", requireFeature("bankSync", createBankLinkToken)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bank/connections", requireFeature("bankSync", getBankConnections)).Methods("GET", "OPTIONS")
+	api.HandleFunc("/bank/connections", requireFeature("bankSync", createBankConnection)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bank/connections/{id}", requireFeature("bankSync", updateBankConnection)).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/bank/connections/{id}", requireFeature("bankSync", deleteBankConnection)).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/bank/connections/{id}/sync", requireFeature("bankSync", syncBankNow)).Methods("POST", "OPTIONS")
+	api.HandleFunc("/notifications", getNotifications).Methods("GET", "OPTIONS")
+	api.HandleFunc("/notifications/unread", getUnreadCount).Methods("GET", "OPTIONS")
+	api.HandleFunc("/notifications/read", markAllNotificationsRead).Methods("POST", "OPTIONS")
+	api.HandleFunc("/notifications/mutes", getNotificationMutes).Methods("GET", "OPTIONS")
+	api.HandleFunc("/notifications/mutes/{type}", setNotificationMute).Methods("PUT", "DELETE", "OPTIONS")
+	api.HandleFunc("/notifications/preferences", getAllNotificationPrefs).Methods("GET", "OPTIONS")
+	api.HandleFunc("/notifications/preferences/{user}", getNotificationPrefs).Methods("GET", "OPTIONS")
+	api.HandleFunc("/notifications/preferences/{user}", updateNotificationPrefs).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/notifications/preferences/{user}", deleteNotificationPrefs).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/notifications/{id}/read", markNotificationRead).Methods("POST", "OPTIONS")
+
+	// Session and per-user preferences
+	api.HandleFunc("/me", getMe).Methods("GET", "OPTIONS")
+	api.HandleFunc("/me/preferences", getMyPreferences).Methods("GET", "OPTIONS")
+	api.HandleFunc("/me/preferences", updateMyPreferences).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/me/mentions", getMyMentions).Methods("GET", "OPTIONS")
+
+	// Household settings
+	api.HandleFunc("/settings", getSettings).Methods("GET", "OPTIONS")
+	api.HandleFunc("/settings", updateSettings).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/exchange-rates", getExchangeRates).Methods("GET", "OPTIONS")
+	api.HandleFunc("/exchange-rates/refresh", refreshExchangeRatesHandler).Methods("POST", "OPTIONS")
+
+	// Feature flags
+	api.HandleFunc("/features", getFeatures).Methods("GET", "OPTIONS")
+
+	// Replication
+	api.HandleFunc("/replication/snapshot", getSnapshot).Methods("GET", "OPTIONS")
+	api.HandleFunc("/replication/status", getReplicationStatus).Methods("GET", "OPTIONS")
+
+	// Admin: privileged operations behind their own token
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuthMiddleware)
+	admin.HandleFunc("/seed", seedData).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/seed", wipeSeedData).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/jobs", getJobs).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/jobs/{name}/run", runJobNow).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/queue", getQueuedTasks).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/queue/dead", getDeadLetters).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/queue/dead/{id}/retry", retryDeadLetter).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/queue/dead/{id}", deleteDeadLetter).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/retention/rules", getRetentionRules).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/retention/rules", createRetentionRule).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/retention/rules/{id}", updateRetentionRule).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/retention/rules/{id}", deleteRetentionRule).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/retention/runs", getRetentionRuns).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/integrity", getIntegrityReport).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/integrity/repair", repairIntegrity).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/config", getEffectiveConfig).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/config/reload", reloadConfigHandler).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/dbstats", getDBStats).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/backups", getBackups).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/backup", backupNow).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/restore", restoreBackup).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/maintenance", getMaintenance).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/maintenance", setMaintenance).Methods("PUT", "OPTIONS")
+	// Whole-store export and import for migration; dumps carry password hashes
+	admin.HandleFunc("/export/full", exportFull).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/import/full", importFull).Methods("POST", "OPTIONS")
+
+	return r
 }
 
+// corsMiddleware answers cross-origin requests from the origins the CORS
+// policy allows; others get no CORS headers, so browsers block them
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c := config()
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && c.allowsOrigin(origin) {
+			if slices.Contains(c.CORSAllowedOrigins, "*") {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if c.CORSAllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.CORSAllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.CORSAllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Action-ID, X-Request-ID, X-Total-Count")
+		}
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -214,45 +775,85 @@ func respondError(w http.ResponseWriter, status int, message string) {
 
 // EXPENSES
 
+// getExpenses lists expenses matching the standard filters: ?from=&to=,
+// ?category=, ?user=, ?tag= and ?field.<key>= for custom fields.
+// ?sortBy=date|amount orders them, by date when only ?order= is given, with
+// ties broken by when they were recorded, and ?page=&limit= pages them.
 func getExpenses(w http.ResponseWriter, r *http.Request) {
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := parseListPage(r, []string{"date", "amount"})
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	var expenses []Expense
-	err := db.View(func(tx *bolt.Tx) error {
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(expensesBucket))
-		return b.ForEach(func(k, v []byte) error {
+		return forEach(r.Context(), b, func(k, v []byte) error {
 			var expense Expense
 			if err := json.Unmarshal(v, &expense); err != nil {
 				return err
 			}
-			expenses = append(expenses, expense)
+			if f.matches(expenseFields(expense)) {
+				expense.Version = recordVersion(v)
+				expenses = append(expenses, expense)
+			}
 			return nil
 		})
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if expenses == nil {
 		expenses = []Expense{}
 	}
-	respondJSON(w, http.StatusOK, expenses)
+	if page.SortBy != "" {
+		sort.SliceStable(expenses, func(i, j int) bool {
+			a, b := expenses[i], expenses[j]
+			if page.Desc {
+				a, b = b, a
+			}
+			if page.SortBy == "amount" && a.Amount != b.Amount {
+				return a.Amount < b.Amount
+			}
+			if a.Date != b.Date {
+				return a.Date < b.Date
+			}
+			return a.ID < b.ID
+		})
+	}
+	respondJSON(w, http.StatusOK, paginate(w, expenses, page))
 }
 
 func getExpense(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	var expense Expense
-	err := db.View(func(tx *bolt.Tx) error {
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(expensesBucket))
 		v := b.Get([]byte(id))
 		if v == nil {
 			return fmt.Errorf("expense not found")
 		}
-		return json.Unmarshal(v, &expense)
+		if err := json.Unmarshal(v, &expense); err != nil {
+			return err
+		}
+		if !expense.visibleTo(authUser(r)) {
+			return fmt.Errorf("expense not found")
+		}
+		expense.Version = recordVersion(v)
+		return nil
 	})
 	if err != nil {
-		respondError(w, http.StatusNotFound, err.Error())
+		respondStoreError(w, http.StatusNotFound, err)
 		return
 	}
+	setETag(w, expense.Version)
 	respondJSON(w, http.StatusOK, expense)
 }
 
@@ -262,28 +863,103 @@ func createExpense(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if user := authUser(r); user != "" {
+		expense.User, expense.MemberID = user, ""
+	}
+	member, err := resolveMember(r.Context(), &expense.MemberID, &expense.User)
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	if expense.Currency == "" {
+		expense.Currency = member.DefaultCurrency
+	}
+	settings := currentSettings()
+	loc := settings.location(expense.User)
+	date, err := normalizeDate(expense.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+	expense.Date = date
 	now := time.Now().Format(time.RFC3339)
 	if expense.ID == "" {
 		expense.ID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	// Default currency to INR if not set
-	if expense.Currency == "" {
-		expense.Currency = "INR"
+	expense.Currency, err = normalizeCurrency(expense.Currency, settings.BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expense.Amount = roundForCurrency(expense.Amount, expense.Currency)
+	expense.Tags = normalizeTags(expense.Tags)
+	expense.CustomFields, err = validateCustomFields(r.Context(), expense.CustomFields)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateItems(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateSplits(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateTax(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validatePurchase(&expense, loc); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateDonation(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 	expense.CreatedAt = now
 	expense.UpdatedAt = now
-	err := db.Update(func(tx *bolt.Tx) error {
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(expensesBucket))
+		if err := checkAccount(tx, expense.AccountID); err != nil {
+			return err
+		}
+		if err := applyRules(tx, &expense); err != nil {
+			return err
+		}
+		if err := applyMerchant(tx, &expense); err != nil {
+			return err
+		}
+		memberID, err := linkMember(tx, expense.MemberID, expense.User)
+		if err != nil {
+			return err
+		}
+		expense.MemberID = memberID
+		// The count is kept by the comments, not the client
+		expense.CommentCount = countComments(tx, expense.ID)
+		expense.Version = ""
 		data, err := json.Marshal(expense)
 		if err != nil {
 			return err
 		}
+		expense.Version = recordVersion(data)
+		expenseWritten(tx)
 		return b.Put([]byte(expense.ID), data)
 	})
+	if err == errUnknownAccount || err == errUnknownMember {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
+	publishWebhook("expense.created", expense)
+	setETag(w, expense.Version)
 	respondJSON(w, http.StatusCreated, expense)
 }
 
@@ -295,91 +971,194 @@ func updateExpense(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if user := authUser(r); user != "" {
+		expense.User, expense.MemberID = user, ""
+	}
+	member, err := resolveMember(r.Context(), &expense.MemberID, &expense.User)
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	if expense.Currency == "" {
+		expense.Currency = member.DefaultCurrency
+	}
+	settings := currentSettings()
+	loc := settings.location(expense.User)
+	date, err := normalizeDate(expense.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+	expense.Date = date
 	expense.ID = id
 	expense.UpdatedAt = time.Now().Format(time.RFC3339)
-	// Default currency to INR if not set
-	if expense.Currency == "" {
-		expense.Currency = "INR"
+	expense.Currency, err = normalizeCurrency(expense.Currency, settings.BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expense.Amount = roundForCurrency(expense.Amount, expense.Currency)
+	expense.Tags = normalizeTags(expense.Tags)
+	expense.CustomFields, err = validateCustomFields(r.Context(), expense.CustomFields)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateItems(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateSplits(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	if err := validateTax(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validatePurchase(&expense, loc); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateDonation(&expense); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expected := expectedVersions(r, expense.Version)
+	expense.Version = ""
+	var current Expense
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(expensesBucket))
 		existing := b.Get([]byte(id))
+		if existing == nil && expected != nil {
+			return errNotFound
+		}
 		if existing != nil {
 			var old Expense
 			json.Unmarshal(existing, &old)
+			if !old.visibleTo(authUser(r)) {
+				return errNotFound
+			}
+			if err := checkVersion(expected, existing); err != nil {
+				current = old
+				current.Version = recordVersion(existing)
+				return err
+			}
+			// A shared expense stays with the member who paid it
+			if old.User != "" && authUser(r) != "" {
+				expense.User = old.User
+			}
 			expense.CreatedAt = old.CreatedAt
+			// Claim links are kept by the claim; an expense on one stays
+			// reimbursable
+			expense.ClaimID, expense.Reimbursed = old.ClaimID, old.Reimbursed
+			if old.ClaimID != "" {
+				expense.Reimbursable = true
+			}
+		}
+		if err := checkAccount(tx, expense.AccountID); err != nil {
+			return err
+		}
+		if err := applyMerchant(tx, &expense); err != nil {
+			return err
+		}
+		memberID, err := linkMember(tx, expense.MemberID, expense.User)
+		if err != nil {
+			return err
 		}
+		expense.MemberID = memberID
+		// The count is kept by the comments, not the client
+		expense.CommentCount = countComments(tx, expense.ID)
 		data, err := json.Marshal(expense)
 		if err != nil {
 			return err
 		}
+		expense.Version = recordVersion(data)
+		expenseWritten(tx)
 		return b.Put([]byte(id), data)
 	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	}
+	if err == errVersionConflict {
+		setETag(w, current.Version)
+		respondJSON(w, http.StatusConflict, map[string]interface{}{"error": "expense " + err.Error(), "current": current})
+		return
+	}
+	if err == errUnknownAccount || err == errUnknownMember {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
+	publishWebhook("expense.updated", expense)
+	setETag(w, expense.Version)
 	respondJSON(w, http.StatusOK, expense)
 }
 
 func deleteExpense(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	err := db.Update(func(tx *bolt.Tx) error {
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
 		b := tx.Bucket([]byte(expensesBucket))
+		if !reachable(b, id, authUser(r), Expense.visibleTo) {
+			return errNotFound
+		}
+		j.track(expensesBucket, []byte(id))
+		if err := deleteComments(tx, j, id); err != nil {
+			return err
+		}
+		if err := deleteAttachments(tx, j, id); err != nil {
+			return err
+		}
 		return b.Delete([]byte(id))
 	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "expense not found")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Expense deleted"})
+	publishWebhook("expense.deleted", map[string]string{"id": id})
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Expense deleted"})
 }
 
 // BUDGETS
 
 func getBudgets(w http.ResponseWriter, r *http.Request) {
+	user := authUser(r)
 	var budgets []Budget
-	err := db.View(func(tx *bolt.Tx) error {
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
 		budgetBucket := tx.Bucket([]byte(budgetsBucket))
-		expenseBucket := tx.Bucket([]byte(expensesBucket))
 
 		// First collect all budgets
-		err := budgetBucket.ForEach(func(k, v []byte) error {
+		err := forEach(r.Context(), budgetBucket, func(k, v []byte) error {
 			var budget Budget
 			if err := json.Unmarshal(v, &budget); err != nil {
 				return err
 			}
-			budgets = append(budgets, budget)
+			if budget.visibleTo(user) {
+				budgets = append(budgets, budget)
+			}
 			return nil
 		})
 		if err != nil {
 			return err
 		}
 
-		// Calculate spent amount for each budget from expenses
-		for i := range budgets {
-			budgets[i].Spent = 0
-			expenseBucket.ForEach(func(k, v []byte) error {
-				var expense Expense
-				if err := json.Unmarshal(v, &expense); err != nil {
-					return nil // Skip malformed expenses
-				}
-				// Check if this expense is linked to this budget
-				for _, budgetID := range expense.BudgetIds {
-					if budgetID == budgets[i].ID {
-						budgets[i].Spent += expense.Amount
-						break
-					}
-				}
-				return nil
-			})
-		}
-
-		return nil
+		// Work out what each budget has spent in its current period
+		return budgetSpending(r.Context(), tx, loadSettings(tx), budgets, time.Now())
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if budgets == nil {
@@ -394,10 +1173,15 @@ func createBudget(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err := budget.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if budget.ID == "" {
 		budget.ID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	budget.Owner = authUser(r)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(budgetsBucket))
 		data, err := json.Marshal(budget)
 		if err != nil {
@@ -406,7 +1190,7 @@ func createBudget(w http.ResponseWriter, r *http.Request) {
 		return b.Put([]byte(budget.ID), data)
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusCreated, budget)
@@ -420,17 +1204,34 @@ func updateBudget(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err := budget.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	budget.ID = id
-	err := db.Update(func(tx *bolt.Tx) error {
+	budget.Owner = authUser(r)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(budgetsBucket))
+		if v := b.Get([]byte(id)); v != nil {
+			var old Budget
+			json.Unmarshal(v, &old)
+			if !old.visibleTo(budget.Owner) {
+				return errNotFound
+			}
+			budget.Owner = old.Owner
+		}
 		data, err := json.Marshal(budget)
 		if err != nil {
 			return err
 		}
 		return b.Put([]byte(id), data)
 	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "budget not found")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusOK, budget)
@@ -439,11 +1240,16 @@ func updateBudget(w http.ResponseWriter, r *http.Request) {
 func deleteBudget(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	err := db.Update(func(tx *bolt.Tx) error {
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
 		budgetBucket := tx.Bucket([]byte(budgetsBucket))
 		expenseBucket := tx.Bucket([]byte(expensesBucket))
 
+		if !reachable(budgetBucket, id, authUser(r), Budget.visibleTo) {
+			return errNotFound
+		}
+
 		// Delete the budget
+		j.track(budgetsBucket, []byte(id))
 		if err := budgetBucket.Delete([]byte(id)); err != nil {
 			return err
 		}
@@ -479,6 +1285,7 @@ func deleteBudget(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					return err
 				}
+				j.track(expensesBucket, k)
 				if err := expenseBucket.Put(k, data); err != nil {
 					return err
 				}
@@ -487,30 +1294,38 @@ func deleteBudget(w http.ResponseWriter, r *http.Request) {
 			return nil
 		})
 	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "budget not found")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Budget deleted"})
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Budget deleted"})
 }
 
 // GOALS
 
 func getGoals(w http.ResponseWriter, r *http.Request) {
+	archived := includeArchived(r)
+	user := authUser(r)
 	var goals []Goal
-	err := db.View(func(tx *bolt.Tx) error {
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(goalsBucket))
-		return b.ForEach(func(k, v []byte) error {
+		return forEach(r.Context(), b, func(k, v []byte) error {
 			var goal Goal
 			if err := json.Unmarshal(v, &goal); err != nil {
 				return err
 			}
-			goals = append(goals, goal)
+			if (goal.Status != goalArchived || archived) && goal.visibleTo(user) {
+				goals = append(goals, goal)
+			}
 			return nil
 		})
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if goals == nil {
@@ -525,22 +1340,21 @@ func createGoal(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if goal.ID == "" {
-		goal.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	date, err := normalizeDate(goal.Deadline, householdLocation())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(goalsBucket))
-		data, err := json.Marshal(goal)
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(goal.ID), data)
-	})
+	goal.Deadline = date
+	goal.Currency, err = normalizeCurrency(goal.Currency, currentSettings().BaseCurrency)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	respondJSON(w, http.StatusCreated, goal)
+	if goal.ID == "" {
+		goal.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	saveGoal(w, r, goal, http.StatusCreated)
 }
 
 func updateGoal(w http.ResponseWriter, r *http.Request) {
@@ -551,53 +1365,62 @@ func updateGoal(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	goal.ID = id
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(goalsBucket))
-		data, err := json.Marshal(goal)
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(id), data)
-	})
+	date, err := normalizeDate(goal.Deadline, householdLocation())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	respondJSON(w, http.StatusOK, goal)
+	goal.Deadline = date
+	goal.Currency, err = normalizeCurrency(goal.Currency, currentSettings().BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	goal.ID = id
+	saveGoal(w, r, goal, http.StatusOK)
 }
 
 func deleteGoal(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	err := db.Update(func(tx *bolt.Tx) error {
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
 		b := tx.Bucket([]byte(goalsBucket))
+		if !reachable(b, id, authUser(r), Goal.visibleTo) {
+			return errNotFound
+		}
+		j.track(goalsBucket, []byte(id))
 		return b.Delete([]byte(id))
 	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "goal not found")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Goal deleted"})
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Goal deleted"})
 }
 
 // INVESTMENTS
 
 func getInvestments(w http.ResponseWriter, r *http.Request) {
 	var investments []Investment
-	err := db.View(func(tx *bolt.Tx) error {
+	now := today(householdLocation())
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(investmentsBucket))
-		return b.ForEach(func(k, v []byte) error {
+		return forEach(r.Context(), b, func(k, v []byte) error {
 			var investment Investment
 			if err := json.Unmarshal(v, &investment); err != nil {
 				return err
 			}
+			investment.computeXIRR(now)
 			investments = append(investments, investment)
 			return nil
 		})
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if investments == nil {
@@ -612,10 +1435,21 @@ func createInvestment(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	currency, err := normalizeCurrency(investment.Currency, currentSettings().BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	investment.Currency = currency
+	if err := investment.validatePricing(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if investment.ID == "" {
 		investment.ID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	investment.Transactions, investment.XIRR = nil, nil
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(investmentsBucket))
 		data, err := json.Marshal(investment)
 		if err != nil {
@@ -624,7 +1458,7 @@ func createInvestment(w http.ResponseWriter, r *http.Request) {
 		return b.Put([]byte(investment.ID), data)
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusCreated, investment)
@@ -638,9 +1472,29 @@ func updateInvestment(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	currency, err := normalizeCurrency(investment.Currency, currentSettings().BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	investment.Currency = currency
+	if err := investment.validatePricing(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	investment.ID = id
-	err := db.Update(func(tx *bolt.Tx) error {
+	investment.XIRR = nil
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(investmentsBucket))
+		if v := b.Get([]byte(id)); v != nil {
+			// Transactions are recorded through their own endpoint
+			var old Investment
+			json.Unmarshal(v, &old)
+			investment.Transactions = old.Transactions
+			if err := investment.applyTransactions(); err != nil {
+				return err
+			}
+		}
 		data, err := json.Marshal(investment)
 		if err != nil {
 			return err
@@ -648,43 +1502,62 @@ func updateInvestment(w http.ResponseWriter, r *http.Request) {
 		return b.Put([]byte(id), data)
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
+	investment.computeXIRR(today(householdLocation()))
 	respondJSON(w, http.StatusOK, investment)
 }
 
 func deleteInvestment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	err := db.Update(func(tx *bolt.Tx) error {
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
 		b := tx.Bucket([]byte(investmentsBucket))
+		j.track(investmentsBucket, []byte(id))
 		return b.Delete([]byte(id))
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Investment deleted"})
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Investment deleted"})
 }
 
 // BILLS
 
+// getBills lists bills matching the standard filters on their due date,
+// category and tag
 func getBills(w http.ResponseWriter, r *http.Request) {
+	// ?status=overdue lists only bills with that computed status
+	status := r.URL.Query().Get("status")
+	if status != "" && !validBillStatus(status) {
+		respondError(w, http.StatusBadRequest, "status must be upcoming, due, overdue or paid")
+		return
+	}
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := billToday()
 	var bills []BillReminder
-	err := db.View(func(tx *bolt.Tx) error {
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(billsBucket))
-		return b.ForEach(func(k, v []byte) error {
+		return forEach(r.Context(), b, func(k, v []byte) error {
 			var bill BillReminder
 			if err := json.Unmarshal(v, &bill); err != nil {
 				return err
 			}
-			bills = append(bills, bill)
+			bill.refresh(now)
+			if (status == "" || bill.Status == status) && f.matches(billFields(bill)) {
+				bills = append(bills, bill)
+			}
 			return nil
 		})
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if bills == nil {
@@ -699,11 +1572,38 @@ func createBill(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	date, err := normalizeDate(bill.DueDate, householdLocation())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bill.DueDate = date
+	bill.Tags = normalizeTags(bill.Tags)
+	// Clients that only know the old status field mark bills paid with it
+	if bill.Status == billPaid {
+		bill.IsPaid = true
+	}
+	if err := bill.validateRecurrence(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Payments are recorded through /api/bills/{id}/payments
+	bill.Payments = nil
+	bill.NextBillID = ""
+	bill.refresh(billToday())
+	bill.Currency, err = normalizeCurrency(bill.Currency, currentSettings().BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if bill.ID == "" {
 		bill.ID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(billsBucket))
+		if err := raiseNextBill(tx, &bill); err != nil {
+			return err
+		}
 		data, err := json.Marshal(bill)
 		if err != nil {
 			return err
@@ -711,7 +1611,7 @@ func createBill(w http.ResponseWriter, r *http.Request) {
 		return b.Put([]byte(bill.ID), data)
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusCreated, bill)
@@ -725,9 +1625,43 @@ func updateBill(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	date, err := normalizeDate(bill.DueDate, householdLocation())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bill.DueDate = date
+	bill.Tags = normalizeTags(bill.Tags)
+	// Clients that only know the old status field mark bills paid with it
+	if bill.Status == billPaid {
+		bill.IsPaid = true
+	}
+	bill.Currency, err = normalizeCurrency(bill.Currency, currentSettings().BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := bill.validateRecurrence(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	bill.ID = id
-	err := db.Update(func(tx *bolt.Tx) error {
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(billsBucket))
+		// Payments are recorded through /api/bills/{id}/payments
+		bill.Payments = nil
+		bill.NextBillID = ""
+		if existing := b.Get([]byte(id)); existing != nil {
+			var old BillReminder
+			json.Unmarshal(existing, &old)
+			bill.Payments = old.Payments
+			bill.PolicyID = old.PolicyID
+			bill.NextBillID = old.NextBillID
+		}
+		bill.refresh(billToday())
+		if err := raiseNextBill(tx, &bill); err != nil {
+			return err
+		}
 		data, err := json.Marshal(bill)
 		if err != nil {
 			return err
@@ -735,7 +1669,7 @@ func updateBill(w http.ResponseWriter, r *http.Request) {
 		return b.Put([]byte(id), data)
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusOK, bill)
@@ -744,15 +1678,16 @@ func updateBill(w http.ResponseWriter, r *http.Request) {
 func deleteBill(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	err := db.Update(func(tx *bolt.Tx) error {
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
 		b := tx.Bucket([]byte(billsBucket))
+		j.track(billsBucket, []byte(id))
 		return b.Delete([]byte(id))
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Bill deleted"})
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Bill deleted"})
 }
 
 // STATS
@@ -765,58 +1700,110 @@ func getStats(w http.ResponseWriter, r *http.Request) {
 		"savingsRate":      0.0,
 	}
 
-	var totalSpent float64
+	var totalSpent Money
 	var transactionCount int
 
-	db.View(func(tx *bolt.Tx) error {
+	// ?period=budget or ?period=fiscalYear limits the totals to the running
+	// budget cycle or financial year
+	settings := currentSettings()
+	period, err := resolvePeriod(r.URL.Query().Get("period"), settings, time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if period.Start != "" {
+		stats["period"] = period
+	}
+	// Totals are in the base currency, with a breakdown by the currency
+	// amounts were recorded in
+	conv := newConverter(settings, settings.BaseCurrency)
+	byCurrency := newCurrencyTotals(settings)
+	user := authUser(r)
+
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
 		expBucket := tx.Bucket([]byte(expensesBucket))
-		expBucket.ForEach(func(k, v []byte) error {
+		err := forEach(r.Context(), expBucket, func(k, v []byte) error {
 			var expense Expense
 			json.Unmarshal(v, &expense)
-			totalSpent += expense.Amount
+			if !period.contains(expense.Date) || !expense.personal() || !expense.visibleTo(user) {
+				return nil
+			}
+			conv.add(&totalSpent, expense.Amount, expense.Currency)
+			byCurrency.spend(expense.Amount, expense.Currency)
 			transactionCount++
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
-		var totalBudget float64
+		var totalBudget Money
 		budBucket := tx.Bucket([]byte(budgetsBucket))
-		budBucket.ForEach(func(k, v []byte) error {
+		err = forEach(r.Context(), budBucket, func(k, v []byte) error {
 			var budget Budget
 			json.Unmarshal(v, &budget)
-			totalBudget += budget.Limit
+			if !budget.visibleTo(user) {
+				return nil
+			}
+			if period.Start != "" {
+				cycle, err := budgetPeriod(budget.Month, settings.BudgetStartDay)
+				if err != nil || !period.contains(cycle.Start) {
+					return nil
+				}
+			}
+			conv.add(&totalBudget, budget.Limit, budget.Currency)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
+		stats["currency"] = settings.BaseCurrency
+		stats["unconvertedCurrencies"] = conv.unconverted()
+		stats["byCurrency"] = byCurrency.list()
 		stats["totalSpent"] = totalSpent
 		stats["monthlyBudget"] = totalBudget
 		stats["transactionCount"] = transactionCount
 		if totalBudget > 0 {
-			stats["savingsRate"] = ((totalBudget - totalSpent) / totalBudget) * 100
+			stats["savingsRate"] = float64(totalBudget-totalSpent) / float64(totalBudget) * 100
 		}
 
 		return nil
 	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	respondJSON(w, http.StatusOK, stats)
 }
 
 // INCOME
 
+// getIncomes lists income matching the standard filters, the source
+// standing in for the category
 func getIncomes(w http.ResponseWriter, r *http.Request) {
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	var incomes []Income
-	err := db.View(func(tx *bolt.Tx) error {
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(incomeBucket))
-		return b.ForEach(func(k, v []byte) error {
+		return forEach(r.Context(), b, func(k, v []byte) error {
 			var income Income
 			if err := json.Unmarshal(v, &income); err != nil {
 				return err
 			}
-			incomes = append(incomes, income)
+			if f.matches(incomeFields(income)) {
+				incomes = append(incomes, income)
+			}
 			return nil
 		})
 	})
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if incomes == nil {
@@ -831,22 +1818,66 @@ func createIncome(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if user := authUser(r); user != "" {
+		income.User, income.MemberID = user, ""
+	}
+	member, err := resolveMember(r.Context(), &income.MemberID, &income.User)
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	if income.Currency == "" {
+		income.Currency = member.DefaultCurrency
+	}
+	settings := currentSettings()
+	loc := settings.location(income.User)
+	date, err := normalizeDate(income.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+	income.Date = date
 	now := time.Now().Format(time.RFC3339)
 	if income.ID == "" {
 		income.ID = fmt.Sprintf("%d", time.Now().UnixNano())
 	}
+	income.Currency, err = normalizeCurrency(income.Currency, settings.BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	income.Amount = roundForCurrency(income.Amount, income.Currency)
+	income.Tags = normalizeTags(income.Tags)
 	income.CreatedAt = now
 	income.UpdatedAt = now
-	err := db.Update(func(tx *bolt.Tx) error {
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(incomeBucket))
+		if err := linkIncomeSource(tx, &income); err != nil {
+			return err
+		}
+		if err := checkAccount(tx, income.AccountID); err != nil {
+			return err
+		}
+		memberID, err := linkMember(tx, income.MemberID, income.User)
+		if err != nil {
+			return err
+		}
+		income.MemberID = memberID
 		data, err := json.Marshal(income)
 		if err != nil {
 			return err
 		}
 		return b.Put([]byte(income.ID), data)
 	})
+	if err == errUnknownIncomeSource || err == errUnknownAccount || err == errUnknownMember {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusCreated, income)
@@ -860,24 +1891,76 @@ func updateIncome(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if user := authUser(r); user != "" {
+		income.User, income.MemberID = user, ""
+	}
+	member, err := resolveMember(r.Context(), &income.MemberID, &income.User)
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	if income.Currency == "" {
+		income.Currency = member.DefaultCurrency
+	}
+	settings := currentSettings()
+	loc := settings.location(income.User)
+	date, err := normalizeDate(income.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+	income.Date = date
 	income.ID = id
 	income.UpdatedAt = time.Now().Format(time.RFC3339)
-	err := db.Update(func(tx *bolt.Tx) error {
+	income.Currency, err = normalizeCurrency(income.Currency, settings.BaseCurrency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	income.Amount = roundForCurrency(income.Amount, income.Currency)
+	income.Tags = normalizeTags(income.Tags)
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(incomeBucket))
+		if err := linkIncomeSource(tx, &income); err != nil {
+			return err
+		}
+		if err := checkAccount(tx, income.AccountID); err != nil {
+			return err
+		}
 		existing := b.Get([]byte(id))
 		if existing != nil {
 			var old Income
 			json.Unmarshal(existing, &old)
+			if !old.visibleTo(authUser(r)) {
+				return errNotFound
+			}
 			income.CreatedAt = old.CreatedAt
+			income.ClaimID = old.ClaimID
 		}
+		memberID, err := linkMember(tx, income.MemberID, income.User)
+		if err != nil {
+			return err
+		}
+		income.MemberID = memberID
 		data, err := json.Marshal(income)
 		if err != nil {
 			return err
 		}
 		return b.Put([]byte(id), data)
 	})
+	if err == errUnknownIncomeSource || err == errUnknownAccount || err == errUnknownMember {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "income not found")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
 	respondJSON(w, http.StatusOK, income)
@@ -886,34 +1969,48 @@ func updateIncome(w http.ResponseWriter, r *http.Request) {
 func deleteIncome(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	err := db.Update(func(tx *bolt.Tx) error {
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
 		b := tx.Bucket([]byte(incomeBucket))
+		if !reachable(b, id, authUser(r), Income.visibleTo) {
+			return errNotFound
+		}
+		j.track(incomeBucket, []byte(id))
 		return b.Delete([]byte(id))
 	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "income not found")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondStoreError(w, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"message": "Income deleted"})
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Income deleted"})
 }
 
 // FILE UPLOAD
 
-func uploadFile(w http.ResponseWriter, r *http.Request) {
+// uploadsDir holds attachments, served publicly under /uploads/
+const uploadsDir = "./uploads"
+
+var errNoUpload = errors.New("no file uploaded")
+
+// saveUpload stores the request's multipart "file" in dir under a unique
+// name, keeping its extension. It returns the stored name and the upload's
+// header.
+func saveUpload(r *http.Request, dir string) (string, *multipart.FileHeader, error) {
 	// Max 10MB file
 	r.ParseMultipartForm(10 << 20)
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Error retrieving file")
-		return
+		return "", nil, errNoUpload
 	}
 	defer file.Close()
 
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll("./uploads", os.ModePerm); err != nil {
-		respondError(w, http.StatusInternalServerError, "Error creating uploads directory")
-		return
+	// Create the directory if it doesn't exist
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", nil, fmt.Errorf("creating %s: %w", dir, err)
 	}
 
 	// Generate unique filename
@@ -927,29 +2024,34 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-	filepath := fmt.Sprintf("./uploads/%s", filename)
 
 	// Create the file
-	dst, err := os.Create(filepath)
+	dst, err := os.Create(filepath.Join(dir, filename))
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Error creating file")
-		return
+		return "", nil, err
 	}
 	defer dst.Close()
 
 	// Copy the uploaded file to the destination
-	_, err = dst.ReadFrom(file)
+	if _, err := dst.ReadFrom(file); err != nil {
+		return "", nil, err
+	}
+	return filename, handler, nil
+}
+
+func uploadFile(w http.ResponseWriter, r *http.Request) {
+	filename, _, err := saveUpload(r, uploadsDir)
+	if err == errNoUpload {
+		respondError(w, http.StatusBadRequest, "Error retrieving file")
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Error saving file")
 		return
 	}
 
 	// Return the URL
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	fileURL := fmt.Sprintf("http://localhost:%s/uploads/%s", port, filename)
+	fileURL := publicURL(r, "/uploads/"+filename)
 
 	respondJSON(w, http.StatusOK, map[string]string{
 		"url":      fileURL,
@@ -959,7 +2061,33 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 
 // DASHBOARD
 
+// recentTransactions returns the n latest expenses by transaction date,
+// breaking ties on the same day by when they were recorded.
+func recentTransactions(expenses []Expense, n int) []Expense {
+	sorted := append([]Expense(nil), expenses...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Date != sorted[j].Date {
+			return sorted[i].Date > sorted[j].Date
+		}
+		return sorted[i].CreatedAt > sorted[j].CreatedAt
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
 func getDashboardData(w http.ResponseWriter, r *http.Request) {
+	recentCount := 5
+	if v := r.URL.Query().Get("recent"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			respondError(w, http.StatusBadRequest, "recent must be between 0 and 100")
+			return
+		}
+		recentCount = n
+	}
+
 	dashboard := map[string]interface{}{}
 
 	var expenses []Expense
@@ -968,69 +2096,138 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 	var bills []BillReminder
 	var incomes []Income
 
-	var totalSpent float64
-	var totalIncome float64
-	var totalBudget float64
-	categorySpending := make(map[string]float64)
+	var totalSpent Money
+	var totalIncome Money
+	var totalBudget Money
+	var invested, lent, borrowed Money
+	var creditScores []map[string]interface{}
+	categorySpending := make(map[string]Money)
 	categoryColors := make(map[string]string)
 
-	db.View(func(tx *bolt.Tx) error {
+	// Totals are in the base currency, with a breakdown by the currency
+	// amounts were recorded in
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	byCurrency := newCurrencyTotals(settings)
+
+	billsToday := today(settings.location(""))
+	archived := includeArchived(r)
+	user := authUser(r)
+
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
 		// Get expenses
 		expBucket := tx.Bucket([]byte(expensesBucket))
-		expBucket.ForEach(func(k, v []byte) error {
+		err := forEach(r.Context(), expBucket, func(k, v []byte) error {
 			var expense Expense
 			json.Unmarshal(v, &expense)
+			if !expense.visibleTo(user) {
+				return nil
+			}
 			expenses = append(expenses, expense)
-			totalSpent += expense.Amount
-			categorySpending[expense.Category] += expense.Amount
+			if !expense.personal() {
+				return nil
+			}
+			byCurrency.spend(expense.Amount, expense.Currency)
+			if conv.add(&totalSpent, expense.Amount, expense.Currency) {
+				for _, part := range expense.categoryParts() {
+					spent := categorySpending[part.Category]
+					conv.add(&spent, part.Amount, expense.Currency)
+					categorySpending[part.Category] = spent
+				}
+			}
 			if expense.CategoryColor != "" {
 				categoryColors[expense.Category] = expense.CategoryColor
 			}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
 		// Get budgets
 		budBucket := tx.Bucket([]byte(budgetsBucket))
-		budBucket.ForEach(func(k, v []byte) error {
+		err = forEach(r.Context(), budBucket, func(k, v []byte) error {
 			var budget Budget
 			json.Unmarshal(v, &budget)
+			if !budget.visibleTo(user) {
+				return nil
+			}
 			budgets = append(budgets, budget)
-			totalBudget += budget.Limit
+			conv.add(&totalBudget, budget.Limit, budget.Currency)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+		if err := budgetSpending(r.Context(), tx, settings, budgets, time.Now()); err != nil {
+			return err
+		}
 
 		// Get goals
 		goalBucket := tx.Bucket([]byte(goalsBucket))
-		goalBucket.ForEach(func(k, v []byte) error {
+		err = forEach(r.Context(), goalBucket, func(k, v []byte) error {
 			var goal Goal
 			json.Unmarshal(v, &goal)
-			goals = append(goals, goal)
+			if (goal.Status != goalArchived || archived) && goal.visibleTo(user) {
+				goals = append(goals, goal)
+			}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
 		// Get bills
 		billBucket := tx.Bucket([]byte(billsBucket))
-		billBucket.ForEach(func(k, v []byte) error {
+		err = forEach(r.Context(), billBucket, func(k, v []byte) error {
 			var bill BillReminder
 			json.Unmarshal(v, &bill)
+			bill.refresh(billsToday)
 			bills = append(bills, bill)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
 		// Get income
 		incBucket := tx.Bucket([]byte(incomeBucket))
-		incBucket.ForEach(func(k, v []byte) error {
+		err = forEach(r.Context(), incBucket, func(k, v []byte) error {
 			var income Income
 			json.Unmarshal(v, &income)
+			if !income.visibleTo(user) {
+				return nil
+			}
 			incomes = append(incomes, income)
-			totalIncome += income.Amount
+			if income.personal() {
+				conv.add(&totalIncome, income.Amount, income.Currency)
+				byCurrency.earn(income.Amount, income.Currency)
+			}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
-		return nil
+		// Net worth: investments plus what outsiders owe us, less what we owe
+		err = forEach(r.Context(), tx.Bucket([]byte(investmentsBucket)), func(k, v []byte) error {
+			var inv Investment
+			if json.Unmarshal(v, &inv) == nil {
+				conv.add(&invested, inv.Value, inv.Currency)
+			}
+			return nil
+		})
+		lent, borrowed = debtPosition(tx, conv)
+		creditScores = creditSparklines(tx, billsToday)
+		return err
 	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	// Build category data for pie chart
+	lang := requestLanguage(r)
 	var categoryData []map[string]interface{}
 	defaultColors := []string{"#22c55e", "#ef4444", "#f59e0b", "#3b82f6", "#8b5cf6", "#ec4899", "#14b8a6", "#6366f1"}
 	colorIdx := 0
@@ -1042,30 +2239,34 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 		}
 		categoryData = append(categoryData, map[string]interface{}{
 			"name":  cat,
+			"label": categoryLabel(lang, cat),
 			"value": amount,
 			"color": color,
 		})
 	}
 
-	// Get recent transactions (last 5)
-	recentExpenses := expenses
-	if len(recentExpenses) > 5 {
-		recentExpenses = recentExpenses[:5]
-	}
+	// Get recent transactions, newest first
+	recentExpenses := recentTransactions(expenses, recentCount)
 
 	// Calculate savings rate
 	savingsRate := 0.0
 	if totalIncome > 0 {
-		savingsRate = ((totalIncome - totalSpent) / totalIncome) * 100
+		savingsRate = float64(totalIncome-totalSpent) / float64(totalIncome) * 100
 	}
 
 	dashboard["stats"] = map[string]interface{}{
-		"totalSpent":       totalSpent,
-		"totalIncome":      totalIncome,
-		"monthlyBudget":    totalBudget,
-		"transactionCount": len(expenses),
-		"savingsRate":      savingsRate,
-		"netBalance":       totalIncome - totalSpent,
+		"currency":              settings.BaseCurrency,
+		"unconvertedCurrencies": conv.unconverted(),
+		"byCurrency":            byCurrency.list(),
+		"totalSpent":            totalSpent,
+		"totalIncome":           totalIncome,
+		"monthlyBudget":         totalBudget,
+		"transactionCount":      len(expenses),
+		"savingsRate":           savingsRate,
+		"netBalance":            totalIncome - totalSpent,
+		"debtsLent":             lent,
+		"debtsBorrowed":         borrowed,
+		"netWorth":              invested + lent - borrowed,
 	}
 	dashboard["expenses"] = expenses
 	dashboard["recentTransactions"] = recentExpenses
@@ -1074,6 +2275,7 @@ func getDashboardData(w http.ResponseWriter, r *http.Request) {
 	dashboard["bills"] = bills
 	dashboard["incomes"] = incomes
 	dashboard["categoryData"] = categoryData
+	dashboard["creditScores"] = creditScores
 
 	respondJSON(w, http.StatusOK, dashboard)
 }
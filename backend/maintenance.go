@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceState describes the read-only maintenance switch
+type MaintenanceState struct {
+	Enabled           bool   `json:"enabled"`
+	Reason            string `json:"reason,omitempty"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds"`
+	Since             string `json:"since,omitempty"`
+	By                string `json:"by,omitempty"`
+}
+
+// maintenance is held in memory only; a restart always comes back writable
+var maintenance = struct {
+	mu    sync.Mutex
+	state MaintenanceState
+}{state: MaintenanceState{RetryAfterSeconds: 60}}
+
+func maintenanceState() MaintenanceState {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	return maintenance.state
+}
+
+func inMaintenance() bool {
+	return maintenanceState().Enabled
+}
+
+// maintenanceMiddleware rejects writes while maintenance mode is on. Admin
+// routes stay writable so the switch can be turned off again.
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := maintenanceState()
+		if state.Enabled && isWriteMethod(r.Method) && !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfterSeconds))
+			msg := "the API is in read-only maintenance mode"
+			if state.Reason != "" {
+				msg += ": " + state.Reason
+			}
+			respondError(w, http.StatusServiceUnavailable, msg)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ADMIN: MAINTENANCE
+
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, maintenanceState())
+}
+
+func setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.RetryAfterSeconds < 0 {
+		respondError(w, http.StatusBadRequest, "retryAfterSeconds must not be negative")
+		return
+	}
+	if req.RetryAfterSeconds == 0 {
+		req.RetryAfterSeconds = 60
+	}
+
+	maintenance.mu.Lock()
+	state := MaintenanceState{RetryAfterSeconds: req.RetryAfterSeconds}
+	if req.Enabled {
+		state.Enabled = true
+		state.Reason = req.Reason
+		state.Since = maintenance.state.Since
+		state.By = maintenance.state.By
+		if !maintenance.state.Enabled {
+			state.Since = time.Now().Format(time.RFC3339)
+			state.By = requestActor(r)
+		}
+	}
+	maintenance.state = state
+	maintenance.mu.Unlock()
+
+	logger("http").Warn("maintenance mode changed", "enabled", state.Enabled, "reason", state.Reason, "actor", requestActor(r))
+	respondJSON(w, http.StatusOK, state)
+}
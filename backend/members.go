@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	errUnknownMember = errors.New("memberId does not match a member")
+	errMemberExists  = errors.New("a member with that name already exists")
+	errMemberInUse   = errors.New("member still has expenses, income or an account; reassign them first")
+)
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Member is a person in the household. Records name their member by Name,
+// the name a member's account signs in with, and link the profile by
+// MemberID, so the display details can change without touching them.
+type Member struct {
+	ID   string `json:"id"`
+	Name string `json:"name"` // as recorded on expenses and income; fixed once created
+	// DisplayName is how the member is shown, defaulting to Name
+	DisplayName string `json:"displayName"`
+	Avatar      string `json:"avatar,omitempty"` // image URL or emoji
+	Color       string `json:"color,omitempty"`  // #rrggbb
+	Role        string `json:"role"`             // adult, child or viewer
+	// DefaultCurrency is used for the member's expenses and income recorded
+	// without a currency
+	DefaultCurrency string `json:"defaultCurrency,omitempty"`
+	CreatedAt       string `json:"createdAt"`
+	UpdatedAt       string `json:"updatedAt"`
+}
+
+func (m *Member) validate() error {
+	m.Name = strings.TrimSpace(m.Name)
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	m.DisplayName = strings.TrimSpace(m.DisplayName)
+	if m.DisplayName == "" {
+		m.DisplayName = m.Name
+	}
+	m.Avatar = strings.TrimSpace(m.Avatar)
+	if m.Color != "" && !colorPattern.MatchString(m.Color) {
+		return fmt.Errorf("color must look like #1e88e5")
+	}
+	if m.Role == "" {
+		m.Role = roleAdult
+	}
+	if err := oneOf("role", m.Role, memberRoles); err != nil {
+		return err
+	}
+	if m.DefaultCurrency != "" {
+		c, err := normalizeCurrency(m.DefaultCurrency, "")
+		if err != nil {
+			return err
+		}
+		m.DefaultCurrency = c
+	}
+	return nil
+}
+
+// loadMembers reads every member, in display name order. Roles are the
+// household settings', which may have been changed there.
+func loadMembers(tx *bolt.Tx) []Member {
+	roles := loadSettings(tx).MemberRoles
+	var members []Member
+	tx.Bucket([]byte(membersBucket)).ForEach(func(k, v []byte) error {
+		var m Member
+		if json.Unmarshal(v, &m) == nil {
+			if role, ok := roles[m.Name]; ok {
+				m.Role = role
+			}
+			members = append(members, m)
+		}
+		return nil
+	})
+	sort.Slice(members, func(i, j int) bool {
+		if a, b := strings.ToLower(members[i].DisplayName), strings.ToLower(members[j].DisplayName); a != b {
+			return a < b
+		}
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// memberNamed finds the member records call name
+func memberNamed(tx *bolt.Tx, name string) (Member, bool) {
+	if name == "" {
+		return Member{}, false
+	}
+	for _, m := range loadMembers(tx) {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// memberIDFor is the ID of the member records call name, empty for names
+// with no profile
+func memberIDFor(tx *bolt.Tx, name string) string {
+	m, _ := memberNamed(tx, name)
+	return m.ID
+}
+
+// linkMember is the member ID to store on a record of user as it is
+// written. A memberID settled by resolveMember must still name that user's
+// member, or the profile went away meanwhile and the write is refused.
+func linkMember(tx *bolt.Tx, memberID, user string) (string, error) {
+	if memberID == "" {
+		return memberIDFor(tx, user), nil
+	}
+	var m Member
+	v := tx.Bucket([]byte(membersBucket)).Get([]byte(memberID))
+	if v == nil || json.Unmarshal(v, &m) != nil || m.Name != user {
+		return "", errUnknownMember
+	}
+	return m.ID, nil
+}
+
+// resolveMember settles who a record being written belongs to. A memberID
+// must name a member, whose name then becomes the record's user; otherwise
+// the profile is looked up by user. Names without a profile are kept as
+// they are and return no member.
+func resolveMember(ctx context.Context, memberID, user *string) (Member, error) {
+	var m Member
+	err := viewContext(ctx, func(tx *bolt.Tx) error {
+		if *memberID == "" {
+			m, _ = memberNamed(tx, *user)
+			return nil
+		}
+		v := tx.Bucket([]byte(membersBucket)).Get([]byte(*memberID))
+		if v == nil {
+			return errUnknownMember
+		}
+		return json.Unmarshal(v, &m)
+	})
+	if err != nil {
+		return m, err
+	}
+	*memberID = m.ID
+	if m.ID != "" {
+		*user = m.Name
+	}
+	return m, nil
+}
+
+// putMember stores a member and keeps the household's role for the name
+// in step, which is what access checks read
+func putMember(tx *bolt.Tx, m Member) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(membersBucket)).Put([]byte(m.ID), data); err != nil {
+		return err
+	}
+	settings := loadSettings(tx)
+	if role, ok := settings.MemberRoles[m.Name]; ok && role == m.Role {
+		return nil
+	}
+	settings.MemberRoles[m.Name] = m.Role
+	data, err = json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(settingsBucket)).Put([]byte(householdSettingsKey), data)
+}
+
+// ensureMember gives name a profile unless it has one, returning it
+func ensureMember(tx *bolt.Tx, name, displayName, role string, now time.Time, n int) (Member, error) {
+	if m, ok := memberNamed(tx, name); ok {
+		return m, nil
+	}
+	m := Member{ID: fmt.Sprintf("%d", now.UnixNano()+int64(n)), Name: name, DisplayName: displayName, Role: role,
+		CreatedAt: now.Format(time.RFC3339)}
+	if err := m.validate(); err != nil {
+		return m, err
+	}
+	m.UpdatedAt = m.CreatedAt
+	return m, putMember(tx, m)
+}
+
+// createMemberProfiles gives a profile to every name found on accounts,
+// roles, expenses and income, then links the records to them
+func createMemberProfiles(tx *bolt.Tx) (int, error) {
+	settings := loadSettings(tx)
+	type person struct{ display, role string }
+	people := map[string]person{}
+	tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+		var u User
+		if json.Unmarshal(v, &u) == nil {
+			people[u.Username] = person{u.Name, u.Role}
+		}
+		return nil
+	})
+	for name, role := range settings.MemberRoles {
+		p := people[name]
+		p.role = role
+		people[name] = p
+	}
+	for _, bucket := range []string{expensesBucket, incomeBucket} {
+		tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			var record struct {
+				User string `json:"user"`
+			}
+			if json.Unmarshal(v, &record) == nil && record.User != "" {
+				if _, ok := people[record.User]; !ok {
+					people[record.User] = person{}
+				}
+			}
+			return nil
+		})
+	}
+	names := make([]string, 0, len(people))
+	for name := range people {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for i, name := range names {
+		p := people[name]
+		if p.role != roleChild && p.role != roleViewer {
+			p.role = roleAdult
+		}
+		if _, err := ensureMember(tx, name, p.display, p.role, now, i); err != nil {
+			return 0, err
+		}
+	}
+	return relinkMembers(tx)
+}
+
+// relinkMembers points every expense and income at the member profile of
+// its user, dropping memberIds that name no member or someone else
+func relinkMembers(tx *bolt.Tx) (int, error) {
+	ids := map[string]string{}
+	for _, m := range loadMembers(tx) {
+		ids[m.Name] = m.ID
+	}
+	return countRewrites(
+		func() (int, error) {
+			return rewriteRecords(tx, expensesBucket, func(e *Expense) { e.MemberID = ids[e.User] })
+		},
+		func() (int, error) {
+			return rewriteRecords(tx, incomeBucket, func(i *Income) { i.MemberID = ids[i.User] })
+		},
+	)
+}
+
+// memberInUse reports whether expenses, income or an account still belong
+// to a member
+func memberInUse(tx *bolt.Tx, m Member) bool {
+	if tx.Bucket([]byte(usersBucket)).Get(userKey(m.Name)) != nil {
+		return true
+	}
+	found := errors.New("found")
+	for _, bucket := range []string{expensesBucket, incomeBucket} {
+		err := tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			var record struct {
+				MemberID string `json:"memberId"`
+				User     string `json:"user"`
+			}
+			if json.Unmarshal(v, &record) == nil && (record.MemberID == m.ID || record.User == m.Name) {
+				return found
+			}
+			return nil
+		})
+		if err == found {
+			return true
+		}
+	}
+	return false
+}
+
+// respondMemberError writes the response for errors of member changes
+func respondMemberError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		respondError(w, http.StatusNotFound, "member not found")
+	case errUnknownMember:
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errMemberExists, errMemberInUse:
+		respondError(w, http.StatusConflict, err.Error())
+	default:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// MEMBERS
+
+func getMembers(w http.ResponseWriter, r *http.Request) {
+	members := []Member{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		members = append(members, loadMembers(tx)...)
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, members)
+}
+
+func getMember(w http.ResponseWriter, r *http.Request) {
+	var m Member
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(membersBucket)).Get([]byte(mux.Vars(r)["id"]))
+		if v == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(v, &m)
+	})
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+func createMember(w http.ResponseWriter, r *http.Request) {
+	var m Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := m.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	m.ID = fmt.Sprintf("%d", now.UnixNano())
+	m.CreatedAt = now.Format(time.RFC3339)
+	m.UpdatedAt = m.CreatedAt
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		if _, ok := memberNamed(tx, m.Name); ok {
+			return errMemberExists
+		}
+		if err := putMember(tx, m); err != nil {
+			return err
+		}
+		// Records already under the name now link to the profile
+		_, err := countRewrites(
+			func() (int, error) {
+				return rewriteRecords(tx, expensesBucket, func(e *Expense) {
+					if e.User == m.Name {
+						e.MemberID = m.ID
+					}
+				})
+			},
+			func() (int, error) {
+				return rewriteRecords(tx, incomeBucket, func(i *Income) {
+					if i.User == m.Name {
+						i.MemberID = m.ID
+					}
+				})
+			},
+		)
+		return err
+	})
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, m)
+}
+
+// updateMember changes how a member is shown, their role and currency. The
+// name records use stays as it is.
+func updateMember(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var m Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(membersBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var old Member
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		if m.Name != "" && strings.TrimSpace(m.Name) != old.Name {
+			return memberProblem("name cannot change; set displayName instead")
+		}
+		m.ID, m.Name, m.CreatedAt = id, old.Name, old.CreatedAt
+		if err := m.validate(); err != nil {
+			return memberProblem(err.Error())
+		}
+		m.UpdatedAt = time.Now().Format(time.RFC3339)
+		return putMember(tx, m)
+	})
+	if p, ok := err.(memberProblem); ok {
+		respondError(w, http.StatusBadRequest, string(p))
+		return
+	}
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+// memberProblem is a member change the request asks for wrongly
+type memberProblem string
+
+func (p memberProblem) Error() string { return string(p) }
+
+// deleteMember removes a member no record or account belongs to any more
+func deleteMember(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(membersBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var m Member
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		if memberInUse(tx, m) {
+			return errMemberInUse
+		}
+		j.track(membersBucket, []byte(id))
+		return b.Delete([]byte(id))
+	})
+	if err != nil {
+		respondMemberError(w, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Member deleted"})
+}
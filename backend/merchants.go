@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Merchant is an entry of the merchant directory. Name, logo, website and
+// default category come from enrichment or from the household's own edits;
+// the totals are computed from expenses on request.
+type Merchant struct {
+	Key  string `json:"key"` // merchantKey of the name
+	Name string `json:"name"`
+	// Aliases are other names the merchant appears under on statements and
+	// alerts, such as "AMZN Mktp" for Amazon. Names that start with an
+	// alias match it too.
+	Aliases         []string `json:"aliases,omitempty"`
+	Website         string   `json:"website,omitempty"`
+	LogoURL         string   `json:"logoUrl,omitempty"`
+	DefaultCategory string   `json:"defaultCategory,omitempty"`
+	// Source is the provider that enriched the merchant, or "manual" once
+	// edited; manual entries are never re-enriched
+	Source    string `json:"source,omitempty"`
+	UpdatedAt string `json:"updatedAt"`
+
+	Transactions int    `json:"transactions"`
+	Total        Money  `json:"total"`
+	LastSeen     string `json:"lastSeen,omitempty"`
+}
+
+// merchantAliasPrefix is the shortest alias a longer name can match by
+// starting with it; shorter aliases must match whole
+const merchantAliasPrefix = 4
+
+var (
+	errMerchantExists = errors.New("merchant already exists")
+	errAliasTaken     = errors.New("alias belongs to another merchant")
+)
+
+// merchantProvider looks up metadata for a merchant name
+type merchantProvider interface {
+	name() string
+	lookup(key string) (Merchant, bool)
+}
+
+// merchantProviders are asked in order; the first that knows a merchant
+// wins
+var merchantProviders = []merchantProvider{bundledMerchants{}}
+
+// merchantKey reduces a merchant name to letters and digits so spelling
+// variants such as "D-Mart" and "DMart" meet
+func merchantKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// bundledMerchants is a small built-in dataset of common Indian merchants
+type bundledMerchants struct{}
+
+var bundledMerchantData = []struct {
+	name, domain, category string
+	aliases                []string
+}{
+	{"BigBasket", "bigbasket.com", "Groceries", []string{"BBNow", "Innovative Retail"}},
+	{"DMart", "dmart.in", "Groceries", []string{"Avenue Supermarts"}},
+	{"Reliance Fresh", "relianceretail.com", "Groceries", []string{"Reliance Retail", "Reliance Smart"}},
+	{"Zepto", "zeptonow.com", "Groceries", []string{"Kiranakart"}},
+	{"Blinkit", "blinkit.com", "Groceries", []string{"Grofers"}},
+	{"Swiggy", "swiggy.com", "Dining", []string{"Bundl Technologies", "Swiggy Instamart"}},
+	{"Zomato", "zomato.com", "Dining", nil},
+	{"Starbucks", "starbucks.in", "Dining", []string{"Tata Starbucks"}},
+	{"Haldiram's", "haldirams.com", "Dining", nil},
+	{"Uber", "uber.com", "Transport", []string{"Uber India", "Uber Trip"}},
+	{"Ola", "olacabs.com", "Transport", []string{"Ola Cabs", "ANI Technologies"}},
+	{"Indian Oil", "iocl.com", "Transport", []string{"IOCL"}},
+	{"Namma Metro", "bmrc.co.in", "Transport", []string{"BMRCL"}},
+	{"IRCTC", "irctc.co.in", "Transport", nil},
+	{"BESCOM", "bescom.karnataka.gov.in", "Utilities", nil},
+	{"Airtel", "airtel.in", "Utilities", []string{"Bharti Airtel"}},
+	{"Jio", "jio.com", "Utilities", []string{"Reliance Jio"}},
+	{"BWSSB", "bwssb.karnataka.gov.in", "Utilities", nil},
+	{"Amazon", "amazon.in", "Shopping", []string{"AMZN", "Amazon.in", "Amazon Pay", "Amazon Seller Services"}},
+	{"Flipkart", "flipkart.com", "Shopping", []string{"FKRT", "Flipkart Internet"}},
+	{"Myntra", "myntra.com", "Shopping", []string{"Myntra Designs"}},
+	{"Decathlon", "decathlon.in", "Shopping", nil},
+	{"BookMyShow", "bookmyshow.com", "Entertainment", []string{"Bigtree Entertainment"}},
+	{"Netflix", "netflix.com", "Entertainment", nil},
+	{"Spotify", "spotify.com", "Entertainment", nil},
+	{"PVR", "pvrcinemas.com", "Entertainment", []string{"PVR INOX"}},
+	{"Apollo Pharmacy", "apollopharmacy.in", "Health", []string{"Apollo Pharmacies"}},
+	{"Practo", "practo.com", "Health", nil},
+	{"1mg", "1mg.com", "Health", []string{"Tata 1mg"}},
+	{"Cult.fit", "cult.fit", "Health", []string{"Curefit"}},
+}
+
+func (bundledMerchants) name() string { return "bundled" }
+
+func (bundledMerchants) lookup(key string) (Merchant, bool) {
+	best, bestLen := -1, 0
+	for i, m := range bundledMerchantData {
+		if merchantKey(m.name) == key {
+			best = i
+			break
+		}
+		for _, alias := range m.aliases {
+			if a := merchantKey(alias); len(a) > bestLen && aliasMatches(key, a) {
+				best, bestLen = i, len(a)
+			}
+		}
+	}
+	if best < 0 {
+		return Merchant{}, false
+	}
+	m := bundledMerchantData[best]
+	return Merchant{
+		Name:            m.name,
+		Aliases:         append([]string(nil), m.aliases...),
+		Website:         "https://" + m.domain,
+		LogoURL:         "https://" + m.domain + "/favicon.ico",
+		DefaultCategory: m.category,
+	}, true
+}
+
+// aliasMatches reports whether a merchant key is the alias key or, for
+// aliases long enough to be telling, starts with it, as statements add
+// store codes and references to names
+func aliasMatches(key, alias string) bool {
+	if alias == "" {
+		return false
+	}
+	return key == alias || (len(alias) >= merchantAliasPrefix && strings.HasPrefix(key, alias))
+}
+
+// MerchantSpending sums a merchant's expenses in the base currency
+type MerchantSpending struct {
+	Merchant     Merchant         `json:"merchant"`
+	Currency     string           `json:"currency"`
+	Transactions int              `json:"transactions"`
+	Total        Money            `json:"total"`
+	Average      Money            `json:"average"`
+	FirstDate    string           `json:"firstDate,omitempty"`
+	LastDate     string           `json:"lastDate,omitempty"`
+	Months       []MerchantMonth  `json:"months"`
+	ByUser       map[string]Money `json:"byUser"`
+	// Names are the spellings expenses carry, with how many use each
+	Names map[string]int `json:"names"`
+}
+
+// MerchantMonth is a merchant's spending in one month
+type MerchantMonth struct {
+	Month        string `json:"month"`
+	Transactions int    `json:"transactions"`
+	Total        Money  `json:"total"`
+}
+
+// merchantDirectory is the stored directory by key, for resolving names
+type merchantDirectory map[string]Merchant
+
+func loadMerchantDirectory(tx *bolt.Tx) merchantDirectory {
+	dir := merchantDirectory{}
+	tx.Bucket([]byte(merchantsBucket)).ForEach(func(k, v []byte) error {
+		var m Merchant
+		if json.Unmarshal(v, &m) == nil {
+			dir[m.Key] = m
+		}
+		return nil
+	})
+	return dir
+}
+
+// resolve finds the entry a merchant name belongs to: the one named so,
+// else the one with the longest alias the name matches
+func (dir merchantDirectory) resolve(name string) (Merchant, bool) {
+	key := merchantKey(name)
+	if key == "" {
+		return Merchant{}, false
+	}
+	if m, ok := dir[key]; ok {
+		return m, true
+	}
+	var best Merchant
+	bestLen := 0
+	for _, m := range dir {
+		for _, alias := range m.Aliases {
+			if a := merchantKey(alias); len(a) > bestLen && aliasMatches(key, a) {
+				best, bestLen = m, len(a)
+			}
+		}
+	}
+	return best, bestLen > 0
+}
+
+// aliasOwner is the entry other than key that already answers to alias
+func (dir merchantDirectory) aliasOwner(key, alias string) (Merchant, bool) {
+	a := merchantKey(alias)
+	for _, m := range dir {
+		if m.Key == key {
+			continue
+		}
+		if m.Key == a {
+			return m, true
+		}
+		for _, other := range m.Aliases {
+			if merchantKey(other) == a {
+				return m, true
+			}
+		}
+	}
+	return Merchant{}, false
+}
+
+func putMerchant(tx *bolt.Tx, m Merchant) error {
+	m.Transactions, m.Total, m.LastSeen = 0, 0, ""
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(merchantsBucket)).Put([]byte(m.Key), data)
+}
+
+// enrichMerchant adds a merchant to the directory, filling in what the
+// providers know about it. Names are first resolved against the entries
+// and their aliases; merchants already enriched or edited by hand are left
+// alone. It returns the directory entry.
+func enrichMerchant(tx *bolt.Tx, name string) (Merchant, error) {
+	if merchantKey(name) == "" {
+		return Merchant{}, nil
+	}
+	dir := loadMerchantDirectory(tx)
+	m, listed := dir.resolve(name)
+	if listed && m.Source != "" {
+		return m, nil
+	}
+	if !listed {
+		m = Merchant{Key: merchantKey(name), Name: strings.TrimSpace(name)}
+	}
+	for _, p := range merchantProviders {
+		found, ok := p.lookup(m.Key)
+		if !ok {
+			continue
+		}
+		// An alias names the merchant it stands for, which may be listed
+		// already
+		found.Key, found.Source = merchantKey(found.Name), p.name()
+		if existing, ok := dir[found.Key]; ok && existing.Source != "" {
+			return existing, nil
+		}
+		if listed && m.Key != found.Key {
+			if err := tx.Bucket([]byte(merchantsBucket)).Delete([]byte(m.Key)); err != nil {
+				return m, err
+			}
+		}
+		m = found
+		break
+	}
+	m.UpdatedAt = time.Now().Format(time.RFC3339)
+	return m, putMerchant(tx, m)
+}
+
+// applyMerchant adds an expense's merchant to the directory, writes it the
+// way the directory names it and gives uncategorized expenses the
+// merchant's default category
+func applyMerchant(tx *bolt.Tx, expense *Expense) error {
+	m, err := enrichMerchant(tx, expense.Merchant)
+	if err != nil {
+		return err
+	}
+	if m.Name != "" {
+		expense.Merchant = m.Name
+	}
+	if expense.Category == "" {
+		expense.Category = m.DefaultCategory
+	}
+	return nil
+}
+
+// enrichMerchants adds every merchant seen on expenses to the directory and
+// retries the providers for ones they did not know before
+func enrichMerchants() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		names := map[string]string{}
+		tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) == nil && e.Merchant != "" {
+				names[merchantKey(e.Merchant)] = e.Merchant
+			}
+			return nil
+		})
+		enriched := 0
+		for _, name := range names {
+			m, err := enrichMerchant(tx, name)
+			if err != nil {
+				return err
+			}
+			if m.Source != "" && m.Source != "manual" {
+				enriched++
+			}
+		}
+		logger("scheduler").Info("enriched merchants", "merchants", len(names), "enriched", enriched)
+		return nil
+	})
+}
+
+// validate tidies a merchant sent by a client and checks its aliases are
+// free in the directory
+func (m *Merchant) validate(dir merchantDirectory) error {
+	m.Name = strings.TrimSpace(m.Name)
+	var aliases []string
+	seen := map[string]bool{m.Key: true}
+	for _, alias := range m.Aliases {
+		alias = strings.TrimSpace(alias)
+		a := merchantKey(alias)
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		if owner, ok := dir.aliasOwner(m.Key, alias); ok {
+			return merchantProblem(fmt.Sprintf("%q already names %s", alias, owner.Name))
+		}
+		aliases = append(aliases, alias)
+	}
+	m.Aliases = aliases
+	return nil
+}
+
+// merchantProblem is a merchant the directory cannot take
+type merchantProblem string
+
+func (p merchantProblem) Error() string { return string(p) }
+
+// respondMerchantError writes the response for errors of directory edits
+func respondMerchantError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		respondError(w, http.StatusNotFound, "merchant not found")
+	case errMerchantExists:
+		respondError(w, http.StatusConflict, err.Error())
+	default:
+		if p, ok := err.(merchantProblem); ok {
+			respondError(w, http.StatusConflict, string(p))
+			return
+		}
+		respondStoreError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// MERCHANTS
+
+// getMerchants lists the directory with each merchant's expense totals in
+// the base currency, busiest first. Expenses count towards the merchant
+// their name resolves to, aliases included.
+func getMerchants(w http.ResponseWriter, r *http.Request) {
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	merchants := map[string]*Merchant{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		dir := loadMerchantDirectory(tx)
+		for key := range dir {
+			m := dir[key]
+			merchants[key] = &m
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) != nil {
+				return nil
+			}
+			found, ok := dir.resolve(e.Merchant)
+			if !ok {
+				return nil
+			}
+			m := merchants[found.Key]
+			m.Transactions++
+			conv.add(&m.Total, e.Amount, e.Currency)
+			if e.Date > m.LastSeen {
+				m.LastSeen = e.Date
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := []Merchant{}
+	for _, m := range merchants {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Transactions != list[j].Transactions {
+			return list[i].Transactions > list[j].Transactions
+		}
+		return list[i].Key < list[j].Key
+	})
+	respondJSON(w, http.StatusOK, list)
+}
+
+// getMerchant returns one directory entry
+func getMerchant(w http.ResponseWriter, r *http.Request) {
+	var m Merchant
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(merchantsBucket)).Get([]byte(mux.Vars(r)["key"]))
+		if v == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(v, &m)
+	})
+	if err != nil {
+		respondMerchantError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+// createMerchant adds a merchant by hand, keyed by its name
+func createMerchant(w http.ResponseWriter, r *http.Request) {
+	var m Merchant
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	m.Key, m.Source = merchantKey(m.Name), "manual"
+	if m.Key == "" {
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	m.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		dir := loadMerchantDirectory(tx)
+		if _, ok := dir[m.Key]; ok {
+			return errMerchantExists
+		}
+		if owner, ok := dir.aliasOwner(m.Key, m.Name); ok {
+			return merchantProblem(fmt.Sprintf("%q already names %s", m.Name, owner.Name))
+		}
+		if err := m.validate(dir); err != nil {
+			return err
+		}
+		return putMerchant(tx, m)
+	})
+	if err != nil {
+		respondMerchantError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, m)
+}
+
+// updateMerchant saves the household's own details for a merchant, which
+// enrichment then leaves alone
+func updateMerchant(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	var m Merchant
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(m.Name) == "" {
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	m.Key, m.Source = key, "manual"
+	m.Transactions, m.Total, m.LastSeen = 0, 0, ""
+	m.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		dir := loadMerchantDirectory(tx)
+		if _, ok := dir[key]; !ok {
+			return errNotFound
+		}
+		if err := m.validate(dir); err != nil {
+			return err
+		}
+		return putMerchant(tx, m)
+	})
+	if err != nil {
+		respondMerchantError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+// deleteMerchant drops a merchant from the directory. Its expenses keep
+// their merchant name, and are listed again on the next expense or
+// enrichment run that meets it.
+func deleteMerchant(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(merchantsBucket))
+		if b.Get([]byte(key)) == nil {
+			return errNotFound
+		}
+		j.track(merchantsBucket, []byte(key))
+		return b.Delete([]byte(key))
+	})
+	if err != nil {
+		respondMerchantError(w, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Merchant deleted"})
+}
+
+// getMerchantSpending sums the spending at a merchant, month by month and
+// member by member. Expenses are matched by name and aliases and narrowed
+// by the standard filters, ?from=&to= and the rest.
+func getMerchantSpending(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	spending := MerchantSpending{Currency: settings.BaseCurrency, ByUser: map[string]Money{}, Names: map[string]int{}}
+	months := map[string]*MerchantMonth{}
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		dir := loadMerchantDirectory(tx)
+		m, ok := dir[key]
+		if !ok {
+			return errNotFound
+		}
+		spending.Merchant = m
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) != nil || !f.matches(expenseFields(e)) {
+				return nil
+			}
+			if found, ok := dir.resolve(e.Merchant); !ok || found.Key != key {
+				return nil
+			}
+			var amount Money
+			if !conv.add(&amount, e.Amount, e.Currency) {
+				return nil
+			}
+			spending.Transactions++
+			spending.Total += amount
+			spending.ByUser[e.User] += amount
+			spending.Names[e.Merchant]++
+			if spending.FirstDate == "" || e.Date < spending.FirstDate {
+				spending.FirstDate = e.Date
+			}
+			if e.Date > spending.LastDate {
+				spending.LastDate = e.Date
+			}
+			if len(e.Date) < 7 {
+				return nil
+			}
+			month := e.Date[:7]
+			if months[month] == nil {
+				months[month] = &MerchantMonth{Month: month}
+			}
+			months[month].Transactions++
+			months[month].Total += amount
+			return nil
+		})
+	})
+	if err != nil {
+		respondMerchantError(w, err)
+		return
+	}
+	if spending.Transactions > 0 {
+		spending.Average = spending.Total / Money(spending.Transactions)
+	}
+	spending.Months = []MerchantMonth{}
+	for _, m := range months {
+		spending.Months = append(spending.Months, *m)
+	}
+	sort.Slice(spending.Months, func(i, j int) bool { return spending.Months[i].Month < spending.Months[j].Month })
+	respondJSON(w, http.StatusOK, spending)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// startupMigrations bring stored records into their current shape. Each one
+// is idempotent, so they simply run on every boot of a primary.
+var startupMigrations = []struct {
+	name string
+	run  func(tx *bolt.Tx) (int, error)
+}{
+	{"money-minor-units", migrateMoney},
+	{"canonical-dates", migrateDates},
+	{"currency-codes", migrateCurrencies},
+	{"bill-paid-state", migrateBillPaidState},
+	{"income-sources", migrateIncomeSources},
+	{"goal-status", migrateGoalStatus},
+}
+
+// schemaMigrations change stored records in ways that must happen exactly
+// once, such as renaming a field or backfilling one from other records. The
+// meta bucket records the version a store has reached. Append new ones with
+// the next version; never reorder or renumber them.
+var schemaMigrations = []struct {
+	version int
+	name    string
+	run     func(tx *bolt.Tx) (int, error)
+}{
+	{1, "expense-comment-counts", backfillCommentCounts},
+	{2, "pending-transactions", moveInboxDrafts},
+	{3, "member-profiles", createMemberProfiles},
+	{4, "auth-secret-file", moveAuthSecret},
+	{5, "member-links", relinkMembers},
+}
+
+const schemaVersionKey = "schemaVersion"
+
+// currentSchemaVersion is the version this release brings stores up to
+func currentSchemaVersion() int {
+	return schemaMigrations[len(schemaMigrations)-1].version
+}
+
+// storedSchemaVersion is the version a store has reached, 0 for one from
+// before versioning
+func storedSchemaVersion(tx *bolt.Tx) int {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(b.Get([]byte(schemaVersionKey))))
+	return n
+}
+
+// checkSchemaVersion refuses data written by a newer release, whose records
+// this one could misread or clobber
+func checkSchemaVersion(version int) error {
+	if version > currentSchemaVersion() {
+		return fmt.Errorf("data is at schema version %d but this release only knows up to %d; upgrade the server first",
+			version, currentSchemaVersion())
+	}
+	return nil
+}
+
+// runStartupMigrations applies the idempotent migrations, then any schema
+// migrations the store has not had yet, all in one transaction
+func runStartupMigrations() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		version := storedSchemaVersion(tx)
+		if err := checkSchemaVersion(version); err != nil {
+			return err
+		}
+		for _, m := range startupMigrations {
+			n, err := m.run(tx)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				logger("store").Info("migrated records", "migration", m.name, "records", n)
+			}
+		}
+		for _, m := range schemaMigrations {
+			if m.version <= version {
+				continue
+			}
+			n, err := m.run(tx)
+			if err != nil {
+				return fmt.Errorf("schema migration %d (%s): %w", m.version, m.name, err)
+			}
+			logger("store").Info("applied schema migration", "version", m.version, "migration", m.name, "records", n)
+		}
+		if version == currentSchemaVersion() {
+			return nil
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(currentSchemaVersion())))
+	})
+}
+
+// rewriteRecords decodes every record of a bucket into T, lets fix adjust
+// it and stores the re-encoded record when the bytes changed. Records that
+// do not parse are left for the integrity check.
+func rewriteRecords[T any](tx *bolt.Tx, bucket string, fix func(*T)) (int, error) {
+	b := tx.Bucket([]byte(bucket))
+	type update struct{ key, value []byte }
+	var updates []update
+	err := b.ForEach(func(k, v []byte) error {
+		var record T
+		if json.Unmarshal(v, &record) != nil {
+			return nil
+		}
+		fix(&record)
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, v) {
+			updates = append(updates, update{append([]byte(nil), k...), data})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range updates {
+		if err := b.Put(u.key, u.value); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+// countRewrites runs rewrite steps in order and sums their counts
+func countRewrites(steps ...func() (int, error)) (int, error) {
+	total := 0
+	for _, step := range steps {
+		n, err := step()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// migrateMoney rewrites float amounts such as 218715.31999999995 as exact
+// decimals, rounded for the record's currency. Decoding into Money does the
+// rounding; re-encoding stores the canonical form.
+func migrateMoney(tx *bolt.Tx) (int, error) {
+	return countRewrites(
+		func() (int, error) {
+			return rewriteRecords(tx, expensesBucket, func(e *Expense) {
+				e.Amount = roundForCurrency(e.Amount, e.Currency)
+			})
+		},
+		func() (int, error) {
+			return rewriteRecords(tx, incomeBucket, func(i *Income) {
+				i.Amount = roundForCurrency(i.Amount, i.Currency)
+			})
+		},
+		func() (int, error) { return rewriteRecords(tx, budgetsBucket, func(*Budget) {}) },
+		func() (int, error) { return rewriteRecords(tx, goalsBucket, func(*Goal) {}) },
+		func() (int, error) { return rewriteRecords(tx, investmentsBucket, func(*Investment) {}) },
+		func() (int, error) { return rewriteRecords(tx, billsBucket, func(*BillReminder) {}) },
+	)
+}
+
+// migrateDates rewrites free-form dates as YYYY-MM-DD. Values that cannot be
+// parsed are kept so nothing is lost; they show up as-is until edited.
+func migrateDates(tx *bolt.Tx) (int, error) {
+	settings := loadSettings(tx)
+	fix := func(date *string, user string) {
+		if normalized, err := normalizeDate(*date, settings.location(user)); err == nil {
+			*date = normalized
+		}
+	}
+	return countRewrites(
+		func() (int, error) {
+			return rewriteRecords(tx, expensesBucket, func(e *Expense) { fix(&e.Date, e.User) })
+		},
+		func() (int, error) { return rewriteRecords(tx, incomeBucket, func(i *Income) { fix(&i.Date, i.User) }) },
+		func() (int, error) { return rewriteRecords(tx, goalsBucket, func(g *Goal) { fix(&g.Deadline, "") }) },
+		func() (int, error) {
+			return rewriteRecords(tx, billsBucket, func(b *BillReminder) { fix(&b.DueDate, "") })
+		},
+	)
+}
+
+// migrateCurrencies gives records saved without a currency the household's
+// base currency and upper-cases codes. Unknown codes are kept as they are.
+func migrateCurrencies(tx *bolt.Tx) (int, error) {
+	base := loadSettings(tx).BaseCurrency
+	fix := func(currency *string) {
+		if code, err := normalizeCurrency(*currency, base); err == nil {
+			*currency = code
+		}
+	}
+	return countRewrites(
+		func() (int, error) { return rewriteRecords(tx, expensesBucket, func(e *Expense) { fix(&e.Currency) }) },
+		func() (int, error) { return rewriteRecords(tx, incomeBucket, func(i *Income) { fix(&i.Currency) }) },
+		func() (int, error) { return rewriteRecords(tx, budgetsBucket, func(b *Budget) { fix(&b.Currency) }) },
+		func() (int, error) { return rewriteRecords(tx, goalsBucket, func(g *Goal) { fix(&g.Currency) }) },
+		func() (int, error) {
+			return rewriteRecords(tx, investmentsBucket, func(i *Investment) { fix(&i.Currency) })
+		},
+		func() (int, error) {
+			return rewriteRecords(tx, billsBucket, func(b *BillReminder) { fix(&b.Currency) })
+		},
+	)
+}
+
+// migrateBillPaidState turns the client-set "paid" status into IsPaid and
+// stores the computed status and balances in place of stale ones
+func migrateBillPaidState(tx *bolt.Tx) (int, error) {
+	now := today(loadSettings(tx).location(""))
+	return rewriteRecords(tx, billsBucket, func(b *BillReminder) {
+		if b.Status == billPaid {
+			b.IsPaid = true
+		}
+		b.refresh(now)
+	})
+}
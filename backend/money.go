@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Money is an amount in thousandths of a major unit, the smallest minor unit
+// in use (Kuwaiti fils, Omani baisa), so every currency's amounts are exact.
+// Arithmetic on it is exact; JSON carries it as a decimal number in major
+// units, e.g. 1234.50 is sent as 1234.5, so clients keep working with
+// ordinary numbers.
+type Money int64
+
+// majorUnit is one rupee, dollar or euro: Amount: 250 * majorUnit
+const majorUnit Money = 1000
+
+// moneyDecimals is the number of decimal places Money keeps
+const moneyDecimals = 3
+
+// moneyFromFloat converts a float amount in major units, rounding half away
+// from zero to the nearest minor unit.
+func moneyFromFloat(f float64) Money {
+	return Money(math.Round(f * float64(majorUnit)))
+}
+
+// Float64 returns the amount in major units, for ratios and percentages
+func (m Money) Float64() float64 {
+	return float64(m) / float64(majorUnit)
+}
+
+// String formats the amount in major units with two decimals, or three when
+// the amount needs them
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%s%d.%s", sign, m/majorUnit, minorDigits(m%majorUnit))
+}
+
+// minorDigits writes the fraction of an amount with two digits, or three
+// when the last one is not zero: 500 is "50", 5 is "005"
+func minorDigits(minor Money) string {
+	text := strings.TrimRight(fmt.Sprintf("%03d", int64(minor)), "0")
+	for len(text) < 2 {
+		text += "0"
+	}
+	return text
+}
+
+// MarshalJSON writes the amount as a decimal number without trailing zeros
+func (m Money) MarshalJSON() ([]byte, error) {
+	s := m.String()
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "" || s == "-" {
+		s = "0"
+	}
+	return []byte(s), nil
+}
+
+// decimalAmount is a plain decimal such as 1234.50, -0.125 or 1e3. Other
+// text big.Rat would read, like the fraction 1/3, is not an amount.
+var decimalAmount = regexp.MustCompile(`^[-+]?(\d+(\.\d*)?|\.\d+)([eE][-+]?\d{1,3})?$`)
+
+// UnmarshalJSON accepts a JSON number or numeric string in major units. The
+// decimal text is parsed exactly, so 0.1 + 0.2 really is 0.30; digits beyond
+// the third decimal are rounded half away from zero. Write handlers then
+// round to the record's currency with roundForCurrency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	text := string(bytes.Trim(data, `"`))
+	if text == "null" || text == "" {
+		*m = 0
+		return nil
+	}
+	if !decimalAmount.MatchString(text) {
+		return fmt.Errorf("invalid amount %s", data)
+	}
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return fmt.Errorf("invalid amount %s", data)
+	}
+	r.Mul(r, big.NewRat(int64(majorUnit), 1))
+
+	// Round half away from zero: truncate |r| + 1/2
+	neg := r.Sign() < 0
+	r.Abs(r)
+	r.Add(r, big.NewRat(1, 2))
+	minor := new(big.Int).Quo(r.Num(), r.Denom())
+	if !minor.IsInt64() {
+		return fmt.Errorf("amount %s out of range", data)
+	}
+	*m = Money(minor.Int64())
+	if neg {
+		*m = -*m
+	}
+	return nil
+}
+
+// currencyDecimals lists currencies without the usual two decimal places,
+// following their ISO 4217 minor units
+var currencyDecimals = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"CLP": 0,
+	"ISK": 0,
+	"IDR": 0,
+	"KWD": 3,
+	"BHD": 3,
+	"OMR": 3,
+	"JOD": 3,
+	"TND": 3,
+	"LYD": 3,
+	"IQD": 3,
+}
+
+// roundForCurrency rounds m to the smallest unit the currency uses
+func roundForCurrency(m Money, currency string) Money {
+	decimals, ok := currencyDecimals[strings.ToUpper(currency)]
+	if !ok {
+		decimals = 2
+	}
+	if decimals >= moneyDecimals {
+		return m
+	}
+	step := Money(math.Pow10(moneyDecimals - decimals))
+	half := step / 2
+	if m < 0 {
+		return -((-m + half) / step * step)
+	}
+	return (m + half) / step * step
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		out  string
+	}{
+		{`0.1`, 100, `0.1`},
+		{`1234.5`, 1234500, `1234.5`},
+		{`218715.31999999995`, 218715320, `218715.32`},
+		{`"99.99"`, 99990, `99.99`},
+		{`2.005`, 2005, `2.005`},
+		{`-2.0005`, -2001, `-2.001`},
+		{`1e3`, 1000000, `1000`},
+		{`0`, 0, `0`},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.in), &m); err != nil {
+			t.Errorf("unmarshal %s: %v", tt.in, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("unmarshal %s = %d, want %d", tt.in, m, tt.want)
+		}
+		out, _ := json.Marshal(m)
+		if string(out) != tt.out {
+			t.Errorf("marshal %d = %s, want %s", m, out, tt.out)
+		}
+	}
+
+	var a, b Money
+	json.Unmarshal([]byte(`0.1`), &a)
+	json.Unmarshal([]byte(`0.2`), &b)
+	if a+b != 300 {
+		t.Errorf("0.1 + 0.2 = %s", a+b)
+	}
+
+	for _, in := range []string{`"1/3"`, `"0x10"`, `"12,50"`, `"1e9999"`, `"Inf"`} {
+		if err := json.Unmarshal([]byte(in), &a); err == nil {
+			t.Errorf("unmarshal %s = %s, want an error", in, a)
+		}
+	}
+}
+
+func TestRoundForCurrency(t *testing.T) {
+	for _, tc := range []struct {
+		m        Money
+		currency string
+		want     Money
+	}{
+		{1234560, "JPY", 1235000},
+		{1234560, "INR", 1234560},
+		{1234565, "INR", 1234570},
+		{-2005, "USD", -2010},
+		{1234565, "KWD", 1234565},
+	} {
+		if got := roundForCurrency(tc.m, tc.currency); got != tc.want {
+			t.Errorf("%s %s rounded to %s, want %s", tc.currency, tc.m, got, tc.want)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	for _, tc := range []struct {
+		m        Money
+		currency string
+		want     string
+	}{
+		{3450 * majorUnit, "INR", "₹3,450"},
+		{123456*majorUnit + 500, "INR", "₹1,23,456.50"},
+		{99 * majorUnit, "INR", "₹99"},
+		{-1234567 * majorUnit, "USD", "-$1,234,567"},
+		{50, "CHF", "0.05 CHF"},
+		{12*majorUnit + 345, "KWD", "12.345 KWD"},
+		{12*majorUnit + 345, "USD", "$12.35"},
+	} {
+		if got := formatMoney(tc.m, tc.currency); got != tc.want {
+			t.Errorf("formatMoney(%d, %s) = %q, want %q", tc.m, tc.currency, got, tc.want)
+		}
+	}
+}
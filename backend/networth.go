@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// NetWorth is what the household owns less what it owes on a day, in the
+// base currency
+type NetWorth struct {
+	Date     string `json:"date"`
+	Currency string `json:"currency"`
+	// Assets
+	Accounts    Money `json:"accounts"` // accounts in credit
+	Investments Money `json:"investments"`
+	Goals       Money `json:"goals"` // savings toward goals not yet archived
+	Lent        Money `json:"lent"`
+	// Liabilities
+	AccountsOwed Money `json:"accountsOwed"` // overdrawn accounts and card balances
+	Borrowed     Money `json:"borrowed"`
+
+	Assets                Money    `json:"assets"`
+	Liabilities           Money    `json:"liabilities"`
+	NetWorth              Money    `json:"netWorth"`
+	UnconvertedCurrencies []string `json:"unconvertedCurrencies"`
+}
+
+// netWorth adds up the accounts, goals and investments user can see, and
+// the household's debts, as of date. An empty user sees everything.
+func netWorth(tx *bolt.Tx, settings Settings, user, date string) (NetWorth, error) {
+	n := NetWorth{Date: date, Currency: settings.BaseCurrency}
+	conv := newConverter(settings, "")
+	balances, err := accountBalances(tx, settings, date)
+	if err != nil {
+		return n, err
+	}
+	err = tx.Bucket([]byte(accountsBucket)).ForEach(func(k, v []byte) error {
+		var a Account
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		if !a.visibleTo(user) {
+			return nil
+		}
+		if balance := balances[a.ID].Balance; balance >= 0 {
+			conv.add(&n.Accounts, balance, a.Currency)
+		} else {
+			conv.add(&n.AccountsOwed, -balance, a.Currency)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	err = tx.Bucket([]byte(investmentsBucket)).ForEach(func(k, v []byte) error {
+		var inv Investment
+		if json.Unmarshal(v, &inv) == nil {
+			conv.add(&n.Investments, inv.Value, inv.Currency)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	err = tx.Bucket([]byte(goalsBucket)).ForEach(func(k, v []byte) error {
+		var g Goal
+		if json.Unmarshal(v, &g) == nil && g.Status != "archived" && g.visibleTo(user) {
+			conv.add(&n.Goals, g.Current, g.Currency)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	n.Lent, n.Borrowed = debtPosition(tx, conv)
+	n.Assets = n.Accounts + n.Investments + n.Goals + n.Lent
+	n.Liabilities = n.AccountsOwed + n.Borrowed
+	n.NetWorth = n.Assets - n.Liabilities
+	n.UnconvertedCurrencies = conv.unconverted()
+	return n, nil
+}
+
+// snapshotNetWorth records the household's net worth for today, replacing
+// an earlier snapshot of the same day
+func snapshotNetWorth() error {
+	settings := currentSettings()
+	date := billToday()
+	return db.Update(func(tx *bolt.Tx) error {
+		n, err := netWorth(tx, settings, "", date)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(netWorthHistoryBucket)).Put([]byte(date), data)
+	})
+}
+
+// NET WORTH
+
+// getNetWorth returns today's net worth as the signed-in member sees it
+func getNetWorth(w http.ResponseWriter, r *http.Request) {
+	user := authUser(r)
+	settings := currentSettings()
+	var n NetWorth
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		n, err = netWorth(tx, settings, user, today(settings.location(user)))
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, n)
+}
+
+// getNetWorthHistory lists the daily snapshots, oldest first, optionally
+// between ?from= and ?to=
+func getNetWorthHistory(w http.ResponseWriter, r *http.Request) {
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	history := []NetWorth{}
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		// Keys are dates, so the bucket is already in order
+		return forEach(r.Context(), tx.Bucket([]byte(netWorthHistoryBucket)), func(k, v []byte) error {
+			date := string(k)
+			if (f.From != "" && date < f.From) || (f.To != "" && date > f.To) {
+				return nil
+			}
+			var n NetWorth
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+			history = append(history, n)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, history)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// notificationMutesKey holds the muted alert types in the settings bucket
+const notificationMutesKey = "notification-mutes"
+
+// loadMutes returns the set of alert types hidden from the notifications
+// center. Muted alerts are still recorded, just not shown or counted.
+func loadMutes(tx *bolt.Tx) map[string]bool {
+	var types []string
+	if v := tx.Bucket([]byte(settingsBucket)).Get([]byte(notificationMutesKey)); v != nil {
+		json.Unmarshal(v, &types)
+	}
+	mutes := map[string]bool{}
+	for _, t := range types {
+		mutes[t] = true
+	}
+	return mutes
+}
+
+func saveMutes(tx *bolt.Tx, mutes map[string]bool) error {
+	types := []string{}
+	for t := range mutes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	data, err := json.Marshal(types)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(settingsBucket)).Put([]byte(notificationMutesKey), data)
+}
+
+// visibleAlerts lists the caller's unmuted alerts, newest first
+func visibleAlerts(r *http.Request, tx *bolt.Tx) ([]Alert, error) {
+	mutes := loadMutes(tx)
+	user := authUser(r)
+	alerts := []Alert{}
+	err := forEach(r.Context(), tx.Bucket([]byte(alertsBucket)), func(k, v []byte) error {
+		var a Alert
+		if json.Unmarshal(v, &a) == nil && !mutes[a.Type] && a.visibleTo(user) {
+			alerts = append(alerts, a)
+		}
+		return nil
+	})
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].CreatedAt > alerts[j].CreatedAt })
+	return alerts, err
+}
+
+// NOTIFICATIONS
+
+// getNotifications lists alerts for the notifications center. ?unread=true
+// leaves out read ones; ?limit caps the list (default 50).
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	var alerts []Alert
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		alerts, err = visibleAlerts(r, tx)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	lang := requestLanguage(r)
+	list := []Alert{}
+	for _, a := range alerts {
+		if unreadOnly && a.ReadAt != "" {
+			continue
+		}
+		if len(list) == limit {
+			break
+		}
+		list = append(list, a.localized(lang))
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// getUnreadCount returns the unread total and a breakdown by alert type,
+// for badges
+func getUnreadCount(w http.ResponseWriter, r *http.Request) {
+	var alerts []Alert
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		alerts, err = visibleAlerts(r, tx)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	total := 0
+	byType := map[string]int{}
+	for _, a := range alerts {
+		if a.ReadAt == "" {
+			total++
+			byType[a.Type]++
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"unread": total, "byType": byType})
+}
+
+func markNotificationRead(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var alert Alert
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(alertsBucket))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &alert); err != nil {
+			return err
+		}
+		if !alert.visibleTo(authUser(r)) {
+			return errNotFound
+		}
+		if alert.ReadAt != "" {
+			return nil
+		}
+		alert.ReadAt = time.Now().Format(time.RFC3339)
+		data, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "notification not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, alert.localized(requestLanguage(r)))
+}
+
+// markAllNotificationsRead marks the caller's alerts read
+func markAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().Format(time.RFC3339)
+	user := authUser(r)
+	var n int
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		n, err = rewriteRecords(tx, alertsBucket, func(a *Alert) {
+			if a.ReadAt == "" && a.visibleTo(user) {
+				a.ReadAt = now
+			}
+		})
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]int{"marked": n})
+}
+
+func getNotificationMutes(w http.ResponseWriter, r *http.Request) {
+	types := []string{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		for t := range loadMutes(tx) {
+			types = append(types, t)
+		}
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Strings(types)
+	respondJSON(w, http.StatusOK, types)
+}
+
+// setNotificationMute mutes an alert type on PUT and unmutes it on DELETE
+func setNotificationMute(w http.ResponseWriter, r *http.Request) {
+	alertType := mux.Vars(r)["type"]
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		mutes := loadMutes(tx)
+		if r.Method == http.MethodDelete {
+			delete(mutes, alertType)
+		} else {
+			mutes[alertType] = true
+		}
+		return saveMutes(tx, mutes)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	getNotificationMutes(w, r)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOperation describes the bodies of one route for the OpenAPI document
+type apiOperation struct {
+	summary  string
+	request  interface{} // the JSON body read, nil for none
+	response interface{} // the JSON body of a success, nil when not JSON or not described
+	status   int         // of a success, 200 when zero
+}
+
+// apiOperations describe routes by method and path below /api. Routes left
+// out are still documented, with untyped bodies.
+var apiOperations = map[string]apiOperation{
+	"POST /auth/register": {summary: "Register a member", request: registerRequest{}, response: authResponse{}, status: http.StatusCreated},
+	"POST /auth/login":    {summary: "Sign in", request: loginRequest{}, response: authResponse{}},
+
+	"GET /expenses":                  {summary: "List expenses", response: []Expense{}},
+	"POST /expenses":                 {summary: "Record an expense", request: Expense{}, response: Expense{}, status: http.StatusCreated},
+	"GET /expenses/{id}":             {summary: "Get an expense", response: Expense{}},
+	"PUT /expenses/{id}":             {summary: "Edit an expense", request: Expense{}, response: Expense{}},
+	"GET /expenses/breakdown":        {summary: "Break expenses down by a dimension", response: []BreakdownGroup{}},
+	"GET /expenses/duplicates":       {summary: "Find expenses that look recorded twice", response: []DuplicateGroup{}},
+	"POST /expenses/{id}/merge":      {summary: "Merge duplicates into an expense", request: ExpenseMerge{}, response: Expense{}},
+	"GET /expenses/{id}/comments":    {summary: "List an expense's comments", response: []ExpenseComment{}},
+	"POST /expenses/{id}/comments":   {summary: "Comment on an expense", request: ExpenseComment{}, response: ExpenseComment{}, status: http.StatusCreated},
+	"GET /expenses/{id}/attachments": {summary: "List an expense's attachments", response: []Attachment{}},
+
+	"GET /balances":               {summary: "Shared expense balances between members", response: []Balance{}},
+	"GET /settlements":            {summary: "Member balances and the payments that settle them", response: Settlements{}},
+	"GET /transfers":              {summary: "List recorded settlements", response: []Transfer{}},
+	"GET /debts":                  {summary: "List debts", response: []Debt{}},
+	"POST /debts":                 {summary: "Record a debt", request: Debt{}, response: Debt{}, status: http.StatusCreated},
+	"PUT /debts/{id}":             {summary: "Edit a debt", request: Debt{}, response: Debt{}},
+	"POST /debts/{id}/repayments": {summary: "Record a repayment", request: paymentRequest{}, response: Debt{}, status: http.StatusCreated},
+
+	"GET /allowances":              {summary: "List allowances", response: []AllowanceRule{}},
+	"POST /allowances":             {summary: "Set up an allowance", request: AllowanceRule{}, response: AllowanceRule{}, status: http.StatusCreated},
+	"PUT /allowances/{id}":         {summary: "Edit an allowance", request: AllowanceRule{}, response: AllowanceRule{}},
+	"GET /allowances/{id}/balance": {summary: "An allowance's balance", response: AllowanceBalance{}},
+
+	"GET /planned-purchases":           {summary: "List planned purchases", response: []PlannedPurchase{}},
+	"POST /planned-purchases":          {summary: "Plan a purchase", request: PlannedPurchase{}, response: PlannedPurchase{}, status: http.StatusCreated},
+	"PUT /planned-purchases/{id}":      {summary: "Edit a planned purchase", request: PlannedPurchase{}, response: PlannedPurchase{}},
+	"POST /planned-purchases/{id}/buy": {summary: "Record a planned purchase as bought", request: buyRequest{}, status: http.StatusCreated},
+
+	"GET /reports/monthly":       {summary: "Monthly report", response: MonthlyReport{}},
+	"GET /analytics/trends":      {summary: "Spending and income over time", response: Trends{}},
+	"GET /forecast":              {summary: "Projected balances for the coming months", response: Forecast{}},
+	"GET /networth":              {summary: "Current net worth", response: NetWorth{}},
+	"GET /networth/history":      {summary: "Net worth snapshots", response: []NetWorth{}},
+	"GET /emergency-fund":        {summary: "Emergency fund progress", response: EmergencyFund{}},
+	"PUT /emergency-fund":        {summary: "Configure the emergency fund", request: EmergencyFundConfig{}},
+	"GET /credit-scores":         {summary: "List credit scores", response: []CreditScore{}},
+	"POST /credit-scores":        {summary: "Record a credit score", request: CreditScore{}, response: CreditScore{}, status: http.StatusCreated},
+	"GET /credit-scores/history": {summary: "Credit score history per member", response: []CreditHistory{}},
+	"GET /insurance":             {summary: "List insurance policies", response: []InsurancePolicy{}},
+	"POST /insurance":            {summary: "Add an insurance policy", request: InsurancePolicy{}, response: InsurancePolicy{}, status: http.StatusCreated},
+	"PUT /insurance/{id}":        {summary: "Edit an insurance policy", request: InsurancePolicy{}, response: InsurancePolicy{}},
+	"GET /donations/report":      {summary: "Donations for a fiscal year", response: DonationReport{}},
+
+	"GET /documents":          {summary: "List documents", response: []Document{}},
+	"PUT /documents/{id}":     {summary: "Edit a document's details", request: Document{}, response: Document{}},
+	"GET /subscriptions":      {summary: "List subscriptions", response: []Subscription{}},
+	"POST /subscriptions":     {summary: "Add a subscription", request: Subscription{}, response: Subscription{}, status: http.StatusCreated},
+	"PUT /subscriptions/{id}": {summary: "Edit a subscription", request: Subscription{}, response: Subscription{}},
+	"GET /warranties":         {summary: "Purchases under warranty or return window", response: []Expense{}},
+	"POST /receipts/scan":     {summary: "Read a receipt image", response: ReceiptScan{}},
+
+	"GET /claims":                   {summary: "List reimbursement claims", response: []Claim{}},
+	"POST /claims":                  {summary: "File a claim", request: Claim{}, response: Claim{}, status: http.StatusCreated},
+	"PUT /claims/{id}":              {summary: "Edit a claim", request: Claim{}, response: Claim{}},
+	"GET /members":                  {summary: "List household members", response: []Member{}},
+	"POST /members":                 {summary: "Add a member", request: Member{}, response: Member{}, status: http.StatusCreated},
+	"GET /members/{id}":             {summary: "Get a member", response: Member{}},
+	"PUT /members/{id}":             {summary: "Edit a member's profile", request: Member{}, response: Member{}},
+	"GET /merchants":                {summary: "List merchants", response: []Merchant{}},
+	"POST /merchants":               {summary: "Add a merchant", request: Merchant{}, response: Merchant{}, status: http.StatusCreated},
+	"GET /merchants/{key}":          {summary: "Get a merchant", response: Merchant{}},
+	"PUT /merchants/{key}":          {summary: "Edit a merchant", request: Merchant{}, response: Merchant{}},
+	"GET /merchants/{key}/spending": {summary: "Sum the spending at a merchant", response: MerchantSpending{}},
+	"GET /custom-fields":            {summary: "List custom expense fields", response: []CustomField{}},
+	"POST /custom-fields":           {summary: "Add a custom expense field", request: CustomField{}, response: CustomField{}, status: http.StatusCreated},
+	"PUT /custom-fields/{key}":      {summary: "Edit a custom expense field", request: CustomField{}, response: CustomField{}},
+
+	"GET /budgets":              {summary: "List budgets", response: []Budget{}},
+	"POST /budgets":             {summary: "Set a budget", request: Budget{}, response: Budget{}, status: http.StatusCreated},
+	"PUT /budgets/{id}":         {summary: "Edit a budget", request: Budget{}, response: Budget{}},
+	"GET /budgets/{id}/history": {summary: "A budget's spending by month", response: []BudgetMonth{}},
+	"GET /goals":                {summary: "List goals", response: []Goal{}},
+	"POST /goals":               {summary: "Set a goal", request: Goal{}, response: Goal{}, status: http.StatusCreated},
+	"PUT /goals/{id}":           {summary: "Edit a goal", request: Goal{}, response: Goal{}},
+
+	"GET /investments":                    {summary: "List investments", response: []Investment{}},
+	"POST /investments":                   {summary: "Add an investment", request: Investment{}, response: Investment{}, status: http.StatusCreated},
+	"PUT /investments/{id}":               {summary: "Edit an investment", request: Investment{}, response: Investment{}},
+	"POST /investments/{id}/transactions": {summary: "Record a buy or sell", request: InvestmentTransaction{}, response: Investment{}, status: http.StatusCreated},
+
+	"GET /bills":                {summary: "List bills", response: []BillReminder{}},
+	"POST /bills":               {summary: "Add a bill", request: BillReminder{}, response: BillReminder{}, status: http.StatusCreated},
+	"GET /bills/{id}":           {summary: "Get a bill", response: BillReminder{}},
+	"PUT /bills/{id}":           {summary: "Edit a bill", request: BillReminder{}, response: BillReminder{}},
+	"POST /bills/{id}/payments": {summary: "Record a payment towards a bill", request: paymentRequest{}, response: BillReminder{}, status: http.StatusCreated},
+	"POST /bills/{id}/pay":      {summary: "Pay a bill in full", request: paymentRequest{}, response: BillReminder{}},
+
+	"GET /income":                {summary: "List income", response: []Income{}},
+	"POST /income":               {summary: "Record income", request: Income{}, response: Income{}, status: http.StatusCreated},
+	"PUT /income/{id}":           {summary: "Edit income", request: Income{}, response: Income{}},
+	"GET /income/upcoming":       {summary: "Expected recurring income", response: []ProjectedIncome{}},
+	"GET /income-sources":        {summary: "List income sources", response: []IncomeSource{}},
+	"POST /income-sources":       {summary: "Add an income source", request: IncomeSource{}, response: IncomeSource{}, status: http.StatusCreated},
+	"PUT /income-sources/{id}":   {summary: "Edit an income source", request: IncomeSource{}, response: IncomeSource{}},
+	"GET /accounts":              {summary: "List accounts with balances", response: []Account{}},
+	"POST /accounts":             {summary: "Add an account", request: Account{}, response: Account{}, status: http.StatusCreated},
+	"PUT /accounts/{id}":         {summary: "Edit an account", request: Account{}, response: Account{}},
+	"GET /accounts/{id}/balance": {summary: "An account's balance", response: AccountBalance{}},
+
+	"POST /import/csv":     {summary: "Preview a statement import", response: CSVImport{}},
+	"GET /import/csv/{id}": {summary: "Get an import preview", response: CSVImport{}},
+
+	"GET /search":                   {summary: "Search expenses, income and bills", response: []SearchResult{}},
+	"GET /tags":                     {summary: "Tags in use", response: []TagUsage{}},
+	"GET /rules":                    {summary: "List categorization rules", response: []CategoryRule{}},
+	"POST /rules":                   {summary: "Add a categorization rule", request: CategoryRule{}, response: CategoryRule{}, status: http.StatusCreated},
+	"PUT /rules/{id}":               {summary: "Edit a categorization rule", request: CategoryRule{}, response: CategoryRule{}},
+	"POST /rules/apply":             {summary: "Apply the rules to existing expenses"},
+	"GET /alerts":                   {summary: "List alerts", response: []Alert{}},
+	"GET /webhooks":                 {summary: "List webhooks", response: []Webhook{}},
+	"POST /webhooks":                {summary: "Register a webhook", request: Webhook{}, response: Webhook{}, status: http.StatusCreated},
+	"PUT /webhooks/{id}":            {summary: "Edit a webhook", request: Webhook{}, response: Webhook{}},
+	"GET /webhooks/{id}/deliveries": {summary: "A webhook's delivery log", response: []WebhookDelivery{}},
+	"GET /pending":                  {summary: "Transactions waiting for review", response: []PendingTransaction{}},
+	"POST /pending/{id}/approve":    {summary: "Approve a pending transaction as an expense", request: Expense{}, response: Expense{}, status: http.StatusCreated},
+	"POST /pending/approve":         {summary: "Approve several pending transactions", request: PendingApproval{}},
+	"POST /ingest/sms":              {summary: "Queue a bank text for review", request: SMSMessage{}, response: PendingTransaction{}, status: http.StatusCreated},
+	"GET /bank/connections":         {summary: "Linked banks", response: []BankConnection{}},
+	"GET /notifications":            {summary: "List notifications", response: []Alert{}},
+
+	"GET /me/preferences": {summary: "Your preferences", response: UserPreferences{}},
+	"PUT /me/preferences": {summary: "Change your preferences", request: UserPreferences{}, response: UserPreferences{}},
+	"GET /me/mentions":    {summary: "Comments mentioning you", response: []Mention{}},
+	"GET /settings":       {summary: "Household settings", response: Settings{}},
+	"PUT /settings":       {summary: "Change household settings", request: Settings{}, response: Settings{}},
+	"GET /features":       {summary: "Feature flags", response: map[string]bool{}},
+
+	"GET /notifications/preferences":        {summary: "Every member's notification preferences", response: []NotificationPrefs{}},
+	"GET /notifications/preferences/{user}": {summary: "A member's notification preferences", response: NotificationPrefs{}},
+	"PUT /notifications/preferences/{user}": {summary: "Change a member's notification preferences", request: NotificationPrefs{}, response: NotificationPrefs{}},
+
+	"GET /admin/jobs":             {summary: "Scheduled jobs", response: []JobStatus{}},
+	"GET /admin/retention/rules":  {summary: "List retention rules", response: []RetentionRule{}},
+	"POST /admin/retention/rules": {summary: "Add a retention rule", request: RetentionRule{}, response: RetentionRule{}, status: http.StatusCreated},
+	"GET /admin/retention/runs":   {summary: "Retention runs", response: []RetentionRun{}},
+	"GET /admin/integrity":        {summary: "Check stored data", response: IntegrityReport{}},
+	"GET /admin/dbstats":          {summary: "Database file and bucket sizes", response: DBStats{}},
+	"GET /admin/backups":          {summary: "List backups", response: []BackupInfo{}},
+	"POST /admin/backup":          {summary: "Take a backup", response: BackupInfo{}, status: http.StatusCreated},
+	"POST /admin/restore":         {summary: "Restore a backup", request: restoreRequest{}},
+	"GET /admin/maintenance":      {summary: "Maintenance mode", response: MaintenanceState{}},
+	"GET /admin/export/full":      {summary: "Download the whole store", response: FullExport{}},
+	"POST /admin/import/full":     {summary: "Replace the whole store with an export", request: FullExport{}},
+}
+
+// apiPathParam matches a mux path variable and its optional pattern
+var apiPathParam = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+// openAPISchemas builds JSON schemas for Go types from their json tags,
+// collecting named structs as components
+type openAPISchemas map[string]interface{}
+
+var (
+	moneyType = reflect.TypeOf(Money(0))
+	timeType  = reflect.TypeOf(time.Time{})
+	rawType   = reflect.TypeOf(json.RawMessage(nil))
+)
+
+func (c openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case moneyType:
+		return map[string]interface{}{"type": "number", "description": "amount in major units, such as 12.5"}
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": c.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": c.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return c.object(t)
+		}
+		name := strings.NewReplacer("[", "_", "]", "", ".", "_").Replace(t.Name())
+		if _, ok := c[name]; !ok {
+			c[name] = nil // a placeholder, for types that refer to themselves
+			c[name] = c.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object lays out a struct's exported fields as encoding/json would
+func (c openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	c.fields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (c openAPISchemas) fields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				c.fields(ft, props)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(opts, "string") {
+			props[name] = map[string]interface{}{"type": "string"}
+			continue
+		}
+		props[name] = c.schema(f.Type)
+	}
+}
+
+// buildOpenAPI documents every route of the router
+func buildOpenAPI(router *mux.Router) map[string]interface{} {
+	schemas := openAPISchemas{
+		"Error": map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+			"error": map[string]interface{}{"type": "string"},
+		}},
+	}
+	paths := map[string]map[string]interface{}{}
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // a prefix, not an endpoint
+		}
+		path := apiPathParam.ReplaceAllString(strings.TrimPrefix(tpl, "/api"), "{$1}")
+		var params []interface{}
+		for _, m := range apiPathParam.FindAllStringSubmatch(tpl, -1) {
+			params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"}})
+		}
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			if paths[path] == nil {
+				paths[path] = map[string]interface{}{}
+			}
+			paths[path][strings.ToLower(method)] = openAPIOperation(schemas, method, path, params)
+		}
+		return nil
+	})
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Family Finance API",
+			"version": "1.0",
+		},
+		"servers":  []interface{}{map[string]interface{}{"url": "/api"}},
+		"paths":    paths,
+		"security": []interface{}{map[string]interface{}{}, map[string]interface{}{"bearerAuth": []string{}}},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer",
+					"description": "a sign-in token, or ADMIN_TOKEN for /admin routes"},
+			},
+		},
+	}
+}
+
+// openAPIOperation documents one method of a path from apiOperations
+func openAPIOperation(schemas openAPISchemas, method, path string, params []interface{}) map[string]interface{} {
+	doc := apiOperations[method+" "+path]
+	tag, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	op := map[string]interface{}{"tags": []string{tag}}
+	if doc.summary != "" {
+		op["summary"] = doc.summary
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if doc.request != nil {
+		op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(doc.request))},
+		}}
+	}
+	status := doc.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if doc.response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(doc.response))},
+		}
+	}
+	op["responses"] = map[string]interface{}{
+		strconv.Itoa(status): success,
+		"default": map[string]interface{}{"description": "Error", "content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+		}},
+	}
+	return op
+}
+
+// API DOCS
+
+// openAPIHandler serves the OpenAPI document for the router's routes
+func openAPIHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, buildOpenAPI(router))
+	}
+}
+
+// apiDocsPage is Swagger UI pointed at the OpenAPI document. Its scripts
+// come from a CDN so the server does not ship them.
+const apiDocsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Family Finance API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+func getAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, apiDocsPage)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Pending transaction states
+const (
+	pendingReview   = "pending"
+	pendingApproved = "approved"
+	pendingRejected = "rejected"
+)
+
+var errAlreadyReviewed = errors.New("transaction was already approved or rejected")
+
+// pendingProblem is an approval the expense rules refuse
+type pendingProblem string
+
+func (p pendingProblem) Error() string { return string(p) }
+
+// PendingTransaction is spending read from an alert email or SMS, synced
+// from a linked bank or queued by a statement import. It waits for review
+// and only becomes an expense once approved.
+type PendingTransaction struct {
+	ID     string `json:"id"`
+	Source string `json:"source"` // email, sms, bank or import
+	// MessageID identifies the message or bank transaction it was read
+	// from, so each is queued once
+	MessageID  string `json:"messageId,omitempty"`
+	ImportID   string `json:"importId,omitempty"` // statement import it came from
+	From       string `json:"from"`               // sender address, SMS sender ID, bank or file name
+	Subject    string `json:"subject,omitempty"`
+	User       string `json:"user,omitempty"` // member it was sent to or imported for
+	ReceivedAt string `json:"receivedAt,omitempty"`
+	Bank       string `json:"bank,omitempty"`
+	Account    string `json:"account,omitempty"`   // last digits of the card or account
+	AccountID  string `json:"accountId,omitempty"` // household account, for linked banks and imports
+	Amount     Money  `json:"amount"`
+	Currency   string `json:"currency"`
+	Merchant   string `json:"merchant,omitempty"`
+	// Description is the statement's; others are described by merchant
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category,omitempty"` // the merchant's default
+	Date        string `json:"date"`
+	Status      string `json:"status"` // pending, approved or rejected
+	ExpenseID   string `json:"expenseId,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+}
+
+// PendingApproval approves several pending transactions as they are
+type PendingApproval struct {
+	IDs []string `json:"ids"`
+}
+
+// expense is the expense a pending transaction becomes
+func (p PendingTransaction) expense() Expense {
+	e := Expense{
+		Amount:      p.Amount,
+		Currency:    p.Currency,
+		Description: p.Description,
+		Category:    p.Category,
+		Merchant:    p.Merchant,
+		Date:        p.Date,
+		User:        p.User,
+		AccountID:   p.AccountID,
+	}
+	for _, d := range []string{p.Merchant, p.Subject, p.Bank + " transaction"} {
+		if e.Description == "" {
+			e.Description = d
+		}
+	}
+	if p.Account != "" {
+		e.Notes = fmt.Sprintf("%s card or account ending %s", p.Bank, p.Account)
+	}
+	return e
+}
+
+func putPendingTransaction(tx *bolt.Tx, p PendingTransaction) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(pendingBucket)).Put([]byte(p.ID), data)
+}
+
+// moveInboxDrafts moves the drafts of the old inbox bucket into the pending
+// queue: accepted drafts become approved and dismissed ones rejected
+func moveInboxDrafts(tx *bolt.Tx) (int, error) {
+	inbox := tx.Bucket([]byte("inbox"))
+	if inbox == nil {
+		return 0, nil
+	}
+	n := 0
+	err := inbox.ForEach(func(k, v []byte) error {
+		var p PendingTransaction
+		if json.Unmarshal(v, &p) != nil {
+			return nil
+		}
+		switch p.Status {
+		case "accepted":
+			p.Status = pendingApproved
+		case "dismissed":
+			p.Status = pendingRejected
+		}
+		n++
+		return putPendingTransaction(tx, p)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.DeleteBucket([]byte("inbox"))
+}
+
+// getInbox serves the mail inbox route of earlier releases from the queue.
+// Its drafts were accepted or dismissed where the queue's are approved or
+// rejected.
+func getInbox(w http.ResponseWriter, r *http.Request) {
+	r = r.Clone(r.Context())
+	q := r.URL.Query()
+	switch q.Get("status") {
+	case "accepted":
+		q.Set("status", pendingApproved)
+	case "dismissed":
+		q.Set("status", pendingRejected)
+	}
+	q.Set("source", "email")
+	r.URL.RawQuery = q.Encode()
+	getPendingTransactions(w, r)
+}
+
+// approvePending writes a pending transaction as an expense, with edits, a
+// partial expense in JSON, applied over it first. n keeps the IDs of
+// expenses approved together apart.
+func approvePending(tx *bolt.Tx, id string, edits []byte, viewer string, now time.Time, n int) (Expense, error) {
+	v := tx.Bucket([]byte(pendingBucket)).Get([]byte(id))
+	if v == nil {
+		return Expense{}, errNotFound
+	}
+	var p PendingTransaction
+	if err := json.Unmarshal(v, &p); err != nil {
+		return Expense{}, err
+	}
+	if p.Status != pendingReview {
+		return Expense{}, errAlreadyReviewed
+	}
+	e := p.expense()
+	if len(edits) > 0 {
+		if err := json.Unmarshal(edits, &e); err != nil {
+			return Expense{}, pendingProblem(err.Error())
+		}
+	}
+	if viewer != "" {
+		e.User = viewer
+	}
+	settings := currentSettings()
+	date, err := normalizeDate(e.Date, settings.location(e.User))
+	if err != nil {
+		return Expense{}, pendingProblem(err.Error())
+	}
+	if date != "" {
+		e.Date = date
+	} else {
+		e.Date = p.Date
+	}
+	if e.Currency, err = normalizeCurrency(e.Currency, settings.BaseCurrency); err != nil {
+		return Expense{}, pendingProblem(err.Error())
+	}
+	e.Amount = roundForCurrency(e.Amount, e.Currency)
+	if e.Amount <= 0 {
+		return Expense{}, pendingProblem("amount must be positive")
+	}
+	e.Tags = normalizeTags(e.Tags)
+	e.ID = fmt.Sprintf("%d", now.UnixNano()+int64(n))
+	e.CreatedAt = now.Format(time.RFC3339)
+	e.UpdatedAt = e.CreatedAt
+	if err := checkAccount(tx, e.AccountID); err != nil {
+		return Expense{}, err
+	}
+	if err := applyRules(tx, &e); err != nil {
+		return Expense{}, err
+	}
+	if err := applyMerchant(tx, &e); err != nil {
+		return Expense{}, err
+	}
+	if err := putExpense(tx, e); err != nil {
+		return Expense{}, err
+	}
+	p.Status = pendingApproved
+	p.ExpenseID = e.ID
+	p.UpdatedAt = e.CreatedAt
+	return e, putPendingTransaction(tx, p)
+}
+
+// respondPendingError writes the response for errors of reviews
+func respondPendingError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		respondError(w, http.StatusNotFound, "pending transaction not found")
+	case errAlreadyReviewed:
+		respondError(w, http.StatusConflict, err.Error())
+	case errUnknownAccount:
+		respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		if p, ok := err.(pendingProblem); ok {
+			respondError(w, http.StatusBadRequest, string(p))
+			return
+		}
+		respondStoreError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// PENDING TRANSACTIONS
+
+// getPendingTransactions lists the review queue, newest first: the
+// transactions waiting unless ?status= asks for approved, rejected or all.
+// ?source= narrows it to email, sms, bank or import.
+func getPendingTransactions(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = pendingReview
+	}
+	source := r.URL.Query().Get("source")
+	list := []PendingTransaction{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(pendingBucket)), func(k, v []byte) error {
+			var p PendingTransaction
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if (status == "all" || p.Status == status) && (source == "" || p.Source == source) {
+				list = append(list, p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Date != list[j].Date {
+			return list[i].Date > list[j].Date
+		}
+		return list[i].ID > list[j].ID
+	})
+	respondJSON(w, http.StatusOK, list)
+}
+
+// approvePendingTransaction records a pending transaction as an expense.
+// The body may correct any expense field first, such as the category or
+// the account paid from.
+func approvePendingTransaction(w http.ResponseWriter, r *http.Request) {
+	edits, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var expense Expense
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		expense, err = approvePending(tx, mux.Vars(r)["id"], edits, authUser(r), time.Now(), 0)
+		return err
+	})
+	if err != nil {
+		respondPendingError(w, err)
+		return
+	}
+	publishWebhook("expense.created", expense)
+	respondJSON(w, http.StatusCreated, expense)
+}
+
+// approvePendingTransactions approves several pending transactions as they
+// are, all or none
+func approvePendingTransactions(w http.ResponseWriter, r *http.Request) {
+	var req PendingApproval
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.IDs) == 0 {
+		respondError(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	var expenses []Expense
+	now := time.Now()
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		expenses = nil
+		for i, id := range req.IDs {
+			e, err := approvePending(tx, id, nil, authUser(r), now, i)
+			if err != nil {
+				return err
+			}
+			expenses = append(expenses, e)
+		}
+		return nil
+	})
+	if err != nil {
+		respondPendingError(w, err)
+		return
+	}
+	for _, e := range expenses {
+		publishWebhook("expense.created", e)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"approved": len(expenses), "expenses": expenses})
+}
+
+// rejectPendingTransaction sets a pending transaction aside. It is kept, so
+// the same message or bank transaction is not queued again.
+func rejectPendingTransaction(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		v := tx.Bucket([]byte(pendingBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		var p PendingTransaction
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		if p.Status != pendingReview {
+			return errAlreadyReviewed
+		}
+		j.track(pendingBucket, []byte(id))
+		p.Status = pendingRejected
+		p.UpdatedAt = time.Now().Format(time.RFC3339)
+		return putPendingTransaction(tx, p)
+	})
+	if err != nil {
+		respondPendingError(w, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Transaction rejected"})
+}
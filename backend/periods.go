@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Period is a half-open date range [Start, End) in YYYY-MM-DD form
+type Period struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// contains reports whether a canonical date falls inside the period. An
+// empty period contains everything.
+func (p Period) contains(date string) bool {
+	if p.Start == "" && p.End == "" {
+		return true
+	}
+	return date >= p.Start && date < p.End
+}
+
+// budgetPeriod returns the cycle a budget month label stands for. With a
+// start day of 25, "2026-01" runs from 25 January to 24 February.
+func budgetPeriod(month string, startDay int) (Period, error) {
+	t, err := time.Parse("2006-01", month)
+	if err != nil {
+		return Period{}, fmt.Errorf("invalid budget month %q (want YYYY-MM)", month)
+	}
+	start := time.Date(t.Year(), t.Month(), startDay, 0, 0, 0, 0, time.UTC)
+	return Period{Start: start.Format(dateLayout), End: start.AddDate(0, 1, 0).Format(dateLayout)}, nil
+}
+
+// currentBudgetMonth is the label of the budget cycle containing now. Before
+// the start day, the previous month's cycle is still running.
+func currentBudgetMonth(now time.Time, startDay int) string {
+	if now.Day() < startDay {
+		now = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+	}
+	return now.Format("2006-01")
+}
+
+// weekPeriod returns the Monday-to-Sunday week containing now
+func weekPeriod(now time.Time) Period {
+	start := time.Date(now.Year(), now.Month(), now.Day()-(int(now.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	return Period{Start: start.Format(dateLayout), End: start.AddDate(0, 0, 7).Format(dateLayout)}
+}
+
+// fiscalYear returns the financial year containing now, e.g. April to March
+func fiscalYear(now time.Time, startMonth int) Period {
+	year := now.Year()
+	if int(now.Month()) < startMonth {
+		year--
+	}
+	start := time.Date(year, time.Month(startMonth), 1, 0, 0, 0, 0, time.UTC)
+	return Period{Start: start.Format(dateLayout), End: start.AddDate(1, 0, 0).Format(dateLayout)}
+}
+
+// resolvePeriod turns a ?period= value into a date range in the household's
+// zone: "budget" is the running budget cycle, "fiscalYear" the running
+// financial year, and "" everything.
+func resolvePeriod(name string, s Settings, now time.Time) (Period, error) {
+	now = now.In(s.location(""))
+	switch name {
+	case "":
+		return Period{}, nil
+	case "budget":
+		return budgetPeriod(currentBudgetMonth(now, s.BudgetStartDay), s.BudgetStartDay)
+	case "fiscalYear":
+		return fiscalYear(now, s.FiscalYearStartMonth), nil
+	}
+	return Period{}, fmt.Errorf("unknown period %q (want budget or fiscalYear)", name)
+}
+
+// reportingPeriod returns the month, quarter or financial year a date falls
+// in, with its label: "2026-01", "FY2025-26 Q4" or "FY2025-26". Quarters
+// count from the start of the financial year.
+func reportingPeriod(date, by string, startMonth int) (string, Period, error) {
+	t, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return "", Period{}, err
+	}
+	fy := fiscalYear(t, startMonth)
+	fyStart, _ := time.Parse(dateLayout, fy.Start)
+	label := fmt.Sprintf("FY%d", fyStart.Year())
+	if startMonth > 1 {
+		label = fmt.Sprintf("FY%d-%02d", fyStart.Year(), (fyStart.Year()+1)%100)
+	}
+	switch by {
+	case "month":
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), Period{Start: start.Format(dateLayout), End: start.AddDate(0, 1, 0).Format(dateLayout)}, nil
+	case "quarter":
+		months := (t.Year()-fyStart.Year())*12 + int(t.Month()-fyStart.Month())
+		start := fyStart.AddDate(0, months/3*3, 0)
+		return fmt.Sprintf("%s Q%d", label, months/3+1), Period{Start: start.Format(dateLayout), End: start.AddDate(0, 3, 0).Format(dateLayout)}, nil
+	case "fiscalYear":
+		return label, fy, nil
+	}
+	return "", Period{}, fmt.Errorf("unknown period %q (want month, quarter or fiscalYear)", by)
+}
+
+// fiscalYearParam resolves a ?year= value, the year a financial year starts
+// in, to that year and its label. Empty means the running financial year.
+func fiscalYearParam(year string, s Settings, now time.Time) (string, Period, error) {
+	period := fiscalYear(now.In(s.location("")), s.FiscalYearStartMonth)
+	if year != "" {
+		y, err := strconv.Atoi(year)
+		if err != nil || y < 1900 || y > 9999 {
+			return "", Period{}, fmt.Errorf("year must be a year such as 2025")
+		}
+		period = fiscalYear(time.Date(y, time.Month(s.FiscalYearStartMonth), 1, 0, 0, 0, 0, time.UTC), s.FiscalYearStartMonth)
+	}
+	label, _, err := reportingPeriod(period.Start, "fiscalYear", s.FiscalYearStartMonth)
+	return label, period, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriods(t *testing.T) {
+	settings := defaultSettings()
+	settings.Timezone = "Asia/Kolkata"
+	settings.BudgetStartDay = 25
+
+	// 20:00 UTC on 24 Jan is already the 25th in India: a new budget cycle
+	now := time.Date(2026, 1, 24, 20, 0, 0, 0, time.UTC)
+	p, err := resolvePeriod("budget", settings, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Period{"2026-01-25", "2026-02-25"}); p != want {
+		t.Errorf("budget period = %+v, want %+v", p, want)
+	}
+	p, _ = resolvePeriod("budget", settings, now.Add(-2*time.Hour))
+	if want := (Period{"2025-12-25", "2026-01-25"}); p != want {
+		t.Errorf("budget period before payday = %+v, want %+v", p, want)
+	}
+
+	p, _ = resolvePeriod("fiscalYear", settings, now)
+	if want := (Period{"2025-04-01", "2026-04-01"}); p != want {
+		t.Errorf("fiscal year = %+v, want %+v", p, want)
+	}
+	// 24 Jan 2026 is a Saturday
+	if p, want := weekPeriod(now), (Period{"2026-01-19", "2026-01-26"}); p != want {
+		t.Errorf("week = %+v, want %+v", p, want)
+	}
+	if _, err := resolvePeriod("fortnight", settings, now); err == nil {
+		t.Error("unknown period accepted")
+	}
+}
+
+func TestReportingPeriod(t *testing.T) {
+	cases := []struct {
+		date, by   string
+		startMonth int
+		label      string
+		period     Period
+	}{
+		{"2026-01-15", "month", 4, "2026-01", Period{"2026-01-01", "2026-02-01"}},
+		{"2026-01-15", "quarter", 4, "FY2025-26 Q4", Period{"2026-01-01", "2026-04-01"}},
+		{"2026-04-01", "quarter", 4, "FY2026-27 Q1", Period{"2026-04-01", "2026-07-01"}},
+		{"2026-01-15", "fiscalYear", 4, "FY2025-26", Period{"2025-04-01", "2026-04-01"}},
+		{"2026-08-31", "quarter", 1, "FY2026 Q3", Period{"2026-07-01", "2026-10-01"}},
+	}
+	for _, c := range cases {
+		label, p, err := reportingPeriod(c.date, c.by, c.startMonth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label != c.label || p != c.period {
+			t.Errorf("reportingPeriod(%s, %s, %d) = %s %+v, want %s %+v", c.date, c.by, c.startMonth, label, p, c.label, c.period)
+		}
+	}
+	if _, _, err := reportingPeriod("2026-01-15", "week", 4); err == nil {
+		t.Error("unknown grouping accepted")
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var plannedPriorities = []string{"low", "medium", "high"}
+
+var errAlreadyBought = errors.New("planned purchase already bought")
+
+// PlannedPurchase is an item on the household's wishlist. Until bought, what
+// is left to save for it counts against its target month in the cash-flow
+// projection.
+type PlannedPurchase struct {
+	ID            string `json:"id"`
+	Item          string `json:"item"`
+	EstimatedCost Money  `json:"estimatedCost"`
+	Currency      string `json:"currency"`
+	TargetMonth   string `json:"targetMonth"` // YYYY-MM
+	Priority      string `json:"priority"`    // low, medium or high
+	Saved         Money  `json:"saved"`       // set aside so far
+	Notes         string `json:"notes,omitempty"`
+	User          string `json:"user,omitempty"`
+	Status        string `json:"status"` // planned or bought
+	// ExpenseID and GoalID are the records made when it was bought
+	ExpenseID string `json:"expenseId,omitempty"`
+	GoalID    string `json:"goalId,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func (p *PlannedPurchase) validate(settings Settings) error {
+	p.Item = strings.TrimSpace(p.Item)
+	if p.Item == "" {
+		return fmt.Errorf("item is required")
+	}
+	if p.EstimatedCost <= 0 {
+		return fmt.Errorf("estimatedCost must be positive")
+	}
+	if p.Saved < 0 {
+		return fmt.Errorf("saved cannot be negative")
+	}
+	if _, err := time.Parse("2006-01", p.TargetMonth); err != nil {
+		return fmt.Errorf("targetMonth must be YYYY-MM")
+	}
+	if p.Priority == "" {
+		p.Priority = "medium"
+	}
+	if err := oneOf("priority", p.Priority, plannedPriorities); err != nil {
+		return err
+	}
+	var err error
+	if p.Currency, err = normalizeCurrency(p.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	p.EstimatedCost = roundForCurrency(p.EstimatedCost, p.Currency)
+	p.Saved = roundForCurrency(p.Saved, p.Currency)
+	return nil
+}
+
+// stillToSave is what remains to be put aside before buying
+func (p PlannedPurchase) stillToSave() Money {
+	if p.Status == "bought" || p.Saved >= p.EstimatedCost {
+		return 0
+	}
+	return p.EstimatedCost - p.Saved
+}
+
+// PLANNED PURCHASES
+
+// getPlannedPurchases lists the wishlist by target month, highest priority
+// first within a month. ?status= limits it to planned or bought items.
+func getPlannedPurchases(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	list := []PlannedPurchase{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(plannedPurchasesBucket)), func(k, v []byte) error {
+			var p PlannedPurchase
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if status == "" || p.Status == status {
+				list = append(list, p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rank := map[string]int{"high": 0, "medium": 1, "low": 2}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].TargetMonth != list[j].TargetMonth {
+			return list[i].TargetMonth < list[j].TargetMonth
+		}
+		return rank[list[i].Priority] < rank[list[j].Priority]
+	})
+	respondJSON(w, http.StatusOK, list)
+}
+
+func putPlannedPurchase(tx *bolt.Tx, p PlannedPurchase) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(plannedPurchasesBucket)).Put([]byte(p.ID), data)
+}
+
+// savePlannedPurchase stores a created or edited wishlist item. Bought items
+// keep their links and can no longer be edited.
+func savePlannedPurchase(w http.ResponseWriter, r *http.Request, p PlannedPurchase, status int) {
+	if err := p.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.Status, p.ExpenseID, p.GoalID = "planned", "", ""
+	p.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(plannedPurchasesBucket)).Get([]byte(p.ID)); v != nil {
+			var old PlannedPurchase
+			json.Unmarshal(v, &old)
+			if old.Status == "bought" {
+				return errAlreadyBought
+			}
+			p.CreatedAt = old.CreatedAt
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		return putPlannedPurchase(tx, p)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "planned purchase not found")
+	case err == errAlreadyBought:
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, status, p)
+	}
+}
+
+func createPlannedPurchase(w http.ResponseWriter, r *http.Request) {
+	var p PlannedPurchase
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if p.ID == "" {
+		p.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	p.CreatedAt = now.Format(time.RFC3339)
+	savePlannedPurchase(w, r, p, http.StatusCreated)
+}
+
+func updatePlannedPurchase(w http.ResponseWriter, r *http.Request) {
+	var p PlannedPurchase
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.ID = mux.Vars(r)["id"]
+	savePlannedPurchase(w, r, p, http.StatusOK)
+}
+
+func deletePlannedPurchase(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(plannedPurchasesBucket, []byte(id))
+		return tx.Bucket([]byte(plannedPurchasesBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Planned purchase deleted"})
+}
+
+// buyRequest is the body of POST /api/planned-purchases/{id}/buy. The
+// amount defaults to the estimated cost and the date to today.
+type buyRequest struct {
+	Amount   Money  `json:"amount"`
+	Date     string `json:"date"`
+	Category string `json:"category"`
+	Merchant string `json:"merchant"`
+	User     string `json:"user"`
+}
+
+// buyPlannedPurchase turns a wishlist item into the expense of buying it and
+// a goal recording what was saved towards it, in one transaction. The goal
+// completes when the savings covered the price; otherwise it stays active
+// for the shortfall.
+func buyPlannedPurchase(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req buyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Amount < 0 {
+		respondError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	loc := currentSettings().location(req.User)
+	date, err := normalizeDate(req.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+
+	var p PlannedPurchase
+	var expense Expense
+	var goal Goal
+	completed := false
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(plannedPurchasesBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		if p.Status == "bought" {
+			return errAlreadyBought
+		}
+		now := time.Now()
+		user := req.User
+		if user == "" {
+			user = p.User
+		}
+		amount := req.Amount
+		if amount == 0 {
+			amount = p.EstimatedCost
+		}
+		expense = Expense{
+			ID:          fmt.Sprintf("%d", now.UnixNano()),
+			Amount:      roundForCurrency(amount, p.Currency),
+			Currency:    p.Currency,
+			Description: p.Item,
+			Category:    req.Category,
+			Merchant:    strings.TrimSpace(req.Merchant),
+			Date:        date,
+			User:        user,
+			Notes:       p.Notes,
+			CreatedAt:   now.Format(time.RFC3339),
+		}
+		expense.UpdatedAt = expense.CreatedAt
+		if err := applyMerchant(tx, &expense); err != nil {
+			return err
+		}
+		if err := putExpense(tx, expense); err != nil {
+			return err
+		}
+		goal = Goal{
+			ID:       fmt.Sprintf("%d", now.UnixNano()+1),
+			Name:     p.Item,
+			Target:   expense.Amount,
+			Current:  p.Saved,
+			Currency: p.Currency,
+			Deadline: date,
+		}
+		completed = goal.applyLifecycle(nil, now)
+		data, err := json.Marshal(goal)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(goalsBucket)).Put([]byte(goal.ID), data); err != nil {
+			return err
+		}
+		p.Status, p.ExpenseID, p.GoalID = "bought", expense.ID, goal.ID
+		p.UpdatedAt = now.Format(time.RFC3339)
+		return putPlannedPurchase(tx, p)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "planned purchase not found")
+		return
+	case err == errAlreadyBought:
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if completed {
+		goalCompletedAlert(goal)
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"plannedPurchase": p, "expense": expense, "goal": goal})
+}
+
+// CASH FLOW
+
+// CashFlowMonth is the projected money in and out of one month, in the base
+// currency
+type CashFlowMonth struct {
+	Month   string `json:"month"` // YYYY-MM
+	Income  Money  `json:"income"`
+	Bills   Money  `json:"bills"`   // unpaid bill balances due
+	Planned Money  `json:"planned"` // still to save for planned purchases
+	Net     Money  `json:"net"`
+}
+
+// getCashFlow projects the coming ?months= (default 6, the current one
+// included) from recurring income, unpaid bills and planned purchases.
+// Overdue bills and planned purchases whose month has passed count in the
+// current month.
+func getCashFlow(w http.ResponseWriter, r *http.Request) {
+	count := 6
+	if v := r.URL.Query().Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 24 {
+			respondError(w, http.StatusBadRequest, "months must be between 1 and 24")
+			return
+		}
+		count = n
+	}
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	now := time.Now().In(settings.location(""))
+	from := now.Format(dateLayout)
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	until := first.AddDate(0, count, -1).Format(dateLayout)
+
+	months := make([]CashFlowMonth, count)
+	index := map[string]int{}
+	for i := range months {
+		months[i].Month = first.AddDate(0, i, 0).Format("2006-01")
+		index[months[i].Month] = i
+	}
+	// month finds the projection a date or month falls in; earlier ones
+	// count now
+	month := func(date string) *CashFlowMonth {
+		if len(date) < 7 || date[:7] < months[0].Month {
+			return &months[0]
+		}
+		if i, ok := index[date[:7]]; ok {
+			return &months[i]
+		}
+		return nil
+	}
+
+	var incomes []Income
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		err := forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var income Income
+			if json.Unmarshal(v, &income) == nil {
+				incomes = append(incomes, income)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEach(r.Context(), tx.Bucket([]byte(billsBucket)), func(k, v []byte) error {
+			var bill BillReminder
+			if json.Unmarshal(v, &bill) != nil {
+				return nil
+			}
+			bill.refresh(from)
+			if m := month(bill.DueDate); m != nil && bill.Status != "paid" {
+				conv.add(&m.Bills, bill.Remaining, bill.Currency)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(plannedPurchasesBucket)), func(k, v []byte) error {
+			var p PlannedPurchase
+			if json.Unmarshal(v, &p) != nil {
+				return nil
+			}
+			if m := month(p.TargetMonth); m != nil {
+				conv.add(&m.Planned, p.stillToSave(), p.Currency)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, projected := range projectIncome(incomes, from, until) {
+		if m := month(projected.Date); m != nil {
+			conv.add(&m.Income, projected.Amount, projected.Currency)
+		}
+	}
+	for i := range months {
+		months[i].Net = months[i].Income - months[i].Bills - months[i].Planned
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"currency":              settings.BaseCurrency,
+		"unconvertedCurrencies": conv.unconverted(),
+		"months":                months,
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// priceProvider looks up the latest market price of a symbol, in the
+// currency it reports
+type priceProvider interface {
+	name() string
+	quote(symbol string) (price float64, currency string, err error)
+}
+
+// priceProviders build the market-data providers investments can be
+// priced from
+var priceProviders = map[string]func(c *Config) priceProvider{
+	"yahoo":        func(c *Config) priceProvider { return yahooPrices{} },
+	"alphavantage": func(c *Config) priceProvider { return alphaVantagePrices{key: c.AlphaVantageAPIKey} },
+	"amfi":         func(c *Config) priceProvider { return amfiPrices{} },
+}
+
+// Provider endpoints; tests point them at local servers
+var (
+	yahooURL        = "https://query1.finance.yahoo.com"
+	alphaVantageURL = "https://www.alphavantage.co"
+	amfiURL         = "https://api.mfapi.in"
+)
+
+var pricesClient = &http.Client{Timeout: 15 * time.Second}
+
+// getPriceJSON fetches a provider response into v
+func getPriceJSON(u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "family-finance-api")
+	resp, err := pricesClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("price provider answered %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// yahooPrices quotes stocks and funds by Yahoo Finance ticker, e.g.
+// INFY.NS or VOO
+type yahooPrices struct{}
+
+func (yahooPrices) name() string { return "yahoo" }
+
+func (yahooPrices) quote(symbol string) (float64, string, error) {
+	var body struct {
+		Chart struct {
+			Result []struct {
+				Meta struct {
+					Currency           string  `json:"currency"`
+					RegularMarketPrice float64 `json:"regularMarketPrice"`
+				} `json:"meta"`
+			} `json:"result"`
+		} `json:"chart"`
+	}
+	if err := getPriceJSON(yahooURL+"/v8/finance/chart/"+url.PathEscape(symbol), &body); err != nil {
+		return 0, "", err
+	}
+	if len(body.Chart.Result) == 0 || body.Chart.Result[0].Meta.RegularMarketPrice <= 0 {
+		return 0, "", fmt.Errorf("no price for %s", symbol)
+	}
+	meta := body.Chart.Result[0].Meta
+	return meta.RegularMarketPrice, meta.Currency, nil
+}
+
+// alphaVantagePrices quotes by Alpha Vantage symbol, e.g. RELIANCE.BSE.
+// Alpha Vantage does not say which currency a quote is in.
+type alphaVantagePrices struct {
+	key string
+}
+
+func (alphaVantagePrices) name() string { return "alphavantage" }
+
+func (p alphaVantagePrices) quote(symbol string) (float64, string, error) {
+	var body struct {
+		Quote map[string]string `json:"Global Quote"`
+	}
+	q := url.Values{"function": {"GLOBAL_QUOTE"}, "symbol": {symbol}, "apikey": {p.key}}
+	if err := getPriceJSON(alphaVantageURL+"/query?"+q.Encode(), &body); err != nil {
+		return 0, "", err
+	}
+	price, err := strconv.ParseFloat(body.Quote["05. price"], 64)
+	if err != nil || price <= 0 {
+		return 0, "", fmt.Errorf("no price for %s", symbol)
+	}
+	return price, "", nil
+}
+
+// amfiPrices gives the latest NAV of an Indian mutual fund by its AMFI
+// scheme code, e.g. 120503
+type amfiPrices struct{}
+
+func (amfiPrices) name() string { return "amfi" }
+
+func (amfiPrices) quote(symbol string) (float64, string, error) {
+	var body struct {
+		Data []struct {
+			NAV string `json:"nav"`
+		} `json:"data"`
+	}
+	if err := getPriceJSON(amfiURL+"/mf/"+url.PathEscape(symbol)+"/latest", &body); err != nil {
+		return 0, "", err
+	}
+	if len(body.Data) == 0 {
+		return 0, "", fmt.Errorf("no NAV for scheme %s", symbol)
+	}
+	nav, err := strconv.ParseFloat(body.Data[0].NAV, 64)
+	if err != nil || nav <= 0 {
+		return 0, "", fmt.Errorf("no NAV for scheme %s", symbol)
+	}
+	return nav, "INR", nil
+}
+
+// validatePricing checks the market-data fields of an investment
+func (inv *Investment) validatePricing() error {
+	inv.Symbol = strings.TrimSpace(inv.Symbol)
+	if inv.Units < 0 {
+		return fmt.Errorf("units cannot be negative")
+	}
+	if inv.PriceProvider != "" {
+		if _, ok := priceProviders[inv.PriceProvider]; !ok {
+			return fmt.Errorf("priceProvider must be one of alphavantage, amfi, yahoo")
+		}
+	}
+	return nil
+}
+
+// reprice values an investment at a unit price in its own currency
+func (inv *Investment) reprice(price float64, at string) {
+	inv.Price = price
+	inv.PricedAt = at
+	inv.Value = roundForCurrency(moneyFromFloat(inv.Units*price), inv.Currency)
+	inv.computeReturns()
+}
+
+// PriceRefresh reports a refresh of investment prices
+type PriceRefresh struct {
+	Updated []Investment      `json:"updated"`
+	Failed  map[string]string `json:"failed"` // investment ID to what went wrong
+}
+
+// refreshPrices prices every investment with a symbol and units from its
+// provider, or the configured default. Quotes in another currency are
+// converted at the household's rates.
+func refreshPrices() (PriceRefresh, error) {
+	report := PriceRefresh{Updated: []Investment{}, Failed: map[string]string{}}
+	var investments []Investment
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(investmentsBucket)).ForEach(func(k, v []byte) error {
+			var inv Investment
+			if json.Unmarshal(v, &inv) == nil && inv.Symbol != "" && inv.Units > 0 {
+				investments = append(investments, inv)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(investments) == 0 {
+		return report, err
+	}
+
+	c := config()
+	settings := currentSettings()
+	now := time.Now().Format(time.RFC3339)
+	priced := map[string]Investment{}
+	for _, inv := range investments {
+		name := inv.PriceProvider
+		if name == "" {
+			name = c.PriceProvider
+		}
+		build, ok := priceProviders[name]
+		if !ok {
+			report.Failed[inv.ID] = "no price provider configured"
+			continue
+		}
+		price, currency, err := build(c).quote(inv.Symbol)
+		if err != nil {
+			report.Failed[inv.ID] = err.Error()
+			continue
+		}
+		if currency = strings.ToUpper(currency); currency != "" && currency != inv.Currency {
+			from, ok1 := settings.rate(currency)
+			to, ok2 := settings.rate(inv.Currency)
+			if !ok1 || !ok2 {
+				report.Failed[inv.ID] = fmt.Sprintf("no exchange rate between %s and %s", currency, inv.Currency)
+				continue
+			}
+			price = price * from / to
+		}
+		inv.reprice(price, now)
+		priced[inv.ID] = inv
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(investmentsBucket))
+		for id, inv := range priced {
+			// Keep edits made while quotes were being fetched, other than
+			// the price itself
+			var current Investment
+			v := b.Get([]byte(id))
+			if v == nil || json.Unmarshal(v, &current) != nil {
+				continue
+			}
+			current.reprice(inv.Price, inv.PricedAt)
+			data, err := json.Marshal(current)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+			report.Updated = append(report.Updated, current)
+		}
+		return nil
+	})
+	sort.Slice(report.Updated, func(i, j int) bool { return report.Updated[i].ID < report.Updated[j].ID })
+	return report, err
+}
+
+// refreshInvestmentPrices is the scheduled price refresh
+func refreshInvestmentPrices() error {
+	report, err := refreshPrices()
+	if err != nil {
+		return err
+	}
+	logger("scheduler").Info("refreshed investment prices", "updated", len(report.Updated), "failed", len(report.Failed))
+	return nil
+}
+
+// refreshInvestmentsHandler prices investments now rather than waiting for
+// the scheduled refresh
+func refreshInvestmentsHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := refreshPrices()
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
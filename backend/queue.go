@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Task is a unit of slow background work persisted in the queue bucket
+type Task struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       string          `json:"runAt"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   string          `json:"createdAt"`
+	UpdatedAt   string          `json:"updatedAt"`
+}
+
+const (
+	taskBaseBackoff = 2 * time.Second
+	taskMaxBackoff  = time.Hour
+)
+
+var taskQueue = struct {
+	mu       sync.Mutex
+	handlers map[string]func(payload json.RawMessage) error
+	inflight map[string]bool
+	wake     chan struct{}
+}{
+	handlers: map[string]func(payload json.RawMessage) error{},
+	inflight: map[string]bool{},
+	wake:     make(chan struct{}, 1),
+}
+
+// registerTaskHandler sets the function that processes tasks of a type.
+// Returning an error schedules a retry with exponential backoff.
+func registerTaskHandler(taskType string, fn func(payload json.RawMessage) error) {
+	taskQueue.mu.Lock()
+	defer taskQueue.mu.Unlock()
+	taskQueue.handlers[taskType] = fn
+}
+
+// enqueueTask persists a task for asynchronous processing
+func enqueueTask(taskType string, payload interface{}) (*Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	task := Task{
+		ID:          fmt.Sprintf("%d", now.UnixNano()),
+		Type:        taskType,
+		Payload:     data,
+		MaxAttempts: config().QueueMaxAttempts,
+		RunAt:       now.Format(time.RFC3339Nano),
+		CreatedAt:   now.Format(time.RFC3339),
+		UpdatedAt:   now.Format(time.RFC3339),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(queueBucket)).Put([]byte(task.ID), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case taskQueue.wake <- struct{}{}:
+	default:
+	}
+	return &task, nil
+}
+
+// startQueue launches the dispatcher and the configured number of workers
+func startQueue() {
+	workers := config().QueueWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	tasks := make(chan Task)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range tasks {
+				processTask(task)
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			// Paused during maintenance; tasks wait in the bucket
+			if !inMaintenance() {
+				for _, task := range dueTasks() {
+					tasks <- task
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-taskQueue.wake:
+			}
+		}
+	}()
+}
+
+// dueTasks claims every task whose RunAt has passed and is not already
+// being processed.
+func dueTasks() []Task {
+	now := time.Now()
+	var due []Task
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(queueBucket)).ForEach(func(k, v []byte) error {
+			var task Task
+			if err := json.Unmarshal(v, &task); err != nil {
+				return nil // Skip malformed tasks
+			}
+			runAt, err := time.Parse(time.RFC3339Nano, task.RunAt)
+			if err == nil && runAt.After(now) {
+				return nil
+			}
+			due = append(due, task)
+			return nil
+		})
+	})
+
+	taskQueue.mu.Lock()
+	defer taskQueue.mu.Unlock()
+	claimed := due[:0]
+	for _, task := range due {
+		if !taskQueue.inflight[task.ID] {
+			taskQueue.inflight[task.ID] = true
+			claimed = append(claimed, task)
+		}
+	}
+	return claimed
+}
+
+func processTask(task Task) {
+	defer func() {
+		taskQueue.mu.Lock()
+		delete(taskQueue.inflight, task.ID)
+		taskQueue.mu.Unlock()
+	}()
+
+	taskQueue.mu.Lock()
+	handler := taskQueue.handlers[task.Type]
+	taskQueue.mu.Unlock()
+
+	_, span := startSpan(context.Background(), "task "+task.Type,
+		attribute.String("task.id", task.ID), attribute.Int("task.attempt", task.Attempts+1))
+	var err error
+	if handler == nil {
+		err = fmt.Errorf("no handler registered for task type %q", task.Type)
+	} else {
+		err = func() (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("panic: %v", p)
+				}
+			}()
+			return handler(task.Payload)
+		}()
+	}
+	endSpan(span, err)
+
+	dbErr := db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket([]byte(queueBucket))
+		if err == nil {
+			return queue.Delete([]byte(task.ID))
+		}
+
+		now := time.Now()
+		task.Attempts++
+		task.LastError = err.Error()
+		task.UpdatedAt = now.Format(time.RFC3339)
+		if task.MaxAttempts > 0 && task.Attempts >= task.MaxAttempts {
+			logger("queue").Warn("task moved to dead letters", "task", task.ID, "type", task.Type, "attempts", task.Attempts, "err", err)
+			data, err := json.Marshal(task)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(deadLettersBucket)).Put([]byte(task.ID), data); err != nil {
+				return err
+			}
+			return queue.Delete([]byte(task.ID))
+		}
+
+		task.RunAt = now.Add(taskBackoff(task.Attempts)).Format(time.RFC3339Nano)
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		return queue.Put([]byte(task.ID), data)
+	})
+	if dbErr != nil {
+		logger("queue").Error("recording task result", "task", task.ID, "err", dbErr)
+	}
+}
+
+// taskBackoff doubles the delay per attempt with up to 20% jitter
+func taskBackoff(attempts int) time.Duration {
+	d := taskBaseBackoff
+	for i := 1; i < attempts && d < taskMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > taskMaxBackoff {
+		d = taskMaxBackoff
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+func listTasks(ctx context.Context, bucket string) ([]Task, error) {
+	tasks := []Task{}
+	err := viewContext(ctx, func(tx *bolt.Tx) error {
+		return forEach(ctx, tx.Bucket([]byte(bucket)), func(k, v []byte) error {
+			var task Task
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+// ADMIN: QUEUE
+
+func getQueuedTasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := listTasks(r.Context(), queueBucket)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, tasks)
+}
+
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	tasks, err := listTasks(r.Context(), deadLettersBucket)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, tasks)
+}
+
+func retryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var task Task
+	err := db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket([]byte(deadLettersBucket))
+		v := dead.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &task); err != nil {
+			return err
+		}
+		now := time.Now()
+		task.Attempts = 0
+		task.RunAt = now.Format(time.RFC3339Nano)
+		task.UpdatedAt = now.Format(time.RFC3339)
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(queueBucket)).Put([]byte(id), data); err != nil {
+			return err
+		}
+		return dead.Delete([]byte(id))
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "dead letter not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	select {
+	case taskQueue.wake <- struct{}{}:
+	default:
+	}
+	respondJSON(w, http.StatusOK, task)
+}
+
+func deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deadLettersBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Dead letter deleted"})
+}
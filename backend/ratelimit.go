@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// visitor is a token bucket for one client address
+type visitor struct {
+	tokens float64
+	seen   time.Time
+}
+
+var limiter = struct {
+	mu       sync.Mutex
+	visitors map[string]*visitor
+	swept    time.Time
+}{visitors: map[string]*visitor{}}
+
+// visitorIP identifies the client for rate limiting, using the proxy's
+// X-Forwarded-For only when proxy headers are trusted.
+func visitorIP(r *http.Request) string {
+	if config().TrustProxyHeaders {
+		if ip := firstHeaderValue(r.Header.Get("X-Forwarded-For")); ip != "" {
+			return ip
+		}
+	}
+	return clientIP(r)
+}
+
+// allowRequest takes a token from the client's bucket. It returns how long
+// to wait when the bucket is empty.
+func allowRequest(ip string, perMinute int, now time.Time) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	// Forget idle visitors now and then so the map doesn't grow forever
+	if now.Sub(limiter.swept) > 10*time.Minute {
+		for key, v := range limiter.visitors {
+			if now.Sub(v.seen) > 10*time.Minute {
+				delete(limiter.visitors, key)
+			}
+		}
+		limiter.swept = now
+	}
+
+	capacity := float64(perMinute)
+	v := limiter.visitors[ip]
+	if v == nil {
+		v = &visitor{tokens: capacity, seen: now}
+		limiter.visitors[ip] = v
+	}
+	v.tokens = math.Min(capacity, v.tokens+now.Sub(v.seen).Minutes()*capacity)
+	v.seen = now
+	if v.tokens < 1 {
+		wait := time.Duration((1 - v.tokens) / capacity * float64(time.Minute))
+		return false, wait
+	}
+	v.tokens--
+	return true, 0
+}
+
+// rateLimitMiddleware caps requests per client per minute; 0 disables it
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perMinute := config().RateLimitPerMinute
+		if perMinute <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := allowRequest(visitorIP(r), perMinute, time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// rateProvider fetches exchange rates for a base currency: the value of one
+// unit of each other currency in the base currency
+type rateProvider interface {
+	name() string
+	rates(base string) (map[string]float64, error)
+}
+
+// rateProviders build the provider named by the exchangeRatesProvider
+// setting
+var rateProviders = map[string]func(c *Config) rateProvider{
+	"http": func(c *Config) rateProvider { return httpRates{url: c.ExchangeRatesURL} },
+}
+
+// configuredRateProvider is the provider rates are fetched from, or nil
+// when rates are only entered by hand
+func configuredRateProvider() rateProvider {
+	c := config()
+	if build, ok := rateProviders[c.ExchangeRatesProvider]; ok {
+		return build(c)
+	}
+	return nil
+}
+
+var ratesClient = &http.Client{Timeout: 10 * time.Second}
+
+// httpRates reads rates from a JSON API answering {"rates": {"USD": 0.012}}
+// with the units of each currency one unit of the base buys, as
+// exchangerate-api.com and similar services do. "{base}" in the URL is
+// replaced by the base currency.
+type httpRates struct {
+	url string
+}
+
+func (httpRates) name() string { return "http" }
+
+func (p httpRates) rates(base string) (map[string]float64, error) {
+	resp, err := ratesClient.Get(strings.ReplaceAll(p.url, "{base}", base))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rates provider answered %s", resp.Status)
+	}
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("reading rates: %w", err)
+	}
+	rates := map[string]float64{}
+	for code, perBase := range body.Rates {
+		if perBase > 0 {
+			rates[strings.ToUpper(code)] = 1 / perBase
+		}
+	}
+	return rates, nil
+}
+
+// FetchedRate is an exchange rate cached from the provider
+type FetchedRate struct {
+	Currency  string  `json:"currency"`
+	Base      string  `json:"base"`
+	Rate      float64 `json:"rate"` // value of one unit in the base currency
+	Provider  string  `json:"provider"`
+	FetchedAt string  `json:"fetchedAt"`
+}
+
+// loadFetchedRates returns the cached rates for a base currency. Rates
+// fetched for an earlier base currency are ignored until the next refresh.
+func loadFetchedRates(tx *bolt.Tx, base string) map[string]float64 {
+	rates := map[string]float64{}
+	b := tx.Bucket([]byte(exchangeRatesBucket))
+	if b == nil {
+		return rates
+	}
+	b.ForEach(func(k, v []byte) error {
+		var r FetchedRate
+		if json.Unmarshal(v, &r) == nil && r.Base == base {
+			rates[r.Currency] = r.Rate
+		}
+		return nil
+	})
+	return rates
+}
+
+// refreshExchangeRates replaces the cached rates with the provider's
+// current ones for the base currency. Without a provider it does nothing.
+func refreshExchangeRates() error {
+	p := configuredRateProvider()
+	if p == nil {
+		return nil
+	}
+	base := currentSettings().BaseCurrency
+	rates, err := p.rates(base)
+	if err != nil {
+		return fmt.Errorf("fetching exchange rates from %s: %w", p.name(), err)
+	}
+	now := time.Now().Format(time.RFC3339)
+	stored := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(exchangeRatesBucket)); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(exchangeRatesBucket))
+		if err != nil {
+			return err
+		}
+		for code, rate := range rates {
+			if !iso4217[code] || code == base {
+				continue
+			}
+			data, err := json.Marshal(FetchedRate{Currency: code, Base: base, Rate: rate, Provider: p.name(), FetchedAt: now})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(code), data); err != nil {
+				return err
+			}
+			stored++
+		}
+		return nil
+	})
+	if err == nil {
+		logger("scheduler").Info("refreshed exchange rates", "provider", p.name(), "base", base, "rates", stored)
+	}
+	return err
+}
+
+// ExchangeRate is a rate in use and where it came from
+type ExchangeRate struct {
+	Currency  string  `json:"currency"`
+	Rate      float64 `json:"rate"`   // value of one unit in the base currency
+	Source    string  `json:"source"` // "manual" for settings, else the provider
+	FetchedAt string  `json:"fetchedAt,omitempty"`
+}
+
+// EXCHANGE RATES
+
+// getExchangeRates lists the rates totals are converted with. Rates set in
+// the household settings override fetched ones.
+func getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	var settings Settings
+	rates := []ExchangeRate{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		settings = loadSettings(tx)
+		for code, rate := range settings.ExchangeRates {
+			rates = append(rates, ExchangeRate{Currency: code, Rate: rate, Source: "manual"})
+		}
+		return tx.Bucket([]byte(exchangeRatesBucket)).ForEach(func(k, v []byte) error {
+			var f FetchedRate
+			if json.Unmarshal(v, &f) != nil || f.Base != settings.BaseCurrency {
+				return nil
+			}
+			if _, manual := settings.ExchangeRates[f.Currency]; !manual {
+				rates = append(rates, ExchangeRate{Currency: f.Currency, Rate: f.Rate, Source: f.Provider, FetchedAt: f.FetchedAt})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Currency < rates[j].Currency })
+	provider := ""
+	if p := configuredRateProvider(); p != nil {
+		provider = p.name()
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"base":     settings.BaseCurrency,
+		"provider": provider,
+		"rates":    rates,
+	})
+}
+
+// refreshExchangeRatesHandler fetches rates from the provider now rather
+// than waiting for the scheduled refresh
+func refreshExchangeRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if configuredRateProvider() == nil {
+		respondError(w, http.StatusBadRequest, "no exchange rate provider is configured")
+		return
+	}
+	if err := refreshExchangeRates(); err != nil {
+		respondError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	getExchangeRates(w, r)
+}
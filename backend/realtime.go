@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// ChangeEvent tells connected clients that a record was created, updated
+// or deleted, so they can refetch it. It carries no record data: clients
+// load what they are allowed to see through the API.
+type ChangeEvent struct {
+	Entity string `json:"entity"` // collection changed, e.g. "expenses"
+	ID     string `json:"id,omitempty"`
+	Action string `json:"action"` // created, updated or deleted
+	Path   string `json:"path"`
+	Actor  string `json:"actor"`
+	Time   string `json:"time"`
+}
+
+// eventBacklog is how many events a client may fall behind by before
+// further ones are dropped for it
+const eventBacklog = 64
+
+// eventHub fans change events out to the connected clients
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan ChangeEvent]struct{}
+}
+
+var events = &eventHub{clients: map[chan ChangeEvent]struct{}{}}
+
+func (h *eventHub) subscribe() chan ChangeEvent {
+	ch := make(chan ChangeEvent, eventBacklog)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan ChangeEvent) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) listening() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients) > 0
+}
+
+// closeAll disconnects every client, for shutdown
+func (h *eventHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// publish sends an event to every client without waiting on slow ones
+func (h *eventHub) publish(e ChangeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+			logger("events").Warn("event dropped, client too far behind", "entity", e.Entity, "id", e.ID)
+		}
+	}
+}
+
+// createdRecorder keeps the start of a response body, where a created
+// record's ID is
+type createdRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (c *createdRecorder) Write(p []byte) (int, error) {
+	if room := 64<<10 - c.body.Len(); room > 0 {
+		c.body.Write(p[:min(len(p), room)])
+	}
+	return c.statusRecorder.Write(p)
+}
+
+// changeEvent describes a successful write to the API from its route:
+// a POST to a collection creates, a DELETE of a record deletes, and
+// anything else updates the record or collection named
+func changeEvent(r *http.Request, created []byte) (ChangeEvent, bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	entity, _, _ := strings.Cut(path, "/")
+	if entity == "" || entity == "auth" || entity == "admin" || entity == "replication" || path == r.URL.Path {
+		return ChangeEvent{}, false
+	}
+	e := ChangeEvent{Entity: entity, ID: mux.Vars(r)["id"], Action: "updated", Path: r.URL.Path,
+		Actor: requestActor(r), Time: time.Now().Format(time.RFC3339)}
+	switch {
+	case r.Method == http.MethodPost && path == entity:
+		var record struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(created, &record)
+		e.ID, e.Action = record.ID, "created"
+	case r.Method == http.MethodDelete && strings.HasSuffix(routeTemplate(r), "/{id}"):
+		e.Action = "deleted"
+	}
+	return e, true
+}
+
+// eventsMiddleware publishes a change event for every successful write to
+// the API while clients are listening
+func eventsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWriteMethod(r.Method) || !events.listening() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &createdRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(rec, r)
+		if rec.status < 200 || rec.status > 299 {
+			return
+		}
+		if e, ok := changeEvent(r, rec.body.Bytes()); ok {
+			events.publish(e)
+		}
+	})
+}
+
+// EVENTS
+
+// eventsSocket serves /api/ws. Browsers cannot set headers on a WebSocket,
+// so a token may come as ?token=. Browsers do not apply CORS to sockets
+// either, so pages are held to the CORS policy here.
+var eventsSocket = websocket.Server{
+	Handshake: func(ws *websocket.Config, r *http.Request) error {
+		origin := r.Header.Get("Origin")
+		if origin == "" || config().allowsOrigin(origin) {
+			return nil
+		}
+		if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+			return nil // same origin
+		}
+		return fmt.Errorf("origin %s is not allowed", origin)
+	},
+	Handler: streamEvents,
+}
+
+// streamEvents sends change events to a client as JSON messages until it
+// goes away. Anything the client sends is ignored.
+func streamEvents(ws *websocket.Conn) {
+	// The server's timeouts are for requests, not long-lived sockets
+	ws.SetDeadline(time.Time{})
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
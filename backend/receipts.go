@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ocrEngine reads the text of a receipt image
+type ocrEngine interface {
+	name() string
+	recognize(ctx context.Context, image []byte, ext string) (string, error)
+}
+
+// ocrEngines build the engine named by the ocrProvider setting
+var ocrEngines = map[string]func(c *Config) ocrEngine{
+	"tesseract": func(c *Config) ocrEngine { return tesseractOCR{path: c.TesseractPath} },
+	"vision":    func(c *Config) ocrEngine { return visionOCR{key: c.VisionAPIKey} },
+}
+
+// configuredOCR is the engine receipts are read with, or nil when none is
+// set up
+func configuredOCR() ocrEngine {
+	c := config()
+	if build, ok := ocrEngines[c.OCRProvider]; ok {
+		return build(c)
+	}
+	return nil
+}
+
+// tesseractOCR runs the tesseract binary on the image
+type tesseractOCR struct {
+	path string
+}
+
+func (tesseractOCR) name() string { return "tesseract" }
+
+func (t tesseractOCR) recognize(ctx context.Context, image []byte, ext string) (string, error) {
+	f, err := os.CreateTemp("", "receipt-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(image)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.path, f.Name(), "stdout")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("tesseract: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// visionURL is the Google Cloud Vision annotate endpoint
+var visionURL = "https://vision.googleapis.com/v1/images:annotate"
+
+// visionOCR asks Google Cloud Vision to detect the image's text
+type visionOCR struct {
+	key string
+}
+
+func (visionOCR) name() string { return "vision" }
+
+func (v visionOCR) recognize(ctx context.Context, image []byte, ext string) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"requests": []interface{}{map[string]interface{}{
+			"image":    map[string]string{"content": base64.StdEncoding.EncodeToString(image)},
+			"features": []map[string]string{{"type": "DOCUMENT_TEXT_DETECTION"}},
+		}},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, visionURL+"?key="+v.key, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ratesClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Responses []struct {
+			FullTextAnnotation struct {
+				Text string `json:"text"`
+			} `json:"fullTextAnnotation"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"responses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("reading vision response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vision answered %s", resp.Status)
+	}
+	if len(result.Responses) == 0 {
+		return "", nil
+	}
+	if e := result.Responses[0].Error; e != nil {
+		return "", fmt.Errorf("vision: %s", e.Message)
+	}
+	return result.Responses[0].FullTextAnnotation.Text, nil
+}
+
+// ReceiptScan is what could be read off a receipt, to prefill an expense.
+// Fields that could not be found are left empty.
+type ReceiptScan struct {
+	Merchant string     `json:"merchant"`
+	Category string     `json:"category,omitempty"` // the merchant's usual category, when known
+	Date     string     `json:"date,omitempty"`
+	Total    Money      `json:"total"`
+	Currency string     `json:"currency"`
+	Items    []LineItem `json:"items"`
+	Text     string     `json:"text"` // everything recognized
+	Engine   string     `json:"engine"`
+}
+
+var (
+	receiptAmount   = regexp.MustCompile(`(\d{1,3}(?:,\d{2,3})+|\d+)\.(\d{2})\s*$`)
+	receiptTotal    = regexp.MustCompile(`(?i)\b(grand total|net total|net amount|amount payable|total amount|total due|total)\b`)
+	receiptSubtotal = regexp.MustCompile(`(?i)sub\s*-?\s*total`)
+	receiptQuantity = regexp.MustCompile(`(?i)^(.*?)\s+(\d+(?:\.\d+)?)\s*(?:x|@|\*)\s*(\d+(?:\.\d{1,2})?)\s*$`)
+	// Lines that carry an amount but are not goods bought
+	receiptSkip = regexp.MustCompile(`(?i)\b(sub\s*-?\s*total|total|tax|gst|cgst|sgst|igst|vat|cess|discount|round(ing)?|change|cash|card|upi|paid|balance|tender|saving|you saved|service charge)\b`)
+	// Lines at the top of a receipt that are not the merchant's name
+	receiptHeader = regexp.MustCompile(`(?i)(tax invoice|invoice|receipt|bill|gstin|phone|tel|mobile|date|welcome|www\.|@)`)
+
+	receiptYMD       = regexp.MustCompile(`\b(\d{4})[-/.](\d{1,2})[-/.](\d{1,2})\b`)
+	receiptDMY       = regexp.MustCompile(`\b(\d{1,2})[-/.](\d{1,2})[-/.](\d{2}|\d{4})\b`)
+	receiptNamedDate = regexp.MustCompile(`(?i)\b(\d{1,2})[ -]?(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*[ ,-]*(\d{2}|\d{4})\b`)
+)
+
+// receiptMoney reads an amount such as "1,234.50"
+func receiptMoney(whole, fraction string) Money {
+	units, _ := strconv.ParseInt(strings.ReplaceAll(whole, ",", ""), 10, 64)
+	minor, _ := strconv.ParseInt(fraction, 10, 64)
+	return Money(units)*majorUnit + Money(minor)*majorUnit/100
+}
+
+// receiptDate finds the first date on the receipt. Slashed dates are read
+// day first, as printed in India.
+func receiptDate(text string) string {
+	valid := func(y, m, d int) string {
+		if y < 100 {
+			y += 2000
+		}
+		t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+		if t.Year() != y || int(t.Month()) != m || t.Day() != d {
+			return ""
+		}
+		return t.Format(dateLayout)
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if m := receiptYMD.FindStringSubmatch(line); m != nil {
+			y, _ := strconv.Atoi(m[1])
+			mo, _ := strconv.Atoi(m[2])
+			d, _ := strconv.Atoi(m[3])
+			if date := valid(y, mo, d); date != "" {
+				return date
+			}
+		}
+		if m := receiptDMY.FindStringSubmatch(line); m != nil {
+			d, _ := strconv.Atoi(m[1])
+			mo, _ := strconv.Atoi(m[2])
+			y, _ := strconv.Atoi(m[3])
+			if date := valid(y, mo, d); date != "" {
+				return date
+			}
+		}
+		if m := receiptNamedDate.FindStringSubmatch(line); m != nil {
+			d, _ := strconv.Atoi(m[1])
+			mo := strings.Index("janfebmaraprmayjunjulaugsepoctnovdec", strings.ToLower(m[2]))/3 + 1
+			y, _ := strconv.Atoi(m[3])
+			if date := valid(y, mo, d); date != "" {
+				return date
+			}
+		}
+	}
+	return ""
+}
+
+// parseReceipt picks the merchant, date, total and items out of receipt
+// text. The merchant is the first line at the top that reads like a name;
+// the total comes from a total line, preferring a grand total, else the
+// items' sum; items are lines ending in an amount above the total.
+func parseReceipt(text string) ReceiptScan {
+	scan := ReceiptScan{Text: text, Items: []LineItem{}, Date: receiptDate(text)}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for i, line := range lines {
+		if i >= 5 {
+			break
+		}
+		letters := 0
+		for _, r := range line {
+			if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+				letters++
+			}
+		}
+		if letters >= 3 && !receiptHeader.MatchString(line) && receiptAmount.FindString(line) == "" {
+			scan.Merchant = line
+			break
+		}
+	}
+
+	totalLine, totalRank := -1, -1
+	for i, line := range lines {
+		m := receiptAmount.FindStringSubmatch(line)
+		if m == nil || receiptSubtotal.MatchString(line) {
+			continue
+		}
+		if t := receiptTotal.FindString(line); t != "" {
+			// A grand or net total beats a plain one
+			rank := 0
+			if !strings.EqualFold(t, "total") {
+				rank = 1
+			}
+			if rank > totalRank {
+				scan.Total, totalLine, totalRank = receiptMoney(m[1], m[2]), i, rank
+			}
+		}
+	}
+
+	var sum Money
+	for i, line := range lines {
+		if totalLine >= 0 && i >= totalLine {
+			break
+		}
+		m := receiptAmount.FindStringSubmatchIndex(line)
+		if m == nil || receiptSkip.MatchString(line) {
+			continue
+		}
+		amount := receiptMoney(line[m[2]:m[3]], line[m[4]:m[5]])
+		name := strings.TrimSpace(line[:m[0]])
+		item := LineItem{Name: name, Quantity: 1, Price: amount, Amount: amount}
+		if q := receiptQuantity.FindStringSubmatch(name); q != nil {
+			quantity, _ := strconv.ParseFloat(q[2], 64)
+			price, _ := strconv.ParseFloat(q[3], 64)
+			if quantity > 0 && math.Abs(quantity*price-amount.Float64()) < 0.01 {
+				item.Name, item.Quantity, item.Price = strings.TrimSpace(q[1]), quantity, moneyFromFloat(price)
+			}
+		}
+		if strings.Trim(item.Name, "0123456789.,:-*# ") == "" {
+			continue
+		}
+		scan.Items = append(scan.Items, item)
+		sum += amount
+	}
+	if scan.Total == 0 {
+		scan.Total = sum
+	}
+	return scan
+}
+
+// knownMerchant looks a scanned name up in the merchant directory, aliases
+// included, then with the providers, for its usual spelling and category
+func knownMerchant(tx *bolt.Tx, name string) (Merchant, bool) {
+	key := merchantKey(name)
+	if key == "" {
+		return Merchant{}, false
+	}
+	if m, ok := loadMerchantDirectory(tx).resolve(name); ok {
+		return m, true
+	}
+	for _, p := range merchantProviders {
+		if m, ok := p.lookup(key); ok {
+			return m, true
+		}
+	}
+	return Merchant{}, false
+}
+
+// RECEIPTS
+
+// scanReceipt reads the multipart "file" image of a receipt with the
+// configured OCR engine and returns what it found, to prefill the expense
+// form. Nothing is saved.
+func scanReceipt(w http.ResponseWriter, r *http.Request) {
+	engine := configuredOCR()
+	if engine == nil {
+		respondError(w, http.StatusServiceUnavailable, "receipt scanning is not configured")
+		return
+	}
+	r.ParseMultipartForm(10 << 20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Error retrieving file")
+		return
+	}
+	defer file.Close()
+	image, err := io.ReadAll(file)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	text, err := engine.recognize(r.Context(), image, filepath.Ext(header.Filename))
+	if err != nil {
+		logger("http").Warn("receipt scan failed", "engine", engine.name(), "err", err)
+		respondError(w, http.StatusBadGateway, "could not read the receipt: "+err.Error())
+		return
+	}
+	scan := parseReceipt(text)
+	scan.Engine = engine.name()
+	scan.Currency = currentSettings().BaseCurrency
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		if m, ok := knownMerchant(tx, scan.Merchant); ok {
+			if m.Name != "" {
+				scan.Merchant = m.Name
+			}
+			scan.Category = m.DefaultCategory
+		}
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, scan)
+}
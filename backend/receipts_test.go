@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestParseReceipt(t *testing.T) {
+	got := parseReceipt("DMart\n12 Mar 2026\nMilk 1L 64.00\nBread 45.00\n")
+	if got.Merchant != "DMart" || got.Date != "2026-03-12" || got.Total != 109*majorUnit || len(got.Items) != 2 {
+		t.Errorf("receipt without a total line = %+v", got)
+	}
+	if got := parseReceipt("Corner Shop\n2026-02-30\nTotal 1,250.50\n"); got.Date != "" || got.Total != 1250*majorUnit+500 {
+		t.Errorf("receipt with an impossible date = %+v", got)
+	}
+}
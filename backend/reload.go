@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// reloadMu serializes reloads triggered by SIGHUP and the admin endpoint
+var reloadMu sync.Mutex
+
+// ReloadResult reports what a configuration reload changed
+type ReloadResult struct {
+	Applied         bool     `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// reloadConfig re-reads the config file and environment and swaps in the
+// new configuration. Settings bound at startup (listen port, TLS, database,
+// replication role, audit file, worker count) keep their running values and
+// are reported as needing a restart. Nothing changes if validation fails.
+func reloadConfig() (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	old := config()
+
+	result := &ReloadResult{RestartRequired: []string{}}
+	pin := func(name string, changed bool, keep func()) {
+		if changed {
+			result.RestartRequired = append(result.RestartRequired, name)
+			keep()
+		}
+	}
+	pin("port", next.Port != old.Port, func() { next.Port = old.Port })
+	pin("listenAddr", next.ListenAddr != old.ListenAddr, func() { next.ListenAddr = old.ListenAddr })
+	pin("httpTimeouts", next.ReadTimeoutSeconds != old.ReadTimeoutSeconds ||
+		next.WriteTimeoutSeconds != old.WriteTimeoutSeconds ||
+		next.IdleTimeoutSeconds != old.IdleTimeoutSeconds, func() {
+		next.ReadTimeoutSeconds = old.ReadTimeoutSeconds
+		next.WriteTimeoutSeconds = old.WriteTimeoutSeconds
+		next.IdleTimeoutSeconds = old.IdleTimeoutSeconds
+	})
+	pin("tls", next.TLSCertFile != old.TLSCertFile || next.TLSKeyFile != old.TLSKeyFile ||
+		next.TLSRedirectAddr != old.TLSRedirectAddr, func() {
+		next.TLSCertFile = old.TLSCertFile
+		next.TLSKeyFile = old.TLSKeyFile
+		next.TLSRedirectAddr = old.TLSRedirectAddr
+	})
+	pin("shutdownTimeoutSeconds", next.ShutdownTimeoutSeconds != old.ShutdownTimeoutSeconds, func() {
+		next.ShutdownTimeoutSeconds = old.ShutdownTimeoutSeconds
+	})
+	pin("dbPath", next.DBPath != old.DBPath, func() { next.DBPath = old.DBPath })
+	pin("demoMode", next.DemoMode != old.DemoMode, func() { next.DemoMode = old.DemoMode })
+	pin("role", next.Role != old.Role, func() { next.Role = old.Role })
+	pin("primaryUrl", next.PrimaryURL != old.PrimaryURL, func() { next.PrimaryURL = old.PrimaryURL })
+	pin("auditLogPath", next.AuditLogPath != old.AuditLogPath, func() { next.AuditLogPath = old.AuditLogPath })
+	pin("tracing", next.TracingEndpoint != old.TracingEndpoint ||
+		next.TracingServiceName != old.TracingServiceName ||
+		next.TracingSampleRatio != old.TracingSampleRatio, func() {
+		next.TracingEndpoint = old.TracingEndpoint
+		next.TracingServiceName = old.TracingServiceName
+		next.TracingSampleRatio = old.TracingSampleRatio
+	})
+	pin("queueWorkers", next.QueueWorkers != old.QueueWorkers, func() { next.QueueWorkers = old.QueueWorkers })
+
+	if old.Role == rolePrimary {
+		if err := applySchedulerConfig(next); err != nil {
+			return nil, err
+		}
+	}
+	if err := setupLogging(next); err != nil {
+		return nil, err
+	}
+	setConfig(next)
+	result.Applied = true
+
+	logger("config").Info("configuration reloaded", "restartRequired", result.RestartRequired)
+	return result, nil
+}
+
+// watchReloadSignal reloads the configuration whenever SIGHUP arrives
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if _, err := reloadConfig(); err != nil {
+			logger("config").Error("configuration reload failed", "err", err)
+		}
+	}
+}
+
+// ADMIN: CONFIG
+
+func getEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	c := *config()
+	if c.ReplicationToken != "" {
+		c.ReplicationToken = "********"
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = "********"
+	}
+	if c.SentryDSN != "" {
+		c.SentryDSN = "********"
+	}
+	if c.JWTSecret != "" {
+		c.JWTSecret = "********"
+	}
+	if c.SMTPPassword != "" {
+		c.SMTPPassword = "********"
+	}
+	if c.IMAPPassword != "" {
+		c.IMAPPassword = "********"
+	}
+	if c.PlaidSecret != "" {
+		c.PlaidSecret = "********"
+	}
+	if c.BankTokenKey != "" {
+		c.BankTokenKey = "********"
+	}
+	if c.TelegramBotToken != "" {
+		c.TelegramBotToken = "********"
+	}
+	if c.AlphaVantageAPIKey != "" {
+		c.AlphaVantageAPIKey = "********"
+	}
+	if c.VisionAPIKey != "" {
+		c.VisionAPIKey = "********"
+	}
+	if c.BackupS3SecretKey != "" {
+		c.BackupS3SecretKey = "********"
+	}
+	respondJSON(w, http.StatusOK, c)
+}
+
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := reloadConfig()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
+}
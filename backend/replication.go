@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+// replicaStatus tracks the outcome of the most recent snapshot pull
+type replicaStatus struct {
+	mu         sync.Mutex
+	LastSync   string
+	LastTxID   int
+	LastError  string
+	SyncCount  int
+	PrimaryURL string
+}
+
+var replica replicaStatus
+
+// isWriteMethod reports whether the HTTP method mutates state
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// replicaReadOnlyMiddleware rejects writes on a replica. The reverse proxy
+// is expected to route mutating requests to the primary.
+func replicaReadOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config().Role == roleReplica && isWriteMethod(r.Method) {
+			w.Header().Set("X-Primary-URL", config().PrimaryURL)
+			respondError(w, http.StatusServiceUnavailable, "this instance is a read-only replica; send writes to the primary")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runReplica pulls a snapshot immediately and then on every sync interval
+func runReplica() {
+	replica.PrimaryURL = config().PrimaryURL
+	interval := time.Duration(config().ReplicaSyncSeconds) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	for {
+		if err := syncFromPrimary(); err != nil {
+			logger("replication").Error("replica sync failed", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// syncFromPrimary downloads a consistent snapshot from the primary and
+// replaces the local buckets with its contents in a single transaction, so
+// readers always see either the old or the new state.
+func syncFromPrimary() (err error) {
+	ctx, span := startSpan(context.Background(), "replication.sync", attribute.String("primary.url", config().PrimaryURL))
+	defer func() {
+		endSpan(span, err)
+		replica.mu.Lock()
+		if err != nil {
+			replica.LastError = err.Error()
+		} else {
+			replica.LastError = ""
+			replica.LastSync = time.Now().Format(time.RFC3339)
+			replica.SyncCount++
+		}
+		replica.mu.Unlock()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(config().PrimaryURL, "/")+"/api/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	if config().ReplicationToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config().ReplicationToken)
+	}
+	injectTrace(ctx, req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary returned %s", resp.Status)
+	}
+
+	txID, _ := strconv.Atoi(resp.Header.Get("X-Snapshot-Txid"))
+	replica.mu.Lock()
+	unchanged := txID != 0 && txID == replica.LastTxID
+	replica.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "replica-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	snap, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer snap.Close()
+
+	err = snap.View(func(src *bolt.Tx) error {
+		return db.Update(func(dst *bolt.Tx) error {
+			return copyBuckets(src, dst)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	replica.mu.Lock()
+	replica.LastTxID = txID
+	replica.mu.Unlock()
+	return nil
+}
+
+// copyBuckets makes dst's top-level buckets an exact copy of src's
+func copyBuckets(src, dst *bolt.Tx) error {
+	var stale [][]byte
+	dst.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if src.Bucket(name) == nil {
+			stale = append(stale, append([]byte(nil), name...))
+		}
+		return nil
+	})
+	for _, name := range stale {
+		if err := dst.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if dst.Bucket(name) != nil {
+			if err := dst.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		nb, err := dst.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		return copyBucket(b, nb)
+	})
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			child, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), child)
+		}
+		return dst.Put(k, v)
+	})
+}
+
+// REPLICATION
+
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	token := config().ReplicationToken
+	if token == "" {
+		// Without a token anyone could copy the whole database
+		respondError(w, http.StatusNotFound, "replication is not configured")
+		return
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		respondError(w, http.StatusUnauthorized, "invalid replication token")
+		return
+	}
+	// A full snapshot can take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	err := db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		w.Header().Set("X-Snapshot-Txid", strconv.Itoa(tx.ID()))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		logger("replication").Error("snapshot stream failed", "err", err)
+	}
+}
+
+func getReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{"role": config().Role}
+	if config().Role == roleReplica {
+		replica.mu.Lock()
+		status["primaryUrl"] = replica.PrimaryURL
+		status["lastSync"] = replica.LastSync
+		status["lastTxId"] = replica.LastTxID
+		status["lastError"] = replica.LastError
+		status["syncCount"] = replica.SyncCount
+		replica.mu.Unlock()
+	}
+	respondJSON(w, http.StatusOK, status)
+}
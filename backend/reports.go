@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// reportTopMerchants is how many merchants a monthly report lists
+const reportTopMerchants = 5
+
+// ReportCategory is spending in one category over a report's month
+type ReportCategory struct {
+	Category string  `json:"category"`
+	Amount   Money   `json:"amount"`
+	Share    float64 `json:"share"`    // percent of the month's spending
+	Previous Money   `json:"previous"` // in the month before
+	Change   Money   `json:"change"`
+}
+
+// ReportMerchant is spending at one merchant over a report's month
+type ReportMerchant struct {
+	Merchant     string `json:"merchant"`
+	Amount       Money  `json:"amount"`
+	Transactions int    `json:"transactions"`
+}
+
+// ReportBudget is how a monthly budget fared in a report's month, in the
+// budget's currency
+type ReportBudget struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Category    string  `json:"category"`
+	Currency    string  `json:"currency"`
+	Limit       Money   `json:"limit"`
+	CarriedOver Money   `json:"carriedOver"`
+	Spent       Money   `json:"spent"`
+	Remaining   Money   `json:"remaining"`
+	Used        float64 `json:"used"` // percent of limit and carry-over
+	Over        bool    `json:"over"`
+}
+
+// ReportTotals are a month's income and spending
+type ReportTotals struct {
+	Month       string  `json:"month"`
+	Income      Money   `json:"income"`
+	Expenses    Money   `json:"expenses"`
+	Net         Money   `json:"net"`
+	SavingsRate float64 `json:"savingsRate"` // percent of income kept
+}
+
+// ReportChange is how a month compares with the one before. Percentages
+// are left out when the month before had nothing to compare with.
+type ReportChange struct {
+	Income          Money    `json:"income"`
+	Expenses        Money    `json:"expenses"`
+	Net             Money    `json:"net"`
+	IncomePercent   *float64 `json:"incomePercent,omitempty"`
+	ExpensesPercent *float64 `json:"expensesPercent,omitempty"`
+}
+
+// MonthlyReport sums up a budget month, in the base currency unless noted
+type MonthlyReport struct {
+	ReportTotals
+	Period                Period           `json:"period"`
+	Currency              string           `json:"currency"`
+	Categories            []ReportCategory `json:"categories"`
+	Budgets               []ReportBudget   `json:"budgets"`
+	TopMerchants          []ReportMerchant `json:"topMerchants"`
+	Previous              ReportTotals     `json:"previous"`
+	Change                ReportChange     `json:"change"`
+	UnconvertedCurrencies []string         `json:"unconvertedCurrencies"`
+}
+
+// monthTally gathers a month's figures while the records are read
+type monthTally struct {
+	totals     ReportTotals
+	categories map[string]*Money
+	merchants  map[string]*ReportMerchant
+}
+
+func newMonthTally(month string) *monthTally {
+	return &monthTally{totals: ReportTotals{Month: month}, categories: map[string]*Money{}, merchants: map[string]*ReportMerchant{}}
+}
+
+func (t *monthTally) finish() {
+	t.totals.Net = t.totals.Income - t.totals.Expenses
+	if t.totals.Income > 0 {
+		t.totals.SavingsRate = math.Round(float64(t.totals.Net)/float64(t.totals.Income)*10000) / 100
+	}
+}
+
+// percentChange is the change from before to now in percent, or nil when
+// there was nothing before
+func percentChange(before, now Money) *float64 {
+	if before == 0 {
+		return nil
+	}
+	p := math.Round(float64(now-before)/math.Abs(float64(before))*10000) / 100
+	return &p
+}
+
+// monthlyReport sums up a budget month and the one before it, counting the
+// household's own income and spending that user can see
+func monthlyReport(ctx context.Context, tx *bolt.Tx, s Settings, user, month string, now time.Time) (MonthlyReport, error) {
+	period, err := budgetPeriod(month, s.BudgetStartDay)
+	if err != nil {
+		return MonthlyReport{}, err
+	}
+	start, _ := time.Parse("2006-01", month)
+	prevMonth := start.AddDate(0, -1, 0).Format("2006-01")
+	prevPeriod, _ := budgetPeriod(prevMonth, s.BudgetStartDay)
+	cur, prev := newMonthTally(month), newMonthTally(prevMonth)
+	tally := func(date string) *monthTally {
+		switch {
+		case period.contains(date):
+			return cur
+		case prevPeriod.contains(date):
+			return prev
+		}
+		return nil
+	}
+	conv := newConverter(s, "")
+
+	err = forEach(ctx, tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) != nil || !e.personal() || !e.visibleTo(user) {
+			return nil
+		}
+		t := tally(e.Date)
+		if t == nil {
+			return nil
+		}
+		conv.add(&t.totals.Expenses, e.Amount, e.Currency)
+		for _, part := range e.categoryParts() {
+			if t.categories[part.Category] == nil {
+				t.categories[part.Category] = new(Money)
+			}
+			conv.add(t.categories[part.Category], part.Amount, e.Currency)
+		}
+		if key := merchantKey(e.Merchant); key != "" {
+			m := t.merchants[key]
+			if m == nil {
+				m = &ReportMerchant{Merchant: e.Merchant}
+				t.merchants[key] = m
+			}
+			if conv.add(&m.Amount, e.Amount, e.Currency) {
+				m.Transactions++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return MonthlyReport{}, err
+	}
+	err = forEach(ctx, tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+		var i Income
+		if json.Unmarshal(v, &i) != nil || !i.personal() || !i.visibleTo(user) {
+			return nil
+		}
+		if t := tally(i.Date); t != nil {
+			conv.add(&t.totals.Income, i.Amount, i.Currency)
+		}
+		return nil
+	})
+	if err != nil {
+		return MonthlyReport{}, err
+	}
+	cur.finish()
+	prev.finish()
+
+	report := MonthlyReport{
+		ReportTotals: cur.totals,
+		Period:       period,
+		Currency:     s.BaseCurrency,
+		Categories:   []ReportCategory{},
+		TopMerchants: []ReportMerchant{},
+		Previous:     prev.totals,
+		Change: ReportChange{
+			Income:          cur.totals.Income - prev.totals.Income,
+			Expenses:        cur.totals.Expenses - prev.totals.Expenses,
+			Net:             cur.totals.Net - prev.totals.Net,
+			IncomePercent:   percentChange(prev.totals.Income, cur.totals.Income),
+			ExpensesPercent: percentChange(prev.totals.Expenses, cur.totals.Expenses),
+		},
+	}
+
+	// Categories of either month, so ones dropped this month show their fall
+	for category := range prev.categories {
+		if cur.categories[category] == nil {
+			cur.categories[category] = new(Money)
+		}
+	}
+	for category, amount := range cur.categories {
+		c := ReportCategory{Category: category, Amount: *amount}
+		if p := prev.categories[category]; p != nil {
+			c.Previous = *p
+		}
+		c.Change = c.Amount - c.Previous
+		if report.Expenses > 0 {
+			c.Share = math.Round(float64(c.Amount)/float64(report.Expenses)*10000) / 100
+		}
+		report.Categories = append(report.Categories, c)
+	}
+	sort.Slice(report.Categories, func(i, j int) bool {
+		a, b := report.Categories[i], report.Categories[j]
+		if a.Amount != b.Amount {
+			return a.Amount > b.Amount
+		}
+		return a.Category < b.Category
+	})
+
+	for _, m := range cur.merchants {
+		report.TopMerchants = append(report.TopMerchants, *m)
+	}
+	sort.Slice(report.TopMerchants, func(i, j int) bool {
+		a, b := report.TopMerchants[i], report.TopMerchants[j]
+		if a.Amount != b.Amount {
+			return a.Amount > b.Amount
+		}
+		return a.Merchant < b.Merchant
+	})
+	if len(report.TopMerchants) > reportTopMerchants {
+		report.TopMerchants = report.TopMerchants[:reportTopMerchants]
+	}
+
+	if report.Budgets, err = reportBudgets(ctx, tx, s, user, month, now); err != nil {
+		return MonthlyReport{}, err
+	}
+	report.UnconvertedCurrencies = conv.unconverted()
+	return report, nil
+}
+
+// reportBudgets works out how the monthly budgets running in a month fared:
+// budgets for that month, recurring budgets from before it, and budgets
+// naming no month
+func reportBudgets(ctx context.Context, tx *bolt.Tx, s Settings, user, month string, now time.Time) ([]ReportBudget, error) {
+	var budgets []Budget
+	err := forEach(ctx, tx.Bucket([]byte(budgetsBucket)), func(k, v []byte) error {
+		var b Budget
+		if json.Unmarshal(v, &b) != nil || !b.visibleTo(user) || (b.Period != "" && b.Period != "monthly") {
+			return nil
+		}
+		_, err := time.Parse("2006-01", b.Month)
+		if err != nil || b.Month == month || (b.IsRecurring && b.Month < month) {
+			budgets = append(budgets, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := []ReportBudget{}
+	for _, b := range budgets {
+		rb := ReportBudget{ID: b.ID, Name: b.Name, Category: b.Category, Currency: b.Currency, Limit: b.Limit}
+		// The history runs to the running month; later months start afresh
+		history, err := budgetHistory(ctx, tx, s, b, now)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range history {
+			if m.Month == month {
+				rb.CarriedOver, rb.Spent = m.CarriedOver, m.Spent
+			}
+		}
+		rb.Remaining = rb.Limit + rb.CarriedOver - rb.Spent
+		rb.Over = rb.Remaining < 0
+		if available := rb.Limit + rb.CarriedOver; available > 0 {
+			rb.Used = math.Round(float64(rb.Spent)/float64(available)*10000) / 100
+		}
+		report = append(report, rb)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Name != report[j].Name {
+			return report[i].Name < report[j].Name
+		}
+		return report[i].ID < report[j].ID
+	})
+	return report, nil
+}
+
+// reportColors colour the bars of report charts
+var reportColors = []string{"#22c55e", "#ef4444", "#f59e0b", "#3b82f6", "#8b5cf6", "#ec4899", "#14b8a6", "#6366f1"}
+
+// statementMoney writes an amount for a printed statement. The currency is
+// named in the heading, so symbols, which Helvetica lacks for most
+// currencies, are left out.
+func statementMoney(m Money, currency string) string {
+	text := formatMoney(m, currency)
+	if symbol, ok := currencySymbols[currency]; ok {
+		return strings.Replace(text, symbol, "", 1)
+	}
+	return strings.TrimSuffix(text, " "+currency)
+}
+
+// reportTable lays out rows of a table: the first column from the margin,
+// the rest right-aligned at the given edges
+func reportTable(p *pdfWriter, edges []float64, header []string, rows [][]string) {
+	row := func(cells []string, bold bool) {
+		p.need(16)
+		for i, cell := range cells {
+			if i == 0 {
+				p.text(pdfMargin, cell, 9, bold)
+			} else {
+				p.textRight(edges[i-1], cell, 9, bold)
+			}
+		}
+		p.line(14)
+	}
+	row(header, true)
+	p.box(pdfMargin, p.y+10, pdfPageWidth-2*pdfMargin, 0.5, "#9ca3af")
+	for _, cells := range rows {
+		row(cells, false)
+	}
+	p.line(10)
+}
+
+// reportBars draws a horizontal bar chart, bars scaled to the largest value
+func reportBars(p *pdfWriter, labels []string, values []Money, currency string) {
+	largest := Money(0)
+	for _, v := range values {
+		largest = max(largest, v)
+	}
+	const labelWidth, amountWidth = 110, 90
+	span := float64(pdfPageWidth - 2*pdfMargin - labelWidth - amountWidth)
+	for i, label := range labels {
+		p.need(16)
+		p.text(pdfMargin, label, 9, false)
+		if largest > 0 && values[i] > 0 {
+			p.box(pdfMargin+labelWidth, p.y-1, span*float64(values[i])/float64(largest), 9, reportColors[i%len(reportColors)])
+		}
+		p.textRight(pdfPageWidth-pdfMargin, statementMoney(values[i], currency), 9, false)
+		p.line(15)
+	}
+	p.line(10)
+}
+
+// reportHeading starts a section of the statement
+func reportHeading(p *pdfWriter, title string) {
+	p.need(40)
+	p.text(pdfMargin, title, 13, true)
+	p.line(20)
+}
+
+// writeReportPDF renders a monthly report as a printable statement
+func writeReportPDF(w io.Writer, report MonthlyReport) error {
+	cur := report.Currency
+	money := func(m Money) string { return statementMoney(m, cur) }
+	change := func(m Money) string {
+		if m > 0 {
+			return "+" + money(m)
+		}
+		return money(m)
+	}
+	monthName := func(month string) string {
+		t, _ := time.Parse("2006-01", month)
+		return t.Format("January 2006")
+	}
+	p := newPDFWriter()
+	p.text(pdfMargin, "Monthly statement: "+monthName(report.Month), 18, true)
+	p.line(18)
+	p.text(pdfMargin, fmt.Sprintf("%s to %s, amounts in %s", report.Period.Start, report.Period.End, cur), 9, false)
+	p.line(30)
+
+	reportHeading(p, "Summary")
+	edges := []float64{330, 430, pdfPageWidth - pdfMargin}
+	reportTable(p, edges, []string{"", monthName(report.Month), monthName(report.Previous.Month), "Change"}, [][]string{
+		{"Income", money(report.Income), money(report.Previous.Income), change(report.Change.Income)},
+		{"Spending", money(report.Expenses), money(report.Previous.Expenses), change(report.Change.Expenses)},
+		{"Net", money(report.Net), money(report.Previous.Net), change(report.Change.Net)},
+		{"Savings rate", fmt.Sprintf("%.1f%%", report.SavingsRate), fmt.Sprintf("%.1f%%", report.Previous.SavingsRate), ""},
+	})
+	reportBars(p, []string{"Income", "Spending", "Income before", "Spending before"},
+		[]Money{report.Income, report.Expenses, report.Previous.Income, report.Previous.Expenses}, cur)
+
+	if len(report.Categories) > 0 {
+		reportHeading(p, "Spending by category")
+		var labels []string
+		var values []Money
+		var rows [][]string
+		for _, c := range report.Categories {
+			labels = append(labels, c.Category)
+			values = append(values, c.Amount)
+			rows = append(rows, []string{c.Category, money(c.Amount), fmt.Sprintf("%.1f%%", c.Share), money(c.Previous), change(c.Change)})
+		}
+		reportBars(p, labels, values, cur)
+		reportTable(p, []float64{280, 350, 445, pdfPageWidth - pdfMargin},
+			[]string{"Category", "Spent", "Share", "Month before", "Change"}, rows)
+	}
+
+	if len(report.Budgets) > 0 {
+		reportHeading(p, "Budgets")
+		var rows [][]string
+		for _, b := range report.Budgets {
+			name := b.Name
+			if b.Over {
+				name += " (over)"
+			}
+			rows = append(rows, []string{name, statementMoney(b.Limit+b.CarriedOver, b.Currency), statementMoney(b.Spent, b.Currency),
+				statementMoney(b.Remaining, b.Currency), fmt.Sprintf("%.1f%%", b.Used)})
+		}
+		reportTable(p, []float64{280, 365, 460, pdfPageWidth - pdfMargin},
+			[]string{"Budget", "Available", "Spent", "Left", "Used"}, rows)
+	}
+
+	if len(report.TopMerchants) > 0 {
+		reportHeading(p, "Top merchants")
+		var rows [][]string
+		for _, m := range report.TopMerchants {
+			rows = append(rows, []string{m.Merchant, fmt.Sprint(m.Transactions), money(m.Amount)})
+		}
+		reportTable(p, []float64{400, pdfPageWidth - pdfMargin}, []string{"Merchant", "Payments", "Spent"}, rows)
+	}
+
+	if len(report.UnconvertedCurrencies) > 0 {
+		p.need(20)
+		p.text(pdfMargin, "Left out for want of an exchange rate: "+strings.Join(report.UnconvertedCurrencies, ", "), 8, false)
+	}
+	return p.writeTo(w)
+}
+
+// REPORTS
+
+// loadMonthlyReport builds the report for ?month=YYYY-MM (default the
+// running budget month), answering the request itself on failure
+func loadMonthlyReport(w http.ResponseWriter, r *http.Request) (MonthlyReport, bool) {
+	settings := currentSettings()
+	user := authUser(r)
+	now := time.Now()
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = currentBudgetMonth(now.In(settings.location(user)), settings.BudgetStartDay)
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid month %q (want YYYY-MM)", month))
+		return MonthlyReport{}, false
+	}
+	var report MonthlyReport
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		report, err = monthlyReport(r.Context(), tx, settings, user, month, now)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return MonthlyReport{}, false
+	}
+	return report, true
+}
+
+// getMonthlyReport sums up a budget month: income against spending,
+// spending by category and at the top merchants, how budgets fared, and the
+// change from the month before
+func getMonthlyReport(w http.ResponseWriter, r *http.Request) {
+	if report, ok := loadMonthlyReport(w, r); ok {
+		respondJSON(w, http.StatusOK, report)
+	}
+}
+
+// getMonthlyReportPDF downloads the monthly report as a printable PDF
+// statement with tables and bar charts
+func getMonthlyReportPDF(w http.ResponseWriter, r *http.Request) {
+	report, ok := loadMonthlyReport(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": "statement-" + report.Month + ".pdf"}))
+	if err := writeReportPDF(w, report); err != nil {
+		logger("http").Error("report export failed", "month", report.Month, "err", err)
+	}
+}
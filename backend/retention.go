@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// RetentionRule removes or archives records of a target once they are
+// older than MaxAgeDays.
+type RetentionRule struct {
+	ID         string `json:"id"`
+	Target     string `json:"target"`
+	Action     string `json:"action"` // "delete" or "archive"
+	MaxAgeDays int    `json:"maxAgeDays"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// RetentionRun is the report of a single enforcement pass
+type RetentionRun struct {
+	ID         string            `json:"id"`
+	StartedAt  string            `json:"startedAt"`
+	FinishedAt string            `json:"finishedAt"`
+	Results    []RetentionResult `json:"results"`
+}
+
+// RetentionResult lists what one rule removed during a run
+type RetentionResult struct {
+	RuleID string   `json:"ruleId"`
+	Target string   `json:"target"`
+	Action string   `json:"action"`
+	Count  int      `json:"count"`
+	IDs    []string `json:"ids,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// retentionTarget describes a bucket retention rules may apply to and how
+// to find the age of its records.
+type retentionTarget struct {
+	bucket    string
+	timestamp func(v []byte) (time.Time, bool)
+}
+
+var retentionTargets = map[string]retentionTarget{
+	"expenses": {expensesBucket, func(v []byte) (time.Time, bool) {
+		var e Expense
+		if json.Unmarshal(v, &e) != nil {
+			return time.Time{}, false
+		}
+		return firstRecordTime(e.Date, e.CreatedAt)
+	}},
+	"income": {incomeBucket, func(v []byte) (time.Time, bool) {
+		var i Income
+		if json.Unmarshal(v, &i) != nil {
+			return time.Time{}, false
+		}
+		return firstRecordTime(i.Date, i.CreatedAt)
+	}},
+	"deadLetters": {deadLettersBucket, func(v []byte) (time.Time, bool) {
+		var t Task
+		if json.Unmarshal(v, &t) != nil {
+			return time.Time{}, false
+		}
+		return firstRecordTime(t.UpdatedAt)
+	}},
+	"webhookDeliveries": {webhookDeliveriesBucket, func(v []byte) (time.Time, bool) {
+		var d WebhookDelivery
+		if json.Unmarshal(v, &d) != nil {
+			return time.Time{}, false
+		}
+		return firstRecordTime(d.UpdatedAt)
+	}},
+	// Transactions waiting for review are kept however old
+	"pendingTransactions": {pendingBucket, func(v []byte) (time.Time, bool) {
+		var d PendingTransaction
+		if json.Unmarshal(v, &d) != nil || d.Status == pendingReview {
+			return time.Time{}, false
+		}
+		return firstRecordTime(d.UpdatedAt)
+	}},
+	"retentionRuns": {retentionRunsBucket, func(v []byte) (time.Time, bool) {
+		var run RetentionRun
+		if json.Unmarshal(v, &run) != nil {
+			return time.Time{}, false
+		}
+		return firstRecordTime(run.StartedAt)
+	}},
+}
+
+// recordTimeLayouts are the date formats found in stored records
+var recordTimeLayouts = []string{time.RFC3339Nano, time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// parseRecordTime parses a stored date or timestamp string
+func parseRecordTime(s string) (time.Time, bool) {
+	for _, layout := range recordTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// firstRecordTime returns the first of values that parses as a date
+func firstRecordTime(values ...string) (time.Time, bool) {
+	for _, v := range values {
+		if t, ok := parseRecordTime(v); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func validateRetentionRule(rule RetentionRule) error {
+	if _, ok := retentionTargets[rule.Target]; !ok {
+		return fmt.Errorf("unknown retention target %q", rule.Target)
+	}
+	if rule.Action != "delete" && rule.Action != "archive" {
+		return fmt.Errorf("action must be \"delete\" or \"archive\"")
+	}
+	if rule.MaxAgeDays <= 0 {
+		return fmt.Errorf("maxAgeDays must be positive")
+	}
+	return nil
+}
+
+// runRetention applies every enabled rule and stores a report of the run
+func runRetention() error {
+	run := RetentionRun{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		StartedAt: time.Now().Format(time.RFC3339),
+		Results:   []RetentionResult{},
+	}
+
+	var rules []RetentionRule
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(retentionRulesBucket)).ForEach(func(k, v []byte) error {
+			var rule RetentionRule
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			if rule.Enabled {
+				rules = append(rules, rule)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, rule := range rules {
+		result := RetentionResult{RuleID: rule.ID, Target: rule.Target, Action: rule.Action}
+		if err := applyRetentionRule(rule, &result); err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		run.Results = append(run.Results, result)
+	}
+	run.FinishedAt = time.Now().Format(time.RFC3339)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(retentionRunsBucket)).Put([]byte(run.ID), data)
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d retention rules failed", failed)
+	}
+	return nil
+}
+
+func applyRetentionRule(rule RetentionRule, result *RetentionResult) error {
+	target, ok := retentionTargets[rule.Target]
+	if !ok {
+		return fmt.Errorf("unknown retention target %q", rule.Target)
+	}
+	cutoff := time.Now().AddDate(0, 0, -rule.MaxAgeDays)
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(target.bucket))
+		archive := tx.Bucket([]byte(archiveBucket))
+		type expired struct{ key, value []byte }
+		var matches []expired
+		err := b.ForEach(func(k, v []byte) error {
+			if ts, ok := target.timestamp(v); ok && ts.Before(cutoff) {
+				matches = append(matches, expired{append([]byte(nil), k...), append([]byte(nil), v...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if rule.Action == "archive" {
+				if err := archive.Put([]byte(rule.Target+"/"+string(m.key)), m.value); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete(m.key); err != nil {
+				return err
+			}
+			result.IDs = append(result.IDs, string(m.key))
+		}
+		result.Count = len(matches)
+		return nil
+	})
+}
+
+// ADMIN: RETENTION
+
+func getRetentionRules(w http.ResponseWriter, r *http.Request) {
+	rules := []RetentionRule{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(retentionRulesBucket)).ForEach(func(k, v []byte) error {
+			var rule RetentionRule
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, rules)
+}
+
+func createRetentionRule(w http.ResponseWriter, r *http.Request) {
+	var rule RetentionRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateRetentionRule(rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(retentionRulesBucket))
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(rule.ID), data)
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusCreated, rule)
+}
+
+func updateRetentionRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	var rule RetentionRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rule.ID = id
+	if err := validateRetentionRule(rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(retentionRulesBucket))
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, rule)
+}
+
+func deleteRetentionRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(retentionRulesBucket))
+		return b.Delete([]byte(id))
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Retention rule deleted"})
+}
+
+func getRetentionRuns(w http.ResponseWriter, r *http.Request) {
+	runs := []RetentionRun{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(retentionRunsBucket)).ForEach(func(k, v []byte) error {
+			var run RetentionRun
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			return nil
+		})
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Newest first
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	respondJSON(w, http.StatusOK, runs)
+}
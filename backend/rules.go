@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ruleFields    = []string{"merchant", "description", "notes"}
+	ruleOperators = []string{"contains", "equals", "startsWith", "regex"}
+)
+
+// CategoryRule categorizes expenses automatically, e.g. merchant contains
+// "Swiggy" → category Dining, tag takeout. Rules are tried by priority,
+// lowest first, and the first that matches wins.
+type CategoryRule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Field    string `json:"field"`    // merchant, description or notes
+	Operator string `json:"operator"` // contains, equals, startsWith or regex
+	Pattern  string `json:"pattern"`  // compared ignoring case
+	// Category is given to expenses that have none; Tags are added
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Priority int      `json:"priority"`
+	Disabled bool     `json:"disabled,omitempty"`
+	// Matched counts the expenses the rule has categorized
+	Matched   int    `json:"matched"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+func (rule *CategoryRule) validate() error {
+	if rule.Field == "" {
+		rule.Field = "merchant"
+	}
+	if rule.Operator == "" {
+		rule.Operator = "contains"
+	}
+	if err := oneOf("field", rule.Field, ruleFields); err != nil {
+		return err
+	}
+	if err := oneOf("operator", rule.Operator, ruleOperators); err != nil {
+		return err
+	}
+	rule.Name = strings.TrimSpace(rule.Name)
+	rule.Category = strings.TrimSpace(rule.Category)
+	rule.Tags = normalizeTags(rule.Tags)
+	if strings.TrimSpace(rule.Pattern) == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	if rule.Operator == "regex" {
+		if _, err := regexp.Compile("(?i)" + rule.Pattern); err != nil {
+			return fmt.Errorf("pattern: %v", err)
+		}
+	} else {
+		rule.Pattern = strings.TrimSpace(rule.Pattern)
+	}
+	if rule.Category == "" && len(rule.Tags) == 0 {
+		return fmt.Errorf("a rule must set a category or tags")
+	}
+	return nil
+}
+
+// matches reports whether the rule picks out the expense
+func (rule CategoryRule) matches(e Expense) bool {
+	var value string
+	switch rule.Field {
+	case "merchant":
+		value = e.Merchant
+	case "description":
+		value = e.Description
+	case "notes":
+		value = e.Notes
+	}
+	value, pattern := strings.ToLower(strings.TrimSpace(value)), strings.ToLower(rule.Pattern)
+	switch rule.Operator {
+	case "contains":
+		return value != "" && strings.Contains(value, pattern)
+	case "equals":
+		return value == pattern
+	case "startsWith":
+		return value != "" && strings.HasPrefix(value, pattern)
+	case "regex":
+		re, err := regexp.Compile("(?i)" + rule.Pattern)
+		return err == nil && value != "" && re.MatchString(value)
+	}
+	return false
+}
+
+// before orders rules by priority, then the order they were made in
+func (rule CategoryRule) before(other CategoryRule) bool {
+	if rule.Priority != other.Priority {
+		return rule.Priority < other.Priority
+	}
+	if rule.CreatedAt != other.CreatedAt {
+		return rule.CreatedAt < other.CreatedAt
+	}
+	return rule.ID < other.ID
+}
+
+// loadRules reads the enabled rules in the order they are tried
+func loadRules(tx *bolt.Tx) []CategoryRule {
+	var rules []CategoryRule
+	tx.Bucket([]byte(rulesBucket)).ForEach(func(k, v []byte) error {
+		var rule CategoryRule
+		if json.Unmarshal(v, &rule) == nil && !rule.Disabled {
+			rules = append(rules, rule)
+		}
+		return nil
+	})
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].before(rules[j])
+	})
+	return rules
+}
+
+// categorize applies the first of the rules matching the expense: a
+// category it lacks and the rule's tags. It returns the rule, or nil.
+func categorize(rules []CategoryRule, e *Expense) *CategoryRule {
+	for i, rule := range rules {
+		if !rule.matches(*e) {
+			continue
+		}
+		if e.Category == "" {
+			e.Category = rule.Category
+		}
+		e.Tags = normalizeTags(append(e.Tags, rule.Tags...))
+		return &rules[i]
+	}
+	return nil
+}
+
+// applyRules categorizes a new expense by the household's rules, counting
+// the match on the rule. Rules run before the merchant's default category.
+func applyRules(tx *bolt.Tx, e *Expense) error {
+	rule := categorize(loadRules(tx), e)
+	if rule == nil {
+		return nil
+	}
+	return countRuleMatches(tx, map[string]int{rule.ID: 1})
+}
+
+// countRuleMatches adds to the rules' match counts
+func countRuleMatches(tx *bolt.Tx, counts map[string]int) error {
+	b := tx.Bucket([]byte(rulesBucket))
+	for id, n := range counts {
+		v := b.Get([]byte(id))
+		if v == nil {
+			continue
+		}
+		var rule CategoryRule
+		if err := json.Unmarshal(v, &rule); err != nil {
+			return err
+		}
+		rule.Matched += n
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(id), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RULES
+
+func getRules(w http.ResponseWriter, r *http.Request) {
+	rules := []CategoryRule{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(rulesBucket)), func(k, v []byte) error {
+			var rule CategoryRule
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].before(rules[j])
+	})
+	respondJSON(w, http.StatusOK, rules)
+}
+
+// saveRule stores a created or edited rule
+func saveRule(w http.ResponseWriter, r *http.Request, rule CategoryRule, status int) {
+	if err := rule.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rule.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(rulesBucket))
+		if v := b.Get([]byte(rule.ID)); v != nil {
+			var old CategoryRule
+			json.Unmarshal(v, &old)
+			rule.CreatedAt, rule.Matched = old.CreatedAt, old.Matched
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(rule.ID), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, status, rule)
+}
+
+func createRule(w http.ResponseWriter, r *http.Request) {
+	var rule CategoryRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	rule.CreatedAt = now.Format(time.RFC3339)
+	rule.Matched = 0
+	saveRule(w, r, rule, http.StatusCreated)
+}
+
+func updateRule(w http.ResponseWriter, r *http.Request) {
+	var rule CategoryRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rule.ID = mux.Vars(r)["id"]
+	saveRule(w, r, rule, http.StatusOK)
+}
+
+// deleteRule removes a rule; expenses it categorized keep their category
+func deleteRule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(rulesBucket, []byte(id))
+		return tx.Bucket([]byte(rulesBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Rule deleted"})
+}
+
+// applyRulesToExpenses runs the rules over the caller's existing
+// uncategorized expenses, as one undoable change
+func applyRulesToExpenses(w http.ResponseWriter, r *http.Request) {
+	user := authUser(r)
+	var updated []string
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		rules := loadRules(tx)
+		b := tx.Bucket([]byte(expensesBucket))
+		var changed []Expense
+		counts := map[string]int{}
+		err := forEach(r.Context(), b, func(k, v []byte) error {
+			var e Expense
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Category != "" || !e.visibleTo(user) {
+				return nil
+			}
+			if rule := categorize(rules, &e); rule != nil && e.Category != "" {
+				counts[rule.ID]++
+				changed = append(changed, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		now := time.Now().Format(time.RFC3339)
+		for _, e := range changed {
+			j.track(expensesBucket, []byte(e.ID))
+			e.UpdatedAt = now
+			if err := putExpense(tx, e); err != nil {
+				return err
+			}
+			updated = append(updated, e.ID)
+		}
+		for id := range counts {
+			j.track(rulesBucket, []byte(id))
+		}
+		return countRuleMatches(tx, counts)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if updated == nil {
+		updated = []string{}
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]interface{}{"updated": len(updated), "expenseIds": updated})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// JobConfig overrides a job's schedule or switches it off
+type JobConfig struct {
+	Schedule string `json:"schedule,omitempty"`
+	Enabled  *bool  `json:"enabled,omitempty"`
+}
+
+// JobStatus is the health record of a scheduled job. The run history
+// fields are persisted in the jobs bucket so they survive restarts.
+type JobStatus struct {
+	Name           string `json:"name"`
+	Schedule       string `json:"schedule"`
+	Enabled        bool   `json:"enabled"`
+	Running        bool   `json:"running"`
+	NextRun        string `json:"nextRun,omitempty"`
+	LastRun        string `json:"lastRun,omitempty"`
+	LastDurationMs int64  `json:"lastDurationMs"`
+	LastStatus     string `json:"lastStatus,omitempty"` // "ok" or "error"
+	LastError      string `json:"lastError,omitempty"`
+	RunCount       int    `json:"runCount"`
+	FailureCount   int    `json:"failureCount"`
+}
+
+type scheduledJob struct {
+	name            string
+	defaultSchedule string
+	run             func() error
+
+	spec     string
+	schedule *cronSchedule
+	enabled  bool
+	running  bool
+}
+
+var scheduler = struct {
+	mu   sync.Mutex
+	jobs map[string]*scheduledJob
+}{jobs: map[string]*scheduledJob{}}
+
+// registerJob adds a job to the scheduler. It must be called before
+// startScheduler; defaultSchedule may be overridden in the config file.
+func registerJob(name, defaultSchedule string, run func() error) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	scheduler.jobs[name] = &scheduledJob{name: name, defaultSchedule: defaultSchedule, run: run}
+}
+
+// applySchedulerConfig resolves every job's schedule and enabled state from
+// the config, failing on unknown jobs or invalid cron expressions.
+func applySchedulerConfig(c *Config) error {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for name := range c.Jobs {
+		if _, ok := scheduler.jobs[name]; !ok {
+			return fmt.Errorf("config references unknown job %q", name)
+		}
+	}
+	parsed := map[string]*cronSchedule{}
+	for name, job := range scheduler.jobs {
+		spec := job.defaultSchedule
+		if jc, ok := c.Jobs[name]; ok && jc.Schedule != "" {
+			spec = jc.Schedule
+		}
+		schedule, err := parseCron(spec)
+		if err != nil {
+			return fmt.Errorf("job %s: %w", name, err)
+		}
+		parsed[name] = schedule
+	}
+	for name, job := range scheduler.jobs {
+		job.schedule = parsed[name]
+		job.spec = job.defaultSchedule
+		job.enabled = true
+		if jc, ok := c.Jobs[name]; ok {
+			if jc.Schedule != "" {
+				job.spec = jc.Schedule
+			}
+			if jc.Enabled != nil {
+				job.enabled = *jc.Enabled
+			}
+		}
+	}
+	return nil
+}
+
+// startScheduler wakes at the top of every minute and launches due jobs
+func startScheduler() error {
+	if err := applySchedulerConfig(config()); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(next.Sub(now))
+			if inMaintenance() {
+				continue // Jobs write; leave the database alone
+			}
+
+			scheduler.mu.Lock()
+			var due []*scheduledJob
+			for _, job := range scheduler.jobs {
+				if job.enabled && !job.running && job.schedule.matches(next) {
+					job.running = true
+					due = append(due, job)
+				}
+			}
+			scheduler.mu.Unlock()
+
+			for _, job := range due {
+				go executeJob(job)
+			}
+		}
+	}()
+	return nil
+}
+
+// executeJob runs a job that has already been marked running and records
+// the outcome.
+func executeJob(job *scheduledJob) {
+	started := time.Now()
+	_, span := startSpan(context.Background(), "job "+job.name, attribute.String("job.name", job.name))
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return job.run()
+	}()
+	duration := time.Since(started)
+	endSpan(span, err)
+
+	scheduler.mu.Lock()
+	job.running = false
+	scheduler.mu.Unlock()
+
+	if err != nil {
+		logger("scheduler").Error("job failed", "job", job.name, "durationMs", duration.Milliseconds(), "err", err)
+	} else {
+		logger("scheduler").Info("job finished", "job", job.name, "durationMs", duration.Milliseconds())
+	}
+
+	dbErr := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		var status JobStatus
+		if v := b.Get([]byte(job.name)); v != nil {
+			json.Unmarshal(v, &status)
+		}
+		status.Name = job.name
+		status.LastRun = started.Format(time.RFC3339)
+		status.LastDurationMs = duration.Milliseconds()
+		status.RunCount++
+		if err != nil {
+			status.LastStatus = "error"
+			status.LastError = err.Error()
+			status.FailureCount++
+		} else {
+			status.LastStatus = "ok"
+			status.LastError = ""
+		}
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(job.name), data)
+	})
+	if dbErr != nil {
+		logger("scheduler").Error("recording job status", "job", job.name, "err", dbErr)
+	}
+}
+
+// ADMIN: JOBS
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	stored := map[string]JobStatus{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobsBucket)).ForEach(func(k, v []byte) error {
+			var status JobStatus
+			if err := json.Unmarshal(v, &status); err != nil {
+				return nil // Skip malformed records
+			}
+			stored[string(k)] = status
+			return nil
+		})
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now()
+	jobs := []JobStatus{}
+	scheduler.mu.Lock()
+	for name, job := range scheduler.jobs {
+		status := stored[name]
+		status.Name = name
+		status.Schedule = job.spec
+		status.Enabled = job.enabled
+		status.Running = job.running
+		if job.enabled && job.schedule != nil {
+			if next := job.schedule.next(now); !next.IsZero() {
+				status.NextRun = next.Format(time.RFC3339)
+			}
+		}
+		jobs = append(jobs, status)
+	}
+	scheduler.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	respondJSON(w, http.StatusOK, jobs)
+}
+
+func runJobNow(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	scheduler.mu.Lock()
+	job, ok := scheduler.jobs[name]
+	if !ok {
+		scheduler.mu.Unlock()
+		respondError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if job.running {
+		scheduler.mu.Unlock()
+		respondError(w, http.StatusConflict, "job is already running")
+		return
+	}
+	job.running = true
+	scheduler.mu.Unlock()
+
+	go executeJob(job)
+	respondJSON(w, http.StatusAccepted, map[string]string{"message": "Job started"})
+}
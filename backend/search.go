@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// searchFieldWeights rank a match by the field it is in
+var searchFieldWeights = map[string]int{"description": 3, "merchant": 3, "category": 2, "tags": 2, "notes": 1}
+
+// searchTypes are the kinds of record search covers
+var searchTypes = []string{"expense", "income", "bill"}
+
+// SearchResult is a record matching a search
+type SearchResult struct {
+	Type     string   `json:"type"` // expense, income or bill
+	ID       string   `json:"id"`
+	Title    string   `json:"title"`
+	Date     string   `json:"date,omitempty"`
+	Amount   Money    `json:"amount"`
+	Currency string   `json:"currency"`
+	Category string   `json:"category,omitempty"`
+	Score    int      `json:"score"`
+	Matched  []string `json:"matched"` // fields the terms were found in
+}
+
+// searchDoc is an indexed record: its result, minus the score, and who may
+// see it
+type searchDoc struct {
+	result SearchResult
+	owner  string
+	shared bool
+}
+
+// searchPosting is an occurrence of a token in a field of a document
+type searchPosting struct {
+	doc   int
+	field string
+}
+
+// searchIndex is an inverted index of the searchable text of expenses,
+// income and bills. It is built on startup and rebuilt on the next search
+// after any write, which bolt's transaction ID reveals.
+type searchIndex struct {
+	mu     sync.Mutex
+	db     *bolt.DB
+	txID   int
+	docs   []searchDoc
+	tokens []string // sorted, for prefix lookups
+	index  map[string][]searchPosting
+}
+
+var search = &searchIndex{}
+
+// searchTokens splits text into lowercase words of letters and digits
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes a document under the words of its fields
+func (s *searchIndex) add(doc searchDoc, fields map[string]string) {
+	id := len(s.docs)
+	s.docs = append(s.docs, doc)
+	for field, text := range fields {
+		seen := map[string]bool{}
+		for _, token := range searchTokens(text) {
+			if seen[token] {
+				continue
+			}
+			seen[token] = true
+			if _, ok := s.index[token]; !ok {
+				s.tokens = append(s.tokens, token)
+			}
+			s.index[token] = append(s.index[token], searchPosting{doc: id, field: field})
+		}
+	}
+}
+
+// rebuild indexes every searchable record as of tx
+func (s *searchIndex) rebuild(tx *bolt.Tx) {
+	s.docs, s.tokens, s.index = nil, nil, map[string][]searchPosting{}
+	tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) != nil {
+			return nil
+		}
+		s.add(searchDoc{result: SearchResult{Type: "expense", ID: e.ID, Title: e.Description, Date: e.Date,
+			Amount: e.Amount, Currency: e.Currency, Category: e.Category}, owner: e.User, shared: e.IsShared},
+			map[string]string{"description": e.Description, "merchant": e.Merchant, "category": e.Category,
+				"tags": strings.Join(e.Tags, " "), "notes": e.Notes})
+		return nil
+	})
+	tx.Bucket([]byte(incomeBucket)).ForEach(func(k, v []byte) error {
+		var i Income
+		if json.Unmarshal(v, &i) != nil {
+			return nil
+		}
+		title := i.Description
+		if title == "" {
+			title = i.Source
+		}
+		s.add(searchDoc{result: SearchResult{Type: "income", ID: i.ID, Title: title, Date: i.Date,
+			Amount: i.Amount, Currency: i.Currency, Category: i.Source}, owner: i.User},
+			map[string]string{"description": i.Description, "merchant": i.Source, "tags": strings.Join(i.Tags, " ")})
+		return nil
+	})
+	tx.Bucket([]byte(billsBucket)).ForEach(func(k, v []byte) error {
+		var b BillReminder
+		if json.Unmarshal(v, &b) != nil {
+			return nil
+		}
+		s.add(searchDoc{result: SearchResult{Type: "bill", ID: b.ID, Title: b.Name, Date: b.DueDate,
+			Amount: b.Amount, Currency: b.Currency, Category: b.Category}},
+			map[string]string{"description": b.Name, "category": b.Category, "tags": strings.Join(b.Tags, " ")})
+		return nil
+	})
+	sort.Strings(s.tokens)
+	s.db, s.txID = db, tx.ID()
+}
+
+// refresh rebuilds the index if the store has changed since it was built.
+// Callers hold s.mu.
+func (s *searchIndex) refresh(tx *bolt.Tx) {
+	if s.db != db || s.txID != tx.ID() {
+		s.rebuild(tx)
+	}
+}
+
+// buildSearchIndex indexes the store on startup
+func buildSearchIndex() error {
+	return db.View(func(tx *bolt.Tx) error {
+		search.mu.Lock()
+		defer search.mu.Unlock()
+		search.rebuild(tx)
+		logger("store").Info("search index built", "records", len(search.docs), "words", len(search.tokens))
+		return nil
+	})
+}
+
+// lookup scores the documents containing words starting with every term.
+// A whole-word match counts double.
+func (s *searchIndex) lookup(terms []string) map[int]*SearchResult {
+	var hits map[int]*SearchResult
+	for _, term := range terms {
+		termHits := map[int]*SearchResult{}
+		for i := sort.SearchStrings(s.tokens, term); i < len(s.tokens) && strings.HasPrefix(s.tokens[i], term); i++ {
+			token := s.tokens[i]
+			for _, p := range s.index[token] {
+				h, ok := termHits[p.doc]
+				if !ok {
+					res := s.docs[p.doc].result
+					h = &res
+					termHits[p.doc] = h
+				}
+				score := searchFieldWeights[p.field]
+				if token == term {
+					score *= 2
+				}
+				h.Score += score
+				if !slices.Contains(h.Matched, p.field) {
+					h.Matched = append(h.Matched, p.field)
+				}
+			}
+		}
+		if hits == nil {
+			hits = termHits
+			continue
+		}
+		for doc, h := range hits {
+			th, ok := termHits[doc]
+			if !ok {
+				delete(hits, doc)
+				continue
+			}
+			h.Score += th.Score
+			for _, field := range th.Matched {
+				if !slices.Contains(h.Matched, field) {
+					h.Matched = append(h.Matched, field)
+				}
+			}
+		}
+	}
+	return hits
+}
+
+// SEARCH
+
+// searchRecords finds expenses, income and bills whose description,
+// merchant, category, tags or notes contain words starting with every term of
+// ?q=, best matches first. ?type= limits the search to one kind of record
+// and ?limit= caps the results (default 20).
+func searchRecords(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	terms := searchTokens(q.Get("q"))
+	if len(terms) == 0 {
+		respondError(w, http.StatusBadRequest, "q must contain a word to search for")
+		return
+	}
+	kind := q.Get("type")
+	if kind != "" && !slices.Contains(searchTypes, kind) {
+		respondError(w, http.StatusBadRequest, "type must be expense, income or bill")
+		return
+	}
+	limit := 20
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	user := authUser(r)
+	results := []SearchResult{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		search.mu.Lock()
+		defer search.mu.Unlock()
+		search.refresh(tx)
+		for doc, h := range search.lookup(terms) {
+			d := search.docs[doc]
+			if (kind != "" && h.Type != kind) || !(d.shared || ownedBy(d.owner, user)) {
+				continue
+			}
+			sort.Strings(h.Matched)
+			results = append(results, *h)
+		}
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Date != b.Date {
+			return a.Date > b.Date
+		}
+		return a.ID < b.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	respondJSON(w, http.StatusOK, results)
+}
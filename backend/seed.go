@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// demoIDPrefix marks records created by the seeder so they can be wiped
+// without touching real data.
+const demoIDPrefix = "demo-"
+
+// demoBuckets lists the buckets the seeder writes to
+var demoBuckets = []string{expensesBucket, budgetsBucket, goalsBucket, investmentsBucket, billsBucket, incomeBucket}
+
+type demoCategory struct {
+	Name      string
+	Color     string
+	Merchants []string
+	Min, Max  float64
+}
+
+var demoCategories = []demoCategory{
+	{"Groceries", "#22c55e", []string{"BigBasket", "DMart", "Reliance Fresh", "Zepto"}, 250, 3500},
+	{"Dining", "#f59e0b", []string{"Swiggy", "Zomato", "Starbucks", "Haldiram's"}, 150, 1800},
+	{"Transport", "#3b82f6", []string{"Uber", "Ola", "Indian Oil", "Namma Metro"}, 60, 2500},
+	{"Utilities", "#8b5cf6", []string{"BESCOM", "Airtel", "Jio", "BWSSB"}, 400, 3000},
+	{"Shopping", "#ec4899", []string{"Amazon", "Flipkart", "Myntra", "Decathlon"}, 300, 6000},
+	{"Entertainment", "#14b8a6", []string{"BookMyShow", "Netflix", "Spotify", "PVR"}, 150, 1500},
+	{"Health", "#ef4444", []string{"Apollo Pharmacy", "Practo", "1mg", "Cult.fit"}, 200, 4000},
+}
+
+var demoUsers = []string{"Dad", "Mom"}
+
+// seedDemoData writes a deterministic set of sample records covering the
+// last three months. Existing demo records are replaced.
+func seedDemoData() (map[string]int, error) {
+	rng := rand.New(rand.NewSource(42))
+	now := time.Now().In(householdLocation())
+	counts := map[string]int{}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := wipeDemoRecords(tx, counts); err != nil {
+			return err
+		}
+		for k := range counts {
+			delete(counts, k)
+		}
+
+		put := func(bucket, id string, v interface{}) error {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			counts[bucket]++
+			return tx.Bucket([]byte(bucket)).Put([]byte(id), data)
+		}
+
+		// Budgets for the current month, one per category
+		budgetIDs := map[string]string{}
+		month := now.Format("2006-01")
+		for i, cat := range demoCategories {
+			budget := Budget{
+				ID:          fmt.Sprintf("%sbudget-%d", demoIDPrefix, i+1),
+				Name:        cat.Name,
+				Category:    cat.Name,
+				Month:       month,
+				Limit:       Money(int(cat.Max*4/500)+1) * 500 * majorUnit,
+				Currency:    "INR",
+				Color:       cat.Color,
+				IsRecurring: true,
+			}
+			budgetIDs[cat.Name] = budget.ID
+			if err := put(budgetsBucket, budget.ID, budget); err != nil {
+				return err
+			}
+		}
+
+		// Expenses spread over the last 90 days
+		for i := 0; i < 120; i++ {
+			cat := demoCategories[rng.Intn(len(demoCategories))]
+			date := now.AddDate(0, 0, -rng.Intn(90))
+			amount := cat.Min + rng.Float64()*(cat.Max-cat.Min)
+			ts := date.Format(time.RFC3339)
+			expense := Expense{
+				ID:            fmt.Sprintf("%sexpense-%03d", demoIDPrefix, i+1),
+				Amount:        Money(amount * float64(majorUnit)),
+				Currency:      "INR",
+				Description:   fmt.Sprintf("%s purchase", cat.Name),
+				Category:      cat.Name,
+				CategoryColor: cat.Color,
+				Merchant:      cat.Merchants[rng.Intn(len(cat.Merchants))],
+				Date:          date.Format("2006-01-02"),
+				User:          demoUsers[rng.Intn(len(demoUsers))],
+				IsShared:      rng.Intn(4) == 0,
+				CreatedAt:     ts,
+				UpdatedAt:     ts,
+			}
+			if date.Format("2006-01") == month {
+				expense.BudgetIds = []string{budgetIDs[cat.Name]}
+			}
+			if err := put(expensesBucket, expense.ID, expense); err != nil {
+				return err
+			}
+		}
+
+		// Monthly salary and some side income
+		for m := 0; m < 3; m++ {
+			date := time.Date(now.Year(), now.Month(), 1, 9, 0, 0, 0, now.Location()).AddDate(0, -m, 0)
+			ts := date.Format(time.RFC3339)
+			incomes := []Income{
+				{Amount: 145000 * majorUnit, Source: "Salary", Description: "Monthly salary", User: "Dad", IsRecurring: true},
+				{Amount: 98000 * majorUnit, Source: "Salary", Description: "Monthly salary", User: "Mom", IsRecurring: true},
+				{Amount: Money(5000+rng.Intn(15000)) * majorUnit, Source: "Freelance", Description: "Consulting invoice", User: "Mom"},
+			}
+			for j, income := range incomes {
+				income.ID = fmt.Sprintf("%sincome-%d-%d", demoIDPrefix, m+1, j+1)
+				income.Currency = "INR"
+				income.Date = date.Format("2006-01-02")
+				income.CreatedAt = ts
+				income.UpdatedAt = ts
+				if err := put(incomeBucket, income.ID, income); err != nil {
+					return err
+				}
+			}
+		}
+
+		goals := []Goal{
+			{Name: "Emergency Fund", Target: 600000 * majorUnit, Current: 385000 * majorUnit, Deadline: now.AddDate(1, 0, 0).Format("2006-01-02"), Color: "#22c55e"},
+			{Name: "Goa Vacation", Target: 120000 * majorUnit, Current: 42000 * majorUnit, Deadline: now.AddDate(0, 6, 0).Format("2006-01-02"), Color: "#3b82f6"},
+			{Name: "New Car", Target: 900000 * majorUnit, Current: 150000 * majorUnit, Deadline: now.AddDate(3, 0, 0).Format("2006-01-02"), Color: "#f59e0b"},
+		}
+		for i, goal := range goals {
+			goal.ID = fmt.Sprintf("%sgoal-%d", demoIDPrefix, i+1)
+			goal.Currency = "INR"
+			if err := put(goalsBucket, goal.ID, goal); err != nil {
+				return err
+			}
+		}
+
+		investments := []Investment{
+			{Name: "Nifty 50 Index Fund", Type: "Mutual Fund", InvestedValue: 250000 * majorUnit, Value: 291500 * majorUnit},
+			{Name: "HDFC Bank", Type: "Stock", InvestedValue: 80000 * majorUnit, Value: 86400 * majorUnit},
+			{Name: "Public Provident Fund", Type: "PPF", InvestedValue: 300000 * majorUnit, Value: 342000 * majorUnit},
+			{Name: "Sovereign Gold Bond", Type: "Gold", InvestedValue: 60000 * majorUnit, Value: 71800 * majorUnit},
+		}
+		for i, investment := range investments {
+			investment.ID = fmt.Sprintf("%sinvestment-%d", demoIDPrefix, i+1)
+			investment.Currency = "INR"
+			investment.Returns = investment.Value - investment.InvestedValue
+			investment.ReturnsPercent = float64(investment.Returns) / float64(investment.InvestedValue) * 100
+			if err := put(investmentsBucket, investment.ID, investment); err != nil {
+				return err
+			}
+		}
+
+		bills := []BillReminder{
+			{Name: "Electricity", Amount: 2400 * majorUnit, DueDate: now.AddDate(0, 0, 5).Format("2006-01-02"), Status: "upcoming", Category: "Utilities"},
+			{Name: "Broadband", Amount: 999 * majorUnit, DueDate: now.AddDate(0, 0, 2).Format("2006-01-02"), Status: "upcoming", Category: "Utilities"},
+			{Name: "Credit Card", Amount: 18650 * majorUnit, DueDate: now.AddDate(0, 0, -1).Format("2006-01-02"), Status: "overdue", Category: "Shopping"},
+			{Name: "Netflix", Amount: 649 * majorUnit, DueDate: now.AddDate(0, 0, 12).Format("2006-01-02"), Status: "upcoming", Category: "Entertainment"},
+		}
+		for i, bill := range bills {
+			bill.ID = fmt.Sprintf("%sbill-%d", demoIDPrefix, i+1)
+			bill.Currency = "INR"
+			if err := put(billsBucket, bill.ID, bill); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return counts, err
+}
+
+// wipeDemoRecords deletes every record whose key carries the demo prefix
+func wipeDemoRecords(tx *bolt.Tx, counts map[string]int) error {
+	for _, name := range demoBuckets {
+		b := tx.Bucket([]byte(name))
+		var keys [][]byte
+		c := b.Cursor()
+		prefix := []byte(demoIDPrefix)
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), demoIDPrefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		counts[name] += len(keys)
+	}
+	return nil
+}
+
+// ADMIN: SEED
+
+func seedData(w http.ResponseWriter, r *http.Request) {
+	counts, err := seedDemoData()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Demo data seeded",
+		"created": counts,
+	})
+}
+
+func wipeSeedData(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return wipeDemoRecords(tx, counts)
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Demo data removed",
+		"deleted": counts,
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"time"
+	_ "time/tzdata" // zone data for minimal containers without /usr/share/zoneinfo
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// householdSettingsKey is the single record in the settings bucket
+const householdSettingsKey = "household"
+
+// Settings are household preferences that change how data is interpreted
+type Settings struct {
+	// Timezone is an IANA zone such as "Asia/Kolkata" used to decide which
+	// day and month a transaction falls in. Empty means the server's zone.
+	Timezone string `json:"timezone"`
+	// UserTimezones overrides Timezone for members living elsewhere,
+	// keyed by the user name recorded on expenses and income.
+	UserTimezones map[string]string `json:"userTimezones"`
+	// MemberRoles marks each member an adult, a child or a viewer, keyed
+	// like UserTimezones. Members without a role are not adults.
+	MemberRoles map[string]string `json:"memberRoles"`
+
+	// FiscalYearStartMonth is 1-12; Indian financial years start in April
+	FiscalYearStartMonth int `json:"fiscalYearStartMonth"`
+	// BudgetStartDay is the day of month budget cycles begin, e.g. payday.
+	// Capped at 28 so every month has it.
+	BudgetStartDay int `json:"budgetStartDay"`
+
+	// BaseCurrency is the ISO 4217 code totals are reported in
+	BaseCurrency string `json:"baseCurrency"`
+	// ExchangeRates give the value of one unit of another currency in the
+	// base currency, e.g. {"USD": 83.2}. Amounts in currencies without a
+	// rate are left out of totals.
+	ExchangeRates map[string]float64 `json:"exchangeRates"`
+
+	// fetchedRates come from the exchange rate provider and apply to
+	// currencies without a rate of their own above
+	fetchedRates map[string]float64
+}
+
+// defaultSettings apply until the household saves its own
+func defaultSettings() Settings {
+	return Settings{
+		UserTimezones:        map[string]string{},
+		MemberRoles:          map[string]string{},
+		FiscalYearStartMonth: 4,
+		BudgetStartDay:       1,
+		BaseCurrency:         defaultCurrency,
+		ExchangeRates:        map[string]float64{},
+	}
+}
+
+// applyDefaults fills fields left unset, including ones added after the
+// settings were saved
+func (s *Settings) applyDefaults() {
+	d := defaultSettings()
+	if s.UserTimezones == nil {
+		s.UserTimezones = d.UserTimezones
+	}
+	if s.MemberRoles == nil {
+		s.MemberRoles = d.MemberRoles
+	}
+	if s.FiscalYearStartMonth == 0 {
+		s.FiscalYearStartMonth = d.FiscalYearStartMonth
+	}
+	if s.BudgetStartDay == 0 {
+		s.BudgetStartDay = d.BudgetStartDay
+	}
+	if s.BaseCurrency == "" {
+		s.BaseCurrency = d.BaseCurrency
+	}
+	if s.ExchangeRates == nil {
+		s.ExchangeRates = d.ExchangeRates
+	}
+}
+
+// validate checks the settings and canonicalizes currency codes
+func (s *Settings) validate() error {
+	if s.FiscalYearStartMonth < 1 || s.FiscalYearStartMonth > 12 {
+		return fmt.Errorf("fiscalYearStartMonth must be 1-12")
+	}
+	if s.BudgetStartDay < 1 || s.BudgetStartDay > 28 {
+		return fmt.Errorf("budgetStartDay must be 1-28")
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", s.Timezone)
+	}
+	for user, tz := range s.UserTimezones {
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" {
+			return fmt.Errorf("invalid timezone %q for %s", tz, user)
+		}
+	}
+	for user, role := range s.MemberRoles {
+		if err := oneOf("memberRoles."+user, role, memberRoles); err != nil {
+			return err
+		}
+	}
+	base, err := normalizeCurrency(s.BaseCurrency, "")
+	if err != nil {
+		return err
+	}
+	s.BaseCurrency = base
+	rates := make(map[string]float64, len(s.ExchangeRates))
+	for code, rate := range s.ExchangeRates {
+		c, err := normalizeCurrency(code, "")
+		if err != nil || c == "" {
+			return fmt.Errorf("exchangeRates: unknown currency %q", code)
+		}
+		if rate <= 0 {
+			return fmt.Errorf("exchangeRates: rate for %s must be positive", c)
+		}
+		rates[c] = rate
+	}
+	s.ExchangeRates = rates
+	return nil
+}
+
+// loadSettings reads the household settings, returning defaults when none
+// have been saved.
+func loadSettings(tx *bolt.Tx) Settings {
+	s := defaultSettings()
+	if v := tx.Bucket([]byte(settingsBucket)).Get([]byte(householdSettingsKey)); v != nil {
+		json.Unmarshal(v, &s)
+	}
+	s.applyDefaults()
+	s.fetchedRates = loadFetchedRates(tx, s.BaseCurrency)
+	return s
+}
+
+func currentSettings() Settings {
+	var s Settings
+	db.View(func(tx *bolt.Tx) error {
+		s = loadSettings(tx)
+		return nil
+	})
+	return s
+}
+
+// Household roles. Children can record their own spending but are kept out
+// of sensitive areas such as the documents vault. Viewers, such as a
+// financial planner, can look at the household's records but change nothing,
+// and are kept out of adult-only areas like children are.
+const (
+	roleAdult  = "adult"
+	roleChild  = "child"
+	roleViewer = "viewer"
+)
+
+var memberRoles = []string{roleAdult, roleChild, roleViewer}
+
+// isAdult reports whether a member was given the adult role. Members
+// without a role and names the household does not know are not adults.
+func (s Settings) isAdult(user string) bool {
+	return user != "" && s.MemberRoles[user] == roleAdult
+}
+
+// adults lists the members given the adult role, in name order
+func (s Settings) adults() []string {
+	var adults []string
+	for user, role := range s.MemberRoles {
+		if role == roleAdult {
+			adults = append(adults, user)
+		}
+	}
+	sort.Strings(adults)
+	return adults
+}
+
+// requireAdult turns away requests not signed in as an adult member. Only
+// the token counts: a Remote-User header names anyone it likes.
+func requireAdult(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := authUser(r)
+		if user == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			respondError(w, http.StatusUnauthorized, "sign in as an adult member to do this")
+			return
+		}
+		if !currentSettings().isAdult(user) {
+			respondError(w, http.StatusForbidden, "only adult members can do this")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// location returns the zone for a household member, falling back to the
+// household zone and then the server's.
+func (s Settings) location(user string) *time.Location {
+	name := s.Timezone
+	if tz, ok := s.UserTimezones[user]; ok {
+		name = tz
+	}
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// householdLocation is the zone used for household-wide periods
+func householdLocation() *time.Location {
+	return currentSettings().location("")
+}
+
+// SETTINGS
+
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, currentSettings())
+}
+
+func updateSettings(w http.ResponseWriter, r *http.Request) {
+	var s Settings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.applyDefaults()
+	if err := s.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	caller := authUser(r)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		// Once there are accounts only adults hand out roles
+		old := loadSettings(tx)
+		if k, _ := tx.Bucket([]byte(usersBucket)).Cursor().First(); k != nil &&
+			!maps.Equal(old.MemberRoles, s.MemberRoles) && !old.isAdult(caller) {
+			return errForbidden
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(settingsBucket)).Put([]byte(householdSettingsKey), data)
+	})
+	if err == errForbidden {
+		respondError(w, http.StatusForbidden, "only adult members can change roles")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, s)
+}
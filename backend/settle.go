@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExpenseSplit is one member's share of a shared expense. The member who
+// paid (the expense's PaidBy, else its User) may list their own share too;
+// every other share is owed to them. A share is a fixed amount or a
+// percentage of the expense, from which the amount is worked out on save.
+type ExpenseSplit struct {
+	User    string  `json:"user"`
+	Amount  Money   `json:"amount"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// Transfer moves money between household members. It is not spending:
+// settlements of shared expenses are recorded as transfers.
+type Transfer struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    Money  `json:"amount"`
+	Currency  string `json:"currency"`
+	Date      string `json:"date"`
+	Kind      string `json:"kind"` // "settlement"
+	Note      string `json:"note,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Balance is what one member owes another after netting shared expenses
+// against the transfers between them
+type Balance struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency"`
+	Message  string `json:"message"` // e.g. "A owes B ₹3,450"
+}
+
+// MemberBalance is where a member stands across all shared expenses and
+// transfers in one currency: positive when they are owed, negative when
+// they owe
+type MemberBalance struct {
+	User     string `json:"user"`
+	Currency string `json:"currency"`
+	Net      Money  `json:"net"`
+}
+
+// Settlements are the members' net balances and the fewest payments that
+// would settle them all
+type Settlements struct {
+	Members  []MemberBalance `json:"members"`
+	Payments []Balance       `json:"payments"`
+}
+
+var errNothingOwed = errors.New("nothing owed")
+
+// visibleTo reports whether user may see the transfer: members see those
+// they paid or received
+func (t Transfer) visibleTo(user string) bool {
+	return user == "" || t.From == user || t.To == user
+}
+
+// visibleTo reports whether user is one of the members the balance is between
+func (b Balance) visibleTo(user string) bool {
+	return user == "" || b.From == user || b.To == user
+}
+
+// payer is the member who paid for the expense
+func (e Expense) payer() string {
+	if e.PaidBy != "" {
+		return e.PaidBy
+	}
+	return e.User
+}
+
+// validateSplits works out percentage shares and checks that an expense's
+// shares add up to its amount
+func validateSplits(e *Expense) error {
+	e.PaidBy = strings.TrimSpace(e.PaidBy)
+	if len(e.Splits) == 0 {
+		e.Splits = nil
+		return nil
+	}
+	var total, percentTotal Money
+	var percents float64
+	last := -1
+	for i, s := range e.Splits {
+		e.Splits[i].User = strings.TrimSpace(s.User)
+		if e.Splits[i].User == "" {
+			return fmt.Errorf("splits[%d]: user is required", i)
+		}
+		if s.Percent != 0 {
+			if s.Percent < 0 || s.Percent > 100 {
+				return fmt.Errorf("splits[%d]: percent must be between 0 and 100", i)
+			}
+			e.Splits[i].Amount = roundForCurrency(Money(math.Round(float64(e.Amount)*s.Percent/100)), e.Currency)
+			percents += s.Percent
+			percentTotal += e.Splits[i].Amount
+			last = i
+		}
+		if e.Splits[i].Amount <= 0 {
+			return fmt.Errorf("splits[%d]: amount must be positive", i)
+		}
+		total += e.Splits[i].Amount
+	}
+	// Shares that add up before rounding still do: the last percentage share
+	// takes what rounding left over
+	if exact := float64(total-percentTotal) + float64(e.Amount)*percents/100; last >= 0 && math.Abs(exact-float64(e.Amount)) < 0.5 {
+		e.Splits[last].Amount += e.Amount - total
+		total = e.Amount
+	}
+	if total != e.Amount {
+		return fmt.Errorf("splits add up to %s, expense amount is %s", total, e.Amount)
+	}
+	if e.payer() == "" {
+		return fmt.Errorf("paidBy or user (who paid) is required for split expenses")
+	}
+	e.IsShared = true
+	return nil
+}
+
+// computeBalances nets what members owe each other, pair by pair and
+// currency by currency. Fully settled pairs are left out.
+func computeBalances(expenses []Expense, transfers []Transfer, lang string) []Balance {
+	type pair struct{ from, to, currency string }
+	owed := map[pair]Money{}
+	for _, e := range expenses {
+		for _, s := range e.Splits {
+			if s.User != e.payer() {
+				owed[pair{s.User, e.payer(), e.Currency}] += s.Amount
+			}
+		}
+	}
+	for _, t := range transfers {
+		owed[pair{t.From, t.To, t.Currency}] -= t.Amount
+	}
+
+	balances := []Balance{}
+	seen := map[pair]bool{}
+	for p := range owed {
+		back := pair{p.to, p.from, p.currency}
+		if seen[p] || seen[back] {
+			continue
+		}
+		seen[p] = true
+		net := owed[p] - owed[back]
+		from, to := p.from, p.to
+		if net < 0 {
+			net, from, to = -net, to, from
+		}
+		if net == 0 {
+			continue
+		}
+		balances = append(balances, Balance{
+			From:     from,
+			To:       to,
+			Amount:   net,
+			Currency: p.currency,
+			Message:  translate(lang, "balance.owes", from, to, formatMoney(net, p.currency)),
+		})
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		a, b := balances[i], balances[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Currency < b.Currency
+	})
+	return balances
+}
+
+// simplifyDebts works out each member's net balance, currency by currency,
+// and the payments that settle them: the member owing most pays the one
+// owed most until everyone is square. This often needs fewer payments than
+// settling pair by pair, and may have a member pay someone they never
+// shared an expense with.
+func simplifyDebts(expenses []Expense, transfers []Transfer, lang string) Settlements {
+	type position struct{ user, currency string }
+	net := map[position]Money{}
+	for _, e := range expenses {
+		for _, s := range e.Splits {
+			if s.User != e.payer() {
+				net[position{s.User, e.Currency}] -= s.Amount
+				net[position{e.payer(), e.Currency}] += s.Amount
+			}
+		}
+	}
+	for _, t := range transfers {
+		net[position{t.From, t.Currency}] += t.Amount
+		net[position{t.To, t.Currency}] -= t.Amount
+	}
+
+	result := Settlements{Members: []MemberBalance{}, Payments: []Balance{}}
+	byCurrency := map[string][]MemberBalance{}
+	for p, amount := range net {
+		if amount != 0 {
+			byCurrency[p.currency] = append(byCurrency[p.currency], MemberBalance{User: p.user, Currency: p.currency, Net: amount})
+		}
+	}
+	currencies := make([]string, 0, len(byCurrency))
+	for c := range byCurrency {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		members := byCurrency[currency]
+		sort.Slice(members, func(i, j int) bool {
+			if members[i].Net != members[j].Net {
+				return members[i].Net > members[j].Net
+			}
+			return members[i].User < members[j].User
+		})
+		result.Members = append(result.Members, members...)
+
+		// Creditors are at the front, most owed first; debtors at the back,
+		// most owing last
+		left := append([]MemberBalance(nil), members...)
+		for i, j := 0, len(left)-1; i < j && left[i].Net > 0 && left[j].Net < 0; {
+			amount := min(left[i].Net, -left[j].Net)
+			from, to := left[j].User, left[i].User
+			result.Payments = append(result.Payments, Balance{From: from, To: to, Amount: amount, Currency: currency,
+				Message: translate(lang, "balance.owes", from, to, formatMoney(amount, currency))})
+			left[i].Net -= amount
+			left[j].Net += amount
+			if left[i].Net == 0 {
+				i++
+			}
+			if left[j].Net == 0 {
+				j--
+			}
+		}
+	}
+	return result
+}
+
+// loadSplits reads split expenses and the transfers between members
+func loadSplits(r *http.Request, tx *bolt.Tx) ([]Expense, []Transfer, error) {
+	var expenses []Expense
+	var transfers []Transfer
+	err := forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+		var e Expense
+		if json.Unmarshal(v, &e) == nil && len(e.Splits) > 0 {
+			expenses = append(expenses, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = forEach(r.Context(), tx.Bucket([]byte(transfersBucket)), func(k, v []byte) error {
+		var t Transfer
+		if json.Unmarshal(v, &t) == nil {
+			transfers = append(transfers, t)
+		}
+		return nil
+	})
+	return expenses, transfers, err
+}
+
+// loadBalances nets what members owe each other pair by pair, keeping the
+// balances the caller is party to
+func loadBalances(r *http.Request, tx *bolt.Tx, lang string) ([]Balance, error) {
+	expenses, transfers, err := loadSplits(r, tx)
+	if err != nil {
+		return nil, err
+	}
+	user := authUser(r)
+	return slices.DeleteFunc(computeBalances(expenses, transfers, lang), func(b Balance) bool { return !b.visibleTo(user) }), nil
+}
+
+// loadSettlements works out the simplified payments between members,
+// keeping the caller's own balance and payments
+func loadSettlements(r *http.Request, tx *bolt.Tx, lang string) (Settlements, error) {
+	expenses, transfers, err := loadSplits(r, tx)
+	if err != nil {
+		return Settlements{}, err
+	}
+	s := simplifyDebts(expenses, transfers, lang)
+	if user := authUser(r); user != "" {
+		s.Members = slices.DeleteFunc(s.Members, func(m MemberBalance) bool { return m.User != user })
+		s.Payments = slices.DeleteFunc(s.Payments, func(b Balance) bool { return !b.visibleTo(user) })
+	}
+	return s, nil
+}
+
+// BALANCES & TRANSFERS
+
+func getBalances(w http.ResponseWriter, r *http.Request) {
+	lang := requestLanguage(r)
+	var balances []Balance
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		balances, err = loadBalances(r, tx, lang)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, balances)
+}
+
+// getSettlements returns each member's net balance and the simplified
+// payments that would settle everyone up
+func getSettlements(w http.ResponseWriter, r *http.Request) {
+	lang := requestLanguage(r)
+	var settlements Settlements
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		settlements, err = loadSettlements(r, tx, lang)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, settlements)
+}
+
+// settleUp records a repayment from one member to another as a transfer.
+// Without an amount it settles the whole balance, bringing it to zero.
+func settleUp(w http.ResponseWriter, r *http.Request) {
+	lang := requestLanguage(r)
+	settle(w, r, func(tx *bolt.Tx) ([]Balance, error) {
+		return loadBalances(r, tx, lang)
+	}, func(tx *bolt.Tx, t Transfer) (interface{}, error) {
+		balances, err := loadBalances(r, tx, lang)
+		return map[string]interface{}{"transfer": t, "balances": balances}, err
+	})
+}
+
+// settleSettlement records one of the simplified payments as a transfer.
+// Without an amount it makes the whole payment.
+func settleSettlement(w http.ResponseWriter, r *http.Request) {
+	lang := requestLanguage(r)
+	settle(w, r, func(tx *bolt.Tx) ([]Balance, error) {
+		s, err := loadSettlements(r, tx, lang)
+		return s.Payments, err
+	}, func(tx *bolt.Tx, t Transfer) (interface{}, error) {
+		s, err := loadSettlements(r, tx, lang)
+		return map[string]interface{}{"transfer": t, "settlements": s}, err
+	})
+}
+
+// settle records the transfer in the request body, which may pay no more
+// than the matching debt among owing lists, and responds with what result
+// reads after it
+func settle(w http.ResponseWriter, r *http.Request, owing func(tx *bolt.Tx) ([]Balance, error),
+	result func(tx *bolt.Tx, t Transfer) (interface{}, error)) {
+	var t Transfer
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t.From, t.To = strings.TrimSpace(t.From), strings.TrimSpace(t.To)
+	if t.From == "" || t.To == "" || t.From == t.To {
+		respondError(w, http.StatusBadRequest, "from and to must be two different members")
+		return
+	}
+	if !t.visibleTo(authUser(r)) {
+		respondError(w, http.StatusForbidden, "members can only record settlements they pay or receive")
+		return
+	}
+	settings := currentSettings()
+	var err error
+	if t.Currency, err = normalizeCurrency(t.Currency, settings.BaseCurrency); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	loc := settings.location(t.From)
+	if t.Date, err = normalizeDate(t.Date, loc); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if t.Date == "" {
+		t.Date = today(loc)
+	}
+	if t.Amount < 0 {
+		respondError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	now := time.Now()
+	t.ID = fmt.Sprintf("%d", now.UnixNano())
+	t.Kind = "settlement"
+	t.CreatedAt = now.Format(time.RFC3339)
+
+	var owed Money
+	var response interface{}
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		current, err := owing(tx)
+		if err != nil {
+			return err
+		}
+		for _, b := range current {
+			if b.From == t.From && b.To == t.To && b.Currency == t.Currency {
+				owed = b.Amount
+			}
+		}
+		if owed == 0 {
+			return errNothingOwed
+		}
+		if t.Amount == 0 {
+			t.Amount = owed
+		}
+		if t.Amount > owed {
+			return errOverpayment
+		}
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(transfersBucket)).Put([]byte(t.ID), data); err != nil {
+			return err
+		}
+		response, err = result(tx, t)
+		return err
+	})
+	switch {
+	case err == errNothingOwed:
+		respondError(w, http.StatusConflict, fmt.Sprintf("%s owes %s nothing in %s", t.From, t.To, t.Currency))
+	case err == errOverpayment:
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("%s only owes %s %s", t.From, t.To, formatMoney(owed, t.Currency)))
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusCreated, response)
+	}
+}
+
+// getTransfers lists the transfers the caller paid or received
+func getTransfers(w http.ResponseWriter, r *http.Request) {
+	user := authUser(r)
+	transfers := []Transfer{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(transfersBucket)), func(k, v []byte) error {
+			var t Transfer
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.visibleTo(user) {
+				transfers = append(transfers, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, transfers)
+}
+
+// deleteTransfer reverses a recorded settlement, reopening the balance
+func deleteTransfer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(transfersBucket))
+		if !reachable(b, id, authUser(r), Transfer.visibleTo) {
+			return errNotFound
+		}
+		j.track(transfersBucket, []byte(id))
+		return b.Delete([]byte(id))
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "transfer not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Transfer deleted"})
+}
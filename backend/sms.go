@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultSMSTemplates read the transaction texts of common Indian banks and
+// UPI apps. From matches the sender ID, such as "VM-HDFCBK"; templates in
+// the config are tried first, and the last one reads any UPI payment.
+var defaultSMSTemplates = []MailTemplate{
+	{Bank: "HDFC Bank", From: "HDFC", Pattern: `Sent Rs\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) From HDFC Bank A/C [x*]*(?P<account>\d{4}) To (?P<merchant>.+?) On (?P<date>\d{2}/\d{2}/\d{2,4})`},
+	{Bank: "HDFC Bank", From: "HDFC", Pattern: `Spent Rs\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) On HDFC Bank Card [x*]*(?P<account>\d{4}) At (?P<merchant>.+?) On (?P<date>\d{4}-\d{2}-\d{2})`},
+	{Bank: "ICICI Bank", From: "ICICI", Pattern: `ICICI Bank Acc(?:oun)?t XX(?P<account>\d{3,4}) debited (?:for|with) (?:Rs|INR)\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) on (?P<date>\d{2}-\w{3}-\d{2,4}); (?P<merchant>.+?) credited`},
+	{Bank: "ICICI Bank", From: "ICICI", Pattern: `INR (?P<amount>[\d,]+(?:\.\d{1,2})?) spent (?:using|on) (?:your )?ICICI Bank (?:Credit )?Card XX(?P<account>\d{4}) on (?P<date>\d{2}-\w{3}-\d{2,4}) (?:at|on) (?P<merchant>.+?)\.`},
+	{Bank: "SBI", From: "SBI", Pattern: `A/C X(?P<account>\d{4}) debited by (?P<amount>[\d,]+(?:\.\d{1,2})?) on date (?P<date>\d{2}\w{3}\d{2}) trf to (?P<merchant>.+?) Ref`},
+	{Bank: "SBI Card", From: "SBI", Pattern: `Rs\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) spent on your SBI Credit Card ending (?:with )?(?P<account>\d{4}) at (?P<merchant>.+?) on (?P<date>\d{2}/\d{2}/\d{2,4})`},
+	{Bank: "UPI", From: "", Pattern: `(?:Rs|INR)\.?\s?(?P<amount>[\d,]+(?:\.\d{1,2})?) (?:has been |was )?(?:debited|paid|sent)\b.*?\bto (?:VPA )?(?P<merchant>[\w.\-]+@[\w.\-]+)`},
+}
+
+// SMSMessage is a text forwarded from a member's phone
+type SMSMessage struct {
+	Sender     string `json:"sender"` // sender ID, e.g. "VM-HDFCBK"
+	Text       string `json:"text"`
+	ReceivedAt string `json:"receivedAt,omitempty"` // RFC 3339; now when empty
+	User       string `json:"user,omitempty"`
+}
+
+// readTransactionSMS reads a bank text with the first template it matches.
+// ok is false for texts that are not debits, such as OTPs and credits.
+func readTransactionSMS(sender, text, user string, received time.Time, templates []MailTemplate, settings Settings) (PendingTransaction, bool, error) {
+	text = strings.Join(strings.Fields(text), " ")
+	sum := sha256.Sum256([]byte(sender + "\n" + text))
+	draft := PendingTransaction{
+		Source:    "sms",
+		MessageID: "sms:" + hex.EncodeToString(sum[:8]),
+		From:      sender,
+		User:      user,
+	}
+	if !received.IsZero() {
+		draft.ReceivedAt = received.Format(time.RFC3339)
+	}
+	for _, t := range templates {
+		if !strings.Contains(strings.ToUpper(sender), strings.ToUpper(t.From)) {
+			continue
+		}
+		re, err := t.compile()
+		if err != nil {
+			return PendingTransaction{}, false, err
+		}
+		if t.read(re, text, &draft, received, settings) {
+			return draft, true, nil
+		}
+	}
+	return PendingTransaction{}, false, nil
+}
+
+// INGEST
+
+// ingestSMS queues a bank text forwarded by a phone for review as an
+// expense. A text sent again answers with the pending transaction already
+// queued; one that is not a transaction is refused with 422.
+func ingestSMS(w http.ResponseWriter, r *http.Request) {
+	var req SMSMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		respondError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if user := authUser(r); user != "" {
+		req.User = user
+	}
+	received := time.Now()
+	if req.ReceivedAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ReceivedAt)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "receivedAt must be an RFC 3339 time")
+			return
+		}
+		received = t
+	}
+	settings := currentSettings()
+	templates := append(append([]MailTemplate{}, config().SMSTemplates...), defaultSMSTemplates...)
+	draft, ok, err := readTransactionSMS(strings.TrimSpace(req.Sender), req.Text, req.User, received, templates, settings)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusUnprocessableEntity, "not a recognized transaction message")
+		return
+	}
+
+	status := http.StatusCreated
+	now := time.Now()
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pendingBucket))
+		err := b.ForEach(func(k, v []byte) error {
+			var d PendingTransaction
+			if json.Unmarshal(v, &d) == nil && d.MessageID == draft.MessageID {
+				draft, status = d, http.StatusOK
+			}
+			return nil
+		})
+		if err != nil || status == http.StatusOK {
+			return err
+		}
+		draft.ID = fmt.Sprintf("%d", now.UnixNano())
+		draft.Status = pendingReview
+		draft.CreatedAt = now.Format(time.RFC3339)
+		draft.UpdatedAt = draft.CreatedAt
+		if m, ok := knownMerchant(tx, draft.Merchant); ok {
+			if m.Name != "" {
+				draft.Merchant = m.Name
+			}
+			draft.Category = m.DefaultCategory
+		}
+		return putPendingTransaction(tx, draft)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, status, draft)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// errRequestTimeout is returned by the context-aware transaction helpers
+// when the request was cancelled or ran past its deadline.
+var errRequestTimeout = errors.New("request timed out")
+
+// viewContext runs fn in a read transaction unless ctx is already done.
+// Scans inside fn should use forEach with the same ctx to stop early.
+func viewContext(ctx context.Context, fn func(tx *bolt.Tx) error) (err error) {
+	_, span := startSpan(ctx, "bolt.View")
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	return contextError(db.View(fn))
+}
+
+// updateContext runs fn in a write transaction. The context is checked again
+// once the writer lock is held, since waiting for it can take a while.
+// Returning a context error from fn rolls the transaction back.
+func updateContext(ctx context.Context, fn func(tx *bolt.Tx) error) (err error) {
+	_, span := startSpan(ctx, "bolt.Update")
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return contextError(err)
+	}
+	return contextError(db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(tx)
+	}))
+}
+
+// contextError maps context cancellation to errRequestTimeout
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return errRequestTimeout
+	}
+	return err
+}
+
+// forEach is bucket.ForEach that stops once ctx is done, so a scan started
+// for a client that has gone away doesn't keep its transaction open.
+func forEach(ctx context.Context, b *bolt.Bucket, fn func(k, v []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(k, v)
+	})
+}
+
+// respondStoreError answers a failed storage operation, turning timeouts
+// into 503 so clients know to retry rather than report a server fault.
+func respondStoreError(w http.ResponseWriter, status int, err error) {
+	if errors.Is(err, errRequestTimeout) {
+		w.Header().Set("Retry-After", "1")
+		respondError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	respondError(w, status, err.Error())
+}
+
+// requestDeadlineMiddleware bounds how long a request may spend in the
+// handler. The deadline reaches storage through r.Context().
+func requestDeadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := time.Duration(config().RequestTimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	subscriptionCycles   = []string{"monthly", "quarterly", "yearly"}
+	subscriptionStatuses = []string{"active", "flagged", "cancelled"}
+
+	errUnknownExpense = errors.New("unknown expense")
+)
+
+// subscriptionCycleMonths is the length of each billing cycle
+var subscriptionCycleMonths = map[string]int{"monthly": 1, "quarterly": 3, "yearly": 12}
+
+// defaultRemindDays is how long before a renewal it is reminded of
+const defaultRemindDays = 3
+
+// Subscription is a recurring service the household pays for. Flagging one
+// for cancellation marks it to be pruned; reminders then warn before it
+// renews again.
+type Subscription struct {
+	ID          string `json:"id"`
+	Service     string `json:"service"`
+	Plan        string `json:"plan,omitempty"`
+	Amount      Money  `json:"amount"`
+	Currency    string `json:"currency"`
+	Cycle       string `json:"cycle"`       // monthly, quarterly or yearly
+	RenewalDate string `json:"renewalDate"` // next renewal; moves on as renewals pass
+	// ExpenseID links the recurring expense the subscription is paid by
+	ExpenseID   string `json:"expenseId,omitempty"`
+	User        string `json:"user,omitempty"`
+	Status      string `json:"status"` // active, flagged or cancelled
+	RemindDays  int    `json:"remindDays"`
+	Notes       string `json:"notes,omitempty"`
+	FlaggedAt   string `json:"flaggedAt,omitempty"`
+	CancelledAt string `json:"cancelledAt,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+
+	Annualized Money `json:"annualized"` // computed: a year of renewals
+}
+
+func (s *Subscription) validate(settings Settings) error {
+	s.Service = strings.TrimSpace(s.Service)
+	if s.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	if s.Amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if s.Cycle == "" {
+		s.Cycle = "monthly"
+	}
+	if err := oneOf("cycle", s.Cycle, subscriptionCycles); err != nil {
+		return err
+	}
+	if s.Status == "" {
+		s.Status = "active"
+	}
+	if err := oneOf("status", s.Status, subscriptionStatuses); err != nil {
+		return err
+	}
+	if s.RemindDays < 0 {
+		return fmt.Errorf("remindDays cannot be negative")
+	}
+	if s.RemindDays == 0 {
+		s.RemindDays = defaultRemindDays
+	}
+	var err error
+	if s.Currency, err = normalizeCurrency(s.Currency, settings.BaseCurrency); err != nil {
+		return err
+	}
+	s.Amount = roundForCurrency(s.Amount, s.Currency)
+	if s.RenewalDate, err = normalizeDate(s.RenewalDate, settings.location(s.User)); err != nil {
+		return err
+	}
+	if s.RenewalDate == "" {
+		return fmt.Errorf("renewalDate is required")
+	}
+	return nil
+}
+
+// annualize fills in the yearly cost
+func (s *Subscription) annualize() {
+	s.Annualized = s.Amount * Money(12/subscriptionCycleMonths[s.Cycle])
+}
+
+// renew moves a past renewal date on by whole cycles until it is today or
+// later. It reports whether the date moved.
+func (s *Subscription) renew(today string) bool {
+	moved := false
+	for s.RenewalDate < today {
+		t, err := time.Parse(dateLayout, s.RenewalDate)
+		if err != nil {
+			return moved
+		}
+		s.RenewalDate = addMonthsClamped(t, subscriptionCycleMonths[s.Cycle]).Format(dateLayout)
+		moved = true
+	}
+	return moved
+}
+
+// checkSubscriptionRenewals rolls passed renewals forward and reminds the
+// household of those coming up within each subscription's reminder window.
+// Subscriptions flagged for cancellation get a sharper reminder.
+func checkSubscriptionRenewals() error {
+	now := billToday()
+	t, _ := time.Parse(dateLayout, now)
+	var upcoming []Subscription
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(subscriptionsBucket))
+		var renewed []Subscription
+		err := b.ForEach(func(k, v []byte) error {
+			var s Subscription
+			if json.Unmarshal(v, &s) != nil || s.Status == "cancelled" {
+				return nil
+			}
+			if s.renew(now) {
+				renewed = append(renewed, s)
+			}
+			if s.RenewalDate <= t.AddDate(0, 0, s.RemindDays).Format(dateLayout) {
+				upcoming = append(upcoming, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, s := range renewed {
+			if err := putSubscription(tx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range upcoming {
+		alert := newAlert(fmt.Sprintf("subscription.renewal:%s:%s", s.ID, s.RenewalDate), "subscription.renewal", s.ID,
+			"alert.subscription."+s.Status, s.Service, formatMoney(s.Amount, s.Currency), s.RenewalDate)
+		if s.User != "" {
+			alert.Recipients = []string{s.User}
+		}
+		if _, err := emitAlert(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putSubscription(tx *bolt.Tx, s Subscription) error {
+	s.Annualized = 0
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(subscriptionsBucket)).Put([]byte(s.ID), data)
+}
+
+func loadSubscriptions(r *http.Request, tx *bolt.Tx) ([]Subscription, error) {
+	subs := []Subscription{}
+	err := forEach(r.Context(), tx.Bucket([]byte(subscriptionsBucket)), func(k, v []byte) error {
+		var s Subscription
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		s.annualize()
+		subs = append(subs, s)
+		return nil
+	})
+	return subs, err
+}
+
+// SUBSCRIPTIONS
+
+// getSubscriptions lists subscriptions by renewal date, optionally only
+// those of one ?status=
+func getSubscriptions(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	var subs []Subscription
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		subs, err = loadSubscriptions(r, tx)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := []Subscription{}
+	for _, s := range subs {
+		if status == "" || s.Status == status {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RenewalDate < list[j].RenewalDate })
+	respondJSON(w, http.StatusOK, list)
+}
+
+// saveSubscription stores a created or edited subscription, stamping status
+// changes
+func saveSubscription(w http.ResponseWriter, r *http.Request, s Subscription, status int) {
+	if err := s.validate(currentSettings()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	s.UpdatedAt = now
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		var old Subscription
+		if v := tx.Bucket([]byte(subscriptionsBucket)).Get([]byte(s.ID)); v != nil {
+			json.Unmarshal(v, &old)
+			s.CreatedAt = old.CreatedAt
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		s.FlaggedAt, s.CancelledAt = old.FlaggedAt, old.CancelledAt
+		if s.Status == "flagged" && old.Status != "flagged" {
+			s.FlaggedAt = now
+		}
+		if s.Status == "cancelled" && old.Status != "cancelled" {
+			s.CancelledAt = now
+		}
+		if s.Status == "active" {
+			s.FlaggedAt, s.CancelledAt = "", ""
+		}
+		if s.ExpenseID != "" && tx.Bucket([]byte(expensesBucket)).Get([]byte(s.ExpenseID)) == nil {
+			return errUnknownExpense
+		}
+		return putSubscription(tx, s)
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "subscription not found")
+	case err == errUnknownExpense:
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("expense %s not found", s.ExpenseID))
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		s.annualize()
+		respondJSON(w, status, s)
+	}
+}
+
+func createSubscription(w http.ResponseWriter, r *http.Request) {
+	var s Subscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if s.ID == "" {
+		s.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	s.CreatedAt = now.Format(time.RFC3339)
+	saveSubscription(w, r, s, http.StatusCreated)
+}
+
+// updateSubscription edits a subscription; setting status to "flagged"
+// flags it for cancellation
+func updateSubscription(w http.ResponseWriter, r *http.Request) {
+	var s Subscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.ID = mux.Vars(r)["id"]
+	saveSubscription(w, r, s, http.StatusOK)
+}
+
+func deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		j.track(subscriptionsBucket, []byte(id))
+		return tx.Bucket([]byte(subscriptionsBucket)).Delete([]byte(id))
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Subscription deleted"})
+}
+
+// getSubscriptionReport totals what subscriptions cost a year in the base
+// currency, and what cancelling the flagged ones would save. Cancelled
+// subscriptions are left out.
+func getSubscriptionReport(w http.ResponseWriter, r *http.Request) {
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	var subs []Subscription
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		var err error
+		subs, err = loadSubscriptions(r, tx)
+		return err
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var annual, flagged Money
+	count := 0
+	list := []Subscription{}
+	for _, s := range subs {
+		if s.Status == "cancelled" {
+			continue
+		}
+		count++
+		conv.add(&annual, s.Annualized, s.Currency)
+		if s.Status == "flagged" {
+			conv.add(&flagged, s.Annualized, s.Currency)
+		}
+		list = append(list, s)
+	}
+	// Costliest first, to show what is worth pruning
+	sort.Slice(list, func(i, j int) bool { return list[i].Annualized > list[j].Annualized })
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"currency":              settings.BaseCurrency,
+		"unconvertedCurrencies": conv.unconverted(),
+		"count":                 count,
+		"annual":                annual,
+		"monthly":               annual / 12,
+		"flaggedSavings":        flagged,
+		"subscriptions":         list,
+	})
+}
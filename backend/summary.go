@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// listFilter holds the query filters shared by transaction endpoints:
+// ?from=&to= (inclusive dates), ?category=, ?user= and ?field.<key>= for
+// custom fields. Empty fields match everything. Signed-in callers only see
+// their own and shared records.
+type listFilter struct {
+	From     string
+	To       string
+	Category string
+	User     string
+	Tag      string
+	Fields   map[string]string
+	Viewer   string
+}
+
+// entry is what filters and summaries look at in a transaction
+type entry struct {
+	Amount   Money
+	Currency string
+	Date     string
+	Category string
+	User     string
+	Shared   bool
+	Tags     []string
+	Fields   map[string]interface{}
+}
+
+// parseListFilter reads the standard filters, normalizing dates so they
+// compare with stored ones
+func parseListFilter(r *http.Request) (listFilter, error) {
+	q := r.URL.Query()
+	loc := householdLocation()
+	from, err := normalizeDate(q.Get("from"), loc)
+	if err != nil {
+		return listFilter{}, err
+	}
+	to, err := normalizeDate(q.Get("to"), loc)
+	if err != nil {
+		return listFilter{}, err
+	}
+	f := listFilter{From: from, To: to, Category: q.Get("category"), User: q.Get("user"), Tag: normalizeTag(q.Get("tag")),
+		Fields: map[string]string{}, Viewer: authUser(r)}
+	for param, values := range q {
+		if key, ok := strings.CutPrefix(param, "field."); ok && len(values) > 0 {
+			f.Fields[key] = values[0]
+		}
+	}
+	return f, nil
+}
+
+func (f listFilter) matches(e entry) bool {
+	if f.From != "" && e.Date < f.From {
+		return false
+	}
+	if f.To != "" && e.Date > f.To {
+		return false
+	}
+	if f.Category != "" && e.Category != f.Category {
+		return false
+	}
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Tag != "" && !slices.Contains(e.Tags, f.Tag) {
+		return false
+	}
+	if !e.Shared && !ownedBy(e.User, f.Viewer) {
+		return false
+	}
+	return f.matchesFields(e.Fields)
+}
+
+// matchesFields compares custom field values in their query string form
+func (f listFilter) matchesFields(values map[string]interface{}) bool {
+	for key, want := range f.Fields {
+		v, ok := values[key]
+		if !ok || fieldString(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// listPage holds the paging parameters of list endpoints: ?page= (from 1)
+// and ?limit=, and ?sortBy= with ?order=asc|desc. Lists are only paged when
+// one of page or limit is given, and an order without sortBy sorts by the
+// endpoint's first sortable field.
+type listPage struct {
+	Page   int
+	Limit  int // 0 for everything
+	SortBy string
+	Desc   bool
+}
+
+// defaultPageLimit applies when ?page= is given without ?limit=
+const defaultPageLimit = 50
+
+// parseListPage reads the paging parameters; sortBy must be one of sortable
+func parseListPage(r *http.Request, sortable []string) (listPage, error) {
+	q := r.URL.Query()
+	p := listPage{Page: 1, SortBy: q.Get("sortBy")}
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("page must be a positive number")
+		}
+		p.Page, p.Limit = n, defaultPageLimit
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			return p, fmt.Errorf("limit must be between 1 and 500")
+		}
+		p.Limit = n
+	}
+	if p.SortBy != "" && !slices.Contains(sortable, p.SortBy) {
+		return p, fmt.Errorf("sortBy must be one of %s", strings.Join(sortable, ", "))
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		p.Desc = true
+	default:
+		return p, fmt.Errorf("order must be asc or desc")
+	}
+	if p.SortBy == "" && q.Get("order") != "" {
+		p.SortBy = sortable[0]
+	}
+	return p, nil
+}
+
+// paginate cuts the requested page out of a sorted list and reports the
+// list's full length in X-Total-Count
+func paginate[T any](w http.ResponseWriter, items []T, p listPage) []T {
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+	if p.Limit == 0 {
+		return items
+	}
+	start := min((p.Page-1)*p.Limit, len(items))
+	return items[start:min(start+p.Limit, len(items))]
+}
+
+// Summary aggregates the records matching a filter. The total is in the
+// base currency; records in currencies without a rate are counted but left
+// out of it, and their currencies listed.
+type Summary struct {
+	Count                 int      `json:"count"`
+	Total                 Money    `json:"total"`
+	Currency              string   `json:"currency"`
+	UnconvertedCurrencies []string `json:"unconvertedCurrencies"`
+	FirstDate             string   `json:"firstDate,omitempty"`
+	LastDate              string   `json:"lastDate,omitempty"`
+}
+
+func (s *Summary) add(conv *converter, amount Money, currency, date string) {
+	s.Count++
+	conv.add(&s.Total, amount, currency)
+	if date == "" {
+		return
+	}
+	if s.FirstDate == "" || date < s.FirstDate {
+		s.FirstDate = date
+	}
+	if date > s.LastDate {
+		s.LastDate = date
+	}
+}
+
+// summarize scans a bucket, adding every record that passes the filter
+func summarize[T any](ctx context.Context, bucket string, f listFilter, fields func(T) entry) (Summary, error) {
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+	s := Summary{Currency: settings.BaseCurrency}
+	err := viewContext(ctx, func(tx *bolt.Tx) error {
+		return forEach(ctx, tx.Bucket([]byte(bucket)), func(k, v []byte) error {
+			var record T
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if e := fields(record); f.matches(e) {
+				s.add(conv, e.Amount, e.Currency, e.Date)
+			}
+			return nil
+		})
+	})
+	s.UnconvertedCurrencies = conv.unconverted()
+	return s, err
+}
+
+func expenseFields(e Expense) entry {
+	return entry{Amount: e.Amount, Currency: e.Currency, Date: e.Date, Category: e.Category, User: e.User, Shared: e.IsShared,
+		Tags: e.Tags, Fields: e.CustomFields}
+}
+
+// incomeFields treats the income source as its category
+func incomeFields(i Income) entry {
+	return entry{Amount: i.Amount, Currency: i.Currency, Date: i.Date, Category: i.Source, User: i.User, Tags: i.Tags}
+}
+
+// billFields filters bills by due date; they belong to the household
+func billFields(b BillReminder) entry {
+	return entry{Amount: b.Amount, Currency: b.Currency, Date: b.DueDate, Category: b.Category, Tags: b.Tags}
+}
+
+// respondSummary runs summarize for a request and writes either the full
+// summary or just the count
+func respondSummary[T any](w http.ResponseWriter, r *http.Request, bucket string, fields func(T) entry, countOnly bool) {
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s, err := summarize(r.Context(), bucket, f, fields)
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if countOnly {
+		respondJSON(w, http.StatusOK, map[string]int{"count": s.Count})
+		return
+	}
+	respondJSON(w, http.StatusOK, s)
+}
+
+// COUNTS & SUMMARIES
+
+func getExpenseCount(w http.ResponseWriter, r *http.Request) {
+	respondSummary(w, r, expensesBucket, expenseFields, true)
+}
+
+func getExpenseSummary(w http.ResponseWriter, r *http.Request) {
+	respondSummary(w, r, expensesBucket, expenseFields, false)
+}
+
+func getIncomeCount(w http.ResponseWriter, r *http.Request) {
+	respondSummary(w, r, incomeBucket, incomeFields, true)
+}
+
+func getIncomeSummary(w http.ResponseWriter, r *http.Request) {
+	respondSummary(w, r, incomeBucket, incomeFields, false)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// normalizeTag lowercases a tag and collapses its spaces, so "Vacation
+// 2024" and "vacation  2024" are the same tag
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// normalizeTags normalizes a record's tags, dropping empty and repeated
+// ones. It returns nil for no tags so they are left out of the JSON.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); tag != "" && !slices.Contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// TagUsage is a tag and how many records of each kind carry it
+type TagUsage struct {
+	Tag      string `json:"tag"`
+	Count    int    `json:"count"`
+	Expenses int    `json:"expenses"`
+	Income   int    `json:"income"`
+	Bills    int    `json:"bills"`
+}
+
+// TAGS
+
+// getTags lists the tags on the expenses, income and bills the caller can
+// see, most used first
+func getTags(w http.ResponseWriter, r *http.Request) {
+	user := authUser(r)
+	usage := map[string]*TagUsage{}
+	count := func(tags []string, kind func(*TagUsage) *int) {
+		for _, tag := range tags {
+			u, ok := usage[tag]
+			if !ok {
+				u = &TagUsage{Tag: tag}
+				usage[tag] = u
+			}
+			u.Count++
+			*kind(u)++
+		}
+	}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		err := forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.visibleTo(user) {
+				count(e.Tags, func(u *TagUsage) *int { return &u.Expenses })
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var i Income
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			if i.visibleTo(user) {
+				count(i.Tags, func(u *TagUsage) *int { return &u.Income })
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(billsBucket)), func(k, v []byte) error {
+			var b BillReminder
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			count(b.Tags, func(u *TagUsage) *int { return &u.Bills })
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tags := make([]TagUsage, 0, len(usage))
+	for _, u := range usage {
+		tags = append(tags, *u)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	respondJSON(w, http.StatusOK, tags)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExpenseTax is the GST on an expense, recorded by members who freelance so
+// they can claim input tax
+type ExpenseTax struct {
+	GSTRate float64 `json:"gstRate"` // percent, e.g. 18
+	// Amount is the tax included in the expense amount; left out, it is
+	// worked out from the rate
+	Amount        Money  `json:"amount"`
+	Business      bool   `json:"business"` // a business expense, eligible for input tax credit
+	InvoiceNumber string `json:"invoiceNumber,omitempty"`
+}
+
+// validateTax checks an expense's tax details against its amount
+func validateTax(e *Expense) error {
+	t := e.Tax
+	if t == nil {
+		return nil
+	}
+	if t.GSTRate < 0 || t.GSTRate > 100 {
+		return fmt.Errorf("tax.gstRate must be between 0 and 100")
+	}
+	if t.Amount < 0 {
+		return fmt.Errorf("tax.amount cannot be negative")
+	}
+	if t.Amount == 0 && t.GSTRate > 0 {
+		t.Amount = Money(math.Round(float64(e.Amount) * t.GSTRate / (100 + t.GSTRate)))
+	}
+	t.Amount = roundForCurrency(t.Amount, e.Currency)
+	if t.Amount > e.Amount {
+		return fmt.Errorf("tax.amount cannot exceed the expense amount")
+	}
+	t.InvoiceNumber = strings.TrimSpace(t.InvoiceNumber)
+	return nil
+}
+
+// TaxRateTotal is the input tax paid at one GST rate
+type TaxRateTotal struct {
+	GSTRate float64 `json:"gstRate"`
+	Taxable Money   `json:"taxable"` // amounts before tax
+	Tax     Money   `json:"tax"`
+}
+
+// TaxPeriod aggregates the input tax of one month, quarter or financial year
+type TaxPeriod struct {
+	Label   string         `json:"label"`
+	Start   string         `json:"start"`
+	End     string         `json:"end"`
+	Count   int            `json:"count"`
+	Taxable Money          `json:"taxable"`
+	Tax     Money          `json:"tax"`
+	ByRate  []TaxRateTotal `json:"byRate"`
+}
+
+func (p *TaxPeriod) add(rate float64, taxable, tax Money) {
+	p.Count++
+	p.Taxable += taxable
+	p.Tax += tax
+	for i := range p.ByRate {
+		if p.ByRate[i].GSTRate == rate {
+			p.ByRate[i].Taxable += taxable
+			p.ByRate[i].Tax += tax
+			return
+		}
+	}
+	p.ByRate = append(p.ByRate, TaxRateTotal{GSTRate: rate, Taxable: taxable, Tax: tax})
+}
+
+// getTaxSummary aggregates input tax on expenses with tax details by
+// ?by=month (default), quarter or fiscalYear, in the base currency. The
+// usual list filters apply, and ?business=true keeps business expenses only.
+func getTaxSummary(w http.ResponseWriter, r *http.Request) {
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "month"
+	}
+	if err := oneOf("by", by, []string{"month", "quarter", "fiscalYear"}); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	businessOnly := r.URL.Query().Get("business") == "true"
+	settings := currentSettings()
+	conv := newConverter(settings, settings.BaseCurrency)
+
+	periods := map[string]*TaxPeriod{}
+	total := TaxPeriod{Label: "total", ByRate: []TaxRateTotal{}}
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var expense Expense
+			if err := json.Unmarshal(v, &expense); err != nil {
+				return err
+			}
+			if expense.Tax == nil || (businessOnly && !expense.Tax.Business) || !f.matches(expenseFields(expense)) {
+				return nil
+			}
+			label, period, err := reportingPeriod(expense.Date, by, settings.FiscalYearStartMonth)
+			if err != nil {
+				return nil
+			}
+			var taxable, tax Money
+			if !conv.add(&taxable, expense.Amount-expense.Tax.Amount, expense.Currency) {
+				return nil
+			}
+			conv.add(&tax, expense.Tax.Amount, expense.Currency)
+			p, ok := periods[label]
+			if !ok {
+				p = &TaxPeriod{Label: label, Start: period.Start, End: period.End, ByRate: []TaxRateTotal{}}
+				periods[label] = p
+			}
+			p.add(expense.Tax.GSTRate, taxable, tax)
+			total.add(expense.Tax.GSTRate, taxable, tax)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	list := []TaxPeriod{}
+	for _, p := range periods {
+		sort.Slice(p.ByRate, func(i, j int) bool { return p.ByRate[i].GSTRate < p.ByRate[j].GSTRate })
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+	sort.Slice(total.ByRate, func(i, j int) bool { return total.ByRate[i].GSTRate < total.ByRate[j].GSTRate })
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"currency":              settings.BaseCurrency,
+		"unconvertedCurrencies": conv.unconverted(),
+		"by":                    by,
+		"periods":               list,
+		"total":                 total,
+	})
+}
+
+// Deduction limits under the old income tax regime, in rupees. Senior
+// citizens get a higher 80D limit, for their own cover or their parents'.
+var (
+	taxDeductionSections = []string{"80C", "80D", "80D-parents"}
+	taxDeductionLimits   = map[string]Money{
+		"80C":         150000 * majorUnit,
+		"80D":         25000 * majorUnit,
+		"80D-parents": 25000 * majorUnit,
+	}
+)
+
+const seniorHealthDeductionLimit = 50000 * majorUnit
+
+// DeductionSource is what one insurance policy contributes to a deduction
+type DeductionSource struct {
+	PolicyID string `json:"policyId"`
+	Name     string `json:"name"`
+	Paid     Money  `json:"paid"`
+}
+
+// TaxDeduction is a section's claimable deduction for a financial year
+type TaxDeduction struct {
+	Section    string            `json:"section"`
+	Limit      Money             `json:"limit"`
+	Paid       Money             `json:"paid"`
+	Deductible Money             `json:"deductible"` // paid, capped at the limit
+	Sources    []DeductionSource `json:"sources"`
+}
+
+// getTaxDeductions totals the insurance premiums paid in a financial year
+// under 80C and 80D, in the base currency. ?year= is the year the financial
+// year starts in, default the running one. Premiums count on the dates
+// their bills were paid.
+func getTaxDeductions(w http.ResponseWriter, r *http.Request) {
+	settings := currentSettings()
+	label, period, err := fiscalYearParam(r.URL.Query().Get("year"), settings, time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conv := newConverter(settings, settings.BaseCurrency)
+
+	sections := map[string]*TaxDeduction{}
+	for _, name := range taxDeductionSections {
+		sections[name] = &TaxDeduction{Section: name, Sources: []DeductionSource{}}
+	}
+	senior := map[string]bool{}
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		policies := loadPolicies(tx)
+		paid := map[string]Money{}
+		err := forEach(r.Context(), tx.Bucket([]byte(billsBucket)), func(k, v []byte) error {
+			var bill BillReminder
+			if err := json.Unmarshal(v, &bill); err != nil {
+				return err
+			}
+			p, ok := policies[bill.PolicyID]
+			if !ok || p.taxSection() == "" {
+				return nil
+			}
+			for _, payment := range bill.Payments {
+				if period.contains(payment.Date) {
+					amount := paid[p.ID]
+					conv.add(&amount, payment.Amount, bill.Currency)
+					paid[p.ID] = amount
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range policies {
+			section := p.taxSection()
+			if section == "" {
+				continue
+			}
+			if p.Senior {
+				senior[section] = true
+			}
+			if paid[p.ID] == 0 {
+				continue
+			}
+			d := sections[section]
+			d.Paid += paid[p.ID]
+			d.Sources = append(d.Sources, DeductionSource{PolicyID: p.ID, Name: p.premiumName(), Paid: paid[p.ID]})
+		}
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	list := []TaxDeduction{}
+	var total Money
+	for _, name := range taxDeductionSections {
+		d := sections[name]
+		limit := taxDeductionLimits[name]
+		if senior[name] && name != "80C" {
+			limit = seniorHealthDeductionLimit
+		}
+		conv.add(&d.Limit, limit, "INR")
+		d.Deductible = d.Paid
+		if d.Deductible > d.Limit {
+			d.Deductible = d.Limit
+		}
+		total += d.Deductible
+		sort.Slice(d.Sources, func(i, j int) bool { return d.Sources[i].Paid > d.Sources[j].Paid })
+		list = append(list, *d)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"currency":              settings.BaseCurrency,
+		"unconvertedCurrencies": conv.unconverted(),
+		"fiscalYear":            label,
+		"start":                 period.Start,
+		"end":                   period.End,
+		"sections":              list,
+		"total":                 total,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// telegramAPI is the Bot API's address; tests replace it
+var telegramAPI = "https://api.telegram.org"
+
+func init() {
+	channelSenders["telegram"] = telegramAlerts
+}
+
+// telegramAlerts sends a member their alerts in one message to the chat in
+// their notification preferences. Without a bot token the alerts are only
+// logged.
+func telegramAlerts(user string, alerts []Alert) error {
+	c := config()
+	if c.TelegramBotToken == "" {
+		logNotifications(user, "telegram", alerts)
+		return nil
+	}
+	var prefs NotificationPrefs
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(notificationPrefsBucket)).Get([]byte(user)); v != nil {
+			return json.Unmarshal(v, &prefs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if prefs.TelegramChatID == "" {
+		return fmt.Errorf("no telegram chat for %s", user)
+	}
+
+	var text strings.Builder
+	for _, a := range alerts {
+		text.WriteString(a.Message + "\n")
+		if a.Link != "" && c.BaseURL != "" {
+			text.WriteString(strings.TrimRight(c.BaseURL, "/") + "/" + strings.TrimLeft(a.Link, "/") + "\n")
+		}
+	}
+	err = postJSON(telegramAPI+"/bot"+c.TelegramBotToken+"/sendMessage", nil,
+		map[string]string{"chat_id": prefs.TelegramChatID, "text": text.String()})
+	if err != nil {
+		// Errors name the URL, which holds the token
+		return errors.New(strings.ReplaceAll(err.Error(), c.TelegramBotToken, "<token>"))
+	}
+	return nil
+}
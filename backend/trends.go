@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TrendSeries is one category's totals over time, one value per period
+type TrendSeries struct {
+	Category string  `json:"category"`
+	Total    Money   `json:"total"`
+	Values   []Money `json:"values"`
+}
+
+// Trends is spending and income per period, ready to chart. Amounts are in
+// the base currency; Periods holds the first day of each period.
+type Trends struct {
+	Granularity           string        `json:"granularity"`
+	Currency              string        `json:"currency"`
+	Period                Period        `json:"period"`
+	Periods               []string      `json:"periods"`
+	Spending              []Money       `json:"spending"`
+	Income                []Money       `json:"income"`
+	SpendingByCategory    []TrendSeries `json:"spendingByCategory"`
+	IncomeBySource        []TrendSeries `json:"incomeBySource"`
+	UnconvertedCurrencies []string      `json:"unconvertedCurrencies"`
+}
+
+// trendSteps lay out the periods of each granularity: where the first one
+// starts given the first day wanted, and the start of the one after
+var trendSteps = map[string]struct {
+	align func(time.Time) time.Time
+	next  func(time.Time) time.Time
+}{
+	"day": {
+		align: func(t time.Time) time.Time { return t },
+		next:  func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	},
+	"week": {
+		align: func(t time.Time) time.Time { start, _ := time.Parse(dateLayout, weekPeriod(t).Start); return start },
+		next:  func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+	},
+	"month": {
+		align: func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) },
+		next:  func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	},
+}
+
+// trendTally adds amounts to the period a date falls in, overall and per
+// category
+type trendTally struct {
+	periods    []string
+	totals     []Money
+	categories map[string][]Money
+}
+
+func newTrendTally(periods []string) *trendTally {
+	return &trendTally{periods: periods, totals: make([]Money, len(periods)), categories: map[string][]Money{}}
+}
+
+// index finds the period a date falls in, -1 outside them all
+func (t *trendTally) index(date string) int {
+	i := sort.SearchStrings(t.periods, date)
+	if i == len(t.periods) || t.periods[i] != date {
+		i--
+	}
+	return i
+}
+
+func (t *trendTally) add(conv *converter, i int, category string, amount Money, currency string) {
+	values := t.categories[category]
+	if values == nil {
+		values = make([]Money, len(t.periods))
+		t.categories[category] = values
+	}
+	var converted Money
+	if conv.add(&converted, amount, currency) {
+		values[i] += converted
+		t.totals[i] += converted
+	}
+}
+
+// series lists the categories, largest total first
+func (t *trendTally) series() []TrendSeries {
+	list := []TrendSeries{}
+	for category, values := range t.categories {
+		s := TrendSeries{Category: category, Values: values}
+		for _, v := range values {
+			s.Total += v
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Total != list[j].Total {
+			return list[i].Total > list[j].Total
+		}
+		return list[i].Category < list[j].Category
+	})
+	return list
+}
+
+// ANALYTICS
+
+// getTrends returns spending by category and income by source per day,
+// week or month (?granularity=, default month) over the last ?months=
+// (default 12) up to today. Reimbursed expenses and claim payouts are left
+// out, as in reports; ?user=, ?category= and ?tag= narrow the records.
+func getTrends(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	granularity := q.Get("granularity")
+	if granularity == "" {
+		granularity = "month"
+	}
+	step, ok := trendSteps[granularity]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "granularity must be day, week or month")
+		return
+	}
+	months := 12
+	if v := q.Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 60 {
+			respondError(w, http.StatusBadRequest, "months must be between 1 and 60")
+			return
+		}
+		months = n
+	}
+	f, err := parseListFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	settings := currentSettings()
+	end, _ := time.Parse(dateLayout, today(settings.location(f.Viewer)))
+	first := time.Date(end.Year(), end.Month()-time.Month(months-1), 1, 0, 0, 0, 0, time.UTC)
+	var periods []string
+	for t := step.align(first); !t.After(end); t = step.next(t) {
+		periods = append(periods, t.Format(dateLayout))
+	}
+	f.From, f.To = periods[0], end.Format(dateLayout)
+
+	spending, income := newTrendTally(periods), newTrendTally(periods)
+	conv := newConverter(settings, "")
+	user := authUser(r)
+	err = viewContext(r.Context(), func(tx *bolt.Tx) error {
+		err := forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !e.personal() || !e.visibleTo(user) || !f.matches(expenseFields(e)) {
+				return nil
+			}
+			i := spending.index(e.Date)
+			for _, part := range e.categoryParts() {
+				spending.add(conv, i, part.Category, part.Amount, e.Currency)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var in Income
+			if err := json.Unmarshal(v, &in); err != nil {
+				return err
+			}
+			if !in.personal() || !in.visibleTo(user) || !f.matches(incomeFields(in)) {
+				return nil
+			}
+			income.add(conv, income.index(in.Date), in.Source, in.Amount, in.Currency)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, Trends{
+		Granularity:           granularity,
+		Currency:              settings.BaseCurrency,
+		Period:                Period{Start: f.From, End: end.AddDate(0, 0, 1).Format(dateLayout)},
+		Periods:               periods,
+		Spending:              spending.totals,
+		Income:                income.totals,
+		SpendingByCategory:    spending.series(),
+		IncomeBySource:        income.series(),
+		UnconvertedCurrencies: conv.unconverted(),
+	})
+}
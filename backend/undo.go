@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// undoWindow is how long an action can be reverted
+const undoWindow = 10 * time.Minute
+
+// actionHeader carries the ID that reverts a mutating request
+const actionHeader = "X-Action-ID"
+
+var (
+	errUndoExpired  = errors.New("undo window has passed")
+	errUndoConflict = errors.New("records changed since the action")
+)
+
+// UndoAction is the journal of one undoable request: every record it
+// changed, before and after
+type UndoAction struct {
+	ID        string         `json:"id"`
+	Path      string         `json:"path"`
+	Changes   []RecordChange `json:"changes"`
+	CreatedAt string         `json:"createdAt"`
+	ExpiresAt string         `json:"expiresAt"`
+}
+
+// RecordChange is one record's stored bytes before and after an action.
+// Nil means the record did not exist.
+type RecordChange struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Before []byte `json:"before,omitempty"`
+	After  []byte `json:"after,omitempty"`
+}
+
+func (a UndoAction) expired(now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, a.ExpiresAt)
+	return err != nil || now.After(expires)
+}
+
+// undoJournal collects the records a request is about to change
+type undoJournal struct {
+	tx      *bolt.Tx
+	changes []RecordChange
+	seen    map[string]bool
+}
+
+// track saves a record's current value before it is written or deleted.
+// Only the first call per record counts.
+func (j *undoJournal) track(bucket string, key []byte) {
+	id := bucket + "\x00" + string(key)
+	if j.seen[id] {
+		return
+	}
+	j.seen[id] = true
+	change := RecordChange{Bucket: bucket, Key: string(key)}
+	if v := j.tx.Bucket([]byte(bucket)).Get(key); v != nil {
+		change.Before = append([]byte(nil), v...)
+	}
+	j.changes = append(j.changes, change)
+}
+
+// undoable runs fn in an update transaction, journaling the records it
+// tracks, and returns the ID of an action that reverts them. The ID is
+// empty when nothing was tracked.
+func undoable(r *http.Request, fn func(tx *bolt.Tx, j *undoJournal) error) (string, error) {
+	var actionID string
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		j := &undoJournal{tx: tx, seen: map[string]bool{}}
+		if err := fn(tx, j); err != nil {
+			return err
+		}
+		if len(j.changes) == 0 {
+			return nil
+		}
+		for i, c := range j.changes {
+			if v := tx.Bucket([]byte(c.Bucket)).Get([]byte(c.Key)); v != nil {
+				j.changes[i].After = append([]byte(nil), v...)
+			}
+		}
+		now := time.Now()
+		action := UndoAction{
+			ID:        fmt.Sprintf("%d", now.UnixNano()),
+			Path:      r.Method + " " + r.URL.Path,
+			Changes:   j.changes,
+			CreatedAt: now.Format(time.RFC3339),
+			ExpiresAt: now.Add(undoWindow).Format(time.RFC3339),
+		}
+		if err := pruneUndoActions(tx, now); err != nil {
+			return err
+		}
+		data, err := json.Marshal(action)
+		if err != nil {
+			return err
+		}
+		actionID = action.ID
+		return tx.Bucket([]byte(undoBucket)).Put([]byte(action.ID), data)
+	})
+	return actionID, err
+}
+
+// pruneUndoActions drops journals whose window has passed
+func pruneUndoActions(tx *bolt.Tx, now time.Time) error {
+	b := tx.Bucket([]byte(undoBucket))
+	var expired [][]byte
+	b.ForEach(func(k, v []byte) error {
+		var a UndoAction
+		if json.Unmarshal(v, &a) != nil || a.expired(now) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respondUndoable writes a response for an undoable request, exposing the
+// action ID in a header and in message bodies
+func respondUndoable(w http.ResponseWriter, status int, actionID string, data interface{}) {
+	if actionID != "" {
+		w.Header().Set(actionHeader, actionID)
+		switch m := data.(type) {
+		case map[string]string:
+			m["actionId"] = actionID
+		case map[string]interface{}:
+			m["actionId"] = actionID
+		}
+	}
+	respondJSON(w, status, data)
+}
+
+// UNDO
+
+// undoAction restores every record an action changed, provided none has
+// been changed again since. Each action can be undone once.
+func undoAction(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["actionId"]
+	var action UndoAction
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		journal := tx.Bucket([]byte(undoBucket))
+		v := journal.Get([]byte(id))
+		if v == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(v, &action); err != nil {
+			return err
+		}
+		if action.expired(time.Now()) {
+			journal.Delete([]byte(id))
+			return errUndoExpired
+		}
+		for _, c := range action.Changes {
+			current := tx.Bucket([]byte(c.Bucket)).Get([]byte(c.Key))
+			if !bytes.Equal(current, c.After) {
+				return errUndoConflict
+			}
+		}
+		for _, c := range action.Changes {
+			b := tx.Bucket([]byte(c.Bucket))
+			var err error
+			if c.Before == nil {
+				err = b.Delete([]byte(c.Key))
+			} else {
+				err = b.Put([]byte(c.Key), c.Before)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return journal.Delete([]byte(id))
+	})
+	switch {
+	case err == errNotFound:
+		respondError(w, http.StatusNotFound, "action not found")
+	case err == errUndoExpired:
+		respondError(w, http.StatusGone, err.Error())
+	case err == errUndoConflict:
+		respondError(w, http.StatusConflict, fmt.Sprintf("cannot undo %s: %s", action.Path, err))
+	case err != nil:
+		respondStoreError(w, http.StatusInternalServerError, err)
+	default:
+		respondJSON(w, http.StatusOK, map[string]interface{}{"message": "Undone", "action": action.Path, "records": len(action.Changes)})
+	}
+}
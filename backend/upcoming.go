@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ProjectedIncome is an expected future credit of a recurring income. It is
+// computed on request and never stored.
+type ProjectedIncome struct {
+	Date        string `json:"date"`
+	Amount      Money  `json:"amount"`
+	Currency    string `json:"currency"`
+	Source      string `json:"source"`
+	SourceID    string `json:"sourceId,omitempty"`
+	Description string `json:"description"`
+	User        string `json:"user"`
+	BasedOn     string `json:"basedOn"` // ID of the entry the projection repeats
+}
+
+// recurringSeries groups recurring entries that repeat each other: the same
+// source received by the same person
+func recurringSeries(i Income) string {
+	source := i.SourceID
+	if source == "" {
+		source = strings.ToLower(strings.TrimSpace(i.Source))
+	}
+	return source + "\x00" + i.User
+}
+
+// projectIncome repeats the latest entry of every recurring series monthly,
+// on the same day of the month, returning the credits dated from from up to
+// until. Months without that day use their last day.
+func projectIncome(incomes []Income, from, until string) []ProjectedIncome {
+	latest := map[string]Income{}
+	for _, i := range incomes {
+		if !i.IsRecurring || i.Date == "" {
+			continue
+		}
+		key := recurringSeries(i)
+		if prev, ok := latest[key]; !ok || i.Date > prev.Date {
+			latest[key] = i
+		}
+	}
+
+	projected := []ProjectedIncome{}
+	for _, i := range latest {
+		last, err := time.Parse(dateLayout, i.Date)
+		if err != nil {
+			continue
+		}
+		for n := 1; ; n++ {
+			date := addMonthsClamped(last, n).Format(dateLayout)
+			if date > until {
+				break
+			}
+			if date < from {
+				continue
+			}
+			projected = append(projected, ProjectedIncome{
+				Date:        date,
+				Amount:      i.Amount,
+				Currency:    i.Currency,
+				Source:      i.Source,
+				SourceID:    i.SourceID,
+				Description: i.Description,
+				User:        i.User,
+				BasedOn:     i.ID,
+			})
+		}
+	}
+	sort.Slice(projected, func(a, b int) bool {
+		if projected[a].Date != projected[b].Date {
+			return projected[a].Date < projected[b].Date
+		}
+		return projected[a].BasedOn < projected[b].BasedOn
+	})
+	return projected
+}
+
+// addMonthsClamped moves t by n months keeping its day where the month has
+// it, so a salary on the 31st lands on 28 or 29 February
+func addMonthsClamped(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+func getUpcomingIncome(w http.ResponseWriter, r *http.Request) {
+	months := 3
+	if v := r.URL.Query().Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 24 {
+			respondError(w, http.StatusBadRequest, "months must be between 1 and 24")
+			return
+		}
+		months = n
+	}
+
+	var incomes []Income
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(incomeBucket)), func(k, v []byte) error {
+			var income Income
+			if json.Unmarshal(v, &income) == nil {
+				incomes = append(incomes, income)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now().In(householdLocation())
+	from := now.Format(dateLayout)
+	until := now.AddDate(0, months, 0).Format(dateLayout)
+	respondJSON(w, http.StatusOK, projectIncome(incomes, from, until))
+}
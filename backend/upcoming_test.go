@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestProjectIncome(t *testing.T) {
+	incomes := []Income{
+		{ID: "dec", Amount: 80000 * majorUnit, SourceID: "salary", User: "alice", Date: "2025-12-31", IsRecurring: true},
+		{ID: "jan", Amount: 85000 * majorUnit, SourceID: "salary", User: "alice", Date: "2026-01-31", IsRecurring: true},
+		{ID: "rent", Amount: 20000 * majorUnit, Source: "Flat rent", User: "bob", Date: "2026-01-05", IsRecurring: true},
+		{ID: "bonus", Amount: 50000 * majorUnit, SourceID: "salary", User: "alice", Date: "2026-01-15"},
+	}
+	got := projectIncome(incomes, "2026-02-05", "2026-04-05")
+
+	want := []struct {
+		date, basedOn string
+		amount        Money
+	}{
+		{"2026-02-05", "rent", 20000 * majorUnit},
+		{"2026-02-28", "jan", 85000 * majorUnit},
+		{"2026-03-05", "rent", 20000 * majorUnit},
+		{"2026-03-31", "jan", 85000 * majorUnit},
+		{"2026-04-05", "rent", 20000 * majorUnit},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d projections, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Date != w.date || got[i].BasedOn != w.basedOn || got[i].Amount != w.amount {
+			t.Errorf("projection %d = %+v, want %+v", i, got[i], w)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// publicBaseURL returns the externally visible origin used in generated
+// links. A configured BASE_URL wins; otherwise X-Forwarded-Proto/Host are
+// honoured when the server sits behind a trusted proxy, and finally the
+// request's own Host header is used.
+func publicBaseURL(r *http.Request) string {
+	c := config()
+	if c.BaseURL != "" {
+		return strings.TrimRight(c.BaseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if c.TrustProxyHeaders {
+		if proto := firstHeaderValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+			scheme = proto
+		}
+		if fwdHost := firstHeaderValue(r.Header.Get("X-Forwarded-Host")); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	if host == "" {
+		host = "localhost:" + c.Port
+	}
+	return scheme + "://" + host
+}
+
+// publicURL joins a path onto the public base URL
+func publicURL(r *http.Request, path string) string {
+	return publicBaseURL(r) + "/" + strings.TrimLeft(path, "/")
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header, as
+// proxies append their own values to forwarded headers.
+func firstHeaderValue(v string) string {
+	if i := strings.Index(v, ","); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
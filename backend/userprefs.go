@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// UserPreferences are one member's display choices, shared by every client
+// they sign in from
+type UserPreferences struct {
+	User   string `json:"user"`
+	Locale string `json:"locale"` // e.g. "en-IN"
+	// BaseCurrency overrides the household currency for this member's
+	// views. Empty means the household's.
+	BaseCurrency       string `json:"baseCurrency"`
+	DateFormat         string `json:"dateFormat"`
+	DefaultAccount     string `json:"defaultAccount"`
+	DefaultExpenseView string `json:"defaultExpenseView"`
+	Theme              string `json:"theme"`
+	UpdatedAt          string `json:"updatedAt,omitempty"`
+}
+
+var (
+	dateFormats  = []string{"DD/MM/YYYY", "MM/DD/YYYY", "YYYY-MM-DD", "DD MMM YYYY"}
+	expenseViews = []string{"list", "calendar", "category"}
+	themes       = []string{"system", "light", "dark"}
+	localeTag    = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+)
+
+func defaultUserPreferences(user string) UserPreferences {
+	return UserPreferences{
+		User:               user,
+		Locale:             "en-IN",
+		DateFormat:         "DD/MM/YYYY",
+		DefaultExpenseView: "list",
+		Theme:              "system",
+	}
+}
+
+func oneOf(field, value string, allowed []string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s", field, strings.Join(allowed, ", "))
+}
+
+// validate checks the preferences and canonicalizes the currency code
+func (p *UserPreferences) validate() error {
+	if !localeTag.MatchString(p.Locale) {
+		return fmt.Errorf("locale must be a language tag such as en-IN")
+	}
+	currency, err := normalizeCurrency(p.BaseCurrency, "")
+	if err != nil {
+		return err
+	}
+	p.BaseCurrency = currency
+	if err := oneOf("dateFormat", p.DateFormat, dateFormats); err != nil {
+		return err
+	}
+	if err := oneOf("defaultExpenseView", p.DefaultExpenseView, expenseViews); err != nil {
+		return err
+	}
+	return oneOf("theme", p.Theme, themes)
+}
+
+// loadUserPreferences returns a member's saved preferences, or the defaults
+func loadUserPreferences(tx *bolt.Tx, user string) UserPreferences {
+	p := defaultUserPreferences(user)
+	if v := tx.Bucket([]byte(userPrefsBucket)).Get([]byte(user)); v != nil {
+		json.Unmarshal(v, &p)
+	}
+	return p
+}
+
+// ME
+
+// getMe describes the session: who the caller is and their preferences, so
+// clients can apply them on start
+func getMe(w http.ResponseWriter, r *http.Request) {
+	user := requestActor(r)
+	var prefs UserPreferences
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		prefs = loadUserPreferences(tx, user)
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"user": user, "preferences": prefs})
+}
+
+func getMyPreferences(w http.ResponseWriter, r *http.Request) {
+	user := requestActor(r)
+	var prefs UserPreferences
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		prefs = loadUserPreferences(tx, user)
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, prefs)
+}
+
+// updateMyPreferences saves the caller's preferences. Fields left out of
+// the body keep their current values.
+func updateMyPreferences(w http.ResponseWriter, r *http.Request) {
+	user := requestActor(r)
+	var prefs UserPreferences
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		prefs = loadUserPreferences(tx, user)
+		return nil
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := prefs.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefs.User = user
+	prefs.UpdatedAt = time.Now().Format(time.RFC3339)
+	err = updateContext(r.Context(), func(tx *bolt.Tx) error {
+		data, err := json.Marshal(prefs)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(userPrefsBucket)).Put([]byte(user), data)
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, prefs)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// returnReminderDays is how long before a return window closes its
+// reminder goes out
+const returnReminderDays = 3
+
+// Purchase marks an expense as a purchase of goods, with the dates its
+// warranty runs out and its return window closes. Either date can instead be
+// given as a length from the expense date.
+type Purchase struct {
+	WarrantyExpires string `json:"warrantyExpires,omitempty"`
+	ReturnBy        string `json:"returnBy,omitempty"`
+	WarrantyMonths  int    `json:"warrantyMonths,omitempty"`
+	ReturnDays      int    `json:"returnDays,omitempty"`
+}
+
+// validatePurchase settles a purchase's dates against the expense date
+func validatePurchase(e *Expense, loc *time.Location) error {
+	p := e.Purchase
+	if p == nil {
+		return nil
+	}
+	if p.WarrantyMonths < 0 || p.ReturnDays < 0 {
+		return fmt.Errorf("purchase.warrantyMonths and purchase.returnDays cannot be negative")
+	}
+	var err error
+	if p.WarrantyExpires, err = normalizeDate(p.WarrantyExpires, loc); err != nil {
+		return err
+	}
+	if p.ReturnBy, err = normalizeDate(p.ReturnBy, loc); err != nil {
+		return err
+	}
+	bought, err := time.Parse(dateLayout, e.Date)
+	if err != nil {
+		return err
+	}
+	if p.WarrantyExpires == "" && p.WarrantyMonths > 0 {
+		p.WarrantyExpires = addMonthsClamped(bought, p.WarrantyMonths).Format(dateLayout)
+	}
+	if p.ReturnBy == "" && p.ReturnDays > 0 {
+		p.ReturnBy = bought.AddDate(0, 0, p.ReturnDays).Format(dateLayout)
+	}
+	if p.WarrantyExpires != "" && p.WarrantyExpires < e.Date {
+		return fmt.Errorf("purchase.warrantyExpires is before the purchase date")
+	}
+	if p.ReturnBy != "" && p.ReturnBy < e.Date {
+		return fmt.Errorf("purchase.returnBy is before the purchase date")
+	}
+	return nil
+}
+
+var (
+	warrantyBefore = regexp.MustCompile(`(?i)(\d+)\s*[- ]?\s*(years?|yrs?|months?|mos?)\b[^.\n]{0,30}?warranty`)
+	warrantyAfter  = regexp.MustCompile(`(?i)warranty[^.\n\d]{0,30}(\d+)\s*[- ]?\s*(years?|yrs?|months?|mos?)\b`)
+	returnBefore   = regexp.MustCompile(`(?i)(\d+)\s*[- ]?\s*days?\b[^.\n]{0,20}?(?:return|exchange)`)
+	returnAfter    = regexp.MustCompile(`(?i)(?:return|exchange)[^.\n\d]{0,30}(\d+)\s*[- ]?\s*days?\b`)
+)
+
+// suggestPurchase reads warranty and return terms such as "1 year warranty"
+// or "returns accepted within 30 days" from receipt text
+func suggestPurchase(text string) Purchase {
+	var p Purchase
+	for _, re := range []*regexp.Regexp{warrantyBefore, warrantyAfter} {
+		if m := re.FindStringSubmatch(text); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			if strings.HasPrefix(strings.ToLower(m[2]), "y") {
+				n *= 12
+			}
+			p.WarrantyMonths = n
+			break
+		}
+	}
+	for _, re := range []*regexp.Regexp{returnBefore, returnAfter} {
+		if m := re.FindStringSubmatch(text); m != nil {
+			p.ReturnDays, _ = strconv.Atoi(m[1])
+			break
+		}
+	}
+	return p
+}
+
+// purchaseName is how reminders refer to a purchase
+func purchaseName(e Expense) string {
+	if e.Description != "" {
+		return e.Description
+	}
+	if e.Merchant != "" {
+		return e.Merchant
+	}
+	return formatMoney(e.Amount, e.Currency)
+}
+
+// checkReturnWindows reminds members of purchases whose return window closes
+// within returnReminderDays. Each window is reminded of once.
+func checkReturnWindows() error {
+	now := billToday()
+	t, _ := time.Parse(dateLayout, now)
+	horizon := t.AddDate(0, 0, returnReminderDays).Format(dateLayout)
+	var closing []Expense
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(expensesBucket)).ForEach(func(k, v []byte) error {
+			var e Expense
+			if json.Unmarshal(v, &e) != nil || e.Purchase == nil {
+				return nil
+			}
+			if by := e.Purchase.ReturnBy; by != "" && by >= now && by <= horizon {
+				closing = append(closing, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range closing {
+		alert := newAlert(fmt.Sprintf("purchase.return:%s:%s", e.ID, e.Purchase.ReturnBy), "purchase.return", e.ID,
+			"alert.purchase.return", purchaseName(e), e.Purchase.ReturnBy)
+		if e.User != "" {
+			alert.Recipients = []string{e.User}
+		}
+		if _, err := emitAlert(alert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PURCHASES
+
+// getWarranties lists purchases still under warranty, soonest expiry first.
+// ?all=true includes expired warranties too.
+func getWarranties(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "true"
+	now := billToday()
+	expenses := []Expense{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(expensesBucket)), func(k, v []byte) error {
+			var e Expense
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Purchase == nil || e.Purchase.WarrantyExpires == "" {
+				return nil
+			}
+			if all || e.Purchase.WarrantyExpires >= now {
+				expenses = append(expenses, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(expenses, func(i, j int) bool {
+		return expenses[i].Purchase.WarrantyExpires < expenses[j].Purchase.WarrantyExpires
+	})
+	respondJSON(w, http.StatusOK, expenses)
+}
+
+// suggestPurchaseTerms proposes warranty and return dates from the text of a
+// scanned receipt. Nothing is saved; the client fills the expense with it.
+func suggestPurchaseTerms(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text string `json:"text"`
+		Date string `json:"date"` // purchase date, default today
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	loc := householdLocation()
+	date, err := normalizeDate(req.Date, loc)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if date == "" {
+		date = today(loc)
+	}
+	e := Expense{Date: date}
+	p := suggestPurchase(req.Text)
+	e.Purchase = &p
+	if err := validatePurchase(&e, loc); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestSuggestPurchase(t *testing.T) {
+	for text, want := range map[string]Purchase{
+		"SONY WH-1000XM5\n1 Year Manufacturer Warranty\nReturns accepted within 10 days": {WarrantyMonths: 12, ReturnDays: 10},
+		"Warranty: 6 months. 7-day exchange policy":                                      {WarrantyMonths: 6, ReturnDays: 7},
+		"Extended warranty for 2 yrs":                                                    {WarrantyMonths: 24},
+		"No returns. Thank you for shopping!":                                            {},
+	} {
+		if got := suggestPurchase(text); got != want {
+			t.Errorf("suggestPurchase(%q) = %+v, want %+v", text, got, want)
+		}
+	}
+}
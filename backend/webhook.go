@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	channelSenders["webhook"] = webhookAlerts
+}
+
+// webhookAlerts posts a member's alerts to the webhook URL in their
+// notification preferences. While the webhooks feature is off the alerts
+// are only logged.
+func webhookAlerts(user string, alerts []Alert) error {
+	if !featureEnabled("webhooks") {
+		logNotifications(user, "webhook", alerts)
+		return nil
+	}
+	var prefs NotificationPrefs
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(notificationPrefsBucket)).Get([]byte(user)); v != nil {
+			return json.Unmarshal(v, &prefs)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if prefs.Webhook == "" {
+		return fmt.Errorf("no webhook URL for %s", user)
+	}
+	return postJSON(prefs.Webhook, nil, map[string]interface{}{"user": user, "alerts": alerts})
+}
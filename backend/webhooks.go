@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// webhookTask is the queue task type that makes one webhook delivery
+const webhookTask = "webhook"
+
+// webhookEvents are the events webhooks can subscribe to. Besides record
+// changes they are alert types, sent as the alerts are raised.
+var webhookEvents = []string{
+	"expense.created", "expense.updated", "expense.deleted",
+	"budget.threshold", "budget.exceeded",
+	"bill.due", "bill.overdue", "goal.completed",
+	"expense.unusual", "expense.newMerchant", "expense.duplicate",
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook posts events to an external URL. Each delivery is signed with
+// the secret: X-Webhook-Signature is "sha256=" and the hex HMAC-SHA256 of
+// the body.
+type Webhook struct {
+	ID          string   `json:"id"`
+	URL         string   `json:"url"`
+	Description string   `json:"description,omitempty"`
+	Events      []string `json:"events"` // see webhookEvents; "*" for all
+	// Secret is generated unless given, and only shown when the webhook is
+	// created
+	Secret    string `json:"secret,omitempty"`
+	Disabled  bool   `json:"disabled,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// WebhookDelivery is one event sent, or being sent, to a webhook
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhookId"`
+	Event     string          `json:"event"`
+	Body      json.RawMessage `json:"body"`
+	Status    string          `json:"status"` // pending, retrying, delivered or failed
+	Attempts  int             `json:"attempts"`
+	// ResponseStatus is the HTTP status of the last attempt, 0 when it got
+	// no response
+	ResponseStatus int    `json:"responseStatus,omitempty"`
+	Error          string `json:"error,omitempty"`
+	CreatedAt      string `json:"createdAt"`
+	UpdatedAt      string `json:"updatedAt"`
+}
+
+func (h *Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("events must name at least one event, or \"*\"")
+	}
+	for _, e := range h.Events {
+		if e != "*" && !slices.Contains(webhookEvents, e) {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	slices.Sort(h.Events)
+	h.Events = slices.Compact(h.Events)
+	return nil
+}
+
+// subscribes reports whether the webhook wants an event
+func (h Webhook) subscribes(event string) bool {
+	return !h.Disabled && (slices.Contains(h.Events, "*") || slices.Contains(h.Events, event))
+}
+
+// signWebhook is the X-Webhook-Signature of a body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// publishWebhook queues a delivery of an event to every webhook subscribed
+// to it. Nothing is sent while the webhooks feature is off; failures are
+// logged, never returned, so the change that raised the event stands.
+func publishWebhook(event string, data interface{}) {
+	if !featureEnabled("webhooks") {
+		return
+	}
+	now := time.Now()
+	var deliveries []string
+	err := db.Update(func(tx *bolt.Tx) error {
+		var hooks []Webhook
+		err := tx.Bucket([]byte(webhooksBucket)).ForEach(func(k, v []byte) error {
+			var h Webhook
+			if json.Unmarshal(v, &h) == nil && h.subscribes(event) {
+				hooks = append(hooks, h)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, h := range hooks {
+			d := WebhookDelivery{
+				ID:        fmt.Sprintf("%d", now.UnixNano()+int64(i)),
+				WebhookID: h.ID,
+				Event:     event,
+				Status:    "pending",
+				CreatedAt: now.Format(time.RFC3339),
+				UpdatedAt: now.Format(time.RFC3339),
+			}
+			d.Body, err = json.Marshal(map[string]interface{}{"id": d.ID, "event": event, "createdAt": d.CreatedAt, "data": data})
+			if err != nil {
+				return err
+			}
+			if err := putWebhookDelivery(tx, d); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d.ID)
+		}
+		return nil
+	})
+	if err == nil {
+		for _, id := range deliveries {
+			if _, err = enqueueTask(webhookTask, map[string]string{"delivery": id}); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logger("webhooks").Error("queueing webhook deliveries", "event", event, "err", err)
+	}
+}
+
+func putWebhookDelivery(tx *bolt.Tx, d WebhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(webhookDeliveriesBucket)).Put([]byte(d.ID), data)
+}
+
+// deliverWebhook is the queue handler for webhook deliveries. A failed
+// attempt returns its error so the queue retries with backoff; the delivery
+// is marked failed once the queue gives up.
+func deliverWebhook(payload json.RawMessage) error {
+	var task struct {
+		Delivery string `json:"delivery"`
+	}
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return err
+	}
+	var d WebhookDelivery
+	var h Webhook
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(webhookDeliveriesBucket)).Get([]byte(task.Delivery))
+		if v == nil {
+			return nil // pruned
+		}
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		if v := tx.Bucket([]byte(webhooksBucket)).Get([]byte(d.WebhookID)); v != nil {
+			found = json.Unmarshal(v, &h) == nil
+		}
+		return nil
+	})
+	if err != nil || d.ID == "" {
+		return err
+	}
+
+	var sendErr error
+	d.ResponseStatus = 0
+	if !found || h.Disabled {
+		sendErr = fmt.Errorf("webhook was removed or disabled")
+	} else {
+		req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(d.Body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Event", d.Event)
+		req.Header.Set("X-Webhook-Delivery", d.ID)
+		req.Header.Set("X-Webhook-Signature", signWebhook(h.Secret, d.Body))
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			sendErr = err
+		} else {
+			resp.Body.Close()
+			d.ResponseStatus = resp.StatusCode
+			if resp.StatusCode >= 300 {
+				sendErr = fmt.Errorf("%s returned %s", h.URL, resp.Status)
+			}
+		}
+	}
+
+	d.Attempts++
+	d.UpdatedAt = time.Now().Format(time.RFC3339)
+	d.Status, d.Error = "delivered", ""
+	if sendErr != nil {
+		d.Error = sendErr.Error()
+		d.Status = "retrying"
+		if max := config().QueueMaxAttempts; !found || h.Disabled || (max > 0 && d.Attempts >= max) {
+			d.Status = "failed"
+		}
+	}
+	err = db.Update(func(tx *bolt.Tx) error { return putWebhookDelivery(tx, d) })
+	if err != nil {
+		return err
+	}
+	if d.Status == "retrying" {
+		return sendErr
+	}
+	return nil
+}
+
+// WEBHOOKS
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks := []Webhook{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		return forEach(r.Context(), tx.Bucket([]byte(webhooksBucket)), func(k, v []byte) error {
+			var h Webhook
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			h.Secret = ""
+			hooks = append(hooks, h)
+			return nil
+		})
+	})
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt < hooks[j].CreatedAt })
+	respondJSON(w, http.StatusOK, hooks)
+}
+
+// saveWebhook stores a created or edited webhook. Edits keep the secret
+// unless a new one is given.
+func saveWebhook(w http.ResponseWriter, r *http.Request, h Webhook, status int) {
+	if err := h.validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.UpdatedAt = time.Now().Format(time.RFC3339)
+	err := updateContext(r.Context(), func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(webhooksBucket))
+		if v := b.Get([]byte(h.ID)); v != nil {
+			var old Webhook
+			json.Unmarshal(v, &old)
+			h.CreatedAt = old.CreatedAt
+			if h.Secret == "" {
+				h.Secret = old.Secret
+			}
+		} else if status != http.StatusCreated {
+			return errNotFound
+		}
+		data, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(h.ID), data)
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != http.StatusCreated {
+		h.Secret = ""
+	}
+	respondJSON(w, status, h)
+}
+
+// createWebhook registers a webhook, answering with its secret this once
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var h Webhook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	if h.ID == "" {
+		h.ID = fmt.Sprintf("%d", now.UnixNano())
+	}
+	if h.Secret == "" {
+		secret := make([]byte, 24)
+		if _, err := rand.Read(secret); err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		h.Secret = hex.EncodeToString(secret)
+	}
+	h.CreatedAt = now.Format(time.RFC3339)
+	saveWebhook(w, r, h, http.StatusCreated)
+}
+
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	var h Webhook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.ID = mux.Vars(r)["id"]
+	saveWebhook(w, r, h, http.StatusOK)
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	actionID, err := undoable(r, func(tx *bolt.Tx, j *undoJournal) error {
+		b := tx.Bucket([]byte(webhooksBucket))
+		if b.Get([]byte(id)) == nil {
+			return errNotFound
+		}
+		j.track(webhooksBucket, []byte(id))
+		return b.Delete([]byte(id))
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	respondUndoable(w, http.StatusOK, actionID, map[string]string{"message": "Webhook deleted"})
+}
+
+// getWebhookDeliveries is a webhook's delivery log, newest first. ?status=
+// narrows it; ?limit caps it (default 50).
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status := r.URL.Query().Get("status")
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	deliveries := []WebhookDelivery{}
+	err := viewContext(r.Context(), func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(webhooksBucket)).Get([]byte(id)) == nil {
+			return errNotFound
+		}
+		return forEach(r.Context(), tx.Bucket([]byte(webhookDeliveriesBucket)), func(k, v []byte) error {
+			var d WebhookDelivery
+			if json.Unmarshal(v, &d) == nil && d.WebhookID == id && (status == "" || d.Status == status) {
+				deliveries = append(deliveries, d)
+			}
+			return nil
+		})
+	})
+	if err == errNotFound {
+		respondError(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		respondStoreError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	respondJSON(w, http.StatusOK, deliveries)
+}
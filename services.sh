@@ -99,7 +99,8 @@ start_api() {
     fi
 
     print_status "Starting API server..."
-    PORT=$API_PORT nohup ./"$API_BINARY" > "$API_LOG" 2>&1 &
+    # The bundled frontend does not sign in yet
+    AUTH_REQUIRED=false PORT=$API_PORT nohup ./"$API_BINARY" > "$API_LOG" 2>&1 &
     
     # Wait for startup
     sleep 2